@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// addedApp is the apps.yaml entry written by add, in the order the fields should appear
+type addedApp struct {
+	Git          string `yaml:"git"`
+	Source       string `yaml:"source,omitempty"`
+	Package      string `yaml:"package"`
+	Signer       string `yaml:"signer,omitempty"`
+	Channel      string `yaml:"channel,omitempty"`
+	AssetFilter  string `yaml:"asset_filter,omitempty"`
+	MetadataPath string `yaml:"metadata_path,omitempty"`
+}
+
+// add onboards a new app: it downloads the APK of the latest release to find its package name and signer,
+// appends an entry for it to apps.yaml and then runs an update of just that app, which scoops its metadata
+// and adds the first version to the repo.
+func add(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	var (
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file the app is added to")
+		name         = flags.String("name", "", "Name of the apps.yaml entry, defaults to the name of the repository")
+		source       = flags.String("source", "", "Type of host releases are fetched from: \"github\", \"gitlab\" or \"gitea\". Detected from the URL if empty")
+		channel      = flags.String("channel", "", "Release channel of the app, see \"channel\" in apps.yaml")
+		assetFilter  = flags.String("asset-filter", "", "Regular expression the names of the app's release assets match, see \"asset_filter\" in apps.yaml. Needed to add another app of a monorepo that's already in apps.yaml")
+		metadataPath = flags.String("metadata-path", "", "Directory of the app's fastlane metadata in the repo, e.g. \"fastlane/app2/metadata/android\" for monorepos, see \"metadata_path\" in apps.yaml")
+		accessToken  = flags.String("pat", "", "GitHub personal access token, also passed to the update")
+		githubAuth   = addGitHubAuthFlags(flags)
+		httpConfig   = addHTTPFlags(flags)
+		gitLabToken  = flags.String("gitlab-token", "", "GitLab access token")
+		giteaToken   = flags.String("gitea-token", "", "Gitea access token")
+		noUpdate     = flags.Bool("no-update", false, "Only add the entry to apps.yaml, without updating the repo")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s add [flags] <repository URL> [-- update flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "The URL can omit the scheme, e.g. github.com/org/app.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	err = httpConfig.setup()
+	if err != nil {
+		fatal("Setting up HTTP clients failed", "error", err)
+	}
+
+	repoURL := flags.Arg(0)
+	if !strings.Contains(repoURL, "://") {
+		repoURL = "https://" + repoURL
+	}
+	repoURL = strings.TrimSuffix(strings.TrimSuffix(repoURL, "/"), ".git")
+
+	repo, err := apps.RepoInfo(repoURL)
+	if err != nil || repo.Name == "" {
+		fatal("Invalid repository URL, it must contain both owner and name", "url", repoURL, "error", err)
+	}
+	if *name == "" {
+		*name = repo.Name
+	}
+
+	var filter *regexp.Regexp
+	if *assetFilter != "" {
+		filter, err = regexp.Compile(*assetFilter)
+		if err != nil {
+			fatal("Invalid asset filter", "asset_filter", *assetFilter, "error", err)
+		}
+	}
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+	for _, app := range appsList {
+		if app.Name() == *name {
+			fatal("apps.yaml already has an entry with this name, choose another one with -name", "name", *name)
+		}
+		// Monorepos publish several apps, which are told apart by their assets
+		if sameRepo(app.GitURL, repoURL) && (filter == nil || app.AssetFilter == *assetFilter) {
+			fatal("apps.yaml already has an entry for this repository, set -asset-filter to add another app published from it", "name", app.Name(), "git", app.GitURL)
+		}
+	}
+
+	// Not a workspace, as it would become the temporary directory of the update as well
+	tmpDir, err := os.MkdirTemp("", "metascoop-add-*")
+	if err != nil {
+		fatal("Creating temporary directory failed", "error", err)
+	}
+
+	githubTokens, err := githubAuth.tokenSource(*accessToken, "")
+	if err != nil {
+		fatal("Setting up GitHub authentication failed", "error", err)
+	}
+
+	entry, err := discoverApp(context.Background(), tmpDir, repoURL, *source, *channel, filter, sources.Options{
+		GitHub:      github.NewClient(githubClient(githubTokens)),
+		GitLabToken: *gitLabToken,
+		GiteaToken:  *giteaToken,
+	})
+	_ = os.RemoveAll(tmpDir)
+	if err != nil {
+		fatal("Discovering app failed", "git", repoURL, "error", err)
+	}
+
+	// The repository may have been renamed since the other app was added, or the package is published from another
+	// one already
+	for _, app := range appsList {
+		if entry.Git != repoURL && sameRepo(app.GitURL, entry.Git) && (filter == nil || app.AssetFilter == *assetFilter) {
+			fatal("apps.yaml already has an entry for this repository, which moved", "name", app.Name(), "git", app.GitURL, "moved_to", entry.Git)
+		}
+		if app.PackageName != "" && app.PackageName == entry.Package {
+			fatal("apps.yaml already has an entry for this package", "name", app.Name(), "git", app.GitURL, "package", entry.Package)
+		}
+	}
+
+	entry.MetadataPath = strings.Trim(*metadataPath, "/")
+
+	err = appendApp(*appsFilePath, *name, entry)
+	if err != nil {
+		fatal("Adding app to apps.yaml failed", "path", *appsFilePath, "error", err)
+	}
+
+	slog.Info("Added app to apps.yaml", "name", *name, "package", entry.Package, "signer", entry.Signer, "path", *appsFilePath)
+
+	if *noUpdate {
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatal("Finding metascoop executable failed", "error", err)
+	}
+
+	updateArgs := []string{"-ap=" + *appsFilePath, "-app=" + *name}
+	if *accessToken != "" {
+		updateArgs = append(updateArgs, "-pat="+*accessToken)
+	}
+	updateArgs = append(updateArgs, githubAuth.args()...)
+	rest := flags.Args()[1:]
+	if len(rest) > 0 && rest[0] == "--" {
+		rest = rest[1:]
+	}
+	updateArgs = append(updateArgs, rest...)
+
+	slog.Info("Updating the repo with the new app", "name", *name)
+
+	cmd := exec.Command(exe, updateArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		fatal("Running the update failed", "error", err)
+	}
+}
+
+// githubClient returns an HTTP client that authenticates with the tokens, if there are any
+func githubClient(tokens oauth2.TokenSource) *http.Client {
+	if tokens == nil {
+		return &http.Client{}
+	}
+	return oauth2.NewClient(context.Background(), tokens)
+}
+
+// sameRepo reports whether two git URLs point to the same repository
+func sameRepo(a, b string) bool {
+	normalize := func(u string) string {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git"))
+	}
+	return normalize(a) == normalize(b)
+}
+
+// discoverApp downloads the APK of the newest release of the repository and returns the apps.yaml entry for it.
+// If filter is set, only assets whose names match it are considered.
+func discoverApp(ctx context.Context, tmpDir string, repoURL, kind, channel string, filter *regexp.Regexp, opts sources.Options) (entry addedApp, err error) {
+	src, err := sources.New(kind, repoURL, opts)
+	if err != nil {
+		return
+	}
+
+	// Renamed repositories are added with their new URL
+	details, err := src.Details(ctx)
+	if err != nil {
+		return entry, fmt.Errorf("looking up repository: %w", err)
+	}
+	if details.MovedTo != "" {
+		slog.Info("Repository was moved, adding it with its new URL", "git", repoURL, "moved_to", details.MovedTo)
+		repoURL = details.MovedTo
+	}
+
+	releases, err := src.ListReleases(ctx)
+	if err != nil {
+		return entry, fmt.Errorf("listing releases: %w", err)
+	}
+
+	prereleases := apps.AppInfo{Channel: channel}.IncludesPrereleases()
+
+	var (
+		release sources.Release
+		assets  []sources.Asset
+	)
+	for _, r := range releases {
+		if r.Draft || (r.Prerelease && !prereleases) {
+			continue
+		}
+		// Without filters, all ".apk" assets are candidates
+		var candidates []sources.Asset
+		for _, a := range (apps.AppInfo{}).FindAPKAssets(r) {
+			if filter == nil || filter.MatchString(a.Name) {
+				candidates = append(candidates, a)
+			}
+		}
+		if assets, _ = apps.SelectABISplits(candidates); len(assets) > 0 {
+			release = r
+			break
+		}
+	}
+	if len(assets) == 0 {
+		return entry, fmt.Errorf("none of the %d releases has an APK asset", len(releases))
+	}
+
+	asset := assets[0]
+	slog.Info("Downloading APK of the latest release", "release", release.TagName, "asset", asset.Name)
+
+	path := filepath.Join(tmpDir, "app.apk")
+
+	rc, _, err := src.DownloadAsset(ctx, asset, 0)
+	if err != nil {
+		return
+	}
+	_, err = download.ToFile(path, rc)
+	if err != nil {
+		return entry, fmt.Errorf("downloading %q: %w", asset.Name, err)
+	}
+
+	m, err := apk.ReadManifest(path)
+	if err != nil {
+		return entry, fmt.Errorf("reading APK manifest: %w", err)
+	}
+
+	entry = addedApp{
+		Git:     repoURL,
+		Source:  kind,
+		Package: m.Package,
+		Channel: channel,
+	}
+	if filter != nil {
+		entry.AssetFilter = filter.String()
+	}
+
+	signers, err := apk.Verify(path)
+
+	// v2 and v3 signatures usually use the same certificate
+	fingerprints := make(map[string]bool)
+	for _, s := range signers {
+		fingerprints[s.CertSHA256] = true
+	}
+
+	switch {
+	case errors.Is(err, apk.ErrNoSignature):
+		slog.Warn("APK has no v2/v3 signature, so the signer can't be pinned", "asset", asset.Name)
+		err = nil
+	case err != nil:
+		return entry, fmt.Errorf("verifying APK signature: %w", err)
+	case len(fingerprints) > 1:
+		// Pinning one of them would reject updates signed by the others
+		slog.Warn("APK has several signers, so the signer isn't pinned", "asset", asset.Name, "signers", len(fingerprints))
+	default:
+		entry.Signer = signers[0].CertSHA256
+	}
+
+	return
+}
+
+// appendApp adds an entry to the end of the apps file, leaving the existing entries as they are. The file is
+// parsed again afterwards and restored if the result is invalid.
+func appendApp(appsFilePath, name string, entry interface{}) (err error) {
+	old, err := os.ReadFile(appsFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	// Like the entries in our apps.yaml
+	enc.SetIndent(2)
+	err = enc.Encode(map[string]interface{}{name: entry})
+	if err != nil {
+		return
+	}
+
+	content := string(old)
+	if content != "" {
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += "\n"
+	}
+	content += buf.String()
+
+	err = os.WriteFile(appsFilePath, []byte(content), 0o644)
+	if err != nil {
+		return
+	}
+
+	if _, perr := apps.ParseAppFile(appsFilePath); perr != nil {
+		if old == nil {
+			_ = os.Remove(appsFilePath)
+		} else {
+			_ = os.WriteFile(appsFilePath, old, 0o644)
+		}
+		return fmt.Errorf("the new entry makes apps.yaml invalid: %w", perr)
+	}
+
+	return
+}
@@ -0,0 +1,261 @@
+package apk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// This file implements a parser for Android's binary XML format ("AXML"), which is used for
+// AndroidManifest.xml and other XML resources inside APKs.
+
+const (
+	chunkStringPool   = 0x0001
+	chunkXML          = 0x0003
+	chunkXMLStartElem = 0x0102
+	chunkXMLEndElem   = 0x0103
+	chunkXMLResMap    = 0x0180
+
+	stringPoolUTF8 = 1 << 8
+
+	noIndex = 0xffffffff
+)
+
+// Value types of typed attribute values
+const (
+	TypeReference = 0x01
+	TypeString    = 0x03
+	TypeIntDec    = 0x10
+	TypeIntHex    = 0x11
+	TypeBoolean   = 0x12
+)
+
+type xmlAttr struct {
+	// Name is the attribute name without namespace prefix
+	Name string
+
+	// ResID is the resource id of the attribute, e.g. 0x0101021b for android:versionCode.
+	// It's zero for attributes without resource id, like "package" on the manifest element.
+	ResID uint32
+
+	Type uint8
+	Data uint32
+
+	// String is set for string values
+	String string
+}
+
+type xmlElement struct {
+	Name  string
+	Depth int
+	Attrs []xmlAttr
+}
+
+func (e xmlElement) attr(resID uint32, name string) (a xmlAttr, ok bool) {
+	for _, a := range e.Attrs {
+		if (resID != 0 && a.ResID == resID) || (a.ResID == 0 && a.Name == name) {
+			return a, true
+		}
+	}
+	return
+}
+
+// parseStringPool decodes a string pool chunk
+func parseStringPool(chunk []byte) (strings []string, err error) {
+	if len(chunk) < 28 {
+		return nil, errors.New("truncated string pool")
+	}
+
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	count := int(binary.LittleEndian.Uint32(chunk[8:]))
+	flags := binary.LittleEndian.Uint32(chunk[16:])
+	stringsStart := int(binary.LittleEndian.Uint32(chunk[20:]))
+
+	if headerSize+count*4 > len(chunk) || stringsStart > len(chunk) {
+		return nil, errors.New("string pool exceeds chunk")
+	}
+
+	strings = make([]string, count)
+	for i := 0; i < count; i++ {
+		offset := stringsStart + int(binary.LittleEndian.Uint32(chunk[headerSize+i*4:]))
+		if offset >= len(chunk) {
+			return nil, fmt.Errorf("string %d is out of bounds", i)
+		}
+
+		if flags&stringPoolUTF8 != 0 {
+			strings[i], err = decodeUTF8String(chunk[offset:])
+		} else {
+			strings[i], err = decodeUTF16String(chunk[offset:])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("string %d: %w", i, err)
+		}
+	}
+
+	return
+}
+
+func decodeUTF8String(b []byte) (string, error) {
+	// First the length in UTF-16 code units, then in bytes. Both use one or two bytes.
+	skip := func(b []byte) (n int, rest []byte, err error) {
+		if len(b) < 1 {
+			return 0, nil, errors.New("truncated string")
+		}
+		if b[0]&0x80 == 0 {
+			return int(b[0]), b[1:], nil
+		}
+		if len(b) < 2 {
+			return 0, nil, errors.New("truncated string")
+		}
+		return int(b[0]&0x7f)<<8 | int(b[1]), b[2:], nil
+	}
+
+	_, b, err := skip(b)
+	if err != nil {
+		return "", err
+	}
+	n, b, err := skip(b)
+	if err != nil {
+		return "", err
+	}
+	if n > len(b) {
+		return "", errors.New("truncated string")
+	}
+
+	return string(b[:n]), nil
+}
+
+func decodeUTF16String(b []byte) (string, error) {
+	if len(b) < 2 {
+		return "", errors.New("truncated string")
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	if n&0x8000 != 0 {
+		if len(b) < 2 {
+			return "", errors.New("truncated string")
+		}
+		n = (n&0x7fff)<<16 | int(binary.LittleEndian.Uint16(b))
+		b = b[2:]
+	}
+	if n*2 > len(b) {
+		return "", errors.New("truncated string")
+	}
+
+	units := make([]uint16, n)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[i*2:])
+	}
+
+	return string(utf16.Decode(units)), nil
+}
+
+// parseAXML returns all start elements of a binary XML document in document order
+func parseAXML(data []byte) (elements []xmlElement, err error) {
+	if len(data) < 8 || binary.LittleEndian.Uint16(data) != chunkXML {
+		return nil, errors.New("not a binary XML document")
+	}
+
+	var (
+		pool   []string
+		resMap []uint32
+		depth  int
+
+		// badIndex is the first string index that isn't in the pool
+		badIndex error
+	)
+
+	str := func(i uint32) string {
+		if i == noIndex {
+			return ""
+		}
+		if int(i) >= len(pool) {
+			if badIndex == nil {
+				badIndex = fmt.Errorf("string index %d is out of range, the pool has %d strings", i, len(pool))
+			}
+			return ""
+		}
+		return pool[i]
+	}
+
+	pos := int(binary.LittleEndian.Uint16(data[2:]))
+	if pos < 8 || pos > len(data) {
+		return nil, fmt.Errorf("invalid document header size %d", pos)
+	}
+	for pos+8 <= len(data) {
+		typ := binary.LittleEndian.Uint16(data[pos:])
+		headerSize := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 8 || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid chunk size %d at offset %d", size, pos)
+		}
+		if headerSize < 8 || headerSize > size {
+			return nil, fmt.Errorf("invalid chunk header size %d at offset %d", headerSize, pos)
+		}
+		chunk := data[pos : pos+size]
+
+		switch typ {
+		case chunkStringPool:
+			pool, err = parseStringPool(chunk)
+			if err != nil {
+				return
+			}
+		case chunkXMLResMap:
+			for i := headerSize; i+4 <= len(chunk); i += 4 {
+				resMap = append(resMap, binary.LittleEndian.Uint32(chunk[i:]))
+			}
+		case chunkXMLStartElem:
+			if headerSize+20 > len(chunk) {
+				return nil, errors.New("truncated start element")
+			}
+			ext := chunk[headerSize:]
+
+			e := xmlElement{
+				Name:  str(binary.LittleEndian.Uint32(ext[4:])),
+				Depth: depth,
+			}
+
+			attrStart := int(binary.LittleEndian.Uint16(ext[8:]))
+			attrSize := int(binary.LittleEndian.Uint16(ext[10:]))
+			attrCount := int(binary.LittleEndian.Uint16(ext[12:]))
+
+			for i := 0; i < attrCount; i++ {
+				off := attrStart + i*attrSize
+				if off+20 > len(ext) {
+					return nil, errors.New("truncated attribute")
+				}
+				a := ext[off:]
+
+				nameIdx := binary.LittleEndian.Uint32(a[4:])
+				attr := xmlAttr{
+					Name: str(nameIdx),
+					Type: a[15],
+					Data: binary.LittleEndian.Uint32(a[16:]),
+				}
+				if int(nameIdx) < len(resMap) {
+					attr.ResID = resMap[nameIdx]
+				}
+				if attr.Type == TypeString {
+					attr.String = str(attr.Data)
+				} else if raw := binary.LittleEndian.Uint32(a[8:]); raw != noIndex {
+					attr.String = str(raw)
+				}
+
+				e.Attrs = append(e.Attrs, attr)
+			}
+			if badIndex != nil {
+				return nil, badIndex
+			}
+
+			elements = append(elements, e)
+			depth++
+		case chunkXMLEndElem:
+			depth--
+		}
+
+		pos += size
+	}
+
+	return
+}
@@ -0,0 +1,270 @@
+package apk
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// axmlBuilder encodes binary XML documents for the tests
+type axmlBuilder struct {
+	utf8     bool
+	pool     []string
+	elements []byte
+}
+
+// testAttr is an attribute of an element of axmlBuilder. String values are added to the pool, other values are
+// stored in data.
+type testAttr struct {
+	name  string
+	typ   uint8
+	data  uint32
+	value string
+}
+
+// resourceAttrs are the attribute names with resource ids, which come first in the pool so the resource map covers
+// them by index
+var resourceAttrs = []struct {
+	name string
+	id   uint32
+}{
+	{"name", attrName},
+	{"icon", attrIcon},
+	{"minSdkVersion", attrMinSdkVersion},
+	{"versionCode", attrVersionCode},
+	{"versionName", attrVersionName},
+	{"targetSdkVersion", attrTargetSdkVersion},
+}
+
+func newAXMLBuilder(utf8 bool) *axmlBuilder {
+	b := &axmlBuilder{utf8: utf8}
+	for _, a := range resourceAttrs {
+		b.pool = append(b.pool, a.name)
+	}
+	return b
+}
+
+func (b *axmlBuilder) index(s string) uint32 {
+	for i, p := range b.pool {
+		if p == s {
+			return uint32(i)
+		}
+	}
+	b.pool = append(b.pool, s)
+	return uint32(len(b.pool) - 1)
+}
+
+func (b *axmlBuilder) start(name string, attrs ...testAttr) {
+	var a []byte
+	for _, at := range attrs {
+		raw, data := uint32(noIndex), at.data
+		if at.typ == TypeString && at.value != "" {
+			raw = b.index(at.value)
+			data = raw
+		}
+		a = appendLE(a, uint32(noIndex), b.index(at.name), raw, uint16(8), uint16(at.typ)<<8, data)
+	}
+	ext := appendLE(nil, uint32(noIndex), b.index(name), uint16(20), uint16(20), uint16(len(attrs)), uint16(0), uint16(0), uint16(0))
+	b.elements = append(b.elements, testChunk(chunkXMLStartElem, appendLE(nil, uint32(1), uint32(noIndex)), append(ext, a...))...)
+}
+
+func (b *axmlBuilder) end(name string) {
+	ext := appendLE(nil, uint32(noIndex), b.index(name))
+	b.elements = append(b.elements, testChunk(chunkXMLEndElem, appendLE(nil, uint32(1), uint32(noIndex)), ext)...)
+}
+
+func (b *axmlBuilder) bytes() []byte {
+	var resMap []byte
+	for _, a := range resourceAttrs {
+		resMap = appendLE(resMap, a.id)
+	}
+
+	body := append(b.stringPool(), testChunk(chunkXMLResMap, nil, resMap)...)
+	return testChunk(chunkXML, nil, append(body, b.elements...))
+}
+
+func (b *axmlBuilder) stringPool() []byte {
+	var offsets, data []byte
+	for _, s := range b.pool {
+		offsets = appendLE(offsets, uint32(len(data)))
+		if b.utf8 {
+			data = appendUTF8Length(data, len(utf16.Encode([]rune(s))))
+			data = appendUTF8Length(data, len(s))
+			data = append(append(data, s...), 0)
+			continue
+		}
+
+		units := utf16.Encode([]rune(s))
+		data = appendLE(data, uint16(len(units)))
+		for _, u := range units {
+			data = appendLE(data, u)
+		}
+		data = appendLE(data, uint16(0))
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	var flags uint32
+	if b.utf8 {
+		flags = stringPoolUTF8
+	}
+	header := appendLE(nil, uint32(len(b.pool)), uint32(0), flags, uint32(28+len(offsets)), uint32(0))
+	return testChunk(chunkStringPool, header, append(offsets, data...))
+}
+
+// appendUTF8Length appends a length of a UTF-8 pool string, which takes two bytes if it's longer than 127
+func appendUTF8Length(b []byte, n int) []byte {
+	if n > 0x7f {
+		return append(b, byte(n>>8)|0x80, byte(n))
+	}
+	return append(b, byte(n))
+}
+
+func testChunk(typ uint16, header, body []byte) []byte {
+	headerSize := 8 + len(header)
+	c := appendLE(nil, typ, uint16(headerSize), uint32(headerSize+len(body)))
+	return append(append(c, header...), body...)
+}
+
+// appendLE appends the uint16 and uint32 values in little endian
+func appendLE(b []byte, values ...interface{}) []byte {
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, v)
+		}
+	}
+	return b
+}
+
+func str(name, value string) testAttr {
+	return testAttr{name: name, typ: TypeString, value: value}
+}
+
+func num(name string, value uint32) testAttr {
+	return testAttr{name: name, typ: TypeIntDec, data: value}
+}
+
+func TestParseAXMLErrors(t *testing.T) {
+	valid := testManifest(false, clockAttrs, clockChildren)
+	// The string pool is the first chunk after the 8 byte document header
+	const pool = 8
+
+	changed := func(change func(data []byte)) []byte {
+		data := append([]byte(nil), valid...)
+		change(data)
+		return data
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			name: "not binary XML",
+			data: []byte("<manifest package=\"com.example.clock\"/>"),
+			want: "not a binary XML document",
+		},
+		{
+			name: "truncated document",
+			data: valid[:len(valid)-6],
+			want: "invalid chunk size",
+		},
+		{
+			name: "chunk larger than the document",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint32(data[pool+4:], 0x7fffffff) }),
+			want: "invalid chunk size",
+		},
+		{
+			name: "chunk smaller than a chunk header",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint32(data[pool+4:], 4) }),
+			want: "invalid chunk size",
+		},
+		{
+			name: "chunk header larger than the chunk",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint16(data[pool+2:], 0xffff) }),
+			want: "invalid chunk header size",
+		},
+		{
+			name: "chunk header smaller than a chunk header",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint16(data[pool+2:], 2) }),
+			want: "invalid chunk header size",
+		},
+		{
+			name: "document header larger than the document",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint16(data[2:], 0xffff) }),
+			want: "invalid document header size",
+		},
+		{
+			name: "truncated string pool",
+			data: testChunk(chunkXML, nil, testChunk(chunkStringPool, nil, make([]byte, 12))),
+			want: "truncated string pool",
+		},
+		{
+			name: "more strings than the pool has room for",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint32(data[pool+8:], 0xffffff) }),
+			want: "string pool exceeds chunk",
+		},
+		{
+			name: "string offset out of bounds",
+			data: changed(func(data []byte) { binary.LittleEndian.PutUint32(data[pool+28:], 0xffffff) }),
+			want: "string 0 is out of bounds",
+		},
+		{
+			name: "string longer than the pool",
+			data: changed(func(data []byte) {
+				start := pool + int(binary.LittleEndian.Uint32(data[pool+20:]))
+				binary.LittleEndian.PutUint16(data[start:], 0x7fff)
+			}),
+			want: "string 0: truncated string",
+		},
+		{
+			name: "string index out of range",
+			data: testManifest(false, []testAttr{{name: "package", typ: TypeString, data: 1000}}, nil),
+			want: "string index 1000 is out of range",
+		},
+		{
+			name: "truncated start element",
+			data: testChunk(chunkXML, nil, testChunk(chunkXMLStartElem, appendLE(nil, uint32(1), uint32(noIndex)), make([]byte, 12))),
+			want: "truncated start element",
+		},
+		{
+			name: "truncated attribute",
+			data: testChunk(chunkXML, nil, testChunk(chunkXMLStartElem, appendLE(nil, uint32(1), uint32(noIndex)),
+				appendLE(nil, uint32(noIndex), uint32(noIndex), uint16(20), uint16(20), uint16(3), uint16(0), uint16(0), uint16(0)))),
+			want: "truncated attribute",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAXML(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseAXMLCorrupted checks that truncated and corrupted documents are rejected without panicking
+func TestParseAXMLCorrupted(t *testing.T) {
+	for _, utf8 := range []bool{false, true} {
+		valid := testManifest(utf8, clockAttrs, clockChildren)
+
+		for n := 0; n < len(valid); n++ {
+			_, _ = parseAXML(valid[:n])
+		}
+		for i := range valid {
+			for _, b := range []byte{0x00, 0x7f, 0x80, 0xff} {
+				data := append([]byte(nil), valid...)
+				data[i] = b
+				_, _ = parseAXML(data)
+			}
+		}
+	}
+}
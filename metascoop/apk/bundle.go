@@ -0,0 +1,51 @@
+package apk
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrNoUniversalAPK is returned for APK sets that only contain split APKs
+var ErrNoUniversalAPK = errors.New("the APK set contains no universal APK, it was not built with --mode=universal")
+
+// ExtractUniversal writes the universal APK of the APK set (.apks) at path to dest. APK sets contain it if
+// bundletool built them with --mode=universal.
+func ExtractUniversal(path, dest string) (err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		if f.Name != "universal.apk" {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, rc)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = os.Remove(dest)
+			return fmt.Errorf("extracting universal APK: %w", err)
+		}
+		return nil
+	}
+
+	return ErrNoUniversalAPK
+}
@@ -0,0 +1,93 @@
+package apk
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// signatureFile reports whether the zip entry at name belongs to the v1 (JAR) signature, which differs between
+// an upstream APK and one rebuilt from the same source without the upstream key
+func signatureFile(name string) bool {
+	if !strings.HasPrefix(name, "META-INF/") || strings.Count(name, "/") != 1 {
+		return false
+	}
+
+	switch path.Ext(name) {
+	case ".SF", ".RSA", ".DSA", ".EC":
+		return true
+	}
+	return name == "META-INF/MANIFEST.MF"
+}
+
+// CompareContents compares the files in the APKs at a and b, ignoring their signatures. The APK
+// Signing Block is outside of the zip entries, so it's ignored as well. It returns the names of the
+// files that are missing in one of the APKs or differ, so an empty result means both were built
+// from the same source.
+func CompareContents(a, b string) (differences []string, err error) {
+	sumsA, err := entryDigests(a)
+	if err != nil {
+		return
+	}
+	sumsB, err := entryDigests(b)
+	if err != nil {
+		return
+	}
+
+	for name, sum := range sumsA {
+		other, ok := sumsB[name]
+		switch {
+		case !ok:
+			differences = append(differences, name+" (only in "+filepath.Base(a)+")")
+		case other != sum:
+			differences = append(differences, name)
+		}
+	}
+	for name := range sumsB {
+		if _, ok := sumsA[name]; !ok {
+			differences = append(differences, name+" (only in "+filepath.Base(b)+")")
+		}
+	}
+
+	sort.Strings(differences)
+	return
+}
+
+// entryDigests returns the SHA-256 of the uncompressed content of all files in the APK at apkPath, except the signature
+func entryDigests(apkPath string) (sums map[string][sha256.Size]byte, err error) {
+	z, err := zip.OpenReader(apkPath)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	sums = make(map[string][sha256.Size]byte, len(z.File))
+	for _, f := range z.File {
+		if signatureFile(f.Name) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("opening %s in %s: %w", f.Name, apkPath, err)
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s in %s: %w", f.Name, apkPath, err)
+		}
+
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		sums[f.Name] = sum
+	}
+
+	return
+}
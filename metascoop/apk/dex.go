@@ -0,0 +1,131 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// dexFile matches the DEX files of an APK, multidex apps have classes2.dex and so on
+var dexFile = regexp.MustCompile(`^classes\d*\.dex$`)
+
+// ClassNames returns the sorted names of all classes the DEX files of the APK at path define or reference,
+// in dotted form like "com.example.Foo"
+func ClassNames(path string) (names []string, err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	seen := make(map[string]bool)
+	for _, f := range z.File {
+		if !dexFile.MatchString(f.Name) {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+
+		types, err := dexTypes(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", f.Name, err)
+		}
+
+		for _, t := range types {
+			// Class descriptors look like "Lcom/example/Foo;", primitives and arrays aren't classes
+			if !strings.HasPrefix(t, "L") || !strings.HasSuffix(t, ";") {
+				continue
+			}
+			name := strings.ReplaceAll(t[1:len(t)-1], "/", ".")
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return
+}
+
+// dexTypes returns the descriptors of the type_ids section of a DEX file,
+// see https://source.android.com/docs/core/runtime/dex-format
+func dexTypes(data []byte) (types []string, err error) {
+	if len(data) < 0x70 || !bytes.HasPrefix(data, []byte("dex\n")) {
+		return nil, fmt.Errorf("not a DEX file")
+	}
+
+	u32 := func(off uint32) (uint32, error) {
+		if uint64(off)+4 > uint64(len(data)) {
+			return 0, fmt.Errorf("offset 0x%x is out of bounds", off)
+		}
+		return binary.LittleEndian.Uint32(data[off:]), nil
+	}
+
+	stringIDsSize, _ := u32(0x38)
+	stringIDsOff, _ := u32(0x3c)
+	typeIDsSize, _ := u32(0x40)
+	typeIDsOff, _ := u32(0x44)
+
+	for i := uint32(0); i < typeIDsSize; i++ {
+		stringIdx, err := u32(typeIDsOff + 4*i)
+		if err != nil {
+			return nil, err
+		}
+		if stringIdx >= stringIDsSize {
+			return nil, fmt.Errorf("type %d references string %d, but there are only %d", i, stringIdx, stringIDsSize)
+		}
+
+		dataOff, err := u32(stringIDsOff + 4*stringIdx)
+		if err != nil {
+			return nil, err
+		}
+
+		s, err := dexString(data, dataOff)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, s)
+	}
+
+	return
+}
+
+// dexString reads the string_data_item at off: the ULEB128 length in UTF-16 code units, followed by the
+// null-terminated MUTF-8 data. Descriptors are ASCII in practice, so the bytes are used as they are.
+func dexString(data []byte, off uint32) (s string, err error) {
+	if uint64(off) >= uint64(len(data)) {
+		return "", fmt.Errorf("string offset 0x%x is out of bounds", off)
+	}
+
+	rest := data[off:]
+	for i := 0; ; i++ {
+		if i >= len(rest) || i >= 5 {
+			return "", fmt.Errorf("invalid string length at 0x%x", off)
+		}
+		if rest[i]&0x80 == 0 {
+			rest = rest[i+1:]
+			break
+		}
+	}
+
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 {
+		return "", fmt.Errorf("unterminated string at 0x%x", off)
+	}
+
+	return string(rest[:end]), nil
+}
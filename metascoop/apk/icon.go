@@ -0,0 +1,252 @@
+package apk
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/images"
+)
+
+// Resource ids of the android: attributes of drawable XML files
+const (
+	attrDrawable = 0x01010199
+	attrSrc      = 0x01010119
+)
+
+// maxReferenceDepth is how many references are followed when resolving a drawable
+const maxReferenceDepth = 8
+
+// adaptiveIconSize is the size in pixels of rendered adaptive icons with only color layers, 108dp at xxxhdpi
+const adaptiveIconSize = 432
+
+// ErrNoIcon is returned for APKs without launcher icon
+var ErrNoIcon = errors.New("APK has no launcher icon")
+
+// ExtractIcon returns the launcher icon of the APK at path. Bitmap icons are returned in their highest density.
+// Adaptive icons are only used if there is no bitmap; they are rendered with a circular mask, like most launchers
+// show them. Icons that only exist as vector drawables or WebP images can't be extracted.
+func ExtractIcon(path string) (icon image.Image, err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	data, err := readZipFile(&z.Reader, "AndroidManifest.xml")
+	if err != nil {
+		return
+	}
+	m, err := ParseManifest(data)
+	if err != nil {
+		return
+	}
+	if m.Icon == 0 {
+		return nil, ErrNoIcon
+	}
+
+	data, err = readZipFile(&z.Reader, "resources.arsc")
+	if err != nil {
+		return
+	}
+	res, err := ParseResources(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading resources: %w", err)
+	}
+
+	d := drawableResolver{z: &z.Reader, res: res}
+	return d.drawable(m.Icon, 0)
+}
+
+// drawableResolver turns drawable resources of an APK into images
+type drawableResolver struct {
+	z   *zip.Reader
+	res Resources
+}
+
+// densityRank orders resource values by density, highest first. Density independent values (like adaptive icons)
+// come last, so bitmaps are preferred.
+func densityRank(v ResourceValue) int {
+	if v.Density == DensityAny || v.Density == DensityNone {
+		return -1
+	}
+	return int(v.Density)
+}
+
+// drawable returns the image of the drawable resource id, trying its configurations by density
+func (d *drawableResolver) drawable(id uint32, depth int) (img image.Image, err error) {
+	if depth > maxReferenceDepth {
+		return nil, fmt.Errorf("resource 0x%08x: too many references", id)
+	}
+
+	values := append([]ResourceValue(nil), d.res[id]...)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("resource 0x%08x not found", id)
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return densityRank(values[i]) > densityRank(values[j])
+	})
+
+	var errs []error
+	for _, v := range values {
+		img, err = d.value(v, depth)
+		if err == nil {
+			return
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (d *drawableResolver) value(v ResourceValue, depth int) (img image.Image, err error) {
+	switch v.Type {
+	case TypeReference:
+		return d.drawable(v.Data, depth+1)
+	case TypeString:
+		return d.file(v.String, depth)
+	case TypeColorARGB8, TypeColorARGB4:
+		return image.NewUniform(argb(v.Data)), nil
+	case TypeColorRGB8, TypeColorRGB4:
+		return image.NewUniform(argb(v.Data | 0xff000000)), nil
+	}
+	return nil, fmt.Errorf("drawable value has unsupported type 0x%02x", v.Type)
+}
+
+func argb(c uint32) color.Color {
+	return color.NRGBA{R: uint8(c >> 16), G: uint8(c >> 8), B: uint8(c), A: uint8(c >> 24)}
+}
+
+// file decodes the drawable file at name in the APK
+func (d *drawableResolver) file(name string, depth int) (img image.Image, err error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".png", ".jpg", ".jpeg":
+	case ".xml":
+		return d.xmlDrawable(name, depth)
+	default:
+		return nil, fmt.Errorf("%s: unsupported image format", name)
+	}
+
+	data, err := readZipFile(d.z, name)
+	if err != nil {
+		return
+	}
+
+	img, _, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return
+}
+
+// xmlDrawable renders adaptive icons and bitmap drawables. Other drawables, most notably vectors, are not supported.
+func (d *drawableResolver) xmlDrawable(name string, depth int) (img image.Image, err error) {
+	data, err := readZipFile(d.z, name)
+	if err != nil {
+		return
+	}
+	elements, err := parseAXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", name, err)
+	}
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("%s is empty", name)
+	}
+
+	ref := func(e xmlElement, resID uint32, attrName string) (image.Image, error) {
+		a, ok := e.attr(resID, attrName)
+		if !ok {
+			return nil, fmt.Errorf("%s: <%s> has no android:%s attribute, inline drawables are not supported", name, e.Name, attrName)
+		}
+		return d.value(ResourceValue{Type: a.Type, Data: a.Data, String: a.String}, depth+1)
+	}
+
+	switch root := elements[0]; root.Name {
+	case "bitmap":
+		return ref(root, attrSrc, "src")
+	case "adaptive-icon":
+		var background, foreground image.Image
+		for _, e := range elements[1:] {
+			if e.Depth != 1 {
+				continue
+			}
+			switch e.Name {
+			case "background":
+				background, err = ref(e, attrDrawable, "drawable")
+			case "foreground":
+				foreground, err = ref(e, attrDrawable, "drawable")
+			}
+			if err != nil {
+				return
+			}
+		}
+		if foreground == nil {
+			return nil, fmt.Errorf("%s: adaptive icon has no foreground", name)
+		}
+		return renderAdaptiveIcon(background, foreground), nil
+	default:
+		return nil, fmt.Errorf("%s: <%s> drawables are not supported", name, root.Name)
+	}
+}
+
+// renderAdaptiveIcon composes the layers of an adaptive icon. Layers are 108dp, of which launchers show the inner
+// 72dp, masked to the shape of their icons. background may be nil.
+func renderAdaptiveIcon(background, foreground image.Image) *image.RGBA {
+	layers := []image.Image{foreground}
+	if background != nil {
+		layers = []image.Image{background, foreground}
+	}
+
+	// Colors have no size, bitmaps are drawn at the size of the largest one
+	size := 0
+	for _, l := range layers {
+		if _, ok := l.(*image.Uniform); !ok && l.Bounds().Dx() > size {
+			size = l.Bounds().Dx()
+		}
+	}
+	if size == 0 {
+		size = adaptiveIconSize
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, size, size))
+	for _, l := range layers {
+		if _, ok := l.(*image.Uniform); !ok {
+			l = images.Scale(l, size, size)
+		}
+		draw.Draw(canvas, canvas.Bounds(), l, image.Point{}, draw.Over)
+	}
+
+	inset := size / 6
+	visible := size - 2*inset
+	icon := image.NewRGBA(image.Rect(0, 0, visible, visible))
+	draw.Draw(icon, icon.Bounds(), canvas, image.Pt(inset, inset), draw.Src)
+
+	// Circular mask with an antialiased edge. The pixels are premultiplied, so all channels are scaled by the coverage.
+	r := float64(visible) / 2
+	for y := 0; y < visible; y++ {
+		for x := 0; x < visible; x++ {
+			dist := math.Hypot(float64(x)+0.5-r, float64(y)+0.5-r)
+			coverage := math.Max(0, math.Min(1, r-dist+0.5))
+			if coverage == 1 {
+				continue
+			}
+
+			p := icon.Pix[y*icon.Stride+x*4:]
+			for i := 0; i < 4; i++ {
+				p[i] = uint8(float64(p[i]) * coverage)
+			}
+		}
+	}
+
+	return icon
+}
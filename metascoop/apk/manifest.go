@@ -0,0 +1,150 @@
+package apk
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Resource ids of the android: attributes we read from the manifest
+const (
+	attrName             = 0x01010003
+	attrIcon             = 0x01010002
+	attrMinSdkVersion    = 0x0101020c
+	attrVersionCode      = 0x0101021b
+	attrVersionName      = 0x0101021c
+	attrTargetSdkVersion = 0x01010270
+)
+
+// Manifest contains the parts of AndroidManifest.xml that matter for publishing an APK
+type Manifest struct {
+	Package     string
+	VersionCode int64
+	VersionName string
+
+	MinSdkVersion    int
+	TargetSdkVersion int
+
+	// Permissions contains the names of all uses-permission entries
+	Permissions []string
+
+	// Icon is the resource id of the application icon, or zero if none is set
+	Icon uint32
+}
+
+// ReadManifest parses the manifest of the APK at path
+func ReadManifest(path string) (m Manifest, err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	data, err := readZipFile(&z.Reader, "AndroidManifest.xml")
+	if err != nil {
+		return
+	}
+
+	return ParseManifest(data)
+}
+
+func readZipFile(z *zip.Reader, name string) (data []byte, err error) {
+	for _, f := range z.File {
+		if f.Name != name {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		return io.ReadAll(rc)
+	}
+
+	return nil, fmt.Errorf("APK contains no %s", name)
+}
+
+func attrInt(a xmlAttr) (int64, error) {
+	switch a.Type {
+	case TypeIntDec, TypeIntHex:
+		return int64(int32(a.Data)), nil
+	case TypeString:
+		return strconv.ParseInt(a.String, 10, 64)
+	}
+	return 0, fmt.Errorf("attribute %q has unexpected type 0x%02x", a.Name, a.Type)
+}
+
+// ParseManifest parses a binary AndroidManifest.xml
+func ParseManifest(data []byte) (m Manifest, err error) {
+	elements, err := parseAXML(data)
+	if err != nil {
+		return
+	}
+
+	if len(elements) == 0 || elements[0].Name != "manifest" {
+		return m, errors.New("document is not an Android manifest")
+	}
+
+	root := elements[0]
+
+	if a, ok := root.attr(0, "package"); ok {
+		m.Package = a.String
+	}
+	if m.Package == "" {
+		return m, errors.New("manifest has no package name")
+	}
+
+	if a, ok := root.attr(attrVersionCode, "versionCode"); ok {
+		m.VersionCode, err = attrInt(a)
+		if err != nil {
+			return m, fmt.Errorf("reading versionCode: %w", err)
+		}
+	}
+	if a, ok := root.attr(attrVersionName, "versionName"); ok {
+		// References to string resources are left empty, we don't resolve resources.arsc here
+		m.VersionName = a.String
+	}
+
+	for _, e := range elements[1:] {
+		// Only direct children of <manifest> are relevant, e.g. <uses-permission> inside other elements is ignored
+		switch {
+		case e.Depth == 1 && e.Name == "uses-sdk":
+			if a, ok := e.attr(attrMinSdkVersion, "minSdkVersion"); ok {
+				v, err := attrInt(a)
+				if err != nil {
+					return m, fmt.Errorf("reading minSdkVersion: %w", err)
+				}
+				m.MinSdkVersion = int(v)
+			}
+			if a, ok := e.attr(attrTargetSdkVersion, "targetSdkVersion"); ok {
+				v, err := attrInt(a)
+				if err != nil {
+					return m, fmt.Errorf("reading targetSdkVersion: %w", err)
+				}
+				m.TargetSdkVersion = int(v)
+			}
+		case e.Depth == 1 && (e.Name == "uses-permission" || e.Name == "uses-permission-sdk-23"):
+			if a, ok := e.attr(attrName, "name"); ok && a.String != "" {
+				m.Permissions = append(m.Permissions, a.String)
+			}
+		case e.Depth == 1 && e.Name == "application":
+			if a, ok := e.attr(attrIcon, "icon"); ok && a.Type == TypeReference {
+				m.Icon = a.Data
+			}
+		}
+	}
+
+	// Android defaults the target SDK to the min SDK, and the min SDK to 1
+	if m.MinSdkVersion == 0 {
+		m.MinSdkVersion = 1
+	}
+	if m.TargetSdkVersion == 0 {
+		m.TargetSdkVersion = m.MinSdkVersion
+	}
+
+	return
+}
@@ -0,0 +1,143 @@
+package apk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testManifest builds a manifest with the attrs on the manifest element and children between it and its end
+func testManifest(utf8 bool, attrs []testAttr, children func(b *axmlBuilder)) []byte {
+	b := newAXMLBuilder(utf8)
+	b.start("manifest", attrs...)
+	if children != nil {
+		children(b)
+	}
+	b.end("manifest")
+	return b.bytes()
+}
+
+var clockAttrs = []testAttr{str("package", "com.example.clock"), num("versionCode", 20), str("versionName", "2.0.0")}
+
+func clockChildren(b *axmlBuilder) {
+	b.start("uses-sdk", num("minSdkVersion", 24), num("targetSdkVersion", 34))
+	b.end("uses-sdk")
+	b.start("uses-permission", str("name", "android.permission.INTERNET"))
+	b.end("uses-permission")
+	b.start("application", testAttr{name: "icon", typ: TypeReference, data: 0x7f080001})
+	// Permissions of other elements aren't the app's
+	b.start("uses-permission", str("name", "android.permission.CAMERA"))
+	b.end("uses-permission")
+	b.end("application")
+}
+
+func TestParseManifest(t *testing.T) {
+	longPermission := "com.example.clock.permission." + strings.Repeat("X", 200)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Manifest
+	}{
+		{
+			name: "UTF-16 pool",
+			data: testManifest(false, clockAttrs, clockChildren),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0", MinSdkVersion: 24, TargetSdkVersion: 34,
+				Permissions: []string{"android.permission.INTERNET"}, Icon: 0x7f080001},
+		},
+		{
+			name: "UTF-8 pool",
+			data: testManifest(true, clockAttrs, clockChildren),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0", MinSdkVersion: 24, TargetSdkVersion: 34,
+				Permissions: []string{"android.permission.INTERNET"}, Icon: 0x7f080001},
+		},
+		{
+			name: "UTF-8 pool with long and non-ASCII strings",
+			data: testManifest(true, []testAttr{str("package", "com.example.clock"), num("versionCode", 20), str("versionName", "2.0.0-ünïcödé")}, func(b *axmlBuilder) {
+				b.start("uses-permission", str("name", longPermission))
+				b.end("uses-permission")
+			}),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0-ünïcödé", MinSdkVersion: 1, TargetSdkVersion: 1,
+				Permissions: []string{longPermission}},
+		},
+		{
+			name: "UTF-16 pool with non-BMP strings",
+			data: testManifest(false, []testAttr{str("package", "com.example.clock"), num("versionCode", 20), str("versionName", "2.0.0 ⏰🕰")}, nil),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0 ⏰🕰", MinSdkVersion: 1, TargetSdkVersion: 1},
+		},
+		{
+			name: "versionName is a resource reference",
+			data: testManifest(false, []testAttr{str("package", "com.example.clock"), num("versionCode", 20), {name: "versionName", typ: TypeReference, data: 0x7f0f0001}}, clockChildren),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, MinSdkVersion: 24, TargetSdkVersion: 34,
+				Permissions: []string{"android.permission.INTERNET"}, Icon: 0x7f080001},
+		},
+		{
+			name: "versionCode as string",
+			data: testManifest(false, []testAttr{str("package", "com.example.clock"), str("versionCode", "20")}, nil),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, MinSdkVersion: 1, TargetSdkVersion: 1},
+		},
+		{
+			name: "no uses-sdk",
+			data: testManifest(false, clockAttrs, nil),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0", MinSdkVersion: 1, TargetSdkVersion: 1},
+		},
+		{
+			name: "uses-sdk without targetSdkVersion",
+			data: testManifest(false, clockAttrs, func(b *axmlBuilder) {
+				b.start("uses-sdk", num("minSdkVersion", 21))
+				b.end("uses-sdk")
+			}),
+			want: Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0", MinSdkVersion: 21, TargetSdkVersion: 21},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseManifest(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			name: "no manifest element",
+			data: func() []byte {
+				b := newAXMLBuilder(false)
+				b.start("application")
+				b.end("application")
+				return b.bytes()
+			}(),
+			want: "not an Android manifest",
+		},
+		{
+			name: "no package",
+			data: testManifest(false, []testAttr{num("versionCode", 20)}, nil),
+			want: "no package name",
+		},
+		{
+			name: "versionCode of another type",
+			data: testManifest(false, []testAttr{str("package", "com.example.clock"), {name: "versionCode", typ: TypeBoolean, data: 1}}, nil),
+			want: "reading versionCode",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseManifest(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one about %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package apk
+
+import (
+	"archive/zip"
+	"sort"
+	"strings"
+)
+
+// NativeCode returns the ABIs the APK at path contains native libraries for, sorted by name.
+// This is the same information F-Droid puts into the "nativecode" field of the index.
+func NativeCode(path string) (abis []string, err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	var seen = make(map[string]bool)
+	for _, f := range z.File {
+		split := strings.Split(f.Name, "/")
+		if len(split) < 3 || split[0] != "lib" || split[1] == "" || !strings.HasSuffix(f.Name, ".so") {
+			continue
+		}
+
+		if !seen[split[1]] {
+			seen[split[1]] = true
+			abis = append(abis, split[1])
+		}
+	}
+
+	sort.Strings(abis)
+
+	return
+}
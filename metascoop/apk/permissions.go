@@ -0,0 +1,61 @@
+package apk
+
+// dangerousPermissions are the permissions with protection level "dangerous" (plus the special ones that need
+// to be granted in the system settings), which give access to private data or let apps act on behalf of the user,
+// see https://developer.android.com/reference/android/Manifest.permission
+var dangerousPermissions = map[string]bool{
+	"android.permission.ACCEPT_HANDOVER":                    true,
+	"android.permission.ACCESS_BACKGROUND_LOCATION":         true,
+	"android.permission.ACCESS_COARSE_LOCATION":             true,
+	"android.permission.ACCESS_FINE_LOCATION":               true,
+	"android.permission.ACCESS_MEDIA_LOCATION":              true,
+	"android.permission.ACTIVITY_RECOGNITION":               true,
+	"android.permission.ADD_VOICEMAIL":                      true,
+	"android.permission.ANSWER_PHONE_CALLS":                 true,
+	"android.permission.BIND_ACCESSIBILITY_SERVICE":         true,
+	"android.permission.BIND_DEVICE_ADMIN":                  true,
+	"android.permission.BIND_NOTIFICATION_LISTENER_SERVICE": true,
+	"android.permission.BLUETOOTH_ADVERTISE":                true,
+	"android.permission.BLUETOOTH_CONNECT":                  true,
+	"android.permission.BLUETOOTH_SCAN":                     true,
+	"android.permission.BODY_SENSORS":                       true,
+	"android.permission.BODY_SENSORS_BACKGROUND":            true,
+	"android.permission.CALL_PHONE":                         true,
+	"android.permission.CAMERA":                             true,
+	"android.permission.GET_ACCOUNTS":                       true,
+	"android.permission.MANAGE_EXTERNAL_STORAGE":            true,
+	"android.permission.NEARBY_WIFI_DEVICES":                true,
+	"android.permission.PROCESS_OUTGOING_CALLS":             true,
+	"android.permission.QUERY_ALL_PACKAGES":                 true,
+	"android.permission.READ_CALENDAR":                      true,
+	"android.permission.READ_CALL_LOG":                      true,
+	"android.permission.READ_CONTACTS":                      true,
+	"android.permission.READ_EXTERNAL_STORAGE":              true,
+	"android.permission.READ_MEDIA_AUDIO":                   true,
+	"android.permission.READ_MEDIA_IMAGES":                  true,
+	"android.permission.READ_MEDIA_VIDEO":                   true,
+	"android.permission.READ_MEDIA_VISUAL_USER_SELECTED":    true,
+	"android.permission.READ_PHONE_NUMBERS":                 true,
+	"android.permission.READ_PHONE_STATE":                   true,
+	"android.permission.READ_SMS":                           true,
+	"android.permission.RECEIVE_MMS":                        true,
+	"android.permission.RECEIVE_SMS":                        true,
+	"android.permission.RECEIVE_WAP_PUSH":                   true,
+	"android.permission.RECORD_AUDIO":                       true,
+	"android.permission.REQUEST_INSTALL_PACKAGES":           true,
+	"android.permission.SEND_SMS":                           true,
+	"android.permission.SYSTEM_ALERT_WINDOW":                true,
+	"android.permission.USE_SIP":                            true,
+	"android.permission.UWB_RANGING":                        true,
+	"android.permission.WRITE_CALENDAR":                     true,
+	"android.permission.WRITE_CALL_LOG":                     true,
+	"android.permission.WRITE_CONTACTS":                     true,
+	"android.permission.WRITE_EXTERNAL_STORAGE":             true,
+	"android.permission.WRITE_SETTINGS":                     true,
+	"com.android.voicemail.permission.ADD_VOICEMAIL":        true,
+}
+
+// IsDangerousPermission reports whether the permission gives access to private data or sensitive actions
+func IsDangerousPermission(name string) bool {
+	return dangerousPermissions[name]
+}
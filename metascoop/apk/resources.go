@@ -0,0 +1,203 @@
+package apk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// This file implements a parser for the resource table ("resources.arsc") of APKs. It only reads
+// what's needed to resolve simple resources like the launcher icon: values of plain entries in all
+// configurations, with the screen density they are meant for. Bags (styles, arrays etc.) are skipped.
+
+const (
+	chunkTable     = 0x0002
+	chunkPackage   = 0x0200
+	chunkType      = 0x0201
+	typeFlagSparse = 0x01
+
+	// typeFlagOffset16 means entry offsets are stored as uint16 divided by 4
+	typeFlagOffset16 = 0x02
+
+	entryFlagComplex = 0x0001
+	entryFlagCompact = 0x0008
+)
+
+// Value types of colors, their data is always ARGB
+const (
+	TypeColorARGB8 = 0x1c
+	TypeColorRGB8  = 0x1d
+	TypeColorARGB4 = 0x1e
+	TypeColorRGB4  = 0x1f
+)
+
+// Special screen densities of resource configurations
+const (
+	DensityDefault = 0
+	DensityAny     = 0xfffe
+	DensityNone    = 0xffff
+)
+
+// ResourceValue is the value of a resource in one configuration
+type ResourceValue struct {
+	// Density is the screen density in dpi the value is meant for, or one of the special densities
+	Density uint16
+
+	Type uint8
+	Data uint32
+
+	// String is set for string values, which includes file paths like "res/mipmap-hdpi/ic_launcher.png"
+	String string
+}
+
+// Resources maps resource ids to their values in all configurations
+type Resources map[uint32][]ResourceValue
+
+// ParseResources decodes a resource table
+func ParseResources(data []byte) (r Resources, err error) {
+	if len(data) < 12 || binary.LittleEndian.Uint16(data) != chunkTable {
+		return nil, errors.New("not a resource table")
+	}
+
+	r = make(Resources)
+
+	var pool []string
+
+	pos := int(binary.LittleEndian.Uint16(data[2:]))
+	for pos+8 <= len(data) {
+		typ := binary.LittleEndian.Uint16(data[pos:])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 8 || pos+size > len(data) {
+			return nil, fmt.Errorf("invalid chunk size %d at offset %d", size, pos)
+		}
+		chunk := data[pos : pos+size]
+
+		switch typ {
+		case chunkStringPool:
+			pool, err = parseStringPool(chunk)
+			if err != nil {
+				return
+			}
+		case chunkPackage:
+			err = r.parsePackage(chunk, pool)
+			if err != nil {
+				return
+			}
+		}
+
+		pos += size
+	}
+
+	return
+}
+
+func (r Resources) parsePackage(chunk []byte, pool []string) (err error) {
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	if headerSize < 12 || headerSize > len(chunk) {
+		return errors.New("truncated package header")
+	}
+	id := binary.LittleEndian.Uint32(chunk[8:])
+
+	pos := headerSize
+	for pos+8 <= len(chunk) {
+		typ := binary.LittleEndian.Uint16(chunk[pos:])
+		size := int(binary.LittleEndian.Uint32(chunk[pos+4:]))
+		if size < 8 || pos+size > len(chunk) {
+			return fmt.Errorf("invalid chunk size %d in package 0x%02x", size, id)
+		}
+
+		if typ == chunkType {
+			err = r.parseType(chunk[pos:pos+size], id, pool)
+			if err != nil {
+				return
+			}
+		}
+
+		pos += size
+	}
+
+	return
+}
+
+func (r Resources) parseType(chunk []byte, pkgID uint32, pool []string) (err error) {
+	headerSize := int(binary.LittleEndian.Uint16(chunk[2:]))
+	if headerSize < 20 || headerSize > len(chunk) {
+		return errors.New("truncated type header")
+	}
+
+	typeID := uint32(chunk[8])
+	flags := chunk[9]
+	entryCount := int(binary.LittleEndian.Uint32(chunk[12:]))
+	entriesStart := int(binary.LittleEndian.Uint32(chunk[16:]))
+
+	// The density is part of the screen type in the configuration, which starts at offset 20
+	var density uint16
+	if headerSize >= 20+16 {
+		density = binary.LittleEndian.Uint16(chunk[20+14:])
+	}
+
+	// map[entry index]offset of the entry
+	offsets := make(map[int]int, entryCount)
+	for i := 0; i < entryCount; i++ {
+		switch {
+		case flags&typeFlagSparse != 0:
+			p := headerSize + i*4
+			if p+4 > len(chunk) {
+				return errors.New("truncated entry offsets")
+			}
+			offsets[int(binary.LittleEndian.Uint16(chunk[p:]))] = int(binary.LittleEndian.Uint16(chunk[p+2:])) * 4
+		case flags&typeFlagOffset16 != 0:
+			p := headerSize + i*2
+			if p+2 > len(chunk) {
+				return errors.New("truncated entry offsets")
+			}
+			if o := binary.LittleEndian.Uint16(chunk[p:]); o != 0xffff {
+				offsets[i] = int(o) * 4
+			}
+		default:
+			p := headerSize + i*4
+			if p+4 > len(chunk) {
+				return errors.New("truncated entry offsets")
+			}
+			if o := binary.LittleEndian.Uint32(chunk[p:]); o != noIndex {
+				offsets[i] = int(o)
+			}
+		}
+	}
+
+	for index, offset := range offsets {
+		p := entriesStart + offset
+		if p+8 > len(chunk) {
+			return fmt.Errorf("entry %d is out of bounds", index)
+		}
+		e := chunk[p:]
+
+		entryFlags := binary.LittleEndian.Uint16(e[2:])
+
+		var v ResourceValue
+		switch {
+		case entryFlags&entryFlagCompact != 0:
+			// The key is stored in place of the size, the type in the upper byte of the flags
+			v = ResourceValue{Type: uint8(entryFlags >> 8), Data: binary.LittleEndian.Uint32(e[4:])}
+		case entryFlags&entryFlagComplex != 0:
+			continue
+		default:
+			entrySize := int(binary.LittleEndian.Uint16(e))
+			if entrySize+8 > len(e) {
+				return fmt.Errorf("value of entry %d is out of bounds", index)
+			}
+			value := e[entrySize:]
+			v = ResourceValue{Type: value[3], Data: binary.LittleEndian.Uint32(value[4:])}
+		}
+
+		v.Density = density
+		if v.Type == TypeString && int(v.Data) < len(pool) {
+			v.String = pool[v.Data]
+		}
+
+		id := pkgID<<24 | typeID<<16 | uint32(index)
+		r[id] = append(r[id], v)
+	}
+
+	return
+}
@@ -0,0 +1,441 @@
+package apk
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// This file implements verification of the APK Signature Scheme v2 and v3, see
+// https://source.android.com/docs/security/features/apksigning/v2
+
+const (
+	sigBlockMagic = "APK Sig Block 42"
+
+	blockIDv2 = 0x7109871a
+	blockIDv3 = 0xf05368c0
+
+	eocdMagic   = 0x06054b50
+	eocdMinSize = 22
+
+	chunkSize = 1 << 20
+)
+
+// ErrNoSignature is returned for APKs that have no v2 or v3 signature
+var ErrNoSignature = errors.New("APK has no v2 or v3 signature")
+
+type sigAlgorithm struct {
+	hash crypto.Hash
+	kind string
+}
+
+var sigAlgorithms = map[uint32]sigAlgorithm{
+	0x0101: {crypto.SHA256, "rsa-pss"},
+	0x0102: {crypto.SHA512, "rsa-pss"},
+	0x0103: {crypto.SHA256, "rsa-pkcs1"},
+	0x0104: {crypto.SHA512, "rsa-pkcs1"},
+	0x0201: {crypto.SHA256, "ecdsa"},
+	0x0202: {crypto.SHA512, "ecdsa"},
+	0x0301: {crypto.SHA256, "dsa"},
+}
+
+// Signer describes a verified signer of an APK
+type Signer struct {
+	// Scheme is the version of the signature scheme, 2 or 3
+	Scheme int
+
+	Certificate *x509.Certificate
+
+	// CertSHA256 is the lowercase hex SHA-256 of the certificate, the same value F-Droid uses as "signer"
+	CertSHA256 string
+}
+
+// NormalizeFingerprint lowercases a hex fingerprint and removes separators, so "AB:CD" and "abcd" compare equal
+func NormalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "", "-", "").Replace(fp))
+}
+
+type apkLayout struct {
+	sigBlockOffset int64
+	cdOffset       int64
+	eocdOffset     int64
+
+	eocd  []byte
+	pairs map[uint32][]byte
+}
+
+// Verify checks the v3 signature of the APK at path (falling back to v2) and returns the signers.
+// It fails if the signature can't be verified or the APK content doesn't match the signed digests.
+func Verify(path string) (signers []Signer, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	layout, err := readLayout(f)
+	if err != nil {
+		return
+	}
+
+	scheme, block := 3, layout.pairs[blockIDv3]
+	if block == nil {
+		scheme, block = 2, layout.pairs[blockIDv2]
+	}
+	if block == nil {
+		return nil, ErrNoSignature
+	}
+
+	signerSeq, _, err := lengthPrefixed(block)
+	if err != nil {
+		return
+	}
+
+	var digestCache = make(map[crypto.Hash][]byte)
+
+	for len(signerSeq) > 0 {
+		var signerData []byte
+		signerData, signerSeq, err = lengthPrefixed(signerSeq)
+		if err != nil {
+			return
+		}
+
+		s, serr := verifySigner(f, layout, scheme, signerData, digestCache)
+		if serr != nil {
+			return nil, fmt.Errorf("v%d signer: %w", scheme, serr)
+		}
+		signers = append(signers, s)
+	}
+
+	if len(signers) == 0 {
+		return nil, errors.New("signature block contains no signers")
+	}
+
+	return
+}
+
+func readLayout(f *os.File) (l apkLayout, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+
+	// The EOCD record is at the very end, followed by a comment of up to 64KiB
+	tailSize := int64(eocdMinSize + 0xffff)
+	if tailSize > size {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	_, err = f.ReadAt(tail, size-tailSize)
+	if err != nil {
+		return
+	}
+
+	eocdPos := -1
+	for i := len(tail) - eocdMinSize; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(tail[i:]) == eocdMagic {
+			eocdPos = i
+			break
+		}
+	}
+	if eocdPos < 0 {
+		return l, errors.New("not a zip file: cannot find end of central directory")
+	}
+
+	l.eocd = tail[eocdPos:]
+	l.eocdOffset = size - tailSize + int64(eocdPos)
+	l.cdOffset = int64(binary.LittleEndian.Uint32(l.eocd[16:20]))
+
+	if l.cdOffset < 32 || l.cdOffset > l.eocdOffset {
+		return l, ErrNoSignature
+	}
+
+	var footer [24]byte
+	_, err = f.ReadAt(footer[:], l.cdOffset-24)
+	if err != nil {
+		return
+	}
+	if string(footer[8:]) != sigBlockMagic {
+		return l, ErrNoSignature
+	}
+
+	blockSize := int64(binary.LittleEndian.Uint64(footer[:8]))
+	l.sigBlockOffset = l.cdOffset - blockSize - 8
+	if blockSize < 24 || l.sigBlockOffset < 0 {
+		return l, errors.New("invalid APK signing block size")
+	}
+
+	block := make([]byte, blockSize-24)
+	_, err = f.ReadAt(block, l.sigBlockOffset+8)
+	if err != nil {
+		return
+	}
+
+	l.pairs = make(map[uint32][]byte)
+	for len(block) > 0 {
+		if len(block) < 12 {
+			return l, errors.New("truncated APK signing block")
+		}
+		pairLen := binary.LittleEndian.Uint64(block[:8])
+		if pairLen < 4 || pairLen > uint64(len(block)-8) {
+			return l, errors.New("invalid entry in APK signing block")
+		}
+		id := binary.LittleEndian.Uint32(block[8:12])
+		l.pairs[id] = block[12 : 8+pairLen]
+		block = block[8+pairLen:]
+	}
+
+	return
+}
+
+// lengthPrefixed splits off a uint32 little-endian length-prefixed value
+func lengthPrefixed(data []byte) (value []byte, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("truncated length-prefixed value")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, errors.New("length-prefixed value exceeds its container")
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+func verifySigner(f *os.File, l apkLayout, scheme int, data []byte, digestCache map[crypto.Hash][]byte) (s Signer, err error) {
+	s.Scheme = scheme
+
+	signedData, rest, err := lengthPrefixed(data)
+	if err != nil {
+		return
+	}
+	if scheme == 3 {
+		// min and max SDK version
+		if len(rest) < 8 {
+			return s, errors.New("truncated signer")
+		}
+		rest = rest[8:]
+	}
+	signatures, rest, err := lengthPrefixed(rest)
+	if err != nil {
+		return
+	}
+	publicKeyDER, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(publicKeyDER)
+	if err != nil {
+		return s, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	// Verify the strongest supported signature over the signed data
+	var (
+		bestAlg uint32
+		bestSig []byte
+	)
+	for len(signatures) > 0 {
+		var sig []byte
+		sig, signatures, err = lengthPrefixed(signatures)
+		if err != nil {
+			return
+		}
+		if len(sig) < 4 {
+			return s, errors.New("truncated signature")
+		}
+		alg := binary.LittleEndian.Uint32(sig)
+		if _, ok := sigAlgorithms[alg]; !ok {
+			continue
+		}
+		value, _, verr := lengthPrefixed(sig[4:])
+		if verr != nil {
+			return s, verr
+		}
+		if bestSig == nil || sigAlgorithms[alg].hash > sigAlgorithms[bestAlg].hash {
+			bestAlg, bestSig = alg, value
+		}
+	}
+	if bestSig == nil {
+		return s, errors.New("no supported signature algorithm")
+	}
+
+	alg := sigAlgorithms[bestAlg]
+	err = checkSignature(publicKey, alg, signedData, bestSig)
+	if err != nil {
+		return s, fmt.Errorf("signature doesn't match: %w", err)
+	}
+
+	// Now that the signed data is trusted, look at its content
+	digests, rest, err := lengthPrefixed(signedData)
+	if err != nil {
+		return
+	}
+	certs, _, err := lengthPrefixed(rest)
+	if err != nil {
+		return
+	}
+
+	var expectedDigest []byte
+	for len(digests) > 0 {
+		var d []byte
+		d, digests, err = lengthPrefixed(digests)
+		if err != nil {
+			return
+		}
+		if len(d) >= 4 && binary.LittleEndian.Uint32(d) == bestAlg {
+			expectedDigest, _, err = lengthPrefixed(d[4:])
+			if err != nil {
+				return
+			}
+		}
+	}
+	if expectedDigest == nil {
+		return s, errors.New("signed data contains no digest for the signature algorithm")
+	}
+
+	actual, ok := digestCache[alg.hash]
+	if !ok {
+		actual, err = contentDigest(f, l, alg.hash)
+		if err != nil {
+			return s, fmt.Errorf("computing content digest: %w", err)
+		}
+		digestCache[alg.hash] = actual
+	}
+	if !bytes.Equal(actual, expectedDigest) {
+		return s, errors.New("APK content doesn't match the signed digest, the file was modified after signing")
+	}
+
+	certDER, _, err := lengthPrefixed(certs)
+	if err != nil {
+		return s, fmt.Errorf("reading certificate: %w", err)
+	}
+	s.Certificate, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		return s, fmt.Errorf("parsing certificate: %w", err)
+	}
+
+	certKey, err := x509.MarshalPKIXPublicKey(s.Certificate.PublicKey)
+	if err != nil || !bytes.Equal(certKey, publicKeyDER) {
+		return s, errors.New("public key doesn't match the certificate")
+	}
+
+	sum := sha256.Sum256(certDER)
+	s.CertSHA256 = hex.EncodeToString(sum[:])
+
+	return
+}
+
+func newHash(h crypto.Hash) hash.Hash {
+	if h == crypto.SHA512 {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+func checkSignature(publicKey interface{}, alg sigAlgorithm, data, sig []byte) error {
+	h := newHash(alg.hash)
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch alg.kind {
+	case "rsa-pss", "rsa-pkcs1":
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("public key is not an RSA key")
+		}
+		if alg.kind == "rsa-pss" {
+			return rsa.VerifyPSS(key, alg.hash, digest, sig, &rsa.PSSOptions{SaltLength: alg.hash.Size()})
+		}
+		return rsa.VerifyPKCS1v15(key, alg.hash, digest, sig)
+	case "ecdsa":
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("public key is not an ECDSA key")
+		}
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case "dsa":
+		key, ok := publicKey.(*dsa.PublicKey)
+		if !ok {
+			return errors.New("public key is not a DSA key")
+		}
+		var rs struct{ R, S *big.Int }
+		_, err := asn1.Unmarshal(sig, &rs)
+		if err != nil {
+			return err
+		}
+		if !dsa.Verify(key, digest, rs.R, rs.S) {
+			return errors.New("invalid DSA signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported signature algorithm %q", alg.kind)
+}
+
+// contentDigest computes the chunked digest over everything except the signing block
+func contentDigest(f *os.File, l apkLayout, h crypto.Hash) (digest []byte, err error) {
+	// The EOCD must be hashed as if the central directory started where the signing block starts
+	eocd := make([]byte, len(l.eocd))
+	copy(eocd, l.eocd)
+	binary.LittleEndian.PutUint32(eocd[16:20], uint32(l.sigBlockOffset))
+
+	sections := []io.Reader{
+		io.NewSectionReader(f, 0, l.sigBlockOffset),
+		io.NewSectionReader(f, l.cdOffset, l.eocdOffset-l.cdOffset),
+		bytes.NewReader(eocd),
+	}
+
+	var (
+		chunkDigests []byte
+		numChunks    uint32
+		buf          = make([]byte, chunkSize)
+		prefix       [5]byte
+	)
+
+	for _, section := range sections {
+		for {
+			n, rerr := io.ReadFull(section, buf)
+			if n > 0 {
+				ch := newHash(h)
+				prefix[0] = 0xa5
+				binary.LittleEndian.PutUint32(prefix[1:], uint32(n))
+				ch.Write(prefix[:])
+				ch.Write(buf[:n])
+				chunkDigests = ch.Sum(chunkDigests)
+				numChunks++
+			}
+			if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+				break
+			}
+			if rerr != nil {
+				return nil, rerr
+			}
+		}
+	}
+
+	top := newHash(h)
+	prefix[0] = 0x5a
+	binary.LittleEndian.PutUint32(prefix[1:], numChunks)
+	top.Write(prefix[:])
+	top.Write(chunkDigests)
+
+	return top.Sum(nil), nil
+}
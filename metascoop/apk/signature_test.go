@@ -0,0 +1,253 @@
+package apk_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/e2e"
+)
+
+var testManifest = e2e.Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0", MinSdkVersion: 24, TargetSdkVersion: 34}
+
+// signedAPK returns an APK signed by a new signer with the v2 scheme
+func signedAPK(t *testing.T) (data []byte, signer *e2e.Signer) {
+	t.Helper()
+
+	signer, err := e2e.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = e2e.BuildAPK(testManifest, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// verify writes data to a file and verifies its signature
+func verify(t *testing.T, data []byte) ([]apk.Signer, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "app.apk")
+	err := os.WriteFile(path, data, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apk.Verify(path)
+}
+
+// signingBlock returns the offsets of the APK signing block and the central directory of the APK data. The APK
+// has no zip comment, like the ones of e2e.BuildAPK.
+func signingBlock(data []byte) (start, cd int) {
+	eocd := len(data) - 22
+	cd = int(binary.LittleEndian.Uint32(data[eocd+16:]))
+	size := int(binary.LittleEndian.Uint64(data[cd-24:]))
+	return cd - size - 8, cd
+}
+
+// lengthPrefixed returns the value at off of data that has a uint32 length prefix, and the offset after it
+func lengthPrefixed(data []byte, off int) (value []byte, next int) {
+	n := int(binary.LittleEndian.Uint32(data[off:]))
+	return data[off+4 : off+4+n], off + 4 + n
+}
+
+func appendLengthPrefixed(b []byte, values ...[]byte) []byte {
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+// v2Signer returns the offset of the signed data of the only v2 signer of the APK data
+func v2Signer(data []byte) int {
+	start, _ := signingBlock(data)
+	// Block size, pair size and ID, then the lengths of the signer sequence and the signer
+	return start + 8 + 8 + 4 + 4 + 4
+}
+
+// toV3 replaces the v2 signing block of the APK data by a v3 one of the same signer
+func toV3(t *testing.T, data []byte, signer *e2e.Signer) []byte {
+	t.Helper()
+
+	keyPEM, err := signer.PEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := parsed.(*ecdsa.PrivateKey)
+
+	// The content digest doesn't cover the signing block, so the one the v2 signer signed stays valid
+	v2Data, _ := lengthPrefixed(data, v2Signer(data))
+	digests, next := lengthPrefixed(v2Data, 0)
+	certs, _ := lengthPrefixed(v2Data, next)
+
+	sdk := binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 24), 0x7fffffff)
+	signedData := appendLengthPrefixed(nil, digests, certs)
+	signedData = append(signedData, sdk...)
+	signedData = appendLengthPrefixed(signedData, nil)
+
+	sum := sha256.Sum256(signedData)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v3Signer := appendLengthPrefixed(nil, signedData)
+	v3Signer = append(v3Signer, sdk...)
+	v3Signer = appendLengthPrefixed(v3Signer, appendLengthPrefixed(nil, appendLengthPrefixed(binary.LittleEndian.AppendUint32(nil, 0x0201), sig)), publicKey)
+	value := appendLengthPrefixed(nil, appendLengthPrefixed(nil, v3Signer))
+
+	pair := binary.LittleEndian.AppendUint64(nil, uint64(4+len(value)))
+	pair = binary.LittleEndian.AppendUint32(pair, 0xf05368c0)
+	pair = append(pair, value...)
+	size := uint64(len(pair) + 8 + 16)
+	sigBlock := binary.LittleEndian.AppendUint64(nil, size)
+	sigBlock = append(sigBlock, pair...)
+	sigBlock = binary.LittleEndian.AppendUint64(sigBlock, size)
+	sigBlock = append(sigBlock, "APK Sig Block 42"...)
+
+	start, cd := signingBlock(data)
+	eocd := append([]byte(nil), data[len(data)-22:]...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(start+len(sigBlock)))
+
+	var out bytes.Buffer
+	out.Write(data[:start])
+	out.Write(sigBlock)
+	out.Write(data[cd : len(data)-22])
+	out.Write(eocd)
+	return out.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	data, signer := signedAPK(t)
+
+	signers, err := verify(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || signers[0].Scheme != 2 || signers[0].CertSHA256 != signer.Fingerprint() {
+		t.Errorf("signers are %+v, want the v2 signer %s", signers, signer.Fingerprint())
+	}
+}
+
+func TestVerifyV3(t *testing.T) {
+	data, signer := signedAPK(t)
+
+	signers, err := verify(t, toV3(t, data, signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || signers[0].Scheme != 3 || signers[0].CertSHA256 != signer.Fingerprint() {
+		t.Errorf("signers are %+v, want the v3 signer %s", signers, signer.Fingerprint())
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	unsigned, err := e2e.BuildAPK(testManifest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+
+		// change modifies a copy of a v2 signed APK
+		change func(data []byte) []byte
+
+		want string
+	}{
+		{
+			name: "tampered content",
+			change: func(data []byte) []byte {
+				// In the compressed data of the first entry
+				data[50] ^= 0xff
+				return data
+			},
+			want: "doesn't match the signed digest",
+		},
+		{
+			name: "tampered central directory",
+			change: func(data []byte) []byte {
+				_, cd := signingBlock(data)
+				data[cd+10] ^= 0xff
+				return data
+			},
+			want: "doesn't match the signed digest",
+		},
+		{
+			name: "corrupted signature",
+			change: func(data []byte) []byte {
+				off := v2Signer(data)
+				_, next := lengthPrefixed(data, off)
+				// The signatures and the first one, its algorithm and its value
+				sig, _ := lengthPrefixed(data, next+4+4+4)
+				sig[len(sig)-1] ^= 0xff
+				return data
+			},
+			want: "signature doesn't match",
+		},
+		{
+			name: "tampered signed data",
+			change: func(data []byte) []byte {
+				signedData, _ := lengthPrefixed(data, v2Signer(data))
+				signedData[len(signedData)/2] ^= 0xff
+				return data
+			},
+			want: "signature doesn't match",
+		},
+		{
+			name: "v2 signer in a v3 block",
+			change: func(data []byte) []byte {
+				start, _ := signingBlock(data)
+				binary.LittleEndian.PutUint32(data[start+16:], 0xf05368c0)
+				return data
+			},
+			want: "v3 signer",
+		},
+		{
+			name: "truncated APK",
+			change: func(data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			want: "not a zip file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := signedAPK(t)
+
+			_, err := verify(t, tt.change(data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one about %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("no signing block", func(t *testing.T) {
+		_, err := verify(t, unsigned)
+		if !errors.Is(err, apk.ErrNoSignature) {
+			t.Errorf("got error %v, want ErrNoSignature", err)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/hooks"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// appHooks decides which hooks are called for which apps
+type appHooks struct {
+	config hooks.Config
+}
+
+func newAppHooks(configPath string, appsList []apps.AppInfo) (h *appHooks, err error) {
+	config, err := hooks.LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", configPath, err)
+	}
+
+	known := make(map[string]bool)
+	for _, hook := range config.Hooks {
+		known[hook.Name] = true
+	}
+	for _, app := range appsList {
+		for _, name := range app.Hooks {
+			if !known[name] {
+				return nil, fmt.Errorf("app %q uses hook %q, which isn't in %q", app.Name(), name, configPath)
+			}
+		}
+	}
+
+	return &appHooks{config: config}, nil
+}
+
+// forApp returns the hooks that are called for app at point
+func (h *appHooks) forApp(app apps.AppInfo, point string) (list []*hooks.Hook) {
+	if h == nil {
+		return nil
+	}
+
+	for _, hook := range h.config.Hooks {
+		if !hook.Wants(point) {
+			continue
+		}
+
+		selected := len(app.Hooks) == 0
+		for _, name := range app.Hooks {
+			selected = selected || name == hook.Name
+		}
+		if selected {
+			list = append(list, hook)
+		}
+	}
+
+	return
+}
+
+// run calls the hooks of app at point one after another. The first veto ends it, it's returned as *hooks.VetoError.
+// For the points after the download, the package name is taken from the APK at path.
+func (h *appHooks) run(logger *slog.Logger, app apps.AppInfo, point, asset, path string) (err error) {
+	list := h.forApp(app, point)
+	if len(list) == 0 {
+		return
+	}
+
+	e := hooks.Event{
+		Point:   point,
+		App:     app.Name(),
+		Package: app.PackageName,
+		Release: app.ReleaseTag,
+		Asset:   asset,
+		Path:    path,
+	}
+	if point != hooks.PointPreDownload {
+		if m, merr := apk.ReadManifest(path); merr == nil {
+			e.Package = m.Package
+		}
+	}
+
+	for _, hook := range list {
+		logger.Debug("Running hook", "hook", hook.Name, "point", point, "path", path)
+
+		err = hook.Run(context.Background(), e)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// prePublish calls the pre-publish hooks for the APKs downloaded in this run and removes those they veto
+func (h *appHooks) prePublish(jobs []scoop.Download, apkInfoMap map[string]apps.AppInfo, assetNames map[string]string, addError func(app string, err error)) {
+	if h == nil {
+		return
+	}
+
+	jobs = append([]scoop.Download(nil), jobs...)
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Target < jobs[j].Target })
+
+	for _, job := range jobs {
+		info, ok := apkInfoMap[filepath.Base(job.Target)]
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(job.Target); err != nil {
+			// The download failed or the APK was removed after a failed rebuild
+			continue
+		}
+
+		logger := slog.With("app", info.Name(), "release", info.ReleaseTag)
+
+		err := h.run(logger, info, hooks.PointPrePublish, assetNames[job.Target], job.Target)
+		if err == nil {
+			continue
+		}
+
+		var veto *hooks.VetoError
+		if errors.As(err, &veto) {
+			logger.Error("Hook vetoed publishing the APK, removing it", "path", job.Target, "hook", veto.Hook, "reason", veto.Reason)
+		} else {
+			logger.Error("Running pre-publish hook failed, removing the APK", "path", job.Target, "error", err)
+		}
+		addError(info.Name(), fmt.Errorf("publishing %q of release %q: %w", filepath.Base(job.Target), info.ReleaseTag, err))
+
+		rerr := os.Remove(job.Target)
+		if rerr != nil {
+			logger.Error("Removing APK failed", "path", job.Target, "error", rerr)
+		}
+	}
+}
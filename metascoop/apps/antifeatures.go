@@ -0,0 +1,93 @@
+package apps
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// KnownAntiFeatures are the anti-features F-Droid clients know, see https://f-droid.org/en/docs/Anti-Features/
+var KnownAntiFeatures = []string{
+	"Ads",
+	"ApplicationDebuggable",
+	"DisabledAlgorithm",
+	"KnownVuln",
+	"NoSourceSince",
+	"NonFreeAdd",
+	"NonFreeAssets",
+	"NonFreeDep",
+	"NonFreeNet",
+	"NSFW",
+	"Tracking",
+	"TetheredNet",
+	"UpstreamNonFree",
+}
+
+// VersionAntiFeatures are anti-features that only some versions of an app have, e.g. because tracking
+// was removed in a later release
+type VersionAntiFeatures struct {
+	// Tag is a regular expression the release tag must match, e.g. "^v1\\."
+	Tag string `yaml:"tag"`
+
+	AntiFeatures []string `yaml:"anti_features"`
+
+	tag *regexp.Regexp
+}
+
+func (v *VersionAntiFeatures) compile() (err error) {
+	if v.Tag == "" {
+		return fmt.Errorf("tag must be set")
+	}
+	v.tag, err = regexp.Compile(v.Tag)
+	if err != nil {
+		return
+	}
+	if len(v.AntiFeatures) == 0 {
+		return fmt.Errorf("no anti_features given for tag %q", v.Tag)
+	}
+	return validateAntiFeatures(v.AntiFeatures)
+}
+
+// ReleaseAntiFeatures returns the sorted anti-features of the version released with the given tag
+func (a AppInfo) ReleaseAntiFeatures(tag string) (list []string) {
+	seen := make(map[string]bool)
+	add := func(afs []string) {
+		for _, af := range afs {
+			if !seen[af] {
+				seen[af] = true
+				list = append(list, af)
+			}
+		}
+	}
+
+	add(a.AntiFeatures)
+	for _, v := range a.VersionAntiFeatures {
+		if v.tag != nil && v.tag.MatchString(tag) {
+			add(v.AntiFeatures)
+		}
+	}
+
+	sort.Strings(list)
+	return
+}
+
+// HasVersionAntiFeatures reports whether the anti-features of some versions differ from those of the app
+func (a AppInfo) HasVersionAntiFeatures() bool {
+	return len(a.VersionAntiFeatures) > 0
+}
+
+func validateAntiFeatures(list []string) error {
+	for _, af := range list {
+		known := false
+		for _, k := range KnownAntiFeatures {
+			if af == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown anti-feature %q, must be one of %q", af, KnownAntiFeatures)
+		}
+	}
+	return nil
+}
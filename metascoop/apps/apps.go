@@ -1,78 +1,333 @@
 package apps
 
 import (
-	"fmt"
-	"net/url"
-	"os"
-	"strings"
-
-	"gopkg.in/yaml.v3"
+	"regexp"
+	"time"
 )
 
 type AppInfo struct {
 	GitURL  string `yaml:"git"`
 	Summary string `yaml:"summary"`
 
+	// Source is the type of host releases are fetched from: "github", "gitlab", "gitea", "url" or "fdroid".
+	// It is detected from the git URL if empty
+	Source string `yaml:"source"`
+
+	// APKURL is where the "url" source downloads the APK from. It may contain "{version}", which is replaced by the
+	// version VersionRegex finds on the VersionURL page (by default the APK URL itself). Without a VersionRegex, the
+	// APK at the URL is published as release "latest" and downloaded again whenever it changes.
+	APKURL       string `yaml:"apk_url"`
+	VersionURL   string `yaml:"version_url"`
+	VersionRegex string `yaml:"version_regex"`
+
+	versionRegex *regexp.Regexp
+
+	// FDroidRepo is the URL of the F-Droid repo the "fdroid" source mirrors the versions of PackageName from,
+	// e.g. "https://vendor.example/fdroid/repo". The APKs are verified against the hashes of its index.
+	FDroidRepo string `yaml:"fdroid_repo"`
+
+	// Workflow is the file name of the GitHub Actions workflow, e.g. "nightly.yml", whose latest successful run on
+	// Branch (the default branch if empty) the "github-actions" source publishes the artifacts of. VersionCode is
+	// "run_number" or "commit_date" if the APKs are built with that versionCode, see sources.ActionsConfig.
+	Workflow    string `yaml:"workflow"`
+	Branch      string `yaml:"branch"`
+	VersionCode string `yaml:"version_code"`
+
 	AuthorName string `yaml:"author"`
 	repoAuthor string
 
 	FriendlyName string `yaml:"name"`
 	keyName      string
 
+	// file is the apps file the app is defined in, which may be one that is included by the main one
+	file string
+
+	// remote is set for apps of remote fragments, which can't be edited here
+	remote bool
+
 	Description string `yaml:"description"`
 
 	Categories []string `yaml:"categories"`
 
-	AntiFeatures []string `yaml:"anti_features"`
+	// AntiFeatures are the F-Droid anti-features of all versions, e.g. "NonFreeNet" or "Tracking".
+	// VersionAntiFeatures adds more to the versions of releases whose tag matches.
+	AntiFeatures        []string              `yaml:"anti_features"`
+	VersionAntiFeatures []VersionAntiFeatures `yaml:"version_anti_features"`
+
+	// AssetFilter is a regular expression release asset names must match to be considered, by default all ".apk" files are.
+	// AssetExclude removes matching assets from the candidates.
+	AssetFilter  string `yaml:"asset_filter"`
+	AssetExclude string `yaml:"asset_exclude"`
+
+	assetFilter  *regexp.Regexp
+	assetExclude *regexp.Regexp
+
+	// Bundles accepts Android App Bundles (.aab) and APK sets (.apks) of releases without APKs, which are
+	// converted to a universal APK after the download. App Bundles need -bundletool and -bundle-keystore.
+	Bundles bool `yaml:"bundles"`
+
+	// Companions are assets that are published alongside the APK of a release, e.g. OBB expansion files
+	Companions []CompanionAsset `yaml:"companions"`
+
+	// TagPattern is a regular expression release tags must match, e.g. "^release-(\\d+\\.\\d+\\.\\d+)$". Its group
+	// named "version" (or its first group) is the versionName the APK of the release must have. See TagVersion.
+	TagPattern string `yaml:"tag_pattern"`
+
+	tagPattern *regexp.Regexp
+
+	// PackageName is the application id the APKs must have, e.g. "net.nymtech.nym_vpn_client". Downloads of other packages are rejected.
+	PackageName string `yaml:"package"`
+
+	// Signer is the SHA-256 fingerprint of the certificate APKs must be signed with. Downloads signed by anyone else are rejected.
+	Signer string `yaml:"signer"`
+
+	// FileNameTemplate is the name the APKs of the app get in the repo, e.g. "{package}_{versionCode}.apk" instead
+	// of "<app>_<tag>.apk". It overrides -apk-name, see GenerateTemplateFilename for the variables.
+	FileNameTemplate string `yaml:"file_name"`
+
+	// Priority decides which app publishes a package if several do, e.g. the GitHub releases of an app and a mirror
+	// of the F-Droid repo of its developer. Versions that both have are published by the app with the higher
+	// priority, and its metadata is used. The other app only adds versions the first one doesn't have.
+	Priority int `yaml:"priority"`
+
+	// Retention is the number of newest versions that are kept in the repo, older ones are removed.
+	// Zero uses the global default, a negative value keeps all versions.
+	Retention int `yaml:"keep_versions"`
+
+	// Pin holds the app at the release with this tag, e.g. after a bad upstream release: newer releases aren't
+	// published, and the pinned version is suggested to clients even if newer ones are in the repo already.
+	// Frozen holds the app at the versions in the repo. Metadata is updated either way.
+	Pin    string `yaml:"pin"`
+	Frozen bool   `yaml:"frozen"`
+
+	// MinReleaseAge holds back releases until they were published this long ago, e.g. "24h", so upstream has time
+	// to pull a broken build before it reaches users. Zero uses the global default (-min-release-age), a negative
+	// value exempts the app.
+	MinReleaseAge Duration `yaml:"min_release_age"`
 
+	// Reproducible describes how to rebuild the APKs from the tagged source, so they can be verified with -reproducible
+	Reproducible *ReproducibleBuild `yaml:"reproducible"`
+
+	// MinTargetSDK is the lowest targetSdkVersion APKs must have, so outdated builds aren't published.
+	// Zero uses the global default (-min-target-sdk), a negative value exempts the app.
+	MinTargetSDK int `yaml:"min_target_sdk"`
+
+	// MaxAPKSize is the largest APK that's accepted, e.g. "150M", so a wrong artifact like a debug build with
+	// symbols isn't published. Zero uses the global default (-max-apk-size), a negative value exempts the app.
+	MaxAPKSize Size `yaml:"max_apk_size"`
+
+	// MetadataRepo is the git URL of the repo the fastlane metadata is taken from, if it isn't the app's repo
+	MetadataRepo string `yaml:"metadata_repo"`
+
+	// MetadataPath is the directory in the metadata repo that contains the locale directories, e.g.
+	// "app/src/main/fastlane/metadata/android". By default, fastlane directories are searched everywhere.
+	MetadataPath string `yaml:"metadata_path"`
+
+	// MetadataFromRelease takes the metadata from the tag of the newest published release instead of the default
+	// branch, so descriptions and screenshots match the APK that's suggested. See MetadataRef.
+	MetadataFromRelease bool `yaml:"metadata_from_release"`
+
+	// MetadataGitRef is the branch or tag of the metadata repo the metadata is taken from, e.g. "fdroid" for
+	// upstreams that curate their store listing on a branch of its own. The default branch is used if it's empty.
+	MetadataGitRef string `yaml:"metadata_ref"`
+
+	// DescriptionFromReadme takes the description from the first paragraphs of the README in the root of the
+	// metadata repo if neither apps.yaml nor its fastlane metadata have one, so the app isn't blank in clients
+	DescriptionFromReadme bool `yaml:"description_from_readme"`
+
+	// MetadataTokenEnv and MetadataSSHKeyEnv name environment variables with an access token (for HTTPS URLs) or
+	// the content of a private key (for SSH URLs) that are used to clone a private metadata repo.
+	// The secrets themselves never belong into apps.yaml.
+	MetadataTokenEnv  string `yaml:"metadata_token_env"`
+	MetadataSSHKeyEnv string `yaml:"metadata_ssh_key_env"`
+
+	// Overrides replace metadata fields after everything else was applied, to correct or supplement what
+	// comes from the upstream repo and its fastlane metadata
+	Overrides Overrides `yaml:"overrides"`
+
+	// Channel selects which releases are published, see the Channel* constants. Defaults to ChannelStable
+	Channel string `yaml:"channel"`
+
+	// Notify changes which notifications are sent about this app
+	Notify NotifySettings `yaml:"notify"`
+
+	// Hooks are the names of the hooks from -hooks-config that are called for this app, all if empty
+	Hooks []string `yaml:"hooks"`
+
+	// TrackerPolicy overrides what happens to APKs that contain known trackers, see the TrackerPolicy* constants.
+	// AllowedTrackers are tracker names (as in the signature list) that are ignored for this app.
+	TrackerPolicy   string   `yaml:"tracker_policy"`
+	AllowedTrackers []string `yaml:"allowed_trackers"`
+
+	// AllowedPermissions are dangerous permissions new versions may add, e.g. "android.permission.CAMERA" or
+	// just "CAMERA". Versions that add other dangerous permissions are rejected, see -permission-policy.
+	AllowedPermissions []string `yaml:"allowed_permissions"`
+
+	// OSV is the package under which upstream publishes security advisories, so the published versions are
+	// checked for known vulnerabilities
+	OSV *OSVPackage `yaml:"osv"`
+
+	// DownloadAuth are headers with credentials that are sent with the app's asset downloads
+	DownloadAuth *DownloadAuth `yaml:"download_auth"`
+
+	ReleaseTag         string
 	ReleaseDescription string
+	ReleasePrerelease  bool
+	ReleaseVersionCode int64
 
 	License string
 }
 
-func (a AppInfo) Name() string {
-	return a.keyName
+// Overrides are metadata fields that take precedence over all other sources. Empty fields are left alone.
+type Overrides struct {
+	Categories   []string `yaml:"categories"`
+	License      string   `yaml:"license"`
+	AuthorName   string   `yaml:"author_name"`
+	WebSite      string   `yaml:"website"`
+	IssueTracker string   `yaml:"issue_tracker"`
+	Donate       string   `yaml:"donate"`
+	Bitcoin      string   `yaml:"bitcoin"`
 }
 
-func (a AppInfo) Author() string {
-	if a.AuthorName != "" {
-		return a.AuthorName
+// NotifySettings are the per-app settings of notifications, the notifiers themselves are configured globally
+type NotifySettings struct {
+	// Disabled mutes all notifications about the app
+	Disabled bool `yaml:"disabled"`
+
+	// Notifiers are the names of the notifiers that receive messages about the app, all if empty
+	Notifiers []string `yaml:"notifiers"`
+
+	// FailureThreshold overrides the number of consecutive failed runs after which a notification is sent
+	FailureThreshold int `yaml:"failure_threshold"`
+}
+
+const (
+	// ChannelStable only publishes releases that are not marked as prereleases
+	ChannelStable = "stable"
+
+	// ChannelBeta also publishes prereleases, but only suggests stable releases to clients.
+	// F-Droid clients only update to them if "unstable updates" are enabled.
+	ChannelBeta = "beta"
+
+	// ChannelAll publishes and suggests all releases, regardless of whether they are prereleases
+	ChannelAll = "all"
+)
+
+const (
+	// TrackerPolicyIgnore doesn't scan APKs for trackers
+	TrackerPolicyIgnore = "ignore"
+
+	// TrackerPolicyFlag publishes APKs with trackers, but adds the "Tracking" anti-feature to their versions
+	TrackerPolicyFlag = "flag"
+
+	// TrackerPolicyBlock rejects APKs with trackers, so their releases aren't published
+	TrackerPolicyBlock = "block"
+)
+
+// IncludesPrereleases reports whether prereleases should be published for this app
+func (a AppInfo) IncludesPrereleases() bool {
+	return a.Channel == ChannelBeta || a.Channel == ChannelAll
+}
+
+// KeepVersions returns how many versions should be kept for this app, or zero if all should be kept
+func (a AppInfo) KeepVersions(defaultKeep int) int {
+	switch {
+	case a.Retention < 0:
+		return 0
+	case a.Retention == 0:
+		return defaultKeep
+	default:
+		return a.Retention
 	}
-	return a.repoAuthor
 }
 
-// ParseAppFile returns the list of apps from the app file
-func ParseAppFile(filepath string) (list []AppInfo, err error) {
-	f, err := os.Open(filepath)
-	if err != nil {
-		return
+// RequiredTargetSDK returns the lowest targetSdkVersion APKs of this app must have, or zero if any is accepted
+func (a AppInfo) RequiredTargetSDK(defaultMin int) int {
+	switch {
+	case a.MinTargetSDK < 0:
+		return 0
+	case a.MinTargetSDK == 0:
+		return defaultMin
+	default:
+		return a.MinTargetSDK
 	}
-	defer f.Close()
+}
 
-	var apps map[string]AppInfo
+// APKSizeLimit returns the size in bytes APKs of this app may have at most, or zero if there's no limit
+func (a AppInfo) APKSizeLimit(defaultMax int64) int64 {
+	switch {
+	case a.MaxAPKSize < 0:
+		return 0
+	case a.MaxAPKSize == 0:
+		return defaultMax
+	default:
+		return int64(a.MaxAPKSize)
+	}
+}
 
-	err = yaml.NewDecoder(f).Decode(&apps)
-	if err != nil {
-		return
+// ReleaseAgeLimit returns how long ago releases of this app must have been published, or zero if they're
+// published right away
+func (a AppInfo) ReleaseAgeLimit(defaultAge time.Duration) time.Duration {
+	switch {
+	case a.MinReleaseAge < 0:
+		return 0
+	case a.MinReleaseAge == 0:
+		return defaultAge
+	default:
+		return time.Duration(a.MinReleaseAge)
 	}
+}
 
-	for k, a := range apps {
-		a.keyName = k
+// MetadataGitURL returns the URL of the repo that contains the app's fastlane metadata
+func (a AppInfo) MetadataGitURL() string {
+	if a.MetadataRepo != "" {
+		return a.MetadataRepo
+	}
+	return a.GitURL
+}
+
+// MetadataRef returns the branch or tag the metadata should be checked out from, or an empty string for the default
+// branch. MetadataGitRef wins over fromRelease. Release tags only exist in the app's repo, so a separate
+// MetadataRepo uses its default branch unless MetadataGitRef is set.
+func (a AppInfo) MetadataRef(fromRelease bool) string {
+	if a.MetadataGitRef != "" {
+		return a.MetadataGitRef
+	}
+	if (fromRelease || a.MetadataFromRelease) && a.MetadataRepo == "" {
+		return a.ReleaseTag
+	}
+	return ""
+}
+
+func (a AppInfo) Name() string {
+	return a.keyName
+}
 
-		u, uerr := url.ParseRequestURI(a.GitURL)
-		if uerr != nil {
-			err = fmt.Errorf("problem with given git URL %q for app with key=%q, name=%q: %w", a.GitURL, k, a.Name(), uerr)
-			return
-		}
+// File returns the path of the apps file the app is defined in, or the name of the remote fragment
+func (a AppInfo) File() string {
+	return a.file
+}
 
-		split := strings.Split(strings.Trim(u.Path, "/"), "/")
-		if len(split) == 0 {
-			return
-		}
-		a.repoAuthor = split[0]
+// Remote reports whether the app is defined in a remote fragment, see File
+func (a AppInfo) Remote() bool {
+	return a.remote
+}
 
-		list = append(list, a)
+func (a AppInfo) Author() string {
+	if a.AuthorName != "" {
+		return a.AuthorName
 	}
+	return a.repoAuthor
+}
+
+// scpLikeURL matches the short form of SSH URLs git accepts, e.g. "git@github.com:org/repo.git"
+var scpLikeURL = regexp.MustCompile(`^[\w.-]+@[\w.-]+:[^/]`)
 
+// ParseAppFile returns the list of apps from the app file. Mistakes in it are returned as *FileError, see Lint.
+func ParseAppFile(filepath string) (list []AppInfo, err error) {
+	list, problems, err := Lint(filepath)
+	if err == nil && len(problems) > 0 {
+		return nil, &FileError{Path: filepath, Problems: problems}
+	}
 	return
 }
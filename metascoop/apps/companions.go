@@ -0,0 +1,78 @@
+package apps
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+const (
+	// CompanionOBBMain is the main expansion file of an APK, see https://developer.android.com/google/play/expansion-files
+	CompanionOBBMain = "obb_main"
+
+	// CompanionOBBPatch is the patch expansion file, a smaller update to the main one
+	CompanionOBBPatch = "obb_patch"
+)
+
+// CompanionAsset selects an asset that belongs to the APK of a release
+type CompanionAsset struct {
+	// Pattern is a regular expression the asset name must match, e.g. "\\.obb$"
+	Pattern string `yaml:"pattern"`
+
+	// Type is CompanionOBBMain or CompanionOBBPatch. It determines the name of the file in the repo.
+	Type string `yaml:"type"`
+
+	pattern *regexp.Regexp
+}
+
+func (c *CompanionAsset) compile() (err error) {
+	switch c.Type {
+	case CompanionOBBMain, CompanionOBBPatch:
+	default:
+		return fmt.Errorf("unknown companion type %q, must be %q or %q", c.Type, CompanionOBBMain, CompanionOBBPatch)
+	}
+
+	if c.Pattern == "" {
+		return fmt.Errorf("pattern must be set for companion type %q", c.Type)
+	}
+	c.pattern, err = regexp.Compile(c.Pattern)
+	return
+}
+
+// FileName returns the name F-Droid expects the companion of the given version of pkg to have in the repo, e.g.
+// "main.12.com.example.app.obb". Clients download it together with APKs of that version or newer.
+func (c CompanionAsset) FileName(versionCode int64, pkg string) string {
+	prefix := "main"
+	if c.Type == CompanionOBBPatch {
+		prefix = "patch"
+	}
+	return fmt.Sprintf("%s.%d.%s.obb", prefix, versionCode, pkg)
+}
+
+func (a AppInfo) isCompanion(assetName string) bool {
+	for _, c := range a.Companions {
+		if c.pattern != nil && c.pattern.MatchString(assetName) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindCompanionAssets returns the companions of release and the asset for each of them. If several assets
+// match a companion, the first one by name is used.
+func (a AppInfo) FindCompanionAssets(release sources.Release) (companions []CompanionAsset, assets []sources.Asset) {
+	for _, c := range a.Companions {
+		var found *sources.Asset
+		for i, asset := range release.Assets {
+			if c.pattern != nil && c.pattern.MatchString(asset.Name) && (found == nil || asset.Name < found.Name) {
+				found = &release.Assets[i]
+			}
+		}
+		if found != nil {
+			companions = append(companions, c)
+			assets = append(assets, *found)
+		}
+	}
+	return
+}
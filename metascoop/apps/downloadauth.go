@@ -0,0 +1,92 @@
+package apps
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DownloadAuth are HTTP headers that are sent with the asset downloads of an app, for hosts that need credentials
+// other than the token of the source, e.g. an API key of a CDN. The secrets themselves never belong into
+// apps.yaml: "${NAME}" in a value is replaced by the environment variable NAME.
+type DownloadAuth struct {
+	// Headers maps header names to their values, e.g. Authorization: "Bearer ${ASSETS_TOKEN}"
+	Headers map[string]string `yaml:"headers"`
+
+	// Hosts are the hosts the headers are sent to, e.g. "downloads.example.org". Defaults to the host of each
+	// asset URL. Requests to other hosts, like the storage a download redirects to, don't get the headers.
+	Hosts []string `yaml:"hosts"`
+}
+
+// downloadAuthVariable matches the environment variables in header values
+var downloadAuthVariable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedHeaders are set by downloads themselves
+var reservedHeaders = []string{"Host", "Range", "Content-Length", "Accept-Encoding"}
+
+// Header returns the headers with the environment variables replaced. secrets are the values of the variables, so
+// they can be redacted from logs. Variables that are unset or empty are an error, the download would likely fail.
+func (d *DownloadAuth) Header() (header http.Header, secrets []string, err error) {
+	header = make(http.Header, len(d.Headers))
+	for name, value := range d.Headers {
+		value = downloadAuthVariable.ReplaceAllStringFunc(value, func(v string) string {
+			variable := downloadAuthVariable.FindStringSubmatch(v)[1]
+			secret := os.Getenv(variable)
+			if secret == "" && err == nil {
+				err = fmt.Errorf("$%s of download_auth header %q is empty", variable, name)
+			}
+			if secret != "" {
+				secrets = append(secrets, secret)
+			}
+			return secret
+		})
+		header.Set(name, value)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// HostNames returns the lower-cased hosts the headers are sent to, none if they go to the hosts of the asset URLs
+func (d *DownloadAuth) HostNames() (hosts []string) {
+	for _, h := range d.Hosts {
+		hosts = append(hosts, strings.ToLower(h))
+	}
+	return
+}
+
+func (d *DownloadAuth) validate() error {
+	if len(d.Headers) == 0 {
+		return fmt.Errorf("headers must be set")
+	}
+	for name, value := range d.Headers {
+		if name == "" || strings.ContainsAny(name, " :\t\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		for _, reserved := range reservedHeaders {
+			if textproto.CanonicalMIMEHeaderKey(name) == reserved {
+				return fmt.Errorf("header %q can't be set, downloads set it themselves", name)
+			}
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("the value of header %q contains a line break", name)
+		}
+		for _, m := range downloadAuthVariable.FindAllStringSubmatch(value, -1) {
+			if !envVarName.MatchString(m[1]) {
+				return fmt.Errorf("invalid environment variable %q in header %q", m[0], name)
+			}
+		}
+	}
+	for _, h := range d.Hosts {
+		if h == "" || strings.ContainsAny(h, "/:@ ") {
+			return fmt.Errorf("invalid host %q, it must be a name like \"downloads.example.org\" without scheme or path", h)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package apps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a duration in apps.yaml like "24h" or "90m", which may also be given in days, e.g. "7d". A negative
+// duration is allowed, e.g. to exempt an app from a global setting.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	v, err := ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ParseDuration parses a duration like time.ParseDuration does, and additionally whole days like "2d"
+func ParseDuration(value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, must be like \"36h\", \"90m\" or \"2d\"", value)
+	}
+	return d, nil
+}
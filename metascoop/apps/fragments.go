@@ -0,0 +1,236 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/git"
+)
+
+// fragmentTimeout limits how long fetching a remote fragment may take
+const fragmentTimeout = 2 * time.Minute
+
+// remoteFragment is an apps file of another team that's included from a URL or a git repo, e.g.
+//
+//	include:
+//	  - https://example.org/catalog/apps.yaml
+//	  - git: https://github.com/example/catalog
+//	    ref: main
+//	    path: apps.yaml
+//
+// Its apps are merged with the others like those of included files. As it isn't under the control of the repo's
+// maintainers, it can't set fields that run commands, read secrets of the host or relax the checks of the repo,
+// see remoteForbidden. Its apps must name their package, which can't be one an app of the repo publishes.
+type remoteFragment struct {
+	// URL is the URL of the file, or of the git repo
+	URL string `yaml:"url"`
+	Git string `yaml:"git"`
+
+	// Ref is the branch or tag of the git repo, the default branch if empty
+	Ref string `yaml:"ref"`
+
+	// Path is the path of the file in the git repo, "apps.yaml" if empty
+	Path string `yaml:"path"`
+
+	// TokenEnv names an environment variable with an access token for a private repo or URL
+	TokenEnv string `yaml:"token_env"`
+}
+
+// remoteForbidden are the fields apps of remote fragments can't set: reproducible recipes run on the host, the
+// environment variables could be any secret of the run, a priority would let them take over the versions of other
+// apps, and the others exempt APKs from the tracker, permission and target SDK checks
+var remoteForbidden = []string{
+	"reproducible", "metadata_token_env", "metadata_ssh_key_env", "download_auth",
+	"priority", "tracker_policy", "allowed_trackers", "allowed_permissions", "min_target_sdk",
+}
+
+// isRemoteInclude reports whether the include pattern is the URL of a remote fragment
+func isRemoteInclude(pattern string) bool {
+	return strings.HasPrefix(pattern, "https://") || strings.HasPrefix(pattern, "http://")
+}
+
+// name identifies the fragment in problems, e.g. "https://github.com/example/catalog@main:apps.yaml"
+func (f remoteFragment) name() string {
+	if f.Git == "" {
+		return git.RedactURL(f.URL)
+	}
+	name := git.RedactURL(f.Git)
+	if f.Ref != "" {
+		name += "@" + f.Ref
+	}
+	return name + ":" + f.filePath()
+}
+
+func (f remoteFragment) filePath() string {
+	if f.Path == "" {
+		return "apps.yaml"
+	}
+	return f.Path
+}
+
+func (f remoteFragment) validate() error {
+	switch {
+	case f.Git == "" && f.URL == "":
+		return fmt.Errorf("a remote include needs git or url")
+	case f.Git != "" && f.URL != "":
+		return fmt.Errorf("a remote include can't have both git and url")
+	case f.URL != "" && (f.Ref != "" || f.Path != ""):
+		return fmt.Errorf("ref and path are only used with git")
+	}
+
+	u, err := url.Parse(f.Git + f.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if f.URL != "" && !isRemoteInclude(f.URL) {
+		return fmt.Errorf("invalid URL %q, it must start with https:// or http://", f.URL)
+	}
+	if u.User != nil {
+		return fmt.Errorf("the URL must not contain credentials, set token_env instead")
+	}
+	if strings.HasPrefix(f.Git, "-") || strings.HasPrefix(f.Ref, "-") {
+		return fmt.Errorf("git and ref must not start with \"-\"")
+	}
+	if strings.HasPrefix(path.Clean("/"+f.filePath()), "/..") || strings.HasSuffix(f.filePath(), "/") {
+		return fmt.Errorf("invalid path %q", f.Path)
+	}
+	return nil
+}
+
+// include returns the fragment an include pattern in this fragment refers to. Relative URLs and paths are
+// resolved against the fragment, so a remote fragment can't include local files. The token is only sent to the
+// same host.
+func (f remoteFragment) include(pattern string) (included remoteFragment, err error) {
+	if f.Git != "" && !isRemoteInclude(pattern) {
+		included = f
+		included.Path = strings.TrimPrefix(path.Join(path.Dir("/"+f.filePath()), pattern), "/")
+		return
+	}
+
+	base, err := url.Parse(f.Git + f.URL)
+	if err != nil {
+		return
+	}
+	ref, err := url.Parse(pattern)
+	if err != nil {
+		return
+	}
+	u := base.ResolveReference(ref)
+	if f.Git != "" {
+		// Relative to the repo, not to the URL of its file
+		u = ref
+	}
+
+	included = remoteFragment{URL: u.String()}
+	if u.Host == base.Host {
+		included.TokenEnv = f.TokenEnv
+	}
+	return
+}
+
+var (
+	fragmentLock  sync.Mutex
+	fragmentCache = make(map[remoteFragment][]byte)
+)
+
+// fetch returns the content of the fragment. Fragments are only fetched once per process, so all commands that
+// read the apps file see the same apps.
+func (f remoteFragment) fetch() (content []byte, err error) {
+	fragmentLock.Lock()
+	defer fragmentLock.Unlock()
+
+	if content, ok := fragmentCache[f]; ok {
+		return content, nil
+	}
+
+	var token string
+	if f.TokenEnv != "" {
+		token = os.Getenv(f.TokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("$%s (token_env) is empty", f.TokenEnv)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fragmentTimeout)
+	defer cancel()
+
+	if f.Git != "" {
+		content, err = fetchGitFragment(ctx, f, token)
+	} else {
+		content, err = fetchURLFragment(ctx, f.URL, token)
+	}
+	if err != nil {
+		return
+	}
+
+	fragmentCache[f] = content
+	return
+}
+
+func fetchURLFragment(ctx context.Context, u, token string) (content []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	// Apps files are small, anything larger is likely the wrong URL
+	content, err = io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	return
+}
+
+func fetchGitFragment(ctx context.Context, f remoteFragment, token string) (content []byte, err error) {
+	dir, err := git.CloneRepo(ctx, f.Git, f.Ref, []string{f.filePath()}, git.Credentials{Token: token})
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	return os.ReadFile(filepath.Join(dir, filepath.FromSlash(f.filePath())))
+}
+
+// loadRemote adds the apps of a remote fragment. Problems with fetching it are reported at the include.
+func (l *loader) loadRemote(from string, include *yaml.Node, f remoteFragment, defaults []*yaml.Node, templates map[string]*yaml.Node) {
+	err := f.validate()
+	if err != nil {
+		l.problem(from, include, fmt.Sprintf("invalid include: %s", err))
+		return
+	}
+
+	name := f.name()
+	if l.loading[name] {
+		l.problem(from, include, fmt.Sprintf("%q includes itself", name))
+		return
+	}
+
+	content, err := f.fetch()
+	if err == nil {
+		err = l.parse(name, content, &f, defaults, templates)
+	}
+	if err != nil {
+		l.problem(from, include, fmt.Sprintf("including %q: %s", name, err))
+	}
+}
@@ -36,6 +36,12 @@ type PackageInfo struct {
 }
 
 func (r *RepoIndex) FindLatestPackage(pkgName string) (p PackageInfo, ok bool) {
+	return r.FindLatestPackageFunc(pkgName, nil)
+}
+
+// FindLatestPackageFunc returns the latest version of pkgName for which accept returns true.
+// If accept is nil, all versions are considered.
+func (r *RepoIndex) FindLatestPackageFunc(pkgName string, accept func(PackageInfo) bool) (p PackageInfo, ok bool) {
 	pkgs, ok := r.Packages[pkgName]
 	if !ok {
 		return p, false
@@ -60,7 +66,13 @@ func (r *RepoIndex) FindLatestPackage(pkgName string) (p PackageInfo, ok bool) {
 	})
 
 	// Return the one with the latest version
-	return pkgs[len(pkgs)-1], true
+	for i := len(pkgs) - 1; i >= 0; i-- {
+		if accept == nil || accept(pkgs[i]) {
+			return pkgs[i], true
+		}
+	}
+
+	return p, false
 }
 
 func ReadIndex(path string) (index *RepoIndex, err error) {
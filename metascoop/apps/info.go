@@ -1,33 +1,265 @@
 package apps
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
-	"github.com/google/go-github/v39/github"
 	"golang.org/x/text/runes"
 	"golang.org/x/text/transform"
 	"golang.org/x/text/unicode/norm"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
 )
 
-func FindAPKRelease(release *github.RepositoryRelease) *github.ReleaseAsset {
+// TagVersion returns the versionName the APK released with tag must have. Without a tag pattern, any
+// version is accepted, which is reported as an empty version. ok is false if the tag doesn't match the pattern.
+func (a AppInfo) TagVersion(tag string) (version string, ok bool) {
+	if a.tagPattern == nil {
+		return "", true
+	}
+
+	match := a.tagPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+
+	if i := a.tagPattern.SubexpIndex("version"); i > 0 {
+		return match[i], true
+	}
+	return match[1], true
+}
+
+// FindAPKAssets returns the assets of release that should be considered as APKs of this app, sorted by name.
+// Companion assets are never APKs. If the app accepts bundles, releases without APKs fall back to their APK
+// sets, or to their App Bundles if there are none either.
+func (a AppInfo) FindAPKAssets(release sources.Release) (assets []sources.Asset) {
+	// map[extension]assets, everything that isn't a bundle counts as ".apk"
+	byType := make(map[string][]sources.Asset)
+
 	for _, asset := range release.Assets {
-		if asset.State == nil || *asset.State != "uploaded" {
+		if a.isCompanion(asset.Name) {
+			continue
+		}
+
+		bundle := IsBundle(asset.Name)
+		if bundle && !a.Bundles {
+			continue
+		}
+
+		if a.assetFilter != nil {
+			if !a.assetFilter.MatchString(asset.Name) {
+				continue
+			}
+		} else if !bundle && !strings.HasSuffix(asset.Name, ".apk") {
 			continue
 		}
 
-		if asset.Name != nil && strings.HasSuffix(*asset.Name, ".apk") {
-			return asset
+		if a.assetExclude != nil && a.assetExclude.MatchString(asset.Name) {
+			continue
 		}
+
+		ext := ".apk"
+		if bundle {
+			ext = strings.ToLower(path.Ext(asset.Name))
+		}
+		byType[ext] = append(byType[ext], asset)
 	}
 
-	return nil
+	for _, ext := range []string{".apk", ".apks", ".aab"} {
+		if len(byType[ext]) > 0 {
+			assets = byType[ext]
+			break
+		}
+	}
+
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+
+	return
+}
+
+// IsBundle reports whether the asset name is that of an App Bundle (.aab) or an APK set (.apks)
+func IsBundle(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".aab" || ext == ".apks"
+}
+
+// abiAliases maps substrings of asset names to the Android ABI they indicate. Longer names come first,
+// so "x86_64" isn't detected as "x86".
+var abiAliases = []struct {
+	alias string
+	abi   string
+}{
+	{"arm64-v8a", "arm64-v8a"},
+	{"armeabi-v7a", "armeabi-v7a"},
+	{"x86_64", "x86_64"},
+	{"aarch64", "arm64-v8a"},
+	{"arm64", "arm64-v8a"},
+	{"armv7", "armeabi-v7a"},
+	{"armeabi", "armeabi"},
+	{"x86", "x86"},
+}
+
+// AssetABI returns the ABI an asset was built for according to its name, or an empty string for universal APKs
+func AssetABI(assetName string) string {
+	lower := strings.ToLower(assetName)
+	for _, a := range abiAliases {
+		if strings.Contains(lower, a.alias) {
+			return a.abi
+		}
+	}
+	return ""
+}
+
+// SelectABISplits returns one asset per ABI if the candidates are per-ABI split APKs, and the first universal APK,
+// the one whose name has no ABI, for devices whose ABI has no split. If there are no splits, it returns the first
+// universal APK, and the first candidate only if there is none. Candidates must be sorted by name.
+func SelectABISplits(candidates []sources.Asset) (selected []sources.Asset, ignored []sources.Asset) {
+	var (
+		seen      = make(map[string]bool)
+		universal = -1
+	)
+	for i, c := range candidates {
+		abi := AssetABI(c.Name)
+		if abi == "" && universal < 0 {
+			universal = i
+		}
+		if abi == "" || seen[abi] {
+			continue
+		}
+		seen[abi] = true
+		selected = append(selected, c)
+	}
+
+	if len(selected) >= 2 && universal >= 0 {
+		selected = append(selected, candidates[universal])
+	}
+	if len(selected) < 2 {
+		// Not a split release. A single split sorts before the universal APK, e.g. "app-arm64-v8a.apk" before
+		// "app.apk", so it's only used if there is no universal APK.
+		selected = candidates[:1]
+		for i, c := range candidates {
+			if AssetABI(c.Name) == "" {
+				selected = candidates[i : i+1]
+				break
+			}
+		}
+	}
+
+	for _, c := range candidates {
+		var isSelected bool
+		for _, s := range selected {
+			isSelected = isSelected || s.Name == c.Name
+		}
+		if !isSelected {
+			ignored = append(ignored, c)
+		}
+	}
+
+	return
 }
 
 func GenerateReleaseFilename(appName string, tagName string) string {
-	var normalName = fmt.Sprintf("%s_%s.apk", appName, tagName)
+	return cleanFilename(fmt.Sprintf("%s_%s.apk", appName, tagName))
+}
+
+// GenerateSplitReleaseFilename returns the filename for an APK that only contains native code for abi
+func GenerateSplitReleaseFilename(appName string, tagName string, abi string) string {
+	return cleanFilename(fmt.Sprintf("%s_%s_%s.apk", appName, tagName, abi))
+}
+
+// ReleaseOwner returns the app of list that published the APK with the release file name apkName. Release file
+// names start with the app name, see GenerateReleaseFilename, and the longest matching name wins, so "app" doesn't
+// claim the APKs of "app_beta".
+func ReleaseOwner(list []AppInfo, apkName string) (owner AppInfo, ok bool) {
+	var longest int
+	for _, app := range list {
+		prefix := strings.TrimSuffix(GenerateReleaseFilename(app.Name(), ""), ".apk")
+		if len(prefix) > longest && strings.HasPrefix(apkName, prefix) {
+			owner, ok, longest = app, true, len(prefix)
+		}
+	}
+	return
+}
+
+// FileNameVariables are the values of the variables of a file name template, see GenerateTemplateFilename
+type FileNameVariables struct {
+	App         string
+	Tag         string
+	Package     string
+	VersionName string
+	VersionCode int64
+
+	// ABI is the only ABI a split APK has native code for, empty for other APKs
+	ABI string
+}
+
+// templateVariable matches a variable of a file name template and the separator before it
+var templateVariable = regexp.MustCompile(`([_.-]?)\{([A-Za-z]+)\}`)
+
+// CheckFileNameTemplate returns an error if template can't be used as file name template
+func CheckFileNameTemplate(template string) error {
+	if strings.ContainsAny(template, `/\`) {
+		return errors.New("it must be a file name without directories")
+	}
+
+	var versioned bool
+	for _, m := range templateVariable.FindAllStringSubmatch(template, -1) {
+		switch m[2] {
+		case "tag", "versionName", "versionCode":
+			versioned = true
+		case "app", "package", "abi":
+		default:
+			return fmt.Errorf("unknown variable {%s}, the variables are {app}, {package}, {tag}, {versionName}, {versionCode} and {abi}", m[2])
+		}
+	}
+	if !versioned {
+		return errors.New("it must contain {versionCode}, {versionName} or {tag}, so the versions of an app get different names")
+	}
+	return nil
+}
+
+// GenerateTemplateFilename returns the file name of an APK from template, e.g. "{package}_{versionCode}.apk". A
+// variable without value is left out with the separator before it, so "{package}_{versionCode}_{abi}.apk" of an
+// APK without splits is "<package>_<versionCode>.apk". Split APKs always get their ABI, like with
+// GenerateSplitReleaseFilename, and the name always ends in ".apk".
+func GenerateTemplateFilename(template string, vars FileNameVariables) string {
+	values := map[string]string{
+		"app":         vars.App,
+		"tag":         vars.Tag,
+		"package":     vars.Package,
+		"versionName": vars.VersionName,
+		"versionCode": strconv.FormatInt(vars.VersionCode, 10),
+		"abi":         vars.ABI,
+	}
+
+	var withABI bool
+	name := templateVariable.ReplaceAllStringFunc(template, func(match string) string {
+		m := templateVariable.FindStringSubmatch(match)
+		withABI = withABI || m[2] == "abi"
+
+		value := cleanFilename(values[m[2]])
+		if value == "" {
+			return ""
+		}
+		return m[1] + value
+	})
+
+	name = strings.TrimSuffix(name, ".apk")
+	if vars.ABI != "" && !withABI {
+		name += "_" + cleanFilename(vars.ABI)
+	}
+	return name + ".apk"
+}
+
+func cleanFilename(normalName string) string {
 
 	var tc = transform.Chain(norm.NFD, runes.Remove(runes.Predicate(func(r rune) bool {
 		return unicode.Is(unicode.Mn, r)
@@ -51,23 +283,3 @@ func GenerateReleaseFilename(appName string, tagName string) string {
 		return -1
 	}, cleaned)
 }
-
-func ListAllReleases(githubClient *github.Client, appRepoAuthor, appRepoName string) (allReleases []*github.RepositoryRelease, err error) {
-	var currentPage int = 1
-
-	for {
-		rels, _, ierr := githubClient.Repositories.ListReleases(context.Background(), appRepoAuthor, appRepoName, &github.ListOptions{
-			Page:    currentPage,
-			PerPage: 100,
-		})
-		if ierr != nil || len(rels) == 0 {
-			err = ierr
-			break
-		}
-
-		allReleases = append(allReleases, rels...)
-		currentPage++
-	}
-
-	return
-}
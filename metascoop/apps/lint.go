@@ -0,0 +1,765 @@
+package apps
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// Problem is a mistake in the apps file. Line and Column point to the value it's about, or to the name of the app
+// if the value is missing.
+type Problem struct {
+	// File is the apps file or included file the problem is in
+	File   string
+	Line   int
+	Column int
+
+	// App is empty for problems with the file as a whole
+	App     string
+	Message string
+}
+
+func (p Problem) String() string {
+	pos := strconv.Itoa(p.Line)
+	if p.Column > 0 {
+		pos += ":" + strconv.Itoa(p.Column)
+	}
+	if p.App == "" {
+		return pos + ": " + p.Message
+	}
+	return fmt.Sprintf("%s: app %q: %s", pos, p.App, p.Message)
+}
+
+// FileError is returned by ParseAppFile for an apps file with problems. Its message is the first one.
+type FileError struct {
+	Path     string
+	Problems []Problem
+}
+
+func (e *FileError) Error() string {
+	msg := e.Problems[0].File + ":" + e.Problems[0].String()
+	if n := len(e.Problems) - 1; n > 0 {
+		msg += fmt.Sprintf(" (and %d more, see \"metascoop lint\")", n)
+	}
+	return msg
+}
+
+// typeErrorLine matches the position yaml.v3 puts in front of its type errors
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// Lint reads the apps file at path with the files it includes, and returns the apps together with all mistakes:
+// unknown keys, values of the wrong type, invalid URLs and regular expressions, missing fields and apps that
+// duplicate others. Apps with problems aren't in the list, the others are in the order of the files. err is only
+// set if the file at path can't be read or isn't valid YAML.
+func Lint(path string) (list []AppInfo, problems []Problem, err error) {
+	l := &loader{
+		origins: make(map[*yaml.Node]string),
+		loading: make(map[string]bool),
+		names:   make(map[string]string),
+		files:   make(map[string]int),
+		remote:  make(map[string]bool),
+	}
+	err = l.load(path, nil, nil)
+	if err != nil {
+		return
+	}
+	problems = l.problems
+
+	// map[package name]apps and map[assets]app, to find entries that publish the same
+	var (
+		packages = make(map[string][]AppInfo)
+		assets   = make(map[string]string)
+	)
+
+	// map[package name]app of the local files, remote apps can't publish their packages
+	local := make(map[string]string)
+	for _, e := range l.entries {
+		if pkg := fieldValue(e.key, e.value, "package"); pkg != e.key && !l.remote[e.file] && local[pkg.Value] == "" {
+			local[pkg.Value] = e.key.Value
+		}
+	}
+
+	for _, e := range l.entries {
+		valid := true
+		report := func(node *yaml.Node, msg string) {
+			file := e.file
+			if origin, ok := l.origins[node]; ok {
+				file = origin
+			}
+			problems = append(problems, Problem{File: file, Line: node.Line, Column: node.Column, App: e.key.Value, Message: msg})
+			valid = false
+		}
+
+		unknownKeys(e.value, reflect.TypeOf(AppInfo{}), report)
+
+		var a AppInfo
+		derr := e.value.Decode(&a)
+		var typeErr *yaml.TypeError
+		if errors.As(derr, &typeErr) {
+			for _, msg := range typeErr.Errors {
+				p := Problem{File: e.file, App: e.key.Value, Message: msg}
+				if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+					p.Line, _ = strconv.Atoi(m[1])
+					p.Message = m[2]
+				}
+				problems = append(problems, p)
+			}
+			valid = false
+		} else if derr != nil {
+			report(e.key, derr.Error())
+		}
+		a.keyName = e.key.Value
+		a.file = e.file
+
+		a.validate(func(field string, err error) {
+			report(fieldValue(e.key, e.value, field), err.Error())
+		})
+		a.remote = l.remote[e.file]
+
+		for _, field := range remoteForbidden {
+			node := fieldValue(e.key, e.value, field)
+			file := e.file
+			if origin, ok := l.origins[node]; ok {
+				file = origin
+			}
+			if node != e.key && l.remote[file] {
+				report(node, fmt.Sprintf("%s can't be set in remote fragments, only in the files of this repo", field))
+			}
+		}
+		other, claimed := local[a.PackageName]
+		claimed = claimed && a.remote
+		switch {
+		case a.remote && a.PackageName == "":
+			report(e.key, "apps of remote fragments must set package, so they can't publish the packages of other apps")
+		case claimed:
+			// Setting priority wouldn't help, so this replaces the problem about apps with the same package
+			report(fieldValue(e.key, e.value, "package"), fmt.Sprintf("package %q is published by app %q of this repo, remote fragments can't publish it", a.PackageName, other))
+		}
+
+		if a.PackageName != "" && !claimed {
+			for _, other := range packages[a.PackageName] {
+				if other.Priority == a.Priority {
+					report(fieldValue(e.key, e.value, "package"), fmt.Sprintf("package %q is already published by app %q, set priority to decide which one publishes versions both have", a.PackageName, other.Name()))
+					break
+				}
+			}
+			packages[a.PackageName] = append(packages[a.PackageName], a)
+		}
+		if other, ok := assets[a.assetsKey()]; ok && a.GitURL != "" {
+			report(fieldValue(e.key, e.value, "git"), fmt.Sprintf("publishes the same assets as app %q, set asset_filter or tag_pattern to tell them apart", other))
+		}
+		assets[a.assetsKey()] = a.Name()
+
+		if valid {
+			list = append(list, a)
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return l.files[problems[i].File] < l.files[problems[j].File]
+		}
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+
+	return
+}
+
+// Top-level keys of apps files that aren't apps
+const (
+	// keyInclude is a path or list of paths of more apps files, relative to the file. They may contain globs
+	// like "apps/*.yaml", whose matches are included in lexical order. Remote fragments are included by their URL
+	// or git repo, see remoteFragment.
+	keyInclude = "include"
+
+	// keyDefaults are settings all apps in the file and the files it includes start with. The settings of an app
+	// replace them key by key, as do the defaults of included files.
+	keyDefaults = "defaults"
+
+	// keyTemplates are named settings apps can start with by setting "template" to the name. They replace the
+	// defaults key by key and are visible in the file and the files it includes.
+	keyTemplates = "templates"
+
+	// keyTemplate selects a template in the settings of an app
+	keyTemplate = "template"
+)
+
+// entry is an app from one of the files, with its template and defaults merged into the settings
+type entry struct {
+	file       string
+	key, value *yaml.Node
+}
+
+// loader collects the apps of an apps file and the files it includes
+type loader struct {
+	entries  []entry
+	problems []Problem
+
+	// origins are the files of settings that were merged into apps from other files
+	origins map[*yaml.Node]string
+	loading map[string]bool
+	names   map[string]string
+
+	// files are numbered in the order they were read, problems are sorted by it
+	files map[string]int
+
+	// remote are the names of the remote fragments that were included
+	remote map[string]bool
+}
+
+func (l *loader) problem(file string, node *yaml.Node, msg string) {
+	l.problems = append(l.problems, Problem{File: file, Line: node.Line, Column: node.Column, Message: msg})
+}
+
+// load adds the apps of the file at path. defaults are key/value pairs and templates map names to mappings, both
+// are inherited from the including files.
+func (l *loader) load(path string, defaults []*yaml.Node, templates map[string]*yaml.Node) (err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return l.parse(path, content, nil, defaults, templates)
+}
+
+// parse adds the apps of the apps file called path with the given content. remote is the fragment it was fetched
+// from, nil for local files.
+func (l *loader) parse(path string, content []byte, remote *remoteFragment, defaults []*yaml.Node, templates map[string]*yaml.Node) (err error) {
+	var doc yaml.Node
+	err = yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return fmt.Errorf("%s doesn't contain any apps", path)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		l.problem(path, root, "the file must map the names of apps to their settings")
+		return
+	}
+
+	abs, _ := filepath.Abs(path)
+	if remote != nil {
+		abs = path
+		l.remote[path] = true
+	}
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+	if _, ok := l.files[path]; !ok {
+		l.files[path] = len(l.files)
+	}
+
+	var includes []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case keyInclude:
+			includes = append(includes, value)
+		case keyDefaults:
+			if value.Kind != yaml.MappingNode {
+				l.problem(path, value, "defaults must be a mapping of settings")
+				continue
+			}
+			defaults = mergePairs(expandMerges(value.Content), defaults)
+			l.remember(path, value.Content)
+		case keyTemplates:
+			if value.Kind != yaml.MappingNode {
+				l.problem(path, value, "templates must map names to settings")
+				continue
+			}
+			inherited := templates
+			templates = make(map[string]*yaml.Node, len(inherited))
+			for name, t := range inherited {
+				templates[name] = t
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name, t := value.Content[j], value.Content[j+1]
+				if t.Kind != yaml.MappingNode {
+					l.problem(path, t, fmt.Sprintf("template %q must be a mapping of settings", name.Value))
+					continue
+				}
+				templates[name.Value] = t
+				l.remember(path, t.Content)
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		switch key.Value {
+		case keyInclude, keyDefaults, keyTemplates:
+			continue
+		}
+
+		if other, ok := l.names[key.Value]; ok {
+			l.problems = append(l.problems, Problem{File: path, Line: key.Line, Column: key.Column, App: key.Value, Message: fmt.Sprintf("there is another app with this name in %s", other)})
+			continue
+		}
+		l.names[key.Value] = path
+
+		settings, ok := l.settings(path, key, value, defaults, templates)
+		if ok {
+			l.entries = append(l.entries, entry{file: path, key: key, value: settings})
+		}
+	}
+
+	for _, include := range includes {
+		var patterns []*yaml.Node
+		switch include.Kind {
+		case yaml.ScalarNode:
+			patterns = []*yaml.Node{include}
+		case yaml.SequenceNode:
+			patterns = include.Content
+		case yaml.MappingNode:
+			patterns = []*yaml.Node{include}
+		default:
+			l.problem(path, include, "include must be a path, a URL, a git repo or a list of them")
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if pattern.Kind == yaml.MappingNode {
+				var f remoteFragment
+				valid := true
+				unknownKeys(pattern, reflect.TypeOf(f), func(node *yaml.Node, msg string) {
+					l.problem(path, node, msg)
+					valid = false
+				})
+				if derr := pattern.Decode(&f); derr != nil {
+					l.problem(path, pattern, fmt.Sprintf("invalid include: %s", derr))
+					continue
+				}
+				if remote != nil && f.TokenEnv != "" {
+					l.problem(path, pattern, "token_env can't be set in remote fragments, they could send any secret of the run")
+					continue
+				}
+				if valid {
+					l.loadRemote(path, pattern, f, defaults, templates)
+				}
+				continue
+			}
+			if pattern.Kind != yaml.ScalarNode {
+				l.problem(path, pattern, "an include must be a path, a URL or a git repo")
+				continue
+			}
+			if remote != nil || isRemoteInclude(pattern.Value) {
+				f := remoteFragment{URL: pattern.Value}
+				if remote != nil {
+					var ierr error
+					f, ierr = remote.include(pattern.Value)
+					if ierr != nil {
+						l.problem(path, pattern, fmt.Sprintf("invalid include %q: %s", pattern.Value, ierr))
+						continue
+					}
+				}
+				l.loadRemote(path, pattern, f, defaults, templates)
+				continue
+			}
+
+			p := pattern.Value
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(filepath.Dir(path), p)
+			}
+			matches, gerr := filepath.Glob(p)
+			if gerr != nil {
+				l.problem(path, pattern, fmt.Sprintf("invalid include pattern %q: %s", pattern.Value, gerr))
+				continue
+			}
+			if len(matches) == 0 {
+				l.problem(path, pattern, fmt.Sprintf("included file %q doesn't exist", pattern.Value))
+				continue
+			}
+			sort.Strings(matches)
+
+			for _, match := range matches {
+				matchAbs, _ := filepath.Abs(match)
+				if l.loading[matchAbs] {
+					l.problem(path, pattern, fmt.Sprintf("%q includes itself", match))
+					continue
+				}
+
+				ierr := l.load(match, defaults, templates)
+				if ierr != nil {
+					l.problem(path, pattern, fmt.Sprintf("including %q: %s", match, ierr))
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// remember that the values of pairs come from file
+func (l *loader) remember(file string, pairs []*yaml.Node) {
+	for i := 1; i < len(pairs); i += 2 {
+		l.origins[pairs[i]] = file
+	}
+}
+
+// settings returns the settings of an app with its template and the defaults merged in
+func (l *loader) settings(file string, key, value *yaml.Node, defaults []*yaml.Node, templates map[string]*yaml.Node) (settings *yaml.Node, ok bool) {
+	var own []*yaml.Node
+	switch {
+	case value.Kind == yaml.MappingNode:
+		own = value.Content
+	case value.Kind == yaml.ScalarNode && value.Tag == "!!null":
+	default:
+		l.problems = append(l.problems, Problem{File: file, Line: value.Line, Column: value.Column, App: key.Value, Message: "the settings of an app must be a mapping"})
+		return nil, false
+	}
+
+	var template []*yaml.Node
+	var withoutTemplate []*yaml.Node
+	own = expandMerges(own)
+	for i := 0; i+1 < len(own); i += 2 {
+		if own[i].Value != keyTemplate {
+			withoutTemplate = append(withoutTemplate, own[i], own[i+1])
+			continue
+		}
+
+		t, found := templates[own[i+1].Value]
+		if !found {
+			l.problems = append(l.problems, Problem{File: file, Line: own[i+1].Line, Column: own[i+1].Column, App: key.Value, Message: fmt.Sprintf("there is no template called %q", own[i+1].Value)})
+			return nil, false
+		}
+		template = expandMerges(t.Content)
+	}
+
+	settings = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: key.Line, Column: key.Column}
+	settings.Content = mergePairs(withoutTemplate, mergePairs(template, defaults))
+	return settings, true
+}
+
+// mergePairs returns the key/value pairs of base with those of over replacing the ones with the same key. The
+// order is that of base, followed by the keys that are only in over.
+func mergePairs(over, base []*yaml.Node) (merged []*yaml.Node) {
+	index := make(map[string]int)
+	for i := 0; i+1 < len(base); i += 2 {
+		index[base[i].Value] = len(merged)
+		merged = append(merged, base[i], base[i+1])
+	}
+	for i := 0; i+1 < len(over); i += 2 {
+		if j, ok := index[over[i].Value]; ok && over[i].Value != "<<" {
+			merged[j], merged[j+1] = over[i], over[i+1]
+			continue
+		}
+		index[over[i].Value] = len(merged)
+		merged = append(merged, over[i], over[i+1])
+	}
+	return
+}
+
+// expandMerges replaces the "<<" merge keys in pairs with the pairs of the merged mappings, so they have the same
+// precedence as the other keys when settings are merged. As in YAML, keys set in pairs win over merged ones, and
+// earlier merged mappings win over later ones.
+func expandMerges(pairs []*yaml.Node) (expanded []*yaml.Node) {
+	var merged []*yaml.Node
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i].ShortTag() != "!!merge" {
+			expanded = append(expanded, pairs[i], pairs[i+1])
+			continue
+		}
+
+		value := pairs[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		sources := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			sources = value.Content
+		}
+		for j := len(sources) - 1; j >= 0; j-- {
+			source := sources[j]
+			if source.Kind == yaml.AliasNode {
+				source = source.Alias
+			}
+			if source.Kind != yaml.MappingNode {
+				// Left for Decode to report
+				expanded = append(expanded, pairs[i], pairs[i+1])
+				break
+			}
+			merged = mergePairs(expandMerges(source.Content), merged)
+		}
+	}
+	return mergePairs(expanded, merged)
+}
+
+var unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+
+// unknownKeys reports the keys in node that t doesn't have a field for, also in nested settings
+func unknownKeys(node *yaml.Node, t reflect.Type, report func(node *yaml.Node, msg string)) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			// The decoder reports the type error
+			return
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fields[name] = f.Type
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				// Merge keys reference mappings with more settings of the same type
+				merged := []*yaml.Node{value}
+				if value.Kind == yaml.SequenceNode {
+					merged = value.Content
+				}
+				for _, m := range merged {
+					unknownKeys(m, t, report)
+				}
+				continue
+			}
+
+			ft, ok := fields[key.Value]
+			if !ok {
+				report(key, fmt.Sprintf("unknown key %q", key.Value))
+				continue
+			}
+			unknownKeys(value, ft, report)
+		}
+	case reflect.Slice:
+		if node.Kind == yaml.SequenceNode {
+			for _, item := range node.Content {
+				unknownKeys(item, t.Elem(), report)
+			}
+		}
+	case reflect.Map:
+		if node.Kind == yaml.MappingNode {
+			for i := 1; i < len(node.Content); i += 2 {
+				unknownKeys(node.Content[i], t.Elem(), report)
+			}
+		}
+	}
+}
+
+// fieldValue returns the node of the value of field in the settings of an app, or the name of the app if the
+// field isn't set
+func fieldValue(key, value *yaml.Node, field string) *yaml.Node {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if value.Content[i].Value == field {
+				return value.Content[i+1]
+			}
+		}
+	}
+	return key
+}
+
+// assetsKey identifies the assets an app publishes, apps with the same key publish the same APKs
+func (a *AppInfo) assetsKey() string {
+	return strings.Join([]string{
+		strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(a.GitURL, "/"), ".git")),
+		a.Source, a.AssetFilter, a.AssetExclude, a.TagPattern, a.Workflow, a.Branch, a.APKURL, a.FDroidRepo, a.PackageName,
+	}, "\x00")
+}
+
+// validate checks the settings of the app and compiles its regular expressions. Problems are reported with the key
+// of the field they're about.
+func (a *AppInfo) validate(report func(field string, err error)) {
+	var err error
+
+	u, uerr := url.ParseRequestURI(a.GitURL)
+	switch {
+	case a.GitURL == "":
+		report("git", errors.New("git must be set to the URL of the app's repository"))
+	case uerr != nil:
+		report("git", fmt.Errorf("invalid git URL %q: %w", a.GitURL, uerr))
+	case (u.Scheme != "https" && u.Scheme != "http") || u.Host == "":
+		report("git", fmt.Errorf("invalid git URL %q, it must be an HTTPS URL like https://github.com/owner/repo", a.GitURL))
+	default:
+		split := strings.Split(strings.Trim(u.Path, "/"), "/")
+		a.repoAuthor = split[0]
+
+		if a.Source != sources.KindURL && a.Source != sources.KindFDroid && len(split) < 2 {
+			report("git", fmt.Errorf("git URL %q must contain both owner and name of the repository", a.GitURL))
+		}
+	}
+
+	switch a.Source {
+	case "", sources.KindGitHub, sources.KindGitLab, sources.KindGitea, sources.KindURL, sources.KindFDroid, sources.KindActions:
+	default:
+		report("source", fmt.Errorf("unknown source %q, must be one of %q, %q, %q, %q, %q or %q", a.Source,
+			sources.KindGitHub, sources.KindGitLab, sources.KindGitea, sources.KindURL, sources.KindFDroid, sources.KindActions))
+	}
+
+	if a.AssetFilter != "" {
+		a.assetFilter, err = regexp.Compile(a.AssetFilter)
+		if err != nil {
+			report("asset_filter", fmt.Errorf("invalid asset_filter: %w", err))
+		}
+	}
+	if a.AssetExclude != "" {
+		a.assetExclude, err = regexp.Compile(a.AssetExclude)
+		if err != nil {
+			report("asset_exclude", fmt.Errorf("invalid asset_exclude: %w", err))
+		}
+	}
+
+	for i := range a.Companions {
+		err = a.Companions[i].compile()
+		if err != nil {
+			report("companions", fmt.Errorf("invalid companion %d: %w", i+1, err))
+		}
+	}
+
+	if a.TagPattern != "" {
+		a.tagPattern, err = regexp.Compile(a.TagPattern)
+		switch {
+		case err != nil:
+			report("tag_pattern", fmt.Errorf("invalid tag_pattern: %w", err))
+		case a.tagPattern.NumSubexp() == 0:
+			report("tag_pattern", errors.New("invalid tag_pattern: it needs a group that captures the version"))
+		}
+	}
+
+	if a.Source == sources.KindURL {
+		err = a.compileURLSource()
+		if err != nil {
+			report("apk_url", fmt.Errorf("invalid url source: %w", err))
+		}
+	} else if a.APKURL != "" || a.VersionURL != "" || a.VersionRegex != "" {
+		report("apk_url", fmt.Errorf("apk_url, version_url and version_regex need source %q", sources.KindURL))
+	}
+
+	if a.Source == sources.KindFDroid {
+		if _, uerr := url.ParseRequestURI(a.FDroidRepo); uerr != nil {
+			report("fdroid_repo", fmt.Errorf("invalid fdroid_repo %q: %w", a.FDroidRepo, uerr))
+		}
+		if a.PackageName == "" {
+			report("package", fmt.Errorf("package must be set for source %q", sources.KindFDroid))
+		}
+	} else if a.FDroidRepo != "" {
+		report("fdroid_repo", fmt.Errorf("fdroid_repo needs source %q", sources.KindFDroid))
+	}
+
+	if a.Source == sources.KindActions {
+		err = a.checkActionsSource()
+		if err != nil {
+			report("workflow", fmt.Errorf("invalid github-actions source: %w", err))
+		}
+	} else if a.Workflow != "" || a.Branch != "" || a.VersionCode != "" {
+		report("workflow", fmt.Errorf("workflow, branch and version_code need source %q", sources.KindActions))
+	}
+
+	if a.MetadataRepo != "" && !scpLikeURL.MatchString(a.MetadataRepo) {
+		if _, uerr := url.ParseRequestURI(a.MetadataRepo); uerr != nil {
+			report("metadata_repo", fmt.Errorf("invalid metadata_repo %q: %w", a.MetadataRepo, uerr))
+		}
+	}
+	if a.MetadataPath != "" {
+		cleaned := path.Clean("/" + a.MetadataPath)
+		if cleaned == "/" || strings.Contains(a.MetadataPath, "..") {
+			report("metadata_path", fmt.Errorf("invalid metadata_path %q, it must be a directory within the repo", a.MetadataPath))
+		} else {
+			a.MetadataPath = strings.TrimPrefix(cleaned, "/")
+		}
+	}
+
+	if a.FileNameTemplate != "" {
+		if terr := CheckFileNameTemplate(a.FileNameTemplate); terr != nil {
+			report("file_name", fmt.Errorf("invalid file_name %q: %w", a.FileNameTemplate, terr))
+		}
+	}
+
+	if a.MetadataGitRef != "" {
+		switch {
+		case strings.HasPrefix(a.MetadataGitRef, "-") || strings.ContainsAny(a.MetadataGitRef, " \t\n~^:?*[\\") || strings.Contains(a.MetadataGitRef, ".."):
+			report("metadata_ref", fmt.Errorf("invalid metadata_ref %q, it must be the name of a branch or tag", a.MetadataGitRef))
+		case a.MetadataFromRelease:
+			report("metadata_ref", errors.New("metadata_ref and metadata_from_release can't both be set, metadata_ref names the branch or tag to use"))
+		}
+	}
+
+	err = validateAntiFeatures(a.AntiFeatures)
+	if err != nil {
+		report("anti_features", fmt.Errorf("invalid anti_features: %w", err))
+	}
+	for i := range a.VersionAntiFeatures {
+		err = a.VersionAntiFeatures[i].compile()
+		if err != nil {
+			report("version_anti_features", fmt.Errorf("invalid version_anti_features: %w", err))
+		}
+	}
+
+	switch a.Channel {
+	case "":
+		a.Channel = ChannelStable
+	case ChannelStable, ChannelBeta, ChannelAll:
+	default:
+		report("channel", fmt.Errorf("invalid channel %q, must be one of %q, %q or %q", a.Channel, ChannelStable, ChannelBeta, ChannelAll))
+	}
+
+	if a.Reproducible != nil {
+		err = a.Reproducible.validate()
+		if err != nil {
+			report("reproducible", fmt.Errorf("invalid reproducible build: %w", err))
+		}
+	}
+
+	if a.OSV != nil {
+		err = a.OSV.validate()
+		if err != nil {
+			report("osv", fmt.Errorf("invalid osv: %w", err))
+		}
+	}
+
+	if a.DownloadAuth != nil {
+		err = a.DownloadAuth.validate()
+		if err != nil {
+			report("download_auth", fmt.Errorf("invalid download_auth: %w", err))
+		}
+	}
+
+	switch a.TrackerPolicy {
+	case "", TrackerPolicyIgnore, TrackerPolicyFlag, TrackerPolicyBlock:
+	default:
+		report("tracker_policy", fmt.Errorf("invalid tracker_policy %q, must be one of %q, %q or %q", a.TrackerPolicy, TrackerPolicyIgnore, TrackerPolicyFlag, TrackerPolicyBlock))
+	}
+
+	if a.Pin != "" && a.Frozen {
+		report("pin", fmt.Errorf("pin and frozen can't be combined, a frozen app doesn't get any new version"))
+	}
+	if _, ok := a.TagVersion(a.Pin); a.Pin != "" && !ok {
+		report("pin", fmt.Errorf("the pinned tag %q doesn't match tag_pattern", a.Pin))
+	}
+}
@@ -2,6 +2,7 @@ package apps
 
 import (
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -18,6 +19,8 @@ func ReadMetaFile(path string) (d map[string]interface{}, err error) {
 	return
 }
 
+// WriteMetaFile writes the metadata file at path. Keys are sorted and the line endings of values normalized, so
+// the file only changes if its content does.
 func WriteMetaFile(path string, data map[string]interface{}) (err error) {
 	tmpPath := path + ".tmp"
 	f, err := os.Create(tmpPath)
@@ -25,7 +28,7 @@ func WriteMetaFile(path string, data map[string]interface{}) (err error) {
 		return
 	}
 
-	err = yaml.NewEncoder(f).Encode(data)
+	err = yaml.NewEncoder(f).Encode(normalizeValue(data))
 	if err != nil {
 		_ = f.Close()
 		return
@@ -38,3 +41,45 @@ func WriteMetaFile(path string, data map[string]interface{}) (err error) {
 
 	return os.Rename(tmpPath, path)
 }
+
+// NormalizeText returns s with LF line endings, ending in a single newline unless it's empty. Texts copied from
+// upstream repos are normalized so that a change of editor upstream isn't a change of the repo. Whitespace at the
+// end of lines is kept, it's a line break in markdown.
+func NormalizeText(s string) string {
+	s = strings.TrimRight(normalizeLineEndings(s), "\n")
+	if s == "" {
+		return ""
+	}
+	return s + "\n"
+}
+
+func normalizeLineEndings(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\r", "\n")
+}
+
+// normalizeValue returns v with the line endings of all strings in it normalized
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return normalizeLineEndings(v)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalizeValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, e := range v {
+			l[i] = normalizeValue(e)
+		}
+		return l
+	case []string:
+		l := make([]string, len(v))
+		for i, e := range v {
+			l[i] = normalizeLineEndings(e)
+		}
+		return l
+	}
+	return v
+}
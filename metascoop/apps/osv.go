@@ -0,0 +1,66 @@
+package apps
+
+import (
+	"fmt"
+)
+
+const (
+	// OSVVersionName looks up the version name of an APK, like ecosystems with version numbers expect
+	OSVVersionName = "version_name"
+
+	// OSVVersionTag looks up the tag of the release, like the "GIT" ecosystem expects
+	OSVVersionTag = "tag"
+)
+
+// OSVPackage is the package under which upstream publishes security advisories for an app in the OSV database,
+// see https://osv.dev. The published versions are looked up there, e.g. to mark them with "KnownVuln".
+type OSVPackage struct {
+	// Ecosystem is the OSV ecosystem of the package, e.g. "Maven", "npm" or "GIT"
+	Ecosystem string `yaml:"ecosystem"`
+
+	// Name is the package name in the ecosystem. For "GIT", it defaults to the URL of the app's repo.
+	Name string `yaml:"name"`
+
+	// Version is what's looked up, see the OSVVersion* constants. Defaults to OSVVersionTag for "GIT" and to
+	// OSVVersionName otherwise.
+	Version string `yaml:"version"`
+}
+
+// OSVQuery returns the OSV package of the app and the version that's looked up for the APK with versionName of the
+// release with tag. ok is false if the app has no OSV package.
+func (a AppInfo) OSVQuery(tag, versionName string) (ecosystem, name, version string, ok bool) {
+	if a.OSV == nil {
+		return
+	}
+
+	name = a.OSV.Name
+	if name == "" && a.OSV.Ecosystem == "GIT" {
+		name = a.GitURL
+	}
+
+	source := a.OSV.Version
+	if source == "" && a.OSV.Ecosystem == "GIT" {
+		source = OSVVersionTag
+	}
+	version = versionName
+	if source == OSVVersionTag {
+		version = tag
+	}
+
+	return a.OSV.Ecosystem, name, version, version != ""
+}
+
+func (o *OSVPackage) validate() error {
+	if o.Ecosystem == "" {
+		return fmt.Errorf("ecosystem must be set")
+	}
+	if o.Name == "" && o.Ecosystem != "GIT" {
+		return fmt.Errorf("name must be set for ecosystem %q", o.Ecosystem)
+	}
+	switch o.Version {
+	case "", OSVVersionName, OSVVersionTag:
+	default:
+		return fmt.Errorf("invalid version %q, must be %q or %q", o.Version, OSVVersionName, OSVVersionTag)
+	}
+	return nil
+}
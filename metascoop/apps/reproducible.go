@@ -0,0 +1,41 @@
+package apps
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ReproducibleBuild is a recipe that builds an APK from the source of its release tag. If the result has the same
+// contents as the upstream APK (apart from the signature), the upstream APK was built from that source.
+type ReproducibleBuild struct {
+	// Recipe is a shell command that builds the APK in a checkout of the release tag, e.g. "./gradlew assembleRelease"
+	Recipe string `yaml:"recipe"`
+
+	// Image is the container image the recipe runs in, with the checkout mounted at /src, e.g.
+	// "docker.io/library/gradle:8-jdk17". Without it, the recipe runs on the host.
+	Image string `yaml:"image"`
+
+	// Output is a glob of the built APKs relative to the checkout, e.g. "app/build/outputs/apk/release/*.apk".
+	// If several APKs match, one of them must have the contents of the upstream APK.
+	Output string `yaml:"output"`
+
+	// Required rejects APKs that can't be reproduced, instead of publishing them without marking them as verified
+	Required bool `yaml:"required"`
+}
+
+func (r *ReproducibleBuild) validate() (err error) {
+	if r.Recipe == "" {
+		return fmt.Errorf("recipe must be set")
+	}
+	if r.Output == "" {
+		return fmt.Errorf("output must be set")
+	}
+	if _, err = path.Match(r.Output, ""); err != nil {
+		return fmt.Errorf("invalid output %q: %w", r.Output, err)
+	}
+	if strings.HasPrefix(r.Output, "/") || strings.Contains(r.Output, "..") {
+		return fmt.Errorf("invalid output %q, it must be a path within the checkout", r.Output)
+	}
+	return
+}
@@ -1,15 +1,42 @@
 package apps
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 type RepoMetadata struct {
+	// Screenshots are all images with "screenshot" in their path, used if the repo has no fastlane images
 	Screenshots []string
+
+	// Images maps locales to image kinds ("icon", "featureGraphic", ...) to the fastlane image
+	Images map[string]map[string]string
+
+	// LocalizedScreenshots maps locales to screenshot directories ("phoneScreenshots", ...) to the
+	// fastlane screenshots in them, in the order they should be shown
+	LocalizedScreenshots map[string]map[string][]string
+
+	// Texts maps locales to the names of FastlaneTextFiles to their path
+	Texts map[string]map[string]string
+
+	// Changelogs maps locales to versionCodes to the path of the fastlane changelog for that version
+	Changelogs map[string]map[int]string
 }
 
+// FastlaneTextFiles are the localized texts of a fastlane locale: the app name, summary and description
+var FastlaneTextFiles = []string{"title.txt", "short_description.txt", "full_description.txt"}
+
+// FastlaneImageKinds are the single images of a fastlane locale, named <kind>.png or <kind>.jpg
+var FastlaneImageKinds = []string{"icon", "featureGraphic", "promoGraphic", "tvBanner"}
+
+// FastlaneScreenshotDirs are the screenshot directories of a fastlane locale
+var FastlaneScreenshotDirs = []string{"phoneScreenshots", "sevenInchScreenshots", "tenInchScreenshots", "tvScreenshots", "wearScreenshots"}
+
 var imageSuffixes = map[string]bool{
 	"png":  true,
 	"jpg":  true,
@@ -20,17 +47,55 @@ func hasImageSuffix(path string) bool {
 	return imageSuffixes[strings.TrimPrefix(filepath.Ext(path), ".")]
 }
 
-func FindMetadata(clonedRepoPath string) (r RepoMetadata, err error) {
+// FindMetadata collects the metadata in a cloned repo. By default, fastlane directories are searched everywhere
+// in the repo. If metadataPath is set, it is the directory within the repo that contains the locale directories,
+// e.g. "fastlane/metadata/android" or "metadata".
+func FindMetadata(clonedRepoPath, metadataPath string) (r RepoMetadata, err error) {
 	abs, err := filepath.Abs(clonedRepoPath)
 	if err != nil {
 		return
 	}
 
+	var root string
+	if metadataPath != "" {
+		root = filepath.Join(abs, filepath.FromSlash(metadataPath))
+		abs = root
+	}
+
 	err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
 		if err != nil || d.IsDir() {
 			return err
 		}
 
+		if locale, rest, ok := localeFile(root, path); ok {
+			if name, ok := fastlaneText(rest); ok {
+				if r.Texts == nil {
+					r.Texts = make(map[string]map[string]string)
+				}
+				if r.Texts[locale] == nil {
+					r.Texts[locale] = make(map[string]string)
+				}
+				r.Texts[locale][name] = path
+				return nil
+			}
+
+			if versionCode, ok := fastlaneChangelog(rest); ok {
+				if r.Changelogs == nil {
+					r.Changelogs = make(map[string]map[int]string)
+				}
+				if r.Changelogs[locale] == nil {
+					r.Changelogs[locale] = make(map[int]string)
+				}
+				r.Changelogs[locale][versionCode] = path
+				return nil
+			}
+
+			if kind, dir, ok := fastlaneImage(rest); ok && hasImageSuffix(path) {
+				r.addImage(locale, kind, dir, path)
+				return nil
+			}
+		}
+
 		lp := strings.ToLower(path)
 
 		if strings.Contains(lp, "screenshot") && hasImageSuffix(path) {
@@ -40,6 +105,150 @@ func FindMetadata(clonedRepoPath string) (r RepoMetadata, err error) {
 
 		return nil
 	})
+	if errors.Is(err, fs.ErrNotExist) && root != "" {
+		return r, fmt.Errorf("metadata path %q doesn't exist in the repo", metadataPath)
+	}
+
+	for _, dirs := range r.LocalizedScreenshots {
+		for _, paths := range dirs {
+			sortNatural(paths)
+		}
+	}
+
+	return
+}
+
+func (r *RepoMetadata) addImage(locale, kind, dir, path string) {
+	if kind != "" {
+		if r.Images == nil {
+			r.Images = make(map[string]map[string]string)
+		}
+		if r.Images[locale] == nil {
+			r.Images[locale] = make(map[string]string)
+		}
+		r.Images[locale][kind] = path
+		return
+	}
+
+	if r.LocalizedScreenshots == nil {
+		r.LocalizedScreenshots = make(map[string]map[string][]string)
+	}
+	if r.LocalizedScreenshots[locale] == nil {
+		r.LocalizedScreenshots[locale] = make(map[string][]string)
+	}
+	r.LocalizedScreenshots[locale][dir] = append(r.LocalizedScreenshots[locale][dir], path)
+}
+
+// HasFastlaneImages reports whether the repo contains images in the fastlane layout
+func (r RepoMetadata) HasFastlaneImages() bool {
+	return len(r.Images) > 0 || len(r.LocalizedScreenshots) > 0
+}
+
+// localeFile splits path into the locale and the path within the locale directory. If root is empty, path must be
+// in the fastlane layout: fastlane/metadata/android/<locale>/<rest...>, otherwise it's root/<locale>/<rest...>.
+func localeFile(root, path string) (locale string, rest []string, ok bool) {
+	if root != "" {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return "", nil, false
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) < 2 || parts[0] == ".." {
+			return "", nil, false
+		}
+		return parts[0], parts[1:], true
+	}
+
+	parts := strings.Split(filepath.ToSlash(path), "/")
 
+	for i := len(parts) - 2; i >= 3; i-- {
+		if parts[i-1] == "android" && parts[i-2] == "metadata" && parts[i-3] == "fastlane" && parts[i] != "" {
+			return parts[i], parts[i+1:], true
+		}
+	}
+
+	return "", nil, false
+}
+
+// fastlaneImage reports whether the path within a locale directory is an image, either
+// images/<kind>.png or images/<dir>/<name>.png. F-Droid's own layout doesn't have the images directory.
+func fastlaneImage(rest []string) (kind, dir string, ok bool) {
+	if len(rest) > 1 && rest[0] == "images" {
+		rest = rest[1:]
+	}
+
+	switch len(rest) {
+	case 1:
+		name := strings.TrimSuffix(rest[0], filepath.Ext(rest[0]))
+		for _, k := range FastlaneImageKinds {
+			if name == k {
+				return k, "", true
+			}
+		}
+	case 2:
+		for _, d := range FastlaneScreenshotDirs {
+			if rest[0] == d {
+				return "", d, true
+			}
+		}
+	}
+
+	return "", "", false
+}
+
+// fastlaneChangelog reports whether the path within a locale directory is a changelog, changelogs/<versionCode>.txt
+func fastlaneChangelog(rest []string) (versionCode int, ok bool) {
+	if len(rest) != 2 || rest[0] != "changelogs" || !strings.HasSuffix(rest[1], ".txt") {
+		return 0, false
+	}
+
+	versionCode, err := strconv.Atoi(strings.TrimSuffix(rest[1], ".txt"))
+	if err != nil || versionCode <= 0 {
+		return 0, false
+	}
+
+	return versionCode, true
+}
+
+// textAliases maps the text file names of other layouts (F-Droid, Triple-T) to FastlaneTextFiles
+var textAliases = map[string]string{
+	"name.txt":              "title.txt",
+	"summary.txt":           "short_description.txt",
+	"description.txt":       "full_description.txt",
+	"short-description.txt": "short_description.txt",
+	"full-description.txt":  "full_description.txt",
+}
+
+// fastlaneText reports whether the path within a locale directory is one of the FastlaneTextFiles or an alias of one
+func fastlaneText(rest []string) (name string, ok bool) {
+	if len(rest) != 1 {
+		return "", false
+	}
+
+	for _, n := range FastlaneTextFiles {
+		if rest[0] == n {
+			return n, true
+		}
+	}
+
+	name, ok = textAliases[rest[0]]
 	return
 }
+
+// sortNatural sorts paths by name, comparing numbers by value so "2.png" comes before "10.png"
+func sortNatural(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		a, b := filepath.Base(paths[i]), filepath.Base(paths[j])
+		na, erra := strconv.Atoi(strings.TrimSuffix(a, filepath.Ext(a)))
+		nb, errb := strconv.Atoi(strings.TrimSuffix(b, filepath.Ext(b)))
+		switch {
+		case erra == nil && errb == nil && na != nb:
+			return na < nb
+		case erra == nil && errb != nil:
+			return true
+		case erra != nil && errb == nil:
+			return false
+		}
+		return a < b
+	})
+}
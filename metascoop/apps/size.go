@@ -0,0 +1,46 @@
+package apps
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size is a number of bytes in apps.yaml, either a plain number or one with a binary suffix like "150M". A
+// negative number is allowed, e.g. to exempt an app from a global limit.
+type Size int64
+
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	if n, err := strconv.ParseInt(node.Value, 10, 64); err == nil && node.Kind == yaml.ScalarNode {
+		*s = Size(n)
+		return nil
+	}
+
+	n, err := ParseSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*s = Size(n)
+	return nil
+}
+
+// ParseSize parses a number of bytes with an optional binary suffix like "500M" or "1GiB"
+func ParseSize(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+
+	var multiplier int64 = 1
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			multiplier = 1 << (10 * (i + 1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a number of bytes like \"1048576\", \"512M\" or \"1G\"", value)
+	}
+	return n * multiplier, nil
+}
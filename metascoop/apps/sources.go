@@ -0,0 +1,91 @@
+package apps
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+func (a *AppInfo) compileURLSource() (err error) {
+	if a.APKURL == "" {
+		return fmt.Errorf("apk_url must be set")
+	}
+	if _, err = url.ParseRequestURI(a.APKURL); err != nil {
+		return fmt.Errorf("invalid apk_url: %w", err)
+	}
+
+	if a.VersionURL != "" {
+		if _, err = url.ParseRequestURI(a.VersionURL); err != nil {
+			return fmt.Errorf("invalid version_url: %w", err)
+		}
+		if a.VersionRegex == "" {
+			return fmt.Errorf("version_url needs a version_regex")
+		}
+	}
+
+	if a.VersionRegex == "" {
+		if strings.Contains(a.APKURL, "{version}") {
+			return fmt.Errorf("apk_url contains {version}, but there is no version_regex to detect it")
+		}
+		if a.TagPattern != "" {
+			return fmt.Errorf("tag_pattern needs a version_regex, without it the release is always called %q", sources.LatestTag)
+		}
+		return
+	}
+
+	a.versionRegex, err = regexp.Compile(a.VersionRegex)
+	if err != nil {
+		return fmt.Errorf("invalid version_regex: %w", err)
+	}
+	if a.versionRegex.NumSubexp() == 0 {
+		return fmt.Errorf("version_regex needs a group that captures the version")
+	}
+
+	return
+}
+
+func (a *AppInfo) checkActionsSource() (err error) {
+	if a.Workflow == "" {
+		return fmt.Errorf("workflow must be set")
+	}
+	if kind, kerr := sources.DetectKind(a.GitURL); kerr != nil || kind != sources.KindGitHub {
+		return fmt.Errorf("git must be the URL of a repo on github.com")
+	}
+
+	switch a.VersionCode {
+	case "", sources.VersionCodeRunNumber, sources.VersionCodeCommitDate:
+	default:
+		return fmt.Errorf("invalid version_code %q, must be %q or %q", a.VersionCode, sources.VersionCodeRunNumber, sources.VersionCodeCommitDate)
+	}
+
+	return
+}
+
+// ActionsSource returns the configuration of the "github-actions" source
+func (a AppInfo) ActionsSource() sources.ActionsConfig {
+	return sources.ActionsConfig{
+		Workflow:    a.Workflow,
+		Branch:      a.Branch,
+		VersionCode: a.VersionCode,
+	}
+}
+
+// FDroidSource returns the configuration of the "fdroid" source
+func (a AppInfo) FDroidSource() sources.FDroidConfig {
+	return sources.FDroidConfig{
+		Repo:    a.FDroidRepo,
+		Package: a.PackageName,
+	}
+}
+
+// URLSource returns the configuration of the "url" source
+func (a AppInfo) URLSource() sources.URLConfig {
+	return sources.URLConfig{
+		APK:          a.APKURL,
+		VersionPage:  a.VersionURL,
+		VersionRegex: a.versionRegex,
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
-	"metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/sources"
 )
 
 func TestAppsFile(t *testing.T) {
@@ -16,3 +23,139 @@ func TestAppsFile(t *testing.T) {
 		t.Errorf("the app list is empty, wanted at least one app")
 	}
 }
+
+func TestSelectABISplits(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []string
+		selected   []string
+		ignored    []string
+	}{
+		{name: "universal only", candidates: []string{"app.apk"}, selected: []string{"app.apk"}},
+		{
+			name:       "universal and one split",
+			candidates: []string{"app-arm64-v8a.apk", "app.apk"},
+			selected:   []string{"app.apk"},
+			ignored:    []string{"app-arm64-v8a.apk"},
+		},
+		{
+			name:       "splits",
+			candidates: []string{"app-arm64-v8a.apk", "app-armeabi-v7a.apk", "app-x86_64.apk"},
+			selected:   []string{"app-arm64-v8a.apk", "app-armeabi-v7a.apk", "app-x86_64.apk"},
+		},
+		{
+			name:       "universal and splits",
+			candidates: []string{"app-arm64-v8a.apk", "app-armeabi-v7a.apk", "app.apk"},
+			selected:   []string{"app-arm64-v8a.apk", "app-armeabi-v7a.apk", "app.apk"},
+		},
+		{
+			name:       "two universal APKs and splits",
+			candidates: []string{"app-arm64-v8a.apk", "app-full.apk", "app-lite.apk", "app-x86_64.apk"},
+			selected:   []string{"app-arm64-v8a.apk", "app-x86_64.apk", "app-full.apk"},
+			ignored:    []string{"app-lite.apk"},
+		},
+		{
+			name:       "duplicate ABI",
+			candidates: []string{"app-arm64-v8a.apk", "app-arm64.apk", "app-x86.apk"},
+			selected:   []string{"app-arm64-v8a.apk", "app-x86.apk"},
+			ignored:    []string{"app-arm64.apk"},
+		},
+		{name: "single split", candidates: []string{"app-arm64-v8a.apk"}, selected: []string{"app-arm64-v8a.apk"}},
+		{name: "two universal APKs", candidates: []string{"app-full.apk", "app-lite.apk"}, selected: []string{"app-full.apk"}, ignored: []string{"app-lite.apk"}},
+	}
+
+	names := func(assets []sources.Asset) (names []string) {
+		for _, a := range assets {
+			names = append(names, a.Name)
+		}
+		return
+	}
+	for _, test := range tests {
+		var candidates []sources.Asset
+		for _, name := range test.candidates {
+			candidates = append(candidates, sources.Asset{Name: name})
+		}
+
+		selected, ignored := apps.SelectABISplits(candidates)
+		if got := names(selected); !reflect.DeepEqual(got, test.selected) {
+			t.Errorf("%s: selected %v, want %v", test.name, got, test.selected)
+		}
+		if got := names(ignored); !reflect.DeepEqual(got, test.ignored) {
+			t.Errorf("%s: ignored %v, want %v", test.name, got, test.ignored)
+		}
+	}
+}
+
+func TestLintRemoteFragment(t *testing.T) {
+	fragment := `
+hijack:
+  git: https://github.com/example/hijack
+  package: com.example.local
+unnamed:
+  git: https://github.com/example/unnamed
+relaxed:
+  git: https://github.com/example/relaxed
+  package: com.example.relaxed
+  priority: 10
+  min_target_sdk: -1
+  tracker_policy: ignore
+  allowed_trackers: [Firebase Analytics]
+  allowed_permissions: [CAMERA]
+remote:
+  git: https://github.com/example/remote
+  package: com.example.remote
+  signer: 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(fragment))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "apps.yaml")
+	err := os.WriteFile(path, []byte("include: "+server.URL+"/apps.yaml\nlocal:\n  git: https://github.com/example/local\n  package: com.example.local\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, problems, err := apps.Lint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, a := range list {
+		names = append(names, a.Name())
+	}
+	if want := []string{"local", "remote"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("valid apps are %v, want %v", names, want)
+	}
+
+	got := make(map[string][]string)
+	for _, p := range problems {
+		got[p.App] = append(got[p.App], p.Message)
+	}
+	for app, want := range map[string][]string{
+		"hijack":  {`package "com.example.local" is published by app "local" of this repo`},
+		"unnamed": {"must set package"},
+		"relaxed": {"priority can't be set", "min_target_sdk can't be set", "tracker_policy can't be set", "allowed_trackers can't be set", "allowed_permissions can't be set"},
+	} {
+		messages := got[app]
+		delete(got, app)
+		if len(messages) != len(want) {
+			t.Errorf("app %q has problems %q, want %d", app, messages, len(want))
+			continue
+		}
+		for _, w := range want {
+			found := false
+			for _, m := range messages {
+				found = found || strings.Contains(m, w)
+			}
+			if !found {
+				t.Errorf("app %q has problems %q, want one about %q", app, messages, w)
+			}
+		}
+	}
+	for app, messages := range got {
+		t.Errorf("app %q has unexpected problems %q", app, messages)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+const (
+	attestationOff    = "off"
+	attestationJSON   = "json"
+	attestationInToto = "in-toto"
+)
+
+// attestationSuffix is appended to the name of an APK for the file with its provenance. It's published next to
+// the APK and moved, archived and removed with it, like its signature files.
+const attestationSuffix = ".provenance.json"
+
+// attestationBuilder and attestationBuildType identify metascoop and how it "builds" an APK in in-toto statements:
+// it takes the release asset as it is, or extracts the universal APK from a bundle
+const (
+	attestationBuilder   = "https://github.com/nymtech/fdroid/metascoop"
+	attestationBuildType = attestationBuilder + "/release-asset/v1"
+)
+
+// apkProvenance records where an APK of the repo came from, so users can audit that it's the one upstream released
+type apkProvenance struct {
+	APK     string `json:"apk"`
+	Package string `json:"package,omitempty"`
+	SHA256  string `json:"sha256"`
+
+	App        string `json:"app"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Asset      string `json:"asset"`
+	AssetURL   string `json:"asset_url"`
+
+	// AssetSHA256 is the digest of the asset, it differs from SHA256 if the APK was extracted from a bundle
+	AssetSHA256 string `json:"asset_sha256,omitempty"`
+
+	// RunID identifies the run that published the APK, e.g. the URL of the GitHub Actions run
+	RunID     string    `json:"run_id,omitempty"`
+	Published time.Time `json:"published"`
+}
+
+// attestations collects the provenance of the APKs that are added to the repo in a run and writes them once it's
+// known which APKs stay. Its methods are safe for concurrent use and do nothing on nil.
+type attestations struct {
+	format string
+	runID  string
+
+	lock sync.Mutex
+
+	// map[APK path]provenance, of APKs that are in the repo and of queued downloads
+	pending map[string]apkProvenance
+	added   map[string]bool
+}
+
+// newAttestations returns the attestations in format, nil if they are off. runID defaults to the URL of the
+// GitHub Actions run if the run is one.
+func newAttestations(format, runID string) (a *attestations, err error) {
+	switch format {
+	case attestationOff:
+		return nil, nil
+	case attestationJSON, attestationInToto:
+	default:
+		return nil, fmt.Errorf("unknown provenance format %q, must be %q, %q or %q", format, attestationJSON, attestationInToto, attestationOff)
+	}
+
+	if runID == "" && os.Getenv("GITHUB_RUN_ID") != "" {
+		runID = fmt.Sprintf("%s/%s/actions/runs/%s", os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+	}
+	return &attestations{format: format, runID: runID, pending: make(map[string]apkProvenance), added: make(map[string]bool)}, nil
+}
+
+// add remembers that the APK at path was taken from asset of the release of app
+func (a *attestations) add(path string, app apps.AppInfo, asset scoop.Asset) {
+	a.queue(path, app, asset)
+	a.downloaded(path)
+}
+
+// queue remembers that the APK at path is downloaded from asset of the release of app. Its provenance is only
+// written if the download succeeds, see downloaded.
+func (a *attestations) queue(path string, app apps.AppInfo, asset scoop.Asset) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.pending[path] = apkProvenance{
+		App:         app.Name(),
+		Repository:  app.GitURL,
+		Tag:         app.ReleaseTag,
+		Asset:       asset.Name,
+		AssetURL:    asset.URL,
+		AssetSHA256: asset.SHA256,
+		RunID:       a.runID,
+	}
+}
+
+// downloaded marks the queued download of the APK at path as done
+func (a *attestations) downloaded(path string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.added[path] = true
+}
+
+// rename moves the provenance of the APK at oldPath to newPath, e.g. after it was renamed with a file name template
+func (a *attestations) rename(oldPath, newPath string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if p, ok := a.pending[oldPath]; ok {
+		a.pending[newPath] = p
+		delete(a.pending, oldPath)
+	}
+	if a.added[oldPath] {
+		a.added[newPath] = true
+		delete(a.added, oldPath)
+	}
+}
+
+// write writes the provenance of the APKs that were added and are still in the repo, e.g. not removed because
+// another app publishes the same version. Errors are reported for the app of the APK.
+func (a *attestations) write(digests *download.Digests, addError func(app string, err error)) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var paths []string
+	for path := range a.added {
+		if _, ok := a.pending[path]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, path := range paths {
+		p := a.pending[path]
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		err := a.writeFile(path, p, now, digests)
+		if err != nil {
+			addError(p.App, fmt.Errorf("writing provenance of %q: %w", path, err))
+		}
+	}
+}
+
+func (a *attestations) writeFile(path string, p apkProvenance, now time.Time, digests *download.Digests) (err error) {
+	digest, err := digests.File(path)
+	if err != nil {
+		return
+	}
+	p.APK = filepath.Base(path)
+	p.SHA256 = digest.SHA256
+	p.Published = now
+	if m, merr := apk.ReadManifest(path); merr == nil {
+		p.Package = m.Package
+	}
+
+	var v interface{} = p
+	if a.format == attestationInToto {
+		v = inTotoStatement(p)
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	return os.WriteFile(path+attestationSuffix, append(data, '\n'), 0o644)
+}
+
+// inTotoStatement returns p as an unsigned in-toto statement with a SLSA provenance predicate. It can be signed
+// with tools like cosign to become an attestation.
+func inTotoStatement(p apkProvenance) map[string]interface{} {
+	// Assets that were taken as they are have the digest of the APK
+	assetDigest := p.AssetSHA256
+	if assetDigest == "" && !apps.IsBundle(p.Asset) {
+		assetDigest = p.SHA256
+	}
+	dependency := map[string]interface{}{"uri": p.AssetURL}
+	if assetDigest != "" {
+		dependency["digest"] = map[string]string{"sha256": assetDigest}
+	}
+
+	metadata := map[string]interface{}{
+		"startedOn":  p.Published.Format(time.RFC3339),
+		"finishedOn": p.Published.Format(time.RFC3339),
+	}
+	if p.RunID != "" {
+		metadata["invocationId"] = p.RunID
+	}
+
+	return map[string]interface{}{
+		"_type": "https://in-toto.io/Statement/v1",
+		"subject": []interface{}{
+			map[string]interface{}{"name": p.APK, "digest": map[string]string{"sha256": p.SHA256}},
+		},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]interface{}{
+			"buildDefinition": map[string]interface{}{
+				"buildType": attestationBuildType,
+				"externalParameters": map[string]interface{}{
+					"app":        p.App,
+					"package":    p.Package,
+					"repository": p.Repository,
+					"tag":        p.Tag,
+					"asset":      p.Asset,
+				},
+				"resolvedDependencies": []interface{}{dependency},
+			},
+			"runDetails": map[string]interface{}{
+				"builder":  map[string]interface{}{"id": attestationBuilder},
+				"metadata": metadata,
+			},
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// bundleConverter turns downloaded App Bundles and APK sets into universal APKs
+type bundleConverter struct {
+	// bundletool is the command that runs bundletool, e.g. "java -jar bundletool.jar"
+	bundletool string
+
+	keystore string
+	keyAlias string
+	password string
+}
+
+// convert replaces the bundle at path with its universal APK. assetName is the name of the upstream asset,
+// which tells what kind of bundle it is.
+func (b *bundleConverter) convert(ctx context.Context, path, assetName string) (err error) {
+	tmp, err := os.MkdirTemp("", "metascoop-bundle-*")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	apks := path
+	if strings.EqualFold(filepath.Ext(assetName), ".aab") {
+		apks = filepath.Join(tmp, "universal.apks")
+		err = b.buildAPKs(ctx, path, apks, tmp)
+		if err != nil {
+			return
+		}
+	}
+
+	universal := filepath.Join(tmp, "universal.apk")
+	err = apk.ExtractUniversal(apks, universal)
+	if err != nil {
+		return
+	}
+
+	// The temporary directory may be on another file system
+	return copyFile(universal, path)
+}
+
+// buildAPKs runs bundletool to build an APK set with a universal APK at apksPath from the App Bundle at aab
+func (b *bundleConverter) buildAPKs(ctx context.Context, aab, apksPath, tmp string) (err error) {
+	if b.keystore == "" {
+		return fmt.Errorf("building an APK from an App Bundle needs -bundle-keystore, the APK is signed with it")
+	}
+
+	command := strings.Fields(b.bundletool)
+	if len(command) == 0 {
+		return fmt.Errorf("building an APK from an App Bundle needs -bundletool")
+	}
+
+	// The password is passed in a file, so it doesn't show up in the process list
+	passwordFile := filepath.Join(tmp, "password")
+	err = os.WriteFile(passwordFile, []byte(b.password), 0o600)
+	if err != nil {
+		return
+	}
+
+	args := append(command[1:], "build-apks",
+		"--bundle="+aab,
+		"--output="+apksPath,
+		"--mode=universal",
+		"--ks="+b.keystore,
+		"--ks-pass=file:"+passwordFile,
+	)
+	if b.keyAlias != "" {
+		args = append(args, "--ks-key-alias="+b.keyAlias)
+	}
+
+	cmd := tools.CommandContext(ctx, command[0], args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running bundletool: %w\nOutput:\n%s", err, out.String())
+	}
+
+	return
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/sign"
+)
+
+const (
+	problemPublishedUnavailable = "published_index_unavailable"
+	problemPublishedSignature   = "published_signature"
+	problemPublishedFingerprint = "published_fingerprint"
+	problemPublishedStale       = "published_index_stale"
+	problemPublishedMissing     = "published_missing_version"
+	problemPublishedExtra       = "published_extra_version"
+	problemPublishedChanged     = "published_changed_version"
+	problemPublishedAPK         = "published_apk"
+)
+
+// errNotFound means the published repo doesn't have a file
+var errNotFound = errors.New("not found")
+
+// checkPublished probes the repo as it's served: it downloads the index from the repo URL, checks its signature and
+// fingerprint, spot-checks some of the APKs it lists and compares it with the index in git. It exits with 1 if there
+// are problems, e.g. because the deployment failed or a CDN serves an old index.
+func checkPublished(args []string) {
+	flags := flag.NewFlagSet("check-published", flag.ExitOnError)
+	var (
+		repoURL     = flags.String("repo-url", "", "URL of the published repo directory, e.g. \"https://example.org/fdroid/repo\". Defaults to the address in the index in git")
+		repoDir     = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory, whose index the published one is compared with")
+		fingerprint = flags.String("fingerprint", "", "SHA-256 fingerprint of the certificate the published index must be signed with. Defaults to that of the index in git")
+		sample      = flags.Int("sample", 10, "Number of APKs that are checked with HEAD requests, 0 checks all of them")
+		checkHashes = flags.Bool("hash", false, "Download the sampled APKs and compare their SHA-256 digest with the index instead of only their size")
+		timeout     = flags.Duration("timeout", 2*time.Minute, "Timeout of each request")
+		jsonOutput  = flags.Bool("json", false, "Print the problems as JSON")
+		logLevel    = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat   = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+		httpConfig  = addHTTPFlags(flags)
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s check-published [flags]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	err = httpConfig.setup()
+	if err != nil {
+		fatal("Setting up HTTP clients failed", "error", err)
+	}
+
+	local, err := apps.ReadIndex(filepath.Join(*repoDir, "index-v1.json"))
+	if err != nil {
+		fatal("Reading F-Droid repo index failed", "error", err)
+	}
+
+	if *repoURL == "" {
+		*repoURL, _ = local.Repo["address"].(string)
+		if *repoURL == "" {
+			fatal("The index has no address, set -repo-url")
+		}
+	}
+	if *fingerprint == "" {
+		*fingerprint, err = repoFingerprint(*repoDir, nil)
+		if err != nil {
+			fatal("Reading the fingerprint of the repo failed", "error", err)
+		}
+	}
+
+	c := &publishedCheck{
+		client:      &http.Client{Timeout: *timeout},
+		repoURL:     strings.TrimSuffix(*repoURL, "/"),
+		fingerprint: apk.NormalizeFingerprint(*fingerprint),
+		sample:      *sample,
+		hashes:      *checkHashes,
+	}
+	c.run(context.Background(), local)
+
+	reportProblems(c.problems, *jsonOutput)
+	if len(c.problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// publishedCheck collects the problems of a published repo
+type publishedCheck struct {
+	client      *http.Client
+	repoURL     string
+	fingerprint string
+	sample      int
+	hashes      bool
+
+	problems []problem
+}
+
+func (c *publishedCheck) add(kind, pkg, path, format string, args ...interface{}) {
+	c.problems = append(c.problems, problem{Kind: kind, Package: pkg, Path: path, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (c *publishedCheck) run(ctx context.Context, local *apps.RepoIndex) {
+	published, ok := c.fetchIndex(ctx)
+	if !ok {
+		return
+	}
+
+	c.compare(local, published)
+	c.checkAPKs(ctx, published)
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.Path < b.Path
+	})
+}
+
+// fetchIndex downloads the signed index and verifies it. Unsigned repos, i.e. if no fingerprint is expected, may
+// only serve index-v1.json.
+func (c *publishedCheck) fetchIndex(ctx context.Context) (index *apps.RepoIndex, ok bool) {
+	jarURL := c.repoURL + "/index-v1.jar"
+	jar, err := c.get(ctx, jarURL)
+
+	var data []byte
+	switch {
+	case errors.Is(err, errNotFound) && c.fingerprint == "":
+		jsonURL := c.repoURL + "/index-v1.json"
+		data, err = c.get(ctx, jsonURL)
+		if err != nil {
+			c.add(problemPublishedUnavailable, "", jsonURL, "downloading the index failed: %s", err)
+			return nil, false
+		}
+		slog.Warn("The published index isn't signed", "url", jsonURL)
+	case err != nil:
+		c.add(problemPublishedUnavailable, "", jarURL, "downloading the index failed: %s", err)
+		return nil, false
+	default:
+		files, fp, verr := sign.VerifyJAR(jar)
+		if verr != nil {
+			c.add(problemPublishedSignature, "", jarURL, "the signature of the index is invalid: %s", verr)
+			return nil, false
+		}
+		if c.fingerprint == "" {
+			slog.Warn("No fingerprint to compare with, set -fingerprint", "published", fp)
+		} else if fp != c.fingerprint {
+			c.add(problemPublishedFingerprint, "", jarURL, "the index is signed by %s, expected %s", fp, c.fingerprint)
+			return nil, false
+		}
+		data, ok = files["index-v1.json"]
+		if !ok {
+			c.add(problemPublishedSignature, "", jarURL, "the JAR doesn't contain index-v1.json")
+			return nil, false
+		}
+		slog.Info("The published index has a valid signature", "url", jarURL, "fingerprint", fp)
+	}
+
+	err = json.Unmarshal(data, &index)
+	if err != nil {
+		c.add(problemPublishedUnavailable, "", c.repoURL, "reading the index failed: %s", err)
+		return nil, false
+	}
+	return index, true
+}
+
+// compare reports the drift between the index in git and the published one
+func (c *publishedCheck) compare(local, published *apps.RepoIndex) {
+	localTime, publishedTime := indexTimestamp(local), indexTimestamp(published)
+	if publishedTime < localTime {
+		c.add(problemPublishedStale, "", c.repoURL, "the published index is from %s, the one in git from %s",
+			time.UnixMilli(publishedTime).UTC().Format(time.RFC3339), time.UnixMilli(localTime).UTC().Format(time.RFC3339))
+	}
+
+	byName := func(index *apps.RepoIndex) map[string]apps.PackageInfo {
+		m := make(map[string]apps.PackageInfo)
+		for _, pkgs := range index.Packages {
+			for _, p := range pkgs {
+				m[p.ApkName] = p
+			}
+		}
+		return m
+	}
+	localAPKs, publishedAPKs := byName(local), byName(published)
+
+	for name, p := range localAPKs {
+		pub, ok := publishedAPKs[name]
+		switch {
+		case !ok:
+			c.add(problemPublishedMissing, p.PackageName, name, "version %d is in git, but not in the published index", p.VersionCode)
+		case !strings.EqualFold(pub.Hash, p.Hash):
+			c.add(problemPublishedChanged, p.PackageName, name, "the published index has SHA-256 %s, the one in git %s", pub.Hash, p.Hash)
+		}
+	}
+	for name, p := range publishedAPKs {
+		if _, ok := localAPKs[name]; !ok {
+			c.add(problemPublishedExtra, p.PackageName, name, "version %d is published, but not in git", p.VersionCode)
+		}
+	}
+}
+
+// indexTimestamp returns the timestamp of index in milliseconds
+func indexTimestamp(index *apps.RepoIndex) int64 {
+	ts, _ := index.Repo["timestamp"].(float64)
+	return int64(ts)
+}
+
+// checkAPKs makes sure a random sample of the APKs in the published index can be downloaded and match it
+func (c *publishedCheck) checkAPKs(ctx context.Context, published *apps.RepoIndex) {
+	var pkgs []apps.PackageInfo
+	for _, list := range published.Packages {
+		pkgs = append(pkgs, list...)
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].ApkName < pkgs[j].ApkName
+	})
+	rand.Shuffle(len(pkgs), func(i, j int) {
+		pkgs[i], pkgs[j] = pkgs[j], pkgs[i]
+	})
+	if c.sample > 0 && len(pkgs) > c.sample {
+		pkgs = pkgs[:c.sample]
+	}
+
+	for _, p := range pkgs {
+		apkURL := c.repoURL + "/" + url.PathEscape(p.ApkName)
+
+		err := c.checkAPK(ctx, apkURL, p)
+		if err != nil {
+			c.add(problemPublishedAPK, p.PackageName, apkURL, "%s", err)
+			continue
+		}
+		slog.Debug("Published APK matches the index", "url", apkURL)
+	}
+	slog.Info("Checked published APKs", "checked", len(pkgs))
+}
+
+func (c *publishedCheck) checkAPK(ctx context.Context, apkURL string, p apps.PackageInfo) (err error) {
+	method := http.MethodHead
+	if c.hashes {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apkURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if !c.hashes {
+		size, perr := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if perr == nil && p.Size > 0 && size != int64(p.Size) {
+			return fmt.Errorf("the file has %d bytes, the index says %d", size, p.Size)
+		}
+		return nil
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return
+	}
+	if p.Size > 0 && size != int64(p.Size) {
+		return fmt.Errorf("the file has %d bytes, the index says %d", size, p.Size)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); p.Hash != "" && !strings.EqualFold(sum, p.Hash) {
+		return fmt.Errorf("the file has SHA-256 %s, the index says %s", sum, p.Hash)
+	}
+	return nil
+}
+
+// get downloads u. It returns errNotFound for 404 responses.
+func (c *publishedCheck) get(ctx context.Context, u string) (data []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, io.LimitReader(resp.Body, 256<<20))
+	return buf.Bytes(), err
+}
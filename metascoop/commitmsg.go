@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// maxSubjectVersions is the number of app versions that are listed in the subject of a commit message
+const maxSubjectVersions = 3
+
+// changes is what a run changed in the repo, per section of the commit message
+type changes struct {
+	added    []string
+	removed  []string
+	archived []string
+	metadata []string
+}
+
+func collectChanges(r *report.Report) (c changes) {
+	names := make([]string, 0, len(r.Apps))
+	for name := range r.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		a := r.Apps[name]
+		for _, v := range a.VersionsAdded {
+			c.added = append(c.added, name+" "+v)
+		}
+		c.removed = append(c.removed, a.VersionsRemoved...)
+		c.archived = append(c.archived, a.VersionsArchived...)
+		if len(a.MetadataUpdated) > 0 {
+			c.metadata = append(c.metadata, fmt.Sprintf("%s: %s", name, strings.Join(a.MetadataUpdated, ", ")))
+		}
+	}
+
+	return
+}
+
+func (c changes) subject() string {
+	switch {
+	case len(c.added) > 0 && len(c.added) <= maxSubjectVersions:
+		return "Add " + strings.Join(c.added, ", ")
+	case len(c.added) > 0:
+		return fmt.Sprintf("Add %d new versions", len(c.added))
+	case len(c.removed) > 0 || len(c.archived) > 0:
+		return fmt.Sprintf("Retire %d old versions", len(c.removed)+len(c.archived))
+	case len(c.metadata) == 1:
+		return "Update metadata of " + strings.SplitN(c.metadata[0], ":", 2)[0]
+	case len(c.metadata) > 0:
+		return fmt.Sprintf("Update metadata of %d apps", len(c.metadata))
+	}
+	return "Update repo index"
+}
+
+type changeSection struct {
+	title string
+	items []string
+}
+
+func (c changes) sections() []changeSection {
+	return []changeSection{
+		{"Added", c.added},
+		{"Removed", c.removed},
+		{"Archived", c.archived},
+		{"Metadata updated", c.metadata},
+	}
+}
+
+// commitMessage returns a commit message that lists everything the run changed
+func commitMessage(r *report.Report) string {
+	c := collectChanges(r)
+
+	var b strings.Builder
+	b.WriteString(c.subject())
+	b.WriteString("\n")
+
+	for _, s := range c.sections() {
+		if len(s.items) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", s.title)
+		for _, item := range s.items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+
+	return b.String()
+}
+
+// updateChangelog adds a section about the run to the top of the changelog at path, which is created if needed.
+// Runs that only updated metadata aren't worth an entry.
+func updateChangelog(path string, r *report.Report, now time.Time) (err error) {
+	c := collectChanges(r)
+	if len(c.added) == 0 && len(c.removed) == 0 && len(c.archived) == 0 {
+		return
+	}
+
+	var section strings.Builder
+	fmt.Fprintf(&section, "## %s\n\n", now.UTC().Format("2006-01-02 15:04 MST"))
+	for _, s := range c.sections()[:3] {
+		for _, item := range s.items {
+			fmt.Fprintf(&section, "- %s %s\n", s.title, item)
+		}
+	}
+	section.WriteString("\n")
+
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	old := string(content)
+	if old == "" {
+		old = "# Changelog\n\n"
+	}
+
+	// New sections go below the title, if there is one
+	var head string
+	if strings.HasPrefix(old, "# ") {
+		end := strings.Index(old, "\n")
+		if end < 0 {
+			end = len(old) - 1
+			old += "\n"
+		}
+		head, old = old[:end+1]+"\n", strings.TrimLeft(old[end+1:], "\n")
+	}
+
+	return os.WriteFile(path, []byte(strings.TrimRight(head+section.String()+old, "\n")+"\n"), 0o644)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// problem is an inconsistency found by verifyRepo
+type problem struct {
+	Kind    string `json:"kind"`
+	Package string `json:"package,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Detail  string `json:"detail"`
+}
+
+const (
+	problemOrphanedAPK      = "orphaned_apk"
+	problemMissingAPK       = "missing_apk"
+	problemChecksum         = "checksum_mismatch"
+	problemDuplicateVersion = "duplicate_version_code"
+	problemMetadataOnly     = "metadata_without_apks"
+	problemMissingMetadata  = "missing_metadata"
+	problemMissingIcon      = "missing_icon"
+	problemUnknownPackage   = "package_without_app"
+	problemAppWithoutAPKs   = "app_without_apks"
+)
+
+// verifyRepo cross-checks apps.yaml, the metadata, the APKs and the indexes and reports everything that
+// doesn't fit together. It exits with 1 if there are problems.
+func verifyRepo(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	var (
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file")
+		repoDir      = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory")
+		jsonOutput   = flags.Bool("json", false, "Print the problems as JSON")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s verify [flags]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+
+	problems, err := checkRepo(filepath.Dir(*repoDir), appsList)
+	if err != nil {
+		fatal("Verifying repo failed", "error", err)
+	}
+
+	reportProblems(problems, *jsonOutput)
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// reportProblems prints problems, as JSON if jsonOutput is set
+func reportProblems(problems []problem, jsonOutput bool) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if problems == nil {
+			problems = []problem{}
+		}
+		_ = enc.Encode(problems)
+	} else {
+		for _, p := range problems {
+			var where []string
+			if p.Package != "" {
+				where = append(where, p.Package)
+			}
+			if p.Path != "" {
+				where = append(where, p.Path)
+			}
+			fmt.Printf("%s: %s: %s\n", p.Kind, strings.Join(where, " "), p.Detail)
+		}
+		if len(problems) == 0 {
+			fmt.Println("No problems found")
+		} else {
+			fmt.Printf("%d problems found\n", len(problems))
+		}
+	}
+}
+
+// checkRepo returns the problems of the fdroid directory, sorted by kind and location
+func checkRepo(fdroidDir string, appsList []apps.AppInfo) (problems []problem, err error) {
+	add := func(kind, pkg, path, format string, args ...interface{}) {
+		problems = append(problems, problem{Kind: kind, Package: pkg, Path: path, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	// All packages of the repo and the archive
+	var packages = make(map[string]bool)
+
+	var repoIndex *apps.RepoIndex
+
+	names, err := loadAPKNames(fdroidDir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range []string{"repo", "archive"} {
+		dir := filepath.Join(fdroidDir, name)
+
+		index, ierr := apps.ReadIndex(filepath.Join(dir, "index-v1.json"))
+		if errors.Is(ierr, os.ErrNotExist) {
+			if name == "repo" {
+				return nil, ierr
+			}
+			continue
+		}
+		if ierr != nil {
+			return nil, fmt.Errorf("reading index of %q: %w", dir, ierr)
+		}
+		if name == "repo" {
+			repoIndex = index
+		}
+
+		var indexed = make(map[string]bool)
+		for pkgName, pkgs := range index.Packages {
+			packages[pkgName] = true
+
+			for _, p := range pkgs {
+				indexed[p.ApkName] = true
+				path := filepath.Join(dir, p.ApkName)
+
+				sum, size, herr := sha256File(path)
+				switch {
+				case errors.Is(herr, os.ErrNotExist):
+					add(problemMissingAPK, pkgName, path, "the index lists version %d, but the file doesn't exist", p.VersionCode)
+					continue
+				case herr != nil:
+					return nil, herr
+				}
+
+				if p.Size > 0 && int64(p.Size) != size {
+					add(problemChecksum, pkgName, path, "the file has %d bytes, the index says %d", size, p.Size)
+				} else if p.Hash != "" && !strings.EqualFold(p.Hash, sum) {
+					add(problemChecksum, pkgName, path, "the file has SHA-256 %s, the index says %s", sum, p.Hash)
+				}
+			}
+
+			for _, dup := range duplicateVersionCodes(pkgs) {
+				add(problemDuplicateVersion, pkgName, "", "version code %d is used by %s", dup.versionCode, strings.Join(dup.apks, ", "))
+			}
+		}
+
+		apks, gerr := filepath.Glob(filepath.Join(dir, "*.apk"))
+		if gerr != nil {
+			return nil, gerr
+		}
+		for _, path := range apks {
+			if !indexed[filepath.Base(path)] {
+				add(problemOrphanedAPK, "", path, "the file isn't in the index of %q", name)
+			}
+		}
+	}
+
+	metadataDir := filepath.Join(fdroidDir, "metadata")
+	metaFiles, err := filepath.Glob(filepath.Join(metadataDir, "*.yml"))
+	if err != nil {
+		return
+	}
+	var withMetadata = make(map[string]bool)
+	for _, path := range metaFiles {
+		pkgName := strings.TrimSuffix(filepath.Base(path), ".yml")
+		withMetadata[pkgName] = true
+		if !packages[pkgName] {
+			add(problemMetadataOnly, pkgName, path, "there are no APKs of the package in the repo or archive")
+		}
+	}
+	for pkgName := range packages {
+		if !withMetadata[pkgName] {
+			add(problemMissingMetadata, pkgName, filepath.Join(metadataDir, pkgName+".yml"), "the package has APKs, but no metadata file")
+		}
+	}
+
+	problems = append(problems, checkIcons(filepath.Join(fdroidDir, "repo"), repoIndex)...)
+
+	for pkgName := range repoIndex.Packages {
+		var found bool
+		for _, app := range appsList {
+			if app.PackageName == pkgName || publishesPackage(app, pkgName, repoIndex, names) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add(problemUnknownPackage, pkgName, "", "no app in apps.yaml publishes the package, so it's never updated")
+		}
+	}
+	for _, app := range appsList {
+		if app.PackageName != "" && !packages[app.PackageName] {
+			add(problemAppWithoutAPKs, app.PackageName, "", "the app %q has no APKs in the repo or archive", app.Name())
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.Path < b.Path
+	})
+
+	return
+}
+
+type duplicateVersion struct {
+	versionCode int
+	apks        []string
+}
+
+// duplicateVersionCodes returns version codes used by more than one APK. ABI splits and the universal APK next to
+// them may share a version code, see canShareVersionCode.
+func duplicateVersionCodes(pkgs []apps.PackageInfo) (dups []duplicateVersion) {
+	byCode := make(map[int][]apps.PackageInfo)
+	for _, p := range pkgs {
+		byCode[p.VersionCode] = append(byCode[p.VersionCode], p)
+	}
+
+	for code, list := range byCode {
+		if len(list) < 2 {
+			continue
+		}
+
+		var conflict bool
+		for i, p := range list {
+			for _, other := range list[i+1:] {
+				conflict = conflict || !canShareVersionCode(p.Nativecode, other.Nativecode)
+			}
+		}
+		if !conflict {
+			continue
+		}
+
+		var names []string
+		for _, p := range list {
+			names = append(names, p.ApkName)
+		}
+		sort.Strings(names)
+		dups = append(dups, duplicateVersion{versionCode: code, apks: names})
+	}
+
+	sort.Slice(dups, func(i, j int) bool {
+		return dups[i].versionCode < dups[j].versionCode
+	})
+	return
+}
+
+// checkIcons makes sure every app of the index has an icon and that the icons it references exist
+func checkIcons(repoDir string, index *apps.RepoIndex) (problems []problem) {
+	for _, app := range index.Apps {
+		pkgName, _ := app["packageName"].(string)
+
+		var found, missing bool
+		localized, _ := app["localized"].(map[string]interface{})
+		for locale, l := range localized {
+			fields, _ := l.(map[string]interface{})
+			icon, _ := fields["icon"].(string)
+			if icon == "" {
+				continue
+			}
+
+			path := filepath.Join(repoDir, pkgName, locale, icon)
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, problem{Kind: problemMissingIcon, Package: pkgName, Path: path, Detail: fmt.Sprintf("the index references the %s icon, but the file doesn't exist", locale)})
+				missing = true
+				continue
+			}
+			found = true
+		}
+
+		if icon, _ := app["icon"].(string); icon != "" && !found {
+			// Icons fdroidserver extracted from the APK
+			matches, _ := filepath.Glob(filepath.Join(repoDir, "icons*", icon))
+			found = len(matches) > 0
+		}
+
+		if !found && !missing {
+			problems = append(problems, problem{Kind: problemMissingIcon, Package: pkgName, Detail: "the app has no icon, clients show a placeholder"})
+		}
+	}
+
+	return
+}
+
+func sha256File(path string) (sum string, size int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
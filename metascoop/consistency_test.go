@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+func TestDuplicateVersionCodes(t *testing.T) {
+	apk := func(name string, abis ...string) apps.PackageInfo {
+		return apps.PackageInfo{ApkName: name, VersionCode: 20, Nativecode: abis}
+	}
+
+	tests := []struct {
+		name     string
+		pkgs     []apps.PackageInfo
+		conflict bool
+	}{
+		{name: "splits", pkgs: []apps.PackageInfo{apk("arm64.apk", "arm64-v8a"), apk("x86_64.apk", "x86_64")}},
+		{name: "splits for the same ABI", pkgs: []apps.PackageInfo{apk("a.apk", "arm64-v8a"), apk("b.apk", "arm64-v8a")}, conflict: true},
+		{
+			name: "universal next to splits",
+			pkgs: []apps.PackageInfo{apk("arm64.apk", "arm64-v8a"), apk("x86_64.apk", "x86_64"), apk("universal.apk", "arm64-v8a", "armeabi-v7a", "x86_64")},
+		},
+		{
+			name:     "two universal APKs",
+			pkgs:     []apps.PackageInfo{apk("a.apk", "arm64-v8a", "x86_64"), apk("b.apk", "arm64-v8a", "x86_64")},
+			conflict: true,
+		},
+		{name: "without native code", pkgs: []apps.PackageInfo{apk("a.apk"), apk("arm64.apk", "arm64-v8a")}, conflict: true},
+		{name: "universal for one ABI", pkgs: []apps.PackageInfo{apk("a.apk", "arm64-v8a"), apk("arm64.apk", "arm64-v8a")}, conflict: true},
+	}
+
+	for _, tt := range tests {
+		if dups := duplicateVersionCodes(tt.pkgs); (len(dups) > 0) != tt.conflict {
+			t.Errorf("%s: got duplicates %+v, want a conflict: %v", tt.name, dups, tt.conflict)
+		}
+	}
+}
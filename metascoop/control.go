@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// maxControlRequestSize is the largest control request that is read
+const maxControlRequestSize = 1 << 20
+
+// JSON-RPC 2.0 error codes
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+
+	// rpcDraining is returned for runs that are requested while the server drains
+	rpcDraining = -32000
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// runParams are the parameters of the "run" method. Without apps, all apps are updated.
+type runParams struct {
+	Apps []string `json:"apps"`
+}
+
+// controlHandler serves the control interface of the webhook server, JSON-RPC 2.0 requests sent with POST:
+//
+//   - "run" queues an update of the apps in the "apps" parameter, of all apps without it
+//   - "status" returns the running and the last update and what is queued
+//   - "drain" stops accepting updates, webhooks included, and exits once the queued ones are done
+//
+// Requests must have the bearer token if one is set.
+type controlHandler struct {
+	token        string
+	appsFilePath string
+	updater      *updater
+}
+
+func (h *controlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			slog.Warn("Rejected control request with invalid token", "remote", r.RemoteAddr)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var resp rpcResponse
+	var req rpcRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxControlRequestSize))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	switch {
+	case err != nil:
+		resp.Error = &rpcError{Code: rpcParseError, Message: "invalid JSON"}
+	case req.JSONRPC != "2.0" || req.Method == "":
+		resp.Error = &rpcError{Code: rpcInvalidRequest, Message: "not a JSON-RPC 2.0 request"}
+	default:
+		resp.Result, resp.Error = h.call(req)
+	}
+	resp.JSONRPC, resp.ID = "2.0", req.ID
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *controlHandler) call(req rpcRequest) (result interface{}, rerr *rpcError) {
+	switch req.Method {
+	case "run":
+		var params runParams
+		if len(req.Params) > 0 {
+			err := json.Unmarshal(req.Params, &params)
+			if err != nil {
+				return nil, &rpcError{Code: rpcInvalidParams, Message: "params must be an object with an \"apps\" list"}
+			}
+		}
+
+		if len(params.Apps) > 0 {
+			appsList, err := apps.ParseAppFile(h.appsFilePath)
+			if err != nil {
+				slog.Error("Reading apps file failed", "path", h.appsFilePath, "error", err)
+				return nil, &rpcError{Code: rpcInternalError, Message: "reading apps file failed"}
+			}
+			known := make(map[string]bool, len(appsList))
+			for _, app := range appsList {
+				known[app.Name()] = true
+			}
+			for _, name := range params.Apps {
+				if !known[name] {
+					return nil, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("unknown app %q", name)}
+				}
+			}
+		}
+
+		err := h.updater.add(params.Apps...)
+		if errors.Is(err, errDraining) {
+			return nil, &rpcError{Code: rpcDraining, Message: err.Error()}
+		}
+		slog.Info("Queued update from the control interface", "apps", describeApps(params.Apps))
+		return h.updater.status(), nil
+	case "status":
+		return h.updater.status(), nil
+	case "drain":
+		slog.Info("Draining, no more updates are accepted")
+		h.updater.drain()
+		return h.updater.status(), nil
+	}
+	return nil, &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("unknown method %q, must be \"run\", \"status\" or \"drain\"", req.Method)}
+}
+
+// serveControlSocket serves h on a unix socket at path in the background. A socket left behind by an earlier
+// server is replaced. Only the owner may connect, which is why requests on it need no token: the socket is
+// created in a directory only the owner can enter and only moved to path once its permissions are restricted,
+// since it would get the permissions of the umask first.
+func serveControlSocket(path string, h http.Handler) (err error) {
+	if fi, serr := os.Lstat(path); serr == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%q exists and isn't a socket", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return
+		}
+	}
+
+	// MkdirTemp creates the directory with mode 0700
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".metascoop-control-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "control.sock")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return
+	}
+	// The socket is moved, it must not be removed at the path it was created at
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0o600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = l.Close()
+		return
+	}
+
+	go func() {
+		fatal("Control socket stopped", "error", http.Serve(l, h))
+	}()
+	return nil
+}
+
+// control sends a request to the control interface of a running webhook server and prints the result
+func control(args []string) {
+	flags := flag.NewFlagSet("control", flag.ExitOnError)
+	var (
+		socketPath = flags.String("socket", "", "Path of the control socket of the server, see the serve flag -control-socket")
+		url        = flags.String("url", "", "URL of the control interface of the server, e.g. \"http://localhost:8080/control\". The token is read from $METASCOOP_CONTROL_TOKEN")
+		timeout    = flags.Duration("timeout", 30*time.Second, "How long to wait for the server to respond")
+		logLevel   = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat  = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s control [flags] <run [app...]|status|drain>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Manages a running \"%s serve\": \"run\" queues an update of the apps, of all apps without\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "any, \"status\" shows the running and queued updates, and \"drain\" makes the server exit once the queued\n")
+		fmt.Fprintf(flags.Output(), "updates are done, without accepting new ones. Either -socket or -url must be set.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 || (*socketPath == "") == (*url == "") {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	method := flags.Arg(0)
+	var params interface{}
+	switch method {
+	case "run":
+		params = runParams{Apps: flags.Args()[1:]}
+	case "status", "drain":
+		if flags.NArg() > 1 {
+			flags.Usage()
+			os.Exit(1)
+		}
+	default:
+		fatal("Unknown control method, must be \"run\", \"status\" or \"drain\"", "method", method)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	endpoint, token := *url, os.Getenv("METASCOOP_CONTROL_TOKEN")
+	if *socketPath != "" {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socketPath)
+			},
+		}
+		endpoint, token = "http://metascoop/control", ""
+	}
+
+	result, err := callControl(client, endpoint, token, method, params)
+	if err != nil {
+		fatal("Control request failed", "method", method, "error", err)
+	}
+
+	var out bytes.Buffer
+	err = json.Indent(&out, result, "", "  ")
+	if err != nil {
+		fatal("Printing result failed", "error", err)
+	}
+	out.WriteByte('\n')
+	_, _ = out.WriteTo(os.Stdout)
+}
+
+// callControl sends a JSON-RPC request to endpoint and returns its result
+func callControl(client *http.Client, endpoint, token, method string, params interface{}) (result json.RawMessage, err error) {
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 1})
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("server responded with %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return r.Result, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// duplicateVersions keeps apps that publish the same package from fighting over its versions: a version code is
+// only published by one app, the one with the highest priority. Of apps with the same priority, the one that
+// published the version first keeps it.
+type duplicateVersions struct {
+	// apps are all apps of the apps file, versions of apps that aren't processed in this run count as well
+	apps  []apps.AppInfo
+	names *apkNames
+	index *apps.RepoIndex
+}
+
+func newDuplicateVersions(appsList []apps.AppInfo, names *apkNames, index *apps.RepoIndex) *duplicateVersions {
+	return &duplicateVersions{apps: appsList, names: names, index: index}
+}
+
+// apkOwner returns the app of appsList the APK called apkName was published by, see apps.ReleaseOwner. APKs that
+// were renamed with a file name template are looked up by their release names.
+func apkOwner(appsList []apps.AppInfo, names *apkNames, apkName string) (owner apps.AppInfo, ok bool) {
+	return apps.ReleaseOwner(appsList, names.releaseName(apkName))
+}
+
+// verify rejects the APK at path if another app already published its version and doesn't have a lower priority
+func (d *duplicateVersions) verify(path string, app apps.AppInfo) error {
+	m, err := apk.ReadManifest(path)
+	if err != nil {
+		return fmt.Errorf("reading APK manifest: %w", err)
+	}
+
+	for _, p := range d.index.Packages[m.Package] {
+		if int64(p.VersionCode) != m.VersionCode {
+			continue
+		}
+		other, ok := apkOwner(d.apps, d.names, p.ApkName)
+		if !ok || other.Name() == app.Name() || other.Priority < app.Priority {
+			continue
+		}
+		if other.Priority == app.Priority {
+			return fmt.Errorf("version code %d of %s is already published by app %q, set priority in apps.yaml to decide which app publishes it", m.VersionCode, m.Package, other.Name())
+		}
+		return fmt.Errorf("version code %d of %s is already published by app %q, which has a higher priority", m.VersionCode, m.Package, other.Name())
+	}
+	return nil
+}
+
+// resolve removes the APKs of versions that several apps publish from the repo directory, except the one of the
+// app with the highest priority. These are versions that were downloaded in this run for several apps, or that an
+// app published before another one got a higher priority. It runs before the index is generated, which expects
+// one APK of an app per version code and ABI.
+func (d *duplicateVersions) resolve(repoDir string, jobs []scoop.Download, apkInfoMap map[string]apps.AppInfo, addError func(app string, err error)) {
+	type candidate struct {
+		path string
+		app  apps.AppInfo
+
+		// published is set for APKs that were in the repo before this run
+		published bool
+	}
+
+	// map[package name\x00version code]APKs
+	versions := make(map[string][]candidate)
+	var keys []string
+	add := func(pkgName string, versionCode int64, c candidate) {
+		key := fmt.Sprintf("%s\x00%d", pkgName, versionCode)
+		if _, ok := versions[key]; !ok {
+			keys = append(keys, key)
+		}
+		versions[key] = append(versions[key], c)
+	}
+
+	for pkgName, pkgs := range d.index.Packages {
+		for _, p := range pkgs {
+			path := filepath.Join(repoDir, p.ApkName)
+			app, ok := apkOwner(d.apps, d.names, p.ApkName)
+			if _, err := os.Stat(path); err != nil || !ok {
+				continue
+			}
+			add(pkgName, int64(p.VersionCode), candidate{path: path, app: app, published: true})
+		}
+	}
+	for _, job := range jobs {
+		app, ok := apkInfoMap[filepath.Base(job.Target)]
+		if !ok {
+			// Companion assets
+			continue
+		}
+		m, err := apk.ReadManifest(job.Target)
+		if err != nil {
+			// Failed downloads aren't in the repo
+			continue
+		}
+		add(m.Package, m.VersionCode, candidate{path: job.Target, app: app})
+	}
+
+	// Of apps with the same priority, the one that published the version first and then the first in the apps file wins
+	order := make(map[string]int, len(d.apps))
+	for i, app := range d.apps {
+		order[app.Name()] = i
+	}
+	wins := func(c, winner candidate) bool {
+		switch {
+		case c.app.Priority != winner.app.Priority:
+			return c.app.Priority > winner.app.Priority
+		case c.published != winner.published:
+			return c.published
+		}
+		return order[c.app.Name()] < order[winner.app.Name()]
+	}
+
+	for _, key := range keys {
+		candidates := versions[key]
+
+		winner := candidates[0]
+		for _, c := range candidates[1:] {
+			if wins(c, winner) {
+				winner = c
+			}
+		}
+
+		pkgName, versionCode, _ := strings.Cut(key, "\x00")
+		for _, c := range candidates {
+			if c.app.Name() == winner.app.Name() {
+				continue
+			}
+
+			slog.Warn("Removing APK, another app publishes the same version", "app", c.app.Name(), "path", c.path, "package", pkgName,
+				"version_code", versionCode, "published_by", winner.app.Name())
+			for _, path := range []string{c.path, c.path + ".asc", c.path + ".sig", c.path + attestationSuffix} {
+				err := os.Remove(path)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					addError(c.app.Name(), fmt.Errorf("removing %q, app %q publishes the same version: %w", path, winner.app.Name(), err))
+				}
+			}
+		}
+	}
+}
+
+// preferredVersions returns a filter for the versions of a package that are published by the apps with the highest
+// priority among the ones that were processed, so the metadata of the package comes from them. Versions of apps
+// that weren't processed are accepted, as it isn't known who published them.
+func preferredVersions(versions []apps.PackageInfo, apkInfoMap map[string]apps.AppInfo) func(apps.PackageInfo) bool {
+	var (
+		highest int
+		known   bool
+	)
+	for _, p := range versions {
+		if info, ok := apkInfoMap[p.ApkName]; ok && (!known || info.Priority > highest) {
+			highest, known = info.Priority, true
+		}
+	}
+
+	return func(p apps.PackageInfo) bool {
+		info, ok := apkInfoMap[p.ApkName]
+		return !ok || info.Priority == highest
+	}
+}
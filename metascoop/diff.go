@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/git"
+)
+
+// indexDiff is how the apps of two indexes differ
+type indexDiff struct {
+	Added   []appDiff `json:"added"`
+	Removed []appDiff `json:"removed"`
+	Updated []appDiff `json:"updated"`
+}
+
+// appDiff is how a package differs between two indexes. Apps that were added or removed list all their versions
+// as added or removed.
+type appDiff struct {
+	Package string `json:"package"`
+	Name    string `json:"name,omitempty"`
+
+	VersionsAdded   []versionDiff `json:"versions_added,omitempty"`
+	VersionsRemoved []versionDiff `json:"versions_removed,omitempty"`
+
+	// VersionsChanged have the same version code in both indexes, but a different APK
+	VersionsChanged []versionDiff `json:"versions_changed,omitempty"`
+
+	// MetadataChanged are the fields of the app that changed, localized ones as "localized.<locale>.<field>"
+	MetadataChanged []string `json:"metadata_changed,omitempty"`
+}
+
+type versionDiff struct {
+	VersionCode int    `json:"version_code"`
+	VersionName string `json:"version_name"`
+	APK         string `json:"apk"`
+}
+
+func (v versionDiff) String() string {
+	return fmt.Sprintf("%s (%d)", v.VersionName, v.VersionCode)
+}
+
+func (d indexDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Updated) == 0
+}
+
+// diffIndexes prints how two versions of the index differ: the apps and versions that were added, removed or
+// updated. Each version is an index file or a git ref the index is read from.
+func diffIndexes(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	var (
+		repoPath   = flags.String("C", ".", "Path to the git repository git refs are read from")
+		indexPath  = flags.String("index", "fdroid/repo/index-v1.json", "Path of the index in the git repository, relative to -C")
+		jsonOutput = flags.Bool("json", false, "Print the differences as JSON")
+		exitCode   = flags.Bool("exit-code", false, "Exit with code 1 if the indexes differ, like \"git diff --exit-code\"")
+		logLevel   = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat  = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s diff [flags] <old> <new>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Compares two versions of the index. Each is the path of an index-v1.json file or a git ref,\n")
+		fmt.Fprintf(flags.Output(), "e.g. \"HEAD~1 HEAD\" for what the last commit changed.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	var indexes [2]*apps.RepoIndex
+	for i, arg := range flags.Args() {
+		indexes[i], err = readIndexVersion(*repoPath, *indexPath, arg)
+		if err != nil {
+			fatal("Reading index failed", "version", arg, "error", err)
+		}
+	}
+
+	d := compareIndexes(indexes[0], indexes[1])
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	} else {
+		err = d.print(os.Stdout)
+	}
+	if err != nil {
+		fatal("Printing differences failed", "error", err)
+	}
+
+	if *exitCode && !d.empty() {
+		os.Exit(1)
+	}
+}
+
+// readIndexVersion reads the index from the file version, or from the git ref version of the repo
+func readIndexVersion(repoPath, indexPath, version string) (index *apps.RepoIndex, err error) {
+	if _, serr := os.Stat(version); serr == nil {
+		return apps.ReadIndex(version)
+	}
+
+	content, err := git.ShowFile(repoPath, version, filepath.Clean(indexPath))
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a file nor a git ref with the index: %w", version, err)
+	}
+	err = json.NewDecoder(bytes.NewReader(content)).Decode(&index)
+	return
+}
+
+// compareIndexes returns how the apps of the new index differ from those of the old one. Timestamps that
+// fdroidserver updates in every run aren't changes.
+func compareIndexes(old, new *apps.RepoIndex) (d indexDiff) {
+	// Both lists are empty rather than null in JSON
+	d.Added, d.Removed, d.Updated = []appDiff{}, []appDiff{}, []appDiff{}
+
+	oldApps, newApps := indexApps(old), indexApps(new)
+
+	pkgNames := make(map[string]bool)
+	for _, index := range []*apps.RepoIndex{old, new} {
+		for name := range index.Packages {
+			pkgNames[name] = true
+		}
+		for name := range indexApps(index) {
+			pkgNames[name] = true
+		}
+	}
+	var sorted []string
+	for name := range pkgNames {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, pkgName := range sorted {
+		oldApp, inOld := oldApps[pkgName]
+		newApp, inNew := newApps[pkgName]
+		inOld = inOld || len(old.Packages[pkgName]) > 0
+		inNew = inNew || len(new.Packages[pkgName]) > 0
+
+		a := appDiff{Package: pkgName, Name: appName(newApp)}
+		if a.Name == "" {
+			a.Name = appName(oldApp)
+		}
+		a.VersionsAdded, a.VersionsRemoved, a.VersionsChanged = compareVersions(old.Packages[pkgName], new.Packages[pkgName])
+
+		switch {
+		case !inOld:
+			d.Added = append(d.Added, a)
+		case !inNew:
+			d.Removed = append(d.Removed, a)
+		default:
+			a.MetadataChanged = changedAppFields(oldApp, newApp)
+			if len(a.VersionsAdded) > 0 || len(a.VersionsRemoved) > 0 || len(a.VersionsChanged) > 0 || len(a.MetadataChanged) > 0 {
+				d.Updated = append(d.Updated, a)
+			}
+		}
+	}
+	return
+}
+
+// indexApps returns the app entries of index by package name
+func indexApps(index *apps.RepoIndex) map[string]map[string]interface{} {
+	m := make(map[string]map[string]interface{}, len(index.Apps))
+	for _, app := range index.Apps {
+		if name, _ := app["packageName"].(string); name != "" {
+			m[name] = app
+		}
+	}
+	return m
+}
+
+// appName returns the name of the app entry of an index, as set in the metadata file or by fastlane
+func appName(app map[string]interface{}) string {
+	if name, _ := app["name"].(string); name != "" {
+		return name
+	}
+	localized, _ := app["localized"].(map[string]interface{})
+	fields, _ := localized[defaultLocale].(map[string]interface{})
+	name, _ := fields["name"].(string)
+	return name
+}
+
+// compareVersions returns the versions that are only in new, only in old, and in both with different APKs, by
+// version code and ABIs
+func compareVersions(old, new []apps.PackageInfo) (added, removed, changed []versionDiff) {
+	key := func(p apps.PackageInfo) string {
+		return fmt.Sprintf("%d %s", p.VersionCode, strings.Join(p.Nativecode, ","))
+	}
+	version := func(p apps.PackageInfo) versionDiff {
+		return versionDiff{VersionCode: p.VersionCode, VersionName: p.VersionName, APK: p.ApkName}
+	}
+
+	oldVersions := make(map[string]apps.PackageInfo, len(old))
+	for _, p := range old {
+		oldVersions[key(p)] = p
+	}
+	newVersions := make(map[string]bool, len(new))
+	for _, p := range new {
+		newVersions[key(p)] = true
+
+		o, ok := oldVersions[key(p)]
+		switch {
+		case !ok:
+			added = append(added, version(p))
+		case o.Hash != p.Hash:
+			changed = append(changed, version(p))
+		}
+	}
+	for _, p := range old {
+		if !newVersions[key(p)] {
+			removed = append(removed, version(p))
+		}
+	}
+
+	for _, list := range [][]versionDiff{added, removed, changed} {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].VersionCode != list[j].VersionCode {
+				return list[i].VersionCode > list[j].VersionCode
+			}
+			return list[i].APK < list[j].APK
+		})
+	}
+	return
+}
+
+// changedAppFields returns the fields that differ between two entries of an app, sorted. The localized fields are
+// compared one by one.
+func changedAppFields(old, new map[string]interface{}) (fields []string) {
+	compare := func(prefix string, old, new map[string]interface{}, skip func(key string) bool) {
+		keys := make(map[string]bool)
+		for k := range old {
+			keys[k] = true
+		}
+		for k := range new {
+			keys[k] = true
+		}
+		for k := range keys {
+			if !skip(k) && !reflect.DeepEqual(old[k], new[k]) {
+				fields = append(fields, prefix+k)
+			}
+		}
+	}
+
+	compare("", old, new, func(key string) bool {
+		return key == "added" || key == "lastUpdated" || key == "localized"
+	})
+
+	oldLocalized, _ := old["localized"].(map[string]interface{})
+	newLocalized, _ := new["localized"].(map[string]interface{})
+	locales := make(map[string]bool)
+	for l := range oldLocalized {
+		locales[l] = true
+	}
+	for l := range newLocalized {
+		locales[l] = true
+	}
+	for l := range locales {
+		oldFields, _ := oldLocalized[l].(map[string]interface{})
+		newFields, _ := newLocalized[l].(map[string]interface{})
+		compare("localized."+l+".", oldFields, newFields, func(string) bool { return false })
+	}
+
+	sort.Strings(fields)
+	return
+}
+
+// print writes the differences for humans, e.g. for release notes
+func (d indexDiff) print(w io.Writer) (err error) {
+	var b strings.Builder
+
+	if d.empty() {
+		_, err = io.WriteString(w, "The indexes have the same apps and versions\n")
+		return
+	}
+
+	sections := []struct {
+		title string
+		apps  []appDiff
+	}{
+		{"Added apps", d.Added},
+		{"Removed apps", d.Removed},
+		{"Updated apps", d.Updated},
+	}
+	for _, s := range sections {
+		if len(s.apps) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "%s:\n", s.title)
+		for _, a := range s.apps {
+			fmt.Fprintf(&b, "  %s", a.Package)
+			if a.Name != "" {
+				fmt.Fprintf(&b, " (%s)", a.Name)
+			}
+			b.WriteString("\n")
+
+			for _, v := range a.VersionsAdded {
+				fmt.Fprintf(&b, "    + %s\n", v)
+			}
+			for _, v := range a.VersionsRemoved {
+				fmt.Fprintf(&b, "    - %s\n", v)
+			}
+			for _, v := range a.VersionsChanged {
+				fmt.Fprintf(&b, "    ~ %s, the APK changed\n", v)
+			}
+			if len(a.MetadataChanged) > 0 {
+				fmt.Fprintf(&b, "    metadata: %s\n", strings.Join(a.MetadataChanged, ", "))
+			}
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%d added, %d removed, %d updated apps\n", len(d.Added), len(d.Removed), len(d.Updated))
+
+	_, err = io.WriteString(w, b.String())
+	return
+}
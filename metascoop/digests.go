@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// expectedDigest returns the digest the content of asset should have, either from the host or from an earlier download
+func expectedDigest(asset scoop.Asset, digests *download.Digests) (d download.Digest, ok bool) {
+	if asset.SHA256 != "" {
+		return download.Digest{SHA256: asset.SHA256, Size: asset.Size}, true
+	}
+	return digests.Asset(asset.URL)
+}
+
+// assetChanged reports whether the file at path differs from the upstream asset, e.g. because it was replaced after the release.
+// Without a known digest, only the size is compared.
+func assetChanged(asset scoop.Asset, path string, digests *download.Digests) (changed bool, reason string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return true, err.Error()
+	}
+
+	if asset.Size > 0 && info.Size() != asset.Size {
+		return true, fmt.Sprintf("size is %d, upstream asset has %d bytes", info.Size(), asset.Size)
+	}
+
+	want, ok := expectedDigest(asset, digests)
+	if !ok {
+		return false, ""
+	}
+
+	have, err := digests.File(path)
+	if err != nil {
+		return true, err.Error()
+	}
+
+	if have.SHA256 != want.SHA256 {
+		return true, fmt.Sprintf("SHA-256 is %s, upstream asset has %s", have.SHA256, want.SHA256)
+	}
+
+	return false, ""
+}
+
+// findIdenticalFile returns a file with the same content as asset that was downloaded before, e.g. for another release
+func findIdenticalFile(asset scoop.Asset, digests *download.Digests) (path string, ok bool) {
+	want, ok := expectedDigest(asset, digests)
+	if !ok {
+		return
+	}
+	return digests.FindFile(want)
+}
+
+func copyFile(src, dest string) (err error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return
+	}
+
+	_, err = download.ToFile(dest, f)
+	return
+}
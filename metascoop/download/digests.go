@@ -0,0 +1,194 @@
+package download
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Digests remembers the SHA-256 of downloaded assets and of files in the repo, so re-runs neither
+// download nor hash them again. All methods are safe for concurrent use.
+type Digests struct {
+	path string
+	base string
+
+	lock sync.Mutex
+
+	// Assets maps asset URLs to the digest of their content
+	Assets map[string]Digest `json:"assets"`
+
+	// Files maps paths relative to the directory of the cache file to the digest of their content.
+	// Entries are only reused while the size matches: files in the repo are only written by us, and
+	// modification times don't survive git checkouts.
+	Files map[string]Digest `json:"files"`
+}
+
+type Digest struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// LoadDigests reads the digest cache at path. A missing file results in an empty cache.
+func LoadDigests(path string) (d *Digests, err error) {
+	d = &Digests{
+		path:   path,
+		base:   filepath.Dir(path),
+		Assets: make(map[string]Digest),
+		Files:  make(map[string]Digest),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, d)
+	if d.Assets == nil {
+		d.Assets = make(map[string]Digest)
+	}
+	if d.Files == nil {
+		d.Files = make(map[string]Digest)
+	}
+
+	return
+}
+
+func (d *Digests) key(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	base, err := filepath.Abs(d.base)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+	rel, err := filepath.Rel(base, abs)
+	if err != nil {
+		return filepath.ToSlash(abs)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func hashFile(path string) (d Digest, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	d.Size, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	d.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	return
+}
+
+// File returns the digest of the file at path, hashing it only if the cache has no entry for its current size
+func (d *Digests) File(path string) (digest Digest, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	key := d.key(path)
+
+	d.lock.Lock()
+	cached, ok := d.Files[key]
+	d.lock.Unlock()
+	if ok && cached.Size == info.Size() {
+		return cached, nil
+	}
+
+	digest, err = hashFile(path)
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	d.Files[key] = digest
+	d.lock.Unlock()
+
+	return
+}
+
+// Asset returns the digest the content at url had when it was last downloaded
+func (d *Digests) Asset(url string) (digest Digest, ok bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	digest, ok = d.Assets[url]
+	return
+}
+
+// Record stores the digest of a file that was just downloaded from url
+func (d *Digests) Record(url, path string) (err error) {
+	digest, err := hashFile(path)
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Assets[url] = digest
+	d.Files[d.key(path)] = digest
+
+	return
+}
+
+// FindFile returns a file in the cache that has the given content, if it still exists
+func (d *Digests) FindFile(digest Digest) (path string, ok bool) {
+	d.lock.Lock()
+	var candidates []string
+	for key, fd := range d.Files {
+		if fd == digest {
+			candidates = append(candidates, key)
+		}
+	}
+	d.lock.Unlock()
+
+	for _, key := range candidates {
+		path = filepath.Join(d.base, filepath.FromSlash(key))
+		if current, err := d.File(path); err == nil && current == digest {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// Save writes the cache back to its file. Entries of files that no longer exist are dropped.
+func (d *Digests) Save() (err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for key := range d.Files {
+		if _, serr := os.Stat(filepath.Join(d.base, filepath.FromSlash(key))); errors.Is(serr, os.ErrNotExist) {
+			delete(d.Files, key)
+		}
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmpPath := d.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, d.path)
+}
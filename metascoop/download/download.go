@@ -0,0 +1,36 @@
+package download
+
+import (
+	"io"
+	"os"
+)
+
+// ToFile writes the content of rc to targetFile. The content is first written to a temporary file,
+// so targetFile only exists if the download was successful. It returns the number of bytes written.
+func ToFile(targetFile string, rc io.ReadCloser) (n int64, err error) {
+	defer rc.Close()
+
+	targetTemp := targetFile + ".tmp"
+
+	f, err := os.Create(targetTemp)
+	if err != nil {
+		return
+	}
+
+	n, err = io.Copy(f, rc)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(targetTemp)
+
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(targetTemp, targetFile)
+
+	return
+}
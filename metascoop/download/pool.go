@@ -0,0 +1,325 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// Job describes a single file that should be downloaded
+type Job struct {
+	// App is the name of the app this download belongs to, errors are grouped by it
+	App string
+
+	// Name is a human-readable description used in logs
+	Name string
+
+	// URL is the location of the file, it is used for per-host rate limiting
+	URL string
+
+	// Target is the path the file is written to
+	Target string
+
+	// Open starts the download at the given byte offset. It returns the offset the content actually
+	// starts at, which is 0 if the server doesn't support range requests.
+	Open func(ctx context.Context, offset int64) (rc io.ReadCloser, start int64, err error)
+
+	// SHA256 and Size describe the expected content, if known. They are checked before the file
+	// is moved to Target, so a resumed download that doesn't fit together is never used.
+	SHA256 string
+	Size   int64
+
+	// MaxSize aborts the download once there is more content, if set, so files with an unexpected size aren't
+	// downloaded completely
+	MaxSize int64
+
+	// Convert is optional and replaces the downloaded file with the one that is kept, e.g. the APK extracted
+	// from a bundle. It runs before Verify. If it returns an error, the file is removed.
+	Convert func(path string) error
+
+	// Verify is optional and checks the downloaded file. If it returns an error, the file is removed.
+	Verify func(path string) error
+}
+
+// Progress follows running downloads, e.g. to show them in a terminal. Its methods may be called concurrently.
+type Progress interface {
+	// Started is called when an attempt to download job starts, offset bytes are on disk already. The content
+	// that is received is written to the returned writer, which must not fail.
+	Started(job Job, offset int64) io.Writer
+
+	// Finished is called when job is done, err is nil if it was downloaded
+	Finished(job Job, err error)
+}
+
+// Pool downloads jobs concurrently
+type Pool struct {
+	// Workers is the number of concurrent downloads
+	Workers int
+
+	// HostInterval is the minimum time between starting two downloads from the same host
+	HostInterval time.Duration
+
+	// Timeout is the maximum duration of a single download attempt
+	Timeout time.Duration
+
+	// Retry is applied to every download
+	Retry retry.Policy
+
+	// OnSuccess is called after a job was downloaded successfully. It may be called concurrently.
+	OnSuccess func(job Job, bytes int64, elapsed time.Duration)
+
+	// Progress is told about the downloads while they run, if set
+	Progress Progress
+
+	limiter hostLimiter
+}
+
+// Run downloads all jobs and returns the errors that happened, keyed by app name. Downloads that are running
+// when ctx is done are aborted.
+func (p *Pool) Run(ctx context.Context, jobs []Job) (errs map[string][]error) {
+	errs = make(map[string][]error)
+
+	var (
+		errLock sync.Mutex
+		wg      sync.WaitGroup
+		queue   = make(chan Job)
+	)
+
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				start := time.Now()
+
+				n, err := p.run(ctx, job)
+				if p.Progress != nil {
+					p.Progress.Finished(job, err)
+				}
+				if err != nil {
+					slog.Error("Download failed", "app", job.App, "name", job.Name, "error", err)
+
+					errLock.Lock()
+					errs[job.App] = append(errs[job.App], err)
+					errLock.Unlock()
+
+					continue
+				}
+
+				slog.Info("Downloaded", "app", job.App, "name", job.Name)
+
+				if p.OnSuccess != nil {
+					p.OnSuccess(job, n, time.Since(start))
+				}
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+
+	wg.Wait()
+
+	return
+}
+
+func (p *Pool) run(ctx context.Context, job Job) (n int64, err error) {
+	err = p.Retry.Do(ctx, func() (err error) {
+		n, err = p.attempt(ctx, job)
+		return
+	})
+	return
+}
+
+func (p *Pool) attempt(ctx context.Context, job Job) (n int64, err error) {
+	if u, uerr := url.Parse(job.URL); uerr == nil && u.Host != "" {
+		p.limiter.wait(u.Host, p.HostInterval)
+	}
+
+	slog.Info("Downloading", "app", job.App, "name", job.Name, "path", job.Target)
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	// Partial content is kept in a ".part" file next to the target, so a failed attempt (or run)
+	// continues where the previous one stopped
+	partPath := job.Target + ".part"
+
+	offset, err := partSize(partPath, job.Size)
+	if err != nil {
+		return 0, fmt.Errorf("checking partial download %q: %w", partPath, err)
+	}
+
+	resumed := offset > 0
+	if job.Size == 0 || offset < job.Size {
+		if offset > 0 {
+			slog.Info("Resuming download", "app", job.App, "name", job.Name, "offset", offset)
+		}
+
+		var (
+			stream io.ReadCloser
+			start  int64
+		)
+		stream, start, err = job.Open(ctx, offset)
+		if err != nil {
+			return 0, fmt.Errorf("opening stream: %w", err)
+		}
+		resumed = start > 0
+		if p.Progress != nil {
+			stream = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(stream, p.Progress.Started(job, start)), stream}
+		}
+
+		err = appendToFile(partPath, stream, start, job.MaxSize)
+		if err != nil {
+			return 0, fmt.Errorf("writing to %q: %w", partPath, err)
+		}
+	}
+
+	if info, serr := os.Stat(partPath); job.MaxSize > 0 && serr == nil && info.Size() > job.MaxSize {
+		_ = os.Remove(partPath)
+		return 0, retry.Permanent(fmt.Errorf("%s is larger than the maximum of %d bytes", job.Name, job.MaxSize))
+	}
+
+	digest, err := hashFile(partPath)
+	if err != nil {
+		return 0, fmt.Errorf("hashing %q: %w", partPath, err)
+	}
+	n = digest.Size
+
+	if (job.Size > 0 && digest.Size != job.Size) || (job.SHA256 != "" && !strings.EqualFold(digest.SHA256, job.SHA256)) {
+		// Start from zero the next time, the partial content can't be trusted
+		_ = os.Remove(partPath)
+
+		err = fmt.Errorf("downloaded content of %s doesn't match: expected %d bytes with SHA-256 %q, got %d bytes with %q",
+			job.Name, job.Size, job.SHA256, digest.Size, digest.SHA256)
+		if resumed {
+			// A resumed download may have been put together from different versions of the file
+			return 0, err
+		}
+		return 0, retry.Permanent(err)
+	}
+
+	err = os.Rename(partPath, job.Target)
+	if err != nil {
+		return 0, fmt.Errorf("moving %q to %q: %w", partPath, job.Target, err)
+	}
+
+	if job.Convert != nil {
+		err = job.Convert(job.Target)
+		if err != nil {
+			_ = os.Remove(job.Target)
+			return 0, retry.Permanent(fmt.Errorf("converting %q: %w", job.Target, err))
+		}
+	}
+
+	if job.Verify != nil {
+		err = job.Verify(job.Target)
+		if err != nil {
+			_ = os.Remove(job.Target)
+
+			// Downloading the same file again won't make it valid
+			return 0, retry.Permanent(fmt.Errorf("verifying %q: %w", job.Target, err))
+		}
+	}
+
+	return n, nil
+}
+
+// partSize returns the size of the partial download at path, or 0 if there is none or it can't be resumed
+func partSize(path string, expected int64) (size int64, err error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if expected > 0 && info.Size() > expected {
+		// Content changed upstream, the file has to be downloaded again
+		return 0, os.Remove(path)
+	}
+
+	return info.Size(), nil
+}
+
+// appendToFile writes the content of rc to path, starting at byte offset. Content written before an error
+// is kept, so the download can be resumed later. If maxSize is set, at most one byte more is written, which is
+// enough to tell that the content is too large.
+func appendToFile(path string, rc io.ReadCloser, offset, maxSize int64) (err error) {
+	defer rc.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return
+	}
+
+	err = f.Truncate(offset)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		var r io.Reader = rc
+		if maxSize > 0 {
+			r = io.LimitReader(rc, maxSize-offset+1)
+		}
+		_, err = io.Copy(f, r)
+	}
+
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return
+}
+
+// hostLimiter spaces out requests to the same host
+type hostLimiter struct {
+	lock sync.Mutex
+	next map[string]time.Time
+}
+
+func (h *hostLimiter) wait(host string, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	h.lock.Lock()
+	if h.next == nil {
+		h.next = make(map[string]time.Time)
+	}
+
+	now := time.Now()
+	slot := h.next[host]
+	if slot.Before(now) {
+		slot = now
+	}
+	h.next[host] = slot.Add(interval)
+	h.lock.Unlock()
+
+	time.Sleep(time.Until(slot))
+}
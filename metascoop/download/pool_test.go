@@ -0,0 +1,207 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/retry"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+var content = bytes.Repeat([]byte("0123456789abcdef"), 4096)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// server serves content with handler and records the Range headers of its requests
+type server struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	ranges []string
+}
+
+func newServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) *server {
+	t.Helper()
+
+	s := &server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.lock.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *server) requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// serveRanges serves content with support for range requests
+func serveRanges(w http.ResponseWriter, r *http.Request) {
+	http.ServeContent(w, r, "app.apk", time.Time{}, bytes.NewReader(content))
+}
+
+// job returns a job that downloads the APK of s to dir, with the content in part already downloaded
+func job(t *testing.T, s *server, dir string, part []byte) download.Job {
+	t.Helper()
+
+	target := filepath.Join(dir, "app.apk")
+	if part != nil {
+		err := os.WriteFile(target+".part", part, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u := s.URL + "/app.apk"
+	src, err := sources.NewURL("", sources.URLConfig{APK: u}, sources.Options{HTTPClient: s.Client()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return download.Job{
+		App:    "app",
+		Name:   "app.apk",
+		URL:    u,
+		Target: target,
+		Open: func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+			return src.DownloadAsset(ctx, sources.Asset{Name: "app.apk", URL: u}, offset)
+		},
+	}
+}
+
+func run(jobs ...download.Job) []error {
+	p := download.Pool{Retry: retry.Policy{Name: "download"}}
+	return p.Run(context.Background(), jobs)["app"]
+}
+
+func checkTarget(t *testing.T, j download.Job) {
+	t.Helper()
+
+	data, err := os.ReadFile(j.Target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("downloaded %d bytes with SHA-256 %s, want the %d bytes of the content", len(data), sha256Hex(data), len(content))
+	}
+	if _, err := os.Stat(j.Target + ".part"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial download is left: %v", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	s := newServer(t, serveRanges)
+	j := job(t, s, t.TempDir(), content[:1000])
+	j.Size, j.SHA256 = int64(len(content)), sha256Hex(content)
+
+	if errs := run(j); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	checkTarget(t, j)
+	if got := s.requests(); len(got) != 1 || got[0] != "bytes=1000-" {
+		t.Errorf("requested ranges %q, want the content after the partial download", got)
+	}
+}
+
+func TestResumeWithoutRangeSupport(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	})
+	// Without size and digest, only the status tells that the content starts at zero
+	j := job(t, s, t.TempDir(), content[:1000])
+
+	if errs := run(j); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	checkTarget(t, j)
+	if got := s.requests(); len(got) != 1 || got[0] != "bytes=1000-" {
+		t.Errorf("requested ranges %q, want one request for the content after the partial download", got)
+	}
+}
+
+func TestResumeWithUnexpectedContentRange(t *testing.T) {
+	s := newServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Content from the wrong offset
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(content)
+	})
+	j := job(t, s, t.TempDir(), content[:1000])
+
+	errs := run(j)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "unexpected content range") {
+		t.Fatalf("got errors %v, want one about the content range", errs)
+	}
+	if _, err := os.Stat(j.Target); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("target exists after the download failed: %v", err)
+	}
+	if part, err := os.ReadFile(j.Target + ".part"); err != nil || !bytes.Equal(part, content[:1000]) {
+		t.Errorf("partial download was changed: %d bytes, %v", len(part), err)
+	}
+}
+
+func TestResumeWithUnsatisfiableRange(t *testing.T) {
+	s := newServer(t, serveRanges)
+	// The partial download is larger than the content, which has changed upstream
+	j := job(t, s, t.TempDir(), append(append([]byte(nil), content...), "more"...))
+
+	if errs := run(j); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	checkTarget(t, j)
+	want := []string{fmt.Sprintf("bytes=%d-", len(content)+4), ""}
+	if got := s.requests(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("requested ranges %q, want %q: a full download after the unsatisfiable range", got, want)
+	}
+}
+
+func TestDigestMismatch(t *testing.T) {
+	s := newServer(t, serveRanges)
+	j := job(t, s, t.TempDir(), content[:1000])
+	j.Size, j.SHA256 = int64(len(content)), sha256Hex([]byte("other content"))
+
+	errs := run(j)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "doesn't match") {
+		t.Fatalf("got errors %v, want one about the digest", errs)
+	}
+	for _, path := range []string{j.Target, j.Target + ".part"} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after the digest didn't match: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	s := newServer(t, serveRanges)
+	j := job(t, s, t.TempDir(), nil)
+	j.MaxSize = 1000
+
+	errs := run(j)
+	if len(errs) != 1 || !retry.IsPermanent(errs[0]) || !strings.Contains(errs[0].Error(), "larger than the maximum") {
+		t.Fatalf("got errors %v, want a permanent one about the size", errs)
+	}
+	if _, err := os.Stat(j.Target + ".part"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial download of a file that's too large is left: %v", err)
+	}
+}
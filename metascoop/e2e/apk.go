@@ -0,0 +1,331 @@
+package e2e
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+	"unicode/utf16"
+)
+
+// Manifest describes the fixture APK that BuildAPK generates
+type Manifest struct {
+	Package     string
+	VersionCode int64
+	VersionName string
+
+	MinSdkVersion    int
+	TargetSdkVersion int
+
+	Permissions []string
+
+	// ABIs adds an empty native library per ABI, e.g. "arm64-v8a", so the APK is an ABI split
+	ABIs []string
+}
+
+// Signer signs fixture APKs with the APK Signature Scheme v2, like apksigner would. Its key is generated, so every
+// Signer has another certificate.
+type Signer struct {
+	key  *ecdsa.PrivateKey
+	cert []byte
+}
+
+// NewSigner generates a signing key and a self-signed certificate for it
+func NewSigner() (s *Signer, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metascoop e2e"},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2050, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	return &Signer{key: key, cert: cert}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate, the value of "signer" in apps.yaml
+func (s *Signer) Fingerprint() string {
+	sum := sha256.Sum256(s.cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// PEM returns the key as PKCS#8 and the certificate in PEM, the format of -index-key, so s can sign the index too
+func (s *Signer) PEM() (data []byte, err error) {
+	key, err := x509.MarshalPKCS8PrivateKey(s.key)
+	if err != nil {
+		return
+	}
+	data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert})...), nil
+}
+
+// BuildAPK returns an APK with the binary manifest m, signed by s. Without signer, the APK isn't signed.
+func BuildAPK(m Manifest, s *Signer) (data []byte, err error) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"AndroidManifest.xml", binaryManifest(m)},
+		{"classes.dex", []byte("dex\n035\x00")},
+	}
+	for _, abi := range m.ABIs {
+		files = append(files, struct {
+			name string
+			data []byte
+		}{"lib/" + abi + "/libfixture.so", []byte("\x7fELF")})
+	}
+
+	for _, f := range files {
+		w, cerr := z.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)})
+		if cerr != nil {
+			return nil, cerr
+		}
+		_, err = w.Write(f.data)
+		if err != nil {
+			return
+		}
+	}
+	err = z.Close()
+	if err != nil {
+		return
+	}
+
+	if s == nil {
+		return buf.Bytes(), nil
+	}
+	return s.sign(buf.Bytes())
+}
+
+// sigAlgECDSASHA256 is the id of ECDSA with SHA2-256 in APK signatures
+const sigAlgECDSASHA256 = 0x0201
+
+// sign inserts an APK signing block with a v2 signature in front of the central directory of the zip file apk,
+// see https://source.android.com/docs/security/features/apksigning/v2
+func (s *Signer) sign(apk []byte) (signed []byte, err error) {
+	// The zip writer writes no comment, so the end of central directory record is the last 22 bytes
+	eocdOffset := len(apk) - 22
+	if eocdOffset < 0 || binary.LittleEndian.Uint32(apk[eocdOffset:]) != 0x06054b50 {
+		return nil, fmt.Errorf("APK has no end of central directory record")
+	}
+	cdOffset := int(binary.LittleEndian.Uint32(apk[eocdOffset+16:]))
+
+	digest := contentDigest(apk[:cdOffset], apk[cdOffset:eocdOffset], apk[eocdOffset:])
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		return
+	}
+
+	signedData := concat(
+		lengthPrefixed(lengthPrefixed(concat(uint32LE(sigAlgECDSASHA256), lengthPrefixed(digest)))),
+		lengthPrefixed(lengthPrefixed(s.cert)),
+		lengthPrefixed(nil),
+	)
+	sum := sha256.Sum256(signedData)
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, sum[:])
+	if err != nil {
+		return
+	}
+
+	signer := concat(
+		lengthPrefixed(signedData),
+		lengthPrefixed(lengthPrefixed(concat(uint32LE(sigAlgECDSASHA256), lengthPrefixed(sig)))),
+		lengthPrefixed(publicKey),
+	)
+	v2Block := lengthPrefixed(lengthPrefixed(signer))
+
+	pair := concat(uint64LE(uint64(4+len(v2Block))), uint32LE(0x7109871a), v2Block)
+	blockSize := uint64(len(pair) + 8 + 16)
+	block := concat(uint64LE(blockSize), pair, uint64LE(blockSize), []byte("APK Sig Block 42"))
+
+	eocd := append([]byte(nil), apk[eocdOffset:]...)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32(cdOffset+len(block)))
+
+	return concat(apk[:cdOffset], block, apk[cdOffset:eocdOffset], eocd), nil
+}
+
+// contentDigest computes the chunked SHA-256 digest of the sections of an APK
+func contentDigest(sections ...[]byte) []byte {
+	const chunkSize = 1 << 20
+
+	var chunks []byte
+	var count uint32
+	for _, section := range sections {
+		for len(section) > 0 {
+			n := len(section)
+			if n > chunkSize {
+				n = chunkSize
+			}
+			h := sha256.New()
+			h.Write(append([]byte{0xa5}, uint32LE(uint32(n))...))
+			h.Write(section[:n])
+			chunks = h.Sum(chunks)
+			count++
+			section = section[n:]
+		}
+	}
+
+	h := sha256.New()
+	h.Write(append([]byte{0x5a}, uint32LE(count)...))
+	h.Write(chunks)
+	return h.Sum(nil)
+}
+
+// Resource ids of the manifest attributes, see android.R.attr
+const (
+	attrName             = 0x01010003
+	attrMinSdkVersion    = 0x0101020c
+	attrVersionCode      = 0x0101021b
+	attrVersionName      = 0x0101021c
+	attrTargetSdkVersion = 0x01010270
+)
+
+// Value types of binary XML attributes
+const (
+	typeString = 0x03
+	typeIntDec = 0x10
+)
+
+// binaryManifest encodes m as binary XML ("AXML"), the format of AndroidManifest.xml in APKs
+func binaryManifest(m Manifest) []byte {
+	// Attributes with resource ids come first in the string pool, the resource map covers them by index
+	pool := []string{"name", "minSdkVersion", "versionCode", "versionName", "targetSdkVersion", "package", "manifest", "uses-sdk", "uses-permission", "application"}
+	resIDs := []uint32{attrName, attrMinSdkVersion, attrVersionCode, attrVersionName, attrTargetSdkVersion}
+	index := func(s string) uint32 {
+		for i, p := range pool {
+			if p == s {
+				return uint32(i)
+			}
+		}
+		pool = append(pool, s)
+		return uint32(len(pool) - 1)
+	}
+
+	type attr struct {
+		name  string
+		typ   uint8
+		data  uint32
+		value string
+	}
+	str := func(name, value string) attr {
+		return attr{name: name, typ: typeString, value: value}
+	}
+	num := func(name string, value int64) attr {
+		return attr{name: name, typ: typeIntDec, data: uint32(value)}
+	}
+
+	var elements []byte
+	element := func(name string, attrs ...attr) {
+		var a []byte
+		for _, at := range attrs {
+			raw, data := uint32(0xffffffff), at.data
+			if at.typ == typeString {
+				raw = index(at.value)
+				data = raw
+			}
+			a = concat(a, uint32LE(0xffffffff), uint32LE(index(at.name)), uint32LE(raw), uint16LE(8), []byte{0, at.typ}, uint32LE(data))
+		}
+		ext := concat(uint32LE(0xffffffff), uint32LE(index(name)), uint16LE(20), uint16LE(20), uint16LE(uint16(len(attrs))), uint16LE(0), uint16LE(0), uint16LE(0), a)
+		elements = append(elements, chunk(0x0102, concat(uint32LE(1), uint32LE(0xffffffff)), ext)...)
+	}
+	end := func(name string) {
+		ext := concat(uint32LE(0xffffffff), uint32LE(index(name)))
+		elements = append(elements, chunk(0x0103, concat(uint32LE(1), uint32LE(0xffffffff)), ext)...)
+	}
+
+	element("manifest", str("package", m.Package), num("versionCode", m.VersionCode), str("versionName", m.VersionName))
+	var sdk []attr
+	if m.MinSdkVersion > 0 {
+		sdk = append(sdk, num("minSdkVersion", int64(m.MinSdkVersion)))
+	}
+	if m.TargetSdkVersion > 0 {
+		sdk = append(sdk, num("targetSdkVersion", int64(m.TargetSdkVersion)))
+	}
+	element("uses-sdk", sdk...)
+	end("uses-sdk")
+	for _, p := range m.Permissions {
+		element("uses-permission", str("name", p))
+		end("uses-permission")
+	}
+	element("application")
+	end("application")
+	end("manifest")
+
+	var resMap []byte
+	for _, id := range resIDs {
+		resMap = append(resMap, uint32LE(id)...)
+	}
+
+	body := concat(stringPool(pool), chunk(0x0180, nil, resMap), elements)
+	return chunk(0x0003, nil, body)
+}
+
+// stringPool encodes strings as UTF-16 string pool chunk
+func stringPool(strings []string) []byte {
+	var offsets, data []byte
+	for _, s := range strings {
+		offsets = append(offsets, uint32LE(uint32(len(data)))...)
+		units := utf16.Encode([]rune(s))
+		data = append(data, uint16LE(uint16(len(units)))...)
+		for _, u := range units {
+			data = append(data, uint16LE(u)...)
+		}
+		data = append(data, 0, 0)
+	}
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	const headerSize = 28
+	header := concat(uint32LE(uint32(len(strings))), uint32LE(0), uint32LE(0), uint32LE(uint32(headerSize+len(offsets))), uint32LE(0))
+	return chunk(0x0001, header, concat(offsets, data))
+}
+
+// chunk encodes a binary XML chunk of type typ. header is the part of the header after type, header size and size.
+func chunk(typ uint16, header, body []byte) []byte {
+	headerSize := 8 + len(header)
+	return concat(uint16LE(typ), uint16LE(uint16(headerSize)), uint32LE(uint32(headerSize+len(body))), header, body)
+}
+
+func lengthPrefixed(b []byte) []byte {
+	return concat(uint32LE(uint32(len(b))), b)
+}
+
+func concat(parts ...[]byte) (b []byte) {
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return
+}
+
+func uint16LE(v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(nil, v)
+}
+
+func uint32LE(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
+
+func uint64LE(v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, v)
+}
@@ -0,0 +1,149 @@
+// Package e2e runs metascoop end to end against local stand-ins for the services it talks to: a stub of the
+// GitHub API that serves releases and their assets (GitHub), a git server with fixture repos that have fastlane
+// metadata (GitServer) and fixture APKs (BuildAPK). A run writes into the fdroid directory of a temporary Env
+// with the native indexer, so behaviour changes to asset selection, metadata merging or the index can be checked
+// without network access, fdroidserver or real upstream repos.
+//
+// The tests in this package build the metascoop binary and are skipped if git isn't installed.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// Build compiles the metascoop command of the module in moduleDir into dir and returns the path of the binary
+func Build(ctx context.Context, moduleDir, dir string) (path string, err error) {
+	path = filepath.Join(dir, "metascoop")
+	if filepath.Separator == '\\' {
+		path += ".exe"
+	}
+
+	cmd := tools.CommandContext(ctx, "go", "build", "-o", path, ".")
+	cmd.Dir = moduleDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("building metascoop: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return
+}
+
+// Env is a temporary fdroid repo that metascoop runs update, with the apps file "apps.yaml" and the fdroid
+// directory "fdroid" in Dir
+type Env struct {
+	// Binary is the metascoop binary, see Build
+	Binary string
+
+	// Dir contains the apps file, the fdroid directory and everything else a run keeps, e.g. its git cache
+	Dir string
+
+	GitHub *GitHub
+	Git    *GitServer
+}
+
+// NewEnv creates an Env in dir whose fdroid directory has an empty repo, with a config.yml and an index without
+// apps like "fdroid init" and a first "fdroid update" leave it
+func NewEnv(dir, binary string, gh *GitHub, git *GitServer) (e *Env, err error) {
+	e = &Env{Binary: binary, Dir: dir, GitHub: gh, Git: git}
+
+	err = os.MkdirAll(e.RepoDir(), 0o755)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(e.FdroidDir(), "config.yml"), []byte("repo_url: https://example.com/fdroid/repo\nrepo_name: e2e\nrepo_description: Fixture repo\n"), 0o644)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(e.RepoDir(), "index-v1.json"), []byte(`{"repo": {}, "requests": {}, "apps": [], "packages": {}}`+"\n"), 0o644)
+	return
+}
+
+// AppsFile returns the path of the apps file
+func (e *Env) AppsFile() string {
+	return filepath.Join(e.Dir, "apps.yaml")
+}
+
+// FdroidDir returns the path of the fdroid directory
+func (e *Env) FdroidDir() string {
+	return filepath.Join(e.Dir, "fdroid")
+}
+
+// RepoDir returns the path of the repo directory in the fdroid directory
+func (e *Env) RepoDir() string {
+	return filepath.Join(e.FdroidDir(), "repo")
+}
+
+// WriteApps writes the apps file
+func (e *Env) WriteApps(yaml string) error {
+	return os.WriteFile(e.AppsFile(), []byte(yaml), 0o644)
+}
+
+// Run runs an update of the repo with the apps file and returns what it logged. args are added to the flags that
+// point the run at the stand-ins, so they can override them. The error of a failed run contains its output.
+func (e *Env) Run(ctx context.Context, args ...string) (output []byte, err error) {
+	flags := []string{
+		"-ap=" + e.AppsFile(),
+		"-rd=" + e.RepoDir(),
+		"-readme=-",
+		"-indexer=native",
+		"-github-api-url=" + e.GitHub.URL(),
+		"-git-cache=" + filepath.Join(e.Dir, "git-cache"),
+		"-progress=off",
+		"-log-format=text",
+		"-max-retries=0",
+	}
+	cmd := exec.CommandContext(ctx, e.Binary, append(flags, args...)...)
+	cmd.Dir = e.Dir
+	cmd.Env = e.environ()
+
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("metascoop failed: %w\n%s", err, output)
+	}
+	return
+}
+
+// environ returns the environment of runs: no tokens or git config of the user, and github.com repos are fetched
+// from the git server
+func (e *Env) environ() (env []string) {
+	for _, v := range os.Environ() {
+		name, _, _ := strings.Cut(v, "=")
+		if strings.HasPrefix(name, "GIT_") || strings.HasPrefix(name, "METASCOOP_") || strings.HasPrefix(name, "GITHUB_") || name == "CI" {
+			continue
+		}
+		env = append(env, v)
+	}
+	return append(env,
+		"HOME="+e.Dir,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=url."+e.Git.URL()+".insteadOf",
+		"GIT_CONFIG_VALUE_0=https://github.com/",
+	)
+}
+
+// Index reads the index-v1.json the run generated
+func (e *Env) Index() (index *apps.RepoIndex, err error) {
+	path := filepath.Join(e.RepoDir(), "index-v1.json")
+	if _, err = os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("the run generated no index: %w", err)
+	}
+	return apps.ReadIndex(path)
+}
+
+// ReadFile reads the file at the slash separated path relative to the fdroid directory, e.g. "metadata/<package>.yml"
+func (e *Env) ReadFile(path string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(e.FdroidDir(), filepath.FromSlash(path)))
+	return string(data), err
+}
@@ -0,0 +1,258 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Repo is a repository of the fake GitHub
+type Repo struct {
+	Owner, Name string
+
+	Description string
+
+	// License is the SPDX id of the license GitHub detected, e.g. "GPL-3.0-only"
+	License string
+
+	// Releases are listed newest first, like the API does
+	Releases []Release
+}
+
+// FullName returns "owner/name"
+func (r *Repo) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// Release is a release of a Repo
+type Release struct {
+	Tag         string
+	Body        string
+	Prerelease  bool
+	Draft       bool
+	PublishedAt time.Time
+
+	Assets []Asset
+}
+
+// Asset is a file attached to a Release
+type Asset struct {
+	Name string
+	Data []byte
+
+	// Digest adds the "sha256:<hex>" digest GitHub computes for uploaded assets
+	Digest bool
+}
+
+// GitHub is a stub of the parts of the GitHub REST API that metascoop uses to look up releases: repository
+// details, the releases list and asset downloads, which redirect to a download URL like the real API. It is
+// pointed at with -github-api-url. Its methods are safe for concurrent use.
+type GitHub struct {
+	server *httptest.Server
+
+	lock  sync.Mutex
+	repos map[string]*Repo
+
+	// assets maps asset ids to their repo and asset
+	assets    map[int64]assetRef
+	nextID    int64
+	downloads map[string]int
+}
+
+type assetRef struct {
+	repo    *Repo
+	release int
+	asset   int
+}
+
+// NewGitHub starts a fake GitHub with repos. It has to be closed.
+func NewGitHub(repos ...*Repo) *GitHub {
+	g := &GitHub{repos: make(map[string]*Repo), assets: make(map[int64]assetRef), downloads: make(map[string]int)}
+	for _, r := range repos {
+		g.AddRepo(r)
+	}
+	g.server = httptest.NewServer(http.HandlerFunc(g.serve))
+	return g
+}
+
+// URL returns the base URL of the API, the value of -github-api-url
+func (g *GitHub) URL() string {
+	return g.server.URL + "/"
+}
+
+// Close stops the server
+func (g *GitHub) Close() {
+	g.server.Close()
+}
+
+// AddRepo adds r or replaces the repo with its name, e.g. to publish another release between runs
+func (g *GitHub) AddRepo(r *Repo) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.repos[strings.ToLower(r.FullName())] = r
+	for ri := range r.Releases {
+		for ai := range r.Releases[ri].Assets {
+			g.nextID++
+			g.assets[g.nextID] = assetRef{repo: r, release: ri, asset: ai}
+		}
+	}
+}
+
+// Downloads returns how often the asset called name was downloaded from the repo called "owner/name"
+func (g *GitHub) Downloads(fullName, name string) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.downloads[strings.ToLower(fullName)+"/"+name]
+}
+
+func (g *GitHub) serve(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// The rate limit transport reads these
+	w.Header().Set("X-RateLimit-Limit", "5000")
+	w.Header().Set("X-RateLimit-Remaining", "4999")
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "downloads":
+		id, _ := strconv.ParseInt(parts[1], 10, 64)
+		g.serveAsset(w, req, id)
+	case len(parts) >= 3 && parts[0] == "repos":
+		g.lock.Lock()
+		repo, ok := g.repos[strings.ToLower(parts[1]+"/"+parts[2])]
+		g.lock.Unlock()
+		if !ok {
+			apiError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+
+		switch {
+		case len(parts) == 3:
+			g.serveRepo(w, repo)
+		case len(parts) == 4 && parts[3] == "releases":
+			g.serveReleases(w, req, repo)
+		case len(parts) == 6 && parts[3] == "releases" && parts[4] == "assets":
+			if req.Header.Get("Accept") != "application/octet-stream" {
+				apiError(w, http.StatusNotAcceptable, "Only asset downloads are supported")
+				return
+			}
+			http.Redirect(w, req, g.server.URL+"/downloads/"+parts[5], http.StatusFound)
+		default:
+			apiError(w, http.StatusNotFound, "Not Found")
+		}
+	default:
+		apiError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+func (g *GitHub) serveRepo(w http.ResponseWriter, r *Repo) {
+	repo := map[string]interface{}{
+		"name":        r.Name,
+		"full_name":   r.FullName(),
+		"description": r.Description,
+		"html_url":    "https://github.com/" + r.FullName(),
+	}
+	if r.License != "" {
+		repo["license"] = map[string]string{"spdx_id": r.License}
+	}
+	writeJSON(w, repo)
+}
+
+func (g *GitHub) serveReleases(w http.ResponseWriter, req *http.Request, r *Repo) {
+	// All releases fit on the first page
+	if page := req.URL.Query().Get("page"); page != "" && page != "1" {
+		writeJSON(w, []interface{}{})
+		return
+	}
+
+	g.lock.Lock()
+	ids := make(map[[2]int]int64)
+	for id, ref := range g.assets {
+		if ref.repo == r {
+			ids[[2]int{ref.release, ref.asset}] = id
+		}
+	}
+	g.lock.Unlock()
+
+	releases := []interface{}{}
+	for ri, rel := range r.Releases {
+		assets := []interface{}{}
+		for ai, a := range rel.Assets {
+			id := ids[[2]int{ri, ai}]
+			asset := map[string]interface{}{
+				"id":                   id,
+				"name":                 a.Name,
+				"size":                 len(a.Data),
+				"state":                "uploaded",
+				"browser_download_url": fmt.Sprintf("https://github.com/%s/releases/download/%s/%s", r.FullName(), rel.Tag, a.Name),
+			}
+			if a.Digest {
+				asset["digest"] = "sha256:" + sha256Hex(a.Data)
+			}
+			assets = append(assets, asset)
+		}
+
+		published := rel.PublishedAt
+		if published.IsZero() {
+			published = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		}
+		releases = append(releases, map[string]interface{}{
+			"id":           ri + 1,
+			"tag_name":     rel.Tag,
+			"body":         rel.Body,
+			"prerelease":   rel.Prerelease,
+			"draft":        rel.Draft,
+			"published_at": published.Format(time.RFC3339),
+			"assets":       assets,
+		})
+	}
+	writeJSON(w, releases)
+}
+
+func (g *GitHub) serveAsset(w http.ResponseWriter, req *http.Request, id int64) {
+	g.lock.Lock()
+	ref, ok := g.assets[id]
+	var asset Asset
+	if ok {
+		asset = ref.repo.Releases[ref.release].Assets[ref.asset]
+		g.downloads[strings.ToLower(ref.repo.FullName())+"/"+asset.Name]++
+	}
+	g.lock.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, asset.Name, time.Time{}, bytes.NewReader(asset.Data))
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,177 @@
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// GitServer serves fixture repos with git's smart HTTP protocol, through "git http-backend" like a git daemon
+// would. Runs reach it instead of github.com through the url.<base>.insteadOf setting of Env, so apps.yaml keeps
+// the real repo URLs.
+type GitServer struct {
+	root   string
+	git    string
+	server *httptest.Server
+}
+
+// NewGitServer starts a git server for the repos in root. It has to be closed.
+func NewGitServer(root string) (s *GitServer, err error) {
+	gitPath, err := tools.Path("git")
+	if err != nil {
+		return
+	}
+
+	s = &GitServer{root: root, git: gitPath}
+	s.server = httptest.NewServer(&cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + root,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_CONFIG_NOSYSTEM=1",
+			"HOME=" + root,
+		},
+	})
+	return s, nil
+}
+
+// URL returns the base URL of the repos, "<URL>owner/name" is the repo "owner/name"
+func (s *GitServer) URL() string {
+	return s.server.URL + "/"
+}
+
+// Close stops the server
+func (s *GitServer) Close() {
+	s.server.Close()
+}
+
+// Commit is a commit of a fixture repo
+type Commit struct {
+	// Files maps slash separated paths to their content. Files of earlier commits that aren't listed are removed.
+	Files map[string]string
+
+	// Symlinks maps slash separated paths to the targets of symlinks, which are kept as they are
+	Symlinks map[string]string
+
+	Message string
+
+	// Tags are created on the commit, e.g. the tags of releases
+	Tags []string
+}
+
+// AddRepo creates the repo "owner/name" with commits, the last one is the head of its default branch "main".
+// An existing repo is replaced.
+func (s *GitServer) AddRepo(owner, name string, commits ...Commit) (err error) {
+	work, err := os.MkdirTemp("", "metascoop-e2e-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(work)
+
+	err = s.run(work, "init", "-q", "-b", "main")
+	if err != nil {
+		return
+	}
+
+	for i, c := range commits {
+		err = s.run(work, "rm", "-q", "-r", "--cached", "--ignore-unmatch", ".")
+		if err != nil {
+			return
+		}
+		entries, rerr := os.ReadDir(work)
+		if rerr != nil {
+			return rerr
+		}
+		for _, e := range entries {
+			if e.Name() != ".git" {
+				err = os.RemoveAll(filepath.Join(work, e.Name()))
+				if err != nil {
+					return
+				}
+			}
+		}
+
+		paths := make([]string, 0, len(c.Files))
+		for path := range c.Files {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			full := filepath.Join(work, filepath.FromSlash(path))
+			err = os.MkdirAll(filepath.Dir(full), 0o755)
+			if err != nil {
+				return
+			}
+			err = os.WriteFile(full, []byte(c.Files[path]), 0o644)
+			if err != nil {
+				return
+			}
+		}
+
+		for path, link := range c.Symlinks {
+			full := filepath.Join(work, filepath.FromSlash(path))
+			err = os.MkdirAll(filepath.Dir(full), 0o755)
+			if err != nil {
+				return
+			}
+			err = os.Symlink(link, full)
+			if err != nil {
+				return
+			}
+		}
+
+		message := c.Message
+		if message == "" {
+			message = fmt.Sprintf("Commit %d", i+1)
+		}
+		err = s.run(work, "add", "-A")
+		if err == nil {
+			err = s.run(work, "commit", "-q", "--allow-empty", "-m", message)
+		}
+		for _, tag := range c.Tags {
+			if err == nil {
+				err = s.run(work, "tag", tag)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	bare := filepath.Join(s.root, owner, name)
+	err = os.RemoveAll(bare)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(bare), 0o755)
+	}
+	if err == nil {
+		err = s.run("", "clone", "-q", "--bare", work, bare)
+	}
+	return
+}
+
+// run runs git in dir with a fixed identity and dates, so fixture repos don't depend on the user's config
+func (s *GitServer) run(dir string, args ...string) error {
+	cmd := exec.Command(s.git, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL="+os.DevNull,
+		"GIT_AUTHOR_NAME=Fixture", "GIT_AUTHOR_EMAIL=fixture@example.com", "GIT_AUTHOR_DATE=2024-01-01T00:00:00Z",
+		"GIT_COMMITTER_NAME=Fixture", "GIT_COMMITTER_EMAIL=fixture@example.com", "GIT_COMMITTER_DATE=2024-01-01T00:00:00Z",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("git %v: %w: %s", args, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
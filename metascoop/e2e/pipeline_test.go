@@ -0,0 +1,414 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/sign"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// metascoopBinary is the metascoop binary the tests run, built once by TestMain
+var metascoopBinary string
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	if !tools.Available("git") || !tools.Available("go") {
+		fmt.Println("Skipping end-to-end tests, they need git and go")
+		return 0
+	}
+
+	dir, err := os.MkdirTemp("", "metascoop-e2e-bin-")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	metascoopBinary, err = Build(ctx, "..", dir)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return m.Run()
+}
+
+func newTestEnv(t *testing.T, repos ...*Repo) *Env {
+	t.Helper()
+
+	gh := NewGitHub(repos...)
+	t.Cleanup(gh.Close)
+
+	dir := t.TempDir()
+	git, err := NewGitServer(filepath.Join(dir, "upstream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(git.Close)
+
+	e, err := NewEnv(filepath.Join(dir, "env"), metascoopBinary, gh, git)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func run(t *testing.T, e *Env, args ...string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	_, err := e.Run(ctx, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func buildAPK(t *testing.T, m Manifest, s *Signer) []byte {
+	t.Helper()
+
+	data, err := BuildAPK(m, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readFile(t *testing.T, e *Env, path string) string {
+	t.Helper()
+
+	content, err := e.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestPipeline(t *testing.T) {
+	signer, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := func(code int64, name string) Manifest {
+		return Manifest{Package: "com.example.notes", VersionCode: code, VersionName: name, MinSdkVersion: 24, TargetSdkVersion: 34}
+	}
+
+	repo := &Repo{
+		Owner:       "example",
+		Name:        "notes",
+		Description: "Takes notes",
+		License:     "GPL-3.0-only",
+		Releases: []Release{
+			{Tag: "v1.2.0-beta.1", Prerelease: true, Assets: []Asset{
+				{Name: "notes-1.2.0-beta.1.apk", Data: buildAPK(t, manifest(3, "1.2.0-beta.1"), signer)},
+			}},
+			{Tag: "v1.1.0", Body: "Fixes sync", Assets: []Asset{
+				{Name: "notes-1.1.0.aab", Data: []byte("not an APK")},
+				{Name: "notes-1.1.0.apk", Data: buildAPK(t, manifest(2, "1.1.0"), signer), Digest: true},
+			}},
+		},
+	}
+	e := newTestEnv(t, repo)
+
+	err = e.Git.AddRepo("example", "notes", Commit{
+		Files: map[string]string{
+			"README.md": "# Notes\n",
+			"fastlane/metadata/android/en-US/title.txt":             "Notes\n",
+			"fastlane/metadata/android/en-US/short_description.txt": "Takes notes\n",
+			"fastlane/metadata/android/en-US/full_description.txt":  "Notes takes notes.\n",
+			"fastlane/metadata/android/de-DE/full_description.txt":  "Notes macht Notizen.\n",
+		},
+		Tags: []string{"v1.1.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.WriteApps("notes:\n  git: https://github.com/example/notes\n  signer: " + signer.Fingerprint() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, e)
+
+	// Asset selection: the newest stable release, only its APK
+	for asset, want := range map[string]int{"notes-1.1.0.apk": 1, "notes-1.1.0.aab": 0, "notes-1.2.0-beta.1.apk": 0} {
+		if got := e.GitHub.Downloads("example/notes", asset); got != want {
+			t.Errorf("%s was downloaded %d times, want %d", asset, got, want)
+		}
+	}
+
+	// Index output
+	index, err := e.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := index.Packages["com.example.notes"]
+	if len(versions) != 1 {
+		t.Fatalf("index has %d versions of com.example.notes, want 1: %+v", len(versions), index.Packages)
+	}
+	if v := versions[0]; v.VersionCode != 2 || v.VersionName != "1.1.0" || v.Signer != signer.Fingerprint() || v.TargetSdkVersion != 34 {
+		t.Errorf("indexed version is %+v, want version 1.1.0 (2) signed by %s", v, signer.Fingerprint())
+	}
+	if _, err := os.Stat(filepath.Join(e.RepoDir(), versions[0].ApkName)); err != nil {
+		t.Errorf("indexed APK isn't in the repo: %v", err)
+	}
+
+	// Metadata merge: the license and source from GitHub, the texts from fastlane and the release notes
+	metadata := readFile(t, e, "metadata/com.example.notes.yml")
+	for _, want := range []string{"License: GPL-3.0-only", "SourceCode: https://github.com/example/notes", "CurrentVersionCode: 2"} {
+		if !strings.Contains(metadata, want) {
+			t.Errorf("metadata doesn't contain %q:\n%s", want, metadata)
+		}
+	}
+	texts := map[string]string{
+		"en-US/title.txt":            "Notes",
+		"en-US/full_description.txt": "Notes takes notes.",
+		"de-DE/full_description.txt": "Notes macht Notizen.",
+		"en-US/changelogs/2.txt":     "Fixes sync",
+	}
+	for path, want := range texts {
+		if got := readFile(t, e, "metadata/com.example.notes/"+path); strings.TrimSpace(got) != want {
+			t.Errorf("metadata/com.example.notes/%s is %q, want %q", path, got, want)
+		}
+	}
+
+	// A new release is added, the published one isn't downloaded again
+	repo.Releases = append([]Release{{Tag: "v1.3.0", Assets: []Asset{
+		{Name: "notes-1.3.0.apk", Data: buildAPK(t, manifest(4, "1.3.0"), signer)},
+	}}}, repo.Releases...)
+	e.GitHub.AddRepo(repo)
+
+	run(t, e)
+
+	if got := e.GitHub.Downloads("example/notes", "notes-1.1.0.apk"); got != 1 {
+		t.Errorf("published APK was downloaded %d times, want once", got)
+	}
+	if got := e.GitHub.Downloads("example/notes", "notes-1.3.0.apk"); got != 1 {
+		t.Errorf("APK of the new release was downloaded %d times, want once", got)
+	}
+	index, err = e.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest, ok := index.FindLatestPackage("com.example.notes"); !ok || latest.VersionCode != 4 || len(index.Packages["com.example.notes"]) != 2 {
+		t.Errorf("index has versions %+v, want 1.1.0 and 1.3.0", index.Packages["com.example.notes"])
+	}
+	if metadata := readFile(t, e, "metadata/com.example.notes.yml"); !strings.Contains(metadata, "CurrentVersionCode: 4") {
+		t.Errorf("metadata wasn't updated to the new version:\n%s", metadata)
+	}
+}
+
+func TestPipelineRejectsUnexpectedSigner(t *testing.T) {
+	pinned, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEnv(t, &Repo{Owner: "example", Name: "clock", Releases: []Release{
+		{Tag: "v2.0.0", Assets: []Asset{
+			{Name: "clock.apk", Data: buildAPK(t, Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0"}, other)},
+		}},
+	}})
+	err = e.Git.AddRepo("example", "clock", Commit{Files: map[string]string{"README.md": "# Clock\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n  signer: " + pinned.Fingerprint() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, e, "-fail-on=none")
+
+	index, err := e.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions := index.Packages["com.example.clock"]; len(versions) != 0 {
+		t.Errorf("APK with another signer was published: %+v", versions)
+	}
+	matches, _ := filepath.Glob(filepath.Join(e.RepoDir(), "*.apk"))
+	if len(matches) != 0 {
+		t.Errorf("rejected APK was left in the repo: %v", matches)
+	}
+}
+
+func TestPipelineSignsIndex(t *testing.T) {
+	signer, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEnv(t, &Repo{Owner: "example", Name: "clock", Releases: []Release{
+		{Tag: "v2.0.0", Assets: []Asset{
+			{Name: "clock.apk", Data: buildAPK(t, Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0"}, signer)},
+		}},
+	}})
+	err = e.Git.AddRepo("example", "clock", Commit{Files: map[string]string{"README.md": "# Clock\n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n  signer: " + signer.Fingerprint() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := signer.PEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(e.Dir, "index-key.pem")
+	err = os.WriteFile(keyPath, key, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, e, "-index-key="+keyPath)
+
+	// Both signed indexes contain the JSON next to them and are signed by the key, which is the repo fingerprint
+	for jar, name := range map[string]string{"entry.jar": "entry.json", "index-v1.jar": "index-v1.json"} {
+		data, err := os.ReadFile(filepath.Join(e.RepoDir(), jar))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, fingerprint, err := sign.VerifyJAR(data)
+		if err != nil {
+			t.Errorf("verifying %s: %v", jar, err)
+			continue
+		}
+		if fingerprint != signer.Fingerprint() {
+			t.Errorf("%s is signed by %s, want %s", jar, fingerprint, signer.Fingerprint())
+		}
+		if want := readFile(t, e, "repo/"+name); len(files) != 1 || string(files[name]) != want {
+			t.Errorf("%s doesn't contain only the generated %s: %q", jar, name, files)
+		}
+	}
+}
+
+func TestPipelineNativeGit(t *testing.T) {
+	signer, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := newTestEnv(t, &Repo{Owner: "example", Name: "clock", License: "MIT", Releases: []Release{
+		{Tag: "v2.0.0", Body: "Adds alarms", Assets: []Asset{
+			{Name: "clock.apk", Data: buildAPK(t, Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0"}, signer)},
+		}},
+	}})
+	err = e.Git.AddRepo("example", "clock", Commit{Files: map[string]string{
+		"README.md": "# Clock\n",
+		"fastlane/metadata/android/en-US/title.txt":             "Clock\n",
+		"fastlane/metadata/android/en-US/short_description.txt": "Tells the time\n",
+		"fastlane/metadata/android/de-DE/title.txt":             "Uhr\n",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The native backend doesn't read the git config of Env, so the metadata repo is on the git server itself
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n  metadata_repo: " + e.Git.URL() + "example/clock\n  signer: " + signer.Fingerprint() + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	output, err := e.Run(ctx, "-git-backend=native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(output), "Fetching snapshot") || strings.Contains(string(output), "Creating cached clone") {
+		t.Errorf("the metadata wasn't fetched with the native backend:\n%s", output)
+	}
+
+	texts := map[string]string{
+		"en-US/title.txt":             "Clock",
+		"en-US/short_description.txt": "Tells the time",
+		"de-DE/title.txt":             "Uhr",
+		"en-US/changelogs/20.txt":     "Adds alarms",
+	}
+	for path, want := range texts {
+		if got := readFile(t, e, "metadata/com.example.clock/"+path); strings.TrimSpace(got) != want {
+			t.Errorf("metadata/com.example.clock/%s is %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestPipelineRetriesDuplicateVersions(t *testing.T) {
+	signer, err := NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func(name string, code int64) Release {
+		version := fmt.Sprintf("2.%d.0", code-20)
+		return Release{Tag: "v" + version, Assets: []Asset{
+			{Name: name + ".apk", Data: buildAPK(t, Manifest{Package: "com.example.clock", VersionCode: code, VersionName: version + "-" + name}, signer)},
+		}}
+	}
+
+	clock := &Repo{Owner: "example", Name: "clock", Releases: []Release{release("clock", 20)}}
+	e := newTestEnv(t, clock, &Repo{Owner: "example", Name: "clockmirror", Releases: []Release{release("clockmirror", 20)}})
+	for _, name := range []string{"clock", "clockmirror"} {
+		err = e.Git.AddRepo("example", name, Commit{Files: map[string]string{"README.md": "# Clock\n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	const mirror = "clockmirror:\n  git: https://github.com/example/clockmirror\n"
+
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, e)
+
+	// The mirror has the same priority, so the version stays with the app that published it. The app has a new
+	// release, so the index changes.
+	clock.Releases = append([]Release{release("clock", 21)}, clock.Releases...)
+	e.GitHub.AddRepo(clock)
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n" + mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, e, "-fail-on=none")
+	if got := e.GitHub.Downloads("example/clockmirror", "clockmirror.apk"); got != 1 {
+		t.Fatalf("APK of the mirror was downloaded %d times, want once", got)
+	}
+
+	// Once the other app has a lower priority, the mirror's configuration is the same but its APK is published.
+	// It replaces a version that's in the repo already, which is only allowed with -allow-downgrade.
+	err = e.WriteApps("clock:\n  git: https://github.com/example/clock\n  priority: -1\n" + mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run(t, e, "-fail-on=none", "-allow-downgrade")
+	if got := e.GitHub.Downloads("example/clockmirror", "clockmirror.apk"); got != 2 {
+		t.Errorf("APK of the mirror was downloaded %d times, want it to be downloaded again", got)
+	}
+
+	index, err := e.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[int]string)
+	for _, v := range index.Packages["com.example.clock"] {
+		names[v.VersionCode] = v.VersionName
+	}
+	if len(names) != 2 || names[20] != "2.0.0-clockmirror" || names[21] != "2.1.0-clock" {
+		t.Errorf("index has versions %+v, want 20 of the mirror and 21 of the app", index.Packages["com.example.clock"])
+	}
+}
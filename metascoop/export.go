@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/file"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// exportFields are the fields of fdroidserver metadata in the order fdroidserver writes them. Fields of the
+// metadata files of the repo that aren't in the list are left out of the export.
+var exportFields = []string{
+	"Disabled", "AntiFeatures", "Provides", "Categories", "License", "AuthorName", "AuthorEmail", "AuthorWebSite",
+	"WebSite", "SourceCode", "IssueTracker", "Translation", "Changelog", "Donate", "FlattrID", "Liberapay",
+	"OpenCollective", "Bitcoin", "Litecoin", "Name", "AutoName", "Summary", "Description", "RequiresRoot",
+	"RepoType", "Repo", "Binaries", "Builds", "AllowedAPKSigningKeys", "MaintainerNotes", "ArchivePolicy",
+	"AutoUpdateMode", "UpdateCheckMode", "UpdateCheckIgnore", "VercodeOperation", "UpdateCheckName",
+	"UpdateCheckData", "CurrentVersion", "CurrentVersionCode", "NoSourceSince",
+}
+
+// exportBuild is a version in the Builds list of fdroidserver metadata
+type exportBuild struct {
+	VersionName string   `yaml:"versionName"`
+	VersionCode int      `yaml:"versionCode"`
+	Commit      string   `yaml:"commit"`
+	Gradle      []string `yaml:"gradle"`
+}
+
+const exportNotes = `Exported from metascoop, which publishes the APKs of upstream releases. The builds are the
+versions that were published, their commit is the release tag. Set subdir and the other build
+options before building them with fdroidserver.
+`
+
+// exportMetadata writes fdroidserver metadata files for all packages in the repo, so the apps can be built by
+// stock fdroidserver, either instead of metascoop or next to it. The fields come from the metadata files of the
+// repo, the builds from the published versions and the update check from apps.yaml.
+func exportMetadata(args []string) {
+	flags := flag.NewFlagSet("export-metadata", flag.ExitOnError)
+	var (
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file")
+		repoDir      = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory")
+		outDir       = flags.String("o", "fdroidserver/metadata", "Directory the <package>.yml files are written to, it's the \"metadata\" directory of the fdroidserver repo")
+		localized    = flags.Bool("localized", true, "Also copy the localized texts and changelogs in the metadata/<package> directories, which fdroidserver reads in the same layout")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	var onlyPackages stringList
+	flags.Var(&onlyPackages, "only", "Only export this package, can be given multiple times")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s export-metadata [flags]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+
+	fdroidDir := filepath.Dir(*repoDir)
+	index, err := apps.ReadIndex(filepath.Join(*repoDir, "index-v1.json"))
+	if err != nil {
+		fatal("Reading F-Droid repo index failed", "error", err)
+	}
+	names, err := loadAPKNames(fdroidDir)
+	if err != nil {
+		fatal("Reading APK names failed", "error", err)
+	}
+	// Archived versions are still versions that were published
+	if archived, aerr := apps.ReadIndex(filepath.Join(fdroidDir, "archive", "index-v1.json")); aerr == nil {
+		for pkgName, pkgs := range archived.Packages {
+			index.Packages[pkgName] = append(index.Packages[pkgName], pkgs...)
+		}
+	}
+
+	pkgNames := onlyPackages
+	if len(pkgNames) == 0 {
+		for pkgName := range index.Packages {
+			pkgNames = append(pkgNames, pkgName)
+		}
+		sort.Strings(pkgNames)
+	}
+
+	err = os.MkdirAll(*outDir, 0o755)
+	if err != nil {
+		fatal("Creating output directory failed", "path", *outDir, "error", err)
+	}
+
+	var failed bool
+	for _, pkgName := range pkgNames {
+		logger := slog.With("package", pkgName)
+
+		app, ok := exportApp(appsList, pkgName, index, names)
+		if !ok {
+			logger.Warn("No app in the apps file publishes the package, skipping it")
+			continue
+		}
+		logger = logger.With("app", app.Name())
+
+		meta, err := apps.ReadMetaFile(filepath.Join(fdroidDir, "metadata", pkgName+".yml"))
+		if err != nil {
+			logger.Error("Reading metadata file failed", "error", err)
+			failed = true
+			continue
+		}
+
+		data, err := exportMetaFile(app, meta, index.Packages[pkgName], names)
+		if err != nil {
+			logger.Error("Converting metadata failed", "error", err)
+			failed = true
+			continue
+		}
+		path := filepath.Join(*outDir, pkgName+".yml")
+		err = os.WriteFile(path, data, 0o644)
+		if err != nil {
+			logger.Error("Writing metadata file failed", "path", path, "error", err)
+			failed = true
+			continue
+		}
+
+		if *localized {
+			err = copyDir(filepath.Join(fdroidDir, "metadata", pkgName), filepath.Join(*outDir, pkgName))
+			if err != nil {
+				logger.Error("Copying localized metadata failed", "error", err)
+				failed = true
+				continue
+			}
+		}
+
+		logger.Info("Exported metadata", "path", path, "builds", len(index.Packages[pkgName]))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// exportApp returns the app that publishes pkgName
+func exportApp(appsList []apps.AppInfo, pkgName string, index *apps.RepoIndex, names *apkNames) (app apps.AppInfo, ok bool) {
+	for _, app := range appsList {
+		if app.PackageName == pkgName || publishesPackage(app, pkgName, index, names) {
+			return app, true
+		}
+	}
+	return app, false
+}
+
+// exportMetaFile returns the fdroidserver metadata file of app with the fields of its metadata file meta and a
+// build for each of the published versions
+func exportMetaFile(app apps.AppInfo, meta map[string]interface{}, versions []apps.PackageInfo, names *apkNames) (data []byte, err error) {
+	fields := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		fields[k] = v
+	}
+
+	// fdroidserver accepts the comma-separated list of older metadata, but writes a list
+	if list, ok := fields["AntiFeatures"].(string); ok {
+		fields["AntiFeatures"] = strings.Split(list, ",")
+	}
+
+	fields["RepoType"] = "git"
+	fields["Repo"] = app.GitURL
+	if srcCode, _ := fields["SourceCode"].(string); srcCode == "" {
+		fields["SourceCode"] = app.GitURL
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].VersionCode < versions[j].VersionCode
+	})
+	var (
+		builds  []exportBuild
+		seen    = make(map[int]bool)
+		signers []string
+	)
+	for _, p := range versions {
+		if !seen[p.VersionCode] {
+			seen[p.VersionCode] = true
+			builds = append(builds, exportBuild{
+				VersionName: p.VersionName,
+				VersionCode: p.VersionCode,
+				Commit:      releaseTag(app, p, names),
+				Gradle:      []string{"yes"},
+			})
+		}
+		if p.Signer != "" && !contains(signers, p.Signer) {
+			signers = append(signers, p.Signer)
+		}
+	}
+	fields["Builds"] = builds
+	if len(signers) > 0 {
+		fields["AllowedAPKSigningKeys"] = signers
+	}
+	fields["MaintainerNotes"] = exportNotes
+
+	// Stock fdroidserver can only check git tags for updates
+	kind := app.Source
+	if kind == "" {
+		kind, _ = sources.DetectKind(app.GitURL)
+	}
+	switch kind {
+	case sources.KindGitHub, sources.KindGitLab, sources.KindGitea:
+		fields["AutoUpdateMode"] = "Version"
+		fields["UpdateCheckMode"] = "Tags"
+		if app.TagPattern != "" {
+			fields["UpdateCheckMode"] = "Tags " + app.TagPattern
+		}
+	default:
+		fields["AutoUpdateMode"] = "None"
+		fields["UpdateCheckMode"] = "None"
+	}
+
+	if len(builds) > 0 {
+		if _, ok := fields["CurrentVersionCode"]; !ok {
+			fields["CurrentVersion"] = builds[len(builds)-1].VersionName
+			fields["CurrentVersionCode"] = builds[len(builds)-1].VersionCode
+		}
+	}
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, key := range exportFields {
+		value, ok := fields[key]
+		if !ok || value == nil || value == "" {
+			continue
+		}
+		var node yaml.Node
+		err = node.Encode(value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding %s: %w", key, err)
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &node)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(doc)
+	if err != nil {
+		return
+	}
+	err = enc.Close()
+	return buf.Bytes(), err
+}
+
+// releaseTag returns the tag of the release p was published from. It's part of the APK file name, see
+// apps.GenerateReleaseFilename, so it's exact unless the tag has characters that aren't allowed in file names.
+// APKs that were renamed with a file name template are looked up by their release names.
+func releaseTag(app apps.AppInfo, p apps.PackageInfo, names *apkNames) string {
+	prefix := strings.TrimSuffix(apps.GenerateReleaseFilename(app.Name(), ""), ".apk")
+	tag := strings.TrimSuffix(strings.TrimPrefix(names.releaseName(p.ApkName), prefix), ".apk")
+	if len(p.Nativecode) == 1 {
+		// Split APKs, see apps.GenerateSplitReleaseFilename
+		tag = strings.TrimSuffix(tag, "_"+p.Nativecode[0])
+	}
+	return tag
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// copyDir replaces the directory dest with a copy of the directory src, if it exists
+func copyDir(src, dest string) (err error) {
+	if _, serr := os.Stat(src); serr != nil {
+		return nil
+	}
+
+	err = os.RemoveAll(dest)
+	if err != nil {
+		return
+	}
+
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		return file.Copy(p, target, info.Mode().Perm())
+	})
+}
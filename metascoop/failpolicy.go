@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+const (
+	failOnAny       = "any"
+	failOnNone      = "none"
+	failOnThreshold = "threshold"
+)
+
+// failPolicy decides whether errors of single apps fail the whole run. A failed run exits with code 1,
+// so nothing is committed, not even the updates of apps that worked.
+type failPolicy struct {
+	mode string
+
+	// maxFailed is the number of apps that may fail with failOnThreshold. If percent is set,
+	// it is a percentage of all apps instead.
+	maxFailed int
+	percent   bool
+}
+
+// parseFailPolicy parses the -fail-on and -fail-threshold flags. The threshold is a number of apps ("3")
+// or a percentage of all apps ("25%").
+func parseFailPolicy(mode, threshold string) (p failPolicy, err error) {
+	p.mode = mode
+
+	switch mode {
+	case failOnAny, failOnNone:
+		return
+	case failOnThreshold:
+	default:
+		return p, fmt.Errorf("unknown value %q, must be %q, %q or %q", mode, failOnAny, failOnNone, failOnThreshold)
+	}
+
+	if strings.HasSuffix(threshold, "%") {
+		p.percent = true
+		threshold = strings.TrimSuffix(threshold, "%")
+	}
+
+	p.maxFailed, err = strconv.Atoi(strings.TrimSpace(threshold))
+	if err != nil || p.maxFailed < 0 || (p.percent && p.maxFailed > 100) {
+		return p, fmt.Errorf("invalid threshold %q, must be a number of apps or a percentage like \"25%%\"", threshold)
+	}
+
+	return
+}
+
+// shouldFail reports whether the run failed if failedApps of totalApps apps had errors.
+// Errors that don't belong to a single app fail the run unless all errors are ignored.
+func (p failPolicy) shouldFail(failedApps, totalApps int, runErrors bool) bool {
+	switch p.mode {
+	case failOnNone:
+		return false
+	case failOnThreshold:
+		if runErrors {
+			return true
+		}
+
+		allowed := p.maxFailed
+		if p.percent {
+			allowed = totalApps * p.maxFailed / 100
+		}
+		return failedApps > allowed
+	}
+
+	return runErrors || failedApps > 0
+}
+
+// failed logs the apps that had errors and applies the policy to them
+func failed(r *report.Report, p failPolicy, totalApps int) bool {
+	failedApps := r.FailedApps()
+	if len(failedApps) > 0 {
+		slog.Error("Some apps had errors", "failed", len(failedApps), "total", totalApps, "apps", strings.Join(failedApps, ", "))
+	}
+
+	return p.shouldFail(len(failedApps), totalApps, r.HasRunErrors())
+}
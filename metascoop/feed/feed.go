@@ -0,0 +1,280 @@
+// Package feed generates Atom and JSON feeds of the versions published in the repo, so users and bots can
+// subscribe to updates without an F-Droid client.
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+const (
+	// AtomFile and JSONFile are the names of the feeds in the repo directory
+	AtomFile = "feed.xml"
+	JSONFile = "feed.json"
+)
+
+// Entry is a published version of an app
+type Entry struct {
+	Package     string
+	Name        string
+	VersionName string
+	VersionCode int
+	APK         string
+	Added       time.Time
+
+	// Changelog is the English changelog of the version, if there is one
+	Changelog string
+}
+
+// ID returns a URI that identifies the version
+func (e Entry) ID() string {
+	return fmt.Sprintf("urn:fdroid:%s:%d", e.Package, e.VersionCode)
+}
+
+// Title returns the title of the entry, e.g. "NymVPN 1.2.3"
+func (e Entry) Title() string {
+	return e.Name + " " + e.VersionName
+}
+
+// Text returns the changelog, or a short notice if the version has none
+func (e Entry) Text() string {
+	if e.Changelog != "" {
+		return e.Changelog
+	}
+	return fmt.Sprintf("Version %s (%d) of %s was published.", e.VersionName, e.VersionCode, e.Name)
+}
+
+// Feed is the list of the newest versions in a repo
+type Feed struct {
+	Title   string
+	Address string
+
+	Entries []Entry
+}
+
+// New returns a feed of the newest max versions of the index. Changelogs are read from the metadata directory.
+// The result only depends on the index and the changelogs, so regenerating it without new versions doesn't
+// change the files.
+func New(index *apps.RepoIndex, metadataDir string, max int) (f Feed) {
+	f.Title, _ = index.Repo["name"].(string)
+	if f.Title == "" {
+		f.Title = "F-Droid repo"
+	}
+	f.Address, _ = index.Repo["address"].(string)
+	f.Address = strings.TrimSuffix(f.Address, "/")
+
+	names := make(map[string]string)
+	for _, app := range index.Apps {
+		pkgName, _ := app["packageName"].(string)
+		names[pkgName] = appName(app)
+	}
+
+	for pkgName, pkgs := range index.Packages {
+		for _, p := range pkgs {
+			e := Entry{
+				Package:     pkgName,
+				Name:        names[pkgName],
+				VersionName: p.VersionName,
+				VersionCode: p.VersionCode,
+				APK:         p.ApkName,
+				Added:       time.UnixMilli(p.Added).UTC(),
+			}
+			if e.Name == "" {
+				e.Name = pkgName
+			}
+
+			changelog, err := os.ReadFile(filepath.Join(metadataDir, pkgName, "en-US", "changelogs", fmt.Sprintf("%d.txt", p.VersionCode)))
+			if err == nil {
+				e.Changelog = strings.TrimSpace(string(changelog))
+			}
+
+			f.Entries = append(f.Entries, e)
+		}
+	}
+
+	sort.Slice(f.Entries, func(i, j int) bool {
+		a, b := f.Entries[i], f.Entries[j]
+		if !a.Added.Equal(b.Added) {
+			return a.Added.After(b.Added)
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.VersionCode > b.VersionCode
+	})
+
+	if max > 0 && len(f.Entries) > max {
+		f.Entries = f.Entries[:max]
+	}
+
+	return
+}
+
+func appName(app map[string]interface{}) string {
+	if name, _ := app["name"].(string); name != "" {
+		return name
+	}
+	localized, _ := app["localized"].(map[string]interface{})
+	fields, _ := localized["en-US"].(map[string]interface{})
+	name, _ := fields["name"].(string)
+	return name
+}
+
+// updated is the time of the newest entry, as the feed should only change when entries do
+func (f Feed) updated() time.Time {
+	if len(f.Entries) == 0 {
+		return time.Unix(0, 0).UTC()
+	}
+	return f.Entries[0].Added
+}
+
+func (f Feed) link(name string) string {
+	if f.Address == "" {
+		return ""
+	}
+	return f.Address + "/" + name
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string    `xml:"id"`
+	Title     string    `xml:"title"`
+	Updated   string    `xml:"updated"`
+	Published string    `xml:"published"`
+	Link      *atomLink `xml:"link"`
+	Content   *atomText `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// Atom returns the feed in the Atom format
+func (f Feed) Atom() (data []byte, err error) {
+	feed := atomFeed{
+		ID:      "urn:fdroid:feed",
+		Title:   f.Title,
+		Updated: f.updated().Format(time.RFC3339),
+		Author:  f.Title,
+	}
+	if f.Address != "" {
+		feed.ID = f.link(AtomFile)
+		feed.Links = []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: f.link(AtomFile)},
+			{Rel: "alternate", Href: f.Address},
+		}
+	}
+
+	for _, e := range f.Entries {
+		ae := atomEntry{
+			ID:        e.ID(),
+			Title:     e.Title(),
+			Updated:   e.Added.Format(time.RFC3339),
+			Published: e.Added.Format(time.RFC3339),
+			Content:   &atomText{Type: "text", Text: e.Text()},
+		}
+		if href := f.link(e.APK); href != "" {
+			ae.Link = &atomLink{Rel: "enclosure", Type: "application/vnd.android.package-archive", Href: href}
+		}
+		feed.Entries = append(feed.Entries, ae)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err = enc.Encode(feed)
+	if err != nil {
+		return
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+type jsonItem struct {
+	ID            string `json:"id"`
+	Title         string `json:"title"`
+	ContentText   string `json:"content_text"`
+	URL           string `json:"url,omitempty"`
+	DatePublished string `json:"date_published"`
+}
+
+type jsonFeed struct {
+	Version     string     `json:"version"`
+	Title       string     `json:"title"`
+	HomePageURL string     `json:"home_page_url,omitempty"`
+	FeedURL     string     `json:"feed_url,omitempty"`
+	Items       []jsonItem `json:"items"`
+}
+
+// JSON returns the feed in the JSON Feed format, see https://www.jsonfeed.org/version/1.1/
+func (f Feed) JSON() (data []byte, err error) {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Address,
+		FeedURL:     f.link(JSONFile),
+		Items:       []jsonItem{},
+	}
+
+	for _, e := range f.Entries {
+		feed.Items = append(feed.Items, jsonItem{
+			ID:            e.ID(),
+			Title:         e.Title(),
+			ContentText:   e.Text(),
+			URL:           f.link(e.APK),
+			DatePublished: e.Added.Format(time.RFC3339),
+		})
+	}
+
+	data, err = json.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return
+	}
+	return append(data, '\n'), nil
+}
+
+// Write writes the Atom feed, and the JSON feed if withJSON is set, to the repo directory
+func (f Feed) Write(repoDir string, withJSON bool) (err error) {
+	data, err := f.Atom()
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(repoDir, AtomFile), data, 0o644)
+	if err != nil || !withJSON {
+		return
+	}
+
+	data, err = f.JSON()
+	if err != nil {
+		return
+	}
+	return os.WriteFile(filepath.Join(repoDir, JSONFile), data, 0o644)
+}
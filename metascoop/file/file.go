@@ -2,6 +2,7 @@ package file
 
 import (
 	"io"
+	"io/fs"
 	"os"
 )
 
@@ -48,3 +49,22 @@ func Move(oldpath, newpath string) (err error) {
 	// Now that we know that the destination file was created, we can remove the old path
 	return os.Remove(oldpath)
 }
+
+// Copy copies the file src to the new file dest with mode, it fails if dest exists
+func Copy(src, dest string, mode fs.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
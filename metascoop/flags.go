@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// stringList is a flag that can be given multiple times
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// byteSize is a flag for a number of bytes, with an optional binary suffix like "500M" or "1GiB"
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	n, err := apps.ParseSize(value)
+	if err != nil {
+		return err
+	}
+
+	*b = byteSize(n)
+	return nil
+}
+
+// duration is a flag for a duration like flag.Duration, which may also be given in days like "2d"
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(value string) error {
+	v, err := apps.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
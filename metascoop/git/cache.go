@@ -0,0 +1,481 @@
+package git
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+const (
+	// BackendExec uses the git binary and keeps bare clones in the cache
+	BackendExec = "exec"
+
+	// BackendNative speaks the smart HTTP protocol directly and keeps a snapshot of the checked out files in the cache
+	BackendNative = "native"
+)
+
+// Cache keeps clones of upstream repositories in a directory, so later runs only have to fetch what changed
+type Cache struct {
+	Dir string
+
+	// Backend is either BackendExec (the default) or BackendNative
+	Backend string
+
+	// SparsePatterns are path prefixes the native backend restricts its checkouts to. If empty, everything is checked out.
+	SparsePatterns []string
+
+	// RepoPatterns are checked out in addition to SparsePatterns for single repos, keyed by URL
+	RepoPatterns map[string][]string
+
+	// Credentials are used to fetch private repos, keyed by URL
+	Credentials map[string]Credentials
+
+	HTTPClient *http.Client
+
+	// GitHubClient, if set, is used to fetch the SparsePatterns of github.com repos through the GitHub API, which
+	// is much faster than fetching their history. Selections of more than ContentsMaxFiles files or
+	// ContentsMaxBytes are fetched with the backend, as are repos the API fails for. The client should authenticate,
+	// every file is a request. GitHubAPI is the base URL of the API, https://api.github.com/ by default.
+	GitHubClient *http.Client
+	GitHubAPI    string
+
+	// ImageBudget limits the bytes of images that are fetched through the GitHub API, e.g. screenshots and feature
+	// graphics, over the lifetime of the Cache. Images that don't fit keep the version of the previous snapshot,
+	// see Partial. Nil means no limit.
+	ImageBudget *ByteBudget
+
+	// Retry is applied when fetching from upstream
+	Retry retry.Policy
+
+	// Timeout limits each attempt to fetch a repo and each checkout, git is killed when it's reached. Zero means no limit.
+	Timeout time.Duration
+
+	lock    sync.Mutex
+	repos   map[string]*sync.Mutex
+	fetched map[string]error
+
+	// contents are the targets the fast path was tried for, true if their snapshot was fetched with it
+	contents map[Target]bool
+
+	// partial are the targets whose snapshot has images of an older commit, because ImageBudget was exhausted
+	partial map[Target]bool
+
+	checkouts map[Target]*sharedCheckout
+}
+
+// sharedCheckout is a working copy that's created once for all callers of SharedCheckout
+type sharedCheckout struct {
+	once    sync.Once
+	dirPath string
+	err     error
+}
+
+// NewCache returns a cache that stores its clones in dir
+func NewCache(dir string) (c *Cache, err error) {
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return
+	}
+
+	return &Cache{
+		Dir:       dir,
+		repos:     make(map[string]*sync.Mutex),
+		fetched:   make(map[string]error),
+		contents:  make(map[Target]bool),
+		partial:   make(map[Target]bool),
+		checkouts: make(map[Target]*sharedCheckout),
+	}, nil
+}
+
+func (c *Cache) mirrorPath(gitUrl string) string {
+	sum := sha256.Sum256([]byte(gitUrl))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:8])+".git")
+}
+
+// patterns returns the sparse patterns for gitUrl, or nil if everything is checked out
+func (c *Cache) patterns(gitUrl string) []string {
+	if len(c.SparsePatterns) == 0 {
+		return nil
+	}
+	return append(append([]string(nil), c.SparsePatterns...), c.RepoPatterns[gitUrl]...)
+}
+
+func (c *Cache) snapshotPath(gitUrl, ref string) string {
+	sum := sha256.Sum256([]byte(gitUrl + "\x00" + strings.Join(c.patterns(gitUrl), "\x00")))
+	name := hex.EncodeToString(sum[:8])
+	if ref != "" {
+		refSum := sha256.Sum256([]byte(ref))
+		name += "-" + hex.EncodeToString(refSum[:4])
+	}
+	return filepath.Join(c.Dir, name+".tree")
+}
+
+// Target is a repository and the tag or branch of it that is checked out. An empty Ref is the default branch.
+type Target struct {
+	URL string
+	Ref string
+}
+
+// fetchKey identifies what has to be fetched for t: bare clones contain all refs, snapshots only one
+func (c *Cache) fetchKey(t Target) string {
+	if c.Backend == BackendNative {
+		return t.URL + "\x00" + t.Ref
+	}
+	return t.URL
+}
+
+func (c *Cache) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Cache) repoLock(gitUrl string) *sync.Mutex {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	l, ok := c.repos[gitUrl]
+	if !ok {
+		l = new(sync.Mutex)
+		c.repos[gitUrl] = l
+	}
+	return l
+}
+
+// Update makes sure the cached clone of t is up to date. The network is only accessed once per repo (and ref,
+// for the native backend) for each Cache.
+func (c *Cache) Update(ctx context.Context, t Target) (err error) {
+	l := c.repoLock(t.URL)
+	l.Lock()
+	defer l.Unlock()
+
+	if c.usesContents(t) && c.updateFromContents(ctx, t) {
+		return nil
+	}
+
+	key := c.fetchKey(t)
+
+	c.lock.Lock()
+	err, ok := c.fetched[key]
+	c.lock.Unlock()
+	if ok {
+		return
+	}
+
+	err = c.Retry.Do(ctx, func() error {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+
+		err := c.update(ctx, t)
+		if errors.Is(err, ErrAuth) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrProtocol) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+
+	c.lock.Lock()
+	c.fetched[key] = err
+	c.lock.Unlock()
+
+	return
+}
+
+// Resolve returns the commit t points to upstream, without fetching anything. It only asks the remote for its refs,
+// so it's much cheaper than Update and tells whether what was checked out of t before is still current.
+func (c *Cache) Resolve(ctx context.Context, t Target) (commit string, err error) {
+	err = c.Retry.Do(ctx, func() (err error) {
+		ctx, cancel := c.withTimeout(ctx)
+		defer cancel()
+
+		commit, err = c.resolve(ctx, t)
+		if errors.Is(err, ErrAuth) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrProtocol) {
+			return retry.Permanent(err)
+		}
+		return err
+	})
+	return
+}
+
+func (c *Cache) resolve(ctx context.Context, t Target) (commit string, err error) {
+	creds := c.Credentials[t.URL]
+
+	if c.Backend == BackendNative {
+		r, err := openRemote(ctx, c.httpClient(), t.URL, creds)
+		if err != nil {
+			return "", err
+		}
+		return r.resolve(t.Ref)
+	}
+
+	// Like the native backend, annotated tags resolve to the commit they point to
+	names := []string{"HEAD"}
+	if t.Ref != "" {
+		names = []string{"refs/tags/" + t.Ref + "^{}", "refs/tags/" + t.Ref, "refs/heads/" + t.Ref}
+	}
+
+	output, err := outputGit(ctx, "", creds, nil, nil, append([]string{"ls-remote", "--", t.URL}, names...)...)
+	if err != nil {
+		return
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	for _, name := range names {
+		if commit, ok := refs[name]; ok {
+			return commit, nil
+		}
+	}
+
+	return "", &CloneError{URL: RedactURL(t.URL), Op: "resolving ref", Kind: ErrNotFound, Err: fmt.Errorf("no tag or branch %q", t.Ref)}
+}
+
+// withTimeout limits ctx to c.Timeout
+func (c *Cache) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout > 0 {
+		return context.WithTimeout(ctx, c.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Cache) update(ctx context.Context, t Target) (err error) {
+	if c.Backend == BackendNative {
+		return c.updateSnapshot(ctx, t.URL, t.Ref)
+	}
+
+	gitUrl := t.URL
+	creds := c.Credentials[gitUrl]
+
+	mirror := c.mirrorPath(gitUrl)
+
+	if _, serr := os.Stat(mirror); errors.Is(serr, os.ErrNotExist) {
+		slog.Info("Creating cached clone", "git", RedactURL(gitUrl))
+
+		err = runGit(ctx, "", creds, nil, "clone", "--bare", "--quiet", "--", gitUrl, mirror)
+		if err != nil {
+			_ = os.RemoveAll(mirror)
+		}
+		return
+	}
+
+	slog.Info("Fetching updates for cached clone", "git", RedactURL(gitUrl))
+
+	err = runGit(ctx, mirror, creds, nil, "fetch", "--quiet", "--prune", "--tags", "--", gitUrl, "+refs/heads/*:refs/heads/*")
+	if err != nil && ctx.Err() == nil {
+		// The cached clone might be corrupted, so we start from scratch
+		slog.Warn("Fetching into cached clone failed, cloning again", "git", RedactURL(gitUrl), "error", err)
+
+		_ = os.RemoveAll(mirror)
+
+		err = runGit(ctx, "", creds, nil, "clone", "--bare", "--quiet", "--", gitUrl, mirror)
+		if err != nil {
+			_ = os.RemoveAll(mirror)
+		}
+	}
+
+	return
+}
+
+// Prefetch updates the cached clones of all given targets, using up to workers concurrent git processes
+func (c *Cache) Prefetch(ctx context.Context, targets []Target, workers int) (errs map[Target]error) {
+	errs = make(map[Target]error)
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		queue   = make(chan Target)
+	)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for t := range queue {
+				err := c.Update(ctx, t)
+				if err != nil {
+					errLock.Lock()
+					errs[t] = err
+					errLock.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, t := range targets {
+		queue <- t
+	}
+	close(queue)
+
+	wg.Wait()
+
+	return
+}
+
+// Checkout creates a working copy of t in a new temporary directory. The caller is responsible for removing it.
+func (c *Cache) Checkout(ctx context.Context, t Target) (dirPath string, err error) {
+	err = c.Update(ctx, t)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	dirPath, err = os.MkdirTemp("", "git-*")
+	if err != nil {
+		return
+	}
+
+	if c.Backend == BackendNative || c.fromContents(t) {
+		err = copyTree(c.snapshotPath(t.URL, t.Ref), dirPath)
+		if err != nil {
+			_ = os.RemoveAll(dirPath)
+		}
+		return
+	}
+
+	// Cloning from a local path hard-links objects, so this is cheap
+	args := []string{"clone", "--quiet"}
+	if t.Ref != "" {
+		args = append(args, "--branch", t.Ref)
+	}
+	err = run(ctx, "", append(args, "--", c.mirrorPath(t.URL), dirPath)...)
+	if err != nil {
+		_ = os.RemoveAll(dirPath)
+		return
+	}
+
+	return
+}
+
+// SharedCheckout returns a working copy of t like Checkout, but all callers get the same one, e.g. the apps of
+// a monorepo that take their metadata from different directories of it. It must not be changed and is only
+// removed by RemoveCheckouts.
+func (c *Cache) SharedCheckout(ctx context.Context, t Target) (dirPath string, err error) {
+	c.lock.Lock()
+	s, ok := c.checkouts[t]
+	if !ok {
+		s = &sharedCheckout{}
+		c.checkouts[t] = s
+	}
+	c.lock.Unlock()
+
+	s.once.Do(func() {
+		s.dirPath, s.err = c.Checkout(ctx, t)
+	})
+	return s.dirPath, s.err
+}
+
+// RemoveCheckouts removes the working copies created by SharedCheckout
+func (c *Cache) RemoveCheckouts() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for t, s := range c.checkouts {
+		if s.dirPath != "" {
+			_ = os.RemoveAll(s.dirPath)
+		}
+		delete(c.checkouts, t)
+	}
+}
+
+// updateSnapshot checks out ref (or the remote HEAD) into the snapshot directory, unless the snapshot is already at that commit
+func (c *Cache) updateSnapshot(ctx context.Context, gitUrl, ref string) (err error) {
+	snapshot := c.snapshotPath(gitUrl, ref)
+	commitFile := snapshot + ".commit"
+
+	r, err := openRemote(ctx, c.httpClient(), gitUrl, c.Credentials[gitUrl])
+	if err != nil {
+		return
+	}
+
+	commit, err := r.resolve(ref)
+	if err != nil {
+		return
+	}
+
+	if current, rerr := os.ReadFile(commitFile); rerr == nil && string(current) == commit {
+		if _, serr := os.Stat(snapshot); serr == nil {
+			slog.Info("Cached snapshot is up to date", "git", RedactURL(gitUrl), "commit", commit)
+			return nil
+		}
+	}
+
+	slog.Info("Fetching snapshot", "git", RedactURL(gitUrl), "commit", commit)
+
+	tmp := snapshot + ".tmp"
+	_ = os.RemoveAll(tmp)
+
+	err = r.checkout(ctx, tmp, commit, c.patterns(gitUrl))
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return
+	}
+
+	_ = os.Remove(commitFile)
+	_ = os.RemoveAll(snapshot)
+
+	err = os.Rename(tmp, snapshot)
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(commitFile, []byte(commit), 0o644)
+}
+
+// copyTree copies all files below src into dst, and the symlinks that stay inside it
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil || !linksInside(dst, target, link) {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, info.Mode().Perm())
+	})
+}
@@ -1,22 +1,94 @@
 package git
 
 import (
+	"context"
+	"fmt"
 	"os"
-	"os/exec"
+	"strings"
 )
 
-func CloneRepo(gitUrl string) (dirPath string, err error) {
+// CloneRepo makes a shallow clone of ref (a branch or tag, the default branch if empty) of gitUrl in a new
+// temporary directory. If patterns are given, only the paths starting with one of them are checked out;
+// like SparsePatterns they are literal path prefixes, e.g. "fastlane/" or "README.md".
+// creds are only needed for private repos. The caller is responsible for removing the directory.
+func CloneRepo(ctx context.Context, gitUrl, ref string, patterns []string, creds Credentials) (dirPath string, err error) {
+	sparse, err := sparseCheckoutPatterns(patterns)
+	if err != nil {
+		return
+	}
+
 	dirPath, err = os.MkdirTemp("", "git-*")
 	if err != nil {
 		return
 	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dirPath)
+			dirPath = ""
+		}
+	}()
 
-	cloneCmd := exec.Command("git", "clone", gitUrl, dirPath)
-	err = cloneCmd.Run()
+	args := []string{"clone", "--quiet", "--depth=1", "--no-checkout"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	if len(sparse) > 0 {
+		args = append(args, "--filter=blob:none")
+	}
+	// "--" makes sure a URL starting with "-" isn't taken as an option
+	args = append(args, "--", gitUrl, dirPath)
+
+	err = runGit(ctx, "", creds, nil, args...)
 	if err != nil {
-		_ = os.RemoveAll(dirPath)
 		return
 	}
 
+	if len(sparse) > 0 {
+		// Patterns are passed on stdin so they don't have to survive the argument parser of git
+		err = runGit(ctx, dirPath, creds, strings.NewReader(strings.Join(sparse, "\n")+"\n"), "sparse-checkout", "set", "--no-cone", "--stdin")
+		if err != nil {
+			return
+		}
+	}
+
+	// The blobs of a partial clone are only fetched now
+	err = runGit(ctx, dirPath, creds, nil, "checkout", "--quiet")
 	return
 }
+
+// sparseCheckoutPatterns converts path prefixes to patterns for "git sparse-checkout set --no-cone", which
+// uses the .gitignore syntax
+func sparseCheckoutPatterns(prefixes []string) (patterns []string, err error) {
+	for _, prefix := range prefixes {
+		p := strings.TrimPrefix(prefix, "/")
+		if p == "" || strings.Trim(p, "/") == "" {
+			return nil, fmt.Errorf("invalid sparse checkout pattern %q: selects the whole repository", prefix)
+		}
+		if strings.ContainsAny(p, "\n\r") {
+			return nil, fmt.Errorf("invalid sparse checkout pattern %q: contains a line break", prefix)
+		}
+
+		patterns = append(patterns, "/"+escapePattern(p))
+	}
+	return
+}
+
+// escapePattern escapes all characters of p that have a special meaning in .gitignore patterns, so it only
+// matches the path p itself (and everything below it). The leading "/" anchors it at the repository root,
+// which also keeps "#" and "!" from starting a comment or a negation.
+func escapePattern(p string) string {
+	var b strings.Builder
+	for i, r := range p {
+		switch r {
+		case '\\', '*', '?', '[':
+			b.WriteByte('\\')
+		case ' ':
+			// Trailing spaces are ignored unless they are escaped
+			if strings.TrimRight(p[i:], " ") == "" {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,119 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSparseCheckoutPatterns(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"fastlane/", "/fastlane/"},
+		{"/metadata/", "/metadata/"},
+		{"README.md", "/README.md"},
+		{"icons/*.png", `/icons/\*.png`},
+		{"what?", `/what\?`},
+		{"[draft]/", `/\[draft]/`},
+		{`back\slash`, `/back\\slash`},
+		{"#notes", "/#notes"},
+		{"!important", "/!important"},
+		{"trailing  ", `/trailing\ \ `},
+		{"inner space/x", "/inner space/x"},
+	}
+
+	for _, tt := range tests {
+		got, err := sparseCheckoutPatterns([]string{tt.prefix})
+		if err != nil {
+			t.Errorf("sparseCheckoutPatterns(%q): unexpected error: %s", tt.prefix, err.Error())
+			continue
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("sparseCheckoutPatterns(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+
+	for _, prefix := range []string{"", "/", "//", "a\nb"} {
+		if _, err := sparseCheckoutPatterns([]string{prefix}); err == nil {
+			t.Errorf("sparseCheckoutPatterns(%q): expected an error", prefix)
+		}
+	}
+}
+
+func TestCloneRepoPatterns(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	upstream := t.TempDir()
+	files := []string{
+		"README.md",
+		"src/main.go",
+		"fastlane/metadata/android/en-US/title.txt",
+		"icons/*.png",
+		"icons/a.png",
+		"[draft]/notes.txt",
+		"d/notes.txt",
+	}
+	for _, f := range files {
+		p := filepath.Join(upstream, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(f), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitCmds := [][]string{
+		{"init", "--quiet", "--initial-branch=main"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"},
+		{"tag", "v1.0"},
+	}
+	for _, args := range gitCmds {
+		if err := run(context.Background(), upstream, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := CloneRepo(context.Background(), "file://"+upstream, "v1.0", []string{"fastlane/", "README.md", "icons/*.png", "[draft]/"}, Credentials{})
+	if err != nil {
+		t.Fatalf("CloneRepo: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	var got []string
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"README.md",
+		"[draft]/notes.txt",
+		"fastlane/metadata/android/en-US/title.txt",
+		"icons/*.png",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("checked out %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,202 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// Identity is the author and committer of commits
+type Identity struct {
+	Name  string
+	Email string
+}
+
+const (
+	SigningOpenPGP = "openpgp"
+	SigningSSH     = "ssh"
+)
+
+// Signing configures how commits are signed. The zero value doesn't sign.
+type Signing struct {
+	// Format is SigningOpenPGP or SigningSSH, empty disables signing
+	Format string
+
+	// Key is the OpenPGP key ID or the path of the SSH key. With KeyData, it can be empty.
+	Key string
+
+	// KeyData is the content of a private key, e.g. from a CI secret. An armored OpenPGP key is imported into
+	// a temporary keyring, an SSH key is written to a temporary file. Keys must not have a passphrase.
+	KeyData string
+}
+
+// setup returns the git config options and environment that make git sign commits. cleanup removes the
+// temporary keyring or key file.
+func (s Signing) setup(ctx context.Context) (config []string, env []string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	if s.Format == "" {
+		return []string{"commit.gpgsign=false"}, nil, cleanup, nil
+	}
+
+	dir, err := os.MkdirTemp("", "metascoop-signing-*")
+	if err != nil {
+		return
+	}
+	cleanup = func() { _ = os.RemoveAll(dir) }
+
+	defer func() {
+		if err != nil {
+			cleanup()
+			cleanup = func() {}
+		}
+	}()
+
+	key := s.Key
+
+	switch s.Format {
+	case SigningOpenPGP:
+		config = []string{"gpg.format=openpgp"}
+		if s.KeyData != "" {
+			// GNUPGHOME must not be readable by others
+			err = os.Chmod(dir, 0o700)
+			if err != nil {
+				return
+			}
+			env = []string{"GNUPGHOME=" + dir}
+
+			// gpg starts an agent for the keyring, which would outlive it
+			removeDir := cleanup
+			cleanup = func() {
+				kill := tools.Command("gpgconf", "--kill", "all")
+				kill.Env = append(os.Environ(), env...)
+				_ = kill.Run()
+				removeDir()
+			}
+
+			var fingerprint string
+			fingerprint, err = importOpenPGPKey(ctx, env, s.KeyData)
+			if err != nil {
+				return
+			}
+			if key == "" {
+				key = fingerprint
+			}
+		}
+	case SigningSSH:
+		config = []string{"gpg.format=ssh"}
+		if s.KeyData != "" {
+			data := s.KeyData
+			if !strings.HasSuffix(data, "\n") {
+				data += "\n"
+			}
+			key = filepath.Join(dir, "signing-key")
+			err = os.WriteFile(key, []byte(data), 0o600)
+			if err != nil {
+				return
+			}
+		}
+	default:
+		return nil, nil, cleanup, fmt.Errorf("unknown signing format %q, must be %q or %q", s.Format, SigningOpenPGP, SigningSSH)
+	}
+
+	if key == "" {
+		return nil, nil, cleanup, fmt.Errorf("signing with %s needs a key", s.Format)
+	}
+
+	config = append(config, "commit.gpgsign=true", "user.signingkey="+key)
+
+	return
+}
+
+// importOpenPGPKey imports the armored private key into the keyring in env and returns its fingerprint
+func importOpenPGPKey(ctx context.Context, env []string, armored string) (fingerprint string, err error) {
+	gpg := func(stdin string, args ...string) (out []byte, err error) {
+		cmd := tools.CommandContext(ctx, "gpg", append([]string{"--batch", "--no-tty"}, args...)...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdin = strings.NewReader(stdin)
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		out, err = cmd.Output()
+		if err != nil {
+			err = fmt.Errorf("running gpg %s: %w\nOutput:\n%s", args[0], err, stderr.String())
+		}
+		return
+	}
+
+	_, err = gpg(armored, "--import")
+	if err != nil {
+		return
+	}
+
+	out, err := gpg("", "--with-colons", "--list-secret-keys")
+	if err != nil {
+		return
+	}
+
+	// The first "fpr" record after "sec" is the fingerprint of the primary key
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 9 && fields[0] == "fpr" {
+			return fields[9], nil
+		}
+	}
+
+	return "", fmt.Errorf("the imported data doesn't contain a secret OpenPGP key")
+}
+
+// Commit commits all changes in the repo at dir with the given message, identity and signing
+func Commit(ctx context.Context, dir, message string, id Identity, sign Signing) (err error) {
+	err = run(ctx, dir, "add", "-A")
+	if err != nil {
+		return
+	}
+
+	config, env, cleanup, err := sign.setup(ctx)
+	if err != nil {
+		return fmt.Errorf("setting up commit signing: %w", err)
+	}
+	defer cleanup()
+
+	if id.Name != "" {
+		config = append(config, "user.name="+id.Name)
+	}
+	if id.Email != "" {
+		config = append(config, "user.email="+id.Email)
+	}
+
+	var args []string
+	for _, c := range config {
+		args = append(args, "-c", c)
+	}
+	args = append(args, "commit", "-F", "-")
+
+	return runGitEnv(ctx, dir, Credentials{}, strings.NewReader(message), env, args...)
+}
+
+// Push pushes HEAD of the repo at dir to branch of the remote
+func Push(ctx context.Context, dir, remote, branch string, creds Credentials) (err error) {
+	return runGit(ctx, dir, creds, nil, "push", remote, "HEAD:refs/heads/"+branch)
+}
+
+// CurrentBranch returns the name of the branch that is checked out in the repo at dir
+func CurrentBranch(dir string) (branch string, err error) {
+	cmd := tools.Command("git", "symbolic-ref", "--short", "HEAD")
+	cmd.Dir = dir
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("finding current branch: %w", err)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,366 @@
+package git
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// This file implements the fast path for github.com repos: the files selected by the sparse patterns are
+// fetched one by one through the GitHub API, which is much quicker than fetching a repo with a long history
+// when only a few fastlane text files are needed.
+
+const (
+	// ContentsMaxFiles and ContentsMaxBytes are the largest selections that are fetched through the GitHub API,
+	// larger ones are fetched with the backend
+	ContentsMaxFiles = 200
+	ContentsMaxBytes = 20 << 20
+
+	defaultGitHubAPI = "https://api.github.com/"
+)
+
+// errContentsTooLarge means the selected files are better fetched with git
+var errContentsTooLarge = errors.New("too many files for the GitHub API")
+
+// gitHubRepo returns the owner and name of a github.com repo URL
+func gitHubRepo(gitUrl string) (owner, name string, ok bool) {
+	u, err := url.Parse(gitUrl)
+	if err != nil || !strings.EqualFold(u.Host, "github.com") {
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimSuffix(u.Path, ".git"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return
+	}
+	return parts[0], parts[1], true
+}
+
+// usesContents reports whether t is fetched through the GitHub API first
+func (c *Cache) usesContents(t Target) bool {
+	if c.GitHubClient == nil || len(c.patterns(t.URL)) == 0 {
+		return false
+	}
+	_, _, ok := gitHubRepo(t.URL)
+	return ok
+}
+
+// apiGet requests the path of the GitHub API and returns the response if its status is 200
+func (c *Cache) apiGet(ctx context.Context, p, accept string) (resp *http.Response, err error) {
+	base := c.GitHubAPI
+	if base == "" {
+		base = defaultGitHubAPI
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/"+p, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err = c.GitHubClient.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: unexpected status %s", p, resp.Status)
+	}
+	return
+}
+
+// apiTreeEntry is a file of the recursive tree listing of the GitHub API
+type apiTreeEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+
+	// SHA is the git blob ID of the content
+	SHA string `json:"sha"`
+}
+
+// ByteBudget is a number of bytes that is shared between downloads. Its methods are safe for concurrent use, a
+// nil *ByteBudget has no limit.
+type ByteBudget struct {
+	lock      sync.Mutex
+	remaining int64
+}
+
+// NewByteBudget returns a budget allowing n bytes
+func NewByteBudget(n int64) *ByteBudget {
+	return &ByteBudget{remaining: n}
+}
+
+func (b *ByteBudget) take(n int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if n > b.remaining {
+		return false
+	}
+	b.remaining -= n
+	return true
+}
+
+// isImage reports whether the file at p is an image, which is what makes up most of the bytes of fastlane metadata
+func isImage(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".png", ".jpg", ".jpeg", ".webp", ".gif":
+		return true
+	}
+	return false
+}
+
+// blobID returns the git blob ID of the file at p, as the API lists it for the files of a tree
+func blobID(p string) (id string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", info.Size())
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// updateContents fetches the selected files of t into its snapshot directory through the GitHub API. It returns
+// errContentsTooLarge if the selection is too large, the repo is then fetched with the backend.
+func (c *Cache) updateContents(ctx context.Context, t Target) (err error) {
+	owner, name, _ := gitHubRepo(t.URL)
+	repo := "repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name)
+
+	ref := t.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	resp, err := c.apiGet(ctx, repo+"/commits/"+url.PathEscape(ref), "application/vnd.github.sha")
+	if err != nil {
+		return
+	}
+	sha, err := io.ReadAll(io.LimitReader(resp.Body, 100))
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	commit := strings.TrimSpace(string(sha))
+
+	snapshot := c.snapshotPath(t.URL, t.Ref)
+	commitFile := snapshot + ".commit"
+	if current, rerr := os.ReadFile(commitFile); rerr == nil && string(current) == commit {
+		if _, serr := os.Stat(snapshot); serr == nil {
+			slog.Info("Cached snapshot is up to date", "git", RedactURL(t.URL), "commit", commit)
+			return nil
+		}
+	}
+
+	resp, err = c.apiGet(ctx, repo+"/git/trees/"+commit+"?recursive=1", "application/vnd.github+json")
+	if err != nil {
+		return
+	}
+	var tree struct {
+		Tree      []apiTreeEntry `json:"tree"`
+		Truncated bool           `json:"truncated"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tree)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	if tree.Truncated {
+		return errContentsTooLarge
+	}
+
+	// Symlinks and submodules aren't followed, like the native backend does
+	var (
+		files []apiTreeEntry
+		size  int64
+	)
+	patterns := c.patterns(t.URL)
+	for _, e := range tree.Tree {
+		if e.Type == "blob" && e.Mode != "120000" && matchesPatterns(e.Path, patterns) {
+			files = append(files, e)
+			size += e.Size
+		}
+	}
+	if len(files) > ContentsMaxFiles || size > ContentsMaxBytes {
+		return errContentsTooLarge
+	}
+
+	slog.Info("Fetching snapshot through the GitHub API", "git", RedactURL(t.URL), "commit", commit, "files", len(files), "bytes", size)
+
+	tmp := snapshot + ".tmp"
+	_ = os.RemoveAll(tmp)
+
+	// Files that didn't change since the previous snapshot are taken from it instead of fetching them again, which
+	// spares the images of commits that only changed texts
+	var reused, kept int
+	var fetched int64
+	for _, f := range files {
+		previous := filepath.Join(snapshot, filepath.FromSlash(path.Clean("/"+f.Path)))
+		target := filepath.Join(tmp, filepath.FromSlash(path.Clean("/"+f.Path)))
+
+		if id, ierr := blobID(previous); ierr == nil && id == f.SHA {
+			err = copyFile(previous, target)
+			reused++
+		} else if isImage(f.Path) && !c.ImageBudget.take(f.Size) {
+			// The previous version is better than none, the image is fetched again once the budget allows it
+			if _, serr := os.Stat(previous); serr == nil {
+				err = copyFile(previous, target)
+			}
+			kept++
+		} else {
+			err = c.fetchContent(ctx, repo, commit, f, tmp)
+			fetched += f.Size
+		}
+		if err != nil {
+			_ = os.RemoveAll(tmp)
+			return fmt.Errorf("fetching %q: %w", f.Path, err)
+		}
+	}
+	err = os.MkdirAll(tmp, 0o755)
+	if err != nil {
+		return
+	}
+	slog.Debug("Fetched snapshot", "git", RedactURL(t.URL), "commit", commit, "reused", reused, "bytes", fetched)
+	if kept > 0 {
+		slog.Warn("The image budget is exhausted, keeping the previous version of images", "git", RedactURL(t.URL), "commit", commit, "images", kept)
+
+		c.lock.Lock()
+		c.partial[t] = true
+		c.lock.Unlock()
+	}
+
+	_ = os.Remove(commitFile)
+	_ = os.RemoveAll(snapshot)
+
+	err = os.Rename(tmp, snapshot)
+	if err != nil || kept > 0 {
+		// Without the commit file, the next update fetches what's missing
+		return
+	}
+
+	return os.WriteFile(commitFile, []byte(commit), 0o644)
+}
+
+// fetchContent writes the file f of commit into dir
+func (c *Cache) fetchContent(ctx context.Context, repo, commit string, f apiTreeEntry, dir string) (err error) {
+	target := filepath.Join(dir, filepath.FromSlash(path.Clean("/"+f.Path)))
+
+	var escaped []string
+	for _, part := range strings.Split(f.Path, "/") {
+		escaped = append(escaped, url.PathEscape(part))
+	}
+	resp, err := c.apiGet(ctx, repo+"/contents/"+strings.Join(escaped, "/")+"?ref="+commit, "application/vnd.github.raw")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = os.MkdirAll(filepath.Dir(target), 0o755)
+	if err != nil {
+		return
+	}
+
+	mode := os.FileMode(0o644)
+	if f.Mode == "100755" {
+		mode = 0o755
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(out, resp.Body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// updateFromContents tries the fast path for t once per Cache and reports whether its snapshot is up to date.
+// If it isn't, t has to be fetched with the backend.
+func (c *Cache) updateFromContents(ctx context.Context, t Target) bool {
+	c.lock.Lock()
+	ok, tried := c.contents[t]
+	c.lock.Unlock()
+	if tried {
+		return ok
+	}
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	err := c.updateContents(ctx, t)
+	switch {
+	case errors.Is(err, errContentsTooLarge):
+		slog.Info("Too many files for the GitHub API, fetching the repo with git", "git", RedactURL(t.URL), "ref", t.Ref)
+	case err != nil:
+		slog.Warn("Fetching files through the GitHub API failed, fetching the repo with git", "git", RedactURL(t.URL), "ref", t.Ref, "error", err)
+	}
+
+	c.lock.Lock()
+	c.contents[t] = err == nil
+	c.lock.Unlock()
+
+	return err == nil
+}
+
+// Partial reports whether the snapshot of t has images of an older commit, because they didn't fit the
+// ImageBudget. Metadata copied from it should be copied again by the next run.
+func (c *Cache) Partial(t Target) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.partial[t]
+}
+
+// fromContents reports whether the snapshot of t was fetched through the GitHub API
+func (c *Cache) fromContents(t Target) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.contents[t]
+}
+
+// copyFile copies the file at src to dst, creating the directories of dst
+func copyFile(src, dst string) (err error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0o755)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(dst, content, info.Mode().Perm())
+}
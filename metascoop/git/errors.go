@@ -0,0 +1,45 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrAuth is returned when the server requires (different) credentials
+	ErrAuth = errors.New("authentication failed")
+
+	// ErrNotFound is returned when the repository or ref doesn't exist
+	ErrNotFound = errors.New("repository not found")
+
+	// ErrNetwork is returned when the server couldn't be reached or the connection broke
+	ErrNetwork = errors.New("network error")
+
+	// ErrProtocol is returned when the server sent something we don't understand
+	ErrProtocol = errors.New("protocol error")
+)
+
+// CloneError describes why an operation on a remote repository failed.
+// Use errors.Is with ErrAuth, ErrNotFound, ErrNetwork or ErrProtocol to find out the kind of failure.
+type CloneError struct {
+	URL string
+	Op  string
+
+	Kind error
+	Err  error
+}
+
+func (e *CloneError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s %q: %s", e.Op, e.URL, e.Kind.Error())
+	}
+	return fmt.Sprintf("%s %q: %s: %s", e.Op, e.URL, e.Kind.Error(), e.Err.Error())
+}
+
+func (e *CloneError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CloneError) Is(target error) bool {
+	return target == e.Kind
+}
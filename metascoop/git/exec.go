@@ -0,0 +1,73 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+func run(ctx context.Context, dir string, args ...string) (err error) {
+	return runGit(ctx, dir, Credentials{}, nil, args...)
+}
+
+// runGit runs git with the given credentials and input. If ctx is done before git exits, git and all processes
+// it started (e.g. git-remote-https) are killed. Secrets are removed from the returned error.
+func runGit(ctx context.Context, dir string, creds Credentials, stdin io.Reader, args ...string) (err error) {
+	return runGitEnv(ctx, dir, creds, stdin, nil, args...)
+}
+
+// runGitEnv is runGit with additional environment variables
+func runGitEnv(ctx context.Context, dir string, creds Credentials, stdin io.Reader, extraEnv []string, args ...string) (err error) {
+	_, err = outputGit(ctx, dir, creds, stdin, extraEnv, args...)
+	return
+}
+
+// outputGit is runGitEnv that returns what git wrote to stdout
+func outputGit(ctx context.Context, dir string, creds Credentials, stdin io.Reader, extraEnv []string, args ...string) (stdout []byte, err error) {
+	env, cleanup, err := creds.env()
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	cmd := tools.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	cmd.Env = append(append(os.Environ(), env...), extraEnv...)
+
+	var output, stdoutBuf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(&output, &stdoutBuf)
+	cmd.Stderr = &output
+
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("running git %s: %w", args[0], err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		return nil, fmt.Errorf("running git %s: %w", args[0], ctxErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("running git %s: %w\nOutput:\n%s", args[0], err, creds.redact(output.String()))
+	}
+
+	return stdoutBuf.Bytes(), nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package git
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in its own process group, so its children can be killed together with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	// A negative PID signals the whole group
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,10 @@
+package git
+
+import "os/exec"
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills git itself, there are no process groups that can be signalled as a whole
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
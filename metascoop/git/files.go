@@ -2,12 +2,14 @@ package git
 
 import (
 	"fmt"
-	"os/exec"
+	"path/filepath"
 	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
 )
 
 func GetChangedFileNames(repoPath string) (paths []string, err error) {
-	cmd := exec.Command("git", "diff", "--name-only")
+	cmd := tools.Command("git", "diff", "--name-only")
 	cmd.Dir = repoPath
 
 	output, err := cmd.Output()
@@ -20,3 +22,19 @@ func GetChangedFileNames(repoPath string) (paths []string, err error) {
 
 	return
 }
+
+// ShowFile returns the content of the file at path, relative to the repo at repoPath, in the commit ref
+func ShowFile(repoPath, ref, path string) (content []byte, err error) {
+	cmd := tools.Command("git", "show", ref+":./"+filepath.ToSlash(path))
+	cmd.Dir = repoPath
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	content, err = cmd.Output()
+	if err != nil {
+		err = fmt.Errorf("running git: %w\nOutput:\n%s", err, stderr.String())
+	}
+
+	return
+}
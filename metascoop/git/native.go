@@ -0,0 +1,486 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// This file implements the client side of the git "smart HTTP" protocol, which is enough to check out
+// a single commit without needing the git binary.
+
+type remote struct {
+	client *http.Client
+	url    string
+
+	// authorization is the value of the Authorization header, if the repo is private
+	authorization string
+
+	head string
+	refs map[string]string
+	caps map[string]bool
+}
+
+func (r *remote) fail(op string, kind, err error) error {
+	return &CloneError{URL: RedactURL(r.url), Op: op, Kind: kind, Err: err}
+}
+
+func (r *remote) do(req *http.Request) (*http.Response, error) {
+	if r.authorization != "" {
+		req.Header.Set("Authorization", r.authorization)
+	}
+	return r.client.Do(req)
+}
+
+func checkStatus(resp *http.Response) (kind error) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrAuth
+	case http.StatusNotFound:
+		return ErrNotFound
+	}
+	return ErrNetwork
+}
+
+func readPktLine(r *bufio.Reader) (line []byte, flush bool, err error) {
+	var size [4]byte
+	_, err = io.ReadFull(r, size[:])
+	if err != nil {
+		return
+	}
+
+	n, err := strconv.ParseUint(string(size[:]), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid pkt-line length %q", string(size[:]))
+	}
+	if n == 0 {
+		return nil, true, nil
+	}
+	if n < 4 {
+		return nil, false, fmt.Errorf("invalid pkt-line length %d", n)
+	}
+
+	line = make([]byte, n-4)
+	_, err = io.ReadFull(r, line)
+
+	return
+}
+
+func writePktLine(w *bytes.Buffer, line string) {
+	fmt.Fprintf(w, "%04x%s", len(line)+4, line)
+}
+
+// discover fetches the advertised refs and capabilities of the remote
+func (r *remote) discover(ctx context.Context) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return r.fail("discovering refs", ErrProtocol, err)
+	}
+
+	resp, err := r.do(req)
+	if err != nil {
+		return r.fail("discovering refs", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	if kind := checkStatus(resp); kind != nil {
+		return r.fail("discovering refs", kind, errors.New(resp.Status))
+	}
+	if resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return r.fail("discovering refs", ErrProtocol, errors.New("server doesn't support the smart HTTP protocol"))
+	}
+
+	br := bufio.NewReader(resp.Body)
+
+	// The first section only announces the service
+	for {
+		_, flush, err := readPktLine(br)
+		if err != nil {
+			return r.fail("discovering refs", ErrProtocol, err)
+		}
+		if flush {
+			break
+		}
+	}
+
+	r.caps = make(map[string]bool)
+	r.refs = make(map[string]string)
+
+	for first := true; ; first = false {
+		line, flush, err := readPktLine(br)
+		if err != nil {
+			return r.fail("discovering refs", ErrProtocol, err)
+		}
+		if flush {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if first {
+			if i := bytes.IndexByte(line, 0); i >= 0 {
+				for _, c := range strings.Fields(string(line[i+1:])) {
+					r.caps[strings.SplitN(c, "=", 2)[0]] = true
+				}
+				line = line[:i]
+			}
+		}
+
+		fields := strings.Fields(string(line))
+		if len(fields) == 2 {
+			r.refs[fields[1]] = fields[0]
+			if fields[1] == "HEAD" {
+				r.head = fields[0]
+			}
+		}
+	}
+
+	if r.head == "" {
+		return r.fail("discovering refs", ErrNotFound, errors.New("remote has no HEAD, it might be empty"))
+	}
+
+	return nil
+}
+
+type fetchOptions struct {
+	wants  []string
+	depth  int
+	filter string
+}
+
+// capabilities returns the capabilities of the first want line. Only those the server advertised are requested,
+// a shallow fetch or a filter the server doesn't support is a full fetch instead.
+func (r *remote) capabilities(opts *fetchOptions) (caps []string) {
+	switch {
+	case r.caps["side-band-64k"]:
+		caps = append(caps, "side-band-64k")
+	case r.caps["side-band"]:
+		caps = append(caps, "side-band")
+	}
+	for _, c := range []string{"ofs-delta", "no-progress"} {
+		if r.caps[c] {
+			caps = append(caps, c)
+		}
+	}
+	if r.caps["agent"] {
+		caps = append(caps, "agent=metascoop")
+	}
+
+	if !r.caps["shallow"] {
+		opts.depth = 0
+	}
+	if opts.depth > 0 {
+		caps = append(caps, "shallow")
+	}
+	if !r.caps["filter"] {
+		opts.filter = ""
+	}
+	if opts.filter != "" {
+		caps = append(caps, "filter")
+	}
+	return
+}
+
+// fetch requests the given objects and adds everything the server sends to store
+func (r *remote) fetch(ctx context.Context, opts fetchOptions, store objectStore) (err error) {
+	var body bytes.Buffer
+
+	caps := r.capabilities(&opts)
+	for i, want := range opts.wants {
+		line := "want " + want
+		if i == 0 && len(caps) > 0 {
+			line += " " + strings.Join(caps, " ")
+		}
+		writePktLine(&body, line+"\n")
+	}
+	if opts.depth > 0 {
+		writePktLine(&body, "deepen "+strconv.Itoa(opts.depth)+"\n")
+	}
+	if opts.filter != "" {
+		writePktLine(&body, "filter "+opts.filter+"\n")
+	}
+	body.WriteString("0000")
+	writePktLine(&body, "done\n")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url+"/git-upload-pack", &body)
+	if err != nil {
+		return r.fail("fetching", ErrProtocol, err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+
+	resp, err := r.do(req)
+	if err != nil {
+		return r.fail("fetching", ErrNetwork, err)
+	}
+	defer resp.Body.Close()
+
+	if kind := checkStatus(resp); kind != nil {
+		return r.fail("fetching", kind, errors.New(resp.Status))
+	}
+
+	br := bufio.NewReader(resp.Body)
+
+	// Skip the shallow info and acknowledgement sections until we reach the "NAK" that precedes the pack
+	for {
+		line, flush, err := readPktLine(br)
+		if err != nil {
+			return r.fail("fetching", ErrNetwork, err)
+		}
+		if flush {
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("ERR ")) {
+			return r.fail("fetching", ErrProtocol, errors.New(strings.TrimSpace(string(line[4:]))))
+		}
+		if bytes.HasPrefix(line, []byte("NAK")) || bytes.HasPrefix(line, []byte("ACK")) {
+			break
+		}
+	}
+
+	// Without side band, the pack follows the acknowledgements directly
+	var pack io.Reader = br
+	if r.caps["side-band-64k"] || r.caps["side-band"] {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(demuxSideband(br, pw))
+		}()
+		pack = pr
+	}
+
+	err = readPack(pack, store, maxPackSize)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return r.fail("reading pack", ErrNetwork, err)
+		}
+		return r.fail("reading pack", ErrProtocol, err)
+	}
+
+	return nil
+}
+
+// demuxSideband copies the pack data channel to w, ignoring progress messages
+func demuxSideband(r *bufio.Reader, w io.Writer) error {
+	for {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return err
+		}
+		if flush || len(line) == 0 {
+			return nil
+		}
+
+		switch line[0] {
+		case 1:
+			_, err = w.Write(line[1:])
+			if err != nil {
+				return err
+			}
+		case 3:
+			return fmt.Errorf("remote error: %s", strings.TrimSpace(string(line[1:])))
+		}
+	}
+}
+
+// matchesPatterns reports whether the slash-separated path p is selected by the checkout patterns.
+// Patterns are path prefixes; an empty list selects everything.
+func matchesPatterns(p string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pat := range patterns {
+		pat = strings.TrimPrefix(pat, "/")
+		if p == strings.TrimSuffix(pat, "/") || strings.HasPrefix(p, strings.TrimSuffix(pat, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mayContainMatches reports whether the directory dir could contain paths selected by the patterns
+func mayContainMatches(dir string, patterns []string) bool {
+	if matchesPatterns(dir, patterns) {
+		return true
+	}
+	for _, pat := range patterns {
+		if strings.HasPrefix(strings.TrimPrefix(pat, "/"), dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+type checkoutFile struct {
+	path string
+	mode string
+	id   string
+}
+
+// collectFiles walks the tree and returns all files selected by the patterns
+func collectFiles(store objectStore, treeID, prefix string, patterns []string) (files []checkoutFile, err error) {
+	tree, ok := store[treeID]
+	if !ok || tree.typ != objTree {
+		return nil, fmt.Errorf("missing tree object %s", treeID)
+	}
+
+	entries, err := parseTree(tree.data)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		// Never allow entries that could escape the checkout directory
+		if e.name == "" || e.name == "." || e.name == ".." || e.name == ".git" || strings.ContainsAny(e.name, "/\\") {
+			continue
+		}
+
+		p := path.Join(prefix, e.name)
+
+		switch e.mode {
+		case "40000":
+			if !mayContainMatches(p, patterns) {
+				continue
+			}
+			sub, err := collectFiles(store, e.id, p, patterns)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+		case "100644", "100755", "120000":
+			if matchesPatterns(p, patterns) {
+				files = append(files, checkoutFile{path: p, mode: e.mode, id: e.id})
+			}
+		}
+		// anything else is a submodule, which we don't check out
+	}
+
+	return
+}
+
+// openRemote connects to the repository at gitUrl and discovers its refs
+func openRemote(ctx context.Context, client *http.Client, gitUrl string, creds Credentials) (r *remote, err error) {
+	u, err := url.Parse(gitUrl)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, &CloneError{URL: RedactURL(gitUrl), Op: "parsing URL", Kind: ErrProtocol, Err: errors.New("the native backend only supports http(s) URLs")}
+	}
+
+	r = &remote{client: client, url: strings.TrimSuffix(gitUrl, "/"), authorization: creds.authorization()}
+
+	err = r.discover(ctx)
+
+	return
+}
+
+// resolve returns the commit the tag or branch ref points to, or the remote HEAD if ref is empty
+func (r *remote) resolve(ref string) (commit string, err error) {
+	if ref == "" {
+		return r.head, nil
+	}
+
+	// Annotated tags are advertised together with the commit they point to ("peeled")
+	for _, name := range []string{"refs/tags/" + ref + "^{}", "refs/tags/" + ref, "refs/heads/" + ref, ref} {
+		if commit, ok := r.refs[name]; ok {
+			return commit, nil
+		}
+	}
+
+	return "", r.fail("resolving ref", ErrNotFound, fmt.Errorf("no tag or branch %q", ref))
+}
+
+// checkout writes the files of commit that match patterns into dirPath, without using the git binary.
+func (r *remote) checkout(ctx context.Context, dirPath, commit string, patterns []string) (err error) {
+	store := make(objectStore)
+
+	// If the server supports partial clones, we first only fetch trees and then request the blobs we actually need
+	partial := len(patterns) > 0 && r.caps["filter"]
+
+	opts := fetchOptions{wants: []string{commit}, depth: 1}
+	if partial {
+		opts.filter = "blob:none"
+	}
+
+	err = r.fetch(ctx, opts, store)
+	if err != nil {
+		return
+	}
+
+	c, ok := store[commit]
+	if !ok || c.typ != objCommit {
+		return r.fail("checking out", ErrProtocol, errors.New("server didn't send the requested commit"))
+	}
+	treeID, err := commitTree(c.data)
+	if err != nil {
+		return r.fail("checking out", ErrProtocol, err)
+	}
+
+	files, err := collectFiles(store, treeID, "", patterns)
+	if err != nil {
+		return r.fail("checking out", ErrProtocol, err)
+	}
+
+	var missing []string
+	for _, f := range files {
+		if _, ok := store[f.id]; !ok {
+			missing = append(missing, f.id)
+		}
+	}
+	if len(missing) > 0 {
+		err = r.fetch(ctx, fetchOptions{wants: missing}, store)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, f := range files {
+		blob, ok := store[f.id]
+		if !ok || blob.typ != objBlob {
+			return r.fail("checking out", ErrProtocol, fmt.Errorf("missing blob for %q", f.path))
+		}
+
+		target := filepath.Join(dirPath, filepath.FromSlash(f.path))
+
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err != nil {
+			return
+		}
+
+		switch f.mode {
+		case "120000":
+			// Symlinks are only created if they stay inside the checkout and the OS supports them
+			if link := string(blob.data); linksInside(dirPath, target, link) {
+				_ = os.Symlink(link, target)
+			}
+		case "100755":
+			err = os.WriteFile(target, blob.data, 0o755)
+		default:
+			err = os.WriteFile(target, blob.data, 0o644)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// linksInside reports whether the symlink at target with the content link points to a path inside the directory dir.
+// Absolute links never do, even if they name a path in dir, as the checkout is moved around.
+func linksInside(dir, target, link string) bool {
+	if filepath.IsAbs(link) || strings.HasPrefix(link, "/") || filepath.VolumeName(link) != "" {
+		return false
+	}
+	rel, err := filepath.Rel(dir, filepath.Join(filepath.Dir(target), filepath.FromSlash(link)))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,360 @@
+package git_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/e2e"
+	"github.com/nymtech/fdroid/metascoop/git"
+)
+
+// newNativeServer serves the repo "example/notes" with two commits of fastlane metadata through git http-backend.
+// The first commit is tagged "v1". The returned directory contains the bare repos.
+func newNativeServer(t *testing.T) (server *e2e.GitServer, root string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	root = t.TempDir()
+	server, err := e2e.NewGitServer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	err = server.AddRepo("example", "notes",
+		e2e.Commit{Files: map[string]string{
+			"README.md":   "# Notes\n",
+			"src/main.go": "package main\n",
+			"fastlane/metadata/android/en-US/title.txt": "Notes v1\n",
+		}, Tags: []string{"v1"}},
+		e2e.Commit{Files: map[string]string{
+			"README.md":   "# Notes\n",
+			"src/main.go": "package main\n",
+			"fastlane/metadata/android/en-US/title.txt":        "Notes v2\n",
+			"fastlane/metadata/android/en-US/changelogs/2.txt": "Fixes sync\n",
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, root
+}
+
+// checkoutNative checks out t with the native backend and returns its files
+func checkoutNative(t *testing.T, client *http.Client, target git.Target) (files map[string]string) {
+	t.Helper()
+
+	c, err := git.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backend = git.BackendNative
+	c.SparsePatterns = []string{"fastlane/"}
+	c.HTTPClient = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	dir, err := c.Checkout(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files = make(map[string]string)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestNativeCheckout(t *testing.T) {
+	server, root := newNativeServer(t)
+
+	// http-backend only advertises partial clones where they're allowed
+	out, err := exec.Command("git", "-C", filepath.Join(root, "example", "notes"), "config", "uploadpack.allowFilter", "true").CombinedOutput()
+	if err != nil {
+		t.Fatalf("enabling partial clones: %v: %s", err, out)
+	}
+	proxy := newCapsProxy(t, server, nil)
+
+	for _, tt := range []struct {
+		ref   string
+		files map[string]string
+	}{
+		{"", map[string]string{
+			"fastlane/metadata/android/en-US/title.txt":        "Notes v2\n",
+			"fastlane/metadata/android/en-US/changelogs/2.txt": "Fixes sync\n",
+		}},
+		{"v1", map[string]string{"fastlane/metadata/android/en-US/title.txt": "Notes v1\n"}},
+	} {
+		files := checkoutNative(t, proxy.client(), git.Target{URL: proxy.URL() + "example/notes", Ref: tt.ref})
+		if fmt.Sprint(files) != fmt.Sprint(tt.files) {
+			t.Errorf("checking out %q = %q, want only the fastlane files %q", tt.ref, files, tt.files)
+		}
+	}
+
+	// The commit is fetched without its history and blobs, the fastlane blobs are fetched after
+	for _, want := range []string{"shallow", "filter", "side-band-64k", "ofs-delta"} {
+		if !proxy.requested(want) {
+			t.Errorf("the native backend didn't request %s, requests: %q", want, proxy.requests)
+		}
+	}
+}
+
+func TestNativeCheckoutCapabilities(t *testing.T) {
+	server, _ := newNativeServer(t)
+
+	for _, advertised := range [][]string{
+		{},
+		{"side-band"},
+		{"side-band-64k", "ofs-delta", "no-progress"},
+		{"shallow", "ofs-delta"},
+	} {
+		name := strings.Join(advertised, ",")
+		if name == "" {
+			name = "none"
+		}
+		t.Run(name, func(t *testing.T) {
+			allowed := make(map[string]bool)
+			for _, c := range advertised {
+				allowed[c] = true
+			}
+			proxy := newCapsProxy(t, server, allowed)
+
+			files := checkoutNative(t, proxy.client(), git.Target{URL: proxy.URL() + "example/notes", Ref: "v1"})
+			if files["fastlane/metadata/android/en-US/title.txt"] != "Notes v1\n" || len(files) != 1 {
+				t.Errorf("checkout contains %q, want the fastlane files of v1", files)
+			}
+
+			proxy.lock.Lock()
+			defer proxy.lock.Unlock()
+			for _, caps := range proxy.requests {
+				for _, c := range caps {
+					if !allowed[c] {
+						t.Errorf("the native backend requested %s, which wasn't advertised", c)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestNativeCheckoutSymlinks(t *testing.T) {
+	server, _ := newNativeServer(t)
+
+	dir := "fastlane/metadata/android/en-US/"
+	err := server.AddRepo("example", "links", e2e.Commit{
+		Files: map[string]string{
+			dir + "title.txt": "Links\n",
+			dir + "..notes":   "Not a parent\n",
+		},
+		Symlinks: map[string]string{
+			dir + "short_description.txt": "title.txt",
+			dir + "full_description.txt":  "..notes",
+			dir + "changelogs/1.txt":      "../title.txt",
+			dir + "changelogs/2.txt":      "/etc/passwd",
+			dir + "changelogs/3.txt":      "../../../../../../README.md",
+			dir + "changelogs/4.txt":      "../../../../../..",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := git.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backend = git.BackendNative
+	c.SparsePatterns = []string{"fastlane/"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	checkout, err := c.Checkout(ctx, git.Target{URL: server.URL() + "example/links"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(checkout)
+
+	links := make(map[string]string)
+	err = filepath.Walk(checkout, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		link, err := os.Readlink(path)
+		rel, _ := filepath.Rel(checkout, path)
+		links[filepath.ToSlash(rel)] = link
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Links to absolute paths and out of the checkout aren't created, names that merely start with ".." are fine
+	want := map[string]string{
+		dir + "short_description.txt": "title.txt",
+		dir + "full_description.txt":  "..notes",
+		dir + "changelogs/1.txt":      "../title.txt",
+	}
+	if fmt.Sprint(links) != fmt.Sprint(want) {
+		t.Errorf("checkout has the symlinks %q, want %q", links, want)
+	}
+}
+
+// capsProxy forwards requests to a GitServer. Only the capabilities in allowed are advertised, all if allowed is
+// nil, and the capabilities that clients request are recorded.
+type capsProxy struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	requests [][]string
+}
+
+func newCapsProxy(t *testing.T, upstream *e2e.GitServer, allowed map[string]bool) *capsProxy {
+	t.Helper()
+
+	target, err := url.Parse(upstream.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	forward := httputil.NewSingleHostReverseProxy(target)
+	forward.ModifyResponse = func(resp *http.Response) error {
+		if allowed == nil || resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body, err = rewritePktLines(body, func(line []byte) []byte {
+			i := bytes.IndexByte(line, 0)
+			if i < 0 {
+				return line
+			}
+			var caps []string
+			for _, c := range strings.Fields(string(line[i+1:])) {
+				if allowed[strings.SplitN(c, "=", 2)[0]] {
+					caps = append(caps, c)
+				}
+			}
+			return []byte(string(line[:i+1]) + strings.Join(caps, " ") + "\n")
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+
+	p := &capsProxy{}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, _ = rewritePktLines(body, func(line []byte) []byte {
+				if fields := strings.Fields(string(line)); len(fields) > 2 && fields[0] == "want" {
+					var caps []string
+					for _, c := range fields[2:] {
+						caps = append(caps, strings.SplitN(c, "=", 2)[0])
+					}
+					p.lock.Lock()
+					p.requests = append(p.requests, caps)
+					p.lock.Unlock()
+				}
+				return line
+			})
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		forward.ServeHTTP(w, req)
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func (p *capsProxy) URL() string {
+	return p.server.URL + "/"
+}
+
+func (p *capsProxy) client() *http.Client {
+	return p.server.Client()
+}
+
+// requested reports whether a client requested the capability c
+func (p *capsProxy) requested(c string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, caps := range p.requests {
+		for _, r := range caps {
+			if r == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewritePktLines returns the pkt-lines of data with each line replaced by what fn returns for it
+func rewritePktLines(data []byte, fn func(line []byte) []byte) (rewritten []byte, err error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		var size [4]byte
+		_, err = io.ReadFull(r, size[:])
+		if err == io.EOF {
+			return rewritten, nil
+		}
+		if err != nil {
+			return
+		}
+		n, perr := strconv.ParseUint(string(size[:]), 16, 16)
+		if perr != nil {
+			return nil, perr
+		}
+		if n < 4 {
+			// Flush and delimiter packets
+			rewritten = append(rewritten, size[:]...)
+			continue
+		}
+		line := make([]byte, n-4)
+		_, err = io.ReadFull(r, line)
+		if err != nil {
+			return
+		}
+		line = fn(line)
+		rewritten = append(rewritten, fmt.Sprintf("%04x", len(line)+4)...)
+		rewritten = append(rewritten, line...)
+	}
+}
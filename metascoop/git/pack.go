@@ -0,0 +1,362 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var objTypeNames = map[int]string{
+	objCommit: "commit",
+	objTree:   "tree",
+	objBlob:   "blob",
+	objTag:    "tag",
+}
+
+type object struct {
+	typ  int
+	data []byte
+}
+
+// objectStore maps hex object ids to their content
+type objectStore map[string]object
+
+// maxPackSize limits both the size of a pack and of the objects in it, which are all held in memory. The native
+// backend only checks out metadata, so this is far more than a fetch needs.
+const maxPackSize = 512 << 20
+
+// errPackTooLarge is returned by readPack for packs over its limit
+var errPackTooLarge = errors.New("the pack is too large to hold in memory")
+
+// packBudget is what's left of the limit of readPack. Reads fail with errPackTooLarge once it's used up.
+type packBudget struct {
+	r     io.Reader
+	n     int64
+	limit int64
+}
+
+func (b *packBudget) Read(p []byte) (n int, err error) {
+	if b.n <= 0 {
+		return 0, b.exceeded()
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err = b.r.Read(p)
+	b.n -= int64(n)
+	return
+}
+
+// take reserves n bytes of the budget
+func (b *packBudget) take(n int64) error {
+	if n > b.n {
+		return b.exceeded()
+	}
+	b.n -= n
+	return nil
+}
+
+func (b *packBudget) exceeded() error {
+	return fmt.Errorf("%w, the limit is %d bytes", errPackTooLarge, b.limit)
+}
+
+func hashObject(typ int, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", objTypeNames[typ], len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// countingReader keeps track of the offset in the pack stream. It implements io.ByteReader,
+// which makes zlib stop reading exactly at the end of each compressed object.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+func (c *countingReader) ReadByte() (b byte, err error) {
+	b, err = c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return
+}
+
+type packEntry struct {
+	offset int64
+	typ    int
+	data   []byte
+
+	baseOffset int64
+	baseID     string
+}
+
+// readPack parses a version 2 packfile and adds all contained objects to store. It fails if the pack or the
+// objects it contains are larger than limit bytes.
+func readPack(r io.Reader, store objectStore, limit int64) (err error) {
+	cr := &countingReader{r: bufio.NewReaderSize(&packBudget{r: r, n: limit, limit: limit}, 64*1024)}
+	objects := &packBudget{n: limit, limit: limit}
+
+	var header [12]byte
+	_, err = io.ReadFull(cr, header[:])
+	if err != nil {
+		return fmt.Errorf("reading pack header: %w", err)
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return errors.New("invalid pack signature")
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); v != 2 && v != 3 {
+		return fmt.Errorf("unsupported pack version %d", v)
+	}
+
+	count := binary.BigEndian.Uint32(header[8:12])
+
+	var (
+		entries  = make([]*packEntry, 0, count)
+		byOffset = make(map[int64]*packEntry, count)
+	)
+
+	for i := uint32(0); i < count; i++ {
+		e := &packEntry{offset: cr.n}
+
+		c, err := cr.ReadByte()
+		if err != nil {
+			return err
+		}
+		e.typ = int(c>>4) & 7
+		for c&0x80 != 0 {
+			// The size is redundant with the zlib stream, so we only need to skip it
+			c, err = cr.ReadByte()
+			if err != nil {
+				return err
+			}
+		}
+
+		switch e.typ {
+		case objOfsDelta:
+			c, err = cr.ReadByte()
+			if err != nil {
+				return err
+			}
+			ofs := int64(c & 0x7f)
+			for c&0x80 != 0 {
+				c, err = cr.ReadByte()
+				if err != nil {
+					return err
+				}
+				ofs = ((ofs + 1) << 7) | int64(c&0x7f)
+			}
+			e.baseOffset = e.offset - ofs
+		case objRefDelta:
+			var id [20]byte
+			_, err = io.ReadFull(cr, id[:])
+			if err != nil {
+				return err
+			}
+			e.baseID = hex.EncodeToString(id[:])
+		case objCommit, objTree, objBlob, objTag:
+		default:
+			return fmt.Errorf("invalid object type %d at offset %d", e.typ, e.offset)
+		}
+
+		zr, err := zlib.NewReader(cr)
+		if err != nil {
+			return fmt.Errorf("decompressing object at offset %d: %w", e.offset, err)
+		}
+		objects.r = zr
+		e.data, err = io.ReadAll(objects)
+		if err != nil {
+			return fmt.Errorf("decompressing object at offset %d: %w", e.offset, err)
+		}
+
+		entries = append(entries, e)
+		byOffset[e.offset] = e
+	}
+
+	var deltas []*packEntry
+	for _, e := range entries {
+		if e.typ == objOfsDelta || e.typ == objRefDelta {
+			deltas = append(deltas, e)
+		} else {
+			store[hashObject(e.typ, e.data)] = object{typ: e.typ, data: e.data}
+		}
+	}
+
+	// Now resolve deltas. Bases may be deltas themselves, so we loop until all are resolved
+	for len(deltas) > 0 {
+		var unresolved []*packEntry
+
+		for _, e := range deltas {
+			var base object
+			var ok bool
+			if e.typ == objOfsDelta {
+				be, found := byOffset[e.baseOffset]
+				ok = found && be.typ != objOfsDelta && be.typ != objRefDelta
+				if ok {
+					base = object{typ: be.typ, data: be.data}
+				}
+			} else {
+				base, ok = store[e.baseID]
+			}
+
+			if !ok {
+				unresolved = append(unresolved, e)
+				continue
+			}
+
+			data, err := applyDelta(base.data, e.data, objects)
+			if err != nil {
+				return fmt.Errorf("applying delta at offset %d: %w", e.offset, err)
+			}
+
+			e.typ, e.data = base.typ, data
+			store[hashObject(e.typ, e.data)] = object{typ: e.typ, data: e.data}
+		}
+
+		if len(unresolved) == len(deltas) {
+			return errors.New("pack contains deltas with missing base objects")
+		}
+		deltas = unresolved
+	}
+
+	return nil
+}
+
+func readDeltaSize(d []byte) (size int, rest []byte, err error) {
+	var shift uint
+	for i, c := range d {
+		if shift > 56 {
+			return 0, nil, errors.New("delta size out of range")
+		}
+		size |= int(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			return size, d[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("truncated delta header")
+}
+
+// applyDelta returns the object the delta makes of base. Its size is taken from budget.
+func applyDelta(base, delta []byte, budget *packBudget) (result []byte, err error) {
+	srcSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return
+	}
+	if srcSize != len(base) {
+		return nil, fmt.Errorf("delta base size mismatch: expected %d, got %d", srcSize, len(base))
+	}
+
+	dstSize, delta, err := readDeltaSize(delta)
+	if err != nil {
+		return
+	}
+	err = budget.take(int64(dstSize))
+	if err != nil {
+		return
+	}
+
+	result = make([]byte, 0, dstSize)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 != 0 {
+			var offset, size int
+			for i := uint(0); i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errors.New("truncated copy instruction")
+					}
+					offset |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := uint(0); i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, errors.New("truncated copy instruction")
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(base) {
+				return nil, errors.New("copy instruction out of bounds")
+			}
+			result = append(result, base[offset:offset+size]...)
+		} else if op != 0 {
+			if int(op) > len(delta) {
+				return nil, errors.New("truncated insert instruction")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+		} else {
+			return nil, errors.New("invalid delta instruction")
+		}
+	}
+
+	if len(result) != dstSize {
+		return nil, fmt.Errorf("delta result size mismatch: expected %d, got %d", dstSize, len(result))
+	}
+
+	return
+}
+
+type treeEntry struct {
+	mode string
+	name string
+	id   string
+}
+
+func parseTree(data []byte) (entries []treeEntry, err error) {
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, errors.New("malformed tree object")
+		}
+
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			id:   hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+
+		data = data[nul+21:]
+	}
+	return
+}
+
+// commitTree returns the id of the root tree of a commit object
+func commitTree(data []byte) (id string, err error) {
+	if !bytes.HasPrefix(data, []byte("tree ")) || len(data) < 45 {
+		return "", errors.New("malformed commit object")
+	}
+	return string(data[5:45]), nil
+}
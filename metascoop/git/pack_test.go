@@ -0,0 +1,128 @@
+package git
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPack creates a repo with two versions of a file, which git stores as a delta, and returns a pack of all its
+// objects together with their ids and types
+func testPack(t *testing.T, packArgs ...string) (pack []byte, types map[string]string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	gitCmd := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_NOSYSTEM=1", "GIT_CONFIG_GLOBAL="+os.DevNull,
+			"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, stderr.String())
+		}
+		return string(out)
+	}
+
+	gitCmd("", "init", "-q")
+	var text strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&text, "Line %d of the description\n", i)
+	}
+	for i, content := range []string{text.String(), text.String() + "One more line\n"} {
+		err := os.MkdirAll(filepath.Join(dir, "fastlane"), 0o755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, "fastlane", "full_description.txt"), []byte(content), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		gitCmd("", "add", "-A")
+		gitCmd("", "commit", "-q", "-m", fmt.Sprintf("Commit %d", i))
+	}
+
+	types = make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(gitCmd("", "rev-list", "--objects", "--all")), "\n") {
+		id := strings.Fields(line)[0]
+		types[id] = strings.TrimSpace(gitCmd("", "cat-file", "-t", id))
+	}
+
+	pack = []byte(gitCmd("HEAD\n", append([]string{"pack-objects", "--stdout", "--revs", "-q"}, packArgs...)...))
+	return
+}
+
+func TestReadPack(t *testing.T) {
+	// Without --delta-base-offset, git refers to the bases of deltas by their ids
+	for name, args := range map[string][]string{"ofs-delta": {"--delta-base-offset"}, "ref-delta": nil} {
+		t.Run(name, func(t *testing.T) {
+			pack, types := testPack(t, args...)
+
+			store := make(objectStore)
+			err := readPack(bytes.NewReader(pack), store, maxPackSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(store) != len(types) {
+				t.Errorf("read %d objects, the pack has %d", len(store), len(types))
+			}
+			for id, typ := range types {
+				o, ok := store[id]
+				if !ok {
+					t.Errorf("%s %s is missing", typ, id)
+					continue
+				}
+				// The id is the hash of the content, so this also checks that deltas were applied correctly
+				if objTypeNames[o.typ] != typ || hashObject(o.typ, o.data) != id {
+					t.Errorf("%s %s was read as a %s with id %s", typ, id, objTypeNames[o.typ], hashObject(o.typ, o.data))
+				}
+			}
+		})
+	}
+}
+
+func TestReadPackLimit(t *testing.T) {
+	pack, _ := testPack(t, "--delta-base-offset")
+
+	// What fits into the limit of the pack itself, but not with the objects it contains
+	for _, limit := range []int64{int64(len(pack)) / 2, int64(len(pack))} {
+		err := readPack(bytes.NewReader(pack), make(objectStore), limit)
+		if !errors.Is(err, errPackTooLarge) {
+			t.Errorf("reading a pack of %d bytes with a limit of %d = %v, want errPackTooLarge", len(pack), limit, err)
+		}
+	}
+}
+
+func TestApplyDeltaBudget(t *testing.T) {
+	base := []byte("0123456789")
+	// Source size 10, result size 4, copy 4 bytes from offset 2
+	delta := []byte{10, 4, 0x80 | 0x01 | 0x10, 2, 4}
+
+	got, err := applyDelta(base, delta, &packBudget{n: 4, limit: 4})
+	if err != nil || string(got) != "2345" {
+		t.Errorf("applyDelta = %q, %v, want \"2345\"", got, err)
+	}
+
+	_, err = applyDelta(base, delta, &packBudget{n: 3, limit: 3})
+	if !errors.Is(err, errPackTooLarge) {
+		t.Errorf("applyDelta with a result over the budget = %v, want errPackTooLarge", err)
+	}
+
+	// A result size that doesn't fit in an int must not be allocated
+	huge := append([]byte{10}, bytes.Repeat([]byte{0xff}, 10)...)
+	_, err = applyDelta(base, append(huge, 0x01), &packBudget{n: maxPackSize, limit: maxPackSize})
+	if err == nil {
+		t.Error("applyDelta accepted a delta with an out of range result size")
+	}
+}
@@ -0,0 +1,219 @@
+// Package githubapp authenticates to GitHub as an installation of a GitHub App. Apps get installation tokens
+// with their private key: they expire after an hour, are scoped to the repos the app was installed for and have
+// a rate limit that grows with the organization, unlike personal access tokens.
+package githubapp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const defaultAPI = "https://api.github.com/"
+
+// refreshMargin is how long before their expiry tokens are replaced, so requests that are sent with a token
+// never arrive after it expired
+const refreshMargin = 5 * time.Minute
+
+// App is a GitHub App installation. It's a token source that creates installation tokens as they are needed.
+type App struct {
+	// ID is the app ID shown in the settings of the app, the client ID works as well
+	ID string
+
+	// InstallationID selects the installation, usually that of an organization. If it's zero, the app must be
+	// installed exactly once and that installation is used.
+	InstallationID int64
+
+	Key *rsa.PrivateKey
+
+	// API is the base URL of the REST API, "https://api.github.com/" if empty. GitHub Enterprise servers use
+	// "https://<host>/api/v3/".
+	API string
+
+	// Client sends the requests for tokens, http.DefaultClient if nil
+	Client *http.Client
+
+	lock sync.Mutex
+}
+
+// ParseKey parses the PEM encoded private key of an app, as downloaded from its settings
+func ParseKey(data []byte) (key *rsa.PrivateKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the GitHub App key isn't PEM encoded")
+	}
+
+	if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return
+	}
+	parsed, perr := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if perr != nil {
+		return nil, fmt.Errorf("parsing GitHub App key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("the GitHub App key must be an RSA key, not %T", parsed)
+	}
+	return key, nil
+}
+
+// Identity describes the installation, unlike its tokens it stays the same
+func (a *App) Identity() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return fmt.Sprintf("github-app:%s/%d", a.ID, a.InstallationID)
+}
+
+// TokenSource returns a source of installation tokens that are reused until shortly before they expire
+func (a *App) TokenSource() oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, a)
+}
+
+// Token creates a new installation token. Its expiry is set a bit earlier than GitHub's, so reusing token
+// sources replace it in time.
+func (a *App) Token() (token *oauth2.Token, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if a.InstallationID == 0 {
+		a.InstallationID, err = a.findInstallation(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = a.request(ctx, http.MethodPost, "app/installations/"+strconv.FormatInt(a.InstallationID, 10)+"/access_tokens", &resp)
+	if err != nil {
+		return nil, fmt.Errorf("creating GitHub App installation token: %w", err)
+	}
+	if resp.Token == "" {
+		return nil, errors.New("creating GitHub App installation token: the response contains no token")
+	}
+
+	return &oauth2.Token{AccessToken: resp.Token, Expiry: resp.ExpiresAt.Add(-refreshMargin)}, nil
+}
+
+// findInstallation returns the only installation of the app
+func (a *App) findInstallation(ctx context.Context) (id int64, err error) {
+	var installations []struct {
+		ID      int64 `json:"id"`
+		Account struct {
+			Login string `json:"login"`
+		} `json:"account"`
+	}
+	err = a.request(ctx, http.MethodGet, "app/installations", &installations)
+	if err != nil {
+		return 0, fmt.Errorf("listing GitHub App installations: %w", err)
+	}
+
+	switch len(installations) {
+	case 0:
+		return 0, errors.New("the GitHub App isn't installed anywhere")
+	case 1:
+		return installations[0].ID, nil
+	}
+
+	var accounts []string
+	for _, i := range installations {
+		accounts = append(accounts, fmt.Sprintf("%s (%d)", i.Account.Login, i.ID))
+	}
+	return 0, fmt.Errorf("the GitHub App is installed several times, select one of %s", strings.Join(accounts, ", "))
+}
+
+// request sends a request authenticated as the app itself and decodes the JSON response into result
+func (a *App) request(ctx context.Context, method, path string, result interface{}) (err error) {
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return
+	}
+
+	base := a.API
+	if base == "" {
+		base = defaultAPI
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(base, "/")+"/"+path, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, e.Message)
+		}
+		return fmt.Errorf("%s %s: unexpected status %s", method, path, resp.Status)
+	}
+
+	return json.NewDecoder(bytes.NewReader(data)).Decode(result)
+}
+
+// jwt returns the JSON Web Token the app authenticates with. GitHub accepts them for at most ten minutes, the
+// issue time is a minute in the past to allow for clock drift.
+func (a *App) jwt(now time.Time) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+
+	// App IDs are numbers, client IDs strings
+	var issuer interface{} = a.ID
+	if id, perr := strconv.ParseInt(a.ID, 10, 64); perr == nil {
+		issuer = id
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": issuer,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing GitHub App token: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
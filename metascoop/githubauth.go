@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/nymtech/fdroid/metascoop/githubapp"
+)
+
+// githubAppKeyEnv contains the private key of the GitHub App, it takes precedence over -github-app-key so CI
+// systems don't have to write it to disk
+const githubAppKeyEnv = "METASCOOP_GITHUB_APP_KEY"
+
+// defaultGitHubAPI is the REST API of github.com
+const defaultGitHubAPI = "https://api.github.com/"
+
+// parseGitHubAPIURL returns the base URL of the GitHub REST API with the trailing slash go-github needs,
+// defaultGitHubAPI if raw is empty
+func parseGitHubAPIURL(raw string) (u *url.URL, err error) {
+	if raw == "" {
+		raw = defaultGitHubAPI
+	}
+	u, err = url.Parse(strings.TrimSuffix(raw, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("GitHub API URL %q must be an absolute http or https URL", raw)
+	}
+	return u, nil
+}
+
+// githubAPICacheable returns the requests the HTTP cache stores: responses of the API at api, but not release
+// assets, which are requested from it as well
+func githubAPICacheable(api *url.URL) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		return req.URL.Host == api.Host && req.Header.Get("Accept") != "application/octet-stream"
+	}
+}
+
+// githubAuth are the flags for authenticating to GitHub as a GitHub App instead of with a personal access token
+type githubAuth struct {
+	appID          *string
+	installationID *int64
+	keyPath        *string
+
+	app *githubapp.App
+}
+
+func addGitHubAuthFlags(flags *flag.FlagSet) *githubAuth {
+	return &githubAuth{
+		appID:          flags.String("github-app-id", "", "ID of the GitHub App to authenticate as instead of with -pat. Its installation tokens are refreshed automatically and have higher rate limits"),
+		installationID: flags.Int64("github-app-installation", 0, "ID of the installation of the GitHub App, needed if it's installed for several accounts"),
+		keyPath:        flags.String("github-app-key", "", "Private key (PEM) of the GitHub App. The key can also be given in $"+githubAppKeyEnv),
+	}
+}
+
+// tokenSource returns the source of the tokens requests to GitHub are sent with: installation tokens of the app,
+// or the personal access token pat. The app takes precedence, so a $GITHUB_TOKEN of CI systems doesn't get in
+// the way. It returns nil if neither is configured. apiURL is the REST API of a GitHub
+// Enterprise server, or empty for github.com.
+func (g *githubAuth) tokenSource(pat, apiURL string) (tokens oauth2.TokenSource, err error) {
+	if *g.appID == "" {
+		if pat == "" {
+			return nil, nil
+		}
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: pat}), nil
+	}
+	if pat != "" {
+		slog.Info("Authenticating as GitHub App, the personal access token isn't used", "app_id", *g.appID)
+	}
+
+	data := []byte(os.Getenv(githubAppKeyEnv))
+	switch {
+	case len(data) > 0:
+	case *g.keyPath != "":
+		data, err = os.ReadFile(*g.keyPath)
+		if err != nil {
+			return
+		}
+	default:
+		return nil, fmt.Errorf("the GitHub App needs a private key, set -github-app-key or $%s", githubAppKeyEnv)
+	}
+	key, err := githubapp.ParseKey(data)
+	if err != nil {
+		return
+	}
+
+	g.app = &githubapp.App{
+		ID:             *g.appID,
+		InstallationID: *g.installationID,
+		Key:            key,
+		API:            apiURL,
+	}
+	return g.app.TokenSource(), nil
+}
+
+// credentials identifies the credentials of requests for the HTTP cache. Installation tokens change every hour,
+// so requests of the app are identified by the installation.
+func (g *githubAuth) credentials(req *http.Request) string {
+	if g.app != nil {
+		return g.app.Identity()
+	}
+	return req.Header.Get("Authorization")
+}
+
+// args returns the flags that pass the GitHub App on to another command
+func (g *githubAuth) args() (args []string) {
+	if *g.appID == "" {
+		return nil
+	}
+	args = append(args, "-github-app-id="+*g.appID)
+	if *g.installationID != 0 {
+		args = append(args, "-github-app-installation="+strconv.FormatInt(*g.installationID, 10))
+	}
+	if *g.keyPath != "" {
+		args = append(args, "-github-app-key="+*g.keyPath)
+	}
+	return
+}
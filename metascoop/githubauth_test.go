@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseGitHubAPIURL(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: "https://api.github.com/"},
+		{raw: "https://github.example.com/api/v3", want: "https://github.example.com/api/v3/"},
+		{raw: "http://127.0.0.1:8080/", want: "http://127.0.0.1:8080/"},
+		{raw: "github.example.com/api/v3", wantErr: true},
+		{raw: "ftp://github.example.com/", wantErr: true},
+		{raw: "https://", wantErr: true},
+	}
+	for _, test := range tests {
+		u, err := parseGitHubAPIURL(test.raw)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseGitHubAPIURL(%q) = %s, want an error", test.raw, u)
+			}
+			continue
+		}
+		if err != nil || u.String() != test.want {
+			t.Errorf("parseGitHubAPIURL(%q) = %v, %v, want %s", test.raw, u, err, test.want)
+		}
+	}
+}
+
+func TestGitHubAPICacheable(t *testing.T) {
+	api, err := parseGitHubAPIURL("https://github.example.com/api/v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheable := githubAPICacheable(api)
+
+	tests := []struct {
+		url    string
+		accept string
+		want   bool
+	}{
+		{url: "https://github.example.com/api/v3/repos/o/n/releases", want: true},
+		{url: "https://github.example.com/api/v3/repos/o/n/releases/assets/1", accept: "application/octet-stream", want: false},
+		{url: "https://api.github.com/repos/o/n/releases", want: false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		if got := cacheable(req); got != test.want {
+			t.Errorf("cacheable(%s, Accept %q) = %v, want %v", test.url, test.accept, got, test.want)
+		}
+	}
+}
@@ -1,6 +1,6 @@
-module metascoop
+module github.com/nymtech/fdroid/metascoop
 
-go 1.17
+go 1.21
 
 require gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 
@@ -8,6 +8,7 @@ require (
 	github.com/google/go-github/v39 v39.1.0
 	github.com/hashicorp/go-version v1.3.0
 	github.com/r3labs/diff/v2 v2.14.0
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	golang.org/x/oauth2 v0.0.0-20211005180243-6b3c2da341f1
 	golang.org/x/text v0.3.7
 )
@@ -16,7 +17,6 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
-	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
 	golang.org/x/net v0.0.0-20211008194852-3b03d305991f // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
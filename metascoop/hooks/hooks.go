@@ -0,0 +1,247 @@
+// Package hooks runs custom processing of APKs at fixed points of a run, e.g. to patch files, run another scanner
+// or tell a system about a new version. A hook is a command or a Go plugin, and it can veto the APK.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"plugin"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// The points of a run hooks are called at
+const (
+	// PointPreDownload is before an asset is downloaded. A veto skips it.
+	PointPreDownload = "pre-download"
+
+	// PointPostDownload is after an APK was downloaded, before it's verified. Hooks may change the file, the
+	// verification checks the result. A veto removes it.
+	PointPostDownload = "post-download"
+
+	// PointPrePublish is after all downloads and rebuilds, before the index is updated. A veto removes the APK
+	// from the repo again.
+	PointPrePublish = "pre-publish"
+)
+
+// DefaultTimeout is used for hooks that don't set a timeout
+const DefaultTimeout = 5 * time.Minute
+
+// PluginSymbol is the name of the function Go plugins export, it must be a Func
+const PluginSymbol = "Hook"
+
+// Event describes the APK a hook is called for
+type Event struct {
+	Point string `json:"point"`
+	App   string `json:"app"`
+
+	// Package is the package name from apps.yaml for PointPreDownload, and that of the APK afterwards
+	Package string `json:"package,omitempty"`
+
+	Release string `json:"release"`
+	Asset   string `json:"asset"`
+
+	// Path is where the APK is in the repo, for PointPreDownload where it will be written
+	Path string `json:"path"`
+}
+
+// Func is the type of the function Go plugins export as PluginSymbol. Returning an error vetoes the APK.
+type Func func(ctx context.Context, e Event) error
+
+// VetoError is returned if a hook rejected an APK
+type VetoError struct {
+	Hook   string
+	Point  string
+	Reason string
+}
+
+func (e *VetoError) Error() string {
+	return fmt.Sprintf("hook %q vetoed the APK at %s: %s", e.Hook, e.Point, e.Reason)
+}
+
+// Config is the content of the hooks config file
+type Config struct {
+	Hooks []*Hook `yaml:"hooks"`
+}
+
+// Hook is a command or Go plugin that is called at some points of a run
+type Hook struct {
+	// Name is used to select hooks per app
+	Name string `yaml:"name"`
+
+	// Points are the Point* constants the hook is called at
+	Points []string `yaml:"points"`
+
+	// Command is run with "sh -c". It gets the Event as JSON on stdin and in METASCOOP_HOOK_* environment
+	// variables, and vetoes the APK by exiting with another code than 0. The last line of its output is the reason.
+	Command string `yaml:"command"`
+
+	// Plugin is the path of a Go plugin (built with "go build -buildmode=plugin" against this version of
+	// metascoop) that exports a Func called "Hook"
+	Plugin string `yaml:"plugin"`
+
+	Timeout time.Duration `yaml:"timeout"`
+
+	fn Func
+}
+
+// LoadConfig reads and validates the config file at path and loads the plugins it references
+func LoadConfig(path string) (c Config, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(&c)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	names := make(map[string]bool)
+	for i, h := range c.Hooks {
+		err = h.init()
+		if err != nil {
+			return c, fmt.Errorf("hook %d: %w", i+1, err)
+		}
+		if names[h.Name] {
+			return c, fmt.Errorf("there are several hooks called %q, give them distinct names", h.Name)
+		}
+		names[h.Name] = true
+	}
+
+	return
+}
+
+func (h *Hook) init() (err error) {
+	if h.Name == "" {
+		return fmt.Errorf("name must be set")
+	}
+	if (h.Command == "") == (h.Plugin == "") {
+		return fmt.Errorf("either command or plugin must be set")
+	}
+	if len(h.Points) == 0 {
+		return fmt.Errorf("points must be set")
+	}
+	for _, p := range h.Points {
+		switch p {
+		case PointPreDownload, PointPostDownload, PointPrePublish:
+		default:
+			return fmt.Errorf("unknown point %q, must be %q, %q or %q", p, PointPreDownload, PointPostDownload, PointPrePublish)
+		}
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = DefaultTimeout
+	}
+
+	if h.Plugin != "" {
+		h.fn, err = loadPlugin(h.Plugin)
+		if err != nil {
+			return fmt.Errorf("loading plugin %q: %w", h.Plugin, err)
+		}
+	}
+
+	return
+}
+
+func loadPlugin(path string) (fn Func, err error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return
+	}
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return
+	}
+
+	// Functions are exported as they are, variables as pointers
+	switch f := sym.(type) {
+	case func(context.Context, Event) error:
+		return f, nil
+	case *func(context.Context, Event) error:
+		return *f, nil
+	case *Func:
+		return *f, nil
+	}
+	return nil, fmt.Errorf("%s has type %T instead of hooks.Func", PluginSymbol, sym)
+}
+
+// Wants reports whether the hook is called at point
+func (h *Hook) Wants(point string) bool {
+	for _, p := range h.Points {
+		if p == point {
+			return true
+		}
+	}
+	return false
+}
+
+// Run calls the hook for e. A veto is returned as *VetoError, other errors mean the hook couldn't be run.
+func (h *Hook) Run(ctx context.Context, e Event) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	if h.fn != nil {
+		err = h.fn(ctx, e)
+		if err != nil {
+			return &VetoError{Hook: h.Name, Point: e.Point, Reason: err.Error()}
+		}
+		return
+	}
+
+	input, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	var output bytes.Buffer
+	cmd := tools.Shell(ctx, h.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(),
+		"METASCOOP_HOOK_POINT="+e.Point,
+		"METASCOOP_HOOK_APP="+e.App,
+		"METASCOOP_HOOK_PACKAGE="+e.Package,
+		"METASCOOP_HOOK_RELEASE="+e.Release,
+		"METASCOOP_HOOK_ASSET="+e.Asset,
+		"METASCOOP_HOOK_PATH="+e.Path,
+	)
+
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return fmt.Errorf("hook %q timed out after %s", h.Name, h.Timeout)
+	case errors.As(err, &exitErr):
+		return &VetoError{Hook: h.Name, Point: e.Point, Reason: lastLine(output.String(), exitErr)}
+	case err != nil:
+		return fmt.Errorf("running hook %q: %w", h.Name, err)
+	}
+	return
+}
+
+// lastLine returns the last line of the output of a command, or describes how it exited if there is none
+func lastLine(output string, exitErr *exec.ExitError) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return last
+	}
+	return exitErr.Error()
+}
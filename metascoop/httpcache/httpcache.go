@@ -0,0 +1,187 @@
+package httpcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// maxBodySize limits the size of cached responses, API responses are much smaller
+const maxBodySize = 32 << 20
+
+// Transport caches responses to GET requests in a directory and revalidates them with conditional requests
+// (If-None-Match, If-Modified-Since). GitHub doesn't count "304 Not Modified" answers against the rate limit,
+// so unchanged release lists are free.
+type Transport struct {
+	// Dir is where the responses are stored, it can be kept between runs
+	Dir string
+
+	Next http.RoundTripper
+
+	// Cacheable decides which requests are cached. If nil, all GET requests without a Range header are.
+	Cacheable func(req *http.Request) bool
+
+	// Credentials returns who the request is sent as, the Authorization header if nil. Credentials that change
+	// between runs, like the short-lived tokens of GitHub Apps, must be replaced with a stable identity, or
+	// nothing is ever found in the cache.
+	Credentials func(req *http.Request) string
+}
+
+type entry struct {
+	URL        string      `json:"url"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+func (t *Transport) next() http.RoundTripper {
+	if t.Next != nil {
+		return t.Next
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return false
+	}
+	if t.Cacheable != nil {
+		return t.Cacheable(req)
+	}
+	return true
+}
+
+// path returns the file of the cached response to req. The credentials are part of the key, so a response
+// is never returned to someone who wasn't allowed to see it. This only works if the Authorization header is
+// set before the request reaches the Transport.
+func (t *Transport) path(req *http.Request) string {
+	credentials := req.Header.Get("Authorization")
+	if t.Credentials != nil {
+		credentials = t.Credentials(req)
+	}
+	sum := sha256.Sum256([]byte(req.URL.String() + "\x00" + req.Header.Get("Accept") + "\x00" + credentials))
+	return filepath.Join(t.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if !t.cacheable(req) {
+		return t.next().RoundTrip(req)
+	}
+
+	path := t.path(req)
+	cached, _ := load(path)
+
+	if cached != nil {
+		req = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if modified := cached.Header.Get("Last-Modified"); modified != "" {
+			req.Header.Set("If-Modified-Since", modified)
+		}
+	}
+
+	resp, err = t.next().RoundTrip(req)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		_ = resp.Body.Close()
+
+		// The headers of the 304 response are more recent, e.g. the rate limit
+		header := cached.Header.Clone()
+		for k, v := range resp.Header {
+			header[k] = v
+		}
+		header.Set("X-From-Cache", "1")
+
+		return cached.response(req, header), nil
+
+	case resp.StatusCode == http.StatusOK && (resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""):
+		body, rerr := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+		_ = resp.Body.Close()
+		if rerr != nil {
+			return nil, rerr
+		}
+
+		e := &entry{URL: req.URL.String(), StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+		if len(body) <= maxBodySize {
+			// A failing cache only costs rate limit, so the error is ignored
+			_ = e.store(path)
+		}
+
+		return e.response(req, resp.Header), nil
+	}
+
+	return resp, nil
+}
+
+func (e *entry) response(req *http.Request, header http.Header) *http.Response {
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	header.Del("Content-Encoding")
+
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+func load(path string) (e *entry, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	e = new(entry)
+	err = json.Unmarshal(data, e)
+	if err != nil {
+		return nil, err
+	}
+	if e.Header == nil {
+		return nil, errors.New("cached response has no headers")
+	}
+
+	return
+}
+
+func (e *entry) store(path string) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// httpSettings are the flags for the HTTP traffic of a command. They apply to all of it: the clients for the
+// GitHub API, the other hosts, downloads and the native git backend use http.DefaultTransport, which is replaced
+// in setup. It also adds the download_auth headers of apps to their downloads, see scoop.DownloadTransport. Proxies are taken from $HTTPS_PROXY, $HTTP_PROXY and $NO_PROXY, like by git.
+type httpSettings struct {
+	userAgent *string
+	caBundle  *string
+}
+
+func addHTTPFlags(flags *flag.FlagSet) *httpSettings {
+	return &httpSettings{
+		userAgent: flags.String("user-agent", "metascoop", "User-Agent header of all HTTP requests, e.g. to identify the repo to the hosts it crawls"),
+		caBundle:  flags.String("ca-bundle", "", "PEM file with certificates of CAs that are trusted in addition to the system ones, e.g. of a proxy that intercepts TLS"),
+	}
+}
+
+// setup applies the settings to http.DefaultTransport and to the git commands that are run. It must be called
+// before the first HTTP client is created.
+func (h *httpSettings) setup() (err error) {
+	base, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errors.New("the default HTTP transport was already replaced")
+	}
+	transport := base.Clone()
+
+	if *h.caBundle != "" {
+		pem, err := os.ReadFile(*h.caBundle)
+		if err != nil {
+			return fmt.Errorf("reading CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA bundle %q contains no PEM certificates", *h.caBundle)
+		}
+
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+
+		err = os.Setenv("GIT_SSL_CAINFO", *h.caBundle)
+		if err != nil {
+			return err
+		}
+	}
+
+	http.DefaultTransport = scoop.DownloadTransport(transport)
+	if *h.userAgent != "" {
+		http.DefaultTransport = scoop.DownloadTransport(&userAgentTransport{next: transport, userAgent: *h.userAgent})
+
+		err = os.Setenv("GIT_HTTP_USER_AGENT", *h.userAgent)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// userAgentTransport sets the User-Agent header of all requests, also of clients like go-github that set their own
+type userAgentTransport struct {
+	next      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/images"
+)
+
+// syncImages copies the images of an app from its upstream repo to metadataPkgDir, from where the indexer
+// publishes them to repoPkgDir. Images that were published before are removed from repoPkgDir first, so
+// screenshots that were removed upstream disappear from the repo as well.
+//
+// Images that are already in metadataPkgDir were added by hand and take precedence. It returns the paths
+// that were written, they should be removed after indexing so they aren't committed twice.
+func syncImages(logger *slog.Logger, metadataPkgDir, repoPkgDir string, metadata apps.RepoMetadata, limits images.Limits) (written []string, err error) {
+	graphics := metadata.Images
+	screenshots := metadata.LocalizedScreenshots
+	if !metadata.HasFastlaneImages() && len(metadata.Screenshots) > 0 {
+		// Repos without fastlane metadata only get phone screenshots, from wherever they are
+		screenshots = map[string]map[string][]string{
+			"en-US": {"phoneScreenshots": metadata.Screenshots},
+		}
+	}
+
+	err = removePublishedImages(repoPkgDir)
+	if err != nil {
+		return nil, fmt.Errorf("removing published images: %w", err)
+	}
+
+	for locale, kinds := range graphics {
+		localeDir := filepath.Join(metadataPkgDir, locale)
+
+		for kind, src := range kinds {
+			if existing := findImageFile(localeDir, kind); existing != "" {
+				logger.Info("Keeping image instead of the upstream one", "path", existing, "kind", kind)
+				continue
+			}
+
+			dest := filepath.Join(localeDir, kind+imageExt(src))
+			if publishImage(logger, src, dest, limits) {
+				written = append(written, dest)
+			}
+		}
+	}
+
+	for locale, dirs := range screenshots {
+		for dir, paths := range dirs {
+			destDir := filepath.Join(metadataPkgDir, locale, dir)
+			if entries, rerr := os.ReadDir(destDir); rerr == nil && len(entries) > 0 {
+				logger.Info("Keeping screenshots instead of the upstream ones", "path", destDir)
+				continue
+			}
+
+			var counter = 1
+			for _, src := range paths {
+				dest := filepath.Join(destDir, fmt.Sprintf("%d%s", counter, imageExt(src)))
+				if publishImage(logger, src, dest, limits) {
+					counter++
+				}
+			}
+			if counter > 1 {
+				written = append(written, destDir)
+			}
+
+			logger.Info("Copied screenshots", "count", counter-1, "kind", dir, "locale", locale)
+		}
+	}
+
+	return
+}
+
+// publishImage copies an image and reports whether it was written. Images that can't be used are logged and skipped.
+func publishImage(logger *slog.Logger, src, dest string, limits images.Limits) bool {
+	err := os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	if err != nil {
+		logger.Error("Creating directory for image failed", "path", dest, "error", err)
+		return false
+	}
+
+	resized, err := images.Publish(src, dest, limits)
+	if errors.Is(err, images.ErrTooLarge) {
+		logger.Warn("Skipping image", "error", err)
+		return false
+	}
+	if err != nil {
+		logger.Warn("Skipping image", "path", src, "error", err)
+		return false
+	}
+
+	if resized {
+		logger.Info("Scaled down image", "image", filepath.Base(src), "max_dimension", limits.MaxDimension)
+	}
+
+	return true
+}
+
+// removePublishedImages removes the images in all locales of repoPkgDir. The indexer publishes the current ones again.
+func removePublishedImages(repoPkgDir string) (err error) {
+	locales, err := os.ReadDir(repoPkgDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+		localeDir := filepath.Join(repoPkgDir, locale.Name())
+
+		for _, dir := range apps.FastlaneScreenshotDirs {
+			err = os.RemoveAll(filepath.Join(localeDir, dir))
+			if err != nil {
+				return
+			}
+		}
+
+		entries, rerr := os.ReadDir(localeDir)
+		if rerr != nil {
+			return rerr
+		}
+		for _, e := range entries {
+			if e.IsDir() || !isGraphic(e.Name()) {
+				continue
+			}
+			err = os.Remove(filepath.Join(localeDir, e.Name()))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// isGraphic reports whether name is a published graphic, fdroidserver adds the hash of the content to the name
+// ("icon_<hash>.png") so clients don't cache old versions
+func isGraphic(name string) bool {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, kind := range apps.FastlaneImageKinds {
+		if base == kind || strings.HasPrefix(base, kind+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// findImageFile returns the path of the image of the given kind in dir, if there is one
+func findImageFile(dir, kind string) string {
+	for _, ext := range []string{".png", ".jpg", ".jpeg"} {
+		path := filepath.Join(dir, kind+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// imageExt returns the extension F-Droid expects for the image at path
+func imageExt(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".jpeg" {
+		return ".jpg"
+	}
+	return ext
+}
@@ -0,0 +1,139 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"os"
+)
+
+// Limits restrict the images that are published. Zero values disable a limit.
+type Limits struct {
+	// MaxDimension is the maximum width and height, larger images are scaled down
+	MaxDimension int
+
+	// MaxBytes is the maximum file size after scaling, larger images are rejected
+	MaxBytes int64
+}
+
+// ErrTooLarge is returned for images that are still larger than Limits.MaxBytes after scaling
+var ErrTooLarge = errors.New("image is too large")
+
+// Publish writes the PNG or JPEG image at src to dest, scaled down to fit the limits. Images that already fit
+// are copied unchanged, so their content (and digest) stays stable between runs.
+func Publish(src, dest string, limits Limits) (resized bool, err error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("reading image %q: %w", src, err)
+	}
+
+	if limits.MaxDimension > 0 && (cfg.Width > limits.MaxDimension || cfg.Height > limits.MaxDimension) {
+		data, err = scaleDown(data, format, limits.MaxDimension)
+		if err != nil {
+			return false, fmt.Errorf("scaling image %q: %w", src, err)
+		}
+		resized = true
+	}
+
+	if limits.MaxBytes > 0 && int64(len(data)) > limits.MaxBytes {
+		return resized, fmt.Errorf("%w: %q has %d bytes, at most %d are allowed", ErrTooLarge, src, len(data), limits.MaxBytes)
+	}
+
+	err = os.WriteFile(dest, data, 0o644)
+	return
+}
+
+// scaleDown returns the image in data scaled to fit into a square of maxDimension, encoded in its original format
+func scaleDown(data []byte, format string, maxDimension int) (out []byte, err error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w >= h {
+		w, h = maxDimension, h*maxDimension/w
+	} else {
+		w, h = w*maxDimension/h, maxDimension
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	scaled := boxScale(img, w, h)
+
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: 90})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, scaled)
+	default:
+		err = fmt.Errorf("unsupported image format %q", format)
+	}
+
+	return buf.Bytes(), err
+}
+
+// Scale returns img scaled to w×h pixels. Scaling down averages the source pixels, scaling up repeats them.
+func Scale(img image.Image, w, h int) *image.RGBA {
+	return boxScale(img, w, h)
+}
+
+// boxScale scales img down to w×h pixels, averaging all source pixels that make up a target pixel
+func boxScale(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(bl / n)
+			d[3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/file"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// importedApp is the apps.yaml entry written by import, in the order the fields should appear
+type importedApp struct {
+	Git          string   `yaml:"git"`
+	Name         string   `yaml:"name,omitempty"`
+	Package      string   `yaml:"package"`
+	Signer       string   `yaml:"signer,omitempty"`
+	TagPattern   string   `yaml:"tag_pattern,omitempty"`
+	Categories   []string `yaml:"categories,omitempty"`
+	AntiFeatures []string `yaml:"anti_features,omitempty"`
+}
+
+// fdroidserverMetadata are the fields of an fdroidserver metadata file that import uses
+type fdroidserverMetadata struct {
+	Disabled        string    `yaml:"Disabled"`
+	RepoType        string    `yaml:"RepoType"`
+	Repo            string    `yaml:"Repo"`
+	SourceCode      string    `yaml:"SourceCode"`
+	Name            string    `yaml:"Name"`
+	AutoName        string    `yaml:"AutoName"`
+	Categories      []string  `yaml:"Categories"`
+	AntiFeatures    yaml.Node `yaml:"AntiFeatures"`
+	UpdateCheckMode string    `yaml:"UpdateCheckMode"`
+	SigningKeys     yaml.Node `yaml:"AllowedAPKSigningKeys"`
+	Builds          []struct {
+		VersionCode int    `yaml:"versionCode"`
+		Commit      string `yaml:"commit"`
+	} `yaml:"Builds"`
+
+	path string
+}
+
+// importRepo onboards an existing fdroidserver repo: it generates apps.yaml entries from the metadata files and
+// moves (or copies) the APKs, metadata and graphics into the repo under the names an update gives them, so the
+// first update treats the published versions as already downloaded. Apps whose source isn't on a host metascoop
+// can fetch releases from are skipped.
+func importRepo(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file the apps are added to")
+		repoDir      = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory the versions are imported into")
+		dryRun       = flags.Bool("dry-run", false, "Only print the apps.yaml entries and the files that would be imported")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] <fdroidserver directory>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "The directory contains the \"metadata\" and \"repo\" directories of fdroidserver. It can be the\n")
+		fmt.Fprintf(flags.Output(), "parent of -rd, the files are renamed in place then.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	srcDir := flags.Arg(0)
+	fdroidDir := filepath.Dir(*repoDir)
+	inPlace := sameDir(srcDir, fdroidDir)
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+
+	index, err := apps.ReadIndex(filepath.Join(srcDir, "repo", "index-v1.json"))
+	if err != nil {
+		fatal("Reading the index of the fdroidserver repo failed, run \"fdroid update\" there first", "error", err)
+	}
+
+	metaFiles, err := filepath.Glob(filepath.Join(srcDir, "metadata", "*.yml"))
+	if err != nil {
+		fatal("Listing metadata files failed", "error", err)
+	}
+	sort.Strings(metaFiles)
+
+	names := make(map[string]bool)
+	for _, app := range appsList {
+		names[app.Name()] = true
+	}
+
+	var imported, failed int
+	for _, metaPath := range metaFiles {
+		pkgName := strings.TrimSuffix(filepath.Base(metaPath), ".yml")
+		logger := slog.With("package", pkgName)
+
+		if existing, ok := exportApp(appsList, pkgName, index, nil); ok {
+			logger.Info("Skipping package, apps.yaml already has an app publishing it", "app", existing.Name())
+			continue
+		}
+
+		meta, err := readFdroidserverMetadata(metaPath)
+		if err != nil {
+			logger.Error("Reading metadata file failed", "path", metaPath, "error", err)
+			failed++
+			continue
+		}
+
+		name, entry, err := importEntry(logger, meta, pkgName, index.Packages[pkgName])
+		if err != nil {
+			logger.Warn("Skipping package", "reason", err)
+			continue
+		}
+		if names[name] {
+			name = pkgName
+		}
+		names[name] = true
+		logger = logger.With("app", name)
+
+		if *dryRun {
+			out, _ := yaml.Marshal(map[string]importedApp{name: entry})
+			fmt.Print(string(out))
+		}
+
+		err = importFiles(logger, srcDir, fdroidDir, name, pkgName, meta, index.Packages[pkgName], inPlace, *dryRun)
+		if err != nil {
+			logger.Error("Importing files failed", "error", err)
+			failed++
+			continue
+		}
+
+		if !*dryRun {
+			err = appendApp(*appsFilePath, name, entry)
+			if err != nil {
+				logger.Error("Adding app to apps.yaml failed", "path", *appsFilePath, "error", err)
+				failed++
+				continue
+			}
+		}
+
+		logger.Info("Imported app", "versions", len(index.Packages[pkgName]))
+		imported++
+	}
+
+	slog.Info("Imported fdroidserver repo, run an update to generate the index", "apps", imported, "failed", failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func readFdroidserverMetadata(path string) (meta fdroidserverMetadata, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = yaml.Unmarshal(data, &meta)
+	meta.path = path
+	return
+}
+
+// importEntry returns the name and apps.yaml entry of the app with the fdroidserver metadata meta
+func importEntry(logger *slog.Logger, meta fdroidserverMetadata, pkgName string, versions []apps.PackageInfo) (name string, entry importedApp, err error) {
+	if meta.Disabled != "" {
+		return "", entry, fmt.Errorf("the app is disabled: %s", meta.Disabled)
+	}
+
+	gitURL := meta.SourceCode
+	if meta.Repo != "" && (meta.RepoType == "" || meta.RepoType == "git") {
+		gitURL = meta.Repo
+	}
+	gitURL = strings.TrimSuffix(strings.TrimSuffix(gitURL, "/"), ".git")
+	if _, kerr := sources.DetectKind(gitURL); gitURL == "" || kerr != nil {
+		return "", entry, fmt.Errorf("releases can't be fetched from %q, add the app with a \"url\" or \"fdroid\" source by hand", gitURL)
+	}
+	repo, err := apps.RepoInfo(gitURL)
+	if err != nil || repo.Name == "" {
+		return "", entry, fmt.Errorf("invalid repository URL %q", gitURL)
+	}
+
+	entry = importedApp{
+		Git:          gitURL,
+		Package:      pkgName,
+		Categories:   meta.Categories,
+		AntiFeatures: stringOrList(meta.AntiFeatures),
+	}
+	if meta.Name != "" && meta.Name != meta.AutoName {
+		entry.Name = meta.Name
+	}
+
+	// The signer is only pinned if it's certain: the one fdroidserver allows, or the one of all imported versions
+	signers := stringOrList(meta.SigningKeys)
+	if len(signers) == 0 {
+		for _, p := range versions {
+			if p.Signer != "" && !contains(signers, p.Signer) {
+				signers = append(signers, p.Signer)
+			}
+		}
+	}
+	if len(signers) == 1 {
+		entry.Signer = strings.ToLower(signers[0])
+	} else if len(signers) > 1 {
+		logger.Warn("The app has several signers, so the signer isn't pinned", "signers", len(signers))
+	}
+
+	// fdroidserver tag patterns select tags, ours also say which part is the version
+	if pattern, ok := strings.CutPrefix(meta.UpdateCheckMode, "Tags "); ok {
+		if re, rerr := regexp.Compile(pattern); rerr == nil && re.NumSubexp() > 0 {
+			entry.TagPattern = pattern
+		} else {
+			logger.Warn("The tag pattern of the update check has no version group, it isn't imported", "pattern", pattern)
+		}
+	}
+
+	return repo.Name, entry, nil
+}
+
+// stringOrList returns the values of a field that fdroidserver accepts as a comma-separated string or a list
+func stringOrList(node yaml.Node) (list []string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		for _, v := range strings.Split(node.Value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+	case yaml.SequenceNode:
+		_ = node.Decode(&list)
+	}
+	return
+}
+
+// importFiles moves or copies the APKs of pkgName from the fdroidserver directory srcDir to the fdroid directory,
+// renamed like an update names them, and its metadata file, localized metadata and graphics. Versions whose tag
+// isn't in the builds of the metadata file keep their name: they stay in the repo, but an update doesn't know
+// their release.
+func importFiles(logger *slog.Logger, srcDir, fdroidDir, name, pkgName string, meta fdroidserverMetadata, versions []apps.PackageInfo, inPlace, dryRun bool) (err error) {
+	tags := make(map[int]string)
+	for _, b := range meta.Builds {
+		if b.Commit != "" {
+			tags[b.VersionCode] = b.Commit
+		}
+	}
+
+	// One APK per versionCode is named like a release without splits, several are split APKs
+	perVersion := make(map[int]int)
+	for _, p := range versions {
+		perVersion[p.VersionCode]++
+	}
+
+	transfer := func(src, dest string) error {
+		if dryRun {
+			logger.Info("Would import file", "from", src, "to", dest)
+			return nil
+		}
+		if _, serr := os.Stat(dest); serr == nil {
+			return fmt.Errorf("%s exists already", dest)
+		}
+		err := os.MkdirAll(filepath.Dir(dest), 0o755)
+		if err != nil {
+			return err
+		}
+		if inPlace {
+			return file.Move(src, dest)
+		}
+		return copyFile(src, dest)
+	}
+
+	for _, p := range versions {
+		src := filepath.Join(srcDir, "repo", p.ApkName)
+
+		target := p.ApkName
+		if tag, ok := tags[p.VersionCode]; !ok {
+			logger.Warn("The builds have no commit for the version, its APK keeps its name", "apk", p.ApkName, "version_code", p.VersionCode)
+		} else if perVersion[p.VersionCode] > 1 && len(p.Nativecode) == 1 {
+			target = apps.GenerateSplitReleaseFilename(name, tag, p.Nativecode[0])
+		} else {
+			target = apps.GenerateReleaseFilename(name, tag)
+		}
+		if inPlace && target == p.ApkName {
+			continue
+		}
+
+		err = transfer(src, filepath.Join(fdroidDir, "repo", target))
+		if err != nil {
+			return
+		}
+		if _, serr := os.Stat(src + ".asc"); serr == nil {
+			err = transfer(src+".asc", filepath.Join(fdroidDir, "repo", target+".asc"))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if inPlace {
+		return nil
+	}
+
+	// The metadata files of fdroidserver are what updates write, and they keep the fields that aren't set
+	err = transfer(meta.path, filepath.Join(fdroidDir, "metadata", pkgName+".yml"))
+	if err != nil {
+		return
+	}
+	for _, dir := range []string{"metadata", "repo"} {
+		err = importDir(filepath.Join(srcDir, dir, pkgName), filepath.Join(fdroidDir, dir, pkgName), dryRun)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// importDir copies the directory src to dest, if it exists
+func importDir(src, dest string, dryRun bool) (err error) {
+	if _, serr := os.Stat(src); serr != nil {
+		return nil
+	}
+	if dryRun {
+		slog.Info("Would import directory", "from", src, "to", dest)
+		return nil
+	}
+	return copyDir(src, dest)
+}
@@ -0,0 +1,177 @@
+package index
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+)
+
+// apkFile is everything the indexes need to know about a single APK
+type apkFile struct {
+	Name   string
+	SHA256 string
+	Size   int64
+
+	Manifest   apk.Manifest
+	NativeCode []string
+
+	// Signer is the SHA-256 fingerprint of the signing certificate, Sig the legacy MD5 based
+	// fingerprint of index-v1
+	Signer string
+	Sig    string
+
+	// Added is the time the APK was first indexed, in milliseconds since the epoch
+	Added int64
+
+	// OBBMain and OBBPatch are the expansion files clients download with the APK, if there are any
+	OBBMain  *obbFile
+	OBBPatch *obbFile
+}
+
+// obbFile is an expansion file in the repo, named like "main.12.com.example.app.obb"
+type obbFile struct {
+	Name        string
+	SHA256      string
+	Size        int64
+	Patch       bool
+	VersionCode int64
+	Package     string
+}
+
+var obbName = regexp.MustCompile(`^(main|patch)\.(\d+)\.(.+)\.obb$`)
+
+// scanAPKs reads all APKs in dir. APKs that cannot be parsed are skipped with a log message,
+// just like fdroidserver skips them.
+func scanAPKs(dir string) (apks []apkFile, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".apk") {
+			continue
+		}
+
+		a, serr := scanAPK(filepath.Join(dir, e.Name()))
+		if serr != nil {
+			slog.Warn("Skipping APK while generating index", "path", filepath.Join(dir, e.Name()), "error", serr)
+			continue
+		}
+
+		apks = append(apks, a)
+	}
+
+	sort.Slice(apks, func(i, j int) bool {
+		return apks[i].Name < apks[j].Name
+	})
+
+	obbs, err := scanOBBs(dir, entries)
+	if err != nil {
+		return
+	}
+
+	// Like fdroidserver, an APK gets the newest expansion file that isn't newer than itself
+	for i := range apks {
+		a := &apks[i]
+		for j := range obbs {
+			o := &obbs[j]
+			if o.Package != a.Manifest.Package || o.VersionCode > a.Manifest.VersionCode {
+				continue
+			}
+
+			current := &a.OBBMain
+			if o.Patch {
+				current = &a.OBBPatch
+			}
+			if *current == nil || (*current).VersionCode < o.VersionCode {
+				*current = o
+			}
+		}
+	}
+
+	return
+}
+
+// scanOBBs hashes the expansion files among entries of dir
+func scanOBBs(dir string, entries []os.DirEntry) (obbs []obbFile, err error) {
+	for _, e := range entries {
+		match := obbName.FindStringSubmatch(e.Name())
+		if e.IsDir() || match == nil {
+			continue
+		}
+
+		o := obbFile{Name: e.Name(), Patch: match[1] == "patch", Package: match[3]}
+		o.VersionCode, err = strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing versionCode of %q: %w", e.Name(), err)
+		}
+
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		o.Size, err = io.Copy(h, f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("hashing %q: %w", e.Name(), err)
+		}
+		o.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+		obbs = append(obbs, o)
+	}
+
+	return
+}
+
+func scanAPK(path string) (a apkFile, err error) {
+	a.Name = filepath.Base(path)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	a.Size, err = io.Copy(h, f)
+	if err != nil {
+		return
+	}
+	a.SHA256 = hex.EncodeToString(h.Sum(nil))
+
+	a.Manifest, err = apk.ReadManifest(path)
+	if err != nil {
+		return a, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	a.NativeCode, err = apk.NativeCode(path)
+	if err != nil {
+		return a, fmt.Errorf("reading native code: %w", err)
+	}
+
+	signers, err := apk.Verify(path)
+	if err != nil {
+		return a, fmt.Errorf("verifying signature: %w", err)
+	}
+
+	a.Signer = signers[0].CertSHA256
+
+	// fdroidserver hashes the hex encoded certificate for the legacy "sig" field
+	sig := md5.Sum([]byte(hex.EncodeToString(signers[0].Certificate.Raw)))
+	a.Sig = hex.EncodeToString(sig[:])
+
+	return
+}
@@ -0,0 +1,82 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config contains the settings of fdroid's config.yml that are needed to generate indexes.
+// Using the same file means switching between fdroidserver and the native generator needs no extra configuration.
+type Config struct {
+	RepoURL         string `yaml:"repo_url"`
+	RepoName        string `yaml:"repo_name"`
+	RepoDescription string `yaml:"repo_description"`
+	RepoIcon        string `yaml:"repo_icon"`
+
+	ArchiveURL         string `yaml:"archive_url"`
+	ArchiveName        string `yaml:"archive_name"`
+	ArchiveDescription string `yaml:"archive_description"`
+	ArchiveIcon        string `yaml:"archive_icon"`
+
+	Mirrors []string `yaml:"mirrors"`
+}
+
+// ReadConfig reads the config file at path. A missing file results in an empty config.
+func ReadConfig(path string) (c Config, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = yaml.NewDecoder(f).Decode(&c)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	return
+}
+
+// repoInfo is the part of the config that describes one repo, either the main repo or its archive
+type repoInfo struct {
+	Name        string
+	Description string
+	Address     string
+	Icon        string
+	Mirrors     []string
+}
+
+func (c Config) repo() repoInfo {
+	return repoInfo{
+		Name:        c.RepoName,
+		Description: c.RepoDescription,
+		Address:     c.RepoURL,
+		Icon:        c.RepoIcon,
+		Mirrors:     c.Mirrors,
+	}
+}
+
+func (c Config) archive() repoInfo {
+	r := repoInfo{
+		Name:        c.ArchiveName,
+		Description: c.ArchiveDescription,
+		Address:     c.ArchiveURL,
+		Icon:        c.ArchiveIcon,
+	}
+
+	// Same defaults as fdroidserver
+	if r.Name == "" && c.RepoName != "" {
+		r.Name = c.RepoName + " Archive"
+	}
+	if r.Icon == "" {
+		r.Icon = c.RepoIcon
+	}
+
+	return r
+}
@@ -0,0 +1,655 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/sign"
+)
+
+// Options configures index generation
+type Options struct {
+	// Dir is the fdroid directory that contains config.yml, metadata/, repo/ and optionally archive/
+	Dir string
+
+	// Now is the timestamp of the generated indexes and of newly added APKs. Defaults to the current time.
+	Now time.Time
+
+	// Key signs the indexes if set, producing entry.jar and index-v1.jar
+	Key *sign.Key
+}
+
+// betaChannel is the release channel of versions newer than the suggested version
+const betaChannel = "Beta"
+
+// Generate writes index-v1.json, index-v2.json and entry.json for the repo and, if it exists, the archive.
+// This replaces "fdroid update": packages in the repo without metadata file get a stub, and the
+// localized images in metadata/ are copied to the repo.
+func Generate(opts Options) (err error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+
+	cfg, err := ReadConfig(filepath.Join(opts.Dir, "config.yml"))
+	if err != nil {
+		return fmt.Errorf("reading fdroid config: %w", err)
+	}
+
+	metadataDir := filepath.Join(opts.Dir, "metadata")
+
+	err = generateRepo(filepath.Join(opts.Dir, "repo"), metadataDir, cfg.repo(), true, opts.Now, opts.Key)
+	if err != nil {
+		return
+	}
+
+	archiveDir := filepath.Join(opts.Dir, "archive")
+	if _, serr := os.Stat(archiveDir); serr == nil {
+		err = generateRepo(archiveDir, metadataDir, cfg.archive(), false, opts.Now, opts.Key)
+	}
+
+	return
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// previousTimes contains the "added" timestamps of an existing index, so they survive regenerating it
+type previousTimes struct {
+	// map[sha256]added
+	versions map[string]int64
+	// map[apkName]added, used when only an index-v1.json from fdroidserver exists
+	apkNames map[string]int64
+	// map[packageName]added
+	packages map[string]int64
+}
+
+func readPreviousTimes(dir string) (p previousTimes) {
+	p.versions = make(map[string]int64)
+	p.apkNames = make(map[string]int64)
+	p.packages = make(map[string]int64)
+
+	var v2 IndexV2
+	if readJSON(filepath.Join(dir, "index-v2.json"), &v2) == nil {
+		for pkgName, pkg := range v2.Packages {
+			p.packages[pkgName] = pkg.Metadata.Added
+			for hash, v := range pkg.Versions {
+				p.versions[hash] = v.Added
+			}
+		}
+	}
+
+	var v1 IndexV1
+	if readJSON(filepath.Join(dir, "index-v1.json"), &v1) == nil {
+		for _, app := range v1.Apps {
+			if _, ok := p.packages[app.PackageName]; !ok {
+				p.packages[app.PackageName] = app.Added
+			}
+		}
+		for _, pkgs := range v1.Packages {
+			for _, pkg := range pkgs {
+				p.apkNames[pkg.ApkName] = pkg.Added
+			}
+		}
+	}
+
+	return
+}
+
+func (p previousTimes) added(a apkFile, now int64) int64 {
+	if t, ok := p.versions[a.SHA256]; ok && t != 0 {
+		return t
+	}
+	if t, ok := p.apkNames[a.Name]; ok && t != 0 {
+		return t
+	}
+	return now
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON atomically writes v to path and returns the written data
+func writeJSON(path string, v interface{}) (data []byte, err error) {
+	data, err = json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return
+	}
+
+	return data, os.Rename(tmpPath, path)
+}
+
+// writeStub creates a minimal metadata file for a package that was found in the repo, like "fdroid update --create-metadata"
+func writeStub(metadataDir string, a apkFile) (err error) {
+	path := filepath.Join(metadataDir, a.Manifest.Package+".yml")
+
+	slog.Info("Creating metadata stub", "package", a.Manifest.Package, "path", path)
+
+	err = os.MkdirAll(metadataDir, 0o755)
+	if err != nil {
+		return
+	}
+
+	data, err := yaml.Marshal(map[string]interface{}{
+		"License":            "Unknown",
+		"Categories":         []string{},
+		"CurrentVersion":     a.Manifest.VersionName,
+		"CurrentVersionCode": a.Manifest.VersionCode,
+	})
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+// publishFile copies src to dir/rel unless an identical file is already there, and returns its index entry
+func publishFile(src, dir, rel string) (f FileV2, err error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	f = FileV2{
+		Name:   "/" + filepath.ToSlash(rel),
+		SHA256: hex.EncodeToString(sum[:]),
+		Size:   int64(len(data)),
+	}
+
+	dest := filepath.Join(dir, rel)
+	if existing, rerr := os.ReadFile(dest); rerr == nil && bytes.Equal(existing, data) {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0o755)
+	if err != nil {
+		return
+	}
+
+	return f, os.WriteFile(dest, data, 0o644)
+}
+
+// publishLocalized copies localized files to dir/<pkg>/<locale>/<subdir>/ and returns their index entries
+func publishLocalized(paths Localized, dir, pkg, subdir string) (files map[string]FileV2, err error) {
+	for locale, src := range paths {
+		f, perr := publishFile(src, dir, filepath.Join(pkg, locale, subdir, filepath.Base(src)))
+		if perr != nil {
+			return nil, perr
+		}
+		if files == nil {
+			files = make(map[string]FileV2)
+		}
+		files[locale] = f
+	}
+	return
+}
+
+func generateRepo(dir, metadataDir string, info repoInfo, createStubs bool, now time.Time, key *sign.Key) (err error) {
+	apks, err := scanAPKs(dir)
+	if err != nil {
+		return fmt.Errorf("reading APKs in %q: %w", dir, err)
+	}
+
+	previous := readPreviousTimes(dir)
+	nowMillis := millis(now)
+
+	// map[packageName]apks
+	var packages = make(map[string][]apkFile)
+	for _, a := range apks {
+		a.Added = previous.added(a, nowMillis)
+		packages[a.Manifest.Package] = append(packages[a.Manifest.Package], a)
+	}
+
+	v2 := IndexV2{
+		Repo:     repoV2(dir, info, nowMillis),
+		Packages: make(map[string]PackageV2),
+	}
+	v1 := IndexV1{
+		Repo: RepoV1{
+			Timestamp:   nowMillis,
+			Version:     IndexV2Version,
+			Name:        info.Name,
+			Icon:        info.Icon,
+			Address:     info.Address,
+			Description: info.Description,
+			Mirrors:     info.Mirrors,
+		},
+		Requests: RequestsV1{Install: []string{}, Uninstall: []string{}},
+		Apps:     []AppV1{},
+		Packages: make(map[string][]PackageV1),
+	}
+
+	var pkgNames []string
+	for pkgName := range packages {
+		pkgNames = append(pkgNames, pkgName)
+	}
+	sort.Strings(pkgNames)
+
+	for _, pkgName := range pkgNames {
+		pkgAPKs := packages[pkgName]
+
+		// Newest first, like fdroidserver lists them
+		sort.Slice(pkgAPKs, func(i, j int) bool {
+			if pkgAPKs[i].Manifest.VersionCode != pkgAPKs[j].Manifest.VersionCode {
+				return pkgAPKs[i].Manifest.VersionCode > pkgAPKs[j].Manifest.VersionCode
+			}
+			return pkgAPKs[i].Name < pkgAPKs[j].Name
+		})
+
+		if _, serr := os.Stat(filepath.Join(metadataDir, pkgName+".yml")); errors.Is(serr, os.ErrNotExist) {
+			if !createStubs {
+				slog.Info("Skipping package without metadata", "package", pkgName, "dir", dir)
+				continue
+			}
+
+			err = writeStub(metadataDir, pkgAPKs[0])
+			if err != nil {
+				return fmt.Errorf("creating metadata stub for %s: %w", pkgName, err)
+			}
+		}
+
+		meta, merr := readMetadata(metadataDir, pkgName)
+		if merr != nil {
+			return fmt.Errorf("reading metadata of %s: %w", pkgName, merr)
+		}
+
+		pkg, app, perr := buildPackage(dir, meta, pkgAPKs, previous.packages[pkgName])
+		if perr != nil {
+			return fmt.Errorf("building index entry of %s: %w", pkgName, perr)
+		}
+
+		v2.Packages[pkgName] = pkg
+		v1.Apps = append(v1.Apps, app)
+		for _, a := range pkgAPKs {
+			v1.Packages[pkgName] = append(v1.Packages[pkgName], packageV1(a, meta.antiFeatures(a.Manifest.VersionCode)))
+		}
+
+		for _, c := range meta.Categories {
+			v2.Repo.Categories[c] = NamedV2{Name: Localized{defaultLocale: c}}
+		}
+		for _, af := range meta.AntiFeatureList {
+			v2.Repo.AntiFeatures[af] = NamedV2{Name: Localized{defaultLocale: af}}
+		}
+		for _, v := range pkg.Versions {
+			for af := range v.AntiFeatures {
+				v2.Repo.AntiFeatures[af] = NamedV2{Name: Localized{defaultLocale: af}}
+			}
+			for _, ch := range v.ReleaseChannels {
+				v2.Repo.Channels[ch] = NamedV2{Name: Localized{defaultLocale: ch}}
+			}
+		}
+	}
+
+	data, err := writeJSON(filepath.Join(dir, "index-v2.json"), v2)
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	_, err = writeJSON(filepath.Join(dir, "entry.json"), EntryV2{
+		Timestamp: nowMillis,
+		Version:   IndexV2Version,
+		Index: EntryFileV2{
+			FileV2: FileV2{
+				Name:   "/index-v2.json",
+				SHA256: hex.EncodeToString(sum[:]),
+				Size:   int64(len(data)),
+			},
+			NumPackages: len(v2.Packages),
+		},
+		Diffs: map[string]int{},
+	})
+	if err != nil {
+		return
+	}
+
+	_, err = writeJSON(filepath.Join(dir, "index-v1.json"), v1)
+	if err != nil {
+		return
+	}
+
+	slog.Info("Wrote indexes", "packages", len(v2.Packages), "apks", len(apks), "dir", dir)
+
+	if key == nil {
+		return
+	}
+
+	for _, name := range []string{"entry.json", "index-v1.json"} {
+		jarPath, serr := sign.WriteJAR(filepath.Join(dir, name), key)
+		if serr != nil {
+			return fmt.Errorf("signing %s: %w", name, serr)
+		}
+		slog.Info("Signed index", "path", jarPath)
+	}
+
+	return
+}
+
+func repoV2(dir string, info repoInfo, timestamp int64) (r RepoV2) {
+	r = RepoV2{
+		Name:         Localized{},
+		Address:      info.Address,
+		Timestamp:    timestamp,
+		AntiFeatures: make(map[string]NamedV2),
+		Categories:   make(map[string]NamedV2),
+		Channels:     make(map[string]NamedV2),
+	}
+
+	setLocalized(r.Name, defaultLocale, info.Name)
+	if info.Description != "" {
+		r.Description = Localized{defaultLocale: info.Description}
+	}
+
+	for _, m := range info.Mirrors {
+		r.Mirrors = append(r.Mirrors, MirrorV2{URL: m})
+	}
+
+	if info.Icon != "" {
+		iconPath := filepath.Join(dir, "icons", info.Icon)
+		if f, err := os.Open(iconPath); err == nil {
+			h := sha256.New()
+			n, cerr := io.Copy(h, f)
+			f.Close()
+			if cerr == nil {
+				r.Icon = map[string]FileV2{defaultLocale: {
+					Name:   "/icons/" + info.Icon,
+					SHA256: hex.EncodeToString(h.Sum(nil)),
+					Size:   n,
+				}}
+			}
+		}
+	}
+
+	return
+}
+
+func buildPackage(dir string, meta appMetadata, apks []apkFile, added int64) (pkg PackageV2, app AppV1, err error) {
+	// The suggested version is the one set in the metadata, or the newest one
+	suggested := apks[0]
+	for _, a := range apks {
+		if meta.CurrentVersionCode > 0 && a.Manifest.VersionCode <= meta.CurrentVersionCode {
+			suggested = a
+			break
+		}
+	}
+
+	var lastUpdated int64
+	for _, a := range apks {
+		if a.Added > lastUpdated {
+			lastUpdated = a.Added
+		}
+		if added == 0 || a.Added < added {
+			added = a.Added
+		}
+	}
+
+	pkg.Metadata = MetadataV2{
+		Added:       added,
+		LastUpdated: lastUpdated,
+		Name:        meta.Names,
+		Summary:     meta.Summaries,
+		Description: meta.Descriptions,
+
+		Categories:   meta.Categories,
+		AuthorName:   meta.AuthorName,
+		AuthorEmail:  meta.AuthorEmail,
+		WebSite:      meta.WebSite,
+		SourceCode:   meta.SourceCode,
+		IssueTracker: meta.IssueTracker,
+		Changelog:    meta.Changelog,
+		Bitcoin:      meta.Bitcoin,
+		License:      meta.License,
+
+		PreferredSigner: suggested.Signer,
+	}
+	if meta.Donate != "" {
+		pkg.Metadata.Donate = []string{meta.Donate}
+	}
+
+	app = AppV1{
+		PackageName:  meta.PackageName,
+		Name:         meta.Names[defaultLocale],
+		Summary:      meta.Summaries[defaultLocale],
+		Description:  meta.Descriptions[defaultLocale],
+		AuthorName:   meta.AuthorName,
+		AuthorEmail:  meta.AuthorEmail,
+		WebSite:      meta.WebSite,
+		SourceCode:   meta.SourceCode,
+		IssueTracker: meta.IssueTracker,
+		Changelog:    meta.Changelog,
+		Donate:       meta.Donate,
+		Bitcoin:      meta.Bitcoin,
+		License:      meta.License,
+		Categories:   meta.Categories,
+		AntiFeatures: meta.AntiFeatureList,
+
+		SuggestedVersionName: suggested.Manifest.VersionName,
+		SuggestedVersionCode: strconv.FormatInt(suggested.Manifest.VersionCode, 10),
+
+		Added:       added,
+		LastUpdated: lastUpdated,
+
+		Localized: make(map[string]LocalizedV1),
+	}
+
+	localizedV1 := func(locale string) LocalizedV1 {
+		return app.Localized[locale]
+	}
+
+	for locale, text := range meta.Names {
+		l := localizedV1(locale)
+		l.Name = text
+		app.Localized[locale] = l
+	}
+	for locale, text := range meta.Summaries {
+		l := localizedV1(locale)
+		l.Summary = text
+		app.Localized[locale] = l
+	}
+	for locale, text := range meta.Descriptions {
+		l := localizedV1(locale)
+		l.Description = text
+		app.Localized[locale] = l
+	}
+	for locale, text := range meta.WhatsNew[suggested.Manifest.VersionCode] {
+		l := localizedV1(locale)
+		l.WhatsNew = text
+		app.Localized[locale] = l
+	}
+
+	for _, kind := range imageKinds {
+		files, perr := publishLocalized(meta.Images[kind], dir, meta.PackageName, "")
+		if perr != nil {
+			return pkg, app, perr
+		}
+
+		for locale, f := range files {
+			l := localizedV1(locale)
+			name := filepath.Base(f.Name)
+			switch kind {
+			case "icon":
+				l.Icon = name
+			case "featureGraphic":
+				l.FeatureGraphic = name
+			case "promoGraphic":
+				l.PromoGraphic = name
+			case "tvBanner":
+				l.TVBanner = name
+			}
+			app.Localized[locale] = l
+		}
+
+		switch kind {
+		case "icon":
+			pkg.Metadata.Icon = files
+		case "featureGraphic":
+			pkg.Metadata.FeatureGraphic = files
+		case "promoGraphic":
+			pkg.Metadata.PromoGraphic = files
+		case "tvBanner":
+			pkg.Metadata.TVBanner = files
+		}
+	}
+
+	// Without an icon in the metadata, the launcher icon of the suggested APK is shown, like fdroidserver does
+	if len(meta.Images["icon"]) == 0 {
+		name, ierr := publishAPKIcon(dir, suggested)
+		if ierr == nil {
+			// The icon is in place already, publishFile only returns its index entry
+			iconPath := filepath.Join("icons", name)
+			f, perr := publishFile(filepath.Join(dir, iconPath), dir, iconPath)
+			if perr != nil {
+				return pkg, app, perr
+			}
+
+			app.Icon = name
+			pkg.Metadata.Icon = map[string]FileV2{defaultLocale: f}
+		} else {
+			slog.Warn("Could not extract icon from APK", "package", meta.PackageName, "apk", suggested.Name, "error", ierr)
+		}
+	}
+
+	for _, sk := range screenshotKinds {
+		for locale, paths := range meta.Screenshots[sk.Dir] {
+			var names []string
+			for _, src := range paths {
+				f, perr := publishFile(src, dir, filepath.Join(meta.PackageName, locale, sk.Dir, filepath.Base(src)))
+				if perr != nil {
+					return pkg, app, perr
+				}
+
+				if pkg.Metadata.Screenshots == nil {
+					pkg.Metadata.Screenshots = make(map[string]map[string][]FileV2)
+				}
+				if pkg.Metadata.Screenshots[sk.Kind] == nil {
+					pkg.Metadata.Screenshots[sk.Kind] = make(map[string][]FileV2)
+				}
+				pkg.Metadata.Screenshots[sk.Kind][locale] = append(pkg.Metadata.Screenshots[sk.Kind][locale], f)
+				names = append(names, filepath.Base(src))
+			}
+
+			l := localizedV1(locale)
+			switch sk.Dir {
+			case "phoneScreenshots":
+				l.PhoneScreenshots = names
+			case "sevenInchScreenshots":
+				l.SevenInch = names
+			case "tenInchScreenshots":
+				l.TenInch = names
+			case "tvScreenshots":
+				l.TVScreenshots = names
+			case "wearScreenshots":
+				l.WearScreenshots = names
+			}
+			app.Localized[locale] = l
+		}
+	}
+
+	pkg.Versions = make(map[string]VersionV2, len(apks))
+	for _, a := range apks {
+		v := VersionV2{
+			Added: a.Added,
+			File: FileV2{
+				Name:   "/" + a.Name,
+				SHA256: a.SHA256,
+				Size:   a.Size,
+			},
+			Manifest: ManifestV2{
+				VersionName: a.Manifest.VersionName,
+				VersionCode: a.Manifest.VersionCode,
+				UsesSDK: UsesSDKV2{
+					MinSDKVersion:    a.Manifest.MinSdkVersion,
+					TargetSDKVersion: a.Manifest.TargetSdkVersion,
+				},
+				Signer:     SignerV2{SHA256: []string{a.Signer}},
+				NativeCode: a.NativeCode,
+			},
+			WhatsNew: meta.WhatsNew[a.Manifest.VersionCode],
+		}
+
+		for _, p := range a.Manifest.Permissions {
+			v.Manifest.UsesPermission = append(v.Manifest.UsesPermission, PermissionV2{Name: p})
+		}
+
+		if a.OBBMain != nil {
+			v.OBBMainFile = &FileV2{Name: "/" + a.OBBMain.Name, SHA256: a.OBBMain.SHA256, Size: a.OBBMain.Size}
+		}
+		if a.OBBPatch != nil {
+			v.OBBPatchFile = &FileV2{Name: "/" + a.OBBPatch.Name, SHA256: a.OBBPatch.SHA256, Size: a.OBBPatch.Size}
+		}
+
+		// Versions newer than the suggested one are only offered to users who opted into beta versions
+		if a.Manifest.VersionCode > suggested.Manifest.VersionCode {
+			v.ReleaseChannels = []string{betaChannel}
+		}
+
+		if afs := meta.antiFeatures(a.Manifest.VersionCode); len(afs) > 0 {
+			v.AntiFeatures = make(map[string]Localized)
+			for _, af := range afs {
+				v.AntiFeatures[af] = Localized{}
+			}
+		}
+
+		pkg.Versions[a.SHA256] = v
+	}
+
+	return
+}
+
+func packageV1(a apkFile, antiFeatures []string) (p PackageV1) {
+	p = PackageV1{
+		Added:            a.Added,
+		AntiFeatures:     antiFeatures,
+		ApkName:          a.Name,
+		Hash:             a.SHA256,
+		HashType:         "sha256",
+		MinSdkVersion:    a.Manifest.MinSdkVersion,
+		Nativecode:       a.NativeCode,
+		PackageName:      a.Manifest.Package,
+		Sig:              a.Sig,
+		Signer:           a.Signer,
+		Size:             a.Size,
+		TargetSdkVersion: a.Manifest.TargetSdkVersion,
+		VersionCode:      a.Manifest.VersionCode,
+		VersionName:      a.Manifest.VersionName,
+	}
+
+	for _, perm := range a.Manifest.Permissions {
+		p.UsesPermission = append(p.UsesPermission, [2]interface{}{perm, nil})
+	}
+
+	if a.OBBMain != nil {
+		p.ObbMainFile, p.ObbMainSHA256 = a.OBBMain.Name, a.OBBMain.SHA256
+	}
+	if a.OBBPatch != nil {
+		p.ObbPatchFile, p.ObbPatchSHA256 = a.OBBPatch.Name, a.OBBPatch.SHA256
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/golden")
+
+// copyDir copies the files in src to dst
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGenerateGolden generates the indexes of testdata/fdroid, a repo with two versions of an app whose metadata is
+// localized in en-US and de-DE, and compares them to testdata/golden. Run with -update after intended changes of
+// the index format.
+func TestGenerateGolden(t *testing.T) {
+	dir := t.TempDir()
+	copyDir(t, filepath.Join("testdata", "fdroid"), dir)
+
+	err := Generate(Options{Dir: dir, Now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string][]byte)
+	for _, name := range []string{"index-v1.json", "index-v2.json", "entry.json"} {
+		got[name], err = os.ReadFile(filepath.Join(dir, "repo", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		golden := filepath.Join("testdata", "golden", name)
+		if *update {
+			err = os.MkdirAll(filepath.Dir(golden), 0o755)
+			if err == nil {
+				err = os.WriteFile(golden, got[name], 0o644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[name], want) {
+			t.Errorf("%s differs from %s, run the tests with -update if that's intended:\n%s", name, golden, got[name])
+		}
+	}
+
+	// entry.json points to index-v2.json by its digest, which clients check before using it
+	var entry EntryV2
+	err = readJSON(filepath.Join(dir, "repo", "entry.json"), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(got["index-v2.json"])
+	if entry.Index.SHA256 != hex.EncodeToString(sum[:]) || entry.Index.Size != int64(len(got["index-v2.json"])) {
+		t.Errorf("entry.json has index %+v, but index-v2.json has SHA-256 %x and %d bytes", entry.Index, sum, len(got["index-v2.json"]))
+	}
+
+	// The files index-v2 lists are published with the digests it has for them
+	var v2 IndexV2
+	err = readJSON(filepath.Join(dir, "repo", "index-v2.json"), &v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkg := v2.Packages["com.example.notes"]
+	files := []FileV2{pkg.Metadata.Icon[defaultLocale]}
+	files = append(files, pkg.Metadata.Screenshots["phone"][defaultLocale]...)
+	for _, v := range pkg.Versions {
+		files = append(files, v.File)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, "repo", filepath.FromSlash(f.Name)))
+		if err != nil {
+			t.Errorf("%s is in the index but wasn't published: %v", f.Name, err)
+			continue
+		}
+		if sum := sha256.Sum256(data); f.SHA256 != hex.EncodeToString(sum[:]) || f.Size != int64(len(data)) {
+			t.Errorf("index-v2.json lists %s with SHA-256 %s and %d bytes, the published file has %x and %d bytes", f.Name, f.SHA256, f.Size, sum, len(data))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/images"
+)
+
+// iconDensities are the screen densities clients look for app icons in, in icons-<density>/. The icons/ directory
+// is the fallback for all other densities and gets the largest icon.
+var iconDensities = []int{120, 160, 240, 320, 480, 640}
+
+// iconWidth returns the size in pixels of launcher icons at density, they are 48dp
+func iconWidth(density int) int {
+	return 48 * density / 160
+}
+
+// publishAPKIcon extracts the launcher icon of the APK and writes it to the icon directories of dir at all
+// densities. name is the file name of the icon in these directories. It contains the versionCode, so icons that
+// were written before are kept as they are.
+func publishAPKIcon(dir string, a apkFile) (name string, err error) {
+	name = fmt.Sprintf("%s.%d.png", a.Manifest.Package, a.Manifest.VersionCode)
+
+	// icons/ is written last, so its icon tells that all others exist
+	fallback := filepath.Join(dir, "icons", name)
+	if _, serr := os.Stat(fallback); serr == nil {
+		return
+	}
+
+	icon, err := apk.ExtractIcon(filepath.Join(dir, a.Name))
+	if err != nil {
+		return
+	}
+
+	type target struct {
+		path  string
+		width int
+	}
+	var targets []target
+	for _, d := range iconDensities {
+		targets = append(targets, target{filepath.Join(dir, fmt.Sprintf("icons-%d", d), name), iconWidth(d)})
+	}
+	targets = append(targets, target{fallback, iconWidth(iconDensities[len(iconDensities)-1])})
+
+	for _, t := range targets {
+		var buf bytes.Buffer
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, images.Scale(icon, t.width, t.width))
+		if err != nil {
+			return
+		}
+
+		err = os.MkdirAll(filepath.Dir(t.path), 0o755)
+		if err != nil {
+			return
+		}
+		err = os.WriteFile(t.path, buf.Bytes(), 0o644)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
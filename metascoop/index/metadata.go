@@ -0,0 +1,282 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultLocale = "en-US"
+
+// Localized maps locales to texts, e.g. "en-US" to an app summary
+type Localized map[string]string
+
+// metadataFile is the part of metadata/<package>.yml the index needs
+type metadataFile struct {
+	Name         string      `yaml:"Name"`
+	Summary      string      `yaml:"Summary"`
+	Description  string      `yaml:"Description"`
+	AuthorName   string      `yaml:"AuthorName"`
+	AuthorEmail  string      `yaml:"AuthorEmail"`
+	WebSite      string      `yaml:"WebSite"`
+	SourceCode   string      `yaml:"SourceCode"`
+	IssueTracker string      `yaml:"IssueTracker"`
+	Changelog    string      `yaml:"Changelog"`
+	Donate       string      `yaml:"Donate"`
+	Bitcoin      string      `yaml:"Bitcoin"`
+	License      string      `yaml:"License"`
+	Categories   []string    `yaml:"Categories"`
+	AntiFeatures interface{} `yaml:"AntiFeatures"`
+
+	CurrentVersion     string `yaml:"CurrentVersion"`
+	CurrentVersionCode int64  `yaml:"CurrentVersionCode"`
+
+	Builds []buildEntry `yaml:"Builds"`
+}
+
+// buildEntry is the part of a build in the Builds list the index needs. Binary repos only use it for
+// anti-features that differ between versions.
+type buildEntry struct {
+	VersionCode  int64       `yaml:"versionCode"`
+	AntiFeatures interface{} `yaml:"antifeatures"`
+}
+
+// appMetadata is the metadata of one package, combined from its metadata file and localized files
+type appMetadata struct {
+	metadataFile
+
+	PackageName string
+
+	// AntiFeatureList is the normalized AntiFeatures field
+	AntiFeatureList []string
+
+	// VersionAntiFeatures maps version codes to the anti-features of their builds
+	VersionAntiFeatures map[int64][]string
+
+	Names        Localized
+	Summaries    Localized
+	Descriptions Localized
+
+	// WhatsNew maps version codes to their localized changelogs
+	WhatsNew map[int64]Localized
+
+	// Images maps image kinds like "icon" or "featureGraphic" to the paths of localized files
+	Images map[string]Localized
+
+	// Screenshots maps directory names like "phoneScreenshots" to the localized lists of screenshot paths
+	Screenshots map[string]map[string][]string
+}
+
+var (
+	// Text files that can contain localized metadata, in order of preference. This supports both the
+	// fdroidserver and fastlane names.
+	nameFiles        = []string{"name.txt", "title.txt"}
+	summaryFiles     = []string{"summary.txt", "short_description.txt"}
+	descriptionFiles = []string{"description.txt", "full_description.txt"}
+
+	imageKinds = []string{"icon", "featureGraphic", "promoGraphic", "tvBanner"}
+
+	screenshotKinds = []struct {
+		// Dir is the directory name in metadata/<package>/<locale>/, Kind the name used by index-v2
+		Dir  string
+		Kind string
+	}{
+		{"phoneScreenshots", "phone"},
+		{"sevenInchScreenshots", "sevenInch"},
+		{"tenInchScreenshots", "tenInch"},
+		{"tvScreenshots", "tv"},
+		{"wearScreenshots", "wear"},
+	}
+)
+
+// parseAntiFeatures accepts all formats fdroidserver supports: a comma separated string, a list or a map of names to reasons
+func parseAntiFeatures(v interface{}) (list []string) {
+	switch v := v.(type) {
+	case string:
+		for _, af := range strings.Split(v, ",") {
+			if af = strings.TrimSpace(af); af != "" {
+				list = append(list, af)
+			}
+		}
+	case []interface{}:
+		for _, af := range v {
+			list = append(list, fmt.Sprint(af))
+		}
+	case map[string]interface{}:
+		for af := range v {
+			list = append(list, af)
+		}
+	}
+
+	sort.Strings(list)
+	return
+}
+
+// antiFeatures returns the sorted anti-features of a version, which has those of the app and those of its build
+func (m appMetadata) antiFeatures(versionCode int64) (list []string) {
+	seen := make(map[string]bool)
+	for _, af := range append(append([]string{}, m.AntiFeatureList...), m.VersionAntiFeatures[versionCode]...) {
+		if !seen[af] {
+			seen[af] = true
+			list = append(list, af)
+		}
+	}
+
+	sort.Strings(list)
+	return
+}
+
+func readTextFile(dir string, names []string) string {
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return ""
+}
+
+// findImage returns the path of an image of the given kind in a locale directory, e.g. "icon" finds "icon.png"
+func findImage(localeDir, kind string) string {
+	for _, dir := range []string{localeDir, filepath.Join(localeDir, "images")} {
+		for _, ext := range []string{".png", ".jpg", ".jpeg", ".webp"} {
+			path := filepath.Join(dir, kind+ext)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+func findScreenshots(localeDir, dirName string) (paths []string) {
+	for _, dir := range []string{localeDir, filepath.Join(localeDir, "images")} {
+		entries, err := os.ReadDir(filepath.Join(dir, dirName))
+		if err != nil {
+			continue
+		}
+
+		for _, e := range entries {
+			switch strings.ToLower(filepath.Ext(e.Name())) {
+			case ".png", ".jpg", ".jpeg", ".webp":
+				paths = append(paths, filepath.Join(dir, dirName, e.Name()))
+			}
+		}
+		if len(paths) > 0 {
+			break
+		}
+	}
+
+	// Screenshots are commonly numbered, so "10.png" should come after "9.png"
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := strings.TrimSuffix(filepath.Base(paths[i]), filepath.Ext(paths[i])), strings.TrimSuffix(filepath.Base(paths[j]), filepath.Ext(paths[j]))
+		na, aerr := strconv.Atoi(a)
+		nb, berr := strconv.Atoi(b)
+		if aerr == nil && berr == nil {
+			return na < nb
+		}
+		return paths[i] < paths[j]
+	})
+
+	return
+}
+
+// readMetadata reads metadata/<pkg>.yml and the localized files in metadata/<pkg>/<locale>/
+func readMetadata(metadataDir, pkg string) (m appMetadata, err error) {
+	m.PackageName = pkg
+
+	f, err := os.Open(filepath.Join(metadataDir, pkg+".yml"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = yaml.NewDecoder(f).Decode(&m.metadataFile)
+	if err != nil {
+		return m, fmt.Errorf("parsing metadata of %s: %w", pkg, err)
+	}
+
+	m.AntiFeatureList = parseAntiFeatures(m.AntiFeatures)
+
+	m.VersionAntiFeatures = make(map[int64][]string)
+	for _, b := range m.Builds {
+		if afs := parseAntiFeatures(b.AntiFeatures); len(afs) > 0 {
+			m.VersionAntiFeatures[b.VersionCode] = afs
+		}
+	}
+
+	m.Names = make(Localized)
+	m.Summaries = make(Localized)
+	m.Descriptions = make(Localized)
+	m.WhatsNew = make(map[int64]Localized)
+	m.Images = make(map[string]Localized)
+	m.Screenshots = make(map[string]map[string][]string)
+
+	locales, err := os.ReadDir(filepath.Join(metadataDir, pkg))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	err = nil
+
+	for _, l := range locales {
+		if !l.IsDir() {
+			continue
+		}
+		locale := l.Name()
+		localeDir := filepath.Join(metadataDir, pkg, locale)
+
+		setLocalized(m.Names, locale, readTextFile(localeDir, nameFiles))
+		setLocalized(m.Summaries, locale, readTextFile(localeDir, summaryFiles))
+		setLocalized(m.Descriptions, locale, readTextFile(localeDir, descriptionFiles))
+
+		changelogs, _ := os.ReadDir(filepath.Join(localeDir, "changelogs"))
+		for _, c := range changelogs {
+			vc, perr := strconv.ParseInt(strings.TrimSuffix(c.Name(), ".txt"), 10, 64)
+			if perr != nil || !strings.HasSuffix(c.Name(), ".txt") {
+				continue
+			}
+			if m.WhatsNew[vc] == nil {
+				m.WhatsNew[vc] = make(Localized)
+			}
+			setLocalized(m.WhatsNew[vc], locale, readTextFile(filepath.Join(localeDir, "changelogs"), []string{c.Name()}))
+		}
+
+		for _, kind := range imageKinds {
+			if path := findImage(localeDir, kind); path != "" {
+				if m.Images[kind] == nil {
+					m.Images[kind] = make(Localized)
+				}
+				m.Images[kind][locale] = path
+			}
+		}
+
+		for _, sk := range screenshotKinds {
+			if paths := findScreenshots(localeDir, sk.Dir); len(paths) > 0 {
+				if m.Screenshots[sk.Dir] == nil {
+					m.Screenshots[sk.Dir] = make(map[string][]string)
+				}
+				m.Screenshots[sk.Dir][locale] = paths
+			}
+		}
+	}
+
+	// The fields of the metadata file are the default locale and take precedence over localized files,
+	// as that's where metascoop writes what's configured in apps.yaml
+	setLocalized(m.Names, defaultLocale, m.Name)
+	setLocalized(m.Summaries, defaultLocale, m.Summary)
+	setLocalized(m.Descriptions, defaultLocale, m.Description)
+
+	return
+}
+
+func setLocalized(l Localized, locale, text string) {
+	if text != "" {
+		l[locale] = text
+	}
+}
@@ -0,0 +1,93 @@
+package index
+
+// Types of the legacy index-v1.json. metascoop itself reads this file (see apps.ReadIndex), and older clients
+// still depend on it.
+
+type IndexV1 struct {
+	Repo     RepoV1                 `json:"repo"`
+	Requests RequestsV1             `json:"requests"`
+	Apps     []AppV1                `json:"apps"`
+	Packages map[string][]PackageV1 `json:"packages"`
+}
+
+type RepoV1 struct {
+	Timestamp   int64    `json:"timestamp"`
+	Version     int      `json:"version"`
+	Name        string   `json:"name"`
+	Icon        string   `json:"icon"`
+	Address     string   `json:"address"`
+	Description string   `json:"description"`
+	Mirrors     []string `json:"mirrors,omitempty"`
+}
+
+type RequestsV1 struct {
+	Install   []string `json:"install"`
+	Uninstall []string `json:"uninstall"`
+}
+
+type AppV1 struct {
+	PackageName string `json:"packageName"`
+
+	Name        string `json:"name,omitempty"`
+	Summary     string `json:"summary,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	AuthorName   string   `json:"authorName,omitempty"`
+	AuthorEmail  string   `json:"authorEmail,omitempty"`
+	WebSite      string   `json:"webSite,omitempty"`
+	SourceCode   string   `json:"sourceCode,omitempty"`
+	IssueTracker string   `json:"issueTracker,omitempty"`
+	Changelog    string   `json:"changelog,omitempty"`
+	Donate       string   `json:"donate,omitempty"`
+	Bitcoin      string   `json:"bitcoin,omitempty"`
+	License      string   `json:"license"`
+	Categories   []string `json:"categories,omitempty"`
+	AntiFeatures []string `json:"antiFeatures,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+
+	SuggestedVersionName string `json:"suggestedVersionName,omitempty"`
+	SuggestedVersionCode string `json:"suggestedVersionCode,omitempty"`
+
+	Added       int64 `json:"added"`
+	LastUpdated int64 `json:"lastUpdated"`
+
+	Localized map[string]LocalizedV1 `json:"localized,omitempty"`
+}
+
+type LocalizedV1 struct {
+	Name             string   `json:"name,omitempty"`
+	Summary          string   `json:"summary,omitempty"`
+	Description      string   `json:"description,omitempty"`
+	WhatsNew         string   `json:"whatsNew,omitempty"`
+	Icon             string   `json:"icon,omitempty"`
+	FeatureGraphic   string   `json:"featureGraphic,omitempty"`
+	PromoGraphic     string   `json:"promoGraphic,omitempty"`
+	TVBanner         string   `json:"tvBanner,omitempty"`
+	PhoneScreenshots []string `json:"phoneScreenshots,omitempty"`
+	SevenInch        []string `json:"sevenInchScreenshots,omitempty"`
+	TenInch          []string `json:"tenInchScreenshots,omitempty"`
+	TVScreenshots    []string `json:"tvScreenshots,omitempty"`
+	WearScreenshots  []string `json:"wearScreenshots,omitempty"`
+}
+
+type PackageV1 struct {
+	Added            int64            `json:"added"`
+	AntiFeatures     []string         `json:"antiFeatures,omitempty"`
+	ApkName          string           `json:"apkName"`
+	Hash             string           `json:"hash"`
+	HashType         string           `json:"hashType"`
+	MinSdkVersion    int              `json:"minSdkVersion"`
+	Nativecode       []string         `json:"nativecode,omitempty"`
+	ObbMainFile      string           `json:"obbMainFile,omitempty"`
+	ObbMainSHA256    string           `json:"obbMainFileSha256,omitempty"`
+	ObbPatchFile     string           `json:"obbPatchFile,omitempty"`
+	ObbPatchSHA256   string           `json:"obbPatchFileSha256,omitempty"`
+	PackageName      string           `json:"packageName"`
+	Sig              string           `json:"sig"`
+	Signer           string           `json:"signer"`
+	Size             int64            `json:"size"`
+	TargetSdkVersion int              `json:"targetSdkVersion"`
+	UsesPermission   [][2]interface{} `json:"uses-permission,omitempty"`
+	VersionCode      int64            `json:"versionCode"`
+	VersionName      string           `json:"versionName"`
+}
@@ -0,0 +1,115 @@
+package index
+
+// Types of index-v2.json and entry.json. The format isn't formally specified, these follow what
+// fdroidserver's index.py writes and F-Droid clients read.
+
+// IndexV2Version is the index format version written to entry.json
+const IndexV2Version = 20002
+
+type FileV2 struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+type EntryV2 struct {
+	Timestamp int64          `json:"timestamp"`
+	Version   int            `json:"version"`
+	Index     EntryFileV2    `json:"index"`
+	Diffs     map[string]int `json:"diffs"`
+}
+
+type EntryFileV2 struct {
+	FileV2
+	NumPackages int `json:"numPackages"`
+}
+
+type IndexV2 struct {
+	Repo     RepoV2               `json:"repo"`
+	Packages map[string]PackageV2 `json:"packages"`
+}
+
+type RepoV2 struct {
+	Name         Localized          `json:"name"`
+	Icon         map[string]FileV2  `json:"icon,omitempty"`
+	Address      string             `json:"address"`
+	Description  Localized          `json:"description,omitempty"`
+	Mirrors      []MirrorV2         `json:"mirrors,omitempty"`
+	Timestamp    int64              `json:"timestamp"`
+	AntiFeatures map[string]NamedV2 `json:"antiFeatures,omitempty"`
+	Categories   map[string]NamedV2 `json:"categories,omitempty"`
+	Channels     map[string]NamedV2 `json:"releaseChannels,omitempty"`
+}
+
+type MirrorV2 struct {
+	URL string `json:"url"`
+}
+
+type NamedV2 struct {
+	Name Localized `json:"name"`
+}
+
+type PackageV2 struct {
+	Metadata MetadataV2           `json:"metadata"`
+	Versions map[string]VersionV2 `json:"versions"`
+}
+
+type MetadataV2 struct {
+	Added       int64     `json:"added"`
+	LastUpdated int64     `json:"lastUpdated"`
+	Name        Localized `json:"name,omitempty"`
+	Summary     Localized `json:"summary,omitempty"`
+	Description Localized `json:"description,omitempty"`
+
+	Categories   []string `json:"categories,omitempty"`
+	AuthorName   string   `json:"authorName,omitempty"`
+	AuthorEmail  string   `json:"authorEmail,omitempty"`
+	WebSite      string   `json:"webSite,omitempty"`
+	SourceCode   string   `json:"sourceCode,omitempty"`
+	IssueTracker string   `json:"issueTracker,omitempty"`
+	Changelog    string   `json:"changelog,omitempty"`
+	Donate       []string `json:"donate,omitempty"`
+	Bitcoin      string   `json:"bitcoin,omitempty"`
+	License      string   `json:"license,omitempty"`
+
+	Icon           map[string]FileV2              `json:"icon,omitempty"`
+	FeatureGraphic map[string]FileV2              `json:"featureGraphic,omitempty"`
+	PromoGraphic   map[string]FileV2              `json:"promoGraphic,omitempty"`
+	TVBanner       map[string]FileV2              `json:"tvBanner,omitempty"`
+	Screenshots    map[string]map[string][]FileV2 `json:"screenshots,omitempty"`
+
+	PreferredSigner string `json:"preferredSigner,omitempty"`
+}
+
+type VersionV2 struct {
+	Added           int64                `json:"added"`
+	File            FileV2               `json:"file"`
+	Manifest        ManifestV2           `json:"manifest"`
+	OBBMainFile     *FileV2              `json:"obbMainFile,omitempty"`
+	OBBPatchFile    *FileV2              `json:"obbPatchFile,omitempty"`
+	ReleaseChannels []string             `json:"releaseChannels,omitempty"`
+	WhatsNew        Localized            `json:"whatsNew,omitempty"`
+	AntiFeatures    map[string]Localized `json:"antiFeatures,omitempty"`
+}
+
+type ManifestV2 struct {
+	VersionName    string         `json:"versionName"`
+	VersionCode    int64          `json:"versionCode"`
+	UsesSDK        UsesSDKV2      `json:"usesSdk"`
+	Signer         SignerV2       `json:"signer"`
+	UsesPermission []PermissionV2 `json:"usesPermission,omitempty"`
+	NativeCode     []string       `json:"nativecode,omitempty"`
+}
+
+type UsesSDKV2 struct {
+	MinSDKVersion    int `json:"minSdkVersion"`
+	TargetSDKVersion int `json:"targetSdkVersion"`
+}
+
+type SignerV2 struct {
+	SHA256 []string `json:"sha256"`
+}
+
+type PermissionV2 struct {
+	Name string `json:"name"`
+}
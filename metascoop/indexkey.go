@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// loadIndexKey loads the key for signing indexes. A PEM key from the environment takes precedence over the flags,
+// so CI systems don't have to write secrets to disk.
+func loadIndexKey(keystorePath, keyPath string) (key *scoop.Key, err error) {
+	if pemData := os.Getenv("METASCOOP_INDEX_KEY"); pemData != "" {
+		return scoop.LoadKeyPEM([]byte(pemData))
+	}
+
+	switch {
+	case keystorePath != "":
+		return scoop.LoadKeystore(keystorePath, os.Getenv("METASCOOP_KEYSTORE_PASSWORD"))
+	case keyPath != "":
+		data, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		return scoop.LoadKeyPEM(data)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,14 @@
+// Package appinfo gives the metascoop command the apps.yaml entries behind the apps of package scoop, which keeps
+// them out of its API so it doesn't depend on the apps package. Package scoop sets the functions when it's
+// initialized; they take and return any, as this package can't import scoop.
+package appinfo
+
+import "github.com/nymtech/fdroid/metascoop/apps"
+
+var (
+	// Of returns the entry of a scoop.App
+	Of func(app any) apps.AppInfo
+
+	// New returns the scoop.App of an entry
+	New func(info apps.AppInfo) any
+)
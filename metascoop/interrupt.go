@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/nymtech/fdroid/metascoop/file"
+	"github.com/nymtech/fdroid/metascoop/report"
+	"github.com/nymtech/fdroid/metascoop/workspace"
+)
+
+const (
+	interruptAbort  = "abort"
+	interruptCommit = "commit"
+)
+
+// interruption handles SIGINT and SIGTERM, e.g. when CI cancels the job: lookups, downloads and clones that are
+// running are cancelled. Until the downloads are done, the run has only added files to the repo directory, which
+// are taken back: all of them with interruptAbort, which then exits with code 1, and only those of the apps that
+// weren't fully processed with interruptCommit, which finishes the run for the others so they can be committed.
+// Later interruptions can't take anything back, the run ends with its steps failing.
+//
+// Its methods are safe for concurrent use.
+type interruption struct {
+	mode   string
+	ctx    context.Context
+	report *report.Report
+
+	lock sync.Mutex
+
+	// map[app name]functions that take back the changes to the repo directory, in the order they were made
+	undo map[string][]func() error
+
+	interrupted map[string]bool
+}
+
+// newInterruption starts listening for signals. The workspace is removed if a second signal exits the process.
+func newInterruption(mode string, ws *workspace.Workspace, r *report.Report) (i *interruption, err error) {
+	if mode != interruptAbort && mode != interruptCommit {
+		return nil, fmt.Errorf("unknown value %q, must be %q or %q", mode, interruptAbort, interruptCommit)
+	}
+
+	return &interruption{
+		mode:        mode,
+		ctx:         ws.CancelOnSignal(context.Background()),
+		report:      r,
+		undo:        make(map[string][]func() error),
+		interrupted: make(map[string]bool),
+	}, nil
+}
+
+// done reports whether the run was interrupted
+func (i *interruption) done() bool {
+	return i.ctx.Err() != nil
+}
+
+// finishContext is the context of the steps after the downloads. With interruptCommit they aren't cancelled, so
+// the apps that are committed get their metadata.
+func (i *interruption) finishContext() context.Context {
+	if i.mode == interruptCommit {
+		return context.Background()
+	}
+	return i.ctx
+}
+
+// skip records that app wasn't fully processed, its changes are taken back by rollback
+func (i *interruption) skip(app string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.interrupted[app] = true
+	i.report.SetInterrupted(app)
+}
+
+// skipped reports whether app wasn't fully processed
+func (i *interruption) skipped(app string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	return i.interrupted[app]
+}
+
+func (i *interruption) push(app string, undo func() error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	i.undo[app] = append(i.undo[app], undo)
+}
+
+// added records that the file at path was added to the repo directory for app
+func (i *interruption) added(app, path string) {
+	i.push(app, func() error {
+		return removeIfExists(path, path+attestationSuffix)
+	})
+}
+
+// downloading records that the APK at path is downloaded for app. Its partial download is removed on rollback,
+// so it isn't committed, and so is the APK unless it replaces one that was published before.
+func (i *interruption) downloading(app, path string, replaces bool) {
+	i.push(app, func() error {
+		if replaces {
+			return removeIfExists(path + ".part")
+		}
+		return removeIfExists(path+".part", path, path+attestationSuffix)
+	})
+}
+
+// restored records that the APK at path was moved back to the repo directory from archivedPath for app
+func (i *interruption) restored(app, path, archivedPath string) {
+	i.push(app, func() error {
+		err := file.Move(path, archivedPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(path + attestationSuffix); err == nil {
+			return file.Move(path+attestationSuffix, archivedPath+attestationSuffix)
+		}
+		return nil
+	})
+}
+
+// downloaded takes the download errors into account: with interruptCommit, apps whose downloads were cancelled
+// weren't fully processed
+func (i *interruption) downloaded(downloadErrors map[string][]error) {
+	for app, errs := range downloadErrors {
+		for _, err := range errs {
+			if errors.Is(err, context.Canceled) {
+				i.skip(app)
+				break
+			}
+		}
+	}
+}
+
+// rollback takes back the changes of the apps that weren't fully processed, of all apps with interruptAbort.
+// It does nothing if the run wasn't interrupted.
+func (i *interruption) rollback(addError func(app string, err error)) {
+	if !i.done() {
+		return
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	var names []string
+	for app := range i.undo {
+		if i.mode == interruptAbort || i.interrupted[app] {
+			names = append(names, app)
+		}
+	}
+	sort.Strings(names)
+
+	for _, app := range names {
+		slog.Warn("Taking back the changes of the app, the run was interrupted", "app", app, "changes", len(i.undo[app]))
+
+		undo := i.undo[app]
+		for j := len(undo) - 1; j >= 0; j-- {
+			err := undo[j]()
+			if err != nil {
+				addError(app, fmt.Errorf("taking back changes of the interrupted run: %w", err))
+			}
+		}
+		delete(i.undo, app)
+	}
+}
+
+func removeIfExists(paths ...string) error {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+const (
+	// licensePolicyBlock stops publishing new versions of apps whose upstream license changed from a FOSS license
+	// to another one, until the maintainer sets overrides.license in apps.yaml
+	licensePolicyBlock = "block"
+
+	// licensePolicyWarn only logs, reports and notifies such changes
+	licensePolicyWarn = "warn"
+)
+
+// fossLicenses are the SPDX identifiers of licenses that are approved by the OSI or the FSF and accepted by F-Droid
+var fossLicenses = map[string]bool{
+	"0BSD":               true,
+	"AFL-3.0":            true,
+	"AGPL-3.0":           true,
+	"AGPL-3.0+":          true,
+	"AGPL-3.0-only":      true,
+	"AGPL-3.0-or-later":  true,
+	"Apache-1.1":         true,
+	"Apache-2.0":         true,
+	"Artistic-2.0":       true,
+	"BSD-2-Clause":       true,
+	"BSD-3-Clause":       true,
+	"BSD-3-Clause-Clear": true,
+	"BSL-1.0":            true,
+	"CC0-1.0":            true,
+	"CECILL-2.1":         true,
+	"ECL-2.0":            true,
+	"EPL-1.0":            true,
+	"EPL-2.0":            true,
+	"EUPL-1.1":           true,
+	"EUPL-1.2":           true,
+	"GPL-2.0":            true,
+	"GPL-2.0+":           true,
+	"GPL-2.0-only":       true,
+	"GPL-2.0-or-later":   true,
+	"GPL-3.0":            true,
+	"GPL-3.0+":           true,
+	"GPL-3.0-only":       true,
+	"GPL-3.0-or-later":   true,
+	"ISC":                true,
+	"LGPL-2.1":           true,
+	"LGPL-2.1+":          true,
+	"LGPL-2.1-only":      true,
+	"LGPL-2.1-or-later":  true,
+	"LGPL-3.0":           true,
+	"LGPL-3.0+":          true,
+	"LGPL-3.0-only":      true,
+	"LGPL-3.0-or-later":  true,
+	"MIT":                true,
+	"MIT-0":              true,
+	"MPL-2.0":            true,
+	"MS-PL":              true,
+	"MulanPSL-2.0":       true,
+	"NCSA":               true,
+	"OFL-1.1":            true,
+	"OSL-3.0":            true,
+	"PostgreSQL":         true,
+	"Unlicense":          true,
+	"UPL-1.0":            true,
+	"WTFPL":              true,
+	"Zlib":               true,
+}
+
+// isFOSSLicense reports whether the SPDX license expression only allows using the software under FOSS licenses.
+// Identifiers the host couldn't determine, like GitHub's "NOASSERTION", aren't.
+func isFOSSLicense(expr string) bool {
+	expr = strings.NewReplacer("(", " ", ")", " ").Replace(expr)
+	if strings.TrimSpace(expr) == "" {
+		return false
+	}
+
+	// One of the alternatives is enough, but all licenses that are combined must be free
+	for _, alternative := range strings.Split(expr, " OR ") {
+		free := true
+		for _, part := range strings.Split(alternative, " AND ") {
+			id, _, _ := strings.Cut(strings.TrimSpace(part), " WITH ")
+			free = free && fossLicenses[strings.TrimSpace(id)]
+		}
+		if free {
+			return true
+		}
+	}
+	return false
+}
+
+// licenseCheck compares the license upstream repos declare with the one accepted in earlier runs
+type licenseCheck struct {
+	policy string
+	state  *runState
+	report *report.Report
+}
+
+func newLicenseCheck(policy string, state *runState, r *report.Report) (c *licenseCheck, err error) {
+	if policy != licensePolicyBlock && policy != licensePolicyWarn {
+		return nil, fmt.Errorf("unknown license policy %q, must be %q or %q", policy, licensePolicyBlock, licensePolicyWarn)
+	}
+	return &licenseCheck{policy: policy, state: state, report: r}, nil
+}
+
+// check records the upstream license of app and returns an error if it changed from a FOSS license to another
+// one and the policy blocks that. The remembered license stays the same while the change is blocked. Licenses of
+// apps with overrides.license are accepted as they are, the maintainer decided on them.
+func (c *licenseCheck) check(logger *slog.Logger, app apps.AppInfo, config, license string) (err error) {
+	if license == "" {
+		return
+	}
+
+	previous := c.state.license(app.Name())
+	if previous == "" || previous == license || app.Overrides.License != "" {
+		c.state.acceptLicense(app.Name(), config, license)
+		return
+	}
+
+	change := report.LicenseChange{
+		Previous: previous,
+		Current:  license,
+		NonFree:  isFOSSLicense(previous) && !isFOSSLicense(license),
+	}
+	change.Blocked = change.NonFree && c.policy == licensePolicyBlock
+	c.report.SetLicenseChange(app.Name(), change)
+
+	switch {
+	case change.Blocked:
+		logger.Error("Upstream license changed to one that isn't a known FOSS license, not publishing new versions", "previous", previous, "license", license)
+		return fmt.Errorf("upstream license changed from %q to %q, which isn't a known FOSS license; set overrides.license in apps.yaml to publish new versions anyway", previous, license)
+	case change.NonFree:
+		logger.Warn("Upstream license changed to one that isn't a known FOSS license", "previous", previous, "license", license)
+	default:
+		logger.Info("Upstream license changed", "previous", previous, "license", license)
+	}
+
+	c.state.acceptLicense(app.Name(), config, license)
+	return
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/notify"
+)
+
+// lint checks apps files and prints every problem with its line, so mistakes are found before an update
+// misbehaves. The names of notifiers and hooks the apps use are checked if their config files are given.
+func lint(args []string) {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	var (
+		notifyConfig = flags.String("notify-config", "", "Notification config the apps' notifiers must be in, see the update flag of the same name")
+		hooksConfig  = flags.String("hooks-config", "", "Hooks config the apps' hooks must be in, see the update flag of the same name")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s lint [flags] [apps file...]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Checks apps.yaml if no file is given. The exit code is 1 if there are problems.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"apps.yaml"}
+	}
+
+	var failed bool
+	for _, path := range paths {
+		list, problems, err := apps.Lint(path)
+		if err != nil {
+			fmt.Printf("%s: %s\n", path, err)
+			failed = true
+			continue
+		}
+		for _, p := range problems {
+			fmt.Printf("%s:%s\n", p.File, p)
+		}
+		failed = failed || len(problems) > 0
+
+		// The references are only checked for apps that are valid otherwise
+		if *notifyConfig != "" {
+			config, nerr := notify.LoadConfig(*notifyConfig)
+			if nerr == nil {
+				nerr = checkNotifiers(config, *notifyConfig, list)
+			}
+			if nerr != nil {
+				fmt.Printf("%s: %s\n", path, nerr)
+				failed = true
+			}
+		}
+		if *hooksConfig != "" {
+			if _, herr := newAppHooks(*hooksConfig, list); herr != nil {
+				fmt.Printf("%s: %s\n", path, herr)
+				failed = true
+			}
+		}
+
+		slog.Debug("Checked apps file", "path", path, "apps", len(list), "problems", len(problems))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	slog.Info("No problems found", "files", len(paths))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// defaultLocale is the locale texts of apps.yaml and the upstream repo are in
+const defaultLocale = "en-US"
+
+// localeFallback fills in the texts that are missing in partially translated fastlane locales, so clients that
+// use such a locale don't show an app without description. A locale falls back to the locales configured for it,
+// then to its language without region (de-AT to de) and finally to the default locale.
+type localeFallback struct {
+	disabled bool
+
+	// chains maps locales to the locales they fall back to first
+	chains map[string][]string
+}
+
+// newLocaleFallback parses the -locale-fallback flags, which are "off" or like "de-AT=de-DE,de"
+func newLocaleFallback(specs []string) (f *localeFallback, err error) {
+	f = &localeFallback{chains: make(map[string][]string)}
+
+	for _, spec := range specs {
+		if spec == "off" {
+			f.disabled = true
+			continue
+		}
+
+		locale, list, ok := strings.Cut(spec, "=")
+		locale = strings.TrimSpace(locale)
+		if !ok || locale == "" || strings.TrimSpace(list) == "" {
+			return nil, fmt.Errorf("invalid locale fallback %q, must be like \"de-AT=de-DE,de\" or \"off\"", spec)
+		}
+		for _, l := range strings.Split(list, ",") {
+			if l = strings.TrimSpace(l); l != "" && l != locale {
+				f.chains[locale] = append(f.chains[locale], l)
+			}
+		}
+	}
+	if f.disabled && len(f.chains) > 0 {
+		return nil, fmt.Errorf("locale fallbacks can't be configured if they are turned off")
+	}
+
+	return
+}
+
+// chain returns the locales locale falls back to, in order
+func (f *localeFallback) chain(locale string) (chain []string) {
+	seen := map[string]bool{locale: true}
+	add := func(l string) {
+		if !seen[l] {
+			seen[l] = true
+			chain = append(chain, l)
+		}
+	}
+
+	for _, l := range f.chains[locale] {
+		add(l)
+	}
+	if language, _, ok := strings.Cut(locale, "-"); ok {
+		add(language)
+	}
+	add(defaultLocale)
+
+	return
+}
+
+// fill returns texts with the files that are missing in a locale taken from the first locale of its chain that
+// has them. Only locales that have some texts are filled. Files skip reports true for aren't filled in.
+func (f *localeFallback) fill(texts map[string]map[string]string, skip func(locale, name string) bool) (filled map[string]map[string]string, n int) {
+	if f.disabled {
+		return texts, 0
+	}
+
+	filled = make(map[string]map[string]string, len(texts))
+	for locale, files := range texts {
+		filled[locale] = make(map[string]string, len(apps.FastlaneTextFiles))
+		for name, path := range files {
+			filled[locale][name] = path
+		}
+
+		for _, name := range apps.FastlaneTextFiles {
+			if _, ok := files[name]; ok || skip(locale, name) {
+				continue
+			}
+			for _, l := range f.chain(locale) {
+				if skip(l, name) {
+					break
+				}
+				if path, ok := texts[l][name]; ok {
+					filled[locale][name] = path
+					n++
+					break
+				}
+			}
+		}
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+// Package lock provides advisory file locks, so processes that work on the same repo don't overlap. Locks are
+// released when they are released explicitly or their process exits, also if it crashes, so a stale lock file
+// doesn't block later runs.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrLocked is returned by Acquire if another process still holds the lock when the context is done
+var ErrLocked = errors.New("locked by another process")
+
+// PollInterval is how often Acquire tries to get a lock that is held by another process
+var PollInterval = time.Second
+
+// File is a held lock
+type File struct {
+	f    *os.File
+	path string
+}
+
+// TryAcquire gets the lock at path if no other process holds it. ok is false if one does. The file and its
+// directory are created if needed, and the file describes the holder for the messages of other processes.
+func TryAcquire(path string) (l *File, ok bool, err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return
+	}
+
+	f, ok, err := tryLock(path)
+	if err != nil || !ok {
+		return
+	}
+
+	host, _ := os.Hostname()
+	_ = f.Truncate(0)
+	_, _ = fmt.Fprintf(f, "pid %d on %s since %s\n", os.Getpid(), host, time.Now().UTC().Format(time.RFC3339))
+
+	return &File{f: f, path: path}, true, nil
+}
+
+// Acquire waits until it gets the lock at path, or ctx is done. The error wraps ErrLocked in the latter case.
+func Acquire(ctx context.Context, path string) (l *File, err error) {
+	for {
+		var ok bool
+		l, ok, err = TryAcquire(path)
+		if err != nil || ok {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %s", ErrLocked, Holder(path))
+		case <-time.After(PollInterval):
+		}
+	}
+}
+
+// Holder describes the process that holds or last held the lock at path
+func Holder(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return "unknown holder"
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Path returns the path of the lock file
+func (l *File) Path() string {
+	return l.path
+}
+
+// Release gives up the lock. The file stays, removing it would let two processes lock different files.
+func (l *File) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
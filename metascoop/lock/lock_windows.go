@@ -0,0 +1,31 @@
+//go:build windows
+// +build windows
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errSharingViolation is returned when another process has the file open without sharing write access
+const errSharingViolation syscall.Errno = 32
+
+// tryLock opens the file without sharing write access, which Windows enforces until the handle is closed
+func tryLock(path string) (f *os.File, ok bool, err error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return
+	}
+
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, syscall.FILE_SHARE_READ, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if errors.Is(err, errSharingViolation) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	return os.NewFile(uintptr(h), path), true, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// setupLogging makes a logger with the given level and format ("text" or "json") the default. The log
+// package writes through it too, at the info level.
+func setupLogging(level, format string) (err error) {
+	return setupLoggingTo(os.Stderr, level, format)
+}
+
+// setupLoggingTo is setupLogging with a logger that writes to w
+func setupLoggingTo(w io.Writer, level, format string) (err error) {
+	var l slog.Level
+	err = l.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log level %q, must be one of debug, info, warn or error", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, must be text or json", format)
+	}
+
+	slog.SetDefault(slog.New(&redactingHandler{next: h}))
+
+	return nil
+}
+
+// logSecrets are the values redactingHandler removes from log messages
+var logSecrets struct {
+	lock     sync.RWMutex
+	replacer *strings.Replacer
+	values   []string
+}
+
+// redactFromLog makes the log replace the secrets with "[redacted]", e.g. credentials that were read from the
+// environment. Very short values are ignored, they would garble every message.
+func redactFromLog(secrets ...string) {
+	logSecrets.lock.Lock()
+	defer logSecrets.lock.Unlock()
+
+	for _, secret := range secrets {
+		if len(secret) >= 4 {
+			logSecrets.values = append(logSecrets.values, secret, "[redacted]")
+		}
+	}
+	if len(logSecrets.values) > 0 {
+		logSecrets.replacer = strings.NewReplacer(logSecrets.values...)
+	}
+}
+
+func haveLogSecrets() bool {
+	logSecrets.lock.RLock()
+	defer logSecrets.lock.RUnlock()
+
+	return logSecrets.replacer != nil
+}
+
+func redactSecrets(s string) string {
+	logSecrets.lock.RLock()
+	defer logSecrets.lock.RUnlock()
+
+	if logSecrets.replacer == nil {
+		return s
+	}
+	return logSecrets.replacer.Replace(s)
+}
+
+// redactingHandler removes the secrets given to redactFromLog from the messages and attributes it passes on
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !haveLogSecrets() {
+		return h.next.Handle(ctx, r)
+	}
+
+	redacted := slog.NewRecord(r.Time, r.Level, redactSecrets(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr returns a with the secrets removed from its value. Values that aren't strings, like errors, are
+// formatted first if they contain a secret.
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactSecrets(v.String()))
+	case slog.KindAny:
+		if s := fmt.Sprint(v.Any()); redactSecrets(s) != s {
+			a.Value = slog.StringValue(redactSecrets(s))
+		}
+	case slog.KindGroup:
+		attrs := v.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	}
+	return a
+}
+
+// fatal logs msg at the error level and exits with code 1
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -5,378 +5,1408 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/google/go-github/v39/github"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/feed"
+	"github.com/nymtech/fdroid/metascoop/file"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/hooks"
+	"github.com/nymtech/fdroid/metascoop/httpcache"
+	"github.com/nymtech/fdroid/metascoop/images"
+	"github.com/nymtech/fdroid/metascoop/md"
+	"github.com/nymtech/fdroid/metascoop/metrics"
+	"github.com/nymtech/fdroid/metascoop/notes"
+	"github.com/nymtech/fdroid/metascoop/osv"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+	"github.com/nymtech/fdroid/metascoop/report"
+	"github.com/nymtech/fdroid/metascoop/retry"
+	"github.com/nymtech/fdroid/metascoop/site"
+	"github.com/nymtech/fdroid/metascoop/tools"
+	"github.com/nymtech/fdroid/metascoop/workspace"
 	"golang.org/x/oauth2"
-	"metascoop/apps"
-	"metascoop/file"
-	"metascoop/git"
-	"metascoop/md"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		serve(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "add" {
+		add(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "remove" {
+		remove(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyRepo(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "publish" {
+		publish(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "targets" {
+		updateTargets(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-published" {
+		checkPublished(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export-metadata" {
+		exportMetadata(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		importRepo(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lint" {
+		lint(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		diffIndexes(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "control" {
+		control(os.Args[2:])
+		return
+	}
+
+	var onlyApps, onlyPackages, localeFallbacks stringList
+	flag.Var(&localeFallbacks, "locale-fallback", "Locales a fastlane locale takes missing texts from, e.g. \"de-AT=de-DE,de\", can be given multiple times. Locales fall back to their language (de-AT to de) and then to en-US after these. \"off\" copies the texts of each locale as they are")
+	flag.Var(&onlyApps, "app", "Only update the apps.yaml entry with this name, can be given multiple times")
+	flag.Var(&onlyPackages, "only", "Only update the app publishing this package name, can be given multiple times. Other apps, their versions and metadata stay untouched")
+
+	githubAuth := addGitHubAuthFlags(flag.CommandLine)
+	httpConfig := addHTTPFlags(flag.CommandLine)
+
+	var maxRepoSize, maxAPKSize, imageBudget, maxDownloadBytes byteSize
+	var minReleaseAge duration
+	flag.Var(&minReleaseAge, "min-release-age", "How long ago releases must have been published before they are downloaded, e.g. \"24h\" or \"2d\", so upstream has time to pull broken builds. Can be overridden with min_release_age in apps.yaml. 0 publishes releases right away")
+	flag.Var(&maxAPKSize, "max-apk-size", "Maximum size of an APK, e.g. \"150M\". Larger assets are rejected unless max_apk_size in apps.yaml sets another limit for the app. 0 disables the limit")
+	flag.Var(&imageBudget, "image-budget", "Maximum bytes of images, like screenshots and feature graphics, that are fetched per run with -github-contents, e.g. \"50M\". Images that didn't change since the last run aren't fetched again either way; those beyond the budget keep their previous version until a later run fetches them. 0 disables the limit")
+	flag.Var(&maxDownloadBytes, "max-download-bytes", "Maximum bytes of APKs that are downloaded per run, e.g. \"2G\". Apps whose releases don't fit are deferred to the next run, which starts with the apps that were processed the longest ago. The first download always fits, so larger releases are downloaded eventually. 0 disables the limit")
+	flag.Var(&maxRepoSize, "max-repo-size", "Maximum size of the repo directory, e.g. \"900M\" to stay below the 1 GB limit of GitHub Pages. What happens if it's exceeded depends on -repo-size-policy. 0 disables the limit")
+
 	var (
 		appsFilePath = flag.String("ap", "apps.yaml", "Path to apps.yaml file")
 		repoDir      = flag.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory")
+		readmePath   = flag.String("readme", "", "README with the table of apps and the repo URL that is updated. Defaults to \"README.md\" two directories above the repo directory, \"-\" doesn't update a README")
+		channel      = flag.String("channel", "", "Override the channel of all apps: \""+apps.ChannelStable+"\", \""+apps.ChannelBeta+"\" or \""+apps.ChannelAll+"\", e.g. for a nightly repo next to a stable one. Empty uses the channels from apps.yaml")
+		updateMoved  = flag.Bool("update-moved-repos", false, "Replace the git URL of apps whose upstream repo was renamed or transferred with the new one in apps.yaml. Without it, moved repos are followed for the run and logged with a suggestion")
 		accessToken  = flag.String("pat", "", "GitHub personal access token")
-
-		debugMode = flag.Bool("debug", false, "Debug mode won't run the fdroid command")
+		gitLabToken  = flag.String("gitlab-token", "", "GitLab access token, used for gitlab.com and self-hosted instances")
+		giteaToken   = flag.String("gitea-token", "", "Gitea access token, used for Codeberg and self-hosted instances")
+		githubAPIURL = flag.String("github-api-url", "", "Base URL of the GitHub REST API the releases of github.com apps are looked up in, e.g. a GitHub Enterprise server that mirrors them or a stub server in tests. Empty uses "+defaultGitHubAPI)
+		useGraphQL   = flag.Bool("github-graphql", false, "Look up the releases of all GitHub apps with a few batched GraphQL queries instead of several REST requests per app. Requires -pat, apps it doesn't work for use REST")
+
+		httpCacheDir     = flag.String("http-cache", "", "Directory for cached GitHub API responses, which are revalidated with conditional requests that don't count against the rate limit. Keep it between runs, e.g. with actions/cache")
+		rateLimitReserve = flag.Int("rate-limit-reserve", 50, "Number of GitHub API requests that are kept in reserve. When only these are left, requests wait for the rate limit to reset")
+		maxRunDuration   = flag.Duration("max-run-duration", 0, "How long a run looks up apps, e.g. \"45m\". The apps that are left are deferred to the next run, which starts with the apps that were processed the longest ago. Downloads that were queued still finish. 0 disables the limit")
+		rateLimitMaxWait = flag.Duration("rate-limit-max-wait", 15*time.Minute, "Maximum time to wait for the GitHub API rate limit to reset. If it resets later, the remaining apps fail and are updated in a later run")
+
+		bundletool     = flag.String("bundletool", "bundletool", "Command that runs bundletool, e.g. \"java -jar bundletool.jar\". It builds universal APKs from the App Bundles of apps with bundles in apps.yaml")
+		bundleKeystore = flag.String("bundle-keystore", "", "Keystore the APKs built from App Bundles are signed with. The password is read from $METASCOOP_BUNDLE_KEYSTORE_PASSWORD")
+		bundleKeyAlias = flag.String("bundle-key-alias", "", "Alias of the key in -bundle-keystore, needed if it contains several keys")
+
+		downloadWorkers      = flag.Int("download-workers", 4, "Number of APKs that are downloaded concurrently")
+		attestationFormat    = flag.String("provenance", attestationJSON, "Format of the provenance record written next to each new APK as <apk>"+attestationSuffix+": \""+attestationJSON+"\", an unsigned in-toto statement with SLSA provenance (\""+attestationInToto+"\") or \""+attestationOff+"\"")
+		runID                = flag.String("run-id", "", "Identifier of the run in provenance records, defaults to the URL of the GitHub Actions run")
+		archiveReleases      = flag.Bool("archive-releases", false, "Archive what upstream said about the release of each new APK, its tag, commit and description, in \""+releaseArchiveDir+"/<apk>.json\" next to the repo directory. The history of the repo keeps it even if the release is edited later")
+		provenancePath       = flag.String("metadata-provenance", "", "File that stores the metadata fields as they were last written, so fields that were edited by hand since are kept. Defaults to \"metadata-provenance.json\" next to the repo directory")
+		allowDowngrade       = flag.Bool("allow-downgrade", false, "Accept APKs whose versionCode is already published by another APK, or that is lower than the highest published one although they belong to the newest release. Clients don't offer such versions as updates")
+		forceMetadata        = flag.Bool("force-metadata", false, "Overwrite metadata fields that were edited by hand with the values from apps.yaml and the upstream repo")
+		digestCachePath      = flag.String("digest-cache", "", "File that stores the digests of downloaded assets between runs, so unchanged assets are never downloaded twice. Defaults to \"digests.json\" next to the repo directory")
+		statePath            = flag.String("state", "", "File that remembers the processed releases, the assets that were rejected and the upstream commit the metadata of each app was taken from, so unchanged apps are processed without downloading anything. Defaults to \"state.json\" next to the repo directory")
+		downloadHostInterval = flag.Duration("download-host-interval", 250*time.Millisecond, "Minimum time between starting two downloads from the same host")
+		downloadTimeout      = flag.Duration("download-timeout", 5*time.Minute, "Maximum duration of a single download attempt. 0 disables the limit")
+
+		gitCacheDir    = flag.String("git-cache", "", "Directory for cached clones of upstream repos, kept between runs. A temporary directory is used if empty")
+		cloneWorkers   = flag.Int("clone-workers", 4, "Number of upstream repos that are cloned concurrently")
+		gitTimeout     = flag.Duration("git-timeout", 10*time.Minute, "Maximum duration of fetching a single upstream repo or checking it out, git is killed when it's reached. 0 disables the limit")
+		gitBackend     = flag.String("git-backend", git.BackendExec, "How upstream repos are fetched: \"exec\" runs the git binary, \"native\" only checks out the fastlane directory over HTTP without needing git")
+		githubContents = flag.Bool("github-contents", false, fmt.Sprintf("Fetch the fastlane directory of github.com repos file by file through the GitHub API instead of fetching the repo, which is much faster for repos with a long history. Directories with more than %d files or %d MB are fetched with -git-backend. Every file is an API request, so it should be used with -pat", git.ContentsMaxFiles, git.ContentsMaxBytes>>20))
+
+		reproducible     = flag.Bool("reproducible", false, "Rebuild the downloaded APKs of apps with a reproducible build recipe in apps.yaml from the source of their tag, and mark those with the same contents as verified in metadata/verified.json")
+		rebuildTimeout   = flag.Duration("rebuild-timeout", time.Hour, "Maximum duration of a single rebuild. 0 disables the limit")
+		containerRuntime = flag.String("container-runtime", "docker", "Command that runs the containers of reproducible build recipes with an image, e.g. \"podman\"")
+
+		metadataFromRelease = flag.Bool("metadata-from-release", false, "Take fastlane metadata from the tag of the suggested release instead of the default branch of every app. Can be enabled per app with metadata_from_release in apps.yaml")
+
+		maxRetries  = flag.Int("max-retries", 3, "Number of times failed network operations (API calls, downloads, clones) are retried")
+		retryBudget = flag.Int("retry-budget", 30, "Maximum number of retries per kind of network operation in one run")
+
+		apkNameTemplate = flag.String("apk-name", "", "Template for the file names of APKs in the repo, e.g. \"{package}_{versionCode}\". Variables are {app}, {tag}, {package}, {versionName}, {versionCode} and {abi}, one of {tag}, {versionName} and {versionCode} is required. Empty keeps the release file names <app>_<tag>.apk. Can be overridden with file_name in apps.yaml")
+
+		keepVersions   = flag.Int("keep-versions", 0, "Number of newest versions kept per app, older ones are removed from the repo and archive. 0 keeps all versions. Can be overridden with keep_versions in apps.yaml")
+		repoSizePolicy = flag.String("repo-size-policy", repoSizePolicyWarn, "What happens if the repo directory is larger than -max-repo-size: \"warn\" only logs it, \"archive\" moves the oldest versions of the largest apps to the archive until it fits, \"prune\" deletes them. The newest version of an app is always kept")
+		useArchive     = flag.Bool("archive", false, "Move versions that are older than the kept versions to the \"archive\" directory next to the repo instead of deleting them. Set archive_older in fdroid's config.yml higher than the number of kept versions, otherwise fdroid doesn't index the archive or archives versions on its own")
+
+		reportPath  = flag.String("report", "", "Write a JSON report about the run to this path")
+		metricsPath = flag.String("metrics-file", "", "Write Prometheus metrics about the run to this path, e.g. for the textfile collector of node_exporter")
+
+		commitMessagePath = flag.String("commit-message", "", "Write a commit message that lists the added and removed versions to this path, if the run changed the repo")
+		onInterrupt       = flag.String("on-interrupt", interruptAbort, "What happens when the run receives SIGINT or SIGTERM before its downloads are done: \"abort\" removes the downloaded APKs again and exits with code 1, \"commit\" only removes those of the apps that weren't fully processed and finishes the run for the others, so they are committed. A second signal exits right away")
+		changelogPath     = flag.String("changelog", "", "Add a section about added and removed versions to the top of this Markdown changelog, e.g. CHANGELOG.md in the root of the repo")
+
+		feedEntries = flag.Int("feed-entries", 50, "Number of newest versions listed in the Atom feed \""+feed.AtomFile+"\" in the repo directory. 0 disables the feed")
+		jsonFeed    = flag.Bool("json-feed", false, "Also write the feed as JSON Feed \""+feed.JSONFile+"\" next to the Atom feed")
+
+		generateSite  = flag.Bool("site", false, "Generate a website in the repo directory: index.html with all apps and the QR code of the repo, and <package>/index.html with screenshots, versions and changelogs of each app")
+		siteTemplates = flag.String("site-templates", "", "Directory with templates that replace the built-in ones of the website: \""+site.IndexTemplate+"\", \""+site.AppTemplate+"\" and \""+site.Stylesheet+"\". Missing files fall back to the built-in ones")
+
+		notifyConfig = flag.String("notify-config", "", "YAML file with the notifiers that are told about published versions and failing apps, see notify.Config")
+		hooksConfig  = flag.String("hooks-config", "", "YAML file with hooks, commands or Go plugins that are called before downloads, after downloads and before publishing APKs and can veto them, see hooks.Config")
+		notifyState  = flag.String("notify-state", "", "File that counts the consecutive failed runs of each app for notifications. Defaults to \"notify-state.json\" next to the repo directory")
+
+		imageMaxDimension = flag.Int("image-max-dimension", 2048, "Screenshots and graphics wider or higher than this many pixels are scaled down. 0 disables scaling")
+		imageMaxBytes     = flag.Int64("image-max-bytes", 2<<20, "Screenshots and graphics larger than this many bytes after scaling are skipped. 0 disables the limit")
+
+		releaseNotesFormat    = flag.String("release-notes-format", notes.FormatPlain, "How release notes and fastlane changelogs are written as \"what's new\" texts: \"plain\" converts Markdown and HTML to plain text, \"keep\" leaves them as they are")
+		releaseNotesMaxLength = flag.Int("release-notes-max-length", notes.MaxLength, "Maximum number of characters of \"what's new\" texts, longer ones are shortened at a line or word boundary. 0 disables the limit")
+
+		trackerPolicy     = flag.String("tracker-policy", apps.TrackerPolicyIgnore, "What happens to APKs that contain known trackers: \"ignore\" doesn't scan them, \"flag\" adds the Tracking anti-feature to their versions, \"block\" rejects them. Can be overridden with tracker_policy in apps.yaml")
+		trackerSignatures = flag.String("tracker-signatures", "", "JSON file with tracker signatures in the format of the Exodus Privacy API (https://reports.exodus-privacy.eu.org/api/trackers). A built-in list of common trackers is used if empty")
+		trackerCachePath  = flag.String("tracker-cache", "", "File that stores the trackers found in APKs, so they are only scanned once. Defaults to \"trackers.json\" next to the repo directory")
+
+		osvURL       = flag.String("osv-url", osv.DefaultURL, "OSV API the published versions of apps with osv in apps.yaml are looked up in for known vulnerabilities, which are part of the -report. Empty turns the lookups off")
+		osvKnownVuln = flag.Bool("osv-known-vuln", false, "Add the KnownVuln anti-feature to published versions the OSV database has advisories for")
+
+		minTargetSDK     = flag.Int("min-target-sdk", 0, "Lowest targetSdkVersion APKs must have, e.g. 30. Older builds are rejected unless min_target_sdk in apps.yaml exempts the app. 0 accepts all")
+		permissionPolicy = flag.String("permission-policy", permissionPolicyBlock, "What happens to new versions that request dangerous permissions (e.g. READ_SMS) the previous version didn't: \"block\" rejects them unless allowed_permissions in apps.yaml lists them, \"warn\" only logs them. Permission changes are part of the -report either way")
+		licensePolicy    = flag.String("license-policy", licensePolicyBlock, "What happens when the license an upstream repo declares changes from a FOSS license to one that isn't: \"block\" stops publishing new versions of the app until overrides.license is set in apps.yaml, \"warn\" only logs it. License changes are part of the -report and sent as \"license_changed\" notifications either way")
+
+		failOn        = flag.String("fail-on", failOnAny, "When errors of single apps fail the run (exit code 1, so nothing is committed): \"any\" for every error, \"none\" never, \"threshold\" if more apps failed than -fail-threshold allows")
+		failThreshold = flag.String("fail-threshold", "0", "Number of apps (\"3\") or percentage of all apps (\"25%\") that may fail with -fail-on=threshold")
+
+		indexKeystore = flag.String("index-keystore", "", "PKCS#12 keystore for signing the index with -indexer=native. The password is read from $METASCOOP_KEYSTORE_PASSWORD")
+		indexKey      = flag.String("index-key", "", "PEM file with a PKCS#8 private key and certificate for signing the index with -indexer=native. $METASCOOP_INDEX_KEY can contain the PEM data instead")
+		indexer       = flag.String("indexer", scoop.IndexerFdroid, "How the repo index is generated: \"fdroid\" runs \"fdroid update\", \"native\" generates index-v1 and index-v2 without needing fdroidserver")
+
+		debugMode    = flag.Bool("debug", false, "Debug mode won't run the fdroid command")
+		logLevel     = flag.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat    = flag.String("log-format", "text", "Format of log messages: \"text\" or \"json\". Messages about an app have \"app\" and \"package\" fields")
+		keepTemp     = flag.Bool("keep-temp", false, "Don't remove the temporary files of the run (checkouts, temporary git cache) at the end, their location is logged")
+		dryRun       = flag.Bool("dry-run", false, "Only discover releases and metadata changes and print a plan, without writing to the repo directory")
+		progressMode = flag.String("progress", progressAuto, "Show the progress of the run with a spinner per app, download bars and a summary table at the end: \"auto\" when stderr is a terminal and $CI isn't set, \"on\" or \"off\". Only warnings and errors are logged with it, unless -log-level is set")
+
+		lockDir     = flag.String("lock-dir", "", "Directory with the lock files that keep overlapping runs from writing the repo at the same time. Defaults to \".metascoop-lock\" next to the repo directory")
+		lockTimeout = flag.Duration("lock-timeout", time.Hour, "How long a run waits for another one to finish before it fails. 0 waits forever")
 	)
 	flag.Parse()
 
+	display, err := newProgressDisplay(*progressMode)
+	if err != nil {
+		fatal("Setting up progress display failed", "error", err)
+	}
+	if display != nil {
+		levelSet := false
+		flag.Visit(func(f *flag.Flag) {
+			levelSet = levelSet || f.Name == "log-level"
+		})
+		if !levelSet {
+			*logLevel = "warn"
+		}
+		err = setupLoggingTo(display, *logLevel, *logFormat)
+	} else {
+		err = setupLogging(*logLevel, *logFormat)
+	}
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	err = httpConfig.setup()
+	if err != nil {
+		fatal("Setting up HTTP clients failed", "error", err)
+	}
+
+	ws, err := workspace.New(*keepTemp)
+	if err != nil {
+		fatal("Creating directory for temporary files failed", "error", err)
+	}
+	// Exiting skips deferred functions, so this only runs on panics. finish and fatal clean up on their own.
+	defer ws.Cleanup()
+
+	fatal := func(msg string, args ...any) {
+		display.Stop()
+		ws.Cleanup()
+		fatal(msg, args...)
+	}
+
+	runReport := report.New()
+	runReport.Classify = errorType
+
+	stop, err := newInterruption(*onInterrupt, ws, runReport)
+	if err != nil {
+		fatal("Parsing -on-interrupt failed", "error", err)
+	}
+	ctx := stop.ctx
+
+	if *apkNameTemplate != "" {
+		err = apps.CheckFileNameTemplate(*apkNameTemplate)
+		if err != nil {
+			fatal("Parsing -apk-name failed", "error", err)
+		}
+	}
+
+	err = display.Start()
+	if err != nil {
+		fatal("Starting progress display failed", "error", err)
+	}
+
+	// rateLimits is set once the GitHub client is created
+	var rateLimits *rateLimitTransport
+
+	// notifier is set once the apps are known, if notifications are configured
+	var notifier *notifications
+
+	// finish writes the report and metrics (if requested) and exits with the given code
+	finish := func(code int) {
+		if stop.done() {
+			runReport.SetInterrupted("")
+		}
+		if rateLimits != nil {
+			rateLimits.LogBudget()
+			runReport.SetGitHubRateLimit(rateLimits.Remaining())
+		}
+		runReport.Finish()
+
+		if notifier != nil && !*dryRun {
+			notifier.send(runReport, code == 0)
+		}
+
+		if display != nil {
+			display.Stop()
+			printSummary(os.Stderr, runReport)
+		}
+
+		// Only exit code 0 results in a commit
+		if code == 0 && *commitMessagePath != "" {
+			err := os.WriteFile(*commitMessagePath, []byte(commitMessage(runReport)), 0o644)
+			if err != nil {
+				slog.Error("Writing commit message failed", "path", *commitMessagePath, "error", err)
+			}
+		}
+		if code == 0 && *changelogPath != "" {
+			err := updateChangelog(*changelogPath, runReport, time.Now())
+			if err != nil {
+				slog.Error("Updating changelog failed", "path", *changelogPath, "error", err)
+			}
+		}
+
+		if *reportPath != "" {
+			err := runReport.WriteFile(*reportPath)
+			if err != nil {
+				slog.Error("Writing report failed", "path", *reportPath, "error", err)
+			}
+		}
+		if *metricsPath != "" {
+			reg := metrics.NewRegistry()
+			recordRun(reg, runReport, code)
+
+			err := reg.WriteFile(*metricsPath)
+			if err != nil {
+				slog.Error("Writing metrics failed", "path", *metricsPath, "error", err)
+			}
+		}
+		ws.Cleanup()
+		os.Exit(code)
+	}
+
 	fmt.Println("::group::Initializing")
 
+	failurePolicy, err := parseFailPolicy(*failOn, *failThreshold)
+	if err != nil {
+		fatal("Parsing -fail-on failed", "error", err)
+	}
+
+	err = checkRepoSizePolicy(*repoSizePolicy)
+	if err != nil {
+		fatal("Parsing -repo-size-policy failed", "error", err)
+	}
+
+	notesOptions := notes.Options{Format: *releaseNotesFormat, MaxLength: *releaseNotesMaxLength}
+	if !notesOptions.Valid() {
+		fatal("Unknown release notes format", "format", *releaseNotesFormat)
+	}
+
+	if *indexer != scoop.IndexerFdroid && *indexer != scoop.IndexerNative {
+		fatal("Unknown indexer", "indexer", *indexer)
+	}
+
+	signingKey, err := loadIndexKey(*indexKeystore, *indexKey)
+	if err != nil {
+		fatal("Loading index signing key failed", "error", err)
+	}
+	if signingKey != nil {
+		if *indexer != scoop.IndexerNative {
+			fatal("Index signing keys can only be used with -indexer=" + scoop.IndexerNative + ", fdroidserver uses the keystore from its config.yml")
+		}
+		slog.Info("Signing the index", "certificate", signingKey.Fingerprint())
+	}
+
+	// Runners without fdroidserver, e.g. on Windows, still download releases and metadata. The index is left for a
+	// run that can sign it, generating an unsigned one natively would make clients reject the repo.
+	runIndexer := !*debugMode || *indexer == scoop.IndexerNative
+	if runIndexer && *indexer == scoop.IndexerFdroid {
+		if _, err := tools.Path("fdroid"); err != nil {
+			slog.Warn("Not updating the index, fdroidserver isn't installed. Use -indexer="+scoop.IndexerNative+" with a signing key on runners without it", "error", err)
+			runIndexer = false
+		}
+	}
+
+	err = checkChannel(*channel)
+	if err != nil {
+		fatal("Parsing -channel failed", "error", err)
+	}
+
 	appsList, err := apps.ParseAppFile(*appsFilePath)
 	if err != nil {
-		log.Fatalf("parsing given app file: %s\n", err.Error())
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
 	}
+	if *channel != "" {
+		for i := range appsList {
+			appsList[i].Channel = *channel
+		}
+	}
+
+	// Apps that aren't processed in this run still own the versions they published
+	allApps := appsList
 
-	var authenticatedClient *http.Client = nil
-	if *accessToken != "" {
-		ctx := context.Background()
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: *accessToken},
-		)
-		authenticatedClient = oauth2.NewClient(ctx, ts)
+	if *notifyConfig != "" {
+		if *notifyState == "" {
+			*notifyState = filepath.Join(filepath.Dir(*repoDir), "notify-state.json")
+		}
+		notifier, err = newNotifications(*notifyConfig, *notifyState, appsList)
+		if err != nil {
+			fatal("Setting up notifications failed", "error", err)
+		}
 	}
-	githubClient := github.NewClient(authenticatedClient)
 
-	var haveError bool
+	// runHooks is nil without hooks, which makes its methods do nothing
+	var runHooks *appHooks
+	if *hooksConfig != "" {
+		runHooks, err = newAppHooks(*hooksConfig, appsList)
+		if err != nil {
+			fatal("Setting up hooks failed", "error", err)
+		}
+	}
 
+	githubAPI, err := parseGitHubAPIURL(*githubAPIURL)
+	if err != nil {
+		fatal("Invalid GitHub API URL", "error", err)
+	}
+
+	githubTokens, err := githubAuth.tokenSource(*accessToken, *githubAPIURL)
+	if err != nil {
+		fatal("Setting up GitHub authentication failed", "error", err)
+	}
+
+	var githubTransport http.RoundTripper = http.DefaultTransport
+	if *httpCacheDir != "" {
+		githubTransport = &httpcache.Transport{
+			Dir:         *httpCacheDir,
+			Next:        githubTransport,
+			Cacheable:   githubAPICacheable(githubAPI),
+			Credentials: githubAuth.credentials,
+		}
+	}
+	if githubTokens != nil {
+		// The token is added before the cache sees the request, so it's part of the cache key
+		githubTransport = &oauth2.Transport{
+			Source: githubTokens,
+			Base:   githubTransport,
+		}
+	}
+	rateLimits = newRateLimitTransport(githubTransport, *rateLimitReserve, *rateLimitMaxWait)
+	newRetryPolicy := func(name string) retry.Policy {
+		return retry.Policy{
+			Name:       name,
+			MaxRetries: *maxRetries,
+			BaseDelay:  2 * time.Second,
+			MaxDelay:   time.Minute,
+			Budget:     retry.NewBudget(*retryBudget),
+		}
+	}
 	fdroidIndexFilePath := filepath.Join(*repoDir, "index-v1.json")
 
+	archiveDir := filepath.Join(filepath.Dir(*repoDir), "archive")
+
 	initialFdroidIndex, err := apps.ReadIndex(fdroidIndexFilePath)
 	if err != nil {
-		log.Fatalf("reading f-droid repo index: %s\n", err.Error())
+		fatal("Reading F-Droid repo index failed", "error", err)
 	}
 
-	err = os.MkdirAll(*repoDir, 0o644)
+	names, err := loadAPKNames(filepath.Dir(*repoDir))
 	if err != nil {
-		log.Fatalf("creating repo directory: %s\n", err.Error())
+		fatal("Reading APK names failed", "error", err)
 	}
 
-	fmt.Println("::endgroup::")
+	if len(onlyApps) > 0 || len(onlyPackages) > 0 {
+		byName, err := selectApps(appsList, onlyApps)
+		if err != nil {
+			fatal("Selecting apps failed", "error", err)
+		}
+		byPackage, err := selectPackages(appsList, onlyPackages, initialFdroidIndex, names)
+		if err != nil {
+			fatal("Selecting apps failed", "error", err)
+		}
 
-	// map[apkName]info
-	var apkInfoMap = make(map[string]apps.AppInfo)
+		appsList = uniqueApps(append(byName, byPackage...))
+
+		var selected []string
+		for _, app := range appsList {
+			selected = append(selected, app.Name())
+		}
+		slog.Info("Only updating some apps", "apps", strings.Join(selected, ", "))
+	}
 
-	for _, app := range appsList {
-		fmt.Printf("App: %s/%s\n", app.Author(), app.Name())
+	// Apps claimed by another run are left out, which must not look like they were removed from apps.yaml
+	partialRun := len(onlyApps) > 0 || len(onlyPackages) > 0
 
-		repo, err := apps.RepoInfo(app.GitURL)
+	var locks *runLocks
+	if !*dryRun {
+		if *lockDir == "" {
+			*lockDir = defaultLockDir(*repoDir)
+		}
+		locks, err = newRunLocks(*lockDir)
 		if err != nil {
-			log.Printf("Error while getting repo info from URL %q: %s", app.GitURL, err.Error())
-			haveError = true
-			return
+			fatal("Creating lock directory failed", "path", *lockDir, "error", err)
 		}
 
-		log.Printf("Looking up %s/%s on GitHub", repo.Author, repo.Name)
-		gitHubRepo, _, err := githubClient.Repositories.Get(context.Background(), repo.Author, repo.Name)
+		claimed, err := locks.claim(appsList)
 		if err != nil {
-			log.Printf("Error while looking up repo: %s", err.Error())
-		} else {
-			app.Summary = gitHubRepo.GetDescription()
+			fatal("Claiming apps failed", "error", err)
+		}
+		if len(claimed) == 0 {
+			slog.Info("Other runs are about to update all apps")
+			finish(2)
+		}
+		partialRun = partialRun || len(claimed) < len(appsList)
+		appsList = claimed
 
-			if gitHubRepo.License != nil && gitHubRepo.License.SPDXID != nil {
-				app.License = *gitHubRepo.License.SPDXID
-			}
+		// Released when the process exits
+		err = locks.lockRepo(*lockTimeout)
+		if err != nil {
+			fatal("Locking the repo failed", "error", err)
+		}
 
-			log.Printf("Data from GitHub: summary=%q, license=%q", app.Summary, app.License)
+		// The other run may have changed the repo while this one waited
+		initialFdroidIndex, err = apps.ReadIndex(fdroidIndexFilePath)
+		if err != nil {
+			fatal("Reading F-Droid repo index failed", "error", err)
 		}
+		names, err = loadAPKNames(filepath.Dir(*repoDir))
+		if err != nil {
+			fatal("Reading APK names failed", "error", err)
+		}
+	}
+
+	cloneCredentials, err := metadataCredentials(appsList)
+	if err != nil {
+		fatal("Reading credentials for metadata repos failed", "error", err)
+	}
 
-		releases, err := apps.ListAllReleases(githubClient, repo.Author, repo.Name)
+	if !*dryRun {
+		err = os.MkdirAll(*repoDir, 0o644)
 		if err != nil {
-			log.Printf("Error while listing repo releases for %q: %s\n", app.GitURL, err.Error())
-			haveError = true
-			return
+			fatal("Creating repo directory failed", "error", err)
 		}
+	}
 
-		log.Printf("Received %d releases", len(releases))
+	if *digestCachePath == "" {
+		*digestCachePath = filepath.Join(filepath.Dir(*repoDir), "digests.json")
+	}
+	digests, err := download.LoadDigests(*digestCachePath)
+	if err != nil {
+		fatal("Reading digest cache failed", "error", err)
+	}
 
-		for _, release := range releases {
-			fmt.Printf("::group::Release %s\n", release.GetTagName())
-			func() {
-				defer fmt.Println("::endgroup::")
+	if *statePath == "" {
+		*statePath = filepath.Join(filepath.Dir(*repoDir), "state.json")
+	}
+	state, err := loadState(*statePath)
+	if err != nil {
+		fatal("Reading state failed", "path", *statePath, "error", err)
+	}
+	if !partialRun {
+		state.forget(appsList)
+	}
 
-				if release.GetPrerelease() {
-					log.Printf("Skipping prerelease %q", release.GetTagName())
-					return
-				}
-				if release.GetDraft() {
-					log.Printf("Skipping draft %q", release.GetTagName())
-					return
-				}
-				if release.GetTagName() == "" {
-					log.Printf("Skipping release with empty tag name")
-					return
-				}
+	// stateSettings are the flags that decide which assets are accepted and how metadata is copied, the state of
+	// apps is reset when they change
+	stateSettings := fmt.Sprint(*minTargetSDK, maxAPKSize, *trackerPolicy, *trackerSignatures, *imageMaxDimension, *imageMaxBytes, *metadataFromRelease, *gitBackend, localeFallbacks, notesOptions)
 
-				log.Printf("Working on release with tag name %q", release.GetTagName())
+	// map[app name]configHash, as apps are changed with details from their host during discovery
+	appConfigs := make(map[string]string)
 
-				apk := apps.FindAPKRelease(release)
-				if apk == nil {
-					log.Printf("Couldn't find a release asset with extension \".apk\"")
-					return
-				}
+	if *trackerCachePath == "" {
+		*trackerCachePath = filepath.Join(filepath.Dir(*repoDir), "trackers.json")
+	}
+	trackerScan, err := newTrackerScanner(*trackerPolicy, *trackerSignatures, *trackerCachePath, digests)
+	if err != nil {
+		fatal("Setting up tracker scanning failed", "error", err)
+	}
+
+	vulnerabilities := newVulnerabilityCheck(*osvURL, *osvKnownVuln, newRetryPolicy("OSV query"), runReport)
+
+	bundles := &bundleConverter{
+		bundletool: *bundletool,
+		keystore:   *bundleKeystore,
+		keyAlias:   *bundleKeyAlias,
+		password:   os.Getenv("METASCOOP_BUNDLE_KEYSTORE_PASSWORD"),
+	}
 
-				appName := apps.GenerateReleaseFilename(app.Name(), release.GetTagName())
+	permissions, err := newPermissionGate(*permissionPolicy, initialFdroidIndex, *repoDir, runReport)
+	if err != nil {
+		fatal("Setting up permission checks failed", "error", err)
+	}
 
-				log.Printf("Target APK name: %s", appName)
+	licenses, err := newLicenseCheck(*licensePolicy, state, runReport)
+	if err != nil {
+		fatal("Setting up license checks failed", "error", err)
+	}
 
-				appClone := app
+	duplicates := newDuplicateVersions(allApps, names, initialFdroidIndex)
 
-				appClone.ReleaseDescription = release.GetBody()
-				if appClone.ReleaseDescription != "" {
-					log.Printf("Release notes: %s", appClone.ReleaseDescription)
-				}
+	attested, err := newAttestations(*attestationFormat, *runID)
+	if err != nil {
+		fatal("Parsing -provenance failed", "error", err)
+	}
+	releaseRecords := newReleaseArchive(filepath.Dir(*repoDir), *archiveReleases)
+
+	if *useGraphQL && githubTokens == nil {
+		slog.Info("The GitHub GraphQL API requires a token, using REST requests instead")
+	}
+
+	fmt.Println("::endgroup::")
+
+	// map[apkName]info
+	var apkInfoMap = make(map[string]apps.AppInfo)
 
-				apkInfoMap[appName] = appClone
+	// Paths of APKs that were copied from identical files in the repo instead of downloading them
+	var copiedAPKs []string
 
-				appTargetPath := filepath.Join(*repoDir, appName)
+	// map[APK path]name of the asset it was downloaded from, for hooks
+	var downloadAssets = make(map[string]string)
 
-				// If the app file already exists for this version, we continue
-				if _, err := os.Stat(appTargetPath); !errors.Is(err, os.ErrNotExist) {
-					log.Printf("Already have APK for version %q at %q", release.GetTagName(), appTargetPath)
-					return
+	// With a budget, the apps that were deferred by earlier runs or processed the longest ago come first
+	budget := newRunBudget(runReport.Started, *maxRunDuration, int64(maxDownloadBytes))
+	if budget != nil {
+		appsList = stalestFirst(appsList, state)
+	}
+
+	display.SetHeader(progressHeader(runReport, len(appsList)))
+
+	// Apps are looked up one after another, so this is the start of the current one
+	var discoveryStart time.Time
+
+	policy := scoop.Policy{
+		Start: func(app scoop.App) bool {
+			if stop.done() {
+				slog.Warn("Skipping app, the run was interrupted", "app", app.Name())
+				stop.skip(app.Name())
+				return false
+			}
+			if budget.expired() {
+				slog.Info("Deferring app to the next run, the run took longer than -max-run-duration", "app", app.Name())
+				budget.deferApp(app.Name())
+				runReport.SetDeferred(app.Name())
+				return false
+			}
+
+			info := appInfo(app)
+			fmt.Printf("App: %s/%s\n", info.Author(), app.Name())
+
+			runReport.AddApp(app.Name())
+			discoveryStart = time.Now()
+			display.Working(app.Name(), "looking up releases")
+
+			if info.Source != "" {
+				appConfigs[app.Name()] = configHash(info, stateSettings)
+			}
+			return true
+		},
+		Finish: func(app scoop.App) {
+			runReport.AddTiming(app.Name(), "discovery", time.Since(discoveryStart))
+			display.Idle(app.Name())
+			if locks != nil {
+				locks.discovered(app.Name())
+			}
+
+			// The lookups of the app may have been cancelled
+			if stop.done() {
+				stop.skip(app.Name())
+			}
+			if budget != nil && !budget.isDeferred(app.Name()) && !stop.skipped(app.Name()) {
+				state.processed(app.Name(), discoveryStart)
+			}
+		},
+		Error: runReport.AddError,
+		Skip:  runReport.AddSkip,
+		Repo: func(app scoop.App, repo scoop.Repo) error {
+			info := appInfo(app)
+			logger := slog.With("app", app.Name())
+
+			err := licenses.check(logger, info, appConfigs[app.Name()], repo.License)
+			if err != nil {
+				return err
+			}
+
+			if repo.MovedTo != "" {
+				runReport.SetMovedTo(app.Name(), repo.MovedTo)
+				switch {
+				case *updateMoved && !*dryRun:
+					merr := setAppGitURL(*appsFilePath, app.Name(), repo.MovedTo)
+					if merr != nil {
+						logger.Error("Updating git URL of moved repo failed", "git", info.GitURL, "moved_to", repo.MovedTo, "error", merr)
+					} else {
+						logger.Info("Updated git URL of moved repo in apps.yaml", "git", info.GitURL, "moved_to", repo.MovedTo)
+					}
+				default:
+					logger.Warn("Upstream repo was moved, change its git URL in apps.yaml or run with -update-moved-repos", "git", info.GitURL, "moved_to", repo.MovedTo)
+				}
+			}
+			return nil
+		},
+		Releases: func(app scoop.App, releases []scoop.Release) {
+			state.processReleases(app.Name(), appConfigs[app.Name()], releases)
+		},
+		RepoName:    names.repoName,
+		ReleaseName: names.releaseName,
+		Select: func(ctx context.Context, c *scoop.Candidate) bool {
+			app, asset, tag := appInfo(c.App), c.Asset, c.Release.TagName
+			logger := slog.With("app", app.Name(), "release", tag)
+			apkInfoMap[filepath.Base(c.Path)] = app
+
+			// If the app file already exists for this version, we continue
+			if _, err := os.Stat(c.Path); !errors.Is(err, os.ErrNotExist) {
+				changed, reason := assetChanged(asset, c.Path, digests)
+				if apps.IsBundle(asset.Name) {
+					// The APK was extracted from the bundle, so it can't be compared with the asset
+					changed = false
+				}
+				if !changed || c.Held != "" {
+					logger.Info("Already have APK", "path", c.Path)
+					runReport.AddSkip(app.Name(), tag, asset.Name, "already in repo")
+					return false
 				}
 
-				log.Printf("Downloading APK %q from release %q to %q", apk.GetName(), release.GetTagName(), appTargetPath)
+				logger.Info("APK is outdated, downloading it again", "path", c.Path, "reason", reason)
+			} else if reason, ok := state.rejection(app.Name(), appConfigs[app.Name()], tag, asset); ok {
+				logger.Info("Skipping asset, it was rejected by an earlier run and hasn't changed since", "asset", asset.Name, "reason", reason)
+				runReport.AddSkip(app.Name(), tag, asset.Name, "rejected by an earlier run")
+				return false
+			} else if identical, ok := findIdenticalFile(asset, digests); ok {
+				runReport.AddSkip(app.Name(), tag, asset.Name, "identical file already in repo")
+				if *dryRun {
+					logger.Info("Would copy identical file instead of downloading", "from", identical, "to", c.Path)
+					return false
+				}
 
-				dlCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-				defer cancel()
+				logger.Info("Copying identical file instead of downloading", "from", identical, "to", c.Path)
+				err := copyFile(identical, c.Path)
+				if err != nil {
+					logger.Error("Copying identical file failed", "from", identical, "error", err)
+					runReport.AddError(app.Name(), fmt.Errorf("copying %q: %w", identical, err))
+					return false
+				}
+				attested.add(c.Path, app, asset)
+				releaseRecords.add(c.Path, app, c.Release, asset)
+				stop.added(app.Name(), c.Path)
+				copiedAPKs = append(copiedAPKs, c.Path)
+				return false
+			}
 
-				appStream, _, err := githubClient.Repositories.DownloadReleaseAsset(dlCtx, repo.Author, repo.Name, apk.GetID(), http.DefaultClient)
+			// Versions that were archived earlier can come back if more versions should be kept now
+			archivedPath := filepath.Join(archiveDir, filepath.Base(c.Path))
+			if _, err := os.Stat(archivedPath); *useArchive && err == nil {
+				runReport.AddSkip(app.Name(), tag, asset.Name, "restored from archive")
+				if *dryRun {
+					logger.Info("Would restore APK from the archive", "path", archivedPath)
+					return false
+				}
+
+				logger.Info("Restoring APK from the archive", "path", archivedPath)
+				err = file.Move(archivedPath, c.Path)
 				if err != nil {
-					log.Printf("Error while downloading app %q (artifact id %d) from from release %q: %s", app.GitURL, apk.GetID(), release.GetTagName(), err.Error())
-					haveError = true
-					return
+					logger.Error("Restoring APK from the archive failed", "path", archivedPath, "error", err)
+					runReport.AddError(app.Name(), fmt.Errorf("restoring %q from the archive: %w", archivedPath, err))
+					return false
+				}
+				if _, err := os.Stat(archivedPath + attestationSuffix); err == nil {
+					_ = file.Move(archivedPath+attestationSuffix, c.Path+attestationSuffix)
 				}
+				stop.restored(app.Name(), c.Path, archivedPath)
+				return false
+			}
+
+			if c.MaxSize > 0 && asset.Size > c.MaxSize {
+				logger.Error("Asset is larger than the maximum APK size", "asset", asset.Name, "size", asset.Size, "max_size", c.MaxSize)
+				runReport.AddError(app.Name(), fmt.Errorf("release %q: %q has %s, more than the maximum APK size of %s. Set max_apk_size in apps.yaml if it's expected",
+					tag, asset.Name, formatBytes(asset.Size), formatBytes(c.MaxSize)))
+				return false
+			}
 
-				err = downloadStream(appTargetPath, appStream)
+			if budget.isDeferred(app.Name()) || !budget.take(asset.Size) {
+				logger.Info("Deferring download to the next run, it doesn't fit into -max-download-bytes", "asset", asset.Name, "size", asset.Size)
+				runReport.AddSkip(app.Name(), tag, asset.Name, "deferred, the download budget of the run is used up")
+				budget.deferApp(app.Name())
+				runReport.SetDeferred(app.Name())
+				return false
+			}
+			return true
+		},
+		Queue: func(ctx context.Context, c *scoop.Candidate) bool {
+			app, asset, tag := appInfo(c.App), c.Asset, c.Release.TagName
+			logger := slog.With("app", app.Name(), "release", tag)
+			if c.Checksum != "" {
+				asset.SHA256 = c.Checksum
+			}
+
+			if !*dryRun {
+				err := runHooks.run(logger, app, hooks.PointPreDownload, asset.Name, c.Path)
+				var veto *hooks.VetoError
+				if errors.As(err, &veto) {
+					logger.Info("Hook vetoed downloading the asset", "asset", asset.Name, "hook", veto.Hook, "reason", veto.Reason)
+					runReport.AddSkip(app.Name(), tag, asset.Name, fmt.Sprintf("vetoed by hook %q", veto.Hook))
+					return false
+				}
 				if err != nil {
-					log.Printf("Error while downloading app %q (artifact id %d) from from release %q to %q: %s", app.GitURL, *apk.ID, *release.TagName, appTargetPath, err.Error())
-					haveError = true
-					return
+					logger.Error("Running pre-download hook failed", "asset", asset.Name, "error", err)
+					runReport.AddError(app.Name(), fmt.Errorf("release %q: %w", tag, err))
+					return false
 				}
+			}
 
-				log.Printf("Successfully downloaded app for version %q", release.GetTagName())
-			}()
+			downloadAssets[c.Path] = asset.Name
+			attested.queue(c.Path, app, asset)
+			releaseRecords.queue(c.Path, app, c.Release, asset)
+			_, serr := os.Stat(c.Path)
+			stop.downloading(app.Name(), c.Path, serr == nil)
+
+			if apps.IsBundle(asset.Name) {
+				logger.Info("Asset is a bundle, its universal APK is published", "asset", asset.Name)
+				c.Convert = func(path string) error {
+					return bundles.convert(ctx, path, asset.Name)
+				}
+			}
+			return true
+		},
+		Deferred: budget.isDeferred,
+		Verify: func(c *scoop.Candidate, path string) error {
+			app := appInfo(c.App)
+			logger := slog.With("app", app.Name(), "release", c.Release.TagName)
+
+			// Hooks may change the APK, so it's verified afterwards
+			err := runHooks.run(logger, app, hooks.PointPostDownload, c.Asset.Name, path)
+			if err != nil {
+				return err
+			}
+
+			err = verifyDownload(path, app, c.ABI, *minTargetSDK, c.MaxSize)
+			if err == nil {
+				err = trackerScan.verify(path, app)
+			}
+			if err != nil {
+				// Unlike the checks below, these only depend on the APK and the configuration. Rejections are
+				// remembered for the asset as the host reports it.
+				state.reject(app.Name(), appConfigs[app.Name()], c.Release.TagName, c.Asset, err)
+			}
+			if err == nil {
+				// Conflicts with other apps depend on their priority and versions, so they're checked again
+				// every run
+				err = duplicates.verify(path, app)
+			}
+			if err == nil {
+				err = permissions.verify(logger, path, app)
+			}
+			if err != nil || *allowDowngrade {
+				return err
+			}
+			return verifyVersionCode(path, initialFdroidIndex, filepath.Base(path), c.Newest)
+		},
+		Downloaded: func(d scoop.Download, bytes int64, elapsed time.Duration) {
+			err := digests.Record(d.URL, d.Target)
+			if err != nil {
+				slog.Error("Recording digest failed", "app", d.App, "path", d.Target, "error", err)
+			}
+			attested.downloaded(d.Target)
+			releaseRecords.downloaded(d.Target)
+
+			if info, ok := apkInfoMap[filepath.Base(d.Target)]; ok {
+				runReport.AddDownload(d.App, info.ReleaseTag, bytes)
+			}
+			runReport.AddTiming(d.App, "download", elapsed)
+		},
+	}
+
+	// A nil *downloadProgress in the interface would still be called
+	var downloadProgress scoop.Progress
+	if display != nil {
+		downloadProgress = newDownloadProgress(display)
+	}
+
+	scooper, err := scoop.New(scoop.Options{
+		RepoDir:         *repoDir,
+		Policy:          policy,
+		GitHub:          &http.Client{Transport: rateLimits},
+		GitHubAPI:       githubAPI.String(),
+		GitHubGraphQL:   *useGraphQL && githubTokens != nil,
+		GitLabToken:     *gitLabToken,
+		GiteaToken:      *giteaToken,
+		MaxRetries:      *maxRetries,
+		RetryBudget:     *retryBudget,
+		DownloadWorkers: *downloadWorkers,
+		DownloadTimeout: *downloadTimeout,
+		HostInterval:    *downloadHostInterval,
+		Progress:        downloadProgress,
+		KeepVersions:    *keepVersions,
+		MinReleaseAge:   time.Duration(minReleaseAge),
+		MaxAPKSize:      int64(maxAPKSize),
+		Archive:         *useArchive,
+		Sidecars:        []string{attestationSuffix},
+		DryRun:          *dryRun,
+		Redact:          redactFromLog,
+	})
+	if err != nil {
+		fatal("Setting up release lookups failed", "error", err)
+	}
+
+	run := scooper.Run(ctx, scoopApps(appsList))
+
+	if *dryRun {
+		pruned, err := scooper.Prunable(run)
+		if err != nil {
+			slog.Error("Looking for old versions failed", "error", err)
+			runReport.AddError("", fmt.Errorf("looking for old versions: %w", err))
+		}
+
+		plan := buildPlan(*useArchive, appsList, apkInfoMap, run.Downloads, pruned, initialFdroidIndex, filepath.Join(filepath.Dir(*repoDir), "metadata"))
+		plan.Print(os.Stdout)
+
+		if failed(runReport, failurePolicy, len(appsList)) {
+			finish(1)
 		}
+
+		// Nothing was changed, so there is nothing to commit
+		finish(2)
 	}
 
-	if !*debugMode {
-		fmt.Println("::group::F-Droid: Creating metadata stubs")
-		// Now, we run the fdroid update command
-		cmd := exec.Command("fdroid", "update", "--pretty", "--delete-unknown")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		cmd.Stdin = os.Stdin
-		cmd.Dir = filepath.Dir(*repoDir)
+	fmt.Printf("::group::Downloading %d APKs\n", len(run.Downloads))
+
+	var downloadErrors map[string][]error
+	if stop.done() {
+		// None of the queued downloads is started, so none of their apps is fully processed
+		for _, d := range run.Downloads {
+			stop.skip(d.App)
+		}
+	} else {
+		downloadErrors = scooper.Download(ctx, run.Downloads)
+	}
+	stop.downloaded(downloadErrors)
+
+	fmt.Println("::endgroup::")
+
+	for appName, errs := range downloadErrors {
+		slog.Error("Downloads failed", "app", appName, "count", len(errs))
+		for _, err := range errs {
+			slog.Error("Download failed", "app", appName, "error", err)
+			runReport.AddError(appName, err)
+		}
+	}
+
+	// Until now the run only added files to the repo directory, so an interruption can take them back
+	stop.rollback(runReport.AddError)
+	if stop.done() {
+		if stop.mode == interruptAbort {
+			slog.Warn("The run was interrupted, the files it added to the repo were removed again")
+			finish(1)
+		}
+
+		run.Filter(func(app string) bool {
+			return !stop.skipped(app)
+		})
+
+		slog.Warn("The run was interrupted, finishing it for the apps that were fully processed")
+	}
+
+	// Most variables of file name templates are only known from the APKs, so they are renamed once they're downloaded
+	renamePaths := copiedAPKs
+	for _, d := range run.Downloads {
+		renamePaths = append(renamePaths, d.Target)
+	}
+	renameAPKs(apkRenames{
+		names:          names,
+		run:            run,
+		apkInfoMap:     apkInfoMap,
+		downloadAssets: downloadAssets,
+		attested:       attested,
+		releases:       releaseRecords,
+		digests:        digests,
+		addError:       runReport.AddError,
+	}, renamePaths, *apkNameTemplate)
+
+	err = digests.Save()
+	if err != nil {
+		slog.Error("Writing digest cache failed", "path", *digestCachePath, "error", err)
+	}
+
+	if *gitCacheDir == "" {
+		*gitCacheDir, err = ws.MkdirTemp("git-cache-*")
+		if err != nil {
+			fatal("Creating temporary git cache directory failed", "error", err)
+		}
+	}
+
+	verifiedPath := filepath.Join(filepath.Dir(*repoDir), "metadata", "verified.json")
+	verified, err := loadVerifiedBuilds(verifiedPath)
+	if err != nil {
+		fatal("Reading verified builds failed", "path", verifiedPath, "error", err)
+	}
+
+	if *reproducible {
+		fmt.Println("::group::Rebuilding APKs from source")
+
+		// Builds need complete checkouts, so this doesn't share the sparse settings of the metadata clones
+		rebuildCache, err := git.NewCache(*gitCacheDir)
+		if err != nil {
+			fatal("Creating git cache failed", "error", err)
+		}
+		rebuildCache.Retry = newRetryPolicy("git fetch")
+		rebuildCache.Timeout = *gitTimeout
+
+		r := &rebuilder{cache: rebuildCache, runtime: *containerRuntime, timeout: *rebuildTimeout}
+		rebuildDownloads(r, verified, run.Downloads, apkInfoMap, runReport.AddError)
+
+		fmt.Println("::endgroup::")
+	}
+
+	runHooks.prePublish(run.Downloads, apkInfoMap, downloadAssets, runReport.AddError)
+
+	// APKs that weren't added, e.g. because they couldn't be reproduced or a hook vetoed them, are only known
+	// after the rebuilds and hooks
+	scooper.PlaceCompanions(run)
 
-		log.Printf("Running %q in %s", cmd.String(), cmd.Dir)
+	duplicates.resolve(*repoDir, run.Downloads, apkInfoMap, runReport.AddError)
 
-		err = cmd.Run()
+	attested.write(digests, runReport.AddError)
 
+	if runIndexer {
+		fmt.Println("::group::F-Droid: Creating metadata stubs")
+
+		err = scoop.UpdateIndex(*indexer, filepath.Dir(*repoDir), signingKey)
 		if err != nil {
-			log.Println("Error while running \"fdroid update -c\":", err.Error())
+			slog.Error("Updating the index failed", "error", err)
 
 			fmt.Println("::endgroup::")
-			os.Exit(1)
+			finish(1)
 		}
 		fmt.Println("::endgroup::")
 	}
 
+	fmt.Println("::group::Removing old versions")
+
+	// This runs after "fdroid update" so APKs downloaded in this run are already in the index
+	pruned, err := scooper.Prunable(run)
+	if err == nil {
+		err = scooper.Prune(pruned, *useArchive)
+	}
+	if err != nil {
+		slog.Error("Removing old versions failed", "error", err)
+		runReport.AddError("", fmt.Errorf("removing old versions: %w", err))
+	}
+	for _, p := range pruned {
+		if *useArchive {
+			runReport.AddArchival(p.App, filepath.Base(p.Path))
+		} else {
+			runReport.AddRemoval(p.App, filepath.Base(p.Path))
+		}
+	}
+
+	fmt.Println("::endgroup::")
+
+	fmt.Println("::group::Checking repo size")
+
+	sizeIndex, err := apps.ReadIndex(fdroidIndexFilePath)
+	if err == nil {
+		err = enforceRepoSize(scooper, *repoDir, sizeIndex, apkInfoMap, int64(maxRepoSize), *repoSizePolicy, runReport)
+	}
+	if err != nil {
+		slog.Error("Checking repo size failed", "error", err)
+		runReport.AddError("", fmt.Errorf("checking repo size: %w", err))
+	}
+
+	fmt.Println("::endgroup::")
+
 	fmt.Println("Filling in metadata")
 
 	fdroidIndex, err := apps.ReadIndex(fdroidIndexFilePath)
 	if err != nil {
-		log.Fatalf("reading f-droid repo index: %s\n::endgroup::\n", err.Error())
+		fatal("Reading F-Droid repo index failed", "error", err)
 	}
 
 	// directory paths that should be removed after updating metadata
 	var toRemovePaths []string
 
-	walkPath := filepath.Join(filepath.Dir(*repoDir), "metadata")
-	err = filepath.WalkDir(walkPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".yml") {
-			return err
+	localeFallback, err := newLocaleFallback(localeFallbacks)
+	if err != nil {
+		fatal("Invalid locale fallback", "error", err)
+	}
+
+	imageLimits := images.Limits{
+		MaxDimension: *imageMaxDimension,
+		MaxBytes:     *imageMaxBytes,
+	}
+
+	cloneCache, err := git.NewCache(*gitCacheDir)
+	if err != nil {
+		fatal("Creating git cache failed", "error", err)
+	}
+
+	cloneCache.Retry = newRetryPolicy("git fetch")
+	cloneCache.Timeout = *gitTimeout
+	cloneCache.Credentials = cloneCredentials
+
+	switch *gitBackend {
+	case git.BackendExec:
+		if _, err := tools.Path("git"); err != nil {
+			slog.Warn("Fetching upstream repos over HTTP, git isn't installed", "error", err)
+			cloneCache.Backend = git.BackendNative
+			cloneCache.SparsePatterns = []string{"fastlane/"}
+		}
+	case git.BackendNative:
+		cloneCache.Backend = git.BackendNative
+		cloneCache.SparsePatterns = []string{"fastlane/"}
+	default:
+		fatal("Unknown git backend", "backend", *gitBackend)
+	}
+	if *githubContents {
+		cloneCache.GitHubClient = &http.Client{Transport: rateLimits}
+		cloneCache.GitHubAPI = githubAPI.String()
+		cloneCache.SparsePatterns = []string{"fastlane/"}
+	}
+	if imageBudget > 0 {
+		cloneCache.ImageBudget = git.NewByteBudget(int64(imageBudget))
+	}
+
+	// Pruning runs before, so releases of APKs that were archived right away are archived as well
+	releaseRecords.write(stop.finishContext(), archiveDir, func(ctx context.Context, gitURL, tag string) (string, error) {
+		return cloneCache.Resolve(ctx, git.Target{URL: gitURL, Ref: tag})
+	}, runReport.AddError)
+
+	fmt.Println("::group::Updating cached clones of upstream repos")
+
+	// Only the metadata of the suggested versions is used, so only their clones are fetched
+	var cloneTargets []git.Target
+	var seenTargets = make(map[git.Target]bool)
+	var seenPatterns = make(map[string]bool)
+	cloneCache.RepoPatterns = make(map[string][]string)
+
+	// Asking for the current commit of a target is cheap compared to fetching it. Packages whose metadata was
+	// already copied from that commit aren't fetched and copied again.
+	var (
+		targetCommits = make(map[git.Target]string)
+		skipMetadata  = make(map[string]string)
+	)
+	for pkgname := range fdroidIndex.Packages {
+		latestPackage, ok := findSuggestedPackage(fdroidIndex, pkgname, apkInfoMap)
+		if !ok {
+			continue
+		}
+		apkInfo, ok := apkInfoMap[latestPackage.ApkName]
+		if !ok {
+			continue
+		}
+
+		t := git.Target{URL: apkInfo.MetadataGitURL(), Ref: apkInfo.MetadataRef(*metadataFromRelease)}
+
+		commit, resolved := targetCommits[t]
+		if !resolved {
+			commit, err = cloneCache.Resolve(stop.finishContext(), t)
+			if err != nil {
+				slog.Warn("Looking up upstream commit failed", "git", git.RedactURL(t.URL), "ref", t.Ref, "error", err)
+			}
+			targetCommits[t] = commit
+		}
+		remembered, ok := state.metadataCommit(apkInfo.Name(), appConfigs[apkInfo.Name()], t, packageVersions(fdroidIndex.Packages[pkgname]))
+		if ok && commit != "" && commit == remembered {
+			skipMetadata[pkgname] = commit
+			continue
+		}
+
+		if !seenTargets[t] {
+			seenTargets[t] = true
+			cloneTargets = append(cloneTargets, t)
 		}
+		if apkInfo.MetadataPath != "" && !seenPatterns[t.URL+"\x00"+apkInfo.MetadataPath] {
+			seenPatterns[t.URL+"\x00"+apkInfo.MetadataPath] = true
+			cloneCache.RepoPatterns[t.URL] = append(cloneCache.RepoPatterns[t.URL], apkInfo.MetadataPath+"/")
+		}
+		if apkInfo.DescriptionFromReadme && !seenPatterns[t.URL+"\x00README"] {
+			seenPatterns[t.URL+"\x00README"] = true
+			cloneCache.RepoPatterns[t.URL] = append(cloneCache.RepoPatterns[t.URL], readmeNames...)
+		}
+	}
+
+	for t, err := range cloneCache.Prefetch(stop.finishContext(), cloneTargets, *cloneWorkers) {
+		slog.Error("Updating cached clone failed", "git", git.RedactURL(t.URL), "error", err)
+	}
+
+	fmt.Println("::endgroup::")
 
+	if *provenancePath == "" {
+		*provenancePath = filepath.Join(filepath.Dir(*repoDir), "metadata-provenance.json")
+	}
+	provenance, err := loadProvenance(*provenancePath)
+	if err != nil {
+		fatal("Reading metadata provenance failed", "path", *provenancePath, "error", err)
+	}
+
+	walkPath := filepath.Join(filepath.Dir(*repoDir), "metadata")
+	err = walkMetadataFiles(walkPath, func(path string) error {
 		pkgname := strings.TrimSuffix(filepath.Base(path), ".yml")
+		logger := slog.With("package", pkgname)
 
 		fmt.Printf("::group::%s\n", pkgname)
 
 		return func() error {
 			defer fmt.Println("::endgroup::")
-			log.Printf("Working on %q", pkgname)
+			logger.Debug("Working on package")
 
 			meta, err := apps.ReadMetaFile(path)
 			if err != nil {
-				log.Printf("Reading meta file %q: %s", path, err.Error())
+				logger.Error("Reading meta file failed", "path", path, "error", err)
+				runReport.AddError("", fmt.Errorf("reading meta file %q: %w", path, err))
 				return nil
 			}
 
-			latestPackage, ok := fdroidIndex.FindLatestPackage(pkgname)
+			latestPackage, ok := findSuggestedPackage(fdroidIndex, pkgname, apkInfoMap)
 			if !ok {
 				return nil
 			}
 
-			log.Printf("The latest version is %q with versionCode %d", latestPackage.VersionName, latestPackage.VersionCode)
+			logger.Info("Found latest version", "version", latestPackage.VersionName, "version_code", latestPackage.VersionCode)
 
 			apkInfo, ok := apkInfoMap[latestPackage.ApkName]
 			if !ok {
-				log.Printf("Cannot find apk info for %q", latestPackage.ApkName)
+				logger.Debug("Cannot find app info of latest version", "apk", latestPackage.ApkName)
 				return nil
 			}
 
-			// Now update with some info
-
-			setNonEmpty(meta, "AuthorName", apkInfo.Author())
-			fn := apkInfo.FriendlyName
-			if fn == "" {
-				fn = apkInfo.Name()
-			}
-			setNonEmpty(meta, "Name", fn)
-			setNonEmpty(meta, "SourceCode", apkInfo.GitURL)
-			setNonEmpty(meta, "License", apkInfo.License)
-			setNonEmpty(meta, "Description", apkInfo.Description)
+			logger := logger.With("app", apkInfo.Name())
 
-			var summary = apkInfo.Summary
-			// See https://f-droid.org/en/docs/Build_Metadata_Reference/#Summary for max length
-			const maxSummaryLength = 80
-			if len(summary) > maxSummaryLength {
-				summary = summary[:maxSummaryLength-3] + "..."
+			metadataStart := time.Now()
+			display.Working(apkInfo.Name(), "updating metadata")
+			defer func() {
+				display.Idle(apkInfo.Name())
+				runReport.AddTiming(apkInfo.Name(), "metadata", time.Since(metadataStart))
+			}()
 
-				log.Printf("Truncated summary to length of %d (max length)", len(summary))
+			oldMeta := make(map[string]interface{}, len(meta))
+			for k, v := range meta {
+				oldMeta[k] = v
 			}
 
-			setNonEmpty(meta, "Summary", summary)
-
-			if len(apkInfo.Categories) != 0 {
-				meta["Categories"] = apkInfo.Categories
-			}
+			// Now update with some info
+			applyAppInfo(logger, meta, apkInfo, latestPackage)
+			setVersionAntiFeatures(logger, meta, fdroidIndex.Packages[pkgname], apkInfoMap, func(p apps.PackageInfo, info apps.AppInfo) []string {
+				afs, found, err := trackerScan.antiFeatures(filepath.Join(*repoDir, p.ApkName), info)
+				if err != nil {
+					logger.Warn("Scanning APK for trackers failed", "apk", p.ApkName, "error", err)
+				}
+				if len(found) > 0 {
+					logger.Info("Version contains trackers", "version", p.VersionName, "trackers", strings.Join(found, ","))
+				}
+				return mergeAntiFeatures(afs, vulnerabilities.antiFeatures(stop.finishContext(), logger, p, info))
+			})
 
-			if len(apkInfo.AntiFeatures) != 0 {
-				meta["AntiFeatures"] = strings.Join(apkInfo.AntiFeatures, ",")
+			kept, fields := provenance.merge(pkgname, oldMeta, meta, *forceMetadata)
+			if len(kept) > 0 {
+				logger.Info("Keeping metadata fields that were edited by hand, use -force-metadata to overwrite them", "fields", strings.Join(kept, ","))
 			}
 
-			meta["CurrentVersion"] = latestPackage.VersionName
-			meta["CurrentVersionCode"] = latestPackage.VersionCode
-
-			log.Printf("Set current version info to versionName=%q, versionCode=%d", latestPackage.VersionName, latestPackage.VersionCode)
+			runReport.AddMetadataUpdates(apkInfo.Name(), changedFields(oldMeta, meta))
 
 			err = apps.WriteMetaFile(path, meta)
 			if err != nil {
-				log.Printf("Writing meta file %q: %s", path, err.Error())
+				logger.Error("Writing meta file failed", "path", path, "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("writing meta file: %w", err))
 				return nil
 			}
+			provenance.record(pkgname, fields)
 
-			log.Printf("Updated metadata file %q", path)
+			logger.Info("Updated metadata file", "path", path)
 
 			if apkInfo.ReleaseDescription != "" {
-				destFilePath := filepath.Join(walkPath, latestPackage.PackageName, "en-US", "changelogs", fmt.Sprintf("%d.txt", latestPackage.VersionCode))
+				destFilePath := filepath.Join(walkPath, latestPackage.PackageName, defaultLocale, "changelogs", fmt.Sprintf("%d.txt", latestPackage.VersionCode))
 
 				err = os.MkdirAll(filepath.Dir(destFilePath), os.ModePerm)
 				if err != nil {
-					log.Printf("Creating directory for changelog file %q: %s", destFilePath, err.Error())
+					logger.Error("Creating changelog directory failed", "path", destFilePath, "error", err)
+					runReport.AddError(apkInfo.Name(), fmt.Errorf("creating changelog directory: %w", err))
 					return nil
 				}
 
-				err = os.WriteFile(destFilePath, []byte(apkInfo.ReleaseDescription), os.ModePerm)
+				err = os.WriteFile(destFilePath, []byte(notesOptions.Clean(apkInfo.ReleaseDescription)), 0o644)
 				if err != nil {
-					log.Printf("Writing changelog file %q: %s", destFilePath, err.Error())
+					logger.Error("Writing changelog failed", "path", destFilePath, "error", err)
+					runReport.AddError(apkInfo.Name(), fmt.Errorf("writing changelog: %w", err))
 					return nil
 				}
 
-				log.Printf("Wrote release notes to %q", destFilePath)
+				logger.Info("Wrote release notes", "path", destFilePath)
 			}
 
-			log.Printf("Cloning git repository to search for screenshots")
+			if commit, ok := skipMetadata[pkgname]; ok {
+				logger.Info("Metadata in the upstream repo didn't change since the last run", "commit", commit)
+				return nil
+			}
+
+			logger.Debug("Cloning git repository to search for metadata")
+
+			target := git.Target{URL: apkInfo.MetadataGitURL(), Ref: apkInfo.MetadataRef(*metadataFromRelease)}
+			switch {
+			case apkInfo.MetadataGitRef != "":
+				logger.Info("Using the metadata of the configured ref", "ref", target.Ref)
+			case target.Ref != "":
+				logger.Info("Using the metadata of the release tag", "tag", target.Ref)
+			}
 
-			gitRepoPath, err := git.CloneRepo(apkInfo.GitURL)
+			// Apps of a monorepo share the checkout, it's removed after all metadata was copied
+			gitRepoPath, err := cloneCache.SharedCheckout(stop.finishContext(), target)
+			if err != nil && target.Ref != "" && apkInfo.MetadataGitRef == "" {
+				// Not every release has a tag in the repo, e.g. if the APK is uploaded to a release of a
+				// CI repo, so the default branch is better than no metadata at all
+				logger.Warn("Checking out release tag failed, using the default branch", "tag", target.Ref, "git", git.RedactURL(target.URL), "error", err)
+
+				target.Ref = ""
+				gitRepoPath, err = cloneCache.SharedCheckout(stop.finishContext(), target)
+			}
 			if err != nil {
-				log.Printf("Cloning git repo from %q: %s", apkInfo.GitURL, err.Error())
+				logger.Error("Cloning git repo failed", "git", git.RedactURL(target.URL), "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("cloning git repo: %w", err))
 				return nil
 			}
-			defer os.RemoveAll(gitRepoPath)
 
-			metadata, err := apps.FindMetadata(gitRepoPath)
+			metadata, err := apps.FindMetadata(gitRepoPath, apkInfo.MetadataPath)
 			if err != nil {
-				log.Printf("finding metadata in git repo %q: %s", gitRepoPath, err.Error())
+				logger.Error("Finding metadata in git repo failed", "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("finding metadata in git repo: %w", err))
 				return nil
 			}
 
-			log.Printf("Found %d screenshots", len(metadata.Screenshots))
-
-			screenshotsPath := filepath.Join(walkPath, latestPackage.PackageName, "en-US", "phoneScreenshots")
-
-			_ = os.RemoveAll(screenshotsPath)
-
-			var sccounter int = 1
-			for _, sc := range metadata.Screenshots {
-				var ext = filepath.Ext(sc)
-				if ext == "" {
-					log.Printf("Invalid: screenshot file extension is empty for %q", sc)
-					continue
-				}
-
-				var newFilePath = filepath.Join(screenshotsPath, fmt.Sprintf("%d%s", sccounter, ext))
-
-				err = os.MkdirAll(filepath.Dir(newFilePath), os.ModePerm)
+			if apkInfo.DescriptionFromReadme && apkInfo.Description == "" && metadata.Texts[defaultLocale]["full_description.txt"] == "" {
+				added, err := addReadmeDescription(&metadata, gitRepoPath, ws)
 				if err != nil {
-					log.Printf("Creating directory for screenshot file %q: %s", newFilePath, err.Error())
+					logger.Error("Reading description from README failed", "error", err)
+					runReport.AddError(apkInfo.Name(), fmt.Errorf("reading description from README: %w", err))
 					return nil
 				}
-
-				err = file.Move(sc, newFilePath)
-				if err != nil {
-					log.Printf("Moving screenshot file %q to %q: %s", sc, newFilePath, err.Error())
-					return nil
+				if added {
+					logger.Info("The upstream repo has no fastlane description, using its README")
+				} else {
+					logger.Warn("The upstream repo has neither a fastlane description nor a README to take it from")
 				}
+			}
 
-				log.Printf("Wrote screenshot to %s", newFilePath)
+			written, err := copyChangelogs(filepath.Join(walkPath, latestPackage.PackageName), fdroidIndex.Packages[latestPackage.PackageName], metadata.Changelogs, notesOptions)
+			if err != nil {
+				logger.Error("Copying fastlane changelogs failed", "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("copying fastlane changelogs: %w", err))
+				return nil
+			}
+			if written > 0 {
+				logger.Info("Copied fastlane changelogs", "count", written)
+			}
 
-				sccounter++
+			written, filled, err := copyTexts(filepath.Join(walkPath, latestPackage.PackageName), metadata.Texts, apkInfo, localeFallback)
+			if err != nil {
+				logger.Error("Copying fastlane texts failed", "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("copying fastlane texts: %w", err))
+				return nil
+			}
+			if written > 0 {
+				logger.Info("Copied localized fastlane texts", "count", written, "filled_from_fallbacks", filled)
 			}
 
-			toRemovePaths = append(toRemovePaths, screenshotsPath)
+			synced, err := syncImages(logger, filepath.Join(walkPath, latestPackage.PackageName), filepath.Join(*repoDir, latestPackage.PackageName), metadata, imageLimits)
+			if err != nil {
+				logger.Error("Syncing images failed", "error", err)
+				runReport.AddError(apkInfo.Name(), fmt.Errorf("syncing images: %w", err))
+				return nil
+			}
+
+			toRemovePaths = append(toRemovePaths, synced...)
+
+			// Metadata with images of an older commit is copied again once they were fetched
+			if commit := targetCommits[target]; commit != "" && !cloneCache.Partial(target) {
+				state.copiedMetadata(apkInfo.Name(), appConfigs[apkInfo.Name()], target, commit, packageVersions(fdroidIndex.Packages[pkgname]))
+			}
 
 			return nil
 		}()
 	})
+	cloneCache.RemoveCheckouts()
+
+	// The metadata files written before a failed walk are kept, so is what was written to them
+	if perr := provenance.save(); perr != nil {
+		slog.Error("Writing metadata provenance failed", "path", *provenancePath, "error", perr)
+		runReport.AddError("", fmt.Errorf("writing metadata provenance: %w", perr))
+	}
 	if err != nil {
-		log.Printf("Error while walking metadata: %s", err.Error())
+		slog.Error("Walking metadata failed", "error", err)
 
-		os.Exit(1)
+		finish(1)
 	}
 
-	if !*debugMode {
-		fmt.Println("::group::F-Droid: Reading updated metadata")
+	err = state.save()
+	if err != nil {
+		slog.Error("Writing state failed", "path", *statePath, "error", err)
+		runReport.AddError("", fmt.Errorf("writing state: %w", err))
+	}
+
+	// Names of pruned APKs are dropped, so they're saved after they were removed
+	err = names.save()
+	if err != nil {
+		slog.Error("Writing APK names failed", "path", names.path, "error", err)
+		runReport.AddError("", fmt.Errorf("writing APK names: %w", err))
+	}
+
+	// Pruned versions are dropped from the list, so it's saved after they were removed
+	err = verified.save(*repoDir, archiveDir)
+	if err != nil {
+		slog.Error("Writing verified builds failed", "path", verifiedPath, "error", err)
+		runReport.AddError("", fmt.Errorf("writing verified builds: %w", err))
+	}
 
-		// Now, we run the fdroid update command again to regenerate the index with our new metadata
-		cmd := exec.Command("fdroid", "update", "--pretty", "--delete-unknown")
-		cmd.Stderr = os.Stderr
-		cmd.Stdout = os.Stdout
-		cmd.Stdin = os.Stdin
-		cmd.Dir = filepath.Dir(*repoDir)
+	// Versions are also scanned in the metadata walk, so the cache is complete only now
+	err = trackerScan.cache.Save()
+	if err != nil {
+		slog.Error("Writing tracker cache failed", "path", *trackerCachePath, "error", err)
+	}
 
-		log.Printf("Running %q in %s", cmd.String(), cmd.Dir)
+	if runIndexer {
+		fmt.Println("::group::F-Droid: Reading updated metadata")
 
-		err = cmd.Run()
+		// Now we update the index again with our new metadata
+		err = scoop.UpdateIndex(*indexer, filepath.Dir(*repoDir), signingKey)
 		if err != nil {
-			log.Println("Error while running \"fdroid update -c\":", err.Error())
+			slog.Error("Updating the index failed", "error", err)
 
 			fmt.Println("::endgroup::")
-			os.Exit(1)
+			finish(1)
 		}
 		fmt.Println("::endgroup::")
 	}
@@ -386,7 +1416,7 @@ func main() {
 	// Now at the end, we read the index again
 	fdroidIndex, err = apps.ReadIndex(fdroidIndexFilePath)
 	if err != nil {
-		log.Fatalf("reading f-droid repo index: %s\n::endgroup::\n", err.Error())
+		fatal("Reading F-Droid repo index failed", "error", err)
 	}
 
 	// Now we can remove all paths that were marked for doing so
@@ -394,87 +1424,100 @@ func main() {
 	for _, rmpath := range toRemovePaths {
 		err = os.RemoveAll(rmpath)
 		if err != nil {
-			log.Fatalf("removing path %q: %s\n", rmpath, err.Error())
+			fatal("Removing path failed", "path", rmpath, "error", err)
 		}
 	}
 
-	// We can now generate the README file
-	readmePath := filepath.Join(filepath.Dir(filepath.Dir(*repoDir)), "README.md")
-	err = md.RegenerateReadme(readmePath, fdroidIndex)
+	fingerprint, err := repoFingerprint(*repoDir, signingKey)
+	if err != nil {
+		slog.Error("Reading the fingerprint of the repo failed", "error", err)
+		runReport.AddError("", fmt.Errorf("reading repo fingerprint: %w", err))
+	}
+
+	info, err := writeRepoInfo(*repoDir, fdroidIndex, fingerprint)
 	if err != nil {
-		log.Fatalf("error generating %q: %s\n", readmePath, err.Error())
+		slog.Error("Writing repo info failed", "error", err)
+		runReport.AddError("", fmt.Errorf("writing repo info: %w", err))
+	}
+
+	// We can now generate the README file
+	if *readmePath == "" {
+		*readmePath = filepath.Join(filepath.Dir(filepath.Dir(*repoDir)), "README.md")
+	}
+	if *readmePath != "-" {
+		err = md.RegenerateReadme(*readmePath, fdroidIndex)
+		if err == nil && info.URL != "" {
+			qrPath, _ := filepath.Rel(filepath.Dir(*readmePath), filepath.Join(*repoDir, repoQRPNG))
+			err = md.UpdateRepoInfo(*readmePath, md.RepoInfo{URL: info.URL, QRCode: filepath.ToSlash(qrPath)})
+		}
+		if err != nil {
+			fatal("Generating README failed", "path", *readmePath, "error", err)
+		}
+	}
+
+	if *feedEntries > 0 {
+		err = feed.New(fdroidIndex, filepath.Join(filepath.Dir(*repoDir), "metadata"), *feedEntries).Write(*repoDir, *jsonFeed)
+		if err != nil {
+			slog.Error("Writing feed failed", "error", err)
+			runReport.AddError("", fmt.Errorf("writing feed: %w", err))
+		}
+	}
+
+	if *generateSite {
+		err = writeSite(*repoDir, *siteTemplates, fingerprint)
+		if err != nil {
+			slog.Error("Generating website failed", "error", err)
+			runReport.AddError("", fmt.Errorf("generating website: %w", err))
+		}
 	}
 
 	cpath, haveSignificantChanges := apps.HasSignificantChanges(initialFdroidIndex, fdroidIndex)
 	if haveSignificantChanges {
-		log.Printf("The index %q had a significant change at JSON path %q", fdroidIndexFilePath, cpath)
+		slog.Info("The index had a significant change", "path", fdroidIndexFilePath, "json_path", cpath)
 	} else {
-		log.Printf("The index files didn't change significantly")
+		slog.Info("The index files didn't change significantly")
 
 		changedFiles, err := git.GetChangedFileNames(*repoDir)
-		if err != nil {
-			log.Fatalf("getting changed files: %s\n::endgroup::\n", err.Error())
+		if errors.Is(err, tools.ErrNotFound) {
+			// Without git, changes can't be told apart, and committing them needs git anyway
+			slog.Warn("Can't check which files changed, git isn't installed", "error", err)
+			changedFiles, haveSignificantChanges = nil, true
+		} else if err != nil {
+			fatal("Getting changed files failed", "error", err)
 		}
 
-		// If only the index files changed, we ignore the commit
+		// If only the index files or the state changed, we ignore the commit
 		for _, fname := range changedFiles {
-			if !strings.Contains(fname, "index") {
+			if !strings.Contains(fname, "index") && filepath.Base(fname) != filepath.Base(*statePath) {
 				haveSignificantChanges = true
 
-				log.Printf("File %q is a significant change", fname)
+				slog.Info("Found significant change", "file", fname)
 			}
 		}
 
+		// The state must be committed for the next run to continue with the deferred apps instead of the same ones
+		if !haveSignificantChanges && budget.hasDeferred() {
+			slog.Info("Apps were deferred to the next run, the state that queues them is committed")
+			haveSignificantChanges = true
+		}
+
 		if !haveSignificantChanges {
-			log.Printf("It doesn't look like there were any relevant changes, neither to the index file nor any file indexed by git.")
+			slog.Info("It doesn't look like there were any relevant changes, neither to the index file nor any file indexed by git")
 		}
 	}
 
 	fmt.Println("::endgroup::")
 
 	// If we have an error, we report it as such
-	if haveError {
-		os.Exit(1)
+	if failed(runReport, failurePolicy, len(appsList)) {
+		finish(1)
 	}
 
 	// If we don't have any good changes, we report it with exit code 2
 	if !haveSignificantChanges {
-		os.Exit(2)
+		finish(2)
 	}
 
 	// If we have relevant changes, we exit with code 0
-}
-
-func setNonEmpty(m map[string]interface{}, key string, value string) {
-	if value != "" || m[key] == "Unknown" {
-		m[key] = value
-
-		log.Printf("Set %s to %q", key, value)
-	}
-}
-
-func downloadStream(targetFile string, rc io.ReadCloser) (err error) {
-	defer rc.Close()
-
-	targetTemp := targetFile + ".tmp"
-
-	f, err := os.Create(targetTemp)
-	if err != nil {
-		return
-	}
-
-	_, err = io.Copy(f, rc)
-	if err != nil {
-		_ = f.Close()
-		_ = os.Remove(targetTemp)
-
-		return
-	}
-
-	err = f.Close()
-	if err != nil {
-		return
-	}
-
-	return os.Rename(targetTemp, targetFile)
+	finish(0)
 }
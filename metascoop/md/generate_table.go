@@ -6,7 +6,7 @@ import (
 	"html/template"
 	"os"
 
-	"metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/apps"
 )
 
 const (
@@ -54,5 +54,5 @@ func RegenerateReadme(readMePath string, index *apps.RepoIndex) (err error) {
 	newContent = append(newContent, table.Bytes()...)
 	newContent = append(newContent, content[tableEndIndex:]...)
 
-	return os.WriteFile(readMePath, newContent, os.ModePerm)
+	return os.WriteFile(readMePath, newContent, 0o644)
 }
@@ -0,0 +1,65 @@
+package md
+
+import (
+	"bytes"
+	"html/template"
+	"os"
+)
+
+const (
+	repoInfoStart = "<!-- This repo info is auto-generated. Do not edit -->"
+
+	repoInfoEnd = "<!-- end repo info -->"
+
+	repoInfoTmpl = `
+    ` + "```" + `
+    {{.URL}}
+    ` + "```" + `
+
+    <p align="center">
+      <img src="{{.QRCode}}" alt="F-Droid repo QR code" width="300" height="300"/>
+    </p>
+    `
+)
+
+var repoInfoTemplate = template.Must(template.New("").Parse(repoInfoTmpl))
+
+// RepoInfo is what the README advertises about the repo
+type RepoInfo struct {
+	// URL is the address of the repo with its fingerprint
+	URL string
+
+	// QRCode is the path of the QR code image of URL, relative to the README
+	QRCode string
+}
+
+// UpdateRepoInfo replaces the repo info section of the README with the current URL and QR code. READMEs without
+// the section are left as they are.
+func UpdateRepoInfo(readMePath string, info RepoInfo) (err error) {
+	content, err := os.ReadFile(readMePath)
+	if err != nil {
+		return
+	}
+
+	start := bytes.Index(content, []byte(repoInfoStart))
+	end := bytes.Index(content, []byte(repoInfoEnd))
+	if start < 0 || end < start {
+		return nil
+	}
+
+	var section bytes.Buffer
+	section.WriteString(repoInfoStart)
+
+	err = repoInfoTemplate.Execute(&section, info)
+	if err != nil {
+		return
+	}
+
+	newContent := []byte{}
+
+	newContent = append(newContent, content[:start]...)
+	newContent = append(newContent, section.Bytes()...)
+	newContent = append(newContent, content[end:]...)
+
+	return os.WriteFile(readMePath, newContent, 0o644)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/notes"
+)
+
+// walkMetadataFiles calls fn with the path of every metadata file ("<package>.yml") in the metadata directory
+// dir. A missing directory has no files, fdroid only creates it for the first app that is published.
+func walkMetadataFiles(dir string, fn func(path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if path == dir && errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".yml") {
+			return err
+		}
+		return fn(path)
+	})
+}
+
+// applyAppInfo sets all metadata fields we know from apps.yaml and the upstream repo
+func applyAppInfo(logger *slog.Logger, meta map[string]interface{}, apkInfo apps.AppInfo, latestPackage apps.PackageInfo) {
+	setNonEmpty(logger, meta, "AuthorName", apkInfo.Author())
+	fn := apkInfo.FriendlyName
+	if fn == "" {
+		fn = apkInfo.Name()
+	}
+	setNonEmpty(logger, meta, "Name", fn)
+	setNonEmpty(logger, meta, "SourceCode", apkInfo.GitURL)
+	setNonEmpty(logger, meta, "License", apkInfo.License)
+	setNonEmpty(logger, meta, "Description", apkInfo.Description)
+
+	var summary = apkInfo.Summary
+	// See https://f-droid.org/en/docs/Build_Metadata_Reference/#Summary for max length
+	const maxSummaryLength = 80
+	if len(summary) > maxSummaryLength {
+		summary = summary[:maxSummaryLength-3] + "..."
+
+		logger.Info("Truncated summary to the maximum length", "length", len(summary))
+	}
+
+	setNonEmpty(logger, meta, "Summary", summary)
+
+	if len(apkInfo.Categories) != 0 {
+		meta["Categories"] = apkInfo.Categories
+	}
+
+	if len(apkInfo.AntiFeatures) != 0 {
+		meta["AntiFeatures"] = strings.Join(apkInfo.AntiFeatures, ",")
+	}
+
+	meta["CurrentVersion"] = latestPackage.VersionName
+	meta["CurrentVersionCode"] = latestPackage.VersionCode
+
+	logger.Debug("Set current version", "version", latestPackage.VersionName, "version_code", latestPackage.VersionCode)
+
+	applyOverrides(logger, meta, apkInfo.Overrides)
+}
+
+// applyOverrides sets the fields maintainers configured in the overrides section of apps.yaml
+func applyOverrides(logger *slog.Logger, meta map[string]interface{}, o apps.Overrides) {
+	if len(o.Categories) != 0 {
+		meta["Categories"] = o.Categories
+		logger.Debug("Overrode metadata field", "field", "Categories", "value", strings.Join(o.Categories, ","))
+	}
+
+	for _, f := range []struct{ key, value string }{
+		{"License", o.License},
+		{"AuthorName", o.AuthorName},
+		{"WebSite", o.WebSite},
+		{"IssueTracker", o.IssueTracker},
+		{"Donate", o.Donate},
+		{"Bitcoin", o.Bitcoin},
+	} {
+		if f.value != "" {
+			meta[f.key] = f.value
+			logger.Debug("Overrode metadata field", "field", f.key, "value", f.value)
+		}
+	}
+}
+
+// findSuggestedPackage returns the version clients should be offered by default.
+// For apps on the beta channel that is the latest version that isn't a prerelease. If several apps publish the
+// package, only the versions of the one with the highest priority are considered.
+func findSuggestedPackage(index *apps.RepoIndex, pkgName string, apkInfoMap map[string]apps.AppInfo) (p apps.PackageInfo, ok bool) {
+	preferred := preferredVersions(index.Packages[pkgName], apkInfoMap)
+
+	latest, ok := index.FindLatestPackageFunc(pkgName, preferred)
+	if !ok {
+		return
+	}
+
+	// Pinned apps may have newer versions in the repo, which were published before the pin
+	if info, known := apkInfoMap[latest.ApkName]; known && info.Pin != "" {
+		pinned, found := index.FindLatestPackageFunc(pkgName, func(p apps.PackageInfo) bool {
+			info, known := apkInfoMap[p.ApkName]
+			return known && info.ReleaseTag == info.Pin && preferred(p)
+		})
+		if found {
+			return pinned, true
+		}
+	}
+
+	if info, known := apkInfoMap[latest.ApkName]; !known || info.Channel != apps.ChannelBeta {
+		return latest, true
+	}
+
+	stable, ok := index.FindLatestPackageFunc(pkgName, func(p apps.PackageInfo) bool {
+		info, known := apkInfoMap[p.ApkName]
+		return known && !info.ReleasePrerelease && preferred(p)
+	})
+	if ok {
+		return stable, true
+	}
+
+	// Only prereleases were published so far, so we have to suggest one of them
+	return latest, true
+}
+
+// setVersionAntiFeatures lists the anti-features of the versions that differ from those of the app in "Builds",
+// where fdroidserver (and our own indexer) take them from. Entries of versions that are no longer known are kept.
+// extra returns anti-features of a version that don't come from apps.yaml, e.g. "Tracking" for found trackers.
+func setVersionAntiFeatures(logger *slog.Logger, meta map[string]interface{}, versions []apps.PackageInfo, apkInfoMap map[string]apps.AppInfo, extra func(p apps.PackageInfo, info apps.AppInfo) []string) {
+	builds := make(map[int]map[string]interface{})
+	if old, ok := meta["Builds"].([]interface{}); ok {
+		for _, b := range old {
+			entry, ok := b.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if code, ok := entry["versionCode"].(int); ok {
+				builds[code] = entry
+			}
+		}
+	}
+
+	for _, p := range versions {
+		info, ok := apkInfoMap[p.ApkName]
+		if !ok {
+			continue
+		}
+
+		more := extra(p, info)
+		afs := mergeAntiFeatures(info.ReleaseAntiFeatures(info.ReleaseTag), more)
+		if (!info.HasVersionAntiFeatures() && len(more) == 0) || len(afs) == len(info.AntiFeatures) {
+			delete(builds, p.VersionCode)
+			continue
+		}
+
+		builds[p.VersionCode] = map[string]interface{}{
+			"versionName":  p.VersionName,
+			"versionCode":  p.VersionCode,
+			"antifeatures": afs,
+		}
+		logger.Debug("Set anti-features of version", "version", p.VersionName, "anti_features", strings.Join(afs, ","))
+	}
+
+	if len(builds) == 0 {
+		delete(meta, "Builds")
+		return
+	}
+
+	var codes []int
+	for code := range builds {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
+	var list []interface{}
+	for _, code := range codes {
+		list = append(list, builds[code])
+	}
+	meta["Builds"] = list
+}
+
+func setNonEmpty(logger *slog.Logger, m map[string]interface{}, key string, value string) {
+	if value != "" || m[key] == "Unknown" {
+		m[key] = value
+
+		logger.Debug("Set metadata field", "field", key, "value", value)
+	}
+}
+
+// changedFields returns the sorted keys whose values differ between old and new
+func changedFields(old, new map[string]interface{}) (fields []string) {
+	for k, nv := range new {
+		ov, ok := old[k]
+		// Values read from YAML and values we set might have different types, e.g. []interface{} vs. []string
+		if !ok || (!reflect.DeepEqual(ov, nv) && fmt.Sprint(ov) != fmt.Sprint(nv)) {
+			fields = append(fields, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+
+	sort.Strings(fields)
+
+	return
+}
+
+// copyChangelogs copies the fastlane changelogs of all versions of a package that are in the repo to its
+// metadata directory, where they are picked up as the "what's new" text of that version. They replace the
+// release notes, as they are written specifically for the app store. They are cleaned up like release notes.
+func copyChangelogs(pkgMetadataDir string, versions []apps.PackageInfo, changelogs map[string]map[int]string, clean notes.Options) (written int, err error) {
+	for locale, byVersion := range changelogs {
+		for _, p := range versions {
+			src, ok := byVersion[p.VersionCode]
+			if !ok {
+				continue
+			}
+
+			var content []byte
+			content, err = os.ReadFile(src)
+			if err != nil {
+				return
+			}
+
+			dest := filepath.Join(pkgMetadataDir, locale, "changelogs", fmt.Sprintf("%d.txt", p.VersionCode))
+
+			err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+			if err != nil {
+				return
+			}
+
+			err = os.WriteFile(dest, []byte(clean.Clean(string(content))), 0o644)
+			if err != nil {
+				return
+			}
+
+			written++
+		}
+	}
+
+	return
+}
+
+// copyTexts copies the localized name, summary and description of all fastlane locales to the metadata directory.
+// In the default locale, texts of fields that apps.yaml or the upstream repo already provide are skipped, as
+// clients prefer localized texts over the fields of the metadata file. Texts missing in a locale are taken from
+// the locales it falls back to, filled counts them.
+func copyTexts(pkgMetadataDir string, texts map[string]map[string]string, apkInfo apps.AppInfo, fallback *localeFallback) (written, filled int, err error) {
+	configured := map[string]bool{
+		"title.txt":             apkInfo.FriendlyName != "",
+		"short_description.txt": apkInfo.Summary != "",
+		"full_description.txt":  apkInfo.Description != "",
+	}
+	skip := func(locale, name string) bool {
+		return locale == defaultLocale && configured[name]
+	}
+
+	texts, filled = fallback.fill(texts, skip)
+
+	for locale, files := range texts {
+		for name, src := range files {
+			if skip(locale, name) {
+				continue
+			}
+
+			var content []byte
+			content, err = os.ReadFile(src)
+			if err != nil {
+				return
+			}
+
+			dest := filepath.Join(pkgMetadataDir, locale, name)
+
+			err = os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+			if err != nil {
+				return
+			}
+
+			err = os.WriteFile(dest, []byte(apps.NormalizeText(string(content))), 0o644)
+			if err != nil {
+				return
+			}
+
+			written++
+		}
+	}
+
+	return
+}
+
+// metadataCredentials reads the secrets for private metadata repos from the environment, keyed by repo URL
+func metadataCredentials(appsList []apps.AppInfo) (creds map[string]git.Credentials, err error) {
+	creds = make(map[string]git.Credentials)
+
+	for _, app := range appsList {
+		if app.MetadataTokenEnv == "" && app.MetadataSSHKeyEnv == "" {
+			continue
+		}
+
+		var c git.Credentials
+		if app.MetadataTokenEnv != "" {
+			c.Token = os.Getenv(app.MetadataTokenEnv)
+			if c.Token == "" {
+				return nil, fmt.Errorf("$%s (metadata_token_env of %s) is empty", app.MetadataTokenEnv, app.Name())
+			}
+		}
+		if app.MetadataSSHKeyEnv != "" {
+			c.SSHKey = os.Getenv(app.MetadataSSHKeyEnv)
+			if c.SSHKey == "" {
+				return nil, fmt.Errorf("$%s (metadata_ssh_key_env of %s) is empty", app.MetadataSSHKeyEnv, app.Name())
+			}
+		}
+
+		u := app.MetadataGitURL()
+		if existing, ok := creds[u]; ok && existing != c {
+			return nil, fmt.Errorf("apps using %q must use the same credentials", git.RedactURL(u))
+		}
+		creds[u] = c
+	}
+
+	return
+}
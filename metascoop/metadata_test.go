@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWalkMetadataFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "metadata")
+
+	var paths []string
+	collect := func(path string) error {
+		paths = append(paths, path)
+		return nil
+	}
+
+	// fdroid creates the directory for the first published app only
+	err := walkMetadataFiles(dir, collect)
+	if err != nil || len(paths) != 0 {
+		t.Fatalf("walking a missing metadata directory = %v, %v, want no files and no error", paths, err)
+	}
+
+	for _, name := range []string{"com.example.a.yml", "com.example.b.yml", "com.example.a/en-US/title.txt", "README.md"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = walkMetadataFiles(dir, collect)
+	want := []string{filepath.Join(dir, "com.example.a.yml"), filepath.Join(dir, "com.example.b.yml")}
+	if err != nil || !reflect.DeepEqual(paths, want) {
+		t.Errorf("walkMetadataFiles = %v, %v, want %v", paths, err, want)
+	}
+}
@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Counter = "counter"
+	Gauge   = "gauge"
+)
+
+// Registry holds metrics and writes them in the Prometheus text exposition format. It is safe for concurrent use.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	typ, help string
+
+	// samples are keyed by the formatted label set, e.g. `{type="auth"}`
+	samples map[string]float64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Describe registers a metric, so it shows up with its type and help text even before it has a value
+func (r *Registry) Describe(name, typ, help string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	f := r.family(name, typ, help)
+	f.typ, f.help = typ, help
+}
+
+// family returns the metric called name, r.lock must be held
+func (r *Registry) family(name, typ, help string) *family {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{typ: typ, help: help, samples: make(map[string]float64)}
+		r.families[name] = f
+	}
+	return f
+}
+
+// Set sets the gauge name with the given label pairs ("key", "value", ...) to v
+func (r *Registry) Set(name string, v float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.family(name, Gauge, "").samples[formatLabels(labels)] = v
+}
+
+// Add increases the counter name with the given label pairs ("key", "value", ...) by v
+func (r *Registry) Add(name string, v float64, labels ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.family(name, Counter, "").samples[formatLabels(labels)] += v
+}
+
+// WriteTo writes all metrics sorted by name and labels, so the output only changes if the values do
+func (r *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		f := r.families[name]
+
+		if f.help != "" {
+			fmt.Fprintf(&b, "# HELP %s %s\n", name, escapeHelp(f.help))
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, f.typ)
+
+		var labelSets []string
+		for labels := range f.samples {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+
+		for _, labels := range labelSets {
+			fmt.Fprintf(&b, "%s%s %s\n", name, labels, formatValue(f.samples[labels]))
+		}
+	}
+
+	written, err := io.WriteString(w, b.String())
+	return int64(written), err
+}
+
+// WriteFile writes the metrics to path for the textfile collector of node_exporter. The file is replaced
+// atomically, so the collector never reads a partial file.
+func (r *Registry) WriteFile(path string) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = r.WriteTo(tmp)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+
+	err = os.Chmod(tmp.Name(), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func formatLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	if len(pairs)%2 != 0 {
+		panic("metrics: labels must be given as key/value pairs")
+	}
+
+	var parts []string
+	for i := 0; i < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+`="`+escapeLabel(pairs[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
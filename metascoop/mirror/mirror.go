@@ -0,0 +1,226 @@
+// Package mirror copies the repo directory to download mirrors after it was published, so clients can fetch it
+// from object storage or another web server instead of the git host. Mirrors end up with the same files as the
+// repo directory: new and changed files are uploaded, files that were pruned from the repo are deleted.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	TypeS3    = "s3"
+	TypeRsync = "rsync"
+)
+
+// DefaultIndexCacheControl is the Cache-Control header of index files if the config doesn't set one. Clients
+// must see a new index right away, APKs and graphics are never changed under the same name.
+const DefaultIndexCacheControl = "no-cache"
+
+// Config is the content of the mirrors config file
+type Config struct {
+	Mirrors []*Mirror `yaml:"mirrors"`
+}
+
+// Mirror is a place the repo directory is copied to. Values of endpoint, bucket, access_key_id,
+// secret_access_key, target and ssh_key can reference environment variables like ${S3_SECRET}, so secrets
+// don't have to be in the config file.
+type Mirror struct {
+	// Name is used in logs, it defaults to the type
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// Endpoint is the URL of the S3 API, e.g. "https://s3.eu-central-1.amazonaws.com" or that of another
+	// S3-compatible storage
+	Endpoint string `yaml:"endpoint"`
+
+	// Region is used for signing requests, it defaults to "us-east-1"
+	Region string `yaml:"region"`
+	Bucket string `yaml:"bucket"`
+
+	// Prefix is the directory in the bucket the files are put in, e.g. "fdroid/repo"
+	Prefix string `yaml:"prefix"`
+
+	// AccessKeyID and SecretAccessKey default to $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// PathStyle puts the bucket into the path of URLs instead of the host name, which some S3-compatible
+	// storages need
+	PathStyle bool `yaml:"path_style"`
+
+	// CacheControl is the Cache-Control header of files that aren't index files, none by default.
+	// IndexCacheControl is that of index files, see IsIndex; it defaults to DefaultIndexCacheControl. Only S3
+	// mirrors set headers, for rsync mirrors the web server has to.
+	CacheControl      string `yaml:"cache_control"`
+	IndexCacheControl string `yaml:"index_cache_control"`
+
+	// Target is where rsync copies the files to, e.g. "fdroid@mirror.example.org:/srv/fdroid/repo"
+	Target string `yaml:"target"`
+
+	// SSHKey is the private key rsync connects with, by default ssh uses its own configuration
+	SSHKey string `yaml:"ssh_key"`
+
+	// Args are passed to rsync in addition to the ones that are always used, e.g. ["--chmod=F644"]
+	Args []string `yaml:"args"`
+
+	publisher publisher
+}
+
+// Result counts what a sync changed on the mirror
+type Result struct {
+	Uploaded int
+	Deleted  int
+	Bytes    int64
+}
+
+type publisher interface {
+	sync(ctx context.Context, dir string, files []file) (Result, error)
+}
+
+// file is a file of the repo directory
+type file struct {
+	// rel is the slash-separated path relative to the repo directory
+	rel  string
+	path string
+	size int64
+}
+
+// LoadConfig reads and validates the config file at path
+func LoadConfig(path string) (c Config, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(&c)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	names := make(map[string]bool)
+	for i, m := range c.Mirrors {
+		err = m.init()
+		if err != nil {
+			return c, fmt.Errorf("mirror %d: %w", i+1, err)
+		}
+		if names[m.Name] {
+			return c, fmt.Errorf("there are several mirrors called %q, give them distinct names", m.Name)
+		}
+		names[m.Name] = true
+	}
+
+	return
+}
+
+func (m *Mirror) init() (err error) {
+	if m.Name == "" {
+		m.Name = m.Type
+	}
+	if m.IndexCacheControl == "" {
+		m.IndexCacheControl = DefaultIndexCacheControl
+	}
+
+	m.Endpoint = os.ExpandEnv(m.Endpoint)
+	m.Bucket = os.ExpandEnv(m.Bucket)
+	m.AccessKeyID = os.ExpandEnv(m.AccessKeyID)
+	m.SecretAccessKey = os.ExpandEnv(m.SecretAccessKey)
+	m.Target = os.ExpandEnv(m.Target)
+	m.SSHKey = os.ExpandEnv(m.SSHKey)
+
+	switch m.Type {
+	case TypeS3:
+		m.publisher, err = newS3(m)
+	case TypeRsync:
+		m.publisher, err = newRsync(m)
+	default:
+		err = fmt.Errorf("unknown type %q, must be %q or %q", m.Type, TypeS3, TypeRsync)
+	}
+	return
+}
+
+// Sync makes the mirror contain the same files as the repo directory dir. Index files are uploaded after all
+// other files and files are only deleted at the end, so clients never get an index that lists files the mirror
+// doesn't have yet. Hidden files are left out.
+func (m *Mirror) Sync(ctx context.Context, dir string) (r Result, err error) {
+	files, err := listFiles(dir)
+	if err != nil {
+		return
+	}
+
+	r, err = m.publisher.sync(ctx, dir, files)
+	if err != nil {
+		return r, fmt.Errorf("syncing mirror %q: %w", m.Name, err)
+	}
+	return
+}
+
+// IsIndex reports whether the file at the slash-separated path rel in the repo directory is an index file, i.e.
+// one that's replaced with a new version under the same name: the indexes, their diffs, the website and feeds
+func IsIndex(rel string) bool {
+	base := path.Base(rel)
+	if !strings.Contains(rel, "/") && (strings.HasPrefix(base, "index") || strings.HasPrefix(base, "entry.")) {
+		return true
+	}
+	if strings.HasPrefix(rel, "diff/") {
+		return true
+	}
+	switch path.Ext(base) {
+	case ".html", ".xml", ".css":
+		return true
+	}
+	return false
+}
+
+// listFiles returns the files in dir, those that aren't index files first
+func listFiles(dir string) (files []file, err error) {
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{rel: filepath.ToSlash(rel), path: p, size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return !IsIndex(files[i].rel) && IsIndex(files[j].rel)
+	})
+	return
+}
@@ -0,0 +1,94 @@
+package mirror
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// rsync copies the files with the rsync command, usually over SSH
+type rsync struct {
+	m *Mirror
+}
+
+func newRsync(m *Mirror) (r *rsync, err error) {
+	if m.Target == "" {
+		return nil, fmt.Errorf("rsync mirrors need a target")
+	}
+	if _, err = tools.Path("rsync"); err != nil {
+		return nil, fmt.Errorf("rsync mirrors need the rsync command: %w", err)
+	}
+	return &rsync{m: m}, nil
+}
+
+// sync runs rsync twice: first for the files that aren't index files, then for the whole directory, which
+// uploads the indexes and deletes the files that are gone from the repo. Files are compared by checksum, as a
+// fresh checkout of the repo has new modification times.
+func (r *rsync) sync(ctx context.Context, dir string, files []file) (res Result, err error) {
+	var list bytes.Buffer
+	for _, f := range files {
+		if !IsIndex(f.rel) {
+			list.WriteString(f.rel + "\n")
+		}
+	}
+
+	src := strings.TrimSuffix(dir, string(os.PathSeparator)) + string(os.PathSeparator)
+	target := strings.TrimSuffix(r.m.Target, "/") + "/"
+
+	out, err := r.run(ctx, &list, "--files-from=-", src, target)
+	if err != nil {
+		return
+	}
+	count(out, &res)
+
+	out, err = r.run(ctx, nil, "--recursive", "--delete", "--delete-after", "--exclude=.*", src, target)
+	if err != nil {
+		return
+	}
+	count(out, &res)
+
+	return
+}
+
+func (r *rsync) run(ctx context.Context, stdin *bytes.Buffer, args ...string) (out []byte, err error) {
+	base := []string{"--links", "--checksum", "--delay-updates", "--out-format=%i %l %n"}
+	if r.m.SSHKey != "" {
+		base = append(base, "--rsh=ssh -i "+r.m.SSHKey+" -o BatchMode=yes")
+	}
+	args = append(append(base, r.m.Args...), args...)
+
+	cmd := tools.CommandContext(ctx, "rsync", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err = cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("running rsync: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return
+}
+
+// count adds the files rsync reported as sent or deleted to res
+func count(out []byte, res *Result) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		switch {
+		case strings.HasPrefix(fields[0], "*deleting"):
+			res.Deleted++
+		case strings.HasPrefix(fields[0], "<f") && len(fields) == 3:
+			res.Uploaded++
+			var size int64
+			fmt.Sscan(fields[1], &size)
+			res.Bytes += size
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hex SHA-256 digest of an empty request body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3 uploads to an S3 bucket with single PUT requests, so files must be smaller than 5 GB
+type s3 struct {
+	m       *Mirror
+	client  *http.Client
+	baseURL *url.URL
+}
+
+func newS3(m *Mirror) (s *s3, err error) {
+	if m.Endpoint == "" || m.Bucket == "" {
+		return nil, fmt.Errorf("s3 mirrors need an endpoint and a bucket")
+	}
+	if m.Region == "" {
+		m.Region = "us-east-1"
+	}
+	if m.AccessKeyID == "" {
+		m.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if m.SecretAccessKey == "" {
+		m.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if m.AccessKeyID == "" || m.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 mirrors need access_key_id and secret_access_key, or $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY")
+	}
+	m.Prefix = strings.Trim(m.Prefix, "/")
+
+	u, err := url.Parse(m.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, fmt.Errorf("invalid endpoint %q, must be an http(s) URL", m.Endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if m.PathStyle {
+		u.Path += "/" + m.Bucket
+	} else {
+		u.Host = m.Bucket + "." + u.Host
+	}
+
+	return &s3{m: m, client: &http.Client{Timeout: 30 * time.Minute}, baseURL: u}, nil
+}
+
+// object is an object in the bucket as listed by ListObjectsV2
+type object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+func (s *s3) key(rel string) string {
+	if s.m.Prefix == "" {
+		return rel
+	}
+	return s.m.Prefix + "/" + rel
+}
+
+func (s *s3) sync(ctx context.Context, dir string, files []file) (r Result, err error) {
+	remote, err := s.list(ctx)
+	if err != nil {
+		return r, fmt.Errorf("listing bucket: %w", err)
+	}
+
+	for _, f := range files {
+		key := s.key(f.rel)
+		o, exists := remote[key]
+		delete(remote, key)
+
+		md5sum, sha, err := digests(f.path)
+		if err != nil {
+			return r, err
+		}
+		// ETags of objects uploaded in one part are their MD5 digest
+		if exists && o.Size == f.size && strings.Trim(o.ETag, `"`) == md5sum {
+			continue
+		}
+
+		err = s.put(ctx, key, f, sha)
+		if err != nil {
+			return r, fmt.Errorf("uploading %q: %w", f.rel, err)
+		}
+		r.Uploaded++
+		r.Bytes += f.size
+	}
+
+	keys := make([]string, 0, len(remote))
+	for key := range remote {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err = s.do(ctx, http.MethodDelete, key, nil, nil, emptySHA256, nil, nil)
+		if err != nil {
+			return r, fmt.Errorf("deleting %q: %w", key, err)
+		}
+		r.Deleted++
+	}
+
+	return
+}
+
+// list returns the objects below the prefix by key
+func (s *s3) list(ctx context.Context) (objects map[string]object, err error) {
+	objects = make(map[string]object)
+
+	prefix := ""
+	if s.m.Prefix != "" {
+		prefix = s.m.Prefix + "/"
+	}
+
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var page struct {
+			Contents              []object `xml:"Contents"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = s.do(ctx, http.MethodGet, "", query, nil, emptySHA256, nil, &page)
+		if err != nil {
+			return
+		}
+
+		for _, o := range page.Contents {
+			objects[o.Key] = o
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (s *s3) put(ctx context.Context, key string, f file, sha string) (err error) {
+	content, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer content.Close()
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType(f.rel))
+	cacheControl := s.m.CacheControl
+	if IsIndex(f.rel) {
+		cacheControl = s.m.IndexCacheControl
+	}
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+
+	return s.do(ctx, http.MethodPut, key, nil, &sizedReader{content, f.size}, sha, header, nil)
+}
+
+// sizedReader is a request body of known length
+type sizedReader struct {
+	io.Reader
+	size int64
+}
+
+// do sends a signed request for key, or the bucket if key is empty, and decodes the XML response into result if
+// it isn't nil
+func (s *s3) do(ctx context.Context, method, key string, query url.Values, body *sizedReader, payloadSHA256 string, header http.Header, result interface{}) (err error) {
+	u := *s.baseURL
+	u.Path += "/" + key
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+
+	var reader io.Reader
+	if body != nil {
+		reader = body.Reader
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return
+	}
+	if body != nil {
+		req.ContentLength = body.size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, payloadSHA256, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, u.Path, e.Code, e.Message)
+		}
+		return fmt.Errorf("%s %s: unexpected status %s", method, u.Path, resp.Status)
+	}
+
+	if result != nil {
+		err = xml.Unmarshal(data, result)
+	}
+	return
+}
+
+// sign adds an AWS Signature Version 4 to req
+func (s *s3) sign(req *http.Request, payloadSHA256 string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA256)
+
+	// Only the host and the x-amz-* headers are signed, proxies may change the others
+	signed := []string{"host"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n"
+	var amz []string
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			amz = append(amz, lk)
+		}
+	}
+	sort.Strings(amz)
+	for _, k := range amz {
+		signed = append(signed, k)
+		canonicalHeaders += k + ":" + strings.TrimSpace(req.Header.Get(k)) + "\n"
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadSHA256,
+	}, "\n")
+
+	scope := date + "/" + s.m.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.m.SecretAccessKey)
+	for _, part := range []string{date, s.m.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.m.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// digests returns the hex MD5 and SHA-256 digests of the file at p
+func digests(p string) (md5sum, sha string, err error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	m, s := md5.New(), sha256.New()
+	_, err = io.Copy(io.MultiWriter(m, s), f)
+	if err != nil {
+		return
+	}
+	return hex.EncodeToString(m.Sum(nil)), hex.EncodeToString(s.Sum(nil)), nil
+}
+
+// escape encodes s as S3 expects in canonical requests: everything except unreserved characters, and slashes if
+// keepSlash is set
+func escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(p string) string {
+	return escape(p, true)
+}
+
+// canonicalQuery encodes query sorted by key, which is also how it's sent
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		for _, v := range query[k] {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(escape(k, false) + "=" + escape(v, false))
+		}
+	}
+	return b.String()
+}
+
+// contentType returns the media type of the file at rel, which browsers and clients use for downloads
+func contentType(rel string) string {
+	switch path.Ext(rel) {
+	case ".apk":
+		return "application/vnd.android.package-archive"
+	case ".jar":
+		return "application/java-archive"
+	case ".json":
+		return "application/json"
+	}
+	if t := mime.TypeByExtension(path.Ext(rel)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// setAppGitURL replaces the git URL of the entry name in the apps file it's defined in with gitURL, e.g. after the
+// upstream repo was renamed. Only that value is changed, the other entries and their formatting stay as they are.
+func setAppGitURL(appsFilePath, name, gitURL string) (err error) {
+	path, err := appFile(appsFilePath, name)
+	if err != nil {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%q doesn't contain a mapping of apps", path)
+	}
+
+	var value *yaml.Node
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != name {
+			continue
+		}
+		entry := root.Content[i+1]
+		if entry.Style&yaml.FlowStyle != 0 {
+			return fmt.Errorf("the entry %q is written in flow style, change its git URL by hand", name)
+		}
+		for j := 0; entry.Kind == yaml.MappingNode && j+1 < len(entry.Content); j += 2 {
+			if entry.Content[j].Value == "git" {
+				value = entry.Content[j+1]
+			}
+		}
+		break
+	}
+	if value == nil {
+		return fmt.Errorf("the entry %q in %q doesn't set a git URL", name, path)
+	}
+	if value.Kind != yaml.ScalarNode || value.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return fmt.Errorf("the git URL of %q isn't a single-line value", name)
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	line := lines[value.Line-1]
+	eol := line[len(strings.TrimRight(line, "\r\n")):]
+
+	// The rest of the line is the old value and maybe a comment, which is kept
+	replaced := line[:value.Column-1] + gitURL
+	if value.LineComment != "" {
+		replaced += " " + value.LineComment
+	}
+	lines[value.Line-1] = replaced + eol
+
+	err = replaceAppsFile(appsFilePath, path, []byte(strings.Join(lines, "")))
+	if err != nil {
+		return fmt.Errorf("updating the git URL: %w", err)
+	}
+
+	list, err := apps.ParseAppFile(appsFilePath)
+	if err != nil {
+		return
+	}
+	for _, app := range list {
+		if app.Name() == name && app.GitURL != gitURL {
+			_ = os.WriteFile(path, content, 0o644)
+			return fmt.Errorf("updating the git URL: the entry has git URL %q instead", app.GitURL)
+		}
+	}
+	return
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/file"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// apkNamesFile is the file in the fdroid directory that remembers the release names of renamed APKs
+const apkNamesFile = "apk-names.json"
+
+// apkNames remembers the releases of the APKs that were renamed with a file name template. Release names start
+// with the app and contain the tag, see apps.GenerateReleaseFilename, which is how APKs are attributed to apps and
+// found again by later runs. Renamed APKs are looked up by the names they'd have without template. Its methods are
+// safe for concurrent use, a nil *apkNames has no renamed APKs.
+type apkNames struct {
+	path string
+
+	lock sync.Mutex
+
+	// Files maps the names of renamed APKs to their release names
+	Files map[string]string `json:"files"`
+}
+
+// loadAPKNames reads the names of the fdroid directory. A missing file means no APK was renamed so far.
+func loadAPKNames(fdroidDir string) (n *apkNames, err error) {
+	n = &apkNames{path: filepath.Join(fdroidDir, apkNamesFile), Files: make(map[string]string)}
+
+	data, err := os.ReadFile(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, n)
+	if n.Files == nil {
+		n.Files = make(map[string]string)
+	}
+	return
+}
+
+// releaseName returns the name the APK called name would have without template
+func (n *apkNames) releaseName(name string) string {
+	if n == nil {
+		return name
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if release, ok := n.Files[name]; ok {
+		return release
+	}
+	return name
+}
+
+// repoName returns the name of the APK with the release name release, which differs if it was renamed
+func (n *apkNames) repoName(release string) string {
+	if n == nil {
+		return release
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for name, r := range n.Files {
+		if r == release {
+			return name
+		}
+	}
+	return release
+}
+
+func (n *apkNames) add(name, release string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.Files[name] = release
+}
+
+// save writes the names back to their file. Names of APKs that are neither in the repo nor in the archive anymore
+// are dropped.
+func (n *apkNames) save() (err error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	fdroidDir := filepath.Dir(n.path)
+	for name := range n.Files {
+		_, rerr := os.Stat(filepath.Join(fdroidDir, "repo", name))
+		_, aerr := os.Stat(filepath.Join(fdroidDir, "archive", name))
+		if rerr != nil && aerr != nil {
+			delete(n.Files, name)
+		}
+	}
+
+	if len(n.Files) == 0 {
+		err = os.Remove(n.path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return
+	}
+	return writeIfChanged(n.path, append(data, '\n'))
+}
+
+// renameAPKs gives the APKs that were added to the repo in this run the names of the file name templates of their
+// apps. They are added under their release names, as most variables are only known from the APK, and the run and
+// maps that refer to them are updated. An APK whose new name is taken is removed, it's a version the template
+// doesn't tell apart from another one.
+func renameAPKs(r apkRenames, paths []string, defaultTemplate string) {
+	renamed := make(map[string]string)
+	for _, path := range paths {
+		base := filepath.Base(path)
+		info, ok := r.apkInfoMap[base]
+		if !ok {
+			continue
+		}
+		template := info.FileNameTemplate
+		if template == "" {
+			template = defaultTemplate
+		}
+		if template == "" {
+			continue
+		}
+
+		m, err := apk.ReadManifest(path)
+		if err != nil {
+			// APKs that were rejected aren't in the repo anymore
+			continue
+		}
+
+		release := r.names.releaseName(base)
+		abi := apps.AssetABI(release)
+		if release != apps.GenerateSplitReleaseFilename(info.Name(), info.ReleaseTag, abi) {
+			abi = ""
+		}
+
+		name := apps.GenerateTemplateFilename(template, apps.FileNameVariables{
+			App:         info.Name(),
+			Tag:         info.ReleaseTag,
+			Package:     m.Package,
+			VersionName: m.VersionName,
+			VersionCode: m.VersionCode,
+			ABI:         abi,
+		})
+		if name == base {
+			continue
+		}
+
+		newPath := filepath.Join(filepath.Dir(path), name)
+		if _, err := os.Stat(newPath); err == nil {
+			slog.Error("Removing APK, its name from the file name template is taken", "app", info.Name(), "path", path, "name", name)
+			r.addError(info.Name(), fmt.Errorf("the file name template %q names %q like another APK in the repo, add a variable that tells them apart", template, base))
+			_ = os.Remove(path)
+			continue
+		}
+
+		err = file.Move(path, newPath)
+		if err != nil {
+			r.addError(info.Name(), fmt.Errorf("renaming %q to %q: %w", base, name, err))
+			continue
+		}
+		slog.Info("Renamed APK with the file name template", "app", info.Name(), "from", base, "to", name)
+
+		r.names.add(name, release)
+		_, _ = r.digests.File(newPath)
+		r.attested.rename(path, newPath)
+		r.releases.rename(path, newPath)
+
+		r.apkInfoMap[name] = info
+		delete(r.apkInfoMap, base)
+		if asset, ok := r.downloadAssets[path]; ok {
+			r.downloadAssets[newPath] = asset
+			delete(r.downloadAssets, path)
+		}
+		renamed[path] = newPath
+	}
+
+	for path, newPath := range renamed {
+		r.run.Rename(path, newPath)
+	}
+}
+
+// apkRenames is what renameAPKs updates
+type apkRenames struct {
+	names          *apkNames
+	run            *scoop.Run
+	apkInfoMap     map[string]apps.AppInfo
+	downloadAssets map[string]string
+	attested       *attestations
+	releases       *releaseArchive
+	digests        *download.Digests
+	addError       func(app string, err error)
+}
@@ -0,0 +1,183 @@
+// Package notes turns release notes and changelogs into the plain text F-Droid clients show as "what's new".
+// Release notes on GitHub are usually Markdown, often contain HTML and emoji shortcodes and are longer than the
+// 500 characters fastlane allows for changelogs. Clients show the text as it is, so all of that would end up in
+// the app list of users.
+package notes
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// FormatPlain converts Markdown and HTML to plain text
+	FormatPlain = "plain"
+
+	// FormatKeep leaves the text as it is, it's only shortened
+	FormatKeep = "keep"
+)
+
+// MaxLength is the length limit of fastlane changelogs
+const MaxLength = 500
+
+// ellipsis ends shortened texts
+const ellipsis = "…"
+
+// Options configure how texts are cleaned up
+type Options struct {
+	// Format is FormatPlain or FormatKeep
+	Format string
+
+	// MaxLength is the maximum number of characters, longer texts are shortened. 0 disables the limit.
+	MaxLength int
+}
+
+// Valid reports whether the format is known
+func (o Options) Valid() bool {
+	return o.Format == FormatPlain || o.Format == FormatKeep
+}
+
+// Clean converts text according to the format and shortens it to the maximum length
+func (o Options) Clean(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	if o.Format == FormatPlain {
+		text = PlainText(text)
+	}
+	return Truncate(strings.TrimSpace(text), o.MaxLength)
+}
+
+var (
+	htmlComment   = regexp.MustCompile(`(?s)<!--.*?-->`)
+	autolink      = regexp.MustCompile(`<((?:https?|mailto):[^>\s]+)>`)
+	htmlBreak     = regexp.MustCompile(`(?i)<br\s*/?>|</(?:p|div|li|h[1-6]|tr)>`)
+	htmlListItem  = regexp.MustCompile(`(?i)<li(?:\s[^>]*)?>`)
+	htmlTag       = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	fence         = regexp.MustCompile("^\\s*(?:```|~~~)")
+	heading       = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*?)(?:\s+#+)?\s*$`)
+	rule          = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,}|=+)$`)
+	quote         = regexp.MustCompile(`^\s{0,3}>\s?`)
+	bullet        = regexp.MustCompile(`^(\s*)[*+-]\s+(?:\[[ xX]\]\s+)?`)
+	refDefinition = regexp.MustCompile(`^\s{0,3}\[[^\]]+\]:\s*\S+.*$`)
+	image         = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	link          = regexp.MustCompile(`\[([^\]]+)\](?:\([^)]*\)|\[[^\]]*\])`)
+	code          = regexp.MustCompile("`+([^`]+)`+")
+	strong        = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	emphasis      = regexp.MustCompile(`(^|[^\w*])\*(\S(?:[^*]*?\S)?)\*($|[^\w*])|(^|[^\w])_(\S(?:[^_]*?\S)?)_($|[^\w])`)
+	strikethrough = regexp.MustCompile(`~~(.+?)~~`)
+	shortcode     = regexp.MustCompile(`(^|[\s(])(:[a-z][a-z0-9_+-]*:)`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+// emoji are the shortcodes that are common in release notes. Others are removed, clients would show them as text.
+var emoji = map[string]string{
+	":tada:":                 "🎉",
+	":sparkles:":             "✨",
+	":rocket:":               "🚀",
+	":bug:":                  "🐛",
+	":fire:":                 "🔥",
+	":warning:":              "⚠️",
+	":lock:":                 "🔒",
+	":zap:":                  "⚡",
+	":art:":                  "🎨",
+	":memo:":                 "📝",
+	":wrench:":               "🔧",
+	":recycle:":              "♻️",
+	":boom:":                 "💥",
+	":lipstick:":             "💄",
+	":globe_with_meridians:": "🌐",
+	":white_check_mark:":     "✅",
+	":heavy_check_mark:":     "✔️",
+	":x:":                    "❌",
+	":construction:":         "🚧",
+	":arrow_up:":             "⬆️",
+	":arrow_down:":           "⬇️",
+	":heavy_plus_sign:":      "➕",
+	":heavy_minus_sign:":     "➖",
+	":new:":                  "🆕",
+	":star:":                 "⭐",
+	":heart:":                "❤️",
+	":package:":              "📦",
+	":wastebasket:":          "🗑️",
+	":iphone:":               "📱",
+	":speech_balloon:":       "💬",
+}
+
+// PlainText converts the Markdown and HTML in text to plain text: markup is removed, links are replaced by their
+// text, list items start with "- " and emoji shortcodes are replaced by the emoji.
+func PlainText(text string) string {
+	text = htmlComment.ReplaceAllString(text, "")
+	text = autolink.ReplaceAllString(text, "$1")
+	text = htmlListItem.ReplaceAllString(text, "- ")
+	text = htmlBreak.ReplaceAllString(text, "\n")
+	text = htmlTag.ReplaceAllString(text, "")
+
+	var lines []string
+	inFence := false
+	for _, line := range strings.Split(text, "\n") {
+		if fence.MatchString(line) {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			lines = append(lines, strings.TrimRight(line, " \t"))
+			continue
+		}
+		if refDefinition.MatchString(line) {
+			continue
+		}
+		if rule.MatchString(line) {
+			// Underlines of setext headings and horizontal rules, a blank line separates the sections
+			lines = append(lines, "")
+			continue
+		}
+
+		line = quote.ReplaceAllString(line, "")
+		line = heading.ReplaceAllString(line, "$1")
+		line = bullet.ReplaceAllString(line, "$1- ")
+		lines = append(lines, strings.TrimRight(inline(line), " \t"))
+	}
+
+	text = html.UnescapeString(strings.Join(lines, "\n"))
+	return strings.TrimSpace(blankLines.ReplaceAllString(text, "\n\n"))
+}
+
+// inline removes the inline markup of a line
+func inline(line string) string {
+	line = image.ReplaceAllString(line, "$1")
+	line = link.ReplaceAllString(line, "$1")
+	line = code.ReplaceAllString(line, "$1")
+	line = strong.ReplaceAllString(line, "$1$2")
+	// Both sides of emphasis are matched, so adjacent ones need a second pass
+	for i := 0; i < 2; i++ {
+		line = emphasis.ReplaceAllString(line, "$1$2$3$4$5$6")
+	}
+	line = strikethrough.ReplaceAllString(line, "$1")
+
+	return shortcode.ReplaceAllStringFunc(line, func(match string) string {
+		m := shortcode.FindStringSubmatch(match)
+		return m[1] + emoji[m[2]]
+	})
+}
+
+// Truncate shortens text to at most max characters, including the ellipsis it ends with then. It cuts at the end
+// of a line or a word if one is near the limit. A max of 0 returns text as it is.
+func Truncate(text string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(text) <= max {
+		return text
+	}
+
+	runes := []rune(text)
+	cut := string(runes[:max-utf8.RuneCountInString(ellipsis)])
+
+	// Cutting at a line or word boundary must not lose more than a fifth of the text
+	minimum := len(cut) * 4 / 5
+	if i := strings.LastIndex(cut, "\n"); i >= minimum {
+		cut = cut[:i]
+	} else if i := strings.LastIndexAny(cut, " \t"); i >= minimum {
+		cut = cut[:i]
+	}
+
+	return strings.TrimRight(cut, " \t\n.,;:-") + ellipsis
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/notify"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// notifications decides which events of a run are sent to which notifiers
+type notifications struct {
+	config notify.Config
+	state  *notify.State
+	apps   []apps.AppInfo
+}
+
+func newNotifications(configPath, statePath string, appsList []apps.AppInfo) (n *notifications, err error) {
+	config, err := notify.LoadConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", configPath, err)
+	}
+
+	err = checkNotifiers(config, configPath, appsList)
+	if err != nil {
+		return
+	}
+
+	state, err := notify.LoadState(statePath)
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", statePath, err)
+	}
+
+	return &notifications{config: config, state: state, apps: appsList}, nil
+}
+
+// checkNotifiers returns an error if an app uses a notifier that isn't in config
+func checkNotifiers(config notify.Config, configPath string, appsList []apps.AppInfo) error {
+	known := make(map[string]bool)
+	for _, notifier := range config.Notifiers {
+		known[notifier.Name] = true
+	}
+	for _, app := range appsList {
+		for _, name := range app.Notify.Notifiers {
+			if !known[name] {
+				return fmt.Errorf("app %q uses notifier %q, which isn't in %q", app.Name(), name, configPath)
+			}
+		}
+	}
+	return nil
+}
+
+// notifiers returns the notifiers that receive events of kind about app
+func (n *notifications) notifiers(app apps.AppInfo, kind string) (list []*notify.Notifier) {
+	if app.Notify.Disabled {
+		return nil
+	}
+
+	for _, notifier := range n.config.Notifiers {
+		if !notifier.Wants(kind) {
+			continue
+		}
+
+		selected := len(app.Notify.Notifiers) == 0
+		for _, name := range app.Notify.Notifiers {
+			selected = selected || name == notifier.Name
+		}
+		if selected {
+			list = append(list, notifier)
+		}
+	}
+
+	return
+}
+
+// send records which apps failed and posts the events of the run. Versions are only announced if published is
+// set, i.e. the run succeeded and its changes are committed. Failures of notifiers are only logged.
+func (n *notifications) send(r *report.Report, published bool) {
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for _, app := range n.apps {
+		a, ok := r.Apps[app.Name()]
+		if !ok {
+			continue
+		}
+
+		var events []notify.Event
+
+		failures := n.state.Record(app.Name(), len(a.Errors) > 0)
+
+		threshold := n.config.FailureThreshold
+		if app.Notify.FailureThreshold > 0 {
+			threshold = app.Notify.FailureThreshold
+		}
+		// Only once per streak, not in every run until it's fixed
+		if failures == threshold {
+			events = append(events, notify.Event{
+				Kind:     notify.EventFailing,
+				App:      app.Name(),
+				Failures: failures,
+				Errors:   a.Errors,
+				Message:  fmt.Sprintf("Updating %s failed in %d consecutive runs: %s", app.Name(), failures, a.Errors[0]),
+			})
+		}
+
+		if published && len(a.VersionsAdded) > 0 {
+			events = append(events, notify.Event{
+				Kind:     notify.EventPublished,
+				App:      app.Name(),
+				Versions: a.VersionsAdded,
+				Message:  fmt.Sprintf("%s %s was published", app.Name(), strings.Join(a.VersionsAdded, ", ")),
+			})
+		}
+
+		// Sent even if the run failed, a blocked change is what keeps the app from being updated
+		if c := a.LicenseChange; c != nil && c.NonFree {
+			what := "its new versions are published anyway"
+			if c.Blocked {
+				what = "new versions are blocked until overrides.license is set in apps.yaml"
+			}
+			events = append(events, notify.Event{
+				Kind:            notify.EventLicenseChanged,
+				App:             app.Name(),
+				PreviousLicense: c.Previous,
+				License:         c.Current,
+				Message:         fmt.Sprintf("The upstream license of %s changed from %s to %s, which isn't a known FOSS license, %s", app.Name(), c.Previous, c.Current, what),
+			})
+		}
+
+		for _, e := range events {
+			for _, notifier := range n.notifiers(app, e.Kind) {
+				err := notifier.Send(context.Background(), client, e)
+				if err != nil {
+					slog.Error("Sending notification failed", "app", app.Name(), "event", e.Kind, "notifier", notifier.Name, "error", err)
+					continue
+				}
+				slog.Info("Sent notification", "app", app.Name(), "event", e.Kind, "notifier", notifier.Name)
+			}
+		}
+	}
+
+	err := n.state.Save()
+	if err != nil {
+		slog.Error("Writing notification state failed", "error", err)
+	}
+}
@@ -0,0 +1,289 @@
+// Package notify posts messages about published versions and failing apps to chat services and webhooks
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EventPublished is sent when new versions of an app were added to the repo
+	EventPublished = "published"
+
+	// EventFailing is sent when an app failed in Config.FailureThreshold consecutive runs
+	EventFailing = "failing"
+
+	// EventLicenseChanged is sent when the upstream license of an app changed from a FOSS license to another one
+	EventLicenseChanged = "license_changed"
+)
+
+const (
+	TypeWebhook  = "webhook"
+	TypeDiscord  = "discord"
+	TypeTelegram = "telegram"
+	TypeMatrix   = "matrix"
+)
+
+// DefaultFailureThreshold is used if the config doesn't set a threshold
+const DefaultFailureThreshold = 3
+
+// Event is something that happened to an app during a run
+type Event struct {
+	Kind string `json:"event"`
+	App  string `json:"app"`
+
+	// Versions are the published versions, for EventPublished
+	Versions []string `json:"versions,omitempty"`
+
+	// Failures is the number of consecutive failed runs and Errors are those of this run, for EventFailing
+	Failures int      `json:"failures,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+
+	// PreviousLicense and License are the SPDX identifiers before and after the change, for EventLicenseChanged
+	PreviousLicense string `json:"previous_license,omitempty"`
+	License         string `json:"license,omitempty"`
+
+	// Message is a human-readable description of the event
+	Message string `json:"message"`
+}
+
+// Config is the content of the notification config file
+type Config struct {
+	Notifiers []*Notifier `yaml:"notifiers"`
+
+	// FailureThreshold is the number of consecutive runs an app has to fail in before EventFailing is sent
+	FailureThreshold int `yaml:"failure_threshold"`
+}
+
+// Notifier is a chat room or webhook that receives messages. Values of url, token, chat_id, room and headers can
+// reference environment variables like ${DISCORD_WEBHOOK}, so secrets don't have to be in the config file.
+type Notifier struct {
+	// Name is used to select notifiers per app, it defaults to the type
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+
+	// URL is a template for the URL messages are sent to, e.g. "https://discord.com/api/webhooks/${ID}/${TOKEN}".
+	// Values from the event must be escaped, e.g. "?app={{query .App}}". For Matrix, it's the URL of the homeserver.
+	URL string `yaml:"url"`
+
+	// Events are the kinds of events sent to this notifier, all by default
+	Events []string `yaml:"events"`
+
+	// Body is the template of the request body of webhooks. The default is the event as JSON.
+	Body    string            `yaml:"body"`
+	Headers map[string]string `yaml:"headers"`
+
+	// ChatID is the Telegram chat messages are sent to
+	ChatID string `yaml:"chat_id"`
+
+	// Room and Token are the Matrix room ID (or alias) and access token
+	Room  string `yaml:"room"`
+	Token string `yaml:"token"`
+
+	url  *template.Template
+	body *template.Template
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"join":  strings.Join,
+	"query": url.QueryEscape,
+	"path":  url.PathEscape,
+}
+
+// LoadConfig reads and validates the config file at path
+func LoadConfig(path string) (c Config, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = yaml.NewDecoder(f).Decode(&c)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+
+	names := make(map[string]bool)
+	for i, n := range c.Notifiers {
+		err = n.init()
+		if err != nil {
+			return c, fmt.Errorf("notifier %d: %w", i+1, err)
+		}
+		if names[n.Name] {
+			return c, fmt.Errorf("there are several notifiers called %q, give them distinct names", n.Name)
+		}
+		names[n.Name] = true
+	}
+
+	return
+}
+
+func (n *Notifier) init() (err error) {
+	switch n.Type {
+	case TypeWebhook, TypeDiscord, TypeTelegram:
+	case TypeMatrix:
+		if n.Room == "" || n.Token == "" {
+			return fmt.Errorf("matrix notifiers need a room and a token")
+		}
+	default:
+		return fmt.Errorf("unknown type %q, must be one of %q, %q, %q or %q", n.Type, TypeWebhook, TypeDiscord, TypeTelegram, TypeMatrix)
+	}
+	if n.Type == TypeTelegram && n.ChatID == "" {
+		return fmt.Errorf("telegram notifiers need a chat_id")
+	}
+	if n.Name == "" {
+		n.Name = n.Type
+	}
+
+	for _, e := range n.Events {
+		if e != EventPublished && e != EventFailing && e != EventLicenseChanged {
+			return fmt.Errorf("unknown event %q, must be %q, %q or %q", e, EventPublished, EventFailing, EventLicenseChanged)
+		}
+	}
+
+	n.URL = os.ExpandEnv(n.URL)
+	n.ChatID = os.ExpandEnv(n.ChatID)
+	n.Room = os.ExpandEnv(n.Room)
+	n.Token = os.ExpandEnv(n.Token)
+	for k, v := range n.Headers {
+		n.Headers[k] = os.ExpandEnv(v)
+	}
+
+	if n.URL == "" {
+		return fmt.Errorf("url must be set")
+	}
+	n.url, err = template.New("url").Funcs(funcs).Parse(n.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url template: %w", err)
+	}
+
+	if n.Body != "" {
+		if n.Type != TypeWebhook {
+			return fmt.Errorf("only webhooks have a body template")
+		}
+		n.body, err = template.New("body").Funcs(funcs).Parse(n.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body template: %w", err)
+		}
+	}
+
+	return
+}
+
+// Wants reports whether the notifier is interested in events of the given kind
+func (n *Notifier) Wants(kind string) bool {
+	if len(n.Events) == 0 {
+		return true
+	}
+	for _, e := range n.Events {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// maxMessageLength is less than what Discord (2000) and Telegram (4096) accept
+const maxMessageLength = 1900
+
+var txnCounter atomic.Int64
+
+// Send posts the event
+func (n *Notifier) Send(ctx context.Context, client *http.Client, e Event) (err error) {
+	u, err := execute(n.url, e)
+	if err != nil {
+		return
+	}
+
+	msg := e.Message
+	if len(msg) > maxMessageLength {
+		msg = strings.ToValidUTF8(msg[:maxMessageLength], "") + "…"
+	}
+
+	method := http.MethodPost
+	var body []byte
+
+	switch n.Type {
+	case TypeWebhook:
+		if n.body != nil {
+			var b string
+			b, err = execute(n.body, e)
+			body = []byte(b)
+		} else {
+			body, err = json.Marshal(e)
+		}
+	case TypeDiscord:
+		body, err = json.Marshal(map[string]string{"content": msg})
+	case TypeTelegram:
+		body, err = json.Marshal(map[string]string{"chat_id": n.ChatID, "text": msg})
+	case TypeMatrix:
+		// Sending requires a transaction ID that's unique per access token
+		txn := fmt.Sprintf("metascoop-%d-%d", time.Now().UnixNano(), txnCounter.Add(1))
+		u = strings.TrimSuffix(u, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(n.Room) + "/send/m.room.message/" + txn
+		method = http.MethodPut
+		body, err = json.Marshal(map[string]string{"msgtype": "m.text", "body": msg})
+	}
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Type == TypeMatrix {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	for k, v := range n.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL often contains a secret, which is part of the error
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("sending to %s: %w", n.Name, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sending to %s: unexpected status %s", n.Name, resp.Status)
+	}
+
+	return
+}
+
+func execute(t *template.Template, e Event) (s string, err error) {
+	var buf strings.Builder
+	err = t.Execute(&buf, e)
+	return buf.String(), err
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// State remembers for how many consecutive runs each app has failed
+type State struct {
+	path string
+
+	Failures map[string]int `json:"failures"`
+}
+
+// LoadState reads the state file at path. A missing file results in an empty state.
+func LoadState(path string) (s *State, err error) {
+	s = &State{path: path, Failures: make(map[string]int)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, s)
+	if s.Failures == nil {
+		s.Failures = make(map[string]int)
+	}
+
+	return
+}
+
+// Record adds the outcome of a run of app and returns the number of consecutive failed runs
+func (s *State) Record(app string, failed bool) (failures int) {
+	if !failed {
+		delete(s.Failures, app)
+		return 0
+	}
+
+	s.Failures[app]++
+	return s.Failures[app]
+}
+
+// Save writes the state back to its file
+func (s *State) Save() (err error) {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,142 @@
+package osv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// DefaultURL is the API of osv.dev, see https://google.github.io/osv.dev/api/
+const DefaultURL = "https://api.osv.dev"
+
+// Package identifies a package in the OSV database, e.g. {"Maven", "org.example:app"}
+type Package struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+}
+
+// Vulnerability is an advisory of the OSV database, see https://ossf.github.io/osv-schema/
+type Vulnerability struct {
+	ID      string   `json:"id"`
+	Summary string   `json:"summary,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+
+	// Withdrawn is set for advisories that turned out to be wrong
+	Withdrawn *time.Time `json:"withdrawn,omitempty"`
+}
+
+// Client looks up the advisories of package versions. Results are kept for the lifetime of the client, so a
+// version is only looked up once per run. All methods are safe for concurrent use.
+type Client struct {
+	url   string
+	http  *http.Client
+	retry retry.Policy
+
+	lock  sync.Mutex
+	cache map[string][]Vulnerability
+}
+
+// NewClient returns a client for the OSV API at url, e.g. DefaultURL
+func NewClient(url string, policy retry.Policy) *Client {
+	return &Client{
+		url:   strings.TrimSuffix(url, "/"),
+		http:  &http.Client{Timeout: time.Minute},
+		retry: policy,
+		cache: make(map[string][]Vulnerability),
+	}
+}
+
+type query struct {
+	Package   Package `json:"package"`
+	Version   string  `json:"version"`
+	PageToken string  `json:"page_token,omitempty"`
+}
+
+type response struct {
+	Vulns         []Vulnerability `json:"vulns"`
+	NextPageToken string          `json:"next_page_token"`
+}
+
+// Query returns the advisories that affect version of pkg, sorted by ID. Withdrawn advisories are left out.
+func (c *Client) Query(ctx context.Context, pkg Package, version string) (vulns []Vulnerability, err error) {
+	key := pkg.Ecosystem + "\x00" + pkg.Name + "\x00" + version
+
+	c.lock.Lock()
+	cached, ok := c.cache[key]
+	c.lock.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	q := query{Package: pkg, Version: version}
+	for {
+		var resp response
+		err = c.retry.Do(ctx, func() (perr error) {
+			resp, perr = c.post(ctx, q)
+			return
+		})
+		if err != nil {
+			return nil, fmt.Errorf("querying advisories of %s %s %s: %w", pkg.Ecosystem, pkg.Name, version, err)
+		}
+
+		for _, v := range resp.Vulns {
+			if v.Withdrawn == nil {
+				vulns = append(vulns, v)
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		q.PageToken = resp.NextPageToken
+	}
+
+	sort.Slice(vulns, func(i, j int) bool {
+		return vulns[i].ID < vulns[j].ID
+	})
+
+	c.lock.Lock()
+	c.cache[key] = vulns
+	c.lock.Unlock()
+
+	return
+}
+
+func (c *Client) post(ctx context.Context, q query) (resp response, err error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return resp, retry.Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/v1/query", bytes.NewReader(body))
+	if err != nil {
+		return resp, retry.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, err := c.http.Do(req)
+	if err != nil {
+		return
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(r.Body, 1<<10))
+		err = fmt.Errorf("unexpected status %s: %s", r.Status, strings.TrimSpace(string(msg)))
+		if r.StatusCode >= 400 && r.StatusCode < 500 && r.StatusCode != http.StatusTooManyRequests {
+			err = retry.Permanent(err)
+		}
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&resp)
+	return
+}
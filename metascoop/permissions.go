@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+const (
+	// permissionPolicyBlock rejects versions that add dangerous permissions which aren't allowed in apps.yaml
+	permissionPolicyBlock = "block"
+
+	// permissionPolicyWarn only logs and reports them
+	permissionPolicyWarn = "warn"
+)
+
+// permissionGate compares the permissions of downloaded APKs with those of the previous published version
+type permissionGate struct {
+	policy  string
+	index   *apps.RepoIndex
+	repoDir string
+	report  *report.Report
+}
+
+func newPermissionGate(policy string, index *apps.RepoIndex, repoDir string, r *report.Report) (g *permissionGate, err error) {
+	if policy != permissionPolicyBlock && policy != permissionPolicyWarn {
+		return nil, fmt.Errorf("unknown permission policy %q, must be %q or %q", policy, permissionPolicyBlock, permissionPolicyWarn)
+	}
+	return &permissionGate{policy: policy, index: index, repoDir: repoDir, report: r}, nil
+}
+
+// verify records how the permissions of the APK at path differ from the previous version of its package
+// and rejects it if it adds dangerous permissions that aren't allowed for app
+func (g *permissionGate) verify(logger *slog.Logger, path string, app apps.AppInfo) (err error) {
+	m, err := apk.ReadManifest(path)
+	if err != nil {
+		return fmt.Errorf("reading APK manifest: %w", err)
+	}
+
+	// The previous version is the highest published one below the new APK, so older releases that are
+	// published later are compared with their actual predecessor. Downloads are verified concurrently,
+	// so the index must not be sorted here.
+	var previous apps.PackageInfo
+	for _, p := range g.index.Packages[m.Package] {
+		if int64(p.VersionCode) < m.VersionCode && p.VersionCode > previous.VersionCode {
+			previous = p
+		}
+	}
+	if previous.ApkName == "" {
+		return
+	}
+
+	old, err := apk.ReadManifest(filepath.Join(g.repoDir, previous.ApkName))
+	if os.IsNotExist(err) {
+		logger.Debug("APK of previous version is gone, cannot compare permissions", "apk", previous.ApkName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading manifest of previous version %q: %w", previous.ApkName, err)
+	}
+
+	change := report.PermissionChange{
+		Version:  m.VersionName,
+		Previous: previous.VersionName,
+		Added:    permissionDiff(m.Permissions, old.Permissions),
+		Removed:  permissionDiff(old.Permissions, m.Permissions),
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+
+	for _, p := range change.Added {
+		if apk.IsDangerousPermission(p) && !permissionAllowed(app, p) {
+			change.Dangerous = append(change.Dangerous, p)
+		}
+	}
+	change.Blocked = len(change.Dangerous) > 0 && g.policy == permissionPolicyBlock
+
+	g.report.AddPermissionChange(app.Name(), change)
+
+	logger.Info("Permissions changed since the previous version", "previous", previous.VersionName,
+		"added", strings.Join(change.Added, ","), "removed", strings.Join(change.Removed, ","))
+
+	if len(change.Dangerous) == 0 {
+		return
+	}
+
+	if change.Blocked {
+		return fmt.Errorf("APK adds dangerous permissions since version %q: %s. Add them to allowed_permissions in apps.yaml if they are expected",
+			previous.VersionName, strings.Join(change.Dangerous, ", "))
+	}
+
+	logger.Warn("APK adds dangerous permissions that aren't in allowed_permissions", "previous", previous.VersionName, "permissions", strings.Join(change.Dangerous, ","))
+	return nil
+}
+
+// permissionDiff returns the sorted permissions of a that b doesn't have
+func permissionDiff(a, b []string) (diff []string) {
+	have := make(map[string]bool, len(b))
+	for _, p := range b {
+		have[p] = true
+	}
+
+	for _, p := range a {
+		if !have[p] {
+			have[p] = true
+			diff = append(diff, p)
+		}
+	}
+
+	sort.Strings(diff)
+	return
+}
+
+// permissionAllowed reports whether app lists the permission in allowed_permissions, either with its full
+// name or, for Android's own permissions, without the "android.permission." prefix
+func permissionAllowed(app apps.AppInfo, permission string) bool {
+	for _, a := range app.AllowedPermissions {
+		if a == permission || "android.permission."+a == permission {
+			return true
+		}
+	}
+	return false
+}
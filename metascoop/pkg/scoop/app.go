@@ -0,0 +1,118 @@
+package scoop
+
+import (
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/internal/appinfo"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+func init() {
+	appinfo.Of = func(app any) apps.AppInfo {
+		return app.(App).info
+	}
+	appinfo.New = func(info apps.AppInfo) any {
+		return App{info: info}
+	}
+}
+
+// App is an app of an apps file. During a run it also carries what was found out about it, like the description
+// of its repo, and the release it's considered for.
+type App struct {
+	info apps.AppInfo
+}
+
+// LoadApps reads the apps of the apps file at path, including those of the fragments it includes
+func LoadApps(path string) (list []App, err error) {
+	infos, err := apps.ParseAppFile(path)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		list = append(list, App{info: info})
+	}
+	return
+}
+
+// Name returns the name of the app, which is unique in its apps file
+func (a App) Name() string {
+	return a.info.Name()
+}
+
+// GitURL returns the URL of the upstream repo of the app
+func (a App) GitURL() string {
+	return a.info.GitURL
+}
+
+// Repo is what the host of an app says about its repo
+type Repo struct {
+	Description string
+
+	// License is the SPDX expression of the license the host detected, if any
+	License string
+
+	// MovedTo is the URL of the repo if it was renamed or transferred
+	MovedTo string
+}
+
+// Release is a release of an app
+type Release struct {
+	// ID identifies the release at its host, it changes if a release is published again with the same tag
+	ID          int64
+	TagName     string
+	Body        string
+	Prerelease  bool
+	Draft       bool
+	PublishedAt time.Time
+
+	// VersionCode is the versionCode the APKs of the release must have, if the host knows it
+	VersionCode int64
+
+	Assets []Asset
+}
+
+// Asset is a downloadable file of a release
+type Asset struct {
+	ID   int64
+	Name string
+	Size int64
+	URL  string
+
+	// SHA256 is the hex digest of the content, if the host provides it
+	SHA256 string
+}
+
+func newRelease(r sources.Release) Release {
+	assets := make([]Asset, len(r.Assets))
+	for i, a := range r.Assets {
+		assets[i] = Asset(a)
+	}
+	return Release{
+		ID:          r.ID,
+		TagName:     r.TagName,
+		Body:        r.Body,
+		Prerelease:  r.Prerelease,
+		Draft:       r.Draft,
+		PublishedAt: r.PublishedAt,
+		VersionCode: r.VersionCode,
+		Assets:      assets,
+	}
+}
+
+func (r Release) source() sources.Release {
+	assets := make([]sources.Asset, len(r.Assets))
+	for i, a := range r.Assets {
+		assets[i] = sources.Asset(a)
+	}
+	return sources.Release{
+		ID:          r.ID,
+		TagName:     r.TagName,
+		Body:        r.Body,
+		Prerelease:  r.Prerelease,
+		Draft:       r.Draft,
+		PublishedAt: r.PublishedAt,
+		VersionCode: r.VersionCode,
+		Assets:      assets,
+	}
+}
@@ -0,0 +1,124 @@
+package scoop
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// checksumSuffixes are appended to an asset name to get the name of a file containing only its checksum
+var checksumSuffixes = []string{".sha256", ".sha256sum", ".sha256.txt"}
+
+// checksumListNames are names of assets listing the checksums of all assets of a release, compared case-insensitively
+var checksumListNames = []string{"sha256sums", "sha256sums.txt", "checksums.txt", "checksums.sha256"}
+
+// maxChecksumFileSize limits how much of a checksum file is read, they are tiny
+const maxChecksumFileSize = 1 << 20
+
+// releaseChecksum returns the SHA-256 that upstream published for asset as part of the release and the name
+// of the asset it was found in. An empty sum means that the release doesn't contain a checksum.
+//
+// Detached signatures (.sig, .asc) aren't checked: there is no key to check them with, and the APK signer
+// is already verified against the pinned fingerprints.
+func releaseChecksum(ctx context.Context, src sources.Source, release sources.Release, asset sources.Asset) (sum, origin string, err error) {
+	byName := make(map[string]sources.Asset, len(release.Assets))
+	for _, a := range release.Assets {
+		byName[strings.ToLower(a.Name)] = a
+	}
+
+	type candidate struct {
+		sources.Asset
+		single bool
+	}
+
+	var candidates []candidate
+	for _, suffix := range checksumSuffixes {
+		if a, ok := byName[strings.ToLower(asset.Name+suffix)]; ok {
+			candidates = append(candidates, candidate{a, true})
+		}
+	}
+	for _, name := range checksumListNames {
+		if a, ok := byName[name]; ok {
+			candidates = append(candidates, candidate{a, false})
+		}
+	}
+
+	for _, candidate := range candidates {
+		sum, err = readChecksum(ctx, src, candidate.Asset, asset.Name, candidate.single)
+		if err != nil {
+			return "", candidate.Name, fmt.Errorf("reading checksum file %q: %w", candidate.Name, err)
+		}
+		if sum != "" {
+			return sum, candidate.Name, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+func readChecksum(ctx context.Context, src sources.Source, checksumAsset sources.Asset, name string, single bool) (sum string, err error) {
+	rc, _, err := src.DownloadAsset(ctx, checksumAsset, 0)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	return parseChecksum(io.LimitReader(rc, maxChecksumFileSize), name, single)
+}
+
+// parseChecksum returns the checksum of the file called name from the output of sha256sum (GNU or BSD style).
+// If single is set, the content belongs to this file only and its first checksum is used if no line names the file.
+func parseChecksum(r io.Reader, name string, single bool) (sum string, err error) {
+	var unnamed string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		var hash, file string
+		if strings.HasPrefix(line, "SHA256 (") {
+			// BSD style: SHA256 (name) = hash
+			idx := strings.LastIndex(line, ") = ")
+			if idx < 0 {
+				continue
+			}
+			file, hash = line[len("SHA256 ("):idx], line[idx+len(") = "):]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			hash = fields[0]
+			if len(fields) > 1 {
+				// GNU style, "*" marks binary mode
+				file = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+			}
+		}
+
+		if len(hash) != 64 {
+			continue
+		}
+		if _, derr := hex.DecodeString(hash); derr != nil {
+			continue
+		}
+		hash = strings.ToLower(hash)
+
+		if file == name || path.Base(file) == name {
+			return hash, nil
+		}
+		if single && unnamed == "" {
+			unnamed = hash
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	return unnamed, nil
+}
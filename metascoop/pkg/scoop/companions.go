@@ -0,0 +1,89 @@
+package scoop
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/file"
+)
+
+// companionJob is a companion asset that is downloaded to a temporary path, because its name in the repo
+// depends on the APKs of its release
+type companionJob struct {
+	app       string
+	release   string
+	companion apps.CompanionAsset
+	staged    string
+
+	// apks are the paths of the APKs of the release in the repo
+	apks []string
+}
+
+// companionTarget returns the path of the companion in the repo. It's named after the lowest versionCode of the
+// APKs of its release, so clients download it with all of them. The error wraps os.ErrNotExist if none of the
+// APKs is in the repo (yet).
+func companionTarget(repoDir string, c apps.CompanionAsset, apkPaths []string) (path string, err error) {
+	var (
+		pkg    string
+		lowest int64
+	)
+	for _, p := range apkPaths {
+		m, merr := apk.ReadManifest(p)
+		if errors.Is(merr, os.ErrNotExist) {
+			continue
+		}
+		if merr != nil {
+			return "", merr
+		}
+		if pkg == "" || m.VersionCode < lowest {
+			pkg, lowest = m.Package, m.VersionCode
+		}
+	}
+	if pkg == "" {
+		return "", fmt.Errorf("no APK of the release is in the repo: %w", os.ErrNotExist)
+	}
+
+	return filepath.Join(repoDir, c.FileName(lowest, pkg)), nil
+}
+
+// PlaceCompanions moves the companion assets that run downloaded to their place in the repo. Companions of
+// releases whose APKs weren't added, e.g. because they were removed after the downloads, are dropped.
+func (s *Scooper) PlaceCompanions(run *Run) {
+	if run.companionDir != "" {
+		defer os.RemoveAll(run.companionDir)
+	}
+
+	for _, job := range run.companions {
+		logger := slog.With("app", job.app, "release", job.release)
+
+		if _, err := os.Stat(job.staged); err != nil {
+			// The download failed, which was reported already
+			continue
+		}
+
+		target, err := companionTarget(s.opts.RepoDir, job.companion, job.apks)
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Dropping companion asset, no APK of its release was added", "type", job.companion.Type)
+			continue
+		}
+		if err != nil {
+			logger.Error("Finding name of companion asset failed", "error", err)
+			s.opts.Policy.error(job.app, fmt.Errorf("placing %s of release %q: %w", job.companion.Type, job.release, err))
+			continue
+		}
+
+		err = file.Move(job.staged, target)
+		if err != nil {
+			logger.Error("Moving companion asset to the repo failed", "path", target, "error", err)
+			s.opts.Policy.error(job.app, fmt.Errorf("placing %s of release %q: %w", job.companion.Type, job.release, err))
+			continue
+		}
+
+		logger.Info("Added companion asset", "type", job.companion.Type, "path", target)
+	}
+}
@@ -0,0 +1,88 @@
+package scoop
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+type downloadHeadersKey struct{}
+
+// downloadHeaders are the download_auth headers of an app, see apps.DownloadAuth. A nil *downloadHeaders has none.
+type downloadHeaders struct {
+	header http.Header
+
+	// hosts the headers are sent to, the host of the asset URL if empty
+	hosts []string
+}
+
+// newDownloadHeaders returns the download headers of app, nil if it has none. The secrets in them are passed to
+// redact, if it isn't nil.
+func newDownloadHeaders(app apps.AppInfo, redact func(secrets ...string)) (h *downloadHeaders, err error) {
+	if app.DownloadAuth == nil {
+		return nil, nil
+	}
+
+	header, secrets, err := app.DownloadAuth.Header()
+	if err != nil {
+		return
+	}
+	if redact != nil {
+		redact(secrets...)
+	}
+
+	return &downloadHeaders{header: header, hosts: app.DownloadAuth.HostNames()}, nil
+}
+
+// context returns ctx for the requests that download the asset at assetURL, they get the headers if their host is
+// one the headers are for
+func (h *downloadHeaders) context(ctx context.Context, assetURL string) context.Context {
+	if h == nil {
+		return ctx
+	}
+
+	hosts := h.hosts
+	if len(hosts) == 0 {
+		u, err := url.Parse(assetURL)
+		if err != nil {
+			return ctx
+		}
+		hosts = []string{strings.ToLower(u.Hostname())}
+	}
+	return context.WithValue(ctx, downloadHeadersKey{}, &downloadHeaders{header: h.header, hosts: hosts})
+}
+
+// DownloadTransport returns a transport that adds the download_auth headers of apps to the requests of next that
+// download their assets. Only requests that go through it get the headers, the metascoop command makes it
+// http.DefaultTransport.
+func DownloadTransport(next http.RoundTripper) http.RoundTripper {
+	return &downloadHeaderTransport{next: next}
+}
+
+// downloadHeaderTransport adds the download headers from the context of a request. They are added to each request
+// on its own, also to those that follow redirects, so they never reach hosts they aren't for.
+type downloadHeaderTransport struct {
+	next http.RoundTripper
+}
+
+func (t *downloadHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := req.Context().Value(downloadHeadersKey{}).(*downloadHeaders)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	host := strings.ToLower(req.URL.Hostname())
+	for _, allowed := range h.hosts {
+		if host == allowed {
+			req = req.Clone(req.Context())
+			for name, values := range h.header {
+				req.Header[name] = values
+			}
+			break
+		}
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,123 @@
+package scoop
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/index"
+	"github.com/nymtech/fdroid/metascoop/sign"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// Indexers that generate the indexes of a repo, see UpdateIndex
+const (
+	// IndexerFdroid runs "fdroid update", which signs the indexes with the keystore of fdroidserver's config.yml
+	IndexerFdroid = "fdroid"
+
+	// IndexerNative generates index-v1 and index-v2 without needing fdroidserver, see GenerateIndex
+	IndexerNative = "native"
+)
+
+// Key is the key and certificate the indexes of a repo are signed with. F-Droid clients pin the certificate, so it
+// must stay the same for the lifetime of the repo.
+type Key struct {
+	key *sign.Key
+}
+
+// LoadKeystore reads the key of a PKCS#12 keystore, as created by "fdroid init" or "keytool -genkey -storetype PKCS12"
+func LoadKeystore(path, password string) (*Key, error) {
+	k, err := sign.LoadKeystore(path, password)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{key: k}, nil
+}
+
+// LoadKeyPEM reads a PKCS#8 private key ("BEGIN PRIVATE KEY") and its certificate from PEM data
+func LoadKeyPEM(data []byte) (*Key, error) {
+	k, err := sign.LoadPEM(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{key: k}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate, which users add to the repo URL
+func (k *Key) Fingerprint() string {
+	return k.key.Fingerprint()
+}
+
+// signer returns the key of k, nil if k is nil
+func (k *Key) signer() *sign.Key {
+	if k == nil {
+		return nil
+	}
+	return k.key
+}
+
+// UpdateIndex regenerates the indexes of the fdroid directory dir, which contains config.yml and the metadata and
+// repo directories, with indexer. They are generated in a staged copy of dir that's only moved into place if the
+// indexes are valid, see stagedIndex. key signs them with IndexerNative, it must be nil with IndexerFdroid.
+func UpdateIndex(indexer, dir string, key *Key) (err error) {
+	if key != nil && indexer != IndexerNative {
+		return fmt.Errorf("index signing keys can only be used with the %q indexer, fdroidserver uses the keystore from its config.yml", IndexerNative)
+	}
+
+	staged, err := stageIndex(dir)
+	if err != nil {
+		return
+	}
+	defer staged.remove()
+
+	err = generateIndex(indexer, staged.dir, key)
+	if err != nil {
+		return fmt.Errorf("%w, the fdroid directory was left unchanged", err)
+	}
+
+	err = staged.validate(key != nil)
+	if err != nil {
+		return fmt.Errorf("invalid index, the fdroid directory was left unchanged: %w", err)
+	}
+
+	err = staged.commit()
+	if err != nil {
+		return fmt.Errorf("moving the generated index into place: %w", err)
+	}
+	return nil
+}
+
+// generateIndex runs the indexer in the fdroid directory dir
+func generateIndex(indexer, dir string, key *Key) error {
+	switch indexer {
+	case IndexerFdroid:
+		cmd := tools.Command("fdroid", "update", "--pretty", "--delete-unknown")
+		cmd.Stderr = os.Stderr
+		cmd.Stdout = os.Stdout
+		cmd.Stdin = os.Stdin
+		cmd.Dir = dir
+
+		slog.Info("Running fdroid", "command", cmd.String(), "dir", cmd.Dir)
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("running %q: %w", cmd.String(), err)
+		}
+		return nil
+	case IndexerNative:
+		slog.Info("Generating indexes", "dir", dir)
+
+		return GenerateIndex(dir, key)
+	default:
+		return fmt.Errorf("unknown indexer %q", indexer)
+	}
+}
+
+// GenerateIndex writes the indexes of the fdroid directory dir in place, without needing fdroidserver and without
+// the staged copy of UpdateIndex. They are signed with key if it isn't nil.
+func GenerateIndex(dir string, key *Key) error {
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	return index.Generate(index.Options{Dir: dir, Key: key.signer()})
+}
@@ -0,0 +1,307 @@
+package scoop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/file"
+)
+
+// Index generation changes many files: fdroidserver and the native indexer write stubs and copy images besides
+// writing and signing the indexes. If it fails halfway, the fdroid directory would be left with some of these
+// changes, so it runs on a staged copy instead. The copy is checked and only then moved into place, a failed run
+// leaves the fdroid directory as it was.
+
+// stagingDirName is the directory in the fdroid directory the indexes are generated in. It contains a .gitignore,
+// so it isn't committed if a run is killed before it's removed.
+const stagingDirName = ".metascoop-staging"
+
+// stagedIndex is a copy of an fdroid directory
+type stagedIndex struct {
+	// orig is the fdroid directory, dir its copy
+	orig string
+	dir  string
+}
+
+// skipStaged reports whether the path rel in the fdroid directory is left out of the copy: directories of
+// metascoop itself, like the lock and staging directories
+func skipStaged(rel string) bool {
+	return !strings.ContainsRune(rel, filepath.Separator) && strings.HasPrefix(rel, ".metascoop-")
+}
+
+// linkStaged reports whether the file at rel is linked into the copy instead of copied. Only files that neither
+// indexer writes to are linked, as writing to a link would change the original, but they may be moved or deleted.
+func linkStaged(rel string) bool {
+	switch filepath.Ext(rel) {
+	case ".apk", ".obb", ".asc":
+		return true
+	}
+	return false
+}
+
+// stageIndex copies the fdroid directory dir. APKs are hard links, so the copy is cheap.
+func stageIndex(dir string) (s *stagedIndex, err error) {
+	root := filepath.Join(dir, stagingDirName)
+	err = os.RemoveAll(root)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(root, 0o755)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*\n"), 0o644)
+	if err != nil {
+		return
+	}
+
+	s = &stagedIndex{orig: dir, dir: filepath.Join(root, "fdroid")}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if skipStaged(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(s.dir, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			return nil
+		}
+
+		if linkStaged(rel) && os.Link(p, target) == nil {
+			return nil
+		}
+		return file.Copy(p, target, info.Mode().Perm())
+	})
+	if err != nil {
+		s.remove()
+		return nil, fmt.Errorf("copying %q for generating the index: %w", dir, err)
+	}
+	return
+}
+
+// remove deletes the copy
+func (s *stagedIndex) remove() {
+	err := os.RemoveAll(filepath.Dir(s.dir))
+	if err != nil {
+		slog.Warn("Removing staged index failed", "path", filepath.Dir(s.dir), "error", err)
+	}
+}
+
+// validate checks the indexes of the copy: they must have been written and be readable, and all APKs they list
+// must exist. If the indexes are signed, their JARs must exist too.
+func (s *stagedIndex) validate(signed bool) (err error) {
+	for _, name := range []string{"repo", "archive"} {
+		repoDir := filepath.Join(s.dir, name)
+		if _, serr := os.Stat(repoDir); serr != nil && name == "archive" {
+			continue
+		}
+
+		index, err := apps.ReadIndex(filepath.Join(repoDir, "index-v1.json"))
+		if err != nil {
+			return fmt.Errorf("reading %s index: %w", name, err)
+		}
+		for pkgName, pkgs := range index.Packages {
+			for _, pkg := range pkgs {
+				if _, serr := os.Stat(filepath.Join(repoDir, pkg.ApkName)); serr != nil {
+					return fmt.Errorf("%s index lists %q of %s, but the file doesn't exist", name, pkg.ApkName, pkgName)
+				}
+			}
+		}
+
+		for _, file := range []string{"index-v2.json", "entry.json"} {
+			data, rerr := os.ReadFile(filepath.Join(repoDir, file))
+			if errors.Is(rerr, os.ErrNotExist) {
+				continue
+			}
+			if rerr != nil {
+				return rerr
+			}
+			var v interface{}
+			if jerr := json.Unmarshal(data, &v); jerr != nil {
+				return fmt.Errorf("reading %s %s: %w", name, file, jerr)
+			}
+		}
+
+		if signed {
+			for _, file := range []string{"index-v1.jar", "entry.jar"} {
+				if _, serr := os.Stat(filepath.Join(repoDir, file)); serr != nil {
+					return fmt.Errorf("%s index wasn't signed: %w", name, serr)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isIndexFile reports whether the file at the slash-separated path rel in the fdroid directory is an index,
+// these are moved into place after all other files
+func isIndexFile(rel string) bool {
+	base := path.Base(rel)
+	return strings.Count(rel, "/") == 1 && (strings.HasPrefix(base, "index") || strings.HasPrefix(base, "entry."))
+}
+
+// commit moves the files that were added or changed in the copy into the fdroid directory and deletes those that
+// were deleted. Indexes are moved last, so they never list files that aren't there yet.
+func (s *stagedIndex) commit() (err error) {
+	var changed []string
+	staged := make(map[string]bool)
+
+	err = filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		staged[rel] = true
+		if d.IsDir() {
+			return nil
+		}
+
+		same, err := sameStaged(p, filepath.Join(s.orig, rel))
+		if err != nil {
+			return err
+		}
+		if !same {
+			changed = append(changed, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.SliceStable(changed, func(i, j int) bool {
+		return !isIndexFile(filepath.ToSlash(changed[i])) && isIndexFile(filepath.ToSlash(changed[j]))
+	})
+	for _, rel := range changed {
+		target := filepath.Join(s.orig, rel)
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err != nil {
+			return
+		}
+		// Rename doesn't replace directories, e.g. if the indexer replaced one with a file
+		if info, serr := os.Lstat(target); serr == nil && info.IsDir() {
+			err = os.RemoveAll(target)
+			if err != nil {
+				return
+			}
+		}
+		err = os.Rename(filepath.Join(s.dir, rel), target)
+		if err != nil {
+			return
+		}
+	}
+
+	// Directories that are gone are removed with everything in them
+	var deleted []string
+	err = filepath.WalkDir(s.orig, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.orig, p)
+		if err != nil {
+			return err
+		}
+		if skipStaged(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !staged[rel] {
+			deleted = append(deleted, p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for i := len(deleted) - 1; i >= 0; i-- {
+		err = os.RemoveAll(deleted[i])
+		if err != nil {
+			return
+		}
+	}
+
+	slog.Info("Moved generated index into place", "dir", s.orig, "changed", len(changed), "deleted", len(deleted))
+	return nil
+}
+
+// sameStaged reports whether the staged file at p is the same as the original at orig: the same link, or a copy
+// with the same content
+func sameStaged(p, orig string) (same bool, err error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return
+	}
+	origInfo, err := os.Lstat(orig)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	if os.SameFile(info, origInfo) {
+		return true, nil
+	}
+	if info.Mode() != origInfo.Mode() || info.Size() != origInfo.Size() {
+		return false, nil
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		link, lerr := os.Readlink(p)
+		origLink, oerr := os.Readlink(orig)
+		return lerr == nil && oerr == nil && link == origLink, nil
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return
+	}
+	origData, err := os.ReadFile(orig)
+	if err != nil {
+		return
+	}
+	return bytes.Equal(data, origData), nil
+}
@@ -0,0 +1,198 @@
+package scoop
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/file"
+)
+
+// Pruned is an APK that is no longer kept because of an app's retention policy
+type Pruned struct {
+	// App is the name of the app
+	App         string
+	Path        string
+	PackageName string
+	VersionCode int
+
+	// KeepChangelog is set if another APK with the same versionCode stays in the repo, e.g. a different ABI split
+	KeepChangelog bool
+}
+
+// Prunable returns the APKs in the repo and archive directories that belong to an app of run with a retention
+// policy, but were not selected by it. With Options.Archive, APKs that are already in the archive are not returned.
+// Run only selects the newest releases of these apps, so everything else is older. Packages are only attributed to
+// an app if at least one of their APKs was selected, which means nothing is pruned for apps whose discovery failed.
+func (s *Scooper) Prunable(run *Run) (pruned []Pruned, err error) {
+	fdroidDir := filepath.Dir(s.opts.RepoDir)
+
+	var (
+		appsList []apps.AppInfo
+		retained = make(map[string]bool)
+	)
+	for _, app := range run.apps {
+		appsList = append(appsList, app.info)
+		if app.info.KeepVersions(s.opts.KeepVersions) > 0 {
+			retained[app.Name()] = true
+		}
+	}
+	if len(retained) == 0 {
+		return
+	}
+
+	type indexedAPK struct {
+		dir string
+		apps.PackageInfo
+	}
+
+	// map[packageName]appName
+	var packageApps = make(map[string]string)
+	var all []indexedAPK
+
+	for _, dir := range []string{"repo", "archive"} {
+		dir = filepath.Join(fdroidDir, dir)
+
+		index, ierr := apps.ReadIndex(filepath.Join(dir, "index-v1.json"))
+		if errors.Is(ierr, os.ErrNotExist) {
+			continue
+		}
+		if ierr != nil {
+			return nil, fmt.Errorf("reading index of %q: %w", dir, ierr)
+		}
+
+		for pkgName, pkgs := range index.Packages {
+			for _, p := range pkgs {
+				p.PackageName = pkgName
+				all = append(all, indexedAPK{dir, p})
+
+				if info, ok := run.keptApp(s, p.ApkName); ok && retained[info.Name()] {
+					packageApps[pkgName] = info.Name()
+				}
+			}
+		}
+	}
+
+	// map[packageName]map[versionCode]bool of versions that stay in the repo
+	var keptVersions = make(map[string]map[int]bool)
+	for _, p := range all {
+		if _, ok := run.keptApp(s, p.ApkName); !ok {
+			continue
+		}
+		if keptVersions[p.PackageName] == nil {
+			keptVersions[p.PackageName] = make(map[int]bool)
+		}
+		keptVersions[p.PackageName][p.VersionCode] = true
+	}
+
+	for _, p := range all {
+		appName, ok := packageApps[p.PackageName]
+		if !ok {
+			continue
+		}
+		if _, ok := run.keptApp(s, p.ApkName); ok {
+			continue
+		}
+		if owner, ok := apps.ReleaseOwner(appsList, s.opts.Policy.releaseName(p.ApkName)); ok && owner.Name() != appName {
+			// Another app publishes the package as well, its versions follow its own retention
+			continue
+		}
+		if s.opts.Archive && filepath.Base(p.dir) == "archive" {
+			continue
+		}
+
+		pruned = append(pruned, Pruned{
+			App:           appName,
+			Path:          filepath.Join(p.dir, p.ApkName),
+			PackageName:   p.PackageName,
+			VersionCode:   p.VersionCode,
+			KeepChangelog: keptVersions[p.PackageName][p.VersionCode],
+		})
+	}
+
+	sort.Slice(pruned, func(i, j int) bool {
+		return pruned[i].Path < pruned[j].Path
+	})
+
+	return
+}
+
+// Prune deletes the pruned APKs, their signatures and Options.Sidecars, and their changelogs. If archive is set, the
+// APKs are moved to the archive directory next to the repo directory instead and the changelogs are kept, as the
+// archive index still lists these versions.
+func (s *Scooper) Prune(pruned []Pruned, archive bool) (err error) {
+	fdroidDir := filepath.Dir(s.opts.RepoDir)
+	metadataDir := filepath.Join(fdroidDir, "metadata")
+
+	for _, p := range pruned {
+		if archive {
+			err = s.archiveAPK(p, filepath.Join(fdroidDir, "archive"))
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		slog.Info("Removing version, it's older than the kept versions", "app", p.App, "path", p.Path, "version_code", p.VersionCode)
+
+		for _, path := range s.apkFiles(p.Path) {
+			rerr := os.Remove(path)
+			if rerr != nil && !errors.Is(rerr, os.ErrNotExist) {
+				return fmt.Errorf("removing %q: %w", path, rerr)
+			}
+		}
+
+		if p.KeepChangelog {
+			continue
+		}
+
+		changelogs, gerr := filepath.Glob(filepath.Join(metadataDir, p.PackageName, "*", "changelogs", fmt.Sprintf("%d.txt", p.VersionCode)))
+		if gerr != nil {
+			return gerr
+		}
+		for _, path := range changelogs {
+			err = os.Remove(path)
+			if err != nil {
+				return fmt.Errorf("removing changelog %q: %w", path, err)
+			}
+		}
+	}
+
+	return
+}
+
+// archiveAPK moves the APK and its signature files and sidecars to archiveDir
+func (s *Scooper) archiveAPK(p Pruned, archiveDir string) (err error) {
+	slog.Info("Moving version to the archive, it's older than the kept versions", "app", p.App, "path", p.Path, "version_code", p.VersionCode)
+
+	err = os.MkdirAll(archiveDir, 0o755)
+	if err != nil {
+		return
+	}
+
+	for _, path := range s.apkFiles(p.Path) {
+		if _, serr := os.Stat(path); errors.Is(serr, os.ErrNotExist) {
+			continue
+		}
+
+		err = file.Move(path, filepath.Join(archiveDir, filepath.Base(path)))
+		if err != nil {
+			return fmt.Errorf("moving %q to the archive: %w", path, err)
+		}
+	}
+
+	return
+}
+
+// apkFiles returns the paths of the APK at path and of the files that belong to it
+func (s *Scooper) apkFiles(path string) []string {
+	files := []string{path, path + ".asc", path + ".sig"}
+	for _, suffix := range s.opts.Sidecars {
+		files = append(files, path+suffix)
+	}
+	return files
+}
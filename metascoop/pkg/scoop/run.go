@@ -0,0 +1,707 @@
+package scoop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// Policy decides what a run does with the apps and assets it finds. All functions are optional: the zero Policy
+// downloads the APKs that aren't in the repo directory yet and only logs problems. Verify and Downloaded are called
+// by the download workers concurrently, the others by Run.
+type Policy struct {
+	// Start is called before the releases of app are looked up, with the source kind detected if the apps file
+	// doesn't set it. The app is left out if it returns false.
+	Start func(app App) bool
+
+	// Finish is called once the downloads of a started app are queued, also if its lookup failed
+	Finish func(app App)
+
+	// Error is called with the problems of the app with the name app: those that end its lookup or leave out an
+	// asset, and its failed companion assets
+	Error func(app string, err error)
+
+	// Skip is called for the releases and assets of the app with the name app that aren't downloaded, with the
+	// reason. asset is empty for whole releases.
+	Skip func(app, release, asset, reason string)
+
+	// Repo is called with what the host says about the repo of app. MovedTo is only set if the repo moved to
+	// another URL, the app continues with it. An error ends the lookup of app.
+	Repo func(app App, repo Repo) error
+
+	// Releases is called with all releases of app, newest first
+	Releases func(app App, releases []Release)
+
+	// RepoName returns the name of the APK with the release file name release in the repo directory, ReleaseName
+	// the reverse. They differ if APKs are renamed after their downloads, both return the name they get by default.
+	RepoName    func(release string) string
+	ReleaseName func(name string) string
+
+	// Select decides whether the APK of c is queued for download. By default, APKs that are in the repo directory
+	// already or larger than c.MaxSize aren't. The published checksums of a release are only looked up for the
+	// APKs that are selected.
+	Select func(ctx context.Context, c *Candidate) bool
+
+	// Queue is called right before the APK of c is queued and can still leave it out, e.g. because a hook vetoed
+	// the download. It may set c.Convert.
+	Queue func(ctx context.Context, c *Candidate) bool
+
+	// Deferred reports whether the downloads of the app with the name app were deferred to a later run. The
+	// companion assets of its releases are only downloaded with their APKs then.
+	Deferred func(app string) bool
+
+	// Verify checks the APK of c that was downloaded to path. It's removed if Verify returns an error.
+	Verify func(c *Candidate, path string) error
+
+	// Downloaded is called for each successful download with its size and duration
+	Downloaded func(d Download, bytes int64, elapsed time.Duration)
+}
+
+func (p Policy) start(app App) bool {
+	return p.Start == nil || p.Start(app)
+}
+
+func (p Policy) finish(app App) {
+	if p.Finish != nil {
+		p.Finish(app)
+	}
+}
+
+func (p Policy) error(app string, err error) {
+	if p.Error != nil {
+		p.Error(app, err)
+	}
+}
+
+func (p Policy) skip(app, release, asset, reason string) {
+	if p.Skip != nil {
+		p.Skip(app, release, asset, reason)
+	}
+}
+
+func (p Policy) repo(app App, repo Repo) error {
+	if p.Repo == nil {
+		return nil
+	}
+	return p.Repo(app, repo)
+}
+
+func (p Policy) releases(app App, releases []Release) {
+	if p.Releases != nil {
+		p.Releases(app, releases)
+	}
+}
+
+func (p Policy) repoName(release string) string {
+	if p.RepoName == nil {
+		return release
+	}
+	return p.RepoName(release)
+}
+
+func (p Policy) releaseName(name string) string {
+	if p.ReleaseName == nil {
+		return name
+	}
+	return p.ReleaseName(name)
+}
+
+func (p Policy) selectAPK(ctx context.Context, c *Candidate) bool {
+	if p.Select != nil {
+		return p.Select(ctx, c)
+	}
+
+	app := c.App.Name()
+	if _, err := os.Stat(c.Path); err == nil {
+		slog.Info("Already have APK", "app", app, "release", c.Release.TagName, "path", c.Path)
+		p.skip(app, c.Release.TagName, c.Asset.Name, "already in repo")
+		return false
+	}
+	if c.MaxSize > 0 && c.Asset.Size > c.MaxSize {
+		slog.Error("Asset is larger than the maximum APK size", "app", app, "release", c.Release.TagName, "asset", c.Asset.Name, "size", c.Asset.Size, "max_size", c.MaxSize)
+		p.error(app, fmt.Errorf("release %q: %q has %d bytes, more than the maximum APK size of %d", c.Release.TagName, c.Asset.Name, c.Asset.Size, c.MaxSize))
+		return false
+	}
+	return true
+}
+
+func (p Policy) queue(ctx context.Context, c *Candidate) bool {
+	return p.Queue == nil || p.Queue(ctx, c)
+}
+
+func (p Policy) deferred(app string) bool {
+	return p.Deferred != nil && p.Deferred(app)
+}
+
+func (p Policy) verify(c *Candidate, path string) error {
+	if p.Verify == nil {
+		return nil
+	}
+	return p.Verify(c, path)
+}
+
+func (p Policy) downloaded(d Download, bytes int64, elapsed time.Duration) {
+	if p.Downloaded != nil {
+		p.Downloaded(d, bytes, elapsed)
+	}
+}
+
+// Candidate is an APK of a release that Run may download
+type Candidate struct {
+	// App is the app with the release
+	App     App
+	Release Release
+
+	// Asset is the APK as the host reports it
+	Asset Asset
+
+	// ABI is the only ABI the APK has native code for, if the release has an APK per ABI
+	ABI string
+
+	// Path is the path of the APK in the repo directory
+	Path string
+
+	// Held is why the release is held back, e.g. because it's newer than the pinned release. APKs of held
+	// releases are only candidates if they're in the repo already.
+	Held string
+
+	// Newest is set for the APKs of the newest release that's kept, which must be newer than the published versions
+	Newest bool
+
+	// MaxSize is the maximum size of the APK, zero for no limit
+	MaxSize int64
+
+	// Checksum is the SHA-256 of the APK published with the release, if there is one. It's set before Queue is
+	// called.
+	Checksum string
+
+	// Convert is optional and turns the downloaded asset into the APK that's published, like the universal APK of
+	// a bundle. It runs before Verify.
+	Convert func(path string) error
+}
+
+// Download is a queued download of an APK or companion asset
+type Download struct {
+	// App is the name of the app it belongs to, errors are grouped by it
+	App string
+
+	// Name describes it in logs
+	Name string
+
+	URL  string
+	Size int64
+
+	// Target is the path it's downloaded to
+	Target string
+
+	job download.Job
+}
+
+// Progress follows running downloads, e.g. to show them in a terminal. Its methods may be called concurrently.
+type Progress interface {
+	// Started is called when an attempt to download d starts, offset bytes are on disk already. The content that is
+	// received is written to the returned writer, which must not fail.
+	Started(d Download, offset int64) io.Writer
+
+	// Finished is called when d is done, err is nil if it was downloaded
+	Finished(d Download, err error)
+}
+
+// downloadProgress passes the progress of the jobs of a pool on as that of their downloads
+type downloadProgress struct {
+	progress Progress
+
+	// map[target]download
+	downloads map[string]Download
+}
+
+func (p downloadProgress) Started(job download.Job, offset int64) io.Writer {
+	return p.progress.Started(p.downloads[job.Target], offset)
+}
+
+func (p downloadProgress) Finished(job download.Job, err error) {
+	p.progress.Finished(p.downloads[job.Target], err)
+}
+
+// Run is what Scooper.Run found: the downloads it queued and the APKs of the releases that are kept
+type Run struct {
+	// Downloads are the queued downloads of APKs and companion assets, in order
+	Downloads []Download
+
+	apps []App
+
+	// kept maps the release file names of the APKs of the kept releases to their app, with the release set
+	kept map[string]App
+
+	companions   []companionJob
+	companionDir string
+}
+
+// keptApp returns the app with the release of the APK called apkName, if its release is kept
+func (r *Run) keptApp(s *Scooper, apkName string) (app App, ok bool) {
+	app, ok = r.kept[s.opts.Policy.releaseName(apkName)]
+	return
+}
+
+// Filter drops the downloads and companion assets of the apps keep returns false for, e.g. after an interruption
+func (r *Run) Filter(keep func(app string) bool) {
+	var downloads []Download
+	for _, d := range r.Downloads {
+		if keep(d.App) {
+			downloads = append(downloads, d)
+		}
+	}
+	r.Downloads = downloads
+
+	var companions []companionJob
+	for _, c := range r.companions {
+		if keep(c.app) {
+			companions = append(companions, c)
+		}
+	}
+	r.companions = companions
+}
+
+// Rename tells r that the APK at oldPath was moved to newPath, e.g. because it was renamed with a file name
+// template, so its download and the companion assets of its release refer to it
+func (r *Run) Rename(oldPath, newPath string) {
+	for i, d := range r.Downloads {
+		if d.Target == oldPath {
+			r.Downloads[i].Target = newPath
+		}
+	}
+	for i := range r.companions {
+		for j, path := range r.companions[i].apks {
+			if path == oldPath {
+				r.companions[i].apks[j] = newPath
+			}
+		}
+	}
+}
+
+// Run looks up the releases of apps in order and queues the downloads of the APKs of those that are published, and
+// of their companion assets. Releases that are drafts, prereleases the app doesn't include, too new, held back or
+// older than the kept versions are skipped. Problems of an app are passed to Policy.Error and only end its lookup.
+func (s *Scooper) Run(ctx context.Context, list []App) (run *Run) {
+	run = &Run{apps: list, kept: make(map[string]App)}
+
+	var batch *sources.GitHubBatch
+	if s.opts.GitHubGraphQL {
+		batch = s.githubBatch(ctx, list)
+	}
+
+	for _, app := range list {
+		kindErr := detectKind(&app.info)
+		if !s.opts.Policy.start(app) {
+			continue
+		}
+		s.discover(ctx, run, app, kindErr, batch)
+		s.opts.Policy.finish(app)
+	}
+	return
+}
+
+// githubBatch looks up all apps hosted on GitHub with GraphQL. If the queries fail, it returns what it got (possibly
+// nothing), so the sources fall back to the REST API.
+func (s *Scooper) githubBatch(ctx context.Context, list []App) *sources.GitHubBatch {
+	var urls []string
+	for _, app := range list {
+		info := app.info
+		if detectKind(&info) == nil && info.Source == sources.KindGitHub {
+			urls = append(urls, info.GitURL)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	batch, err := sources.FetchGitHubBatch(ctx, s.sources.GitHub, urls)
+	if err != nil {
+		slog.Warn("Looking up releases with GraphQL failed, using REST requests instead", "error", err)
+	}
+
+	slog.Info("Looked up releases with GraphQL", "repos", batch.Len(), "apps", len(urls))
+
+	return batch
+}
+
+// sameRepo reports whether two git URLs point to the same repository
+func sameRepo(a, b string) bool {
+	normalize := func(u string) string {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(u, "/"), ".git"))
+	}
+	return normalize(a) == normalize(b)
+}
+
+// discover queues the downloads of app, kindErr is the error of detecting its source
+func (s *Scooper) discover(ctx context.Context, run *Run, app App, kindErr error, batch *sources.GitHubBatch) {
+	p := s.opts.Policy
+	logger := slog.With("app", app.Name())
+
+	if kindErr != nil {
+		logger.Error("Detecting source failed", "git", app.info.GitURL, "error", kindErr)
+		p.error(app.Name(), kindErr)
+		return
+	}
+
+	assetHeaders, err := newDownloadHeaders(app.info, s.opts.Redact)
+	if err != nil {
+		logger.Error("Setting up download headers failed", "error", err)
+		p.error(app.Name(), err)
+		return
+	}
+
+	src, err := s.source(app.info, batch)
+	if err != nil {
+		logger.Error("Setting up release source failed", "git", app.info.GitURL, "error", err)
+		p.error(app.Name(), err)
+		return
+	}
+
+	logger.Info("Looking up repo", "git", app.info.GitURL, "source", app.info.Source)
+	var details sources.RepoDetails
+	err = s.apiRetry.Do(ctx, func() (err error) {
+		details, err = src.Details(ctx)
+		return
+	})
+	if err != nil {
+		logger.Error("Looking up repo failed", "error", err)
+		p.error(app.Name(), fmt.Errorf("looking up repo: %w", err))
+	} else {
+		app.info.Summary = details.Description
+
+		repo := Repo{Description: details.Description, License: details.License}
+		if details.MovedTo != "" && !sameRepo(details.MovedTo, app.info.GitURL) {
+			repo.MovedTo = details.MovedTo
+		}
+		err = p.repo(app, repo)
+		if err != nil {
+			p.error(app.Name(), err)
+			return
+		}
+		if details.License != "" {
+			app.info.License = details.License
+		}
+
+		logger.Info("Data from "+app.info.Source, "summary", app.info.Summary, "license", app.info.License)
+
+		// The source already continues with the new name, metadata is cloned from it as well. The package name
+		// doesn't depend on the URL, so the app stays the same.
+		if repo.MovedTo != "" {
+			app.info.GitURL = repo.MovedTo
+		}
+	}
+
+	var releases []sources.Release
+	err = s.apiRetry.Do(ctx, func() (err error) {
+		releases, err = src.ListReleases(ctx)
+		return
+	})
+	if err != nil {
+		logger.Error("Listing releases failed", "git", app.info.GitURL, "error", err)
+		p.error(app.Name(), fmt.Errorf("listing releases: %w", err))
+		return
+	}
+
+	logger.Info("Received releases", "count", len(releases))
+	list := make([]Release, len(releases))
+	for i, r := range releases {
+		list[i] = newRelease(r)
+	}
+	p.releases(app, list)
+
+	keep := app.info.KeepVersions(s.opts.KeepVersions)
+	var keptReleases int
+
+	// Releases newer than the pinned one, and the new releases of frozen apps, are held back: their APKs stay in
+	// the repo if they're there already, but nothing is downloaded for them
+	pinReached := app.info.Pin == ""
+
+	for i, release := range releases {
+		func() {
+			logger := logger.With("release", release.TagName)
+
+			var held string
+			switch {
+			case app.info.Frozen:
+				held = "app is frozen"
+			case !pinReached && release.TagName == app.info.Pin:
+				pinReached = true
+			case !pinReached:
+				held = fmt.Sprintf("newer than the pinned release %q", app.info.Pin)
+			}
+
+			if release.Prerelease && !app.info.IncludesPrereleases() {
+				logger.Info("Skipping prerelease")
+				p.skip(app.Name(), release.TagName, "", "prerelease")
+				return
+			}
+			if release.Draft {
+				logger.Info("Skipping draft")
+				p.skip(app.Name(), release.TagName, "", "draft")
+				return
+			}
+			if release.TagName == "" {
+				logger.Info("Skipping release with empty tag name")
+				p.skip(app.Name(), release.TagName, "", "empty tag name")
+				return
+			}
+			if _, ok := app.info.TagVersion(release.TagName); !ok {
+				logger.Info("Skipping release, its tag doesn't match tag_pattern", "tag_pattern", app.info.TagPattern)
+				p.skip(app.Name(), release.TagName, "", "tag doesn't match tag_pattern")
+				return
+			}
+
+			logger.Debug("Working on release")
+
+			targets, ignored := findTargets(app.info, release)
+			if len(targets) == 0 {
+				logger.Info("No release asset matches the asset filters")
+				p.skip(app.Name(), release.TagName, "", "no matching APK asset")
+				return
+			}
+
+			// Fresh releases wait until they're old enough. APKs of them that are in the repo already, e.g. because
+			// the age was raised, stay, like those of releases that are held back.
+			if age := app.info.ReleaseAgeLimit(s.opts.MinReleaseAge); held == "" && age > 0 && time.Since(release.PublishedAt) < age {
+				var published bool
+				for _, t := range targets {
+					if _, err := os.Stat(filepath.Join(s.opts.RepoDir, p.repoName(t.FileName))); err == nil {
+						published = true
+					}
+				}
+
+				reason := fmt.Sprintf("published less than %s ago", age)
+				if !published {
+					logger.Info("Skipping release, it's too new", "published", release.PublishedAt, "min_release_age", age)
+					p.skip(app.Name(), release.TagName, "", reason)
+					return
+				}
+				held = reason
+			}
+
+			// Releases are listed newest first, so everything after the first few is older than what we keep
+			if keep > 0 && keptReleases >= keep {
+				logger.Info("Skipping release, it's older than the kept versions", "keep", keep)
+				p.skip(app.Name(), release.TagName, "", "older than kept versions")
+				return
+			}
+
+			// Only the newest release has to be newer than everything published, older ones may fill gaps.
+			// Pinned releases can be older than what was published before the pin.
+			newest := keptReleases == 0 && app.info.Pin == ""
+
+			for _, other := range ignored {
+				logger.Info("Ignoring asset, it's not needed for this release", "asset", other.Name)
+				p.skip(app.Name(), release.TagName, other.Name, "another asset was selected")
+			}
+
+			appClone := app
+
+			appClone.info.ReleaseTag = release.TagName
+			appClone.info.ReleasePrerelease = release.Prerelease
+			appClone.info.ReleaseVersionCode = release.VersionCode
+			appClone.info.ReleaseDescription = release.Body
+			if appClone.info.ReleaseDescription != "" {
+				logger.Debug("Release notes", "notes", appClone.info.ReleaseDescription)
+			}
+
+			var releaseAPKs []string
+			queuedBefore := len(run.Downloads)
+
+			for _, target := range targets {
+				// APKs that were renamed with a file name template are found under their names in the repo
+				apkName := p.repoName(target.FileName)
+				apkPath := filepath.Join(s.opts.RepoDir, apkName)
+
+				logger.Debug("Target APK name", "apk", apkName)
+
+				if _, err := os.Stat(apkPath); held != "" && err != nil {
+					logger.Info("Not downloading asset, the release is held back", "asset", target.Asset.Name, "reason", held)
+					p.skip(app.Name(), release.TagName, target.Asset.Name, held)
+					continue
+				}
+
+				run.kept[target.FileName] = appClone
+				releaseAPKs = append(releaseAPKs, apkPath)
+
+				c := &Candidate{
+					App:     appClone,
+					Release: list[i],
+					Asset:   target.Asset,
+					ABI:     target.ABI,
+					Path:    apkPath,
+					Held:    held,
+					Newest:  newest,
+					MaxSize: appClone.info.APKSizeLimit(s.opts.MaxAPKSize),
+				}
+				if !p.selectAPK(ctx, c) {
+					continue
+				}
+
+				asset := sources.Asset(target.Asset)
+
+				sum, origin, err := releaseChecksum(assetHeaders.context(ctx, asset.URL), src, release, asset)
+				if err != nil {
+					logger.Error("Looking for a checksum failed", "asset", asset.Name, "error", err)
+					p.error(app.Name(), fmt.Errorf("release %q: %w", release.TagName, err))
+					continue
+				}
+				if sum != "" {
+					if asset.SHA256 != "" && !strings.EqualFold(asset.SHA256, sum) {
+						logger.Error("Published checksum doesn't match the digest reported by the host", "asset", asset.Name, "checksum_file", origin, "checksum", sum, "digest", asset.SHA256)
+						p.error(app.Name(), fmt.Errorf("release %q: checksum of %q in %q doesn't match the digest reported by the host", release.TagName, asset.Name, origin))
+						continue
+					}
+
+					logger.Info("Download will be verified against the published checksum", "checksum_file", origin)
+					asset.SHA256 = sum
+					c.Checksum = sum
+				}
+
+				if !p.queue(ctx, c) {
+					continue
+				}
+
+				logger.Info("Queueing download", "asset", asset.Name, "path", apkPath)
+
+				name := fmt.Sprintf("APK %q of %q from release %q", asset.Name, app.info.GitURL, release.TagName)
+				run.Downloads = append(run.Downloads, Download{
+					App:    app.Name(),
+					Name:   name,
+					URL:    asset.URL,
+					Size:   asset.Size,
+					Target: apkPath,
+					job: download.Job{
+						App:     app.Name(),
+						Name:    name,
+						URL:     asset.URL,
+						SHA256:  asset.SHA256,
+						Size:    asset.Size,
+						MaxSize: c.MaxSize,
+						Open: func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+							return src.DownloadAsset(assetHeaders.context(ctx, asset.URL), asset, offset)
+						},
+						Convert: c.Convert,
+						Verify: func(path string) error {
+							return p.verify(c, path)
+						},
+					},
+				})
+			}
+
+			// Held releases only use up a kept version if their APKs are in the repo, so freezing an app doesn't
+			// prune the versions it was frozen at
+			if pinReached && len(releaseAPKs) > 0 {
+				keptReleases++
+			}
+
+			if held != "" && len(releaseAPKs) == 0 {
+				return
+			}
+			// Companions of deferred APKs are downloaded with them
+			if p.deferred(app.Name()) && len(run.Downloads) == queuedBefore {
+				return
+			}
+
+			companions, companionAssets := appClone.info.FindCompanionAssets(release)
+			for i, c := range companions {
+				asset := companionAssets[i]
+
+				// Companions of APKs that are already in the repo are only missing if they were added to apps.yaml later
+				if len(run.Downloads) == queuedBefore {
+					target, err := companionTarget(s.opts.RepoDir, c, releaseAPKs)
+					if err == nil {
+						_, err = os.Stat(target)
+					}
+					if err == nil {
+						logger.Info("Already have companion asset", "path", target)
+						continue
+					}
+				}
+
+				if s.opts.DryRun {
+					logger.Info("Would download companion asset", "asset", asset.Name, "type", c.Type)
+					continue
+				}
+
+				if run.companionDir == "" {
+					run.companionDir, err = os.MkdirTemp("", "companions-*")
+					if err != nil {
+						logger.Error("Creating directory for companion assets failed", "error", err)
+						p.error(app.Name(), fmt.Errorf("creating directory for companion assets: %w", err))
+						return
+					}
+				}
+				staged := filepath.Join(run.companionDir, fmt.Sprintf("%d-%s", len(run.companions), asset.Name))
+
+				logger.Info("Queueing download of companion asset", "asset", asset.Name, "type", c.Type)
+
+				name := fmt.Sprintf("%s %q of %q from release %q", c.Type, asset.Name, app.info.GitURL, release.TagName)
+				run.Downloads = append(run.Downloads, Download{
+					App:    app.Name(),
+					Name:   name,
+					URL:    asset.URL,
+					Size:   asset.Size,
+					Target: staged,
+					job: download.Job{
+						App:    app.Name(),
+						Name:   name,
+						URL:    asset.URL,
+						SHA256: asset.SHA256,
+						Size:   asset.Size,
+						Open: func(ctx context.Context, offset int64) (io.ReadCloser, int64, error) {
+							return src.DownloadAsset(assetHeaders.context(ctx, asset.URL), asset, offset)
+						},
+					},
+				})
+				run.companions = append(run.companions, companionJob{
+					app:       app.Name(),
+					release:   release.TagName,
+					companion: c,
+					staged:    staged,
+					apks:      releaseAPKs,
+				})
+			}
+		}()
+	}
+
+	if !pinReached {
+		logger.Error("The pinned release doesn't exist, no releases were published", "pin", app.info.Pin)
+		p.error(app.Name(), fmt.Errorf("there is no release with the pinned tag %q", app.info.Pin))
+	}
+}
+
+// Download downloads downloads and returns the errors of those that failed by app. Downloads are checked against
+// the digests and sizes the host reports and the checksums published with their releases, APKs with Policy.Verify.
+func (s *Scooper) Download(ctx context.Context, downloads []Download) (errs map[string][]error) {
+	jobs := make([]download.Job, len(downloads))
+	byTarget := make(map[string]Download, len(downloads))
+	for i, d := range downloads {
+		jobs[i] = d.job
+		jobs[i].Target = d.Target
+		byTarget[d.Target] = d
+	}
+
+	pool := download.Pool{
+		Workers:      s.opts.DownloadWorkers,
+		HostInterval: s.opts.HostInterval,
+		Timeout:      s.opts.DownloadTimeout,
+		Retry:        s.downloadRetry,
+		OnSuccess: func(job download.Job, bytes int64, elapsed time.Duration) {
+			s.opts.Policy.downloaded(byTarget[job.Target], bytes, elapsed)
+		},
+	}
+	if s.opts.Progress != nil {
+		pool.Progress = downloadProgress{progress: s.opts.Progress, downloads: byTarget}
+	}
+	return pool.Run(ctx, jobs)
+}
@@ -0,0 +1,331 @@
+// Package scoop is the API for Go programs that embed metascoop: it looks up the releases of the apps of an apps
+// file, queues and downloads their APKs and companion assets, removes versions that are no longer kept, finds the
+// fastlane metadata of apps and generates the indexes of an F-Droid repo. The metascoop command runs its updates with
+// Scooper.Run, Scooper.Download, Scooper.PlaceCompanions, Scooper.Prunable and Scooper.Prune and generates the indexes
+// with UpdateIndex. It adds its own checks of downloaded APKs, the state kept between runs and the metadata, README
+// and website of the repo through a Policy.
+//
+// Nothing in this package exits the process or logs fatally, all problems are returned as errors or passed to
+// Policy.Error. The functions log with the default slog logger.
+package scoop
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/retry"
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// Options configure a Scooper
+type Options struct {
+	// RepoDir is the repo directory of the fdroid directory that's updated. The metadata and archive directories
+	// are next to it.
+	RepoDir string
+
+	// Policy decides what a run does with the apps and assets it finds
+	Policy Policy
+
+	// GitHub is the client for the GitHub API, http.DefaultClient if it's nil. GitHubAPI is the base URL of the
+	// REST API, the one of github.com if it's empty.
+	GitHub    *http.Client
+	GitHubAPI string
+
+	// GitHubGraphQL looks up the releases of all GitHub apps of a run with a few batched GraphQL queries instead of
+	// several REST requests per app. The GitHub client must be authenticated, apps it doesn't work for use REST.
+	GitHubGraphQL bool
+
+	GitLabToken string
+	GiteaToken  string
+
+	// HTTPClient is used for the hosts other than GitHub, http.DefaultClient if it's nil
+	HTTPClient *http.Client
+
+	// MaxRetries is how often failed API requests and downloads are retried. RetryBudget limits the retries of
+	// each of them for all apps, 0 for no limit.
+	MaxRetries  int
+	RetryBudget int
+
+	// DownloadWorkers is the number of concurrent downloads, 1 if it's zero
+	DownloadWorkers int
+
+	// DownloadTimeout is the maximum duration of a single download attempt, zero for no limit
+	DownloadTimeout time.Duration
+
+	// HostInterval is the minimum time between starting two downloads from the same host
+	HostInterval time.Duration
+
+	// Progress is told about the downloads, if it isn't nil
+	Progress Progress
+
+	// KeepVersions, MinReleaseAge and MaxAPKSize apply to the apps that don't set keep_versions, min_release_age
+	// or max_apk_size. Zero doesn't limit them.
+	KeepVersions  int
+	MinReleaseAge time.Duration
+	MaxAPKSize    int64
+
+	// Archive moves the versions that are no longer kept to the archive directory, see Prunable and Prune
+	Archive bool
+
+	// Sidecars are the suffixes of the files next to APKs that are moved and removed with them, like their
+	// signatures
+	Sidecars []string
+
+	// DryRun only plans the downloads of a run: companion assets aren't staged
+	DryRun bool
+
+	// Redact is called with the secrets of the download_auth headers of apps, e.g. to keep them out of logs
+	Redact func(secrets ...string)
+
+	// GitCacheDir is the directory with the clones of Metadata, kept between runs. A temporary directory is used
+	// if it's empty.
+	GitCacheDir string
+}
+
+// Scooper looks up and downloads the releases of apps. Apps with the same repo share their requests, like the
+// apps of a monorepo that publish different assets. Its methods are safe for concurrent use, except that Runs
+// must not overlap.
+type Scooper struct {
+	opts    Options
+	sources sources.Options
+	shared  *sharedSources
+
+	apiRetry      retry.Policy
+	downloadRetry retry.Policy
+
+	lock     sync.Mutex
+	gitCache *git.Cache
+	tmpCache string
+}
+
+// New returns a Scooper with the options opts
+func New(opts Options) (s *Scooper, err error) {
+	if opts.DownloadWorkers <= 0 {
+		opts.DownloadWorkers = 1
+	}
+
+	client := github.NewClient(opts.GitHub)
+	if opts.GitHubAPI != "" {
+		u, perr := url.Parse(opts.GitHubAPI)
+		if perr != nil {
+			return nil, fmt.Errorf("parsing GitHub API URL: %w", perr)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		client.BaseURL = u
+	}
+
+	return &Scooper{
+		opts: opts,
+		sources: sources.Options{
+			GitHub:      client,
+			GitLabToken: opts.GitLabToken,
+			GiteaToken:  opts.GiteaToken,
+			HTTPClient:  opts.HTTPClient,
+		},
+		shared:        newSharedSources(),
+		apiRetry:      opts.retryPolicy("API request"),
+		downloadRetry: opts.retryPolicy("download"),
+	}, nil
+}
+
+// retryPolicy returns the policy of the retries of name, with its own budget
+func (o Options) retryPolicy(name string) retry.Policy {
+	return retry.Policy{
+		Name:       name,
+		MaxRetries: o.MaxRetries,
+		BaseDelay:  2 * time.Second,
+		MaxDelay:   time.Minute,
+		Budget:     retry.NewBudget(o.RetryBudget),
+	}
+}
+
+// source returns the source the releases of app are taken from, using batch for GitHub repos if it isn't nil. The
+// kind must have been detected already, see detectKind.
+func (s *Scooper) source(app apps.AppInfo, batch *sources.GitHubBatch) (src sources.Source, err error) {
+	opts := s.sources
+	opts.GitHubBatch = batch
+
+	switch app.Source {
+	case sources.KindURL:
+		return sources.NewURL(app.GitURL, app.URLSource(), opts)
+	case sources.KindFDroid:
+		return sources.NewFDroid(app.FDroidSource(), opts)
+	case sources.KindActions:
+		return sources.NewActions(app.GitURL, app.ActionsSource(), opts)
+	}
+
+	src, err = sources.New(app.Source, app.GitURL, opts)
+	if err != nil {
+		return
+	}
+	return s.shared.get(app.Source, app.GitURL, src), nil
+}
+
+// detectKind sets the source kind of app from its git URL if the apps file doesn't set it
+func detectKind(app *apps.AppInfo) (err error) {
+	if app.Source != "" {
+		return nil
+	}
+	app.Source, err = sources.DetectKind(app.GitURL)
+	return
+}
+
+// Releases returns the releases of app, newest first. Unlike Run, it doesn't leave out drafts, prereleases or
+// releases whose tag doesn't match the tag pattern of the app.
+func (s *Scooper) Releases(ctx context.Context, app App) (releases []Release, err error) {
+	err = detectKind(&app.info)
+	if err != nil {
+		return
+	}
+	src, err := s.source(app.info, nil)
+	if err != nil {
+		return
+	}
+
+	var list []sources.Release
+	err = s.apiRetry.Do(ctx, func() (err error) {
+		list, err = src.ListReleases(ctx)
+		return
+	})
+	for _, r := range list {
+		releases = append(releases, newRelease(r))
+	}
+	return
+}
+
+// Target is an APK asset of a release with the file name it's published under
+type Target struct {
+	Asset Asset
+
+	// ABI is the only ABI the APK has native code for, if the release has an APK per ABI. It's empty for the
+	// universal APK of such a release.
+	ABI string
+
+	// FileName is the name of the APK in the repo directory, its release file name
+	FileName string
+}
+
+// Targets returns the APKs of release that are published for app. If the release has an APK per ABI, all of them
+// are, and its universal APK, otherwise only the first matching asset is. The others are ignored.
+func Targets(app App, release Release) (targets []Target, ignored []Asset) {
+	return findTargets(app.info, release.source())
+}
+
+func findTargets(app apps.AppInfo, release sources.Release) (targets []Target, ignored []Asset) {
+	selected, others := apps.SelectABISplits(app.FindAPKAssets(release))
+	for _, asset := range selected {
+		t := Target{Asset: Asset(asset)}
+		if len(selected) > 1 {
+			t.ABI = apps.AssetABI(asset.Name)
+		}
+		if t.ABI != "" {
+			t.FileName = apps.GenerateSplitReleaseFilename(app.Name(), release.TagName, t.ABI)
+		} else {
+			t.FileName = apps.GenerateReleaseFilename(app.Name(), release.TagName)
+		}
+		targets = append(targets, t)
+	}
+	for _, asset := range others {
+		ignored = append(ignored, Asset(asset))
+	}
+	return
+}
+
+// Metadata is the fastlane metadata of an app, as paths of the files in a checkout of its metadata repo
+type Metadata struct {
+	// Texts maps locales to the names of text files, like "full_description.txt", to their paths
+	Texts map[string]map[string]string
+
+	// Changelogs maps locales to versionCodes to the paths of their changelogs
+	Changelogs map[string]map[int]string
+
+	// Images maps locales to image kinds, like "icon" or "featureGraphic", to their paths
+	Images map[string]map[string]string
+
+	// Screenshots maps locales to screenshot kinds, like "phoneScreenshots", to the paths of the screenshots
+	Screenshots map[string]map[string][]string
+
+	// OtherScreenshots are images with "screenshot" in their path, for repos without fastlane screenshots
+	OtherScreenshots []string
+}
+
+// Metadata returns the fastlane metadata of app, from a checkout of its metadata repo at the tag of app's release
+// if fromRelease is set, else of its default branch. The paths stay valid until Close is called.
+func (s *Scooper) Metadata(ctx context.Context, app App, fromRelease bool) (metadata Metadata, err error) {
+	cache, err := s.metadataCache()
+	if err != nil {
+		return
+	}
+
+	t := git.Target{URL: app.info.MetadataGitURL(), Ref: app.info.MetadataRef(fromRelease)}
+	dir, err := cache.SharedCheckout(ctx, t)
+	if err != nil {
+		return metadata, fmt.Errorf("checking out %s: %w", git.RedactURL(t.URL), err)
+	}
+
+	m, err := apps.FindMetadata(dir, app.info.MetadataPath)
+	if err != nil {
+		return
+	}
+	return Metadata{
+		Texts:            m.Texts,
+		Changelogs:       m.Changelogs,
+		Images:           m.Images,
+		Screenshots:      m.LocalizedScreenshots,
+		OtherScreenshots: m.Screenshots,
+	}, nil
+}
+
+// metadataCache returns the git cache of Metadata, which is created the first time
+func (s *Scooper) metadataCache() (cache *git.Cache, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.gitCache != nil {
+		return s.gitCache, nil
+	}
+
+	dir := s.opts.GitCacheDir
+	if dir == "" {
+		s.tmpCache, err = os.MkdirTemp("", "git-cache-*")
+		if err != nil {
+			return
+		}
+		dir = s.tmpCache
+	}
+
+	s.gitCache, err = git.NewCache(dir)
+	if err != nil {
+		return
+	}
+	s.gitCache.Retry = s.opts.retryPolicy("git fetch")
+	return s.gitCache, nil
+}
+
+// Close removes the checkouts of Metadata, and its clones if Options.GitCacheDir is empty
+func (s *Scooper) Close() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.gitCache != nil {
+		s.gitCache.RemoveCheckouts()
+		s.gitCache = nil
+	}
+	if s.tmpCache != "" {
+		err = os.RemoveAll(s.tmpCache)
+		s.tmpCache = ""
+	}
+	return
+}
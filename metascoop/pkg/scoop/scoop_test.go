@@ -0,0 +1,202 @@
+package scoop_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/e2e"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// newScooper returns a Scooper for the apps file appsYAML, with the releases of repos at a fake GitHub
+func newScooper(t *testing.T, policy scoop.Policy, appsYAML string, repos ...*e2e.Repo) (s *scoop.Scooper, list []scoop.App, repoDir string) {
+	t.Helper()
+
+	gh := e2e.NewGitHub(repos...)
+	t.Cleanup(gh.Close)
+
+	dir := t.TempDir()
+	repoDir = filepath.Join(dir, "fdroid", "repo")
+	err := os.MkdirAll(repoDir, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appsFile := filepath.Join(dir, "apps.yaml")
+	err = os.WriteFile(appsFile, []byte(appsYAML), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err = scoop.LoadApps(appsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = scoop.New(scoop.Options{RepoDir: repoDir, Policy: policy, GitHubAPI: gh.URL()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return
+}
+
+const clockApp = "clock:\n  git: https://github.com/example/clock\n"
+
+func clockRepo(t *testing.T) *e2e.Repo {
+	t.Helper()
+
+	signer, err := e2e.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := e2e.BuildAPK(e2e.Manifest{Package: "com.example.clock", VersionCode: 1, VersionName: "1.0.0", MinSdkVersion: 24, TargetSdkVersion: 34}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &e2e.Repo{Owner: "example", Name: "clock", Releases: []e2e.Release{
+		{Tag: "v1.1.0-rc.1", Prerelease: true, Assets: []e2e.Asset{{Name: "clock-rc.apk", Data: data}}},
+		{Tag: "v1.0.0", PublishedAt: time.Now().Add(-time.Hour), Assets: []e2e.Asset{{Name: "clock.apk", Data: data, Digest: true}}},
+	}}
+}
+
+func TestRunAndDownload(t *testing.T) {
+	var skips []string
+	policy := scoop.Policy{
+		Skip: func(app, release, asset, reason string) {
+			skips = append(skips, release+": "+reason)
+		},
+	}
+	s, list, repoDir := newScooper(t, policy, clockApp, clockRepo(t))
+	ctx := context.Background()
+
+	run := s.Run(ctx, list)
+	if len(run.Downloads) != 1 {
+		t.Fatalf("queued %d downloads, want 1", len(run.Downloads))
+	}
+	want := filepath.Join(repoDir, "clock_v1.0.0.apk")
+	if run.Downloads[0].Target != want {
+		t.Errorf("download target is %q, want %q", run.Downloads[0].Target, want)
+	}
+	if len(skips) != 1 || skips[0] != "v1.1.0-rc.1: prerelease" {
+		t.Errorf("skipped %q, want the prerelease", skips)
+	}
+
+	errs := s.Download(ctx, run.Downloads)
+	if len(errs) != 0 {
+		t.Fatalf("downloads failed: %v", errs)
+	}
+	if _, err := os.Stat(want); err != nil {
+		t.Fatal(err)
+	}
+
+	// APKs that are in the repo already aren't downloaded again
+	skips = nil
+	run = s.Run(ctx, list)
+	if len(run.Downloads) != 0 {
+		t.Errorf("queued %d downloads of an APK that's in the repo", len(run.Downloads))
+	}
+	if len(skips) != 2 || skips[1] != "v1.0.0: already in repo" {
+		t.Errorf("skipped %q, want the APK that's in the repo", skips)
+	}
+}
+
+func TestVerifyRemovesRejectedAPKs(t *testing.T) {
+	rejected := errors.New("wrong signer")
+	policy := scoop.Policy{
+		Verify: func(c *scoop.Candidate, path string) error {
+			return rejected
+		},
+	}
+	s, list, _ := newScooper(t, policy, clockApp, clockRepo(t))
+	ctx := context.Background()
+
+	run := s.Run(ctx, list)
+	errs := s.Download(ctx, run.Downloads)
+	if len(errs["clock"]) != 1 || !errors.Is(errs["clock"][0], rejected) {
+		t.Fatalf("download errors are %v, want the error of Verify", errs)
+	}
+	if _, err := os.Stat(run.Downloads[0].Target); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rejected APK wasn't removed: %v", err)
+	}
+}
+
+func TestTargetsOfSplitRelease(t *testing.T) {
+	appsFile := filepath.Join(t.TempDir(), "apps.yaml")
+	err := os.WriteFile(appsFile, []byte(clockApp), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := scoop.LoadApps(appsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	release := scoop.Release{TagName: "v2.0.0", Assets: []scoop.Asset{
+		{Name: "clock-arm64-v8a.apk"}, {Name: "clock-armeabi-v7a.apk"}, {Name: "clock.apk"},
+	}}
+	targets, ignored := scoop.Targets(list[0], release)
+
+	want := []scoop.Target{
+		{Asset: release.Assets[0], ABI: "arm64-v8a", FileName: "clock_v2.0.0_arm64-v8a.apk"},
+		{Asset: release.Assets[1], ABI: "armeabi-v7a", FileName: "clock_v2.0.0_armeabi-v7a.apk"},
+		// For devices with other ABIs
+		{Asset: release.Assets[2], FileName: "clock_v2.0.0.apk"},
+	}
+	if !reflect.DeepEqual(targets, want) || len(ignored) != 0 {
+		t.Errorf("got targets %+v and ignored %+v, want %+v", targets, ignored, want)
+	}
+}
+
+func TestFrozenAppKeepsItsVersions(t *testing.T) {
+	signer, err := e2e.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := func(tag string, code int64) e2e.Release {
+		data, err := e2e.BuildAPK(e2e.Manifest{Package: "com.example.clock", VersionCode: code, VersionName: tag, MinSdkVersion: 24, TargetSdkVersion: 34}, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e2e.Release{Tag: tag, Assets: []e2e.Asset{{Name: "clock.apk", Data: data}}}
+	}
+	repo := &e2e.Repo{Owner: "example", Name: "clock", Releases: []e2e.Release{
+		release("v3", 3), release("v2", 2), release("v1", 1),
+	}}
+
+	s, list, repoDir := newScooper(t, scoop.Policy{}, clockApp+"  frozen: true\n  keep_versions: 2\n", repo)
+
+	// The app was frozen at the two versions in the repo, then v3 was released
+	index := `{"packages": {"com.example.clock": [
+		{"apkName": "clock_v2.apk", "versionCode": 2},
+		{"apkName": "clock_v1.apk", "versionCode": 1}
+	]}}`
+	err = os.WriteFile(filepath.Join(repoDir, "index-v1.json"), []byte(index), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"clock_v2.apk", "clock_v1.apk"} {
+		err = os.WriteFile(filepath.Join(repoDir, name), nil, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := s.Run(context.Background(), list)
+	if len(run.Downloads) != 0 {
+		t.Errorf("queued %d downloads for a frozen app", len(run.Downloads))
+	}
+
+	pruned, err := s.Prunable(run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 0 {
+		t.Errorf("frozen app would lose %v, the new release took one of the kept versions", pruned)
+	}
+}
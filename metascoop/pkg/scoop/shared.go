@@ -0,0 +1,82 @@
+package scoop
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/nymtech/fdroid/metascoop/sources"
+)
+
+// sharedSources lets the apps of a monorepo, i.e. several apps.yaml entries with the same repo that publish
+// different assets, share its details and releases, so they're only requested once per run
+type sharedSources struct {
+	lock    sync.Mutex
+	sources map[string]*sharedSource
+}
+
+func newSharedSources() *sharedSources {
+	return &sharedSources{sources: make(map[string]*sharedSource)}
+}
+
+// get returns the source shared by all apps of kind with the repo gitURL, src if it's the first one
+func (s *sharedSources) get(kind, gitURL string, src sources.Source) sources.Source {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := kind + "\x00" + strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(gitURL), "/"), ".git")
+	shared, ok := s.sources[key]
+	if !ok {
+		shared = &sharedSource{Source: src}
+		s.sources[key] = shared
+	}
+	return shared
+}
+
+// sharedSource remembers the results of a source. Failed requests aren't remembered, so they can be retried.
+type sharedSource struct {
+	sources.Source
+
+	lock     sync.Mutex
+	details  *sources.RepoDetails
+	releases []sources.Release
+}
+
+func (s *sharedSource) Details(ctx context.Context) (d sources.RepoDetails, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.details != nil {
+		return *s.details, nil
+	}
+
+	d, err = s.Source.Details(ctx)
+	if err == nil {
+		s.details = &d
+	}
+	return
+}
+
+// ListReleases returns a copy of the releases, so the apps can't change each other's
+func (s *sharedSource) ListReleases(ctx context.Context) (releases []sources.Release, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.releases == nil {
+		s.releases, err = s.Source.ListReleases(ctx)
+		if err != nil {
+			s.releases = nil
+			return
+		}
+		if s.releases == nil {
+			s.releases = []sources.Release{}
+		}
+	}
+
+	releases = make([]sources.Release, len(s.releases))
+	for i, r := range s.releases {
+		r.Assets = append([]sources.Asset(nil), r.Assets...)
+		releases[i] = r
+	}
+	return
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// appPlan describes what a run would change for a single app
+type appPlan struct {
+	App     string
+	Package string
+
+	OldVersion string
+	NewVersion string
+
+	Downloads []string
+
+	// Pruned contains APKs that would be removed or archived because of the app's retention policy
+	Pruned []string
+
+	MetadataChanges []string
+}
+
+// runPlan is what a dry run reports instead of changing the repo
+type runPlan struct {
+	Apps []appPlan
+
+	// Archive is set if pruned APKs are moved to the archive instead of being deleted
+	Archive bool
+
+	// Removed contains packages that are in the index, but no longer produced by any app
+	Removed []string
+}
+
+func (p runPlan) Empty() bool {
+	if len(p.Removed) > 0 {
+		return false
+	}
+	for _, a := range p.Apps {
+		if len(a.Downloads) > 0 || len(a.Pruned) > 0 || len(a.MetadataChanges) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func formatVersion(p apps.PackageInfo) string {
+	return fmt.Sprintf("%s (%d)", p.VersionName, p.VersionCode)
+}
+
+// buildPlan compares what discovery found with the current index and metadata files
+func buildPlan(archive bool, appsList []apps.AppInfo, apkInfoMap map[string]apps.AppInfo, jobs []scoop.Download, pruned []scoop.Pruned, index *apps.RepoIndex, metadataDir string) (plan runPlan) {
+	// map[apkName]packageName for everything that is already in the repo
+	var apkPackages = make(map[string]string)
+	for pkgName, pkgs := range index.Packages {
+		for _, p := range pkgs {
+			apkPackages[p.ApkName] = pkgName
+		}
+	}
+
+	var producedPackages = make(map[string]bool)
+
+	plan.Archive = archive
+
+	for _, app := range appsList {
+		ap := appPlan{App: app.Name()}
+
+		for apkName, info := range apkInfoMap {
+			if info.Name() != app.Name() {
+				continue
+			}
+			if pkg, ok := apkPackages[apkName]; ok {
+				ap.Package = pkg
+				producedPackages[pkg] = true
+			}
+		}
+
+		for _, job := range jobs {
+			if job.App != app.Name() {
+				continue
+			}
+
+			apkName := filepath.Base(job.Target)
+			ap.Downloads = append(ap.Downloads, apkName)
+
+			// Releases are listed newest first, so the first download is the new version
+			if ap.NewVersion == "" {
+				ap.NewVersion = apkInfoMap[apkName].ReleaseTag
+			}
+		}
+
+		for _, p := range pruned {
+			if p.App == app.Name() {
+				ap.Pruned = append(ap.Pruned, filepath.Base(p.Path))
+			}
+		}
+
+		if ap.Package != "" {
+			if latest, ok := findSuggestedPackage(index, ap.Package, apkInfoMap); ok {
+				ap.OldVersion = formatVersion(latest)
+
+				if apkInfo, ok := apkInfoMap[latest.ApkName]; ok {
+					ap.MetadataChanges = plannedMetadataChanges(filepath.Join(metadataDir, ap.Package+".yml"), apkInfo, latest)
+				}
+			}
+		}
+
+		plan.Apps = append(plan.Apps, ap)
+	}
+
+	for pkgName := range index.Packages {
+		if !producedPackages[pkgName] {
+			plan.Removed = append(plan.Removed, pkgName)
+		}
+	}
+
+	sort.Slice(plan.Apps, func(i, j int) bool {
+		return plan.Apps[i].App < plan.Apps[j].App
+	})
+	sort.Strings(plan.Removed)
+
+	return
+}
+
+// plannedMetadataChanges returns the fields of the metadata file at path that a run would change
+func plannedMetadataChanges(path string, apkInfo apps.AppInfo, latest apps.PackageInfo) []string {
+	old, err := apps.ReadMetaFile(path)
+	if err != nil {
+		return []string{fmt.Sprintf("(cannot read %q: %s)", path, err.Error())}
+	}
+
+	updated := make(map[string]interface{}, len(old))
+	for k, v := range old {
+		updated[k] = v
+	}
+
+	applyAppInfo(slog.With("app", apkInfo.Name()), updated, apkInfo, latest)
+
+	return changedFields(old, updated)
+}
+
+func (p runPlan) Print(w io.Writer) {
+	fmt.Fprintln(w, "Planned changes:")
+
+	for _, a := range p.Apps {
+		fmt.Fprintf(w, "\n%s", a.App)
+		if a.Package != "" {
+			fmt.Fprintf(w, " (%s)", a.Package)
+		}
+		fmt.Fprintln(w)
+
+		old := a.OldVersion
+		if old == "" {
+			old = "not published yet"
+		}
+		fmt.Fprintf(w, "  current version:  %s\n", old)
+
+		if a.NewVersion != "" {
+			fmt.Fprintf(w, "  new version:      %s\n", a.NewVersion)
+		}
+
+		if len(a.Downloads) == 0 {
+			fmt.Fprintln(w, "  downloads:        none")
+		} else {
+			fmt.Fprintf(w, "  downloads:        %s\n", strings.Join(a.Downloads, ", "))
+		}
+
+		if len(a.Pruned) > 0 && p.Archive {
+			fmt.Fprintf(w, "  archived:         %s\n", strings.Join(a.Pruned, ", "))
+		} else if len(a.Pruned) > 0 {
+			fmt.Fprintf(w, "  removals:         %s\n", strings.Join(a.Pruned, ", "))
+		}
+
+		if len(a.MetadataChanges) == 0 {
+			fmt.Fprintln(w, "  metadata changes: none")
+		} else {
+			fmt.Fprintf(w, "  metadata changes: %s\n", strings.Join(a.MetadataChanges, ", "))
+		}
+	}
+
+	if len(p.Removed) > 0 {
+		fmt.Fprintf(w, "\nPackages that would be removed: %s\n", strings.Join(p.Removed, ", "))
+	}
+}
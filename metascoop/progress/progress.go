@@ -0,0 +1,361 @@
+// Package progress shows what a run is doing in a terminal: the current phase, a spinner for the app that is
+// processed and bars for the running downloads. Log messages and everything written to stdout are printed above
+// it, so the display stays at the bottom of the terminal. CI logs get the plain log output instead.
+package progress
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// interval is how often the display is redrawn
+const interval = 100 * time.Millisecond
+
+// maxBars is the number of downloads that are shown, the others are counted
+const maxBars = 8
+
+var spinner = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// IsTerminal reports whether f is an interactive terminal that understands escape sequences
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	return os.Getenv("TERM") != "dumb"
+}
+
+// Display draws the progress of a run at the bottom of a terminal. All methods are safe for concurrent use, and
+// do nothing on a nil Display, so callers don't have to check whether it's enabled.
+type Display struct {
+	out   *os.File
+	width int
+
+	lock    sync.Mutex
+	header  func() string
+	started time.Time
+	phase   string
+	working map[string]string
+	bars    []*Bar
+	frame   int
+	lines   int
+	running bool
+
+	stop     chan struct{}
+	done     sync.WaitGroup
+	stdout   *os.File
+	captured *os.File
+}
+
+// New returns a display that draws on out, usually stderr
+func New(out *os.File) *Display {
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 100
+	}
+	return &Display{out: out, width: width, working: make(map[string]string)}
+}
+
+// Start starts drawing. Until Stop is called, os.Stdout is replaced by a pipe whose lines are printed above the
+// display. GitHub Actions group markers on stdout ("::group::<name>") set the phase instead of being printed.
+func (d *Display) Start() (err error) {
+	if d == nil {
+		return nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	d.started = time.Now()
+	d.running = true
+	d.stop = make(chan struct{})
+	d.stdout, d.captured = os.Stdout, w
+	os.Stdout = w
+	d.lock.Unlock()
+
+	d.done.Add(2)
+	go d.readStdout(r)
+	go d.loop()
+	return nil
+}
+
+// Stop removes the display from the terminal and restores os.Stdout
+func (d *Display) Stop() {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	if !d.running {
+		d.lock.Unlock()
+		return
+	}
+	os.Stdout = d.stdout
+	d.lock.Unlock()
+
+	// Closing the pipe ends readStdout once it printed everything
+	_ = d.captured.Close()
+	close(d.stop)
+	d.done.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.clear()
+	d.running = false
+}
+
+func (d *Display) loop() {
+	defer d.done.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.lock.Lock()
+			d.frame++
+			d.redraw()
+			d.lock.Unlock()
+		}
+	}
+}
+
+func (d *Display) readStdout(r *os.File) {
+	defer d.done.Done()
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "::group::"):
+			d.lock.Lock()
+			d.phase = strings.TrimPrefix(line, "::group::")
+			d.lock.Unlock()
+		case line == "::endgroup::":
+		default:
+			_, _ = d.Write([]byte(line + "\n"))
+		}
+	}
+}
+
+// Write prints p above the display, it's meant to be used as the output of the logger
+func (d *Display) Write(p []byte) (n int, err error) {
+	if d == nil {
+		return len(p), nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.running {
+		return d.out.Write(p)
+	}
+	d.clear()
+	n, err = d.out.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		_, _ = d.out.Write([]byte{'\n'})
+	}
+	d.redraw()
+	return
+}
+
+// SetHeader sets the function that returns the text after the phase, e.g. counters of the run. It's called on
+// every redraw.
+func (d *Display) SetHeader(header func() string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.header = header
+}
+
+// Working shows that app is being processed, status describes what's done with it
+func (d *Display) Working(app, status string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.working[app] = status
+}
+
+// Idle removes the spinner of app
+func (d *Display) Idle(app string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.working, app)
+}
+
+// Bar adds a progress bar for a download of total bytes, 0 if the size isn't known. It's removed with Done.
+func (d *Display) Bar(name string, total int64) *Bar {
+	if d == nil {
+		return nil
+	}
+
+	b := &Bar{d: d, name: name, total: total}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.bars = append(d.bars, b)
+	return b
+}
+
+// clear removes the display from the terminal, d.lock must be held
+func (d *Display) clear() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.out, "\x1b[%dF\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+// redraw replaces the display with its current state, d.lock must be held
+func (d *Display) redraw() {
+	var lines []string
+
+	header := d.phase
+	if header == "" {
+		header = "Starting"
+	}
+	header = fmt.Sprintf("%s %s", spinner[d.frame%len(spinner)], header)
+	if d.header != nil {
+		if extra := d.header(); extra != "" {
+			header += " · " + extra
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%s · %s", header, time.Since(d.started).Round(time.Second)))
+
+	apps := make([]string, 0, len(d.working))
+	for app := range d.working {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	for _, app := range apps {
+		lines = append(lines, fmt.Sprintf("  %s %s: %s", spinner[d.frame%len(spinner)], app, d.working[app]))
+	}
+
+	for i, b := range d.bars {
+		if i == maxBars {
+			lines = append(lines, fmt.Sprintf("  … %d more downloads", len(d.bars)-maxBars))
+			break
+		}
+		lines = append(lines, "  "+b.line(d.width/3))
+	}
+
+	d.clear()
+	var buf strings.Builder
+	for _, line := range lines {
+		buf.WriteString(truncate(line, d.width-1))
+		buf.WriteByte('\n')
+	}
+	_, _ = io.WriteString(d.out, buf.String())
+	d.lines = len(lines)
+}
+
+// truncate shortens line to width characters, lines must not wrap or clearing them would leave some behind
+func truncate(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width-1]) + "…"
+}
+
+// Bar is the progress of a download. Its methods do nothing on a nil Bar.
+type Bar struct {
+	d     *Display
+	name  string
+	total int64
+
+	// written is guarded by the lock of the display
+	written int64
+}
+
+// Set sets the number of bytes that were downloaded, e.g. when a download is resumed
+func (b *Bar) Set(n int64) {
+	if b == nil {
+		return
+	}
+
+	b.d.lock.Lock()
+	defer b.d.lock.Unlock()
+	b.written = n
+}
+
+// Write counts the downloaded bytes in p
+func (b *Bar) Write(p []byte) (n int, err error) {
+	if b == nil {
+		return len(p), nil
+	}
+
+	b.d.lock.Lock()
+	defer b.d.lock.Unlock()
+	b.written += int64(len(p))
+	return len(p), nil
+}
+
+// Done removes the bar
+func (b *Bar) Done() {
+	if b == nil {
+		return
+	}
+
+	b.d.lock.Lock()
+	defer b.d.lock.Unlock()
+	for i, other := range b.d.bars {
+		if other == b {
+			b.d.bars = append(b.d.bars[:i], b.d.bars[i+1:]...)
+			break
+		}
+	}
+}
+
+// line renders the bar with a width of about size characters
+func (b *Bar) line(size int) string {
+	if b.total <= 0 {
+		return fmt.Sprintf("%s %s", b.name, formatBytes(b.written))
+	}
+
+	done := b.written
+	if done > b.total {
+		done = b.total
+	}
+	filled := int(int64(size) * done / b.total)
+	return fmt.Sprintf("%s [%s%s] %3d%% %s/%s", b.name, strings.Repeat("█", filled), strings.Repeat("░", size-filled),
+		100*done/b.total, formatBytes(done), formatBytes(b.total))
+}
+
+// formatBytes returns n in human-readable binary units, e.g. "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+	"github.com/nymtech/fdroid/metascoop/progress"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+const (
+	progressAuto = "auto"
+	progressOn   = "on"
+	progressOff  = "off"
+)
+
+// newProgressDisplay returns the progress display for the -progress mode, nil if it's off. "auto" shows it if
+// stderr is a terminal and the run isn't on a CI system, whose logs are better off with plain log messages.
+func newProgressDisplay(mode string) (d *progress.Display, err error) {
+	switch mode {
+	case progressOn:
+	case progressAuto:
+		if os.Getenv("CI") != "" || !progress.IsTerminal(os.Stderr) {
+			return nil, nil
+		}
+	case progressOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid progress mode %q, must be %q, %q or %q", mode, progressAuto, progressOn, progressOff)
+	}
+	return progress.New(os.Stderr), nil
+}
+
+// downloadProgress shows the downloads of a pool as bars of the display
+type downloadProgress struct {
+	display *progress.Display
+
+	lock sync.Mutex
+	bars map[string]*progress.Bar
+}
+
+func newDownloadProgress(display *progress.Display) *downloadProgress {
+	return &downloadProgress{display: display, bars: make(map[string]*progress.Bar)}
+}
+
+// Started reuses the bar of earlier attempts of job, they continue where the last one stopped
+func (p *downloadProgress) Started(job scoop.Download, offset int64) io.Writer {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	bar, ok := p.bars[job.Target]
+	if !ok {
+		bar = p.display.Bar(job.Name, job.Size)
+		p.bars[job.Target] = bar
+	}
+	bar.Set(offset)
+	return bar
+}
+
+func (p *downloadProgress) Finished(job scoop.Download, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.bars[job.Target].Done()
+	delete(p.bars, job.Target)
+}
+
+// progressHeader returns the counters shown next to the phase of the run
+func progressHeader(r *report.Report, apps int) func() string {
+	return func() string {
+		header := fmt.Sprintf("%d apps", apps)
+		if failed := len(r.FailedApps()); failed > 0 {
+			header += fmt.Sprintf(", %d failed", failed)
+		}
+		return header
+	}
+}
+
+// printSummary writes a table with the outcome of every app to w, for interactive runs. It must only be called
+// after the run, the report isn't locked.
+func printSummary(w io.Writer, r *report.Report) {
+	names := make([]string, 0, len(r.Apps))
+	for name := range r.Apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "APP\tADDED\tREMOVED\tDOWNLOADED\tRESULT")
+	for _, name := range names {
+		a := r.Apps[name]
+
+		result := "ok"
+		switch {
+		case len(a.Errors) > 0:
+			result = "failed: " + a.Errors[0]
+			if len(a.Errors) > 1 {
+				result += fmt.Sprintf(" (and %d more errors)", len(a.Errors)-1)
+			}
+		case len(a.VersionsAdded) == 0 && len(a.VersionsRemoved) == 0 && len(a.MetadataUpdated) == 0:
+			result = "unchanged"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", name, listOrDash(a.VersionsAdded), listOrDash(a.VersionsRemoved),
+			formatBytes(a.BytesDownloaded), result)
+	}
+	for _, err := range r.Errors {
+		fmt.Fprintf(tw, "-\t-\t-\t-\tfailed: %s\n", err)
+	}
+	_ = tw.Flush()
+}
+
+func listOrDash(list []string) string {
+	if len(list) == 0 {
+		return "-"
+	}
+	return strings.Join(list, ", ")
+}
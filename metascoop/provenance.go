@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// metadataProvenance remembers the value of every field of the metadata files as metascoop last wrote it.
+// A field whose value in the file differs from that was edited manually, so it isn't overwritten.
+type metadataProvenance struct {
+	path string
+
+	// Packages maps package names to fields and their canonical values, see canonicalValue
+	Packages map[string]map[string]string `json:"packages"`
+}
+
+// loadProvenance reads the provenance file at path. A missing file results in an empty provenance.
+func loadProvenance(path string) (p *metadataProvenance, err error) {
+	p = &metadataProvenance{path: path, Packages: make(map[string]map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, p)
+	if p.Packages == nil {
+		p.Packages = make(map[string]map[string]string)
+	}
+
+	return
+}
+
+// canonicalValue returns a representation of a metadata value that doesn't depend on whether it was read from
+// YAML or set by us, e.g. []interface{} and []string with the same items result in the same value.
+// Missing fields are represented by an empty string.
+func canonicalValue(v interface{}, ok bool) string {
+	if !ok {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// merge restores the fields of the package that were edited manually since metascoop last wrote them, i.e.
+// that differ in current (the file) from the provenance, unless force is set. updated (what metascoop would
+// write) is changed in place. Packages without provenance, e.g. those written by older versions, are
+// overwritten. kept is the sorted list of restored fields, fields the provenance of updated, which is only
+// passed to record once updated was written.
+func (p *metadataProvenance) merge(pkg string, current, updated map[string]interface{}, force bool) (kept []string, fields map[string]string) {
+	base, known := p.Packages[pkg]
+
+	keys := make(map[string]bool)
+	for k := range current {
+		keys[k] = true
+	}
+	for k := range updated {
+		keys[k] = true
+	}
+
+	fields = make(map[string]string)
+	for k := range keys {
+		cv, cok := current[k]
+		uv, uok := updated[k]
+		cur, upd := canonicalValue(cv, cok), canonicalValue(uv, uok)
+
+		if known && cur != upd && cur != base[k] && !force {
+			if cok {
+				updated[k] = cv
+			} else {
+				delete(updated, k)
+			}
+			kept = append(kept, k)
+
+			// Still the value metascoop wrote, so the field stays manual until it is reverted
+			if b, ok := base[k]; ok {
+				fields[k] = b
+			}
+			continue
+		}
+
+		if upd != "" {
+			fields[k] = upd
+		}
+	}
+
+	sort.Strings(kept)
+	return
+}
+
+// record sets the provenance of pkg to fields, as returned by merge. It must only be called after the metadata
+// file was written, otherwise the fields metascoop failed to write look like they were edited by hand next time.
+func (p *metadataProvenance) record(pkg string, fields map[string]string) {
+	p.Packages[pkg] = fields
+}
+
+// save writes the provenance back to its file
+func (p *metadataProvenance) save() (err error) {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmpPath := p.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, p.path)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMetadataProvenanceMerge(t *testing.T) {
+	// What metascoop wrote last time
+	written := map[string]interface{}{
+		"License":    "GPL-3.0-only",
+		"Summary":    "Takes notes",
+		"WebSite":    "https://example.com",
+		"Categories": []string{"Writing"},
+	}
+
+	tests := []struct {
+		name string
+
+		// known is whether the package has provenance, i.e. what metascoop wrote is known
+		known   bool
+		current map[string]interface{}
+		force   bool
+
+		wantKept    []string
+		wantUpdated map[string]interface{}
+	}{
+		{
+			name:    "unknown package is overwritten",
+			current: map[string]interface{}{"License": "MIT", "Summary": "Edited"},
+			wantUpdated: map[string]interface{}{
+				"License": "Apache-2.0", "Summary": "Takes notes", "WebSite": "https://example.org", "Categories": []string{"Writing", "Science"},
+			},
+		},
+		{
+			name:  "unedited fields are updated",
+			known: true,
+			// Read back from YAML, the list has another type
+			current: map[string]interface{}{"License": "GPL-3.0-only", "Summary": "Takes notes", "WebSite": "https://example.com", "Categories": []interface{}{"Writing"}},
+			wantUpdated: map[string]interface{}{
+				"License": "Apache-2.0", "Summary": "Takes notes", "WebSite": "https://example.org", "Categories": []string{"Writing", "Science"},
+			},
+		},
+		{
+			name:  "edited and removed fields are kept",
+			known: true,
+			current: map[string]interface{}{
+				"License": "GPL-3.0-only", "Summary": "Edited", "Categories": []interface{}{"Writing"}, "AuthorName": "Someone",
+			},
+			wantKept: []string{"AuthorName", "Summary", "WebSite"},
+			wantUpdated: map[string]interface{}{
+				"License": "Apache-2.0", "Summary": "Edited", "Categories": []string{"Writing", "Science"}, "AuthorName": "Someone",
+			},
+		},
+		{
+			name:    "force overwrites edited fields",
+			known:   true,
+			current: map[string]interface{}{"License": "GPL-3.0-only", "Summary": "Edited", "AuthorName": "Someone"},
+			force:   true,
+			wantUpdated: map[string]interface{}{
+				"License": "Apache-2.0", "Summary": "Takes notes", "WebSite": "https://example.org", "Categories": []string{"Writing", "Science"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &metadataProvenance{Packages: make(map[string]map[string]string)}
+			if tt.known {
+				_, base := p.merge("com.example.notes", nil, copyMeta(written), false)
+				p.record("com.example.notes", base)
+			}
+			before := copyProvenance(p.Packages)
+
+			fresh := map[string]interface{}{
+				"License": "Apache-2.0", "Summary": "Takes notes", "WebSite": "https://example.org", "Categories": []string{"Writing", "Science"},
+			}
+			updated := copyMeta(fresh)
+			kept, fields := p.merge("com.example.notes", tt.current, updated, tt.force)
+
+			if !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Errorf("kept %v, want %v", kept, tt.wantKept)
+			}
+			if !reflect.DeepEqual(updated, tt.wantUpdated) {
+				t.Errorf("updated is %v, want %v", updated, tt.wantUpdated)
+			}
+			if !reflect.DeepEqual(p.Packages, before) {
+				t.Errorf("merge changed the provenance to %v before the file was written", p.Packages)
+			}
+
+			// Once the file is written, the next run updates it with the same values and keeps the same fields
+			p.record("com.example.notes", fields)
+			kept, _ = p.merge("com.example.notes", updated, copyMeta(fresh), false)
+			if !reflect.DeepEqual(kept, tt.wantKept) {
+				t.Errorf("after recording, merging the written file again kept %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestMetadataProvenanceSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata-provenance.json")
+	p, err := loadProvenance(path)
+	if err != nil || len(p.Packages) != 0 {
+		t.Fatalf("loading a missing provenance file = %v, %v, want an empty provenance", p.Packages, err)
+	}
+
+	_, fields := p.merge("com.example.notes", nil, map[string]interface{}{"License": "MIT", "Categories": []string{"Writing"}}, false)
+	p.record("com.example.notes", fields)
+	err = p.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadProvenance(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]string{"com.example.notes": {"License": `"MIT"`, "Categories": `["Writing"]`}}
+	if !reflect.DeepEqual(loaded.Packages, want) {
+		t.Errorf("loaded provenance is %v, want %v", loaded.Packages, want)
+	}
+}
+
+func copyMeta(m map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyProvenance(packages map[string]map[string]string) map[string]map[string]string {
+	c := make(map[string]map[string]string, len(packages))
+	for pkg, fields := range packages {
+		c[pkg] = make(map[string]string, len(fields))
+		for k, v := range fields {
+			c[pkg][k] = v
+		}
+	}
+	return c
+}
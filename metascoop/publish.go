@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/mirror"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// publish commits the changes of an update to the repo and pushes them, either directly to the branch or, in
+// pull request mode, to a new branch with a pull request for review. Pushed changes are then copied to the
+// download mirrors. It's run after an update that exited with 0, see update.sh.
+func publish(args []string) {
+	flags := flag.NewFlagSet("publish", flag.ExitOnError)
+	var (
+		repoPath      = flags.String("C", ".", "Path to the git repo that contains apps.yaml and the fdroid directory")
+		message       = flags.String("message", "Automated update", "Commit message, used if -message-file is empty or missing")
+		messageFile   = flags.String("message-file", "", "File with the commit message, e.g. the one written by the update with -commit-message")
+		name          = flags.String("git-name", "github-actions", "Name of the author and committer")
+		email         = flags.String("git-email", "41898282+github-actions[bot]@users.noreply.github.com", "Email address of the author and committer. For signed commits, it should belong to the key")
+		signingFormat = flags.String("sign", "", "Sign the commit: \""+git.SigningOpenPGP+"\" or \""+git.SigningSSH+"\". Empty doesn't sign")
+		signingKey    = flags.String("signing-key", "", "OpenPGP key ID or path of the SSH key used for signing. $METASCOOP_SIGNING_KEY can contain a private key without passphrase instead, which is used with a temporary keyring")
+		remote        = flags.String("remote", "origin", "Remote the commit is pushed to")
+		branch        = flags.String("branch", "", "Branch the commit is pushed to, defaults to the checked out branch")
+		noPush        = flags.Bool("no-push", false, "Only commit, without pushing")
+
+		mirrorsConfig = flags.String("mirrors-config", "", "YAML file with download mirrors (S3 buckets or rsync targets) the repo directory is copied to after pushing, see mirror.Config. Not used in pull request mode")
+		repoDir       = flags.String("rd", "fdroid/repo", "Path to the repo directory that is copied to the mirrors, relative to -C")
+
+		pullRequest     = flags.Bool("pull-request", false, "Push to a new branch and open a GitHub pull request against -branch instead of pushing to it directly")
+		pullRequestOver = flags.Int("pull-request-over", -1, "Only use pull request mode if the run report (-report) lists more than this many added, removed or archived versions, or errors. -1 disables this")
+		reportPath      = flags.String("report", "", "Run report written by the update with -report, used by -pull-request-over")
+		prBranch        = flags.String("pr-branch", "", "Branch for pull request mode, defaults to \"github.com/nymtech/fdroid/metascoop/update-<time>\"")
+		githubRepo      = flags.String("github-repo", os.Getenv("GITHUB_REPOSITORY"), "GitHub repository (owner/name) the pull request is opened in")
+		githubAPI       = flags.String("github-api", "", "Base URL of the API of a GitHub Enterprise server, e.g. https://github.example.org/api/v3/")
+		accessToken     = flags.String("pat", os.Getenv("GITHUB_TOKEN"), "GitHub token for opening the pull request, needs write access to pull requests")
+		githubAuth      = addGitHubAuthFlags(flags)
+		httpConfig      = addHTTPFlags(flags)
+
+		logLevel  = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s publish [flags]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	err = httpConfig.setup()
+	if err != nil {
+		fatal("Setting up HTTP clients failed", "error", err)
+	}
+
+	msg := *message
+	if *messageFile != "" {
+		content, rerr := os.ReadFile(*messageFile)
+		switch {
+		case rerr == nil && len(content) > 0:
+			msg = string(content)
+		case rerr != nil && !os.IsNotExist(rerr):
+			fatal("Reading commit message failed", "path", *messageFile, "error", rerr)
+		}
+	}
+
+	signing := git.Signing{
+		Format:  *signingFormat,
+		Key:     *signingKey,
+		KeyData: os.Getenv("METASCOOP_SIGNING_KEY"),
+	}
+	if signing.Format == "" && signing.Key != "" {
+		fatal("-signing-key needs -sign")
+	}
+
+	var mirrors mirror.Config
+	if *mirrorsConfig != "" {
+		mirrors, err = mirror.LoadConfig(*mirrorsConfig)
+		if err != nil {
+			fatal("Reading mirrors config failed", "path", *mirrorsConfig, "error", err)
+		}
+	}
+
+	ctx := context.Background()
+
+	err = git.Commit(ctx, *repoPath, msg, git.Identity{Name: *name, Email: *email}, signing)
+	if err != nil {
+		fatal("Committing changes failed", "error", err)
+	}
+	slog.Info("Committed changes", "repo", *repoPath, "signed", signing.Format != "")
+
+	if *noPush {
+		syncMirrors(ctx, mirrors, filepath.Join(*repoPath, *repoDir))
+		return
+	}
+
+	if *branch == "" {
+		*branch, err = git.CurrentBranch(*repoPath)
+		if err != nil {
+			fatal("Pushing needs a branch, set -branch", "error", err)
+		}
+	}
+
+	usePR := *pullRequest
+	if *pullRequestOver >= 0 {
+		if *reportPath == "" {
+			fatal("-pull-request-over needs the -report of the update")
+		}
+		r, rerr := report.ReadFile(*reportPath)
+		if rerr != nil {
+			fatal("Reading run report failed", "path", *reportPath, "error", rerr)
+		}
+		changed := countChanges(r)
+		usePR = changed > *pullRequestOver
+		slog.Info("Counted changes of the update", "changes", changed, "pull_request", usePR)
+	}
+
+	if usePR {
+		if *prBranch == "" {
+			*prBranch = "github.com/nymtech/fdroid/metascoop/update-" + time.Now().UTC().Format("20060102-150405")
+		}
+
+		tokens, terr := githubAuth.tokenSource(*accessToken, *githubAPI)
+		if terr != nil {
+			fatal("Setting up GitHub authentication failed", "error", terr)
+		}
+		client, cerr := pullRequestClient(*githubAPI, tokens)
+		if cerr != nil {
+			fatal("Creating GitHub client failed", "error", cerr)
+		}
+
+		err = git.Push(ctx, *repoPath, *remote, *prBranch, git.Credentials{})
+		if err != nil {
+			fatal("Pushing changes failed", "remote", *remote, "branch", *prBranch, "error", err)
+		}
+		slog.Info("Pushed changes for review", "remote", *remote, "branch", *prBranch)
+
+		prURL, perr := openPullRequest(ctx, client, *githubRepo, *prBranch, *branch, msg)
+		if perr != nil {
+			fatal("Opening pull request failed", "repo", *githubRepo, "error", perr)
+		}
+		slog.Info("Opened pull request", "url", prURL)
+		if len(mirrors.Mirrors) > 0 {
+			slog.Info("Not syncing mirrors, the changes are published once the pull request is merged")
+		}
+		return
+	}
+
+	err = git.Push(ctx, *repoPath, *remote, *branch, git.Credentials{})
+	if err != nil {
+		fatal("Pushing changes failed", "remote", *remote, "branch", *branch, "error", err)
+	}
+	slog.Info("Pushed changes", "remote", *remote, "branch", *branch)
+
+	syncMirrors(ctx, mirrors, filepath.Join(*repoPath, *repoDir))
+}
+
+// syncMirrors copies the repo directory to all mirrors. A failed mirror doesn't keep the others from being
+// synced, but fails the command once all were tried.
+func syncMirrors(ctx context.Context, config mirror.Config, dir string) {
+	failed := 0
+	for _, m := range config.Mirrors {
+		start := time.Now()
+		r, err := m.Sync(ctx, dir)
+		if err != nil {
+			slog.Error("Syncing mirror failed", "mirror", m.Name, "uploaded", r.Uploaded, "deleted", r.Deleted, "error", err)
+			failed++
+			continue
+		}
+		slog.Info("Synced mirror", "mirror", m.Name, "uploaded", r.Uploaded, "deleted", r.Deleted, "bytes", r.Bytes, "duration", time.Since(start).Round(time.Second))
+	}
+
+	if failed > 0 {
+		fatal("Syncing mirrors failed, the changes were pushed", "failed", failed, "mirrors", len(config.Mirrors))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+	"golang.org/x/oauth2"
+
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// countChanges returns the number of changed versions and errors in the report, which is how large (or how
+// suspicious) an update is
+func countChanges(r *report.Report) (n int) {
+	n = len(r.Errors)
+	for _, a := range r.Apps {
+		n += len(a.VersionsAdded) + len(a.VersionsRemoved) + len(a.VersionsArchived) + len(a.Errors)
+	}
+	return
+}
+
+// pullRequestClient returns a client for github.com, or for the GitHub Enterprise server at apiURL
+func pullRequestClient(apiURL string, tokens oauth2.TokenSource) (client *github.Client, err error) {
+	if tokens == nil {
+		return nil, fmt.Errorf("opening pull requests needs a token, set -pat, $GITHUB_TOKEN or a GitHub App")
+	}
+	if apiURL == "" {
+		return github.NewClient(githubClient(tokens)), nil
+	}
+	return github.NewEnterpriseClient(apiURL, apiURL, githubClient(tokens))
+}
+
+// openPullRequest opens a pull request from head to base in repo ("owner/name"). The first line of the commit
+// message is its title, the rest its description.
+func openPullRequest(ctx context.Context, client *github.Client, repo, head, base, message string) (url string, err error) {
+	owner, name, ok := strings.Cut(repo, "/")
+	if !ok || owner == "" || name == "" {
+		return "", fmt.Errorf("invalid GitHub repository %q, must be owner/name", repo)
+	}
+
+	title, body, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	body = strings.TrimSpace(body) + "\n\nThis update was opened for review instead of being published directly. Merging it publishes the changes."
+
+	pr, _, err := client.PullRequests.Create(ctx, owner, name, &github.NewPullRequest{
+		Title: github.String(title),
+		Head:  github.String(head),
+		Base:  github.String(base),
+		Body:  github.String(strings.TrimSpace(body)),
+	})
+	if err != nil {
+		return
+	}
+
+	return pr.GetHTMLURL(), nil
+}
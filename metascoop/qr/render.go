@@ -0,0 +1,56 @@
+package qr
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// QuietZone is the width in modules of the light border scanners need around the code
+const QuietZone = 4
+
+// SVG returns the code as SVG image with one unit per module, including the quiet zone. It scales to the size it's
+// displayed at.
+func (c *Code) SVG() string {
+	full := c.Size + 2*QuietZone
+
+	var path strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+
+			// Runs of dark modules are one rectangle, which keeps the file small
+			run := 1
+			for x+run < c.Size && c.modules[y][x+run] {
+				run++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", x+QuietZone, y+QuietZone, run, run)
+			x += run - 1
+		}
+	}
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`, full, full, path.String())
+}
+
+// Image returns the code as black and white image with scale pixels per module, including the quiet zone
+func (c *Code) Image(scale int) *image.Paletted {
+	if scale < 1 {
+		scale = 1
+	}
+	full := (c.Size + 2*QuietZone) * scale
+
+	img := image.NewPaletted(image.Rect(0, 0, full, full), color.Palette{color.White, color.Black})
+	for y := 0; y < full; y++ {
+		for x := 0; x < full; x++ {
+			if c.Dark(x/scale-QuietZone, y/scale-QuietZone) {
+				img.Pix[y*img.Stride+x] = 1
+			}
+		}
+	}
+
+	return img
+}
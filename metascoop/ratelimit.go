@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// errRateLimitLow is returned for GitHub API requests that are deferred because the rate limit is almost used up
+var errRateLimitLow = errors.New("GitHub API rate limit is almost used up")
+
+// rateLimitTransport keeps track of the GitHub API rate limit from the headers of the responses. When only
+// reserve requests are left, it waits until the limit resets if that happens within maxWait, otherwise
+// requests fail until the end of the run, so the remaining apps are deferred to a later run.
+type rateLimitTransport struct {
+	next http.RoundTripper
+
+	reserve int
+	maxWait time.Duration
+
+	lock sync.Mutex
+
+	// remaining and limit are -1 until a response with the headers was seen
+	remaining, limit int
+	reset            time.Time
+	logged           bool
+}
+
+func newRateLimitTransport(next http.RoundTripper, reserve int, maxWait time.Duration) *rateLimitTransport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &rateLimitTransport{next: next, reserve: reserve, maxWait: maxWait, remaining: -1, limit: -1}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := t.wait(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err == nil {
+		t.update(resp.Header)
+	}
+	return resp, err
+}
+
+// wait blocks until the request can be sent without using up the reserve
+func (t *rateLimitTransport) wait(req *http.Request) error {
+	t.lock.Lock()
+	remaining, reset := t.remaining, t.reset
+	t.lock.Unlock()
+
+	if remaining < 0 || remaining > t.reserve || !time.Now().Before(reset) {
+		return nil
+	}
+
+	// A second more, so the clocks don't have to be in sync
+	d := time.Until(reset) + time.Second
+	if d > t.maxWait {
+		return retry.Permanent(fmt.Errorf("%w: %d requests left until %s", errRateLimitLow, remaining, reset.Format(time.RFC3339)))
+	}
+
+	slog.Warn("GitHub API rate limit is almost used up, waiting until it resets", "remaining", remaining, "reset", reset.Format(time.RFC3339), "wait", d.Round(time.Second))
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *rateLimitTransport) update(h http.Header) {
+	// GraphQL and search requests have their own limits
+	if resource := h.Get("X-RateLimit-Resource"); resource != "" && resource != "core" {
+		return
+	}
+
+	remaining, err := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.remaining = remaining
+	if limit, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil {
+		t.limit = limit
+	}
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		t.reset = time.Unix(reset, 0)
+	}
+
+	if !t.logged {
+		t.logged = true
+		slog.Info("GitHub API rate limit", "remaining", t.remaining, "limit", t.limit, "reset", t.reset.Format(time.RFC3339))
+	}
+}
+
+// Remaining returns the number of requests left, -1 if unknown
+func (t *rateLimitTransport) Remaining() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.remaining
+}
+
+// LogBudget logs the remaining requests
+func (t *rateLimitTransport) LogBudget() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.remaining < 0 {
+		return
+	}
+	slog.Info("GitHub API rate limit at the end of the run", "remaining", t.remaining, "limit", t.limit, "reset", t.reset.Format(time.RFC3339))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/notes"
+	"github.com/nymtech/fdroid/metascoop/workspace"
+)
+
+// readmeNames are the names of READMEs in the root of a repo, in the order they are looked for. The native git
+// backend checks them out besides the fastlane directory for apps with description_from_readme.
+var readmeNames = []string{"README.md", "README.markdown", "README", "README.txt", "readme.md", "Readme.md"}
+
+const (
+	// readmeParagraphs is the number of paragraphs taken from a README
+	readmeParagraphs = 3
+
+	// maxDescriptionLength is the length limit of descriptions in F-Droid clients
+	maxDescriptionLength = 4000
+)
+
+var (
+	readmeHeading   = regexp.MustCompile(`^\s{0,3}(?:#{1,6}\s|<h[1-6][\s>])`)
+	readmeSetext    = regexp.MustCompile(`^\s{0,3}(?:=+|-+)\s*$`)
+	readmeBadge     = regexp.MustCompile(`\[!\[[^\]]*\]\([^)]*\)\]\([^)]*\)|!\[[^\]]*\]\([^)]*\)|(?i)<img[^>]*>`)
+	readmeEmptyLink = regexp.MustCompile(`(?i)<a[^>]*>\s*</a>|\[\]\([^)]*\)`)
+	readmeListItem  = regexp.MustCompile(`^(?:- |\d+[.)] )`)
+)
+
+// readmeDescription returns the first paragraphs of the README in the root of the checkout at repoPath, for apps
+// whose upstream repo has no fastlane description. Badges, images, HTML and headings are left out and the text
+// ends at the first heading after a paragraph, which usually starts a section about building or installing.
+// It's empty if there's no README or it has no paragraphs.
+func readmeDescription(repoPath string) (description string, err error) {
+	var content []byte
+	for _, name := range readmeNames {
+		content, err = os.ReadFile(filepath.Join(repoPath, name))
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	if err != nil {
+		return "", nil
+	}
+
+	var paragraphs []string
+	for _, block := range readmeBlocks(string(content)) {
+		lines := strings.Split(block, "\n")
+		if readmeHeading.MatchString(lines[0]) || (len(lines) == 2 && readmeSetext.MatchString(lines[1])) {
+			if len(paragraphs) > 0 {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(lines[0]), "|") {
+			// Tables don't survive the conversion to plain text
+			continue
+		}
+
+		block = readmeBadge.ReplaceAllString(block, "")
+		block = readmeEmptyLink.ReplaceAllString(block, "")
+		if text := unwrap(notes.PlainText(block)); strings.TrimSpace(text) != "" {
+			paragraphs = append(paragraphs, text)
+		}
+		if len(paragraphs) == readmeParagraphs {
+			break
+		}
+	}
+
+	return notes.Truncate(strings.Join(paragraphs, "\n\n"), maxDescriptionLength), nil
+}
+
+// readmeBlocks splits Markdown into the blocks separated by blank lines, without code blocks
+func readmeBlocks(markdown string) (blocks []string) {
+	var current []string
+	inFence := false
+	flush := func() {
+		if len(current) > 0 {
+			blocks = append(blocks, strings.Join(current, "\n"))
+			current = nil
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			inFence = !inFence
+			flush()
+		case inFence:
+		case trimmed == "":
+			flush()
+		default:
+			current = append(current, line)
+		}
+	}
+	flush()
+	return
+}
+
+// unwrap joins the lines of a paragraph that were only wrapped, list items stay on their own line
+func unwrap(text string) string {
+	var b strings.Builder
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case i == 0:
+		case line == "" || readmeListItem.MatchString(line):
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// addReadmeDescription adds the description from the README in the checkout at repoPath to metadata as the
+// fastlane description of the default locale, so it's copied and used for other locales like one. The text is
+// written to a file in the workspace, as the checkout is shared with other apps.
+func addReadmeDescription(metadata *apps.RepoMetadata, repoPath string, ws *workspace.Workspace) (added bool, err error) {
+	description, err := readmeDescription(repoPath)
+	if err != nil || description == "" {
+		return
+	}
+
+	dir, err := ws.MkdirTemp("readme-*")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(dir, "full_description.txt")
+	err = os.WriteFile(path, []byte(description+"\n"), 0o644)
+	if err != nil {
+		return
+	}
+
+	if metadata.Texts == nil {
+		metadata.Texts = make(map[string]map[string]string)
+	}
+	if metadata.Texts[defaultLocale] == nil {
+		metadata.Texts[defaultLocale] = make(map[string]string)
+	}
+	metadata.Texts[defaultLocale]["full_description.txt"] = path
+	return true, nil
+}
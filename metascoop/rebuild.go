@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// maxListedDifferences is the number of differing files that are named when a rebuild doesn't match
+const maxListedDifferences = 5
+
+// rebuilder verifies APKs by building them again from the source of their release tag
+type rebuilder struct {
+	cache   *git.Cache
+	runtime string
+	timeout time.Duration
+}
+
+// verify rebuilds the APK at apkPath of app with its recipe and compares the result with it
+func (r *rebuilder) verify(ctx context.Context, logger *slog.Logger, app apps.AppInfo, apkPath string) (err error) {
+	recipe := app.Reproducible
+
+	checkout, err := r.cache.Checkout(ctx, git.Target{URL: app.GitURL, Ref: app.ReleaseTag})
+	if err != nil {
+		return fmt.Errorf("checking out tag %q: %w", app.ReleaseTag, err)
+	}
+	defer os.RemoveAll(checkout)
+
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+	if recipe.Image != "" {
+		cmd = tools.CommandContext(ctx, r.runtime, "run", "--rm", "-v", checkout+":/src", "-w", "/src", recipe.Image, "sh", "-c", recipe.Recipe)
+	} else {
+		cmd = tools.Shell(ctx, recipe.Recipe)
+		cmd.Dir = checkout
+	}
+	// Build logs are long, but needed to find out why a build isn't reproducible
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	logger.Info("Rebuilding APK from source", "tag", app.ReleaseTag, "command", cmd.String())
+
+	start := time.Now()
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running build recipe: %w", err)
+	}
+	logger.Info("Rebuilt APK from source", "duration", time.Since(start).Round(time.Second))
+
+	built, err := filepath.Glob(filepath.Join(checkout, filepath.FromSlash(recipe.Output)))
+	if err != nil {
+		return
+	}
+	if len(built) == 0 {
+		return fmt.Errorf("the build recipe produced no APK matching %q", recipe.Output)
+	}
+
+	// With several outputs (e.g. ABI splits), the one with the fewest differences is the counterpart
+	var closest []string
+	for i, b := range built {
+		differences, err := apk.CompareContents(apkPath, b)
+		if err != nil {
+			return fmt.Errorf("comparing with %q: %w", filepath.Base(b), err)
+		}
+		if len(differences) == 0 {
+			logger.Info("Rebuilt APK has the same contents as the upstream APK", "built", filepath.Base(b))
+			return nil
+		}
+		if i == 0 || len(differences) < len(closest) {
+			closest = differences
+		}
+	}
+
+	listed := closest
+	if len(listed) > maxListedDifferences {
+		listed = append(listed[:maxListedDifferences:maxListedDifferences], fmt.Sprintf("and %d more", len(closest)-maxListedDifferences))
+	}
+	return fmt.Errorf("the rebuilt APK differs from the upstream APK in %s", strings.Join(listed, ", "))
+}
+
+// verifiedBuilds lists the APKs that were reproduced from source. It's kept in "verified.json" in the metadata
+// directory, next to the metadata files of the apps.
+type verifiedBuilds struct {
+	path string
+
+	// Packages maps package names to their verified APKs, keyed by APK name
+	Packages map[string]map[string]verifiedBuild `json:"packages"`
+}
+
+type verifiedBuild struct {
+	VersionName string    `json:"versionName"`
+	VersionCode int64     `json:"versionCode"`
+	Tag         string    `json:"tag"`
+	Verified    time.Time `json:"verified"`
+}
+
+func loadVerifiedBuilds(path string) (v *verifiedBuilds, err error) {
+	v = &verifiedBuilds{path: path, Packages: make(map[string]map[string]verifiedBuild)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return v, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, v)
+	if v.Packages == nil {
+		v.Packages = make(map[string]map[string]verifiedBuild)
+	}
+
+	return
+}
+
+// add marks the APK at apkPath as verified
+func (v *verifiedBuilds) add(apkPath, tag string) (err error) {
+	m, err := apk.ReadManifest(apkPath)
+	if err != nil {
+		return
+	}
+
+	if v.Packages[m.Package] == nil {
+		v.Packages[m.Package] = make(map[string]verifiedBuild)
+	}
+	v.Packages[m.Package][filepath.Base(apkPath)] = verifiedBuild{
+		VersionName: m.VersionName,
+		VersionCode: m.VersionCode,
+		Tag:         tag,
+		Verified:    time.Now().UTC().Truncate(time.Second),
+	}
+
+	return
+}
+
+// save writes the list back to its file. APKs that are in none of dirs anymore are dropped.
+func (v *verifiedBuilds) save(dirs ...string) (err error) {
+	for pkg, builds := range v.Packages {
+		for apkName := range builds {
+			found := false
+			for _, dir := range dirs {
+				if _, serr := os.Stat(filepath.Join(dir, apkName)); serr == nil {
+					found = true
+					break
+				}
+			}
+			if !found {
+				delete(builds, apkName)
+			}
+		}
+		if len(builds) == 0 {
+			delete(v.Packages, pkg)
+		}
+	}
+
+	if len(v.Packages) == 0 {
+		err = os.Remove(v.path)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		return
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(v.path, append(data, '\n'), 0o644)
+}
+
+// rebuildDownloads verifies the APKs that were downloaded in this run and belong to apps with a reproducible build.
+// APKs of apps that require verification are removed if they can't be reproduced.
+func rebuildDownloads(r *rebuilder, verified *verifiedBuilds, jobs []scoop.Download, apkInfoMap map[string]apps.AppInfo, addError func(app string, err error)) {
+	jobs = append([]scoop.Download(nil), jobs...)
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Target < jobs[j].Target })
+
+	for _, job := range jobs {
+		info, ok := apkInfoMap[filepath.Base(job.Target)]
+		if !ok || info.Reproducible == nil {
+			continue
+		}
+		if _, err := os.Stat(job.Target); err != nil {
+			// The download failed
+			continue
+		}
+
+		logger := slog.With("app", info.Name(), "release", info.ReleaseTag)
+
+		err := r.verify(context.Background(), logger, info, job.Target)
+		if err == nil {
+			err = verified.add(job.Target, info.ReleaseTag)
+			if err != nil {
+				logger.Error("Marking APK as verified failed", "path", job.Target, "error", err)
+				addError(info.Name(), fmt.Errorf("marking %q as verified: %w", filepath.Base(job.Target), err))
+			}
+			continue
+		}
+
+		if !info.Reproducible.Required {
+			logger.Warn("APK could not be reproduced, publishing it without marking it as verified", "path", job.Target, "error", err)
+			continue
+		}
+
+		logger.Error("APK could not be reproduced, removing it", "path", job.Target, "error", err)
+		addError(info.Name(), fmt.Errorf("reproducing %q of release %q: %w", filepath.Base(job.Target), info.ReleaseTag, err))
+
+		rerr := os.Remove(job.Target)
+		if rerr != nil {
+			logger.Error("Removing APK failed", "path", job.Target, "error", rerr)
+		}
+	}
+}
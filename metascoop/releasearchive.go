@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// releaseArchiveDir is the directory next to the repo directory the releases of APKs are archived in
+const releaseArchiveDir = "provenance"
+
+// releaseRecord is what upstream said about the release an APK was taken from when it was published. Releases can
+// be edited or deleted later, the record in the history of the repo stays.
+type releaseRecord struct {
+	APK        string `json:"apk"`
+	App        string `json:"app"`
+	Repository string `json:"repository"`
+
+	Tag string `json:"tag"`
+
+	// Commit is the commit the tag pointed to, empty if the repo couldn't be asked
+	Commit string `json:"commit,omitempty"`
+
+	ReleaseID   int64     `json:"release_id,omitempty"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at,omitempty"`
+
+	// Body is the release description as upstream wrote it, before it was converted to "what's new" texts
+	Body string `json:"body"`
+
+	Asset    string `json:"asset"`
+	AssetURL string `json:"asset_url"`
+
+	Archived time.Time `json:"archived"`
+}
+
+// releaseArchive collects the releases of the APKs that are added to the repo in a run and writes them to
+// releaseArchiveDir once it's known which APKs stay. Its methods are safe for concurrent use and do nothing on nil.
+type releaseArchive struct {
+	dir string
+
+	lock sync.Mutex
+
+	// map[APK path]record, of APKs that are in the repo and of queued downloads
+	pending map[string]releaseRecord
+	added   map[string]bool
+}
+
+// newReleaseArchive returns the archive in the fdroid directory, nil if releases aren't archived
+func newReleaseArchive(fdroidDir string, enabled bool) *releaseArchive {
+	if !enabled {
+		return nil
+	}
+	return &releaseArchive{dir: filepath.Join(fdroidDir, releaseArchiveDir), pending: make(map[string]releaseRecord), added: make(map[string]bool)}
+}
+
+// add remembers that the APK at path was taken from asset of release
+func (r *releaseArchive) add(path string, app apps.AppInfo, release scoop.Release, asset scoop.Asset) {
+	r.queue(path, app, release, asset)
+	r.downloaded(path)
+}
+
+// queue remembers that the APK at path is downloaded from asset of release. It's only archived if the download
+// succeeds, see downloaded.
+func (r *releaseArchive) queue(path string, app apps.AppInfo, release scoop.Release, asset scoop.Asset) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pending[path] = releaseRecord{
+		App:         app.Name(),
+		Repository:  app.GitURL,
+		Tag:         release.TagName,
+		ReleaseID:   release.ID,
+		Prerelease:  release.Prerelease,
+		PublishedAt: release.PublishedAt,
+		Body:        release.Body,
+		Asset:       asset.Name,
+		AssetURL:    asset.URL,
+	}
+}
+
+// downloaded marks the queued download of the APK at path as done
+func (r *releaseArchive) downloaded(path string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.added[path] = true
+}
+
+// rename moves the release of the APK at oldPath to newPath
+func (r *releaseArchive) rename(oldPath, newPath string) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rec, ok := r.pending[oldPath]; ok {
+		r.pending[newPath] = rec
+		delete(r.pending, oldPath)
+	}
+	if r.added[oldPath] {
+		r.added[newPath] = true
+		delete(r.added, oldPath)
+	}
+}
+
+// write archives the releases of the APKs that were added and are still in the repo or its archive. resolve
+// returns the commit a tag of a repo points to; if it fails, the record is written without it.
+func (r *releaseArchive) write(ctx context.Context, archiveDir string, resolve func(ctx context.Context, gitURL, tag string) (string, error), addError func(app string, err error)) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var paths []string
+	for path := range r.added {
+		if _, ok := r.pending[path]; ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, path := range paths {
+		rec := r.pending[path]
+		rec.APK = filepath.Base(path)
+		_, rerr := os.Stat(path)
+		_, aerr := os.Stat(filepath.Join(archiveDir, rec.APK))
+		if rerr != nil && aerr != nil {
+			continue
+		}
+
+		commit, err := resolve(ctx, rec.Repository, rec.Tag)
+		if err != nil {
+			slog.Warn("Resolving the commit of the release failed, archiving the release without it", "app", rec.App, "tag", rec.Tag, "error", err)
+		}
+		rec.Commit = commit
+		rec.Archived = now
+
+		err = r.writeFile(rec)
+		if err != nil {
+			addError(rec.App, fmt.Errorf("archiving the release of %q: %w", rec.APK, err))
+		}
+	}
+}
+
+func (r *releaseArchive) writeFile(rec releaseRecord) (err error) {
+	err = os.MkdirAll(r.dir, 0o755)
+	if err != nil {
+		return
+	}
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return
+	}
+	return os.WriteFile(filepath.Join(r.dir, rec.APK+".json"), append(data, '\n'), 0o644)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/md"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// remove retires a package: it deletes its APKs, metadata and images, drops the apps publishing it from
+// apps.yaml and regenerates the index.
+func remove(args []string) {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	var (
+		appsFilePath   = flags.String("ap", "apps.yaml", "Path to apps.yaml file")
+		repoDir        = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory")
+		provenancePath = flags.String("metadata-provenance", "", "Metadata provenance file, see the update flag of the same name")
+		indexKeystore  = flags.String("index-keystore", "", "PKCS#12 keystore for signing the index with -indexer=native. The password is read from $METASCOOP_KEYSTORE_PASSWORD")
+		indexKey       = flags.String("index-key", "", "PEM file for signing the index with -indexer=native. $METASCOOP_INDEX_KEY can contain the PEM data instead")
+		indexer        = flags.String("indexer", scoop.IndexerFdroid, "How the repo index is generated: \"fdroid\" or \"native\"")
+		dryRun         = flags.Bool("dry-run", false, "Only print what would be removed")
+		lockDir        = flags.String("lock-dir", "", "Lock directory of the repo, see the update flag of the same name")
+		lockTimeout    = flags.Duration("lock-timeout", time.Hour, "How long to wait for a running update to finish. 0 waits forever")
+		logLevel       = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat      = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s remove [flags] <package name>...\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	signingKey, err := loadIndexKey(*indexKeystore, *indexKey)
+	if err != nil {
+		fatal("Loading index signing key failed", "error", err)
+	}
+
+	fdroidDir := filepath.Dir(*repoDir)
+
+	if !*dryRun {
+		if *lockDir == "" {
+			*lockDir = defaultLockDir(*repoDir)
+		}
+		locks, lerr := newRunLocks(*lockDir)
+		if lerr == nil {
+			lerr = locks.lockRepo(*lockTimeout)
+		}
+		if lerr != nil {
+			fatal("Locking the repo failed", "error", lerr)
+		}
+	}
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+
+	index, err := apps.ReadIndex(filepath.Join(*repoDir, "index-v1.json"))
+	if err != nil {
+		fatal("Reading F-Droid repo index failed", "error", err)
+	}
+	names, err := loadAPKNames(fdroidDir)
+	if err != nil {
+		fatal("Reading APK names failed", "error", err)
+	}
+
+	var (
+		paths    []string
+		appNames []string
+	)
+	for _, pkgName := range flags.Args() {
+		pkgPaths, perr := packageFiles(fdroidDir, pkgName)
+		if perr != nil {
+			fatal("Looking for files of package failed", "package", pkgName, "error", perr)
+		}
+		paths = append(paths, pkgPaths...)
+
+		var found bool
+		for _, app := range appsList {
+			if app.PackageName == pkgName || publishesPackage(app, pkgName, index, names) {
+				appNames = append(appNames, app.Name())
+				found = true
+			}
+		}
+		if len(pkgPaths) == 0 && !found {
+			fatal("Neither the repo nor the apps file has this package", "package", pkgName)
+		}
+	}
+	sort.Strings(appNames)
+
+	if *dryRun {
+		for _, name := range appNames {
+			fmt.Printf("Would remove %q from %s\n", name, *appsFilePath)
+		}
+		for _, path := range paths {
+			fmt.Printf("Would remove %s\n", path)
+		}
+		return
+	}
+
+	for _, path := range paths {
+		slog.Info("Removing file of retired package", "path", path)
+		err = os.RemoveAll(path)
+		if err != nil {
+			fatal("Removing file failed", "path", path, "error", err)
+		}
+	}
+
+	for _, name := range appNames {
+		err = removeAppEntry(*appsFilePath, name)
+		if err != nil {
+			fatal("Removing app from apps.yaml failed", "app", name, "error", err)
+		}
+		slog.Info("Removed app from apps.yaml", "app", name, "path", *appsFilePath)
+	}
+
+	if *provenancePath == "" {
+		*provenancePath = filepath.Join(fdroidDir, "metadata-provenance.json")
+	}
+	if _, serr := os.Stat(*provenancePath); serr == nil {
+		provenance, perr := loadProvenance(*provenancePath)
+		if perr == nil {
+			for _, pkgName := range flags.Args() {
+				delete(provenance.Packages, pkgName)
+			}
+			perr = provenance.save()
+		}
+		if perr != nil {
+			slog.Error("Updating metadata provenance failed", "path", *provenancePath, "error", perr)
+		}
+	}
+
+	err = scoop.UpdateIndex(*indexer, fdroidDir, signingKey)
+	if err != nil {
+		fatal("Updating the index failed", "error", err)
+	}
+
+	readmePath := filepath.Join(filepath.Dir(fdroidDir), "README.md")
+	if _, serr := os.Stat(readmePath); serr == nil {
+		index, err = apps.ReadIndex(filepath.Join(*repoDir, "index-v1.json"))
+		if err == nil {
+			err = md.RegenerateReadme(readmePath, index)
+		}
+		if err != nil {
+			fatal("Generating README failed", "path", readmePath, "error", err)
+		}
+	}
+}
+
+// packageFiles returns all files and directories in the fdroid directory that belong to a package: its APKs
+// (with their signatures) in the repo and archive, the metadata file and directory, and the published images
+func packageFiles(fdroidDir, pkgName string) (paths []string, err error) {
+	exists := func(path string) bool {
+		_, serr := os.Stat(path)
+		return serr == nil
+	}
+
+	for _, dir := range []string{"repo", "archive"} {
+		dir = filepath.Join(fdroidDir, dir)
+
+		index, ierr := apps.ReadIndex(filepath.Join(dir, "index-v1.json"))
+		if ierr != nil && !errors.Is(ierr, os.ErrNotExist) {
+			return nil, fmt.Errorf("reading index of %q: %w", dir, ierr)
+		}
+		if index != nil {
+			for _, p := range index.Packages[pkgName] {
+				apkPath := filepath.Join(dir, p.ApkName)
+				for _, path := range []string{apkPath, apkPath + ".asc", apkPath + ".sig", apkPath + ".idsig", apkPath + attestationSuffix} {
+					if exists(path) {
+						paths = append(paths, path)
+					}
+				}
+			}
+		}
+
+		if path := filepath.Join(dir, pkgName); exists(path) {
+			paths = append(paths, path)
+		}
+
+		// Icons fdroidserver extracted from the APKs, e.g. icons-320/<package>.<versionCode>.png
+		icons, gerr := filepath.Glob(filepath.Join(dir, "icons*", pkgName+".*"))
+		if gerr != nil {
+			return nil, gerr
+		}
+		paths = append(paths, icons...)
+	}
+
+	for _, path := range []string{filepath.Join(fdroidDir, "metadata", pkgName+".yml"), filepath.Join(fdroidDir, "metadata", pkgName)} {
+		if exists(path) {
+			paths = append(paths, path)
+		}
+	}
+
+	return
+}
+
+// removeAppEntry deletes the top-level entry name from the apps file it's defined in, which may be one the apps
+// file includes, leaving the other entries and their formatting as they are. Comments directly above the entry
+// are removed with it.
+func removeAppEntry(appsFilePath, name string) (err error) {
+	path, err := appFile(appsFilePath, name)
+	if err != nil {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(content, &doc)
+	if err != nil {
+		return
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("%q doesn't contain a mapping of apps", path)
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+
+	root := doc.Content[0]
+	var start, end = -1, len(lines)
+	for i := 0; i < len(root.Content); i += 2 {
+		if root.Content[i].Value != name {
+			continue
+		}
+		start = root.Content[i].Line - 1
+		if i+2 < len(root.Content) {
+			end = root.Content[i+2].Line - 1
+		}
+		break
+	}
+	if start < 0 {
+		return fmt.Errorf("there is no app called %q in the apps file", name)
+	}
+
+	// Comments directly above the entry belong to it, those before the next entry to that one
+	for start > 0 && strings.HasPrefix(strings.TrimSpace(lines[start-1]), "#") {
+		start--
+	}
+	for end > start+1 && isCommentOrBlank(lines[end-1]) {
+		end--
+	}
+	// The blank lines that separated this entry from the next one aren't needed anymore
+	for end < len(lines) && strings.TrimSpace(lines[end]) == "" {
+		end++
+	}
+
+	var out bytes.Buffer
+	for _, l := range lines[:start] {
+		out.WriteString(l)
+	}
+	for _, l := range lines[end:] {
+		out.WriteString(l)
+	}
+
+	result := out.Bytes()
+	if end == len(lines) {
+		// The last entry was removed, so the blank lines before it aren't needed anymore
+		result = append(bytes.TrimRight(result, "\n"), '\n')
+	}
+
+	err = replaceAppsFile(appsFilePath, path, result)
+	if err != nil {
+		return fmt.Errorf("removing the entry: %w", err)
+	}
+	return
+}
+
+// appFile returns the path of the file the app name is defined in, the apps file or one it includes. Apps of
+// remote fragments can only be changed where the fragment is maintained.
+func appFile(appsFilePath, name string) (path string, err error) {
+	list, err := apps.ParseAppFile(appsFilePath)
+	if err != nil {
+		return
+	}
+	for _, app := range list {
+		if app.Name() == name && app.Remote() {
+			return "", fmt.Errorf("app %q is defined in the remote fragment %s, change it there", name, app.File())
+		}
+		if app.Name() == name {
+			return app.File(), nil
+		}
+	}
+	return "", fmt.Errorf("there is no app called %q in the apps file", name)
+}
+
+// replaceAppsFile writes content to path, which is the apps file at appsFilePath or one it includes. If the apps
+// file becomes invalid, the old content is restored.
+func replaceAppsFile(appsFilePath, path string, content []byte) (err error) {
+	old, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	tmpPath := path + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0o644)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return
+	}
+
+	if _, perr := apps.ParseAppFile(appsFilePath); perr != nil {
+		_ = os.WriteFile(path, old, 0o644)
+		return fmt.Errorf("the change makes apps.yaml invalid: %w", perr)
+	}
+	return
+}
+
+func isCommentOrBlank(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "" || strings.HasPrefix(trimmed, "#")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+	"github.com/nymtech/fdroid/metascoop/qr"
+	"github.com/nymtech/fdroid/metascoop/sign"
+	"github.com/nymtech/fdroid/metascoop/site"
+)
+
+// Names of the repo info artifacts in the repo directory
+const (
+	repoInfoFile = "repo-info.json"
+	repoQRPNG    = "repo-qr.png"
+	repoQRSVG    = "repo-qr.svg"
+)
+
+// repoQRScale is the number of pixels per module of the PNG QR code
+const repoQRScale = 8
+
+// repoInfo describes the repo for machines, e.g. scripts that link to it
+type repoInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Address     string `json:"address"`
+
+	// Fingerprint is the SHA-256 fingerprint of the certificate that signs the index, empty if it's not signed
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// URL is the address with the fingerprint, which is what users should add to their clients
+	URL string `json:"url"`
+
+	// QRCode contains the names of the QR code images of URL, relative to the repo directory
+	QRCode map[string]string `json:"qr_code,omitempty"`
+
+	Apps int `json:"apps"`
+	APKs int `json:"apks"`
+}
+
+// repoFingerprint returns the fingerprint of the certificate that signs the index. Without the key (e.g. when
+// fdroidserver signs the index), it's read from the signed index. It's empty if the index isn't signed.
+func repoFingerprint(repoDir string, key *scoop.Key) (fingerprint string, err error) {
+	if key != nil {
+		return key.Fingerprint(), nil
+	}
+
+	fingerprint, err = sign.JARFingerprint(filepath.Join(repoDir, "index-v1.jar"))
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Debug("The index isn't signed, so the repo has no fingerprint")
+		return "", nil
+	}
+	return
+}
+
+// writeRepoInfo writes repo-info.json and the QR codes of the repo URL to repoDir. The files only change if the repo
+// does, so they don't cause commits on their own.
+func writeRepoInfo(repoDir string, index *apps.RepoIndex, fingerprint string) (info repoInfo, err error) {
+	info.Name, _ = index.Repo["name"].(string)
+	info.Description, _ = index.Repo["description"].(string)
+	info.Address, _ = index.Repo["address"].(string)
+	info.Address = strings.TrimSuffix(info.Address, "/")
+	info.Fingerprint = fingerprint
+	info.URL = site.RepoURL(info.Address, fingerprint)
+
+	info.Apps = len(index.Apps)
+	for _, pkgs := range index.Packages {
+		info.APKs += len(pkgs)
+	}
+
+	if info.URL != "" {
+		code, qerr := qr.Encode(info.URL)
+		if qerr != nil {
+			return info, qerr
+		}
+
+		var buf bytes.Buffer
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, code.Image(repoQRScale))
+		if err != nil {
+			return
+		}
+		err = writeIfChanged(filepath.Join(repoDir, repoQRPNG), buf.Bytes())
+		if err != nil {
+			return
+		}
+		err = writeIfChanged(filepath.Join(repoDir, repoQRSVG), []byte(code.SVG()+"\n"))
+		if err != nil {
+			return
+		}
+
+		info.QRCode = map[string]string{"png": repoQRPNG, "svg": repoQRSVG}
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeIfChanged(filepath.Join(repoDir, repoInfoFile), append(data, '\n'))
+	return
+}
+
+// writeIfChanged writes data to path unless the file already has that content
+func writeIfChanged(path string, data []byte) error {
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	return os.WriteFile(path, data, 0o644)
+}
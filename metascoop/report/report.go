@@ -0,0 +1,358 @@
+package report
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Report collects machine-readable results of a run. All methods are safe for concurrent use.
+type Report struct {
+	lock sync.Mutex
+
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesDownloaded int64     `json:"bytes_downloaded"`
+
+	// RepoSizeBytes is the size of the repo directory after removing old versions, 0 if it wasn't measured
+	RepoSizeBytes int64 `json:"repo_size_bytes,omitempty"`
+
+	// Errors that don't belong to a single app
+	Errors []string `json:"errors,omitempty"`
+
+	// ErrorTypes counts all errors of the run (of apps and global ones) by the type Classify assigned to them
+	ErrorTypes map[string]int `json:"error_types,omitempty"`
+
+	// GitHubRateLimitRemaining is the number of GitHub API requests left at the end of the run, -1 if unknown
+	GitHubRateLimitRemaining int `json:"github_rate_limit_remaining"`
+
+	// Interrupted is set if the run was stopped by a signal before it was done
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	Apps map[string]*App `json:"apps"`
+
+	// Classify returns the type of an error, e.g. "network" or "auth". If nil, all errors are of type "other".
+	Classify func(error) string `json:"-"`
+}
+
+// App is the summary for a single apps.yaml entry
+type App struct {
+	VersionsAdded    []string `json:"versions_added"`
+	VersionsRemoved  []string `json:"versions_removed,omitempty"`
+	VersionsArchived []string `json:"versions_archived,omitempty"`
+	Skipped          []Skip   `json:"skipped,omitempty"`
+	MetadataUpdated  []string `json:"metadata_updated,omitempty"`
+	Errors           []string `json:"errors,omitempty"`
+
+	PermissionChanges []PermissionChange `json:"permission_changes,omitempty"`
+
+	// MovedTo is the URL the upstream repo was renamed or transferred to, if it doesn't match apps.yaml anymore
+	MovedTo string `json:"moved_to,omitempty"`
+
+	LicenseChange *LicenseChange `json:"license_change,omitempty"`
+
+	// Vulnerabilities are the known advisories of published versions, see apps.OSVPackage
+	Vulnerabilities []Vulnerability `json:"vulnerabilities,omitempty"`
+
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+
+	// DiskUsageBytes is the space used by the app's versions and graphics in the repo directory
+	DiskUsageBytes int64 `json:"disk_usage_bytes,omitempty"`
+
+	// Timings contains the seconds spent in each phase, e.g. "discovery" or "download"
+	Timings map[string]float64 `json:"timings_seconds"`
+
+	// Interrupted is set for apps the run was interrupted for, their changes were taken back. Their errors don't
+	// make them failed apps, they are likely caused by the interruption.
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	// Deferred is set for apps that didn't fit into the time or download budget of the run, the next run
+	// continues with them
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// Skip records a release or asset that was not ingested
+type Skip struct {
+	Release string `json:"release"`
+	Asset   string `json:"asset,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// PermissionChange is how the permissions of a new version differ from those of the previous one
+type PermissionChange struct {
+	Version  string `json:"version"`
+	Previous string `json:"previous"`
+
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+
+	// Dangerous are the added permissions that need to be allowed in apps.yaml
+	Dangerous []string `json:"dangerous,omitempty"`
+	Blocked   bool     `json:"blocked"`
+}
+
+// LicenseChange is how the license declared by the upstream repo changed since the previous run
+type LicenseChange struct {
+	Previous string `json:"previous"`
+	Current  string `json:"current"`
+
+	// NonFree is set if the previous license was a FOSS license and the current one isn't
+	NonFree bool `json:"non_free"`
+	Blocked bool `json:"blocked"`
+}
+
+// Vulnerability is an advisory that affects a published version
+type Vulnerability struct {
+	Version string   `json:"version"`
+	ID      string   `json:"id"`
+	Summary string   `json:"summary,omitempty"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+func New() *Report {
+	return &Report{
+		Started:                  time.Now(),
+		ErrorTypes:               make(map[string]int),
+		GitHubRateLimitRemaining: -1,
+		Apps:                     make(map[string]*App),
+	}
+}
+
+// app returns the entry for name, r.lock must be held
+func (r *Report) app(name string) *App {
+	a, ok := r.Apps[name]
+	if !ok {
+		a = &App{
+			VersionsAdded: []string{},
+			Timings:       make(map[string]float64),
+		}
+		r.Apps[name] = a
+	}
+	return a
+}
+
+// AddApp makes sure the app shows up in the report, even if nothing happened for it
+func (r *Report) AddApp(app string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app)
+}
+
+func (r *Report) AddError(app string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	typ := "other"
+	if r.Classify != nil {
+		typ = r.Classify(err)
+	}
+	r.ErrorTypes[typ]++
+
+	if app == "" {
+		r.Errors = append(r.Errors, err.Error())
+		return
+	}
+
+	a := r.app(app)
+	a.Errors = append(a.Errors, err.Error())
+}
+
+func (r *Report) AddSkip(app, release, asset, reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.Skipped = append(a.Skipped, Skip{Release: release, Asset: asset, Reason: reason})
+}
+
+// AddDownload records a successfully downloaded version
+func (r *Report) AddDownload(app, version string, bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.VersionsAdded = append(a.VersionsAdded, version)
+	a.BytesDownloaded += bytes
+	r.BytesDownloaded += bytes
+}
+
+// AddRemoval records an APK that was removed from the repo
+func (r *Report) AddRemoval(app, apkName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.VersionsRemoved = append(a.VersionsRemoved, apkName)
+}
+
+// AddArchival records an APK that was moved from the repo to the archive
+func (r *Report) AddArchival(app, apkName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.VersionsArchived = append(a.VersionsArchived, apkName)
+}
+
+func (r *Report) AddMetadataUpdates(app string, fields []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.MetadataUpdated = append(a.MetadataUpdated, fields...)
+}
+
+// AddPermissionChange records the permission diff of a new version
+func (r *Report) AddPermissionChange(app string, c PermissionChange) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.PermissionChanges = append(a.PermissionChanges, c)
+}
+
+// SetMovedTo records that the upstream repo of app is at url now
+func (r *Report) SetMovedTo(app, url string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app).MovedTo = url
+}
+
+// SetLicenseChange records that the upstream license of app changed
+func (r *Report) SetLicenseChange(app string, c LicenseChange) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app).LicenseChange = &c
+}
+
+// AddVulnerability records that an advisory affects a published version of app
+func (r *Report) AddVulnerability(app string, v Vulnerability) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	a := r.app(app)
+	a.Vulnerabilities = append(a.Vulnerabilities, v)
+}
+
+// SetRepoSize records the size of the repo directory
+func (r *Report) SetRepoSize(bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.RepoSizeBytes = bytes
+}
+
+// AddDiskUsage adds bytes to the disk space used by app in the repo directory
+func (r *Report) AddDiskUsage(app string, bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app).DiskUsageBytes += bytes
+}
+
+// AddTiming adds d to the time spent by app in the given phase
+func (r *Report) AddTiming(app, phase string, d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app).Timings[phase] += d.Seconds()
+}
+
+// SetGitHubRateLimit records the number of remaining GitHub API requests
+func (r *Report) SetGitHubRateLimit(remaining int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.GitHubRateLimitRemaining = remaining
+}
+
+// SetInterrupted records that the run was interrupted, and that it was for app if it isn't empty
+func (r *Report) SetInterrupted(app string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Interrupted = true
+	if app != "" {
+		r.app(app).Interrupted = true
+	}
+}
+
+// SetDeferred records that app didn't fit into the budget of the run
+func (r *Report) SetDeferred(app string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.app(app).Deferred = true
+}
+
+// FailedApps returns the names of all apps that had at least one error, sorted. Interrupted apps aren't included.
+func (r *Report) FailedApps() (names []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for name, a := range r.Apps {
+		if len(a.Errors) > 0 && !a.Interrupted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// HasRunErrors reports whether an error that doesn't belong to a single app was recorded
+func (r *Report) HasRunErrors() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return len(r.Errors) > 0
+}
+
+// Finish records the duration of the run and sorts the lists, it's called when the run is over
+func (r *Report) Finish() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.DurationSeconds = time.Since(r.Started).Seconds()
+
+	for _, a := range r.Apps {
+		sort.Strings(a.VersionsAdded)
+		sort.Strings(a.VersionsRemoved)
+		sort.Strings(a.VersionsArchived)
+		sort.Strings(a.MetadataUpdated)
+	}
+}
+
+// WriteFile writes the report as JSON to path
+func (r *Report) WriteFile(path string) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// ReadFile reads a report that was written with WriteFile
+func ReadFile(path string) (r *Report, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	r = New()
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
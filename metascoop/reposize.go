@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// What happens if the repo is larger than -max-repo-size
+const (
+	repoSizePolicyWarn    = "warn"
+	repoSizePolicyArchive = "archive"
+	repoSizePolicyPrune   = "prune"
+)
+
+func checkRepoSizePolicy(policy string) error {
+	switch policy {
+	case repoSizePolicyWarn, repoSizePolicyArchive, repoSizePolicyPrune:
+		return nil
+	}
+	return fmt.Errorf("unknown repo size policy %q, must be %q, %q or %q", policy, repoSizePolicyWarn, repoSizePolicyArchive, repoSizePolicyPrune)
+}
+
+// packageUsage is the disk space used by one package in the repo
+type packageUsage struct {
+	// App is the apps.yaml entry of the package, empty if it's unknown
+	App         string
+	PackageName string
+	Bytes       int64
+
+	// Versions are sorted from oldest to newest
+	Versions []versionUsage
+}
+
+// name returns the name of the app, or the package name if it's unknown
+func (u *packageUsage) name() string {
+	if u.App != "" {
+		return u.App
+	}
+	return u.PackageName
+}
+
+// versionUsage is the disk space used by all APKs of one versionCode, e.g. its ABI splits
+type versionUsage struct {
+	VersionCode int
+	Bytes       int64
+	Paths       []string
+}
+
+// fileSize returns the size of the file at path, or zero if it doesn't exist
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// dirSize returns the size of all files in dir and its subdirectories. A missing directory is empty.
+func dirSize(dir string) (size int64, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	return
+}
+
+// measureRepo returns the size of all files in repoDir and the disk usage of each package in the index: its APKs with
+// their signatures, and its graphics in repoDir/<package>/. Packages are attributed to the app that published one of
+// their APKs in this run.
+func measureRepo(repoDir string, index *apps.RepoIndex, apkInfoMap map[string]apps.AppInfo) (total int64, packages []*packageUsage, err error) {
+	total, err = dirSize(repoDir)
+	if err != nil {
+		return
+	}
+
+	for pkgName, pkgs := range index.Packages {
+		u := &packageUsage{PackageName: pkgName}
+
+		// map[versionCode]usage
+		var versions = make(map[int]*versionUsage)
+		for _, p := range pkgs {
+			apkPath := filepath.Join(repoDir, p.ApkName)
+			size := fileSize(apkPath)
+			if size == 0 {
+				// Already removed, e.g. by the retention policy
+				continue
+			}
+			size += fileSize(apkPath+".asc") + fileSize(apkPath+".sig") + fileSize(apkPath+attestationSuffix)
+
+			if info, ok := apkInfoMap[p.ApkName]; ok {
+				u.App = info.Name()
+			}
+
+			v := versions[p.VersionCode]
+			if v == nil {
+				v = &versionUsage{VersionCode: p.VersionCode}
+				versions[p.VersionCode] = v
+			}
+			v.Bytes += size
+			v.Paths = append(v.Paths, apkPath)
+			u.Bytes += size
+		}
+		if len(versions) == 0 {
+			continue
+		}
+
+		graphics, derr := dirSize(filepath.Join(repoDir, pkgName))
+		if derr != nil {
+			return 0, nil, derr
+		}
+		u.Bytes += graphics
+
+		for _, v := range versions {
+			sort.Strings(v.Paths)
+			u.Versions = append(u.Versions, *v)
+		}
+		sort.Slice(u.Versions, func(i, j int) bool {
+			return u.Versions[i].VersionCode < u.Versions[j].VersionCode
+		})
+
+		packages = append(packages, u)
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Bytes != packages[j].Bytes {
+			return packages[i].Bytes > packages[j].Bytes
+		}
+		return packages[i].PackageName < packages[j].PackageName
+	})
+
+	return
+}
+
+// budgetPrunes chooses the versions to remove so the repo fits into maxSize. It repeatedly takes the oldest version of
+// the package that uses the most space. The newest version of a package is never chosen, so size is the size of the
+// repo after removing pruned, which is still larger than maxSize if that's not enough.
+func budgetPrunes(total, maxSize int64, packages []*packageUsage) (pruned []scoop.Pruned, size int64) {
+	size = total
+
+	remaining := make(map[string]int64, len(packages))
+	for _, u := range packages {
+		remaining[u.PackageName] = u.Bytes
+	}
+	next := make(map[string]int, len(packages))
+
+	for size > maxSize {
+		var largest *packageUsage
+		for _, u := range packages {
+			if next[u.PackageName] >= len(u.Versions)-1 {
+				continue
+			}
+			if largest == nil || remaining[u.PackageName] > remaining[largest.PackageName] {
+				largest = u
+			}
+		}
+		if largest == nil {
+			return
+		}
+
+		v := largest.Versions[next[largest.PackageName]]
+		next[largest.PackageName]++
+		remaining[largest.PackageName] -= v.Bytes
+		size -= v.Bytes
+
+		for _, path := range v.Paths {
+			pruned = append(pruned, scoop.Pruned{
+				App:         largest.name(),
+				Path:        path,
+				PackageName: largest.PackageName,
+				VersionCode: v.VersionCode,
+			})
+		}
+	}
+
+	return
+}
+
+// formatBytes returns n in human-readable binary units, e.g. "1.5 MiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// logRepoUsage logs the disk usage of all packages, largest first
+func logRepoUsage(total int64, packages []*packageUsage) {
+	slog.Info("Repo size", "bytes", total, "size", formatBytes(total))
+	for _, u := range packages {
+		versions := make([]string, 0, len(u.Versions))
+		for _, v := range u.Versions {
+			versions = append(versions, fmt.Sprint(v.VersionCode))
+		}
+		slog.Info("Disk usage of package", "app", u.name(), "package", u.PackageName, "bytes", u.Bytes, "size", formatBytes(u.Bytes), "version_codes", strings.Join(versions, ","))
+	}
+}
+
+// enforceRepoSize reports the disk usage of the repo and its packages. If the repo is larger than maxSize (and
+// maxSize isn't zero), it archives or deletes old versions according to policy.
+func enforceRepoSize(scooper *scoop.Scooper, repoDir string, index *apps.RepoIndex, apkInfoMap map[string]apps.AppInfo, maxSize int64, policy string, r *report.Report) (err error) {
+	total, packages, err := measureRepo(repoDir, index, apkInfoMap)
+	if err != nil {
+		return
+	}
+	logRepoUsage(total, packages)
+
+	if maxSize > 0 && total > maxSize && policy != repoSizePolicyWarn {
+		pruned, size := budgetPrunes(total, maxSize, packages)
+
+		archive := policy == repoSizePolicyArchive
+		err = scooper.Prune(pruned, archive)
+		if err != nil {
+			return
+		}
+
+		for _, p := range pruned {
+			if archive {
+				r.AddArchival(p.App, filepath.Base(p.Path))
+			} else {
+				r.AddRemoval(p.App, filepath.Base(p.Path))
+			}
+		}
+
+		if len(pruned) > 0 {
+			slog.Info("Removed old versions to stay below the maximum repo size", "versions", len(pruned), "size", formatBytes(size), "max_size", formatBytes(maxSize))
+		}
+
+		// Measure again instead of trusting the estimate, so the report is exact
+		total, packages, err = measureRepo(repoDir, index, apkInfoMap)
+		if err != nil {
+			return
+		}
+	}
+
+	if maxSize > 0 && total > maxSize {
+		slog.Warn("Repo is larger than the maximum repo size", "size", formatBytes(total), "max_size", formatBytes(maxSize), "policy", policy)
+	}
+
+	r.SetRepoSize(total)
+	for _, u := range packages {
+		if u.App != "" {
+			r.AddDiskUsage(u.App, u.Bytes)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,128 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy describes how often and how fast a failing operation is retried
+type Policy struct {
+	// Name is used in log messages, e.g. "download"
+	Name string
+
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+
+	// BaseDelay is the delay before the first retry, it doubles for every further retry up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Budget limits the total number of retries of all operations using this policy. It may be nil.
+	Budget *Budget
+}
+
+// Budget is a number of retries that is shared between operations, so a broken host can't stall a run for too long
+type Budget struct {
+	lock      sync.Mutex
+	remaining int
+}
+
+// NewBudget returns a budget allowing n retries
+func NewBudget(n int) *Budget {
+	return &Budget{remaining: n}
+}
+
+func (b *Budget) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.remaining <= 0 {
+		return false
+	}
+	b.remaining--
+
+	return true
+}
+
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p *permanentError) Unwrap() error {
+	return p.err
+}
+
+// Permanent marks err as an error that won't go away by retrying, e.g. a 404 response
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked using Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay returns the time to wait before the given retry (starting at 1), including random jitter
+func (p Policy) Delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+
+	// Waiting a random time between half and the full delay keeps concurrent workers from retrying in lockstep
+	return d/2 + time.Duration(jitter.Int63n(int64(d/2)+1))
+}
+
+// Do runs fn until it succeeds, returns a permanent error, the retries are exhausted or ctx is done
+func (p Policy) Do(ctx context.Context, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || IsPermanent(err) || attempt >= p.MaxRetries {
+			return
+		}
+
+		if !p.Budget.take() {
+			slog.Warn("Not retrying, the retry budget is exhausted", "operation", p.Name)
+			return
+		}
+
+		delay := p.Delay(attempt + 1)
+		slog.Warn("Retrying", "operation", p.Name, "delay", delay.Round(time.Millisecond), "retry", attempt+1, "max_retries", p.MaxRetries, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
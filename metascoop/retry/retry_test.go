@@ -0,0 +1,135 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+var errTemporary = errors.New("temporary")
+
+// failing returns a function that fails with err the first n times it's called, and the number of calls
+func failing(n int, err error) (fn func() error, calls *int) {
+	calls = new(int)
+	return func() error {
+		*calls++
+		if *calls <= n {
+			return err
+		}
+		return nil
+	}, calls
+}
+
+func TestDoAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int
+		calls      int
+		wantErr    bool
+	}{
+		{name: "no retries", maxRetries: 0, failures: 1, calls: 1, wantErr: true},
+		{name: "success", maxRetries: 3, failures: 0, calls: 1},
+		{name: "success after retries", maxRetries: 3, failures: 2, calls: 3},
+		{name: "success with the last retry", maxRetries: 3, failures: 3, calls: 4},
+		{name: "retries exhausted", maxRetries: 3, failures: 10, calls: 4, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, calls := failing(tt.failures, errTemporary)
+			p := retry.Policy{Name: "test", MaxRetries: tt.maxRetries, BaseDelay: time.Millisecond}
+
+			err := p.Do(context.Background(), fn)
+			if *calls != tt.calls {
+				t.Errorf("fn was called %d times, want %d", *calls, tt.calls)
+			}
+			if tt.wantErr != errors.Is(err, errTemporary) {
+				t.Errorf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoPermanent(t *testing.T) {
+	notFound := errors.New("404 Not Found")
+	fn, calls := failing(10, retry.Permanent(notFound))
+	p := retry.Policy{Name: "test", MaxRetries: 5, BaseDelay: time.Hour}
+
+	err := p.Do(context.Background(), fn)
+	if *calls != 1 {
+		t.Errorf("fn was called %d times, want once", *calls)
+	}
+	if !errors.Is(err, notFound) || !retry.IsPermanent(err) {
+		t.Errorf("got error %v, want the permanent error", err)
+	}
+	if retry.Permanent(nil) != nil {
+		t.Error("Permanent(nil) isn't nil")
+	}
+}
+
+func TestDoBudget(t *testing.T) {
+	// The budget is shared by all operations of the policy, not per call
+	p := retry.Policy{Name: "test", MaxRetries: 3, BaseDelay: time.Millisecond, Budget: retry.NewBudget(4)}
+
+	fn, calls := failing(100, errTemporary)
+	if err := p.Do(context.Background(), fn); !errors.Is(err, errTemporary) || *calls != 4 {
+		t.Errorf("first operation: fn was called %d times with the error %v, want 4 calls", *calls, err)
+	}
+
+	fn, calls = failing(100, errTemporary)
+	if err := p.Do(context.Background(), fn); !errors.Is(err, errTemporary) || *calls != 2 {
+		t.Errorf("second operation: fn was called %d times with the error %v, want 2 calls with the last retry of the budget", *calls, err)
+	}
+
+	fn, calls = failing(1, errTemporary)
+	if err := p.Do(context.Background(), fn); !errors.Is(err, errTemporary) || *calls != 1 {
+		t.Errorf("operation after the budget is exhausted: fn was called %d times with the error %v, want one call", *calls, err)
+	}
+}
+
+func TestDoContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls int
+	fn := func() error {
+		calls++
+		// Canceled while Do waits before the first retry
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return errTemporary
+	}
+	p := retry.Policy{Name: "test", MaxRetries: 3, BaseDelay: time.Hour}
+
+	done := make(chan error)
+	go func() { done <- p.Do(ctx, fn) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errTemporary) || calls != 1 {
+			t.Errorf("fn was called %d times with the error %v, want one call", calls, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Do didn't return when the context was canceled")
+	}
+}
+
+func TestDelay(t *testing.T) {
+	p := retry.Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		// With jitter, the delay is between half and the full delay
+		for i := 0; i < 20; i++ {
+			if d := p.Delay(attempt); d < want/2 || d > want {
+				t.Errorf("delay of retry %d is %s, want between %s and %s", attempt, d, want/2, want)
+			}
+		}
+	}
+
+	if d := (retry.Policy{}).Delay(1); d != 0 {
+		t.Errorf("delay without base delay is %s, want 0", d)
+	}
+}
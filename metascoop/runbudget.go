@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// runBudget limits how long a run looks up apps and how much it downloads, so a huge release or a slow host
+// doesn't keep every other app from being updated. Apps that don't fit are deferred to the next run, which
+// processes the apps that were processed the longest ago first, see stalestFirst. A nil *runBudget has no limits.
+//
+// It isn't safe for concurrent use, apps are looked up one after another.
+type runBudget struct {
+	// deadline is when no more apps are looked up, zero without limit
+	deadline time.Time
+
+	// maxBytes is how much may be queued for download, 0 without limit
+	maxBytes int64
+	queued   int64
+
+	deferred map[string]bool
+}
+
+// newRunBudget returns the budget of a run that started at start, nil if both limits are 0
+func newRunBudget(start time.Time, maxDuration time.Duration, maxBytes int64) *runBudget {
+	if maxDuration <= 0 && maxBytes <= 0 {
+		return nil
+	}
+
+	b := &runBudget{maxBytes: maxBytes, deferred: make(map[string]bool)}
+	if maxDuration > 0 {
+		b.deadline = start.Add(maxDuration)
+	}
+	return b
+}
+
+// expired reports whether the run took longer than its duration budget
+func (b *runBudget) expired() bool {
+	return b != nil && !b.deadline.IsZero() && time.Now().After(b.deadline)
+}
+
+// take reserves the bytes of a download and reports whether they fit into the budget. The first download of a
+// run always fits, so releases that are larger than the budget are still downloaded eventually.
+func (b *runBudget) take(size int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.maxBytes > 0 && b.queued > 0 && b.queued+size > b.maxBytes {
+		return false
+	}
+	b.queued += size
+	return true
+}
+
+// deferApp records that app wasn't fully processed because of the budget
+func (b *runBudget) deferApp(app string) {
+	if b != nil {
+		b.deferred[app] = true
+	}
+}
+
+func (b *runBudget) isDeferred(app string) bool {
+	return b != nil && b.deferred[app]
+}
+
+// hasDeferred reports whether any app was deferred
+func (b *runBudget) hasDeferred() bool {
+	return b != nil && len(b.deferred) > 0
+}
+
+// stalestFirst sorts appsList by when the apps were last processed by a run with a budget, those that never were
+// first. Apps that were processed at the same time keep the order of the apps file.
+func stalestFirst(appsList []apps.AppInfo, state *runState) []apps.AppInfo {
+	sorted := append([]apps.AppInfo(nil), appsList...)
+
+	processed := make(map[string]time.Time, len(sorted))
+	for _, app := range sorted {
+		processed[app.Name()] = state.processedAt(app.Name())
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return processed[sorted[i].Name()].Before(processed[sorted[j].Name()])
+	})
+	return sorted
+}
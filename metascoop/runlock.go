@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/lock"
+)
+
+// lockHeldEnv tells an update that the process that started it holds the repo lock in this directory, like serve
+// does while the update and its on-change command run
+const lockHeldEnv = "METASCOOP_LOCK_HELD"
+
+// runLocks keep overlapping runs, e.g. from webhooks and cron, from writing the same repo at once. The repo lock is
+// held while a run reads and writes the repo, indexes, state files and apps.yaml. Before waiting for it, a run
+// claims the apps it updates: apps that are claimed by another run are left to that one, as it hasn't looked for
+// their releases yet. Claims are given up once the releases of an app were discovered, so runs that start later
+// see newer releases.
+type runLocks struct {
+	dir string
+
+	repo   *lock.File
+	claims map[string]*lock.File
+}
+
+// defaultLockDir returns the lock directory of the repo with the "repo" directory repoDir
+func defaultLockDir(repoDir string) string {
+	return filepath.Join(filepath.Dir(repoDir), ".metascoop-lock")
+}
+
+// newRunLocks returns the locks in dir, which is created with a .gitignore so the lock files aren't committed
+func newRunLocks(dir string) (l *runLocks, err error) {
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return
+	}
+
+	ignore := filepath.Join(dir, ".gitignore")
+	if _, serr := os.Stat(ignore); serr != nil {
+		err = os.WriteFile(ignore, []byte("*\n"), 0o644)
+		if err != nil {
+			return
+		}
+	}
+
+	return &runLocks{dir: dir, claims: make(map[string]*lock.File)}, nil
+}
+
+func (l *runLocks) repoPath() string {
+	return filepath.Join(l.dir, "repo.lock")
+}
+
+func (l *runLocks) appPath(name string) string {
+	return filepath.Join(l.dir, "app-"+url.PathEscape(name)+".lock")
+}
+
+// claim claims the apps for this run and returns those it got, the others are updated by another run
+func (l *runLocks) claim(appsList []apps.AppInfo) (claimed []apps.AppInfo, err error) {
+	for _, app := range appsList {
+		f, ok, cerr := lock.TryAcquire(l.appPath(app.Name()))
+		if cerr != nil {
+			return nil, fmt.Errorf("claiming %q: %w", app.Name(), cerr)
+		}
+		if !ok {
+			slog.Info("Another run is about to update the app, leaving it to that one", "app", app.Name(), "holder", lock.Holder(l.appPath(app.Name())))
+			continue
+		}
+
+		l.claims[app.Name()] = f
+		claimed = append(claimed, app)
+	}
+	return
+}
+
+// discovered gives up the claim of the app once its releases are known
+func (l *runLocks) discovered(name string) {
+	if f, ok := l.claims[name]; ok {
+		_ = f.Release()
+		delete(l.claims, name)
+	}
+}
+
+// lockRepo waits up to timeout for the repo lock, forever if timeout is 0. It's already held if the process that
+// started this one handed it over.
+func (l *runLocks) lockRepo(timeout time.Duration) (err error) {
+	if held := os.Getenv(lockHeldEnv); held != "" && sameDir(held, l.dir) {
+		slog.Debug("Repo lock is held by the parent process", "dir", l.dir)
+		return
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	f, ok, err := lock.TryAcquire(l.repoPath())
+	if err != nil || ok {
+		l.repo = f
+		return
+	}
+
+	slog.Info("Waiting for another run to finish", "holder", lock.Holder(l.repoPath()), "timeout", timeout)
+	start := time.Now()
+
+	l.repo, err = lock.Acquire(ctx, l.repoPath())
+	if err != nil {
+		return fmt.Errorf("waiting for the repo lock %q: %w", l.repoPath(), err)
+	}
+
+	slog.Info("Got the repo lock", "waited", time.Since(start).Round(time.Second))
+	return
+}
+
+// unlockRepo gives up the repo lock, for processes that continue after their work on the repo
+func (l *runLocks) unlockRepo() {
+	_ = l.repo.Release()
+	l.repo = nil
+}
+
+// sameDir reports whether both paths refer to the same directory
+func sameDir(a, b string) bool {
+	aAbs, aerr := filepath.Abs(a)
+	bAbs, berr := filepath.Abs(b)
+	return aerr == nil && berr == nil && aAbs == bAbs
+}
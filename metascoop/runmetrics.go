@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/google/go-github/v39/github"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/metrics"
+	"github.com/nymtech/fdroid/metascoop/report"
+)
+
+// errorType classifies errors for the failure metrics
+func errorType(err error) string {
+	var (
+		rateLimitErr *github.RateLimitError
+		abuseErr     *github.AbuseRateLimitError
+		netErr       net.Error
+	)
+
+	switch {
+	case errors.As(err, &rateLimitErr), errors.As(err, &abuseErr), errors.Is(err, errRateLimitLow):
+		return "rate_limit"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, git.ErrAuth):
+		return "auth"
+	case errors.Is(err, git.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, git.ErrNetwork), errors.As(err, &netErr):
+		return "network"
+	}
+	return "other"
+}
+
+// runResult describes the outcome of a run by its exit code
+func runResult(exitCode int) string {
+	switch exitCode {
+	case 0:
+		return "changed"
+	case 2:
+		return "unchanged"
+	}
+	return "failed"
+}
+
+// describeRunMetrics registers the metrics recordRun updates
+func describeRunMetrics(reg *metrics.Registry) {
+	reg.Describe("metascoop_runs_total", metrics.Counter, "Runs by result: changed, unchanged or failed")
+	reg.Describe("metascoop_apps_processed_total", metrics.Counter, "Apps that were processed")
+	reg.Describe("metascoop_apps_failed_total", metrics.Counter, "Apps that had at least one error")
+	reg.Describe("metascoop_downloads_total", metrics.Counter, "APKs that were downloaded")
+	reg.Describe("metascoop_downloaded_bytes_total", metrics.Counter, "Bytes of downloaded APKs")
+	reg.Describe("metascoop_errors_total", metrics.Counter, "Errors by type")
+	reg.Describe("metascoop_last_run_duration_seconds", metrics.Gauge, "Duration of the last run")
+	reg.Describe("metascoop_last_run_timestamp_seconds", metrics.Gauge, "Unix time the last run started")
+	reg.Describe("metascoop_github_rate_limit_remaining", metrics.Gauge, "GitHub API requests left at the end of the last run")
+}
+
+// recordRun adds the results of a finished run to reg
+func recordRun(reg *metrics.Registry, r *report.Report, exitCode int) {
+	describeRunMetrics(reg)
+
+	reg.Add("metascoop_runs_total", 1, "result", runResult(exitCode))
+	reg.Add("metascoop_apps_processed_total", float64(len(r.Apps)))
+	reg.Add("metascoop_apps_failed_total", float64(len(r.FailedApps())))
+
+	var downloads int
+	for _, a := range r.Apps {
+		downloads += len(a.VersionsAdded)
+	}
+	reg.Add("metascoop_downloads_total", float64(downloads))
+	reg.Add("metascoop_downloaded_bytes_total", float64(r.BytesDownloaded))
+
+	for typ, n := range r.ErrorTypes {
+		reg.Add("metascoop_errors_total", float64(n), "type", typ)
+	}
+
+	reg.Set("metascoop_last_run_duration_seconds", r.DurationSeconds)
+	reg.Set("metascoop_last_run_timestamp_seconds", float64(r.Started.Unix()))
+	if r.GitHubRateLimitRemaining >= 0 {
+		reg.Set("metascoop_github_rate_limit_remaining", float64(r.GitHubRateLimitRemaining))
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/internal/appinfo"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// appInfo returns the apps.yaml entry of app, with what the run found out about it
+func appInfo(app scoop.App) apps.AppInfo {
+	return appinfo.Of(app)
+}
+
+// scoopApps returns the apps of list for package scoop
+func scoopApps(list []apps.AppInfo) []scoop.App {
+	scoopList := make([]scoop.App, len(list))
+	for i, info := range list {
+		scoopList[i] = appinfo.New(info).(scoop.App)
+	}
+	return scoopList
+}
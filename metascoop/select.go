@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// selectApps returns the apps with the given names. Apps that aren't selected are left untouched by the run,
+// as only versions of apps that are processed are pruned and only their metadata is updated.
+func selectApps(appsList []apps.AppInfo, names []string) (selected []apps.AppInfo, err error) {
+	byName := make(map[string]apps.AppInfo, len(appsList))
+	for _, app := range appsList {
+		byName[app.Name()] = app
+	}
+
+	for _, name := range names {
+		app, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("there is no app called %q in the apps file", name)
+		}
+		selected = append(selected, app)
+	}
+
+	return
+}
+
+// selectPackages returns the apps publishing the given package names. An app publishes a package if it's set
+// as its package in the apps file, or if the index contains one of its APKs with that package name.
+func selectPackages(appsList []apps.AppInfo, packageNames []string, index *apps.RepoIndex, names *apkNames) (selected []apps.AppInfo, err error) {
+	for _, pkgName := range packageNames {
+		var found bool
+		for _, app := range appsList {
+			if app.PackageName == pkgName || publishesPackage(app, pkgName, index, names) {
+				selected = append(selected, app)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no app in the apps file publishes %q, set \"package\" for apps that aren't in the repo yet", pkgName)
+		}
+	}
+
+	return
+}
+
+func publishesPackage(app apps.AppInfo, pkgName string, index *apps.RepoIndex, names *apkNames) bool {
+	// Release file names start with the app name, see apps.GenerateReleaseFilename
+	prefix := strings.TrimSuffix(apps.GenerateReleaseFilename(app.Name(), ""), ".apk")
+
+	for _, p := range index.Packages[pkgName] {
+		if strings.HasPrefix(names.releaseName(p.ApkName), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueApps removes apps that were selected more than once, keeping the first occurrence
+func uniqueApps(list []apps.AppInfo) (unique []apps.AppInfo) {
+	seen := make(map[string]bool, len(list))
+	for _, app := range list {
+		if !seen[app.Name()] {
+			seen[app.Name()] = true
+			unique = append(unique, app)
+		}
+	}
+	return
+}
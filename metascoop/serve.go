@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/metrics"
+	"github.com/nymtech/fdroid/metascoop/report"
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+// maxWebhookSize is the largest payload GitHub sends
+const maxWebhookSize = 25 << 20
+
+// serve runs an HTTP server that updates the affected apps when GitHub reports a new release. Updates run
+// one after another by executing metascoop again with the arguments after "--" and an -app flag per app.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		listen       = flags.String("listen", ":8080", "Address the webhook server listens on")
+		path         = flags.String("path", "/webhook", "URL path GitHub sends release webhooks to")
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file, it is read for every webhook to find the apps of a repository")
+		repoDir      = flags.String("rd", "fdroid/repo", "Path to fdroid \"repo\" directory, also passed to updates")
+		lockDir      = flags.String("lock-dir", "", "Lock directory of the repo, see the update flag of the same name")
+		lockTimeout  = flags.Duration("lock-timeout", 0, "How long an update waits for other runs on the repo, e.g. from cron, to finish. 0 waits forever")
+		onChange     = flags.String("on-change", "", "Shell command that is run after an update changed the repo, e.g. to commit and push it")
+		metricsPath  = flags.String("metrics-path", "/metrics", "URL path Prometheus metrics are served at, empty to disable them")
+		controlPath  = flags.String("control-path", "/control", "URL path of the control interface, it's only served if $METASCOOP_CONTROL_TOKEN is set")
+		socketPath   = flags.String("control-socket", "", "Path of a unix socket the control interface is served on without token, only the user running metascoop can connect")
+		logLevel     = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error. Pass it after \"--\" as well to set it for updates")
+		logFormat    = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags] [-- update flags]\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "The webhook secret is read from $METASCOOP_WEBHOOK_SECRET. Operators manage the server with\n")
+		fmt.Fprintf(flags.Output(), "\"%s control\", over -control-socket or over HTTP with the bearer token $METASCOOP_CONTROL_TOKEN.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	secret := os.Getenv("METASCOOP_WEBHOOK_SECRET")
+	if secret == "" {
+		fatal("$METASCOOP_WEBHOOK_SECRET must be set, webhooks without a valid signature are rejected")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fatal("Finding metascoop executable failed", "error", err)
+	}
+
+	if *lockDir == "" {
+		*lockDir = defaultLockDir(*repoDir)
+	}
+
+	// Flags that come later win, so the update flags could override these, but must not for the lock directory
+	updateArgs := append([]string{"-ap=" + *appsFilePath, "-rd=" + *repoDir, "-lock-dir=" + *lockDir}, flags.Args()...)
+
+	reg := metrics.NewRegistry()
+	describeRunMetrics(reg)
+	reg.Describe("metascoop_webhooks_total", metrics.Counter, "Received webhooks by result: queued, ignored, rejected, invalid or draining")
+	reg.Describe("metascoop_on_change_failures_total", metrics.Counter, "Failed runs of the -on-change command")
+
+	u := &updater{
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		run: func(names []string) string {
+			// The on-change command commits what the update changed, so no other run may write the repo in between
+			locks, err := newRunLocks(*lockDir)
+			if err == nil {
+				err = locks.lockRepo(*lockTimeout)
+			}
+			if err != nil {
+				slog.Error("Locking the repo failed, the apps are updated with the next webhook", "apps", describeApps(names), "error", err)
+				return updateLocked
+			}
+			defer locks.unlockRepo()
+
+			return runUpdate(exe, updateArgs, names, *lockDir, *onChange, reg)
+		},
+		drained: make(chan struct{}),
+	}
+	go u.loop()
+	go func() {
+		<-u.drained
+		slog.Info("Drained, all queued updates are done")
+		os.Exit(0)
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, &webhookHandler{
+		secret:       []byte(secret),
+		appsFilePath: *appsFilePath,
+		updater:      u,
+		metrics:      reg,
+	})
+	if token := os.Getenv("METASCOOP_CONTROL_TOKEN"); token != "" && *controlPath != "" {
+		mux.Handle(*controlPath, &controlHandler{token: token, appsFilePath: *appsFilePath, updater: u})
+		slog.Info("Serving the control interface", "path", *controlPath)
+	}
+	if *socketPath != "" {
+		err = serveControlSocket(*socketPath, &controlHandler{appsFilePath: *appsFilePath, updater: u})
+		if err != nil {
+			fatal("Listening on the control socket failed", "path", *socketPath, "error", err)
+		}
+		slog.Info("Serving the control interface", "socket", *socketPath)
+	}
+	if *metricsPath != "" {
+		mux.HandleFunc(*metricsPath, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			_, _ = reg.WriteTo(w)
+		})
+	}
+
+	slog.Info("Listening for webhooks", "address", *listen, "path", *path)
+	fatal("Webhook server stopped", "error", http.ListenAndServe(*listen, mux))
+}
+
+// Results of updates
+const (
+	updateChanged   = "changed"
+	updateUnchanged = "unchanged"
+	updateFailed    = "failed"
+
+	// updateLocked means the update didn't run, another run held the repo lock
+	updateLocked = "locked"
+)
+
+// errDraining is returned for updates that are queued while the updater drains
+var errDraining = errors.New("the server is draining, no updates are accepted")
+
+// updater runs updates in the background. Apps that are queued while an update is running are
+// collected and updated together afterwards. A queued update of all apps includes the queued apps.
+type updater struct {
+	lock    sync.Mutex
+	pending map[string]bool
+	all     bool
+
+	// current is the update that is running, nil if none is
+	current *updateStatus
+	last    *updateStatus
+
+	// draining is set once drain was called. drained is closed when the updates queued until then are done.
+	draining    bool
+	drained     chan struct{}
+	drainedOnce sync.Once
+
+	wake chan struct{}
+
+	// run updates the apps called names, all apps if there are none, and returns the result
+	run func(names []string) string
+}
+
+// updateStatus describes a running or finished update
+type updateStatus struct {
+	// Apps are the updated apps, empty if all were
+	Apps     []string   `json:"apps,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Result   string     `json:"result,omitempty"`
+}
+
+// updaterStatus is what the control interface reports about the updater
+type updaterStatus struct {
+	Running    *updateStatus `json:"running"`
+	Last       *updateStatus `json:"last"`
+	Pending    []string      `json:"pending"`
+	PendingAll bool          `json:"pending_all"`
+	Draining   bool          `json:"draining"`
+}
+
+// add queues an update of the apps called names, of all apps if there are none
+func (u *updater) add(names ...string) error {
+	u.lock.Lock()
+	if u.draining {
+		u.lock.Unlock()
+		return errDraining
+	}
+	if len(names) == 0 {
+		u.all = true
+	}
+	for _, name := range names {
+		u.pending[name] = true
+	}
+	u.lock.Unlock()
+
+	u.signal()
+	return nil
+}
+
+func (u *updater) signal() {
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drain stops accepting updates. Once the queued ones are done, drained is closed.
+func (u *updater) drain() {
+	u.lock.Lock()
+	u.draining = true
+	u.lock.Unlock()
+
+	u.signal()
+}
+
+func (u *updater) status() (s updaterStatus) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	// The running update is finished in place, the status gets copies
+	if u.current != nil {
+		current := *u.current
+		s.Running = &current
+	}
+	if u.last != nil {
+		last := *u.last
+		s.Last = &last
+	}
+	s.PendingAll, s.Draining = u.all, u.draining
+	s.Pending = []string{}
+	for name := range u.pending {
+		s.Pending = append(s.Pending, name)
+	}
+	sort.Strings(s.Pending)
+	return
+}
+
+func (u *updater) loop() {
+	for range u.wake {
+		u.lock.Lock()
+		var names []string
+		for name := range u.pending {
+			names = append(names, name)
+		}
+		all := u.all
+		u.pending, u.all = make(map[string]bool), false
+
+		if len(names) == 0 && !all {
+			if u.draining {
+				u.drainedOnce.Do(func() { close(u.drained) })
+			}
+			u.lock.Unlock()
+			continue
+		}
+		if all {
+			names = nil
+		}
+		sort.Strings(names)
+
+		u.current = &updateStatus{Apps: names, Started: time.Now().UTC()}
+		u.lock.Unlock()
+
+		result := u.run(names)
+
+		u.lock.Lock()
+		finished := time.Now().UTC()
+		u.current.Finished, u.current.Result = &finished, result
+		u.last, u.current = u.current, nil
+		u.lock.Unlock()
+
+		// Updates queued while this one ran have signaled already, a drain has to check again
+		u.signal()
+	}
+}
+
+// describeApps returns names for log messages
+func describeApps(names []string) string {
+	if len(names) == 0 {
+		return "all"
+	}
+	return strings.Join(names, ", ")
+}
+
+// runUpdate executes metascoop for the given apps, all apps if there are none, and runs onChange if the repo
+// changed. The caller holds the repo lock in lockDir, which the update is told about. The results of the update are
+// added to reg.
+func runUpdate(exe string, args, names []string, lockDir, onChange string, reg *metrics.Registry) (result string) {
+	appList := describeApps(names)
+	slog.Info("Updating apps", "apps", appList)
+
+	args = append([]string(nil), args...)
+	for _, name := range names {
+		args = append(args, "-app="+name)
+	}
+
+	// The report of the update is where the metrics come from
+	var reportPath string
+	if f, err := os.CreateTemp("", "metascoop-report-*.json"); err == nil {
+		_ = f.Close()
+		reportPath = f.Name()
+		defer os.Remove(reportPath)
+
+		args = append(args, "-report="+reportPath)
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), lockHeldEnv+"="+lockDir)
+
+	err := cmd.Run()
+	recordUpdate(reg, reportPath, err)
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 2:
+		slog.Info("Update didn't change anything", "apps", appList)
+		return updateUnchanged
+	default:
+		slog.Error("Update failed", "apps", appList, "error", err)
+		return updateFailed
+	}
+
+	if onChange == "" {
+		slog.Info("Update changed the repo", "apps", appList)
+		return updateChanged
+	}
+
+	slog.Info("Update changed the repo, running the on-change command", "apps", appList, "command", onChange)
+
+	hook := tools.Shell(context.Background(), onChange)
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	err = hook.Run()
+	if err != nil {
+		slog.Error("Running the on-change command failed", "command", onChange, "error", err)
+		reg.Add("metascoop_on_change_failures_total", 1)
+	}
+	return updateChanged
+}
+
+// recordUpdate adds the report an update wrote to reg. runErr is the result of running the update.
+func recordUpdate(reg *metrics.Registry, reportPath string, runErr error) {
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(runErr, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if runErr != nil {
+		exitCode = 1
+	}
+
+	r, err := report.ReadFile(reportPath)
+	if err != nil {
+		// The update didn't get far enough to write a report
+		slog.Warn("Reading the report of the update failed", "error", err)
+		reg.Add("metascoop_runs_total", 1, "result", runResult(exitCode))
+		return
+	}
+
+	recordRun(reg, r, exitCode)
+}
+
+type webhookHandler struct {
+	secret       []byte
+	appsFilePath string
+	updater      *updater
+	metrics      *metrics.Registry
+}
+
+// releaseEvent contains the fields of a GitHub "release" webhook that are used
+type releaseEvent struct {
+	Action  string `json:"action"`
+	Release struct {
+		TagName string `json:"tag_name"`
+	} `json:"release"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+		CloneURL string `json:"clone_url"`
+	} `json:"repository"`
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "reading body failed", http.StatusBadRequest)
+		return
+	}
+
+	if !validSignature(h.secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		slog.Warn("Rejected webhook with invalid signature", "remote", r.RemoteAddr)
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "rejected")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "ping":
+		fmt.Fprintln(w, "pong")
+		return
+	case "release":
+	default:
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "ignored")
+		fmt.Fprintf(w, "ignoring %q event\n", event)
+		return
+	}
+
+	var ev releaseEvent
+	err = json.Unmarshal(body, &ev)
+	if err != nil {
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "invalid")
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	switch ev.Action {
+	case "published", "released", "prereleased", "edited":
+	default:
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "ignored")
+		fmt.Fprintf(w, "ignoring %q release action\n", ev.Action)
+		return
+	}
+
+	appsList, err := apps.ParseAppFile(h.appsFilePath)
+	if err != nil {
+		slog.Error("Reading apps file failed", "path", h.appsFilePath, "error", err)
+		http.Error(w, "reading apps file failed", http.StatusInternalServerError)
+		return
+	}
+
+	var names []string
+	for _, app := range appsList {
+		u := normalizeRepoURL(app.GitURL)
+		if u == normalizeRepoURL(ev.Repository.HTMLURL) || u == normalizeRepoURL(ev.Repository.CloneURL) {
+			names = append(names, app.Name())
+		}
+	}
+	if len(names) == 0 {
+		slog.Info("Ignoring release, no app uses this repository", "repo", ev.Repository.FullName, "release", ev.Release.TagName)
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "ignored")
+		fmt.Fprintf(w, "no app uses %s\n", ev.Repository.FullName)
+		return
+	}
+
+	err = h.updater.add(names...)
+	if err != nil {
+		slog.Warn("Rejecting webhook, the server is draining", "repo", ev.Repository.FullName, "release", ev.Release.TagName)
+		h.metrics.Add("metascoop_webhooks_total", 1, "result", "draining")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	slog.Info("Queued update", "repo", ev.Repository.FullName, "release", ev.Release.TagName, "action", ev.Action, "apps", strings.Join(names, ", "))
+	h.metrics.Add("metascoop_webhooks_total", 1, "result", "queued")
+
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "queued update of %s\n", strings.Join(names, ", "))
+}
+
+// validSignature checks the "sha256=<hex>" HMAC GitHub computes over the payload with the webhook secret
+func validSignature(secret, body []byte, signature string) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// normalizeRepoURL makes repository URLs comparable, e.g. "https://github.com/A/b.git/" and "https://github.com/a/b"
+func normalizeRepoURL(u string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.ToLower(u), "/"), ".git")
+}
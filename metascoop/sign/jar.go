@@ -0,0 +1,144 @@
+package sign
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// signatureName is the base name of the signature files in META-INF/
+const signatureName = "INDEX"
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// WriteJAR writes a signed JAR next to the file at path that contains only that file,
+// e.g. "entry.jar" for "entry.json". This is the format F-Droid clients expect for signed indexes.
+func WriteJAR(path string, k *Key) (jarPath string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	name := filepath.Base(path)
+	jarPath = path[:len(path)-len(filepath.Ext(path))] + ".jar"
+
+	jar, err := buildJAR(name, data, k)
+	if err != nil {
+		return
+	}
+
+	tmpPath := jarPath + ".tmp"
+	err = os.WriteFile(tmpPath, jar, 0o644)
+	if err != nil {
+		return
+	}
+
+	return jarPath, os.Rename(tmpPath, jarPath)
+}
+
+// JARFingerprint returns the SHA-256 fingerprint of the certificate that signed the JAR at path, e.g. a signed
+// index. This works for JARs signed by fdroidserver as well, so the fingerprint of a repo is known without its key.
+func JARFingerprint(path string) (fingerprint string, err error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		dir, name := filepath.Split(f.Name)
+		ext := strings.ToUpper(filepath.Ext(name))
+		if dir != "META-INF/" || (ext != ".RSA" && ext != ".EC" && ext != ".DSA") {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		block, err := io.ReadAll(rc)
+		_ = rc.Close()
+		if err != nil {
+			return "", err
+		}
+
+		certs, err := parseCertificates(block)
+		if err != nil {
+			return "", fmt.Errorf("reading signature block %s: %w", f.Name, err)
+		}
+		if len(certs) == 0 {
+			return "", fmt.Errorf("signature block %s contains no certificate", f.Name)
+		}
+
+		return (&Key{Certificate: certs[0]}).Fingerprint(), nil
+	}
+
+	return "", fmt.Errorf("%s is not signed", path)
+}
+
+// buildJAR creates a JAR containing one file, signed with JAR signing (v1 scheme) like jarsigner does
+func buildJAR(name string, data []byte, k *Key) (jar []byte, err error) {
+	const header = "Manifest-Version: 1.0\r\nCreated-By: metascoop\r\n\r\n"
+	section := fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", name, digest(data))
+	manifest := []byte(header + section)
+
+	sf := []byte(fmt.Sprintf("Signature-Version: 1.0\r\nSHA-256-Digest-Manifest: %s\r\nCreated-By: metascoop\r\n\r\nName: %s\r\nSHA-256-Digest: %s\r\n\r\n",
+		digest(manifest), name, digest([]byte(section))))
+
+	hashed := sha256.Sum256(sf)
+	sig, err := k.Signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	block, err := signedData(k.Certificate, sig)
+	if err != nil {
+		return
+	}
+
+	blockExt := ".RSA"
+	if _, ok := k.Signer.(*ecdsa.PrivateKey); ok {
+		blockExt = ".EC"
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"META-INF/MANIFEST.MF", manifest},
+		{"META-INF/" + signatureName + ".SF", sf},
+		{"META-INF/" + signatureName + blockExt, block},
+		{name, data},
+	} {
+		w, cerr := zw.Create(f.name)
+		if cerr != nil {
+			return nil, cerr
+		}
+		_, err = w.Write(f.data)
+		if err != nil {
+			return
+		}
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+package sign
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nymtech/fdroid/metascoop/tools"
+)
+
+func TestWriteJAR(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		rsaKey bool
+		block  string
+	}{
+		{"RSA", true, "META-INF/INDEX.RSA"},
+		{"ECDSA", false, "META-INF/INDEX.EC"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			k := testKey(t, tt.rsaKey)
+			signJARRoundTrip(t, k, tt.block)
+		})
+	}
+}
+
+// signJARRoundTrip signs an entry.json with k and checks the JAR with VerifyJAR, JARFingerprint and jarsigner if
+// it's installed
+func signJARRoundTrip(t *testing.T, k *Key, block string) {
+	t.Helper()
+
+	entry := []byte(`{"timestamp": 1700000000000, "version": 20002, "index": {"name": "/index-v2.json"}}`)
+	path := filepath.Join(t.TempDir(), "entry.json")
+	err := os.WriteFile(path, entry, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jarPath, err := WriteJAR(path, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(jarPath) != "entry.jar" {
+		t.Errorf("WriteJAR wrote %s, want entry.jar", jarPath)
+	}
+	jar, err := os.ReadFile(jarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, fingerprint, err := VerifyJAR(jar)
+	if err != nil {
+		t.Fatalf("verifying the JAR written by WriteJAR: %v", err)
+	}
+	if len(files) != 1 || !bytes.Equal(files["entry.json"], entry) {
+		t.Errorf("signed files are %q, want only entry.json", files)
+	}
+	if fingerprint != k.Fingerprint() {
+		t.Errorf("VerifyJAR returned fingerprint %s, want %s", fingerprint, k.Fingerprint())
+	}
+	fingerprint, err = JARFingerprint(jarPath)
+	if err != nil || fingerprint != k.Fingerprint() {
+		t.Errorf("JARFingerprint = %s, %v, want %s", fingerprint, err, k.Fingerprint())
+	}
+	if !bytes.Contains(jar, []byte(block)) {
+		t.Errorf("the JAR has no signature block %s", block)
+	}
+
+	if !tools.Available("jarsigner") {
+		t.Log("jarsigner isn't installed, the JAR is only checked with VerifyJAR")
+		return
+	}
+	out, err := tools.Command("jarsigner", "-verify", jarPath).CombinedOutput()
+	if err != nil || !bytes.Contains(out, []byte("jar verified")) {
+		t.Errorf("jarsigner doesn't accept the JAR: %v\n%s", err, out)
+	}
+}
+
+func TestVerifyJARRejectsTampering(t *testing.T) {
+	k := testKey(t, false)
+	jar, err := buildJAR("entry.json", []byte(`{"version": 20002}`), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copy the JAR with another entry.json and everything else unchanged
+	zr, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		data := []byte(`{"version": 20003}`)
+		if f.Name != "entry.json" {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = io.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		w, err := zw.Create(f.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := VerifyJAR(buf.Bytes()); err == nil {
+		t.Error("VerifyJAR accepted a JAR whose file doesn't match its digest")
+	}
+}
+
+func TestVerifyJARRejectsDuplicateEntries(t *testing.T) {
+	k := testKey(t, false)
+	jar, err := buildJAR("entry.json", []byte(`{"version": 20002}`), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers that take the first entry.json would use one that isn't signed
+	zr, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("entry.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte(`{"version": 1}`))
+	for _, f := range zr.File {
+		if err := zw.Copy(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := VerifyJAR(buf.Bytes()); err == nil || !strings.Contains(err.Error(), "entry.json more than once") {
+		t.Errorf("got error %v, want one about the duplicate entry.json", err)
+	}
+}
+
+func TestVerifyJARLimitsSize(t *testing.T) {
+	k := testKey(t, false)
+	// Compresses to a few bytes
+	jar, err := buildJAR("entry.json", make([]byte, 4<<10), k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := VerifyJAR(jar); err != nil {
+		t.Fatalf("verifying a JAR within the limits: %v", err)
+	}
+
+	defer func(entry, content int64) {
+		maxJAREntrySize, maxJARContentSize = entry, content
+	}(maxJAREntrySize, maxJARContentSize)
+
+	maxJAREntrySize = 1 << 10
+	if _, _, err := VerifyJAR(jar); err == nil || !strings.Contains(err.Error(), "entry.json is larger than 1024 bytes") {
+		t.Errorf("got error %v, want one about the size of entry.json", err)
+	}
+
+	maxJAREntrySize, maxJARContentSize = 1<<20, 4<<10
+	if _, _, err := VerifyJAR(jar); err == nil || !strings.Contains(err.Error(), "files of the JAR are larger than 4096 bytes") {
+		t.Errorf("got error %v, want one about the size of the files", err)
+	}
+}
@@ -0,0 +1,132 @@
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Key is the key and certificate used to sign repo indexes. F-Droid clients pin the certificate,
+// so it must stay the same for the lifetime of the repo.
+type Key struct {
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the certificate, which users add to the repo URL
+func (k *Key) Fingerprint() string {
+	sum := sha256.Sum256(k.Certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadKeystore reads a PKCS#12 keystore, as created by "fdroid init" or
+// "keytool -genkey -storetype PKCS12". Legacy JKS keystores must be converted first.
+func LoadKeystore(path, password string) (k *Key, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	key, cert, err := pkcs12.Decode(data, password)
+	if err != nil {
+		var perr error
+		key, cert, perr = decodePBES2(data, password)
+		if perr != nil && !errors.Is(perr, errUnsupportedKS) {
+			err = perr
+		}
+		if perr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding keystore %q: %w", path, err)
+	}
+
+	return newKey(key, cert)
+}
+
+// LoadPEM reads a private key and certificate from PEM data. The key must be PKCS#8 ("BEGIN PRIVATE KEY"),
+// the certificate block can be in the same data or in certPEM.
+func LoadPEM(keyPEM, certPEM []byte) (k *Key, err error) {
+	var (
+		key  interface{}
+		cert *x509.Certificate
+	)
+
+	for _, data := range [][]byte{keyPEM, certPEM} {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+
+			switch block.Type {
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("parsing PKCS#8 private key: %w", err)
+				}
+			case "CERTIFICATE":
+				if cert != nil {
+					continue
+				}
+				cert, err = x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					return nil, fmt.Errorf("parsing certificate: %w", err)
+				}
+			}
+		}
+	}
+
+	if key == nil {
+		return nil, errors.New("no PKCS#8 private key found")
+	}
+	if cert == nil {
+		return nil, errors.New("no certificate found, it is needed so clients can verify the signature")
+	}
+
+	return newKey(key, cert)
+}
+
+func newKey(key interface{}, cert *x509.Certificate) (k *Key, err error) {
+	var pub interface{}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		pub = &key.PublicKey
+	case *ecdsa.PrivateKey:
+		pub = &key.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, only RSA and ECDSA keys can sign indexes", key)
+	}
+
+	if !publicKeysEqual(pub, cert.PublicKey) {
+		return nil, errors.New("the private key doesn't belong to the certificate")
+	}
+
+	return &Key{
+		Signer:      key.(crypto.Signer),
+		Certificate: cert,
+	}, nil
+}
+
+func publicKeysEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case *rsa.PublicKey:
+		b, ok := b.(*rsa.PublicKey)
+		return ok && a.N.Cmp(b.N) == 0 && a.E == b.E
+	case *ecdsa.PublicKey:
+		b, ok := b.(*ecdsa.PublicKey)
+		return ok && a.Curve == b.Curve && a.X.Cmp(b.X) == 0 && a.Y.Cmp(b.Y) == 0
+	}
+	return false
+}
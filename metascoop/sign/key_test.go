@@ -0,0 +1,40 @@
+package sign
+
+import (
+	"crypto/rsa"
+	"testing"
+)
+
+// The keystores in testdata contain the same RSA key and certificate with the alias "index" and the password
+// "metascoop". keystore.p12 is encrypted with PBES2 (PBKDF2 with HMAC-SHA256, AES-256-CBC) and has an HMAC-SHA256
+// MAC, the defaults of keytool since JDK 12 and of OpenSSL 3. keystore-legacy.p12 uses SHA-1 and 3DES like older
+// keytool versions. Both were created with OpenSSL 3:
+//
+//	openssl req -x509 -newkey rsa:2048 -nodes -keyout key.pem -out cert.pem -days 36500 -subj "/CN=metascoop test"
+//	openssl pkcs12 -export -inkey key.pem -in cert.pem -name index -passout pass:metascoop -out keystore.p12
+//	openssl pkcs12 -export -legacy -inkey key.pem -in cert.pem -name index -passout pass:metascoop -out keystore-legacy.p12
+const testKeystoreFingerprint = "cf9b5af4c85c2fe00df54a82b83fba0ab5a3994bd5c21f1029699a2a066b9425"
+
+func TestLoadKeystore(t *testing.T) {
+	for _, path := range []string{"testdata/keystore.p12", "testdata/keystore-legacy.p12"} {
+		t.Run(path, func(t *testing.T) {
+			k, err := LoadKeystore(path, "metascoop")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := k.Signer.(*rsa.PrivateKey); !ok {
+				t.Errorf("the key is a %T, want an RSA key", k.Signer)
+			}
+			if k.Fingerprint() != testKeystoreFingerprint {
+				t.Errorf("fingerprint is %s, want %s", k.Fingerprint(), testKeystoreFingerprint)
+			}
+
+			// The key from the keystore signs indexes that verify against its certificate
+			signJARRoundTrip(t, k, "META-INF/INDEX.RSA")
+
+			if _, err := LoadKeystore(path, "wrong"); err == nil {
+				t.Error("LoadKeystore accepted a wrong password")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package sign
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// golang.org/x/crypto/pkcs12 only supports the legacy SHA-1/3DES encryption. Current versions of keytool and
+// OpenSSL encrypt keystores with PBES2 (PBKDF2 and AES) by default, which is decoded here instead.
+
+var (
+	oidPKCS7EncryptedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidShroudedKey   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509CertBag   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidPBES2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1      = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACSHA512    = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	errUnsupportedKS = errors.New("unsupported keystore encryption")
+	errDecrypt       = errors.New("decrypting keystore failed, is the password correct?")
+)
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  asn1.RawValue `asn1:"optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"tag:0,explicit"`
+	Attributes asn1.RawValue `asn1:"optional"`
+}
+
+type encryptedData struct {
+	Version int
+	Content encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType   asn1.ObjectIdentifier
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte `asn1:"tag:0,optional"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decodePBES2 decodes a PKCS#12 keystore whose contents are encrypted with PBES2
+func decodePBES2(data []byte, password string) (key interface{}, cert *x509.Certificate, err error) {
+	var p pfx
+	if _, err = asn1.Unmarshal(data, &p); err != nil {
+		return
+	}
+	if !p.AuthSafe.ContentType.Equal(oidData) {
+		return nil, nil, errUnsupportedKS
+	}
+
+	var authSafeData []byte
+	if _, err = asn1.Unmarshal(p.AuthSafe.Content.Bytes, &authSafeData); err != nil {
+		return
+	}
+
+	var authSafe []contentInfo
+	if _, err = asn1.Unmarshal(authSafeData, &authSafe); err != nil {
+		return
+	}
+
+	for _, ci := range authSafe {
+		var bagsData []byte
+
+		switch {
+		case ci.ContentType.Equal(oidData):
+			if _, err = asn1.Unmarshal(ci.Content.Bytes, &bagsData); err != nil {
+				return
+			}
+		case ci.ContentType.Equal(oidPKCS7EncryptedData):
+			var ed encryptedData
+			if _, err = asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return
+			}
+			if bagsData, err = pbes2Decrypt(ed.Content.Algorithm, ed.Content.EncryptedData, password); err != nil {
+				return
+			}
+		default:
+			continue
+		}
+
+		// Decrypting with a wrong password can still produce valid padding, but not valid DER
+		var bags []safeBag
+		if _, err = asn1.Unmarshal(bagsData, &bags); err != nil {
+			return nil, nil, errDecrypt
+		}
+
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidKeyBag):
+				key, err = x509.ParsePKCS8PrivateKey(bag.Value.Bytes)
+			case bag.ID.Equal(oidShroudedKey):
+				var epki encryptedPrivateKeyInfo
+				if _, err = asn1.Unmarshal(bag.Value.Bytes, &epki); err != nil {
+					return
+				}
+				var der []byte
+				if der, err = pbes2Decrypt(epki.Algorithm, epki.EncryptedData, password); err != nil {
+					return
+				}
+				if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+					return nil, nil, errDecrypt
+				}
+			case bag.ID.Equal(oidCertBag) && cert == nil:
+				var cb certBag
+				if _, err = asn1.Unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return
+				}
+				if !cb.ID.Equal(oidX509CertBag) {
+					continue
+				}
+				cert, err = x509.ParseCertificate(cb.Data)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if key == nil || cert == nil {
+		return nil, nil, errors.New("keystore must contain a private key and its certificate")
+	}
+
+	return
+}
+
+func pbes2Decrypt(alg pkix.AlgorithmIdentifier, data []byte, password string) (plain []byte, err error) {
+	if !alg.Algorithm.Equal(oidPBES2) {
+		return nil, errUnsupportedKS
+	}
+
+	var params pbes2Params
+	if _, err = asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("%w: key derivation %s", errUnsupportedKS, params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA512):
+		prf = sha512.New
+	default:
+		return nil, fmt.Errorf("%w: PRF %s", errUnsupportedKS, kdf.PRF.Algorithm)
+	}
+
+	var keyLen int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, fmt.Errorf("%w: cipher %s", errUnsupportedKS, params.EncryptionScheme.Algorithm)
+	}
+
+	var iv []byte
+	if _, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(password), kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return
+	}
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("invalid encrypted keystore data")
+	}
+
+	plain = make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// A wrong password almost always results in invalid padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errDecrypt
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errDecrypt
+		}
+	}
+
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,385 @@
+package sign
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	oidSHA1            = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA384          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	errUnsupportedHash = errors.New("unsupported digest algorithm")
+)
+
+// signerInfoAttrs is a signerInfo that may have authenticated attributes, which jarsigner adds for some algorithms
+type signerInfoAttrs struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerialNumber
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type signedDataSigners struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfoAttrs `asn1:"set"`
+}
+
+// Limits of the decompressed content of JARs, so a small JAR can't make VerifyJAR allocate huge amounts of memory.
+// They are far above the indexes of large repos.
+var (
+	maxJAREntrySize   int64 = 256 << 20
+	maxJARContentSize int64 = 512 << 20
+)
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// VerifyJAR checks the JAR signature (v1 scheme) of jar, e.g. a signed index downloaded from a repo: the signature
+// block must be a valid signature of the signature file by the certificate it contains, and the digests must match
+// the manifest and the files. It returns the signed files by name and the SHA-256 fingerprint of the certificate,
+// which the caller has to compare with the one it trusts.
+func VerifyJAR(jar []byte) (files map[string][]byte, fingerprint string, err error) {
+	z, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+	if err != nil {
+		return
+	}
+
+	contents := make(map[string][]byte)
+	var total int64
+	for _, f := range z.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		if _, ok := contents[f.Name]; ok {
+			// Other readers might use the entry that isn't verified
+			return nil, "", fmt.Errorf("the JAR contains %s more than once", f.Name)
+		}
+
+		limit, tooLarge := maxJAREntrySize, fmt.Errorf("%s is larger than %d bytes", f.Name, maxJAREntrySize)
+		if remaining := maxJARContentSize - total; remaining < limit {
+			limit, tooLarge = remaining, fmt.Errorf("the files of the JAR are larger than %d bytes", maxJARContentSize)
+		}
+		if f.UncompressedSize64 > uint64(limit) {
+			return nil, "", tooLarge
+		}
+
+		rc, oerr := f.Open()
+		if oerr != nil {
+			return nil, "", oerr
+		}
+		data, rerr := io.ReadAll(io.LimitReader(rc, limit+1))
+		_ = rc.Close()
+		if rerr != nil {
+			return nil, "", fmt.Errorf("reading %s: %w", f.Name, rerr)
+		}
+		if int64(len(data)) > limit {
+			return nil, "", tooLarge
+		}
+		contents[f.Name] = data
+		total += int64(len(data))
+	}
+
+	var sfName, blockName string
+	for name := range contents {
+		dir, base := path.Split(name)
+		ext := strings.ToUpper(path.Ext(base))
+		if dir != "META-INF/" || (ext != ".RSA" && ext != ".EC" && ext != ".DSA") {
+			continue
+		}
+		if sf := strings.TrimSuffix(name, path.Ext(name)) + ".SF"; contents[sf] != nil {
+			sfName, blockName = sf, name
+			break
+		}
+	}
+	if blockName == "" {
+		return nil, "", errors.New("the JAR isn't signed")
+	}
+
+	cert, err := verifyBlock(contents[blockName], contents[sfName])
+	if err != nil {
+		return nil, "", fmt.Errorf("verifying %s: %w", blockName, err)
+	}
+
+	manifest := contents["META-INF/MANIFEST.MF"]
+	if manifest == nil {
+		return nil, "", errors.New("the JAR has no manifest")
+	}
+	covered, err := verifySignatureFile(contents[sfName], manifest)
+	if err != nil {
+		return nil, "", fmt.Errorf("verifying %s: %w", sfName, err)
+	}
+
+	files = make(map[string][]byte)
+	for _, section := range manifestSections(manifest)[1:] {
+		name := section["Name"]
+		if name == "" || (covered != nil && !covered[name]) {
+			// Sections the signature file doesn't cover aren't signed, even if their digests match
+			continue
+		}
+		data, ok := contents[name]
+		if !ok {
+			return nil, "", fmt.Errorf("the manifest lists %s, but the JAR doesn't contain it", name)
+		}
+		ok, err = matchesDigest(section, "", data)
+		if err != nil {
+			return nil, "", fmt.Errorf("checking %s: %w", name, err)
+		}
+		if !ok {
+			return nil, "", fmt.Errorf("%s doesn't match its digest in the manifest", name)
+		}
+		files[name] = data
+	}
+	for name := range contents {
+		if _, signed := files[name]; !signed && !strings.HasPrefix(name, "META-INF/") {
+			return nil, "", fmt.Errorf("%s isn't signed", name)
+		}
+	}
+
+	return files, (&Key{Certificate: cert}).Fingerprint(), nil
+}
+
+// verifyBlock checks the PKCS#7 signature block of the signature file sf and returns the certificate that signed it
+func verifyBlock(block, sf []byte) (cert *x509.Certificate, err error) {
+	var ci contentInfo
+	_, err = asn1.Unmarshal(block, &ci)
+	if err != nil {
+		return
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("not a PKCS#7 signed data structure")
+	}
+
+	var sd signedDataSigners
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	if err != nil {
+		return
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return
+	}
+	if len(certs) == 0 || len(sd.SignerInfos) == 0 {
+		return nil, errors.New("no certificate or signer")
+	}
+
+	si := sd.SignerInfos[0]
+	for _, c := range certs {
+		if bytes.Equal(c.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) && c.SerialNumber.Cmp(si.IssuerAndSerialNumber.SerialNumber) == 0 {
+			cert = c
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("the certificate of the signer is missing")
+	}
+
+	hash, err := hashOf(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return
+	}
+
+	signed := sf
+	if len(si.AuthenticatedAttributes.Bytes) > 0 {
+		// The attributes are signed as a SET, not with the implicit tag they're stored with
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+
+		var attrs []attribute
+		_, err = asn1.UnmarshalWithParams(signed, &attrs, "set")
+		if err != nil {
+			return nil, fmt.Errorf("reading authenticated attributes: %w", err)
+		}
+		var found bool
+		for _, a := range attrs {
+			if !a.Type.Equal(oidMessageDigest) {
+				continue
+			}
+			var md []byte
+			_, err = asn1.Unmarshal(a.Values.Bytes, &md)
+			if err != nil {
+				return
+			}
+			h := hash.New()
+			h.Write(sf)
+			if !bytes.Equal(md, h.Sum(nil)) {
+				return nil, errors.New("the signature file doesn't match the signed digest")
+			}
+			found = true
+		}
+		if !found {
+			return nil, errors.New("the authenticated attributes have no message digest")
+		}
+	}
+
+	return cert, verifySignature(cert, hash, signed, si.EncryptedDigest)
+}
+
+func hashOf(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("%w %s", errUnsupportedHash, oid)
+}
+
+// verifySignature checks sig of signed with hash by the key of cert. Unlike the x509 package, this accepts SHA-1,
+// which older repos are signed with.
+func verifySignature(cert *x509.Certificate, hash crypto.Hash, signed, sig []byte) error {
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", cert.PublicKey)
+}
+
+// verifySignatureFile checks that the digests of the signature file sf match the manifest: either that of the
+// whole manifest, or those of the sections it lists. It returns the names of the sections it covers, nil if it
+// covers the whole manifest.
+func verifySignatureFile(sf, manifest []byte) (covered map[string]bool, err error) {
+	sfSections := manifestSections(sf)
+
+	// The digest of the whole manifest is optional, without one the sections have to match
+	ok, err := matchesDigest(sfSections[0], "-Manifest", manifest)
+	if ok {
+		return nil, nil
+	}
+
+	raw := rawSections(manifest)
+	covered = make(map[string]bool)
+	for _, section := range sfSections[1:] {
+		data, found := raw[section["Name"]]
+		if !found {
+			return nil, fmt.Errorf("%s isn't in the manifest", section["Name"])
+		}
+		ok, err = matchesDigest(section, "", data)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("the manifest section of %s doesn't match its digest", section["Name"])
+		}
+		covered[section["Name"]] = true
+	}
+	if len(covered) == 0 {
+		return nil, errors.New("the manifest doesn't match its digest")
+	}
+	return covered, nil
+}
+
+// matchesDigest reports whether data matches one of the "<alg>-Digest<suffix>" attributes of section. An error
+// means there's no digest with a supported algorithm.
+func matchesDigest(section map[string]string, suffix string, data []byte) (ok bool, err error) {
+	var found bool
+	for _, alg := range []struct {
+		name string
+		hash crypto.Hash
+	}{{"SHA-512", crypto.SHA512}, {"SHA-384", crypto.SHA384}, {"SHA-256", crypto.SHA256}, {"SHA1", crypto.SHA1}, {"SHA-1", crypto.SHA1}} {
+		want, has := section[alg.name+"-Digest"+suffix]
+		if !has {
+			continue
+		}
+		found = true
+		h := alg.hash.New()
+		h.Write(data)
+		if base64.StdEncoding.EncodeToString(h.Sum(nil)) != want {
+			return false, nil
+		}
+	}
+	if !found {
+		return false, fmt.Errorf("no supported digest%s", strings.ToLower(suffix))
+	}
+	return true, nil
+}
+
+// manifestSections parses a manifest or signature file into its sections, the first one being the main section
+func manifestSections(data []byte) (sections []map[string]string) {
+	current := make(map[string]string)
+	var last string
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			if len(current) > 0 || len(sections) == 0 {
+				sections = append(sections, current)
+			}
+			current = make(map[string]string)
+			last = ""
+		case strings.HasPrefix(line, " ") && last != "":
+			current[last] += line[1:]
+		default:
+			key, value, _ := strings.Cut(line, ": ")
+			current[key] = value
+			last = key
+		}
+	}
+	if len(current) > 0 || len(sections) == 0 {
+		sections = append(sections, current)
+	}
+	return
+}
+
+// rawSections returns the bytes of the individual sections of a manifest by name, including their trailing empty
+// line, which are what signature files can contain the digests of
+func rawSections(manifest []byte) map[string][]byte {
+	sections := make(map[string][]byte)
+
+	rest := manifest
+	for len(rest) > 0 {
+		end := len(rest)
+		if i := bytes.Index(rest, []byte("\r\n\r\n")); i >= 0 {
+			end = i + 4
+		}
+		if i := bytes.Index(rest, []byte("\n\n")); i >= 0 && i+2 < end {
+			end = i + 2
+		}
+		section := rest[:end]
+		rest = rest[end:]
+
+		if parsed := manifestSections(section); len(parsed) > 0 {
+			if name := parsed[0]["Name"]; name != "" {
+				sections[name] = section
+			}
+		}
+	}
+	return sections
+}
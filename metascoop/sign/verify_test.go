@@ -0,0 +1,120 @@
+package sign
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey generates a key with a self-signed certificate, RSA if rsaKey is set and ECDSA otherwise
+func testKey(t *testing.T, rsaKey bool) *Key {
+	t.Helper()
+
+	var signer crypto.Signer
+	var err error
+	if rsaKey {
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "metascoop test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{Signer: signer, Certificate: cert}
+}
+
+// sectionSignedJAR builds a JAR with one file per entry of files, whose signature file has no digest of the whole
+// manifest, only of the manifest sections of the files in covered
+func sectionSignedJAR(t *testing.T, k *Key, files map[string]string, covered ...string) []byte {
+	t.Helper()
+
+	names := []string{"a.json", "b.json"}
+	manifest := "Manifest-Version: 1.0\r\n\r\n"
+	sections := make(map[string]string)
+	for _, name := range names {
+		sections[name] = fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", name, digest([]byte(files[name])))
+		manifest += sections[name]
+	}
+
+	sf := "Signature-Version: 1.0\r\n\r\n"
+	for _, name := range covered {
+		sf += fmt.Sprintf("Name: %s\r\nSHA-256-Digest: %s\r\n\r\n", name, digest([]byte(sections[name])))
+	}
+
+	hashed := sha256.Sum256([]byte(sf))
+	sig, err := k.Signer.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := signedData(k.Certificate, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	entries := [][2]string{{"META-INF/MANIFEST.MF", manifest}, {"META-INF/TEST.SF", sf}, {"META-INF/TEST.EC", string(block)}}
+	for _, name := range names {
+		entries = append(entries, [2]string{name, files[name]})
+	}
+	for _, e := range entries {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(e[1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifyJARSectionDigests(t *testing.T) {
+	k := testKey(t, false)
+	files := map[string]string{"a.json": `{"a": 1}`, "b.json": `{"b": 2}`}
+
+	signed, fingerprint, err := VerifyJAR(sectionSignedJAR(t, k, files, "a.json", "b.json"))
+	if err != nil {
+		t.Fatalf("verifying a JAR whose signature file covers all sections: %v", err)
+	}
+	if len(signed) != 2 || string(signed["a.json"]) != files["a.json"] || string(signed["b.json"]) != files["b.json"] {
+		t.Errorf("signed files are %q, want a.json and b.json", signed)
+	}
+	if fingerprint != k.Fingerprint() {
+		t.Errorf("fingerprint is %s, want %s", fingerprint, k.Fingerprint())
+	}
+
+	// b.json is in the manifest with a matching digest, but its section isn't signed
+	signed, _, err = VerifyJAR(sectionSignedJAR(t, k, files, "a.json"))
+	if err == nil || !strings.Contains(err.Error(), "b.json isn't signed") {
+		t.Errorf("verifying a JAR with an uncovered manifest section = %q, %v, want an error about b.json", signed, err)
+	}
+}
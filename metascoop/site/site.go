@@ -0,0 +1,353 @@
+// Package site generates a static website for the repo: a list of all apps and a page per app with its
+// screenshots, versions and changelogs. It's written next to the indexes, so the repo URL is browsable.
+package site
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/qr"
+)
+
+// Names of the templates, which can be overridden by files with the same name in Options.TemplateDir
+const (
+	IndexTemplate = "index.html"
+	AppTemplate   = "app.html"
+	Stylesheet    = "site.css"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// Options configures the website
+type Options struct {
+	// RepoDir is the directory with index-v1.json, the website is written to it
+	RepoDir string
+
+	// MetadataDir contains the changelogs of the versions
+	MetadataDir string
+
+	// TemplateDir may contain templates that replace the built-in ones
+	TemplateDir string
+
+	// Fingerprint is the SHA-256 fingerprint of the certificate that signs the index, it's shown and part of the
+	// repo URL in the QR code. It's left out if empty.
+	Fingerprint string
+}
+
+// Repo is what the templates get to render
+type Repo struct {
+	Name        string
+	Description string
+	Address     string
+	Icon        string
+	Fingerprint string
+
+	// URL is the address to add the repo in clients, with the fingerprint if it's known
+	URL string
+
+	// QRCode is an SVG image of URL
+	QRCode template.HTML
+
+	Apps []App
+}
+
+// App is an app in the repo
+type App struct {
+	PackageName string
+	Name        string
+	Summary     string
+	Description string
+
+	// Icon and Screenshots are paths relative to the repo directory
+	Icon        string
+	Screenshots []string
+
+	License      string
+	WebSite      string
+	SourceCode   string
+	IssueTracker string
+	AntiFeatures []string
+
+	// Versions are sorted from newest to oldest
+	Versions []Version
+}
+
+// Version is a published APK of an app
+type Version struct {
+	Name          string
+	Code          int
+	APK           string
+	Size          int64
+	MinSdkVersion int
+	Added         time.Time
+	Changelog     string
+}
+
+// Page is the data of a template. Root is the relative path from the page to the repo directory, e.g. "../".
+type Page struct {
+	Repo *Repo
+	App  *App
+	Root string
+}
+
+// Generate writes index.html and the stylesheet to the repo directory, and <package>/index.html for every app.
+// The output only depends on the index, the changelogs and the templates, so regenerating it without changes
+// in the repo doesn't change the files.
+func Generate(opts Options) (err error) {
+	index, err := apps.ReadIndex(filepath.Join(opts.RepoDir, "index-v1.json"))
+	if err != nil {
+		return fmt.Errorf("reading index: %w", err)
+	}
+
+	repo, err := NewRepo(index, opts.MetadataDir, opts.Fingerprint)
+	if err != nil {
+		return
+	}
+
+	indexTmpl, err := loadTemplate(opts.TemplateDir, IndexTemplate)
+	if err != nil {
+		return
+	}
+	appTmpl, err := loadTemplate(opts.TemplateDir, AppTemplate)
+	if err != nil {
+		return
+	}
+
+	css, err := readTemplate(opts.TemplateDir, Stylesheet)
+	if err != nil {
+		return
+	}
+	err = writeFile(filepath.Join(opts.RepoDir, Stylesheet), css)
+	if err != nil {
+		return
+	}
+
+	err = render(indexTmpl, filepath.Join(opts.RepoDir, "index.html"), Page{Repo: repo})
+	if err != nil {
+		return
+	}
+
+	for i := range repo.Apps {
+		app := &repo.Apps[i]
+		err = render(appTmpl, filepath.Join(opts.RepoDir, app.PackageName, "index.html"), Page{Repo: repo, App: app, Root: "../"})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// NewRepo collects the data of the website from the index
+func NewRepo(index *apps.RepoIndex, metadataDir, fingerprint string) (r *Repo, err error) {
+	r = &Repo{
+		Name:        str(index.Repo, "name"),
+		Description: str(index.Repo, "description"),
+		Address:     strings.TrimSuffix(str(index.Repo, "address"), "/"),
+		Fingerprint: fingerprint,
+	}
+	if icon := str(index.Repo, "icon"); icon != "" {
+		r.Icon = "icons/" + icon
+	}
+	if r.Name == "" {
+		r.Name = "F-Droid repo"
+	}
+
+	r.URL = RepoURL(r.Address, fingerprint)
+	if r.URL != "" {
+		code, qerr := qr.Encode(r.URL)
+		if qerr != nil {
+			return nil, fmt.Errorf("encoding repo URL as QR code: %w", qerr)
+		}
+		r.QRCode = template.HTML(code.SVG())
+	}
+
+	for _, m := range index.Apps {
+		app := App{
+			PackageName:  str(m, "packageName"),
+			Name:         localized(m, "name"),
+			Summary:      localized(m, "summary"),
+			Description:  localized(m, "description"),
+			License:      str(m, "license"),
+			WebSite:      str(m, "webSite"),
+			SourceCode:   str(m, "sourceCode"),
+			IssueTracker: str(m, "issueTracker"),
+		}
+		if app.PackageName == "" {
+			continue
+		}
+		if app.Name == "" {
+			app.Name = app.PackageName
+		}
+
+		if list, ok := m["antiFeatures"].([]interface{}); ok {
+			for _, af := range list {
+				if s, ok := af.(string); ok {
+					app.AntiFeatures = append(app.AntiFeatures, s)
+				}
+			}
+		}
+
+		en := english(m)
+		if icon, _ := en["icon"].(string); icon != "" {
+			app.Icon = app.PackageName + "/en-US/" + icon
+		} else if icon := str(m, "icon"); icon != "" {
+			app.Icon = "icons/" + icon
+		}
+		if shots, ok := en["phoneScreenshots"].([]interface{}); ok {
+			for _, s := range shots {
+				if name, ok := s.(string); ok {
+					app.Screenshots = append(app.Screenshots, app.PackageName+"/en-US/phoneScreenshots/"+name)
+				}
+			}
+		}
+
+		for _, p := range index.Packages[app.PackageName] {
+			v := Version{
+				Name:          p.VersionName,
+				Code:          p.VersionCode,
+				APK:           p.ApkName,
+				Size:          int64(p.Size),
+				MinSdkVersion: p.MinSdkVersion,
+				Added:         time.UnixMilli(p.Added).UTC(),
+			}
+
+			changelog, cerr := os.ReadFile(filepath.Join(metadataDir, app.PackageName, "en-US", "changelogs", fmt.Sprintf("%d.txt", p.VersionCode)))
+			if cerr == nil {
+				v.Changelog = strings.TrimSpace(string(changelog))
+			}
+
+			app.Versions = append(app.Versions, v)
+		}
+		sort.Slice(app.Versions, func(i, j int) bool {
+			if app.Versions[i].Code != app.Versions[j].Code {
+				return app.Versions[i].Code > app.Versions[j].Code
+			}
+			return app.Versions[i].APK < app.Versions[j].APK
+		})
+
+		r.Apps = append(r.Apps, app)
+	}
+
+	sort.Slice(r.Apps, func(i, j int) bool {
+		a, b := strings.ToLower(r.Apps[i].Name), strings.ToLower(r.Apps[j].Name)
+		if a != b {
+			return a < b
+		}
+		return r.Apps[i].PackageName < r.Apps[j].PackageName
+	})
+
+	return
+}
+
+// RepoURL returns the URL to add the repo at address in clients. It contains the fingerprint, so clients can verify
+// the index, in upper case like fdroidserver writes it.
+func RepoURL(address, fingerprint string) string {
+	address = strings.TrimSuffix(address, "/")
+	if address == "" || fingerprint == "" {
+		return address
+	}
+	return address + "?fingerprint=" + strings.ToUpper(fingerprint)
+}
+
+func str(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func english(app map[string]interface{}) map[string]interface{} {
+	all, _ := app["localized"].(map[string]interface{})
+	en, _ := all["en-US"].(map[string]interface{})
+	return en
+}
+
+// localized returns the field of the app, or its English translation
+func localized(app map[string]interface{}, key string) string {
+	if s := str(app, key); s != "" {
+		return s
+	}
+	return str(english(app), key)
+}
+
+var funcs = template.FuncMap{
+	"size": func(n int64) string {
+		const unit = 1024
+		if n < unit {
+			return fmt.Sprintf("%d B", n)
+		}
+		div, exp := int64(unit), 0
+		for m := n / unit; m >= unit; m /= unit {
+			div *= unit
+			exp++
+		}
+		return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+	},
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02")
+	},
+	// paragraphs splits text at empty lines
+	"paragraphs": func(text string) (paragraphs []string) {
+		for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+			if p = strings.TrimSpace(p); p != "" {
+				paragraphs = append(paragraphs, p)
+			}
+		}
+		return
+	},
+}
+
+// readTemplate returns the file name from dir, or the built-in one if dir doesn't have it
+func readTemplate(dir, name string) (data []byte, err error) {
+	if dir != "" {
+		data, err = os.ReadFile(filepath.Join(dir, name))
+		if !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	return defaultTemplates.ReadFile("templates/" + name)
+}
+
+func loadTemplate(dir, name string) (t *template.Template, err error) {
+	data, err := readTemplate(dir, name)
+	if err != nil {
+		return
+	}
+
+	t, err = template.New(name).Funcs(funcs).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing template %s: %w", name, err)
+	}
+	return
+}
+
+func render(t *template.Template, path string, page Page) (err error) {
+	var buf bytes.Buffer
+	err = t.Execute(&buf, page)
+	if err != nil {
+		return fmt.Errorf("rendering %s: %w", path, err)
+	}
+	return writeFile(path, buf.Bytes())
+}
+
+// writeFile writes data to path unless it already has that content, so unchanged pages keep their modification time
+func writeFile(path string, data []byte) (err error) {
+	if existing, rerr := os.ReadFile(path); rerr == nil && bytes.Equal(existing, data) {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,247 @@
+package sources
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// How the actions source derives the versionCode of a build
+const (
+	// VersionCodeRunNumber uses the number of the workflow run, e.g. from GITHUB_RUN_NUMBER in the build
+	VersionCodeRunNumber = "run_number"
+
+	// VersionCodeCommitDate uses the commit time of the build as Unix timestamp, e.g. from "git log -1 --format=%ct"
+	VersionCodeCommitDate = "commit_date"
+)
+
+// ActionsConfig describes which workflow runs the actions source takes artifacts from
+type ActionsConfig struct {
+	// Workflow is the file name of the workflow, e.g. "nightly.yml"
+	Workflow string
+
+	// Branch the workflow ran on, the default branch of the repository if it's empty
+	Branch string
+
+	// VersionCode is VersionCodeRunNumber or VersionCodeCommitDate. The APKs must have this versionCode, and it's
+	// part of the tag, so runs that built the same commit again are the same release. If it's empty, the tag has
+	// the run number and the versionCode isn't checked.
+	VersionCode string
+}
+
+// actionsSource publishes the APKs in the artifacts of the latest successful run of a GitHub Actions workflow,
+// e.g. for nightly builds. The run is reported as the only release, with the message of its commit as notes.
+type actionsSource struct {
+	*gitHubSource
+	config ActionsConfig
+}
+
+// RunTagPrefix starts the tags of releases the actions source reports
+const RunTagPrefix = "run-"
+
+// NewActions returns a source for the artifacts of a GitHub Actions workflow in the repository at repoURL.
+// Downloading artifacts always needs a token, also for public repositories.
+func NewActions(repoURL string, config ActionsConfig, opts Options) (s Source, err error) {
+	if config.Workflow == "" {
+		return nil, fmt.Errorf("the workflow of %q must be set", repoURL)
+	}
+	switch config.VersionCode {
+	case "", VersionCodeRunNumber, VersionCodeCommitDate:
+	default:
+		return nil, fmt.Errorf("unknown version code %q, must be %q or %q", config.VersionCode, VersionCodeRunNumber, VersionCodeCommitDate)
+	}
+
+	gh, err := newGitHub(repoURL, opts)
+	if err != nil {
+		return
+	}
+
+	return &actionsSource{gitHubSource: gh, config: config}, nil
+}
+
+func (a *actionsSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	branch := a.config.Branch
+	if branch == "" {
+		repo, _, rerr := a.client.Repositories.Get(ctx, a.owner, a.name)
+		if rerr != nil {
+			return nil, classifyGitHubError(rerr)
+		}
+		branch = repo.GetDefaultBranch()
+	}
+
+	runs, _, err := a.client.Actions.ListWorkflowRunsByFileName(ctx, a.owner, a.name, a.config.Workflow, &github.ListWorkflowRunsOptions{
+		Branch:      branch,
+		Status:      "success",
+		ListOptions: github.ListOptions{PerPage: 1},
+	})
+	if err != nil {
+		return nil, classifyGitHubError(fmt.Errorf("listing runs of workflow %q: %w", a.config.Workflow, err))
+	}
+	if len(runs.WorkflowRuns) == 0 {
+		return nil, nil
+	}
+	run := runs.WorkflowRuns[0]
+
+	versionCode, err := a.versionCode(run)
+	if err != nil {
+		return
+	}
+
+	r := Release{
+		ID:          run.GetID(),
+		TagName:     RunTagPrefix + strconv.Itoa(run.GetRunNumber()),
+		VersionCode: versionCode,
+		PublishedAt: run.GetUpdatedAt().Time,
+	}
+	if versionCode != 0 {
+		r.TagName = RunTagPrefix + strconv.FormatInt(versionCode, 10)
+	}
+	if commit := run.GetHeadCommit(); commit != nil {
+		r.Body = commit.GetMessage()
+	}
+
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		list, resp, lerr := a.client.Actions.ListWorkflowRunArtifacts(ctx, a.owner, a.name, run.GetID(), opts)
+		if lerr != nil {
+			return nil, classifyGitHubError(fmt.Errorf("listing artifacts of run %d: %w", run.GetRunNumber(), lerr))
+		}
+
+		for _, artifact := range list.Artifacts {
+			// Artifacts are deleted after the retention period of the repository
+			if artifact.GetExpired() {
+				continue
+			}
+
+			r.Assets = append(r.Assets, Asset{
+				ID:   artifact.GetID(),
+				Name: artifactAssetName(artifact.GetName()),
+				URL:  artifact.GetArchiveDownloadURL(),
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	return []Release{r}, nil
+}
+
+// versionCode returns the versionCode the APKs of run must have, or zero if none is derived
+func (a *actionsSource) versionCode(run *github.WorkflowRun) (code int64, err error) {
+	switch a.config.VersionCode {
+	case VersionCodeRunNumber:
+		return int64(run.GetRunNumber()), nil
+	case VersionCodeCommitDate:
+		commit := run.GetHeadCommit()
+		if commit == nil || commit.Timestamp == nil {
+			return 0, fmt.Errorf("run %d doesn't report the date of its commit", run.GetRunNumber())
+		}
+		return commit.GetTimestamp().Unix(), nil
+	}
+	return 0, nil
+}
+
+// artifactAssetName returns the name of the asset for an artifact. Artifacts are named freely, so ".apk" is
+// appended to match the default asset filter. asset_filter in apps.yaml can select artifacts by name.
+func artifactAssetName(name string) string {
+	if strings.HasSuffix(name, ".apk") {
+		return name
+	}
+	return name + ".apk"
+}
+
+// DownloadAsset downloads the ZIP archive of the artifact and returns the APK in it. The archive is stored in a
+// temporary file that is removed when rc is closed. Archives can't be resumed, so start is always 0.
+func (a *actionsSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	u, _, err := a.client.Actions.DownloadArtifact(ctx, a.owner, a.name, asset.ID, false)
+	if err != nil {
+		return nil, 0, classifyGitHubError(fmt.Errorf("downloading artifact %q (id %d): %w", asset.Name, asset.ID, err))
+	}
+
+	// The archive is served from a signed URL, which must not get the token
+	body, _, err := downloadURL(ctx, http.DefaultClient, u.String(), nil, 0)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	f, err := os.CreateTemp("", "metascoop-artifact-*.zip")
+	if err != nil {
+		return
+	}
+	archive := &tempArchive{f: f}
+	defer func() {
+		if err != nil {
+			_ = archive.Close()
+		}
+	}()
+
+	size, err := io.Copy(f, body)
+	if err != nil {
+		return
+	}
+
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return nil, 0, retry.Permanent(fmt.Errorf("artifact %q is no ZIP archive: %w", asset.Name, err))
+	}
+
+	var apks []*zip.File
+	for _, entry := range zr.File {
+		if strings.HasSuffix(entry.Name, ".apk") {
+			apks = append(apks, entry)
+		}
+	}
+	switch len(apks) {
+	case 0:
+		return nil, 0, retry.Permanent(fmt.Errorf("artifact %q doesn't contain an APK", asset.Name))
+	case 1:
+	default:
+		var names []string
+		for _, entry := range apks {
+			names = append(names, path.Base(entry.Name))
+		}
+		return nil, 0, retry.Permanent(fmt.Errorf("artifact %q contains several APKs (%s), upload them as separate artifacts", asset.Name, strings.Join(names, ", ")))
+	}
+
+	archive.entry, err = apks[0].Open()
+	if err != nil {
+		return
+	}
+
+	return archive, 0, nil
+}
+
+// tempArchive reads an entry of an archive in a temporary file, which is removed when it's closed
+type tempArchive struct {
+	f     *os.File
+	entry io.ReadCloser
+}
+
+func (t *tempArchive) Read(p []byte) (int, error) {
+	return t.entry.Read(p)
+}
+
+func (t *tempArchive) Close() error {
+	if t.entry != nil {
+		_ = t.entry.Close()
+	}
+	err := t.f.Close()
+	if rerr := os.Remove(t.f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FDroidConfig describes which package the fdroid source mirrors from which repo
+type FDroidConfig struct {
+	// Repo is the URL of the F-Droid repo, i.e. the directory that contains index-v1.json
+	Repo string
+
+	Package string
+}
+
+// fdroidSource mirrors the versions of a package that another F-Droid repo publishes. Every version is
+// reported as its own release, with the SHA-256 from the index so the downloads are verified against it.
+type fdroidSource struct {
+	client *http.Client
+	config FDroidConfig
+
+	// index is fetched once, both Details and ListReleases need it
+	index *fdroidIndex
+}
+
+type fdroidIndex struct {
+	Apps []struct {
+		PackageName string `json:"packageName"`
+		Summary     string `json:"summary"`
+		License     string `json:"license"`
+		Localized   map[string]struct {
+			Summary string `json:"summary"`
+		} `json:"localized"`
+	} `json:"apps"`
+	Packages map[string][]struct {
+		Added       int64  `json:"added"`
+		ApkName     string `json:"apkName"`
+		Hash        string `json:"hash"`
+		HashType    string `json:"hashType"`
+		Size        int64  `json:"size"`
+		VersionCode int64  `json:"versionCode"`
+		VersionName string `json:"versionName"`
+	} `json:"packages"`
+}
+
+// NewFDroid returns a source that takes the APKs of a package from another F-Droid repo
+func NewFDroid(config FDroidConfig, opts Options) (s Source, err error) {
+	if _, err = url.ParseRequestURI(config.Repo); err != nil {
+		return nil, fmt.Errorf("invalid F-Droid repo URL %q: %w", config.Repo, err)
+	}
+	if config.Package == "" {
+		return nil, fmt.Errorf("the package to mirror from %q must be set", config.Repo)
+	}
+	config.Repo = strings.TrimSuffix(config.Repo, "/")
+
+	return &fdroidSource{
+		client: opts.httpClient(),
+		config: config,
+	}, nil
+}
+
+func (f *fdroidSource) fetchIndex(ctx context.Context) (index *fdroidIndex, err error) {
+	if f.index != nil {
+		return f.index, nil
+	}
+
+	index = new(fdroidIndex)
+	err = getJSON(ctx, f.client, f.config.Repo+"/index-v1.json", nil, index)
+	if err != nil {
+		return nil, fmt.Errorf("fetching index of %s: %w", f.config.Repo, err)
+	}
+
+	f.index = index
+	return
+}
+
+func (f *fdroidSource) Details(ctx context.Context) (d RepoDetails, err error) {
+	index, err := f.fetchIndex(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, app := range index.Apps {
+		if app.PackageName != f.config.Package {
+			continue
+		}
+
+		d.License = app.License
+		d.Description = app.Summary
+		if d.Description == "" {
+			d.Description = app.Localized["en-US"].Summary
+		}
+	}
+
+	return
+}
+
+// ListReleases returns one release per version code. The tag is the versionName, unless several version codes
+// share it, e.g. for per-ABI APKs, in which case the version code is appended.
+func (f *fdroidSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	index, err := f.fetchIndex(ctx)
+	if err != nil {
+		return
+	}
+
+	pkgs := index.Packages[f.config.Package]
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("%s doesn't publish package %q", f.config.Repo, f.config.Package)
+	}
+
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		return pkgs[i].VersionCode > pkgs[j].VersionCode
+	})
+
+	names := make(map[string]int)
+	for _, p := range pkgs {
+		names[p.VersionName]++
+	}
+
+	for _, p := range pkgs {
+		tag := p.VersionName
+		switch {
+		case tag == "":
+			tag = strconv.FormatInt(p.VersionCode, 10)
+		case names[tag] > 1:
+			tag += "-" + strconv.FormatInt(p.VersionCode, 10)
+		}
+
+		asset := Asset{
+			Name: p.ApkName,
+			Size: p.Size,
+			URL:  f.config.Repo + "/" + url.PathEscape(p.ApkName),
+		}
+		if strings.EqualFold(p.HashType, "sha256") {
+			asset.SHA256 = strings.ToLower(p.Hash)
+		}
+
+		releases = append(releases, Release{
+			ID:          p.VersionCode,
+			TagName:     tag,
+			PublishedAt: time.UnixMilli(p.Added).UTC(),
+			Assets:      []Asset{asset},
+		})
+	}
+
+	return
+}
+
+func (f *fdroidSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	return downloadURL(ctx, f.client, asset.URL, nil, offset)
+}
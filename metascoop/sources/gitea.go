@@ -0,0 +1,139 @@
+package sources
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// giteaSource fetches releases from Gitea-compatible hosts such as Codeberg or Forgejo instances
+type giteaSource struct {
+	client *http.Client
+	token  string
+
+	baseURL string
+	owner   string
+	name    string
+}
+
+func newGitea(repoURL string, opts Options) (s *giteaSource, err error) {
+	base, path, err := splitRepoURL(repoURL)
+	if err != nil {
+		return
+	}
+
+	split := strings.Split(path, "/")
+
+	return &giteaSource{
+		client:  opts.httpClient(),
+		token:   opts.GiteaToken,
+		baseURL: base,
+		owner:   split[0],
+		name:    split[1],
+	}, nil
+}
+
+type giteaRepo struct {
+	FullName    string `json:"full_name"`
+	HTMLURL     string `json:"html_url"`
+	Description string `json:"description"`
+	// Licenses is only reported by newer Gitea versions
+	Licenses []string `json:"licenses"`
+}
+
+type giteaRelease struct {
+	ID          int64     `json:"id"`
+	TagName     string    `json:"tag_name"`
+	Body        string    `json:"body"`
+	Draft       bool      `json:"draft"`
+	Prerelease  bool      `json:"prerelease"`
+	PublishedAt time.Time `json:"published_at"`
+	Assets      []struct {
+		ID                 int64  `json:"id"`
+		Name               string `json:"name"`
+		Size               int64  `json:"size"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (g *giteaSource) header() http.Header {
+	var header = http.Header{}
+	if g.token != "" {
+		header.Set("Authorization", "token "+g.token)
+	}
+	return header
+}
+
+func (g *giteaSource) repoAPIURL() string {
+	return g.baseURL + "/api/v1/repos/" + g.owner + "/" + g.name
+}
+
+func (g *giteaSource) Details(ctx context.Context) (d RepoDetails, err error) {
+	var repo giteaRepo
+
+	err = getJSON(ctx, g.client, g.repoAPIURL(), g.header(), &repo)
+	if err != nil {
+		return
+	}
+
+	d.Description = repo.Description
+	if len(repo.Licenses) == 1 {
+		d.License = repo.Licenses[0]
+	}
+
+	if repo.FullName != "" && !strings.EqualFold(repo.FullName, g.owner+"/"+g.name) {
+		d.MovedTo = repo.HTMLURL
+		if owner, name, ok := strings.Cut(repo.FullName, "/"); ok {
+			g.owner, g.name = owner, name
+		}
+	}
+
+	return
+}
+
+func (g *giteaSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	for page := 1; ; page++ {
+		var rels []giteaRelease
+
+		err = getJSON(ctx, g.client, g.repoAPIURL()+"/releases?limit=50&page="+strconv.Itoa(page), g.header(), &rels)
+		if err != nil || len(rels) == 0 {
+			return
+		}
+
+		for _, rel := range rels {
+			r := Release{
+				ID:          rel.ID,
+				TagName:     rel.TagName,
+				Body:        rel.Body,
+				Draft:       rel.Draft,
+				Prerelease:  rel.Prerelease,
+				PublishedAt: rel.PublishedAt,
+			}
+
+			for _, asset := range rel.Assets {
+				r.Assets = append(r.Assets, Asset{
+					ID:   asset.ID,
+					Name: asset.Name,
+					Size: asset.Size,
+					URL:  asset.BrowserDownloadURL,
+				})
+			}
+
+			releases = append(releases, r)
+		}
+	}
+}
+
+func (g *giteaSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	var header = http.Header{}
+
+	// Attachments are served from the instance itself, but don't leak the token if they aren't
+	if strings.HasPrefix(asset.URL, g.baseURL+"/") {
+		header = g.header()
+	}
+
+	return downloadURL(ctx, g.client, asset.URL, header, offset)
+}
@@ -0,0 +1,224 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+type gitHubSource struct {
+	client *github.Client
+	batch  *GitHubBatch
+
+	owner string
+	name  string
+}
+
+func newGitHub(repoURL string, opts Options) (s *gitHubSource, err error) {
+	_, path, err := splitRepoURL(repoURL)
+	if err != nil {
+		return
+	}
+
+	split := strings.Split(path, "/")
+
+	client := opts.GitHub
+	if client == nil {
+		client = github.NewClient(nil)
+	}
+
+	return &gitHubSource{
+		client: client,
+		batch:  opts.GitHubBatch,
+		owner:  split[0],
+		name:   split[1],
+	}, nil
+}
+
+func (g *gitHubSource) Details(ctx context.Context) (d RepoDetails, err error) {
+	if r, ok := g.batch.lookup(g.owner, g.name); ok {
+		if r.details.MovedTo != "" {
+			g.moved(r.fullName)
+		}
+		return r.details, nil
+	}
+
+	repo, _, err := g.client.Repositories.Get(ctx, g.owner, g.name)
+	if err != nil {
+		err = classifyGitHubError(err)
+		return
+	}
+
+	d.Description = repo.GetDescription()
+	if repo.License != nil && repo.License.SPDXID != nil {
+		d.License = *repo.License.SPDXID
+	}
+
+	if full := repo.GetFullName(); full != "" && !strings.EqualFold(full, g.owner+"/"+g.name) {
+		d.MovedTo = repo.GetHTMLURL()
+		g.moved(full)
+	}
+
+	return
+}
+
+// moved switches the source to the new full name of its repository. The API redirects requests for the old name,
+// but asset downloads would follow that redirect without the headers they need.
+func (g *gitHubSource) moved(fullName string) {
+	if owner, name, ok := strings.Cut(fullName, "/"); ok {
+		g.owner, g.name = owner, name
+	}
+}
+
+func (g *gitHubSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	if r, ok := g.batch.lookup(g.owner, g.name); ok && r.releases != nil {
+		return r.releases, nil
+	}
+
+	var currentPage int = 1
+
+	for {
+		// go-github doesn't know asset digests yet, so we decode the response ourselves
+		req, ierr := g.client.NewRequest(http.MethodGet, fmt.Sprintf("repos/%s/%s/releases?page=%d&per_page=100", g.owner, g.name, currentPage), nil)
+		if ierr != nil {
+			err = ierr
+			break
+		}
+
+		var rels []*gitHubRelease
+		_, ierr = g.client.Do(ctx, req, &rels)
+		if ierr != nil || len(rels) == 0 {
+			err = classifyGitHubError(ierr)
+			break
+		}
+
+		for _, rel := range rels {
+			releases = append(releases, convertGitHubRelease(rel))
+		}
+		currentPage++
+	}
+
+	return
+}
+
+// DownloadAsset requests the asset through the API, which redirects to the actual content. The requests are
+// made directly because go-github's DownloadReleaseAsset can't ask for a range.
+func (g *gitHubSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	u := fmt.Sprintf("repos/%s/%s/releases/assets/%d", g.owner, g.name, asset.ID)
+	if asset.ID == 0 {
+		// Assets found with GraphQL only have their download URL, which also redirects to the content
+		u = asset.URL
+	}
+
+	req, err := g.client.NewRequest(http.MethodGet, u, nil)
+	if err == nil {
+		req.Header.Set("Accept", "application/octet-stream")
+		rc, start, err = g.openAsset(req.WithContext(ctx), offset)
+	}
+	if err != nil {
+		err = classifyGitHubError(fmt.Errorf("downloading asset %q (id %d): %w", asset.Name, asset.ID, err))
+	}
+	return
+}
+
+// openAsset follows the redirect of an asset request without the API client, as its transport would send
+// the token to the storage host
+func (g *gitHubSource) openAsset(req *http.Request, offset int64) (rc io.ReadCloser, start int64, err error) {
+	client := *g.client.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		_ = resp.Body.Close()
+
+		var loc *url.URL
+		loc, err = resp.Location()
+		if err != nil {
+			return
+		}
+		return downloadURL(req.Context(), http.DefaultClient, loc.String(), nil, offset)
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// Enterprise instances may serve assets from the API directly
+		return rangeResponse(&client, resp, offset)
+	}
+
+	err = github.CheckResponse(resp)
+	_ = resp.Body.Close()
+	if err == nil {
+		err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return
+}
+
+// classifyGitHubError marks errors caused by client mistakes (e.g. a repo that doesn't exist) as permanent
+func classifyGitHubError(err error) error {
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil && isPermanentStatus(errResp.Response.StatusCode) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// gitHubRelease adds the asset digests to the go-github release type
+type gitHubRelease struct {
+	github.RepositoryRelease
+
+	Assets []*gitHubAsset `json:"assets"`
+}
+
+type gitHubAsset struct {
+	github.ReleaseAsset
+
+	// Digest is "sha256:<hex>", it's only set for assets uploaded since GitHub started computing them
+	Digest string `json:"digest"`
+}
+
+func convertGitHubRelease(rel *gitHubRelease) (r Release) {
+	r.ID = rel.GetID()
+	r.TagName = rel.GetTagName()
+	r.Body = rel.GetBody()
+	r.Prerelease = rel.GetPrerelease()
+	r.Draft = rel.GetDraft()
+	r.PublishedAt = rel.GetPublishedAt().Time
+
+	for _, asset := range rel.Assets {
+		// Assets that are still being uploaded (or failed to upload) cannot be downloaded
+		if asset.GetState() != "uploaded" {
+			continue
+		}
+
+		var sha256 string
+		if strings.HasPrefix(asset.Digest, "sha256:") {
+			sha256 = strings.TrimPrefix(asset.Digest, "sha256:")
+		}
+
+		r.Assets = append(r.Assets, Asset{
+			ID:     asset.GetID(),
+			Name:   asset.GetName(),
+			Size:   int64(asset.GetSize()),
+			URL:    asset.GetBrowserDownloadURL(),
+			SHA256: sha256,
+		})
+	}
+
+	return
+}
@@ -0,0 +1,265 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+)
+
+// gitHubBatchSize is the number of repositories looked up per GraphQL query. Each repo can return up to
+// 100 releases with 100 assets, which keeps a query well below the node limit of GitHub.
+const gitHubBatchSize = 20
+
+// GitHubBatch contains the details and releases of many GitHub repositories, which were looked up with a
+// few GraphQL queries instead of several REST requests per repository. Sources that are created with
+// it in their Options use it instead of the REST API. The GraphQL API requires a token.
+type GitHubBatch struct {
+	repos map[string]gitHubBatchRepo
+}
+
+type gitHubBatchRepo struct {
+	details RepoDetails
+
+	// fullName is the owner and name the repository has now, which differ from the requested ones if it moved
+	fullName string
+
+	// releases is nil if the repository has more releases (or assets) than one query returns
+	releases []Release
+}
+
+func gitHubRepoKey(owner, name string) string {
+	return strings.ToLower(owner + "/" + name)
+}
+
+func (b *GitHubBatch) lookup(owner, name string) (r gitHubBatchRepo, ok bool) {
+	if b == nil {
+		return
+	}
+	r, ok = b.repos[gitHubRepoKey(owner, name)]
+	return
+}
+
+// Len returns the number of repositories in the batch
+func (b *GitHubBatch) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.repos)
+}
+
+// FetchGitHubBatch looks up the given GitHub repository URLs with the GraphQL API. Repositories that
+// couldn't be looked up, e.g. because they don't exist, are left out, so their sources use the REST API and
+// report a proper error there. If a query fails, the repositories of the queries before it are still returned.
+func FetchGitHubBatch(ctx context.Context, client *github.Client, repoURLs []string) (b *GitHubBatch, err error) {
+	b = &GitHubBatch{repos: make(map[string]gitHubBatchRepo)}
+
+	var (
+		repos [][2]string
+		seen  = make(map[string]bool)
+	)
+	for _, u := range repoURLs {
+		_, path, perr := splitRepoURL(u)
+		if perr != nil {
+			return b, perr
+		}
+		split := strings.Split(path, "/")
+		if key := gitHubRepoKey(split[0], split[1]); !seen[key] {
+			seen[key] = true
+			repos = append(repos, [2]string{split[0], split[1]})
+		}
+	}
+
+	endpoint := gitHubGraphQLURL(client)
+
+	for start := 0; start < len(repos); start += gitHubBatchSize {
+		end := start + gitHubBatchSize
+		if end > len(repos) {
+			end = len(repos)
+		}
+
+		err = b.fetch(ctx, client, endpoint, repos[start:end])
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// gitHubGraphQLURL returns the GraphQL endpoint that belongs to the REST API the client uses
+func gitHubGraphQLURL(client *github.Client) string {
+	base := client.BaseURL.String()
+	if strings.HasSuffix(base, "/api/v3/") {
+		// GitHub Enterprise Server
+		return strings.TrimSuffix(base, "v3/") + "graphql"
+	}
+	return base + "graphql"
+}
+
+const gitHubRepoFields = `nameWithOwner
+url
+description
+licenseInfo { spdxId }
+releases(first: 100, orderBy: {field: CREATED_AT, direction: DESC}) {
+  pageInfo { hasNextPage }
+  nodes {
+    databaseId
+    tagName
+    description
+    isPrerelease
+    isDraft
+    publishedAt
+    releaseAssets(first: 100) {
+      pageInfo { hasNextPage }
+      nodes { name size downloadUrl }
+    }
+  }
+}`
+
+type gitHubGraphQLRepo struct {
+	NameWithOwner string `json:"nameWithOwner"`
+	URL           string `json:"url"`
+	Description   string `json:"description"`
+	LicenseInfo   *struct {
+		SPDXID string `json:"spdxId"`
+	} `json:"licenseInfo"`
+	Releases struct {
+		PageInfo struct {
+			HasNextPage bool `json:"hasNextPage"`
+		} `json:"pageInfo"`
+		Nodes []struct {
+			DatabaseID    int64      `json:"databaseId"`
+			TagName       string     `json:"tagName"`
+			Description   string     `json:"description"`
+			IsPrerelease  bool       `json:"isPrerelease"`
+			IsDraft       bool       `json:"isDraft"`
+			PublishedAt   *time.Time `json:"publishedAt"`
+			ReleaseAssets struct {
+				PageInfo struct {
+					HasNextPage bool `json:"hasNextPage"`
+				} `json:"pageInfo"`
+				Nodes []struct {
+					Name        string `json:"name"`
+					Size        int64  `json:"size"`
+					DownloadURL string `json:"downloadUrl"`
+				} `json:"nodes"`
+			} `json:"releaseAssets"`
+		} `json:"nodes"`
+	} `json:"releases"`
+}
+
+// fetch looks up repos with one query, using an alias for each of them
+func (b *GitHubBatch) fetch(ctx context.Context, client *github.Client, endpoint string, repos [][2]string) (err error) {
+	var (
+		params    []string
+		fields    []string
+		variables = make(map[string]interface{})
+	)
+	for i, r := range repos {
+		params = append(params, fmt.Sprintf("$owner%d: String!, $name%d: String!", i, i))
+		fields = append(fields, fmt.Sprintf("r%d: repository(owner: $owner%d, name: $name%d) {\n%s\n}", i, i, i, gitHubRepoFields))
+		variables[fmt.Sprintf("owner%d", i)] = r[0]
+		variables[fmt.Sprintf("name%d", i)] = r[1]
+	}
+
+	body := map[string]interface{}{
+		"query":     fmt.Sprintf("query(%s) {\n%s\n}", strings.Join(params, ", "), strings.Join(fields, "\n")),
+		"variables": variables,
+	}
+
+	req, err := client.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return
+	}
+
+	var resp struct {
+		Data   map[string]*gitHubGraphQLRepo `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	_, err = client.Do(ctx, req, &resp)
+	if err != nil {
+		return classifyGitHubError(fmt.Errorf("GraphQL query: %w", err))
+	}
+
+	if len(resp.Data) == 0 && len(resp.Errors) > 0 {
+		// The whole query failed, e.g. because the token lacks a scope. Errors about single repos come with data.
+		return fmt.Errorf("GraphQL query: %s", resp.Errors[0].Message)
+	}
+
+	for i, r := range repos {
+		repo := resp.Data[fmt.Sprintf("r%d", i)]
+		if repo == nil {
+			continue
+		}
+		converted := convertGitHubGraphQLRepo(repo)
+		if converted.fullName != "" && !strings.EqualFold(converted.fullName, r[0]+"/"+r[1]) {
+			converted.details.MovedTo = repo.URL
+		}
+		b.repos[gitHubRepoKey(r[0], r[1])] = converted
+
+		// Sources of moved repositories continue with the new name
+		if converted.details.MovedTo != "" {
+			if key := strings.ToLower(converted.fullName); b.repos[key].fullName == "" {
+				b.repos[key] = converted
+			}
+		}
+	}
+
+	return
+}
+
+func convertGitHubGraphQLRepo(repo *gitHubGraphQLRepo) (r gitHubBatchRepo) {
+	r.fullName = repo.NameWithOwner
+	r.details.Description = repo.Description
+	if repo.LicenseInfo != nil {
+		r.details.License = repo.LicenseInfo.SPDXID
+	}
+
+	if repo.Releases.PageInfo.HasNextPage {
+		// Listing all releases is left to the REST API
+		return
+	}
+
+	r.releases = []Release{}
+	for _, rel := range repo.Releases.Nodes {
+		if rel.ReleaseAssets.PageInfo.HasNextPage {
+			r.releases = nil
+			return
+		}
+
+		release := Release{
+			ID:         rel.DatabaseID,
+			TagName:    rel.TagName,
+			Body:       rel.Description,
+			Prerelease: rel.IsPrerelease,
+			Draft:      rel.IsDraft,
+		}
+		if rel.PublishedAt != nil {
+			release.PublishedAt = *rel.PublishedAt
+		}
+
+		for _, asset := range rel.ReleaseAssets.Nodes {
+			if asset.DownloadURL == "" {
+				continue
+			}
+
+			// GraphQL doesn't return the ID of the asset in the REST API, so it is downloaded through its URL
+			release.Assets = append(release.Assets, Asset{
+				Name: asset.Name,
+				Size: asset.Size,
+				URL:  asset.DownloadURL,
+			})
+		}
+
+		r.releases = append(r.releases, release)
+	}
+
+	return
+}
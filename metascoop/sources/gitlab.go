@@ -0,0 +1,150 @@
+package sources
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type gitLabSource struct {
+	client *http.Client
+	token  string
+
+	baseURL string
+	// project is the URL-encoded full path of the project, e.g. "group%2Fsubgroup%2Fapp"
+	project string
+}
+
+func newGitLab(repoURL string, opts Options) (s *gitLabSource, err error) {
+	base, path, err := splitRepoURL(repoURL)
+	if err != nil {
+		return
+	}
+
+	return &gitLabSource{
+		client:  opts.httpClient(),
+		token:   opts.GitLabToken,
+		baseURL: base,
+		project: url.PathEscape(path),
+	}, nil
+}
+
+type gitLabProject struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+	Description       string `json:"description"`
+	License           *struct {
+		Key string `json:"key"`
+	} `json:"license"`
+}
+
+type gitLabRelease struct {
+	TagName         string    `json:"tag_name"`
+	Description     string    `json:"description"`
+	ReleasedAt      time.Time `json:"released_at"`
+	UpcomingRelease bool      `json:"upcoming_release"`
+	Assets          struct {
+		Links []struct {
+			ID             int64  `json:"id"`
+			Name           string `json:"name"`
+			URL            string `json:"url"`
+			DirectAssetURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
+
+// gitLabLicenses maps the license keys GitLab reports to SPDX identifiers
+var gitLabLicenses = map[string]string{
+	"mit":          "MIT",
+	"apache-2.0":   "Apache-2.0",
+	"gpl-2.0":      "GPL-2.0-only",
+	"gpl-3.0":      "GPL-3.0-only",
+	"agpl-3.0":     "AGPL-3.0-only",
+	"lgpl-2.1":     "LGPL-2.1-only",
+	"lgpl-3.0":     "LGPL-3.0-only",
+	"mpl-2.0":      "MPL-2.0",
+	"bsd-2-clause": "BSD-2-Clause",
+	"bsd-3-clause": "BSD-3-Clause",
+	"unlicense":    "Unlicense",
+}
+
+func (g *gitLabSource) get(ctx context.Context, path string, target interface{}) (err error) {
+	var header = http.Header{}
+	if g.token != "" {
+		header.Set("PRIVATE-TOKEN", g.token)
+	}
+
+	return getJSON(ctx, g.client, g.baseURL+"/api/v4/"+path, header, target)
+}
+
+func (g *gitLabSource) Details(ctx context.Context) (d RepoDetails, err error) {
+	var project gitLabProject
+
+	err = g.get(ctx, "projects/"+g.project+"?license=true", &project)
+	if err != nil {
+		return
+	}
+
+	d.Description = project.Description
+	if project.License != nil {
+		d.License = gitLabLicenses[strings.ToLower(project.License.Key)]
+	}
+
+	if project.PathWithNamespace != "" && !strings.EqualFold(url.PathEscape(project.PathWithNamespace), g.project) {
+		d.MovedTo = project.WebURL
+		g.project = url.PathEscape(project.PathWithNamespace)
+	}
+
+	return
+}
+
+func (g *gitLabSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	for page := 1; ; page++ {
+		var rels []gitLabRelease
+
+		err = g.get(ctx, "projects/"+g.project+"/releases?per_page=100&page="+strconv.Itoa(page), &rels)
+		if err != nil || len(rels) == 0 {
+			return
+		}
+
+		for _, rel := range rels {
+			r := Release{
+				TagName: rel.TagName,
+				Body:    rel.Description,
+				// GitLab has no notion of drafts; releases scheduled for the future are the closest match
+				Draft:       rel.UpcomingRelease,
+				PublishedAt: rel.ReleasedAt,
+			}
+
+			for _, link := range rel.Assets.Links {
+				u := link.DirectAssetURL
+				if u == "" {
+					u = link.URL
+				}
+
+				r.Assets = append(r.Assets, Asset{
+					ID:   link.ID,
+					Name: link.Name,
+					URL:  u,
+				})
+			}
+
+			releases = append(releases, r)
+		}
+	}
+}
+
+func (g *gitLabSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	var header = http.Header{}
+
+	// Only send the token to the GitLab instance itself, asset links may point anywhere
+	if g.token != "" && strings.HasPrefix(asset.URL, g.baseURL+"/") {
+		header.Set("PRIVATE-TOKEN", g.token)
+	}
+
+	return downloadURL(ctx, g.client, asset.URL, header, offset)
+}
@@ -0,0 +1,256 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// Release is a host-independent view of an upstream release
+type Release struct {
+	ID          int64
+	TagName     string
+	Body        string
+	Prerelease  bool
+	Draft       bool
+	PublishedAt time.Time
+
+	// VersionCode is the versionCode the APKs of the release must have, if the source knows it
+	VersionCode int64
+
+	Assets []Asset
+}
+
+// Asset is a downloadable file attached to a release
+type Asset struct {
+	ID   int64
+	Name string
+	Size int64
+	URL  string
+
+	// SHA256 is the hex digest of the content, if the host provides it
+	SHA256 string
+}
+
+// RepoDetails contains information about the upstream repository itself
+type RepoDetails struct {
+	Description string
+	License     string
+
+	// MovedTo is the URL of the repository if it was renamed or transferred, so the host redirected to it
+	MovedTo string
+}
+
+// Source is a place releases of an app can be scooped from
+type Source interface {
+	// Details returns information about the upstream repository
+	Details(ctx context.Context) (RepoDetails, error)
+
+	// ListReleases returns all releases, newest first
+	ListReleases(ctx context.Context) ([]Release, error)
+
+	// DownloadAsset opens a stream for the content of the given asset, starting at byte offset.
+	// start is the offset the stream actually starts at, it is 0 if the host ignored the range.
+	DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error)
+}
+
+// Options contains the clients and credentials used by sources
+type Options struct {
+	GitHub *github.Client
+
+	// GitHubBatch, if set, is used instead of REST requests for the repositories it contains
+	GitHubBatch *GitHubBatch
+
+	GitLabToken string
+	GiteaToken  string
+
+	HTTPClient *http.Client
+}
+
+func (o Options) httpClient() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+const (
+	KindGitHub = "github"
+	KindGitLab = "gitlab"
+	KindGitea  = "gitea"
+
+	// KindURL is for APKs published at a stable URL, see NewURL. It is never detected.
+	KindURL = "url"
+
+	// KindFDroid mirrors a package from another F-Droid repo, see NewFDroid. It is never detected.
+	KindFDroid = "fdroid"
+
+	// KindActions publishes the artifacts of a GitHub Actions workflow, see NewActions. It is never detected.
+	KindActions = "github-actions"
+)
+
+// DetectKind guesses the kind of source from the host of the repository URL.
+// Self-hosted instances must set the kind explicitly.
+func DetectKind(repoURL string) (kind string, err error) {
+	u, err := url.ParseRequestURI(repoURL)
+	if err != nil {
+		return
+	}
+
+	switch strings.TrimPrefix(strings.ToLower(u.Host), "www.") {
+	case "github.com":
+		return KindGitHub, nil
+	case "gitlab.com":
+		return KindGitLab, nil
+	case "codeberg.org":
+		return KindGitea, nil
+	}
+
+	return "", fmt.Errorf("cannot determine source type for host %q, please set it explicitly", u.Host)
+}
+
+// New returns the source of the given kind for the repository URL. If kind is empty, it is detected from the URL.
+func New(kind, repoURL string, opts Options) (s Source, err error) {
+	if kind == "" {
+		kind, err = DetectKind(repoURL)
+		if err != nil {
+			return
+		}
+	}
+
+	switch kind {
+	case KindGitHub:
+		return newGitHub(repoURL, opts)
+	case KindGitLab:
+		return newGitLab(repoURL, opts)
+	case KindGitea:
+		return newGitea(repoURL, opts)
+	case KindURL:
+		return nil, fmt.Errorf("the %q source needs the URL of the APK, use NewURL", kind)
+	case KindFDroid:
+		return nil, fmt.Errorf("the %q source needs the repo and package to mirror, use NewFDroid", kind)
+	case KindActions:
+		return nil, fmt.Errorf("the %q source needs the workflow, use NewActions", kind)
+	}
+
+	return nil, fmt.Errorf("unknown source type %q", kind)
+}
+
+// splitRepoURL returns the base URL (scheme and host) and the trimmed path of a repository URL
+func splitRepoURL(repoURL string) (base string, path string, err error) {
+	u, err := url.ParseRequestURI(repoURL)
+	if err != nil {
+		return
+	}
+
+	path = strings.TrimSuffix(strings.Trim(u.Path, "/"), ".git")
+	if strings.Count(path, "/") < 1 {
+		err = fmt.Errorf("repository URL %q must contain both owner and name", repoURL)
+		return
+	}
+
+	base = u.Scheme + "://" + u.Host
+
+	return
+}
+
+// openURL performs a GET request and returns the body if the server responded with 200 OK
+func openURL(ctx context.Context, client *http.Client, u string, header http.Header) (rc io.ReadCloser, err error) {
+	req, err := newRequest(ctx, u, header)
+	if err != nil {
+		return
+	}
+
+	rc, _, err = openRange(client, req, 0)
+	return
+}
+
+func newRequest(ctx context.Context, u string, header http.Header) (req *http.Request, err error) {
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return
+}
+
+// openRange performs req asking for the content from byte offset on. Servers that don't support ranges
+// respond with the whole content, in which case start is 0.
+func openRange(client *http.Client, req *http.Request, offset int64) (rc io.ReadCloser, start int64, err error) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+
+	return rangeResponse(client, resp, offset)
+}
+
+// rangeResponse checks the response to a request made by openRange
+func rangeResponse(client *http.Client, resp *http.Response, offset int64) (rc io.ReadCloser, start int64, err error) {
+	req := resp.Request
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, 0, nil
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			_ = resp.Body.Close()
+			return nil, 0, fmt.Errorf("GET %s: unexpected content range %q", req.URL.Path, resp.Header.Get("Content-Range"))
+		}
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file is at least as large as the content, which has likely changed
+		_ = resp.Body.Close()
+		req.Header.Del("Range")
+		return openRange(client, req, 0)
+	}
+
+	_ = resp.Body.Close()
+
+	err = fmt.Errorf("GET %s: unexpected status %s", req.URL.Path, resp.Status)
+	if isPermanentStatus(resp.StatusCode) {
+		err = retry.Permanent(err)
+	}
+	return
+}
+
+// downloadURL opens the asset at u from offset on
+func downloadURL(ctx context.Context, client *http.Client, u string, header http.Header, offset int64) (rc io.ReadCloser, start int64, err error) {
+	req, err := newRequest(ctx, u, header)
+	if err != nil {
+		return
+	}
+
+	return openRange(client, req, offset)
+}
+
+// getJSON decodes the JSON response of a GET request into target
+func getJSON(ctx context.Context, client *http.Client, u string, header http.Header, target interface{}) (err error) {
+	rc, err := openURL(ctx, client, u, header)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	return json.NewDecoder(rc).Decode(target)
+}
+
+// isPermanentStatus reports whether a request that returned status code is unlikely to succeed when retried
+func isPermanentStatus(code int) bool {
+	return code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests
+}
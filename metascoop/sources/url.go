@@ -0,0 +1,185 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// URLConfig describes where the url source finds the APK of an app
+type URLConfig struct {
+	// APK is the URL of the APK. It may contain "{version}", which is replaced by the detected version.
+	APK string
+
+	// VersionPage is fetched and searched with VersionRegex to find the current version, e.g. a download page
+	// or a JSON document. Without it, APK always points to the latest build, which is published as tag "latest".
+	VersionPage  string
+	VersionRegex *regexp.Regexp
+}
+
+// LatestTag is the tag of the release the url source reports if it cannot detect versions
+const LatestTag = "latest"
+
+// maxVersionPageSize limits how much of a version page is searched
+const maxVersionPageSize = 8 << 20
+
+// urlSource reports the APK at a fixed URL as the only release. Repository details come from the host of the
+// git URL, if it is known.
+type urlSource struct {
+	client *http.Client
+	config URLConfig
+
+	repo Source
+}
+
+// NewURL returns a source for apps that publish their APK at a stable URL instead of as release assets.
+// repoURL is only used for the repository details.
+func NewURL(repoURL string, config URLConfig, opts Options) (s Source, err error) {
+	if _, err = url.ParseRequestURI(config.APK); err != nil {
+		return nil, fmt.Errorf("invalid APK URL %q: %w", config.APK, err)
+	}
+	if strings.Contains(config.APK, "{version}") && config.VersionRegex == nil {
+		return nil, fmt.Errorf("APK URL %q contains {version}, but there is no version regex", config.APK)
+	}
+	if config.VersionRegex != nil && config.VersionPage == "" {
+		config.VersionPage = config.APK
+	}
+
+	u := &urlSource{
+		client: opts.httpClient(),
+		config: config,
+	}
+
+	if kind, kerr := DetectKind(repoURL); kerr == nil {
+		u.repo, _ = New(kind, repoURL, opts)
+	}
+
+	return u, nil
+}
+
+func (u *urlSource) Details(ctx context.Context) (d RepoDetails, err error) {
+	if u.repo == nil {
+		return
+	}
+	return u.repo.Details(ctx)
+}
+
+func (u *urlSource) ListReleases(ctx context.Context) (releases []Release, err error) {
+	tag := LatestTag
+
+	if u.config.VersionRegex != nil {
+		tag, err = u.detectVersion(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	apkURL := strings.ReplaceAll(u.config.APK, "{version}", url.PathEscape(tag))
+
+	asset, published, err := u.head(ctx, apkURL)
+	if err != nil {
+		return
+	}
+
+	return []Release{{
+		TagName:     tag,
+		PublishedAt: published,
+		Assets:      []Asset{asset},
+	}}, nil
+}
+
+// detectVersion returns the version the version regex finds on the version page
+func (u *urlSource) detectVersion(ctx context.Context) (version string, err error) {
+	rc, err := openURL(ctx, u.client, u.config.VersionPage, nil)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	page, err := io.ReadAll(io.LimitReader(rc, maxVersionPageSize))
+	if err != nil {
+		return
+	}
+
+	re := u.config.VersionRegex
+
+	match := re.FindSubmatch(page)
+	if match == nil {
+		return "", fmt.Errorf("version regex %q doesn't match %s", re.String(), u.config.VersionPage)
+	}
+
+	i := 1
+	if n := re.SubexpIndex("version"); n > 0 {
+		i = n
+	}
+	version = strings.TrimSpace(string(match[i]))
+	if version == "" {
+		return "", fmt.Errorf("version regex %q matches an empty version on %s", re.String(), u.config.VersionPage)
+	}
+
+	return
+}
+
+// head returns the asset at apkURL with the size the server reports. Servers that don't support HEAD
+// requests result in an asset of unknown size.
+func (u *urlSource) head(ctx context.Context, apkURL string) (asset Asset, published time.Time, err error) {
+	asset = Asset{
+		Name: assetName(apkURL),
+		URL:  apkURL,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, apkURL, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		// The final URL after redirects usually has the better name
+		if resp.Request != nil && resp.Request.URL != nil {
+			asset.Name = assetName(resp.Request.URL.String())
+		}
+		if resp.ContentLength > 0 {
+			asset.Size = resp.ContentLength
+		}
+		published, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		err = retry.Permanent(fmt.Errorf("HEAD %s: unexpected status %s", apkURL, resp.Status))
+	}
+
+	return
+}
+
+// assetName returns the file name of the URL. Asset filters only consider ".apk" files by default, so the
+// suffix is added if the URL doesn't have it, e.g. for download links with query parameters.
+func assetName(u string) string {
+	name := "app.apk"
+	if parsed, err := url.Parse(u); err == nil {
+		if base := path.Base(parsed.Path); base != "/" && base != "." {
+			name = base
+		}
+	}
+
+	if !strings.HasSuffix(strings.ToLower(name), ".apk") {
+		name += ".apk"
+	}
+	return name
+}
+
+func (u *urlSource) DownloadAsset(ctx context.Context, asset Asset, offset int64) (rc io.ReadCloser, start int64, err error) {
+	return downloadURL(ctx, u.client, asset.URL, nil, offset)
+}
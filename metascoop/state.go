@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/git"
+	"github.com/nymtech/fdroid/metascoop/pkg/scoop"
+)
+
+// runState is what a run remembers about each app for the next one, so unchanged apps are processed without
+// network access for their assets and metadata: the releases that were processed with the assets that were rejected,
+// and the upstream commit the metadata was last taken from. It's kept next to the repo directory and committed with
+// it. The digests of published assets are in the digest cache. All methods are safe for concurrent use.
+type runState struct {
+	path string
+	lock sync.Mutex
+
+	Apps map[string]*appState `json:"apps"`
+
+	// Processed is when runs with a budget last processed each app, the apps they deferred aren't updated. Apps
+	// are processed stalest first in those runs, see stalestFirst.
+	Processed map[string]time.Time `json:"processed,omitempty"`
+}
+
+type appState struct {
+	// Config is a hash of the apps.yaml entry and the flags that decide which assets are accepted. Everything
+	// remembered about the app is forgotten when it changes, e.g. after a wrong signer was corrected.
+	Config string `json:"config"`
+
+	// Releases are keyed by tag
+	Releases map[string]*releaseState `json:"releases,omitempty"`
+
+	Metadata *metadataState `json:"metadata,omitempty"`
+
+	// License is the license the upstream repo declared when it was last accepted. Unlike the rest, it's kept when
+	// the configuration changes.
+	License string `json:"license,omitempty"`
+}
+
+type releaseState struct {
+	ID int64 `json:"id,omitempty"`
+
+	// Rejected are the assets whose download failed verification, keyed by asset name
+	Rejected map[string]rejectedAsset `json:"rejected,omitempty"`
+}
+
+// rejectedAsset is an asset that isn't downloaded again as long as the host reports the same ID, size and digest
+type rejectedAsset struct {
+	ID     int64  `json:"id,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// metadataState describes the source of the metadata that was last copied from the upstream repo
+type metadataState struct {
+	URL    string `json:"url"`
+	Ref    string `json:"ref,omitempty"`
+	Commit string `json:"commit"`
+
+	// Versions are the versionCodes of the package in the repo, new ones need their changelogs
+	Versions string `json:"versions"`
+}
+
+// loadState reads the state file at path. A missing file results in an empty state.
+func loadState(path string) (s *runState, err error) {
+	s = &runState{path: path, Apps: make(map[string]*appState)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, s)
+	if s.Apps == nil {
+		s.Apps = make(map[string]*appState)
+	}
+
+	return
+}
+
+// configHash returns the hash that identifies the configuration of app together with the global settings
+func configHash(app apps.AppInfo, settings string) string {
+	// The fields about the release being processed are only set later
+	app.ReleaseTag, app.ReleaseDescription, app.ReleasePrerelease, app.ReleaseVersionCode = "", "", false, 0
+
+	data, err := yaml.Marshal(app)
+	if err != nil {
+		data = []byte(fmt.Sprintf("%#v", app))
+	}
+
+	sum := sha256.Sum256(append(append(data, 0), settings...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// app returns the state of the app, which is reset if its configuration changed. The caller must hold the lock.
+func (s *runState) app(name, config string) *appState {
+	a, ok := s.Apps[name]
+	if !ok || a.Config != config {
+		var license string
+		if ok {
+			license = a.License
+		}
+		a = &appState{Config: config, License: license}
+		s.Apps[name] = a
+	}
+	return a
+}
+
+// license returns the upstream license that was last accepted for the app, if any
+func (s *runState) license(name string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if a, ok := s.Apps[name]; ok {
+		return a.License
+	}
+	return ""
+}
+
+// acceptLicense remembers the upstream license of the app, changes are compared with it in the next runs
+func (s *runState) acceptLicense(name, config, license string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.app(name, config).License = license
+}
+
+// forget drops the state of apps that are no longer in the apps file
+func (s *runState) forget(appsList []apps.AppInfo) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known := make(map[string]bool, len(appsList))
+	for _, app := range appsList {
+		known[app.Name()] = true
+	}
+	for name := range s.Apps {
+		if !known[name] {
+			delete(s.Apps, name)
+		}
+	}
+	for name := range s.Processed {
+		if !known[name] {
+			delete(s.Processed, name)
+		}
+	}
+}
+
+// processedAt returns when a run with a budget last processed the app, zero if none did
+func (s *runState) processedAt(name string) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.Processed[name]
+}
+
+// processed remembers that the app was processed at t
+func (s *runState) processed(name string, t time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.Processed == nil {
+		s.Processed = make(map[string]time.Time)
+	}
+	s.Processed[name] = t.UTC().Truncate(time.Second)
+}
+
+// processReleases remembers which releases of the app are current and forgets the state of those that are gone
+// or were published again with another ID
+func (s *runState) processReleases(name, config string, releases []scoop.Release) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a := s.app(name, config)
+
+	current := make(map[string]*releaseState, len(releases))
+	for _, r := range releases {
+		if r.TagName == "" {
+			continue
+		}
+		rs, ok := a.Releases[r.TagName]
+		if !ok || rs.ID != r.ID {
+			rs = &releaseState{ID: r.ID}
+		}
+		current[r.TagName] = rs
+	}
+	a.Releases = current
+}
+
+// rejection returns why the asset of the release was rejected by an earlier run, if it was and hasn't changed since
+func (s *runState) rejection(name, config, tag string, asset scoop.Asset) (reason string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, known := s.Apps[name]
+	if !known || a.Config != config || a.Releases[tag] == nil {
+		return
+	}
+
+	r, ok := a.Releases[tag].Rejected[asset.Name]
+	if !ok || r.ID != asset.ID || r.Size != asset.Size || !strings.EqualFold(r.SHA256, asset.SHA256) {
+		return "", false
+	}
+	return r.Reason, true
+}
+
+// reject remembers that the asset of the release was rejected, so it isn't downloaded again
+func (s *runState) reject(name, config, tag string, asset scoop.Asset, reason error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a := s.app(name, config)
+	if a.Releases == nil {
+		a.Releases = make(map[string]*releaseState)
+	}
+	rs := a.Releases[tag]
+	if rs == nil {
+		rs = &releaseState{}
+		a.Releases[tag] = rs
+	}
+	if rs.Rejected == nil {
+		rs.Rejected = make(map[string]rejectedAsset)
+	}
+
+	rs.Rejected[asset.Name] = rejectedAsset{
+		ID:     asset.ID,
+		Size:   asset.Size,
+		SHA256: asset.SHA256,
+		Reason: reason.Error(),
+	}
+}
+
+// packageVersions returns the versionCodes of pkgs in a stable format for metadataState.Versions
+func packageVersions(pkgs []apps.PackageInfo) string {
+	codes := make([]int, 0, len(pkgs))
+	for _, p := range pkgs {
+		codes = append(codes, p.VersionCode)
+	}
+	sort.Ints(codes)
+
+	var b strings.Builder
+	for i, c := range codes {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprint(&b, c)
+	}
+	return b.String()
+}
+
+// metadataCommit returns the upstream commit the metadata of the app was last copied from, if it was copied from
+// target while the package had the same versions in the repo
+func (s *runState) metadataCommit(name, config string, target git.Target, versions string) (commit string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	a, known := s.Apps[name]
+	if !known || a.Config != config || a.Metadata == nil {
+		return
+	}
+	m := a.Metadata
+	if m.URL != target.URL || m.Ref != target.Ref || m.Versions != versions {
+		return
+	}
+	return m.Commit, true
+}
+
+// copiedMetadata remembers that the metadata of the app was copied from commit of target
+func (s *runState) copiedMetadata(name, config string, target git.Target, commit, versions string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.app(name, config).Metadata = &metadataState{
+		URL:      target.URL,
+		Ref:      target.Ref,
+		Commit:   commit,
+		Versions: versions,
+	}
+}
+
+func (s *runState) save() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// targetsConfig is the content of the file given to "metascoop targets"
+type targetsConfig struct {
+	Targets []*target `yaml:"targets"`
+}
+
+// target is one repo the apps file is published into, e.g. a "stable" and a "nightly" one
+type target struct {
+	Name string `yaml:"name"`
+
+	// RepoDir is the fdroid "repo" directory of the target, like -rd
+	RepoDir string `yaml:"repo"`
+
+	// Channel overrides the channel of all apps in this target, e.g. "all" for a nightly repo. The channels from the
+	// apps file are used if it's empty.
+	Channel string `yaml:"channel"`
+
+	// Apps are the names of the apps published in this target, all by default. Exclude removes apps from them.
+	// Apps that are left out are not touched, their versions stay in the repo if they were published before.
+	Apps    []string `yaml:"apps"`
+	Exclude []string `yaml:"exclude"`
+
+	// README is passed as -readme, so targets without their own README can set it to "-"
+	README string `yaml:"readme"`
+
+	// Args are more flags for the update of this target, they override the common ones
+	Args []string `yaml:"args"`
+}
+
+// loadTargets reads the targets file at path and checks it against the apps file
+func loadTargets(path string, appsList []apps.AppInfo) (c targetsConfig, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	err = dec.Decode(&c)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+	if len(c.Targets) == 0 {
+		return c, fmt.Errorf("no targets defined")
+	}
+
+	names := make(map[string]bool)
+	repoDirs := make(map[string]string)
+	for i, t := range c.Targets {
+		if t.Name == "" {
+			return c, fmt.Errorf("target %d has no name", i+1)
+		}
+		if names[t.Name] {
+			return c, fmt.Errorf("there are several targets called %q, give them distinct names", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.RepoDir == "" {
+			return c, fmt.Errorf("target %q has no repo directory", t.Name)
+		}
+		if other, ok := repoDirs[t.RepoDir]; ok {
+			return c, fmt.Errorf("targets %q and %q have the same repo directory %q", other, t.Name, t.RepoDir)
+		}
+		repoDirs[t.RepoDir] = t.Name
+
+		err = checkChannel(t.Channel)
+		if err != nil {
+			return c, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+
+		_, err = selectApps(appsList, append(append([]string{}, t.Apps...), t.Exclude...))
+		if err != nil {
+			return c, fmt.Errorf("target %q: %w", t.Name, err)
+		}
+	}
+
+	return
+}
+
+// checkChannel returns an error if channel isn't empty or one of the apps.Channel* constants
+func checkChannel(channel string) error {
+	switch channel {
+	case "", apps.ChannelStable, apps.ChannelBeta, apps.ChannelAll:
+		return nil
+	}
+	return fmt.Errorf("unknown channel %q, must be %q, %q or %q", channel, apps.ChannelStable, apps.ChannelBeta, apps.ChannelAll)
+}
+
+// selection returns the names of the apps that are published in the target, or nil if all of them are
+func (t *target) selection(appsList []apps.AppInfo) (names []string) {
+	if len(t.Apps) == 0 && len(t.Exclude) == 0 {
+		return nil
+	}
+
+	excluded := make(map[string]bool, len(t.Exclude))
+	for _, name := range t.Exclude {
+		excluded[name] = true
+	}
+
+	included := t.Apps
+	if len(included) == 0 {
+		for _, app := range appsList {
+			included = append(included, app.Name())
+		}
+	}
+	for _, name := range included {
+		if !excluded[name] {
+			names = append(names, name)
+		}
+	}
+
+	return
+}
+
+// args returns the flags of the update of the target. "{target}" in the common flags is replaced with the name of
+// the target, so e.g. "-report=report-{target}.json" gives every target its own report.
+func (t *target) args(appsFile string, appsList []apps.AppInfo, common []string) (args []string) {
+	args = []string{"-ap=" + appsFile, "-rd=" + t.RepoDir}
+	if t.Channel != "" {
+		args = append(args, "-channel="+t.Channel)
+	}
+	if t.README != "" {
+		args = append(args, "-readme="+t.README)
+	}
+
+	names := t.selection(appsList)
+	for _, name := range names {
+		args = append(args, "-app="+name)
+	}
+
+	for _, arg := range common {
+		args = append(args, strings.ReplaceAll(arg, "{target}", t.Name))
+	}
+	return append(args, t.Args...)
+}
+
+// noAppsSelected is true if the target excludes all apps, so there is nothing to update
+func (t *target) noAppsSelected(appsList []apps.AppInfo) bool {
+	return (len(t.Apps) > 0 || len(t.Exclude) > 0) && len(t.selection(appsList)) == 0
+}
+
+// combineExitCodes returns the exit code of a run of several targets: 1 if one of them failed, 0 if one of them
+// changed its repo and 2 if none did
+func combineExitCodes(codes []int) int {
+	combined := 2
+	for _, code := range codes {
+		switch code {
+		case 0:
+			if combined == 2 {
+				combined = 0
+			}
+		case 2:
+		default:
+			combined = 1
+		}
+	}
+	return combined
+}
+
+// updateTargets publishes one apps file into several repos, e.g. a "stable" and a "nightly" one, by running an
+// update for each target in the targets file. Flags after the subcommand flags are passed to all updates.
+// The exit code follows the one of updates: 0 if a repo changed, 2 if none did and 1 if an update failed.
+func updateTargets(args []string) {
+	flags := flag.NewFlagSet("targets", flag.ExitOnError)
+	var (
+		configPath   = flags.String("config", "targets.yaml", "YAML file with the target repos, see targetsConfig")
+		appsFilePath = flags.String("ap", "apps.yaml", "Path to apps.yaml file")
+		only         = flags.String("target", "", "Only update the target with this name")
+
+		logLevel  = flags.String("log-level", "info", "Minimum level of logged messages: debug, info, warn or error")
+		logFormat = flags.String("log-format", "text", "Format of log messages: \"text\" or \"json\"")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s targets [flags] [-- update flags]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	err := setupLogging(*logLevel, *logFormat)
+	if err != nil {
+		fatal("Setting up logging failed", "error", err)
+	}
+
+	appsList, err := apps.ParseAppFile(*appsFilePath)
+	if err != nil {
+		fatal("Parsing app file failed", "path", *appsFilePath, "error", err)
+	}
+
+	config, err := loadTargets(*configPath, appsList)
+	if err != nil {
+		fatal("Reading targets failed", "path", *configPath, "error", err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		fatal("Finding metascoop executable failed", "error", err)
+	}
+
+	var codes []int
+	var found bool
+	for _, t := range config.Targets {
+		if *only != "" && t.Name != *only {
+			continue
+		}
+		found = true
+
+		if t.noAppsSelected(appsList) {
+			slog.Info("Skipping target without apps", "target", t.Name)
+			codes = append(codes, 2)
+			continue
+		}
+
+		slog.Info("Updating target", "target", t.Name, "repo", t.RepoDir, "channel", t.Channel)
+
+		cmd := exec.Command(self, t.args(*appsFilePath, appsList, flags.Args())...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+		code := 0
+		err = cmd.Run()
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			code = exitErr.ExitCode()
+		case err != nil:
+			slog.Error("Running update failed", "target", t.Name, "error", err)
+			code = 1
+		}
+		codes = append(codes, code)
+
+		slog.Info("Updated target", "target", t.Name, "exit_code", code)
+	}
+	if !found {
+		fatal("There is no target with this name", "target", *only)
+	}
+
+	os.Exit(combineExitCodes(codes))
+}
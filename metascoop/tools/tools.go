@@ -0,0 +1,91 @@
+// Package tools finds the external programs metascoop runs, like git, fdroid, gpg and rsync, on Linux, macOS and
+// Windows runners. A program is looked up in $PATH and then in the directories it's usually installed in on the
+// platform, e.g. Git for Windows or Homebrew, which aren't always in $PATH of services and CI steps.
+// $METASCOOP_<NAME>_PATH, e.g. $METASCOOP_GIT_PATH, sets the program explicitly.
+package tools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is wrapped by the errors for programs that aren't installed
+var ErrNotFound = errors.New("not found")
+
+var (
+	lock  sync.Mutex
+	found = make(map[string]string)
+)
+
+// EnvVar returns the environment variable that sets the path of the program called name
+func EnvVar(name string) string {
+	return "METASCOOP_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_PATH"
+}
+
+// Path returns the path of the program called name. The error wraps ErrNotFound if it isn't installed.
+func Path(name string) (path string, err error) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if path, ok := found[name]; ok {
+		return path, nil
+	}
+
+	if path = os.Getenv(EnvVar(name)); path != "" {
+		if _, err = os.Stat(path); err != nil {
+			return "", fmt.Errorf("%s from $%s: %w", name, EnvVar(name), err)
+		}
+	} else if path, err = exec.LookPath(name); err != nil {
+		path = ""
+		for _, dir := range searchDirs(name) {
+			if p, perr := exec.LookPath(filepath.Join(dir, name)); perr == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			return "", fmt.Errorf("%s: %w in $PATH, install it or set $%s", name, ErrNotFound, EnvVar(name))
+		}
+	}
+
+	found[name] = path
+	return path, nil
+}
+
+// Available reports whether the program called name is installed
+func Available(name string) bool {
+	_, err := Path(name)
+	return err == nil
+}
+
+// Command is exec.Command for the program called name. If it isn't installed, running the command fails with the
+// error of Path.
+func Command(name string, args ...string) *exec.Cmd {
+	return CommandContext(context.Background(), name, args...)
+}
+
+// CommandContext is exec.CommandContext for the program called name, see Command
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	path, err := Path(name)
+	if err != nil {
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Err = err
+		return cmd
+	}
+	return exec.CommandContext(ctx, path, args...)
+}
+
+// Shell returns the command that runs command in the shell of the platform, "sh -c" where there is one. Commands
+// that come from the configuration, like hooks, use it.
+func Shell(ctx context.Context, command string) *exec.Cmd {
+	if Available("sh") {
+		return CommandContext(ctx, "sh", "-c", command)
+	}
+	return fallbackShell(ctx, command)
+}
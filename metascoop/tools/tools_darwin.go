@@ -0,0 +1,24 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// searchDirs returns where Homebrew, MacPorts and "pip install --user" install programs, they aren't in $PATH of
+// launchd services
+func searchDirs(name string) (dirs []string) {
+	dirs = []string{"/opt/homebrew/bin", "/usr/local/bin", "/opt/local/bin"}
+	if home, err := os.UserHomeDir(); err == nil {
+		pythonDirs, _ := filepath.Glob(filepath.Join(home, "Library", "Python", "*", "bin"))
+		dirs = append(dirs, pythonDirs...)
+	}
+	return
+}
+
+// fallbackShell is only used if there's no sh, which macOS always has
+func fallbackShell(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package tools
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// searchDirs returns where programs are installed that aren't in $PATH of services, e.g. fdroidserver with
+// "pip install --user"
+func searchDirs(name string) (dirs []string) {
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".local", "bin"))
+	}
+	return append(dirs, "/usr/local/bin", "/usr/bin", "/bin", "/snap/bin")
+}
+
+// fallbackShell is only used if there's no sh in $PATH
+func fallbackShell(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
@@ -0,0 +1,37 @@
+package tools
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// searchDirs returns where Git for Windows installs git and its shell, fdroidserver and the others are expected
+// in $PATH
+func searchDirs(name string) (dirs []string) {
+	for _, env := range []string{"ProgramFiles", "ProgramW6432", "LocalAppData"} {
+		root := os.Getenv(env)
+		if root == "" {
+			continue
+		}
+		if env == "LocalAppData" {
+			root = filepath.Join(root, "Programs")
+		}
+		dirs = append(dirs, filepath.Join(root, "Git", "cmd"), filepath.Join(root, "Git", "bin"), filepath.Join(root, "Git", "usr", "bin"))
+	}
+	return
+}
+
+// fallbackShell runs command with cmd.exe if there's no sh. The command line is set as it is, cmd.exe doesn't
+// parse it like other programs, so it can't be quoted as arguments.
+func fallbackShell(ctx context.Context, command string) *exec.Cmd {
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+	cmd := exec.CommandContext(ctx, shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `"` + shell + `" /d /s /c "` + command + `"`}
+	return cmd
+}
@@ -0,0 +1,85 @@
+package trackers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// Cache remembers the trackers found in APKs by their SHA-256, so published APKs aren't scanned again in every
+// run. It's emptied when the signatures change. All methods are safe for concurrent use.
+type Cache struct {
+	path string
+
+	lock sync.Mutex
+
+	// Signatures is the fingerprint of the list the results were found with
+	Signatures string `json:"signatures"`
+
+	// Results maps the SHA-256 of APKs to the names of the trackers in them
+	Results map[string][]string `json:"results"`
+}
+
+// LoadCache reads the cache file at path for results of the list. A missing file results in an empty cache.
+func LoadCache(path string, l List) (c *Cache, err error) {
+	c = &Cache{path: path, Signatures: l.fingerprint, Results: make(map[string][]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return
+	}
+
+	var old Cache
+	err = json.Unmarshal(data, &old)
+	if err != nil {
+		return
+	}
+	if old.Signatures == l.fingerprint && old.Results != nil {
+		c.Results = old.Results
+	}
+
+	return
+}
+
+// Get returns the trackers found in the APK with the given SHA-256
+func (c *Cache) Get(sha256 string) (found []string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	found, ok = c.Results[sha256]
+	return
+}
+
+// Put stores the trackers found in the APK with the given SHA-256
+func (c *Cache) Put(sha256 string, found []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if found == nil {
+		found = []string{}
+	}
+	c.Results[sha256] = found
+}
+
+// Save writes the cache back to its file
+func (c *Cache) Save() (err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return
+	}
+
+	tmpPath := c.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(data, '\n'), 0o644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmpPath, c.path)
+}
@@ -0,0 +1,119 @@
+// Package trackers finds tracking libraries in APKs by matching the names of their classes against
+// signatures in the format of the Exodus Privacy tracker list
+package trackers
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+)
+
+// Signature identifies a tracker by the classes it consists of
+type Signature struct {
+	Name string
+
+	// Code matches the dotted names of the tracker's classes, e.g. "com.example.analytics."
+	Code *regexp.Regexp
+}
+
+// List is a list of tracker signatures
+type List struct {
+	Signatures []Signature
+
+	// fingerprint changes whenever the signatures do, so cached results can be invalidated
+	fingerprint string
+}
+
+//go:embed signatures.json
+var defaultSignatures []byte
+
+// exodusList is the format of https://reports.exodus-privacy.eu.org/api/trackers
+type exodusList struct {
+	Trackers map[string]struct {
+		Name          string `json:"name"`
+		CodeSignature string `json:"code_signature"`
+	} `json:"trackers"`
+}
+
+// Default returns the built-in list of common trackers
+func Default() List {
+	l, err := Parse(defaultSignatures)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in tracker signatures: %v", err))
+	}
+	return l
+}
+
+// Load reads a list in the Exodus format from path, e.g. an export of their API
+func Load(path string) (l List, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return Parse(data)
+}
+
+// Parse parses a list in the Exodus format. Trackers without a code signature are ignored.
+func Parse(data []byte) (l List, err error) {
+	var list exodusList
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return
+	}
+
+	for id, t := range list.Trackers {
+		if t.CodeSignature == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(t.CodeSignature)
+		if err != nil {
+			return l, fmt.Errorf("invalid code signature of tracker %s (%q): %w", id, t.Name, err)
+		}
+		l.Signatures = append(l.Signatures, Signature{Name: t.Name, Code: re})
+	}
+
+	// Map order is random, but the fingerprint must not be
+	sort.Slice(l.Signatures, func(i, j int) bool {
+		return l.Signatures[i].Name < l.Signatures[j].Name
+	})
+
+	h := sha256.New()
+	for _, s := range l.Signatures {
+		fmt.Fprintf(h, "%s\x00%s\x00", s.Name, s.Code.String())
+	}
+	l.fingerprint = hex.EncodeToString(h.Sum(nil))
+
+	return
+}
+
+// Match returns the sorted names of the trackers some of the classes belong to
+func (l List) Match(classes []string) (found []string) {
+	for _, s := range l.Signatures {
+		for _, c := range classes {
+			if s.Code.MatchString(c) {
+				found = append(found, s.Name)
+				break
+			}
+		}
+	}
+
+	sort.Strings(found)
+	return
+}
+
+// Scan returns the sorted names of the trackers in the APK at path
+func (l List) Scan(path string) (found []string, err error) {
+	classes, err := apk.ClassNames(path)
+	if err != nil {
+		return
+	}
+	return l.Match(classes), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/download"
+	"github.com/nymtech/fdroid/metascoop/trackers"
+)
+
+// trackerScanner applies the tracker policy of apps to their APKs
+type trackerScanner struct {
+	defaultPolicy string
+	signatures    trackers.List
+	cache         *trackers.Cache
+	digests       *download.Digests
+}
+
+func newTrackerScanner(defaultPolicy, signaturesPath, cachePath string, digests *download.Digests) (s *trackerScanner, err error) {
+	switch defaultPolicy {
+	case apps.TrackerPolicyIgnore, apps.TrackerPolicyFlag, apps.TrackerPolicyBlock:
+	default:
+		return nil, fmt.Errorf("unknown tracker policy %q, must be %q, %q or %q", defaultPolicy, apps.TrackerPolicyIgnore, apps.TrackerPolicyFlag, apps.TrackerPolicyBlock)
+	}
+
+	s = &trackerScanner{defaultPolicy: defaultPolicy, digests: digests}
+
+	if signaturesPath != "" {
+		s.signatures, err = trackers.Load(signaturesPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading tracker signatures from %q: %w", signaturesPath, err)
+		}
+	} else {
+		s.signatures = trackers.Default()
+	}
+
+	s.cache, err = trackers.LoadCache(cachePath, s.signatures)
+	if err != nil {
+		return nil, fmt.Errorf("reading tracker cache: %w", err)
+	}
+
+	return
+}
+
+func (s *trackerScanner) policy(app apps.AppInfo) string {
+	if app.TrackerPolicy != "" {
+		return app.TrackerPolicy
+	}
+	return s.defaultPolicy
+}
+
+// scan returns the sorted trackers in the APK at path that aren't allowed for app. APKs the policy of app
+// ignores aren't scanned.
+func (s *trackerScanner) scan(path string, app apps.AppInfo) (found []string, err error) {
+	if s.policy(app) == apps.TrackerPolicyIgnore {
+		return
+	}
+
+	digest, err := s.digests.File(path)
+	if err != nil {
+		return
+	}
+
+	all, ok := s.cache.Get(digest.SHA256)
+	if !ok {
+		all, err = s.signatures.Scan(path)
+		if err != nil {
+			return nil, fmt.Errorf("scanning %q for trackers: %w", path, err)
+		}
+		s.cache.Put(digest.SHA256, all)
+	}
+
+	for _, t := range all {
+		allowed := false
+		for _, a := range app.AllowedTrackers {
+			if strings.EqualFold(t, a) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			found = append(found, t)
+		}
+	}
+
+	return
+}
+
+// verify rejects the downloaded APK at path if it contains trackers and the policy of app blocks them
+func (s *trackerScanner) verify(path string, app apps.AppInfo) (err error) {
+	found, err := s.scan(path, app)
+	if err != nil || len(found) == 0 {
+		return
+	}
+
+	if s.policy(app) == apps.TrackerPolicyBlock {
+		return fmt.Errorf("APK contains trackers, which tracker_policy %q doesn't allow: %s", apps.TrackerPolicyBlock, strings.Join(found, ", "))
+	}
+	return
+}
+
+// antiFeatures returns the anti-features the trackers in the APK at path add to its version
+func (s *trackerScanner) antiFeatures(path string, app apps.AppInfo) (afs []string, found []string, err error) {
+	if s.policy(app) != apps.TrackerPolicyFlag {
+		return
+	}
+
+	found, err = s.scan(path, app)
+	if err != nil || len(found) == 0 {
+		return
+	}
+
+	return []string{"Tracking"}, found, nil
+}
+
+// mergeAntiFeatures returns the sorted union of both lists
+func mergeAntiFeatures(a, b []string) (list []string) {
+	seen := make(map[string]bool)
+	for _, af := range append(append([]string{}, a...), b...) {
+		if !seen[af] {
+			seen[af] = true
+			list = append(list, af)
+		}
+	}
+	sort.Strings(list)
+	return
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/nymtech/fdroid/metascoop/apk"
+	"github.com/nymtech/fdroid/metascoop/apps"
+)
+
+// verifyDownload runs all checks on a freshly downloaded APK before it is added to the repo.
+// minTargetSDK is the global default for the lowest accepted targetSdkVersion, maxSize the largest accepted
+// size of the app's APKs or zero.
+func verifyDownload(path string, app apps.AppInfo, abi string, minTargetSDK int, maxSize int64) (err error) {
+	err = verifySize(path, maxSize)
+	if err != nil {
+		return
+	}
+
+	err = verifyABI(path, abi)
+	if err != nil {
+		return
+	}
+
+	logger := slog.With("app", app.Name())
+
+	// The tag was matched during discovery already
+	version, _ := app.TagVersion(app.ReleaseTag)
+
+	err = verifyManifest(logger, path, app.PackageName, version, app.ReleaseVersionCode, app.RequiredTargetSDK(minTargetSDK))
+	if err != nil {
+		return
+	}
+
+	return verifySigner(logger, path, app.Signer)
+}
+
+// verifySize checks that the APK at path isn't larger than maxSize, if it's set. The download is already limited,
+// but not APKs that were built from a bundle.
+func verifySize(path string, maxSize int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && info.Size() > maxSize {
+		return fmt.Errorf("APK has %s, more than the maximum APK size of %s. Set max_apk_size in apps.yaml if it's expected", formatBytes(info.Size()), formatBytes(maxSize))
+	}
+	return nil
+}
+
+// verifySigner checks the v2/v3 signature of the APK at path. If expected is not empty,
+// one of the signing certificates must have that SHA-256 fingerprint.
+func verifySigner(logger *slog.Logger, path, expected string) error {
+	signers, err := apk.Verify(path)
+	if errors.Is(err, apk.ErrNoSignature) && expected == "" {
+		logger.Warn("APK has no v2/v3 signature, cannot verify its signer", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("verifying APK signature: %w", err)
+	}
+
+	var fingerprints []string
+	for _, s := range signers {
+		fingerprints = append(fingerprints, s.CertSHA256)
+	}
+
+	if expected == "" {
+		logger.Warn("APK signer isn't pinned, set \"signer\" in apps.yaml", "path", path, "signers", fingerprints)
+		return nil
+	}
+
+	for _, fp := range fingerprints {
+		if fp == apk.NormalizeFingerprint(expected) {
+			logger.Info("APK is signed by the expected certificate", "path", path, "signer", fp)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("APK is signed by %q, but apps.yaml expects %q. The upstream signing key might have been changed or compromised", fingerprints, expected)
+}
+
+// verifyManifest parses the manifest of the APK at path. If expectedPackage, expectedVersion or expectedCode are not
+// empty, the APK must have that package name, versionName and versionCode. If minTargetSDK is not zero, the APK must
+// target at least that API level.
+func verifyManifest(logger *slog.Logger, path, expectedPackage, expectedVersion string, expectedCode int64, minTargetSDK int) error {
+	m, err := apk.ReadManifest(path)
+	if err != nil {
+		return fmt.Errorf("reading APK manifest: %w", err)
+	}
+
+	logger.Info("Read APK manifest", "path", path, "package", m.Package, "version", m.VersionName, "version_code", m.VersionCode,
+		"min_sdk", m.MinSdkVersion, "target_sdk", m.TargetSdkVersion, "permissions", len(m.Permissions))
+
+	if m.VersionCode <= 0 {
+		return fmt.Errorf("APK has invalid versionCode %d", m.VersionCode)
+	}
+
+	if expectedPackage != "" && m.Package != expectedPackage {
+		return fmt.Errorf("APK has package name %q, but apps.yaml expects %q", m.Package, expectedPackage)
+	}
+
+	if expectedVersion != "" && m.VersionName != expectedVersion {
+		return fmt.Errorf("APK has versionName %q, but its tag indicates %q according to tag_pattern", m.VersionName, expectedVersion)
+	}
+
+	if expectedCode != 0 && m.VersionCode != expectedCode {
+		return fmt.Errorf("APK has versionCode %d, but the source derives %d from its build, see version_code in apps.yaml", m.VersionCode, expectedCode)
+	}
+
+	// Without targetSdkVersion, Android assumes the minSdkVersion
+	target := m.TargetSdkVersion
+	if target == 0 {
+		target = m.MinSdkVersion
+	}
+	if minTargetSDK > 0 && target < minTargetSDK {
+		return fmt.Errorf("APK targets API level %d, but at least %d is required. Set min_target_sdk in apps.yaml to exempt the app", target, minTargetSDK)
+	}
+
+	return nil
+}
+
+// verifyVersionCode makes sure the APK at path doesn't reuse the versionCode of another published APK of its package,
+// e.g. because upstream moved a tag, and, if it's from the newest release, that it is newer than everything published.
+// Clients wouldn't offer it as an update otherwise. apkName is the name of the APK in the repo, which may replace
+// a published file with the same name.
+func verifyVersionCode(path string, index *apps.RepoIndex, apkName string, newest bool) error {
+	m, err := apk.ReadManifest(path)
+	if err != nil {
+		return fmt.Errorf("reading APK manifest: %w", err)
+	}
+
+	abis, err := apk.NativeCode(path)
+	if err != nil {
+		return fmt.Errorf("reading native code of APK: %w", err)
+	}
+
+	var highest int
+	for _, p := range index.Packages[m.Package] {
+		if p.ApkName == apkName {
+			continue
+		}
+		if p.VersionCode > highest {
+			highest = p.VersionCode
+		}
+
+		if int64(p.VersionCode) == m.VersionCode && !canShareVersionCode(p.Nativecode, abis) {
+			return fmt.Errorf("versionCode %d is already published by %q, upstream might have re-tagged a release. Use -allow-downgrade to accept it anyway", m.VersionCode, p.ApkName)
+		}
+	}
+
+	if newest && m.VersionCode < int64(highest) {
+		return fmt.Errorf("the newest release has versionCode %d, but %d is already published, so clients wouldn't see it as an update. Use -allow-downgrade to accept it anyway", m.VersionCode, highest)
+	}
+
+	return nil
+}
+
+// canShareVersionCode reports whether two APKs with the given native code may have the same versionCode. ABI splits
+// may if they are for different ABIs, and so may a universal APK with native code for several ABIs and a split,
+// as the universal APK is published for the devices that no split is for.
+func canShareVersionCode(a, b []string) bool {
+	if len(a) > 0 && len(b) > 0 && (len(a) == 1) != (len(b) == 1) {
+		return true
+	}
+	return !sharesABI(a, b)
+}
+
+// sharesABI reports whether two APKs with the given native code can be installed on the same device.
+// APKs without native code run everywhere.
+func sharesABI(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyABI makes sure the APK at path contains native code for abi. If abi is empty, nothing is checked.
+func verifyABI(path, abi string) error {
+	if abi == "" {
+		return nil
+	}
+
+	abis, err := apk.NativeCode(path)
+	if err != nil {
+		return fmt.Errorf("reading native code of APK: %w", err)
+	}
+
+	for _, a := range abis {
+		if a == abi {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the asset name indicates the ABI %q, but the APK contains native code for %q", abi, abis)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nymtech/fdroid/metascoop/e2e"
+)
+
+func TestVerifySigner(t *testing.T) {
+	signer, err := e2e.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := e2e.NewSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writeAPK := func(name string, s *e2e.Signer) string {
+		data, err := e2e.BuildAPK(e2e.Manifest{Package: "com.example.clock", VersionCode: 20, VersionName: "2.0.0"}, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		err = os.WriteFile(path, data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	signed, unsigned := writeAPK("signed.apk", signer), writeAPK("unsigned.apk", nil)
+
+	// The fingerprint as keytool prints it
+	var pairs []string
+	for fp := strings.ToUpper(signer.Fingerprint()); fp != ""; fp = fp[2:] {
+		pairs = append(pairs, fp[:2])
+	}
+	formatted := strings.Join(pairs, ":")
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+		wantErr  string
+	}{
+		{name: "pinned signer", path: signed, expected: signer.Fingerprint()},
+		{name: "pinned signer with separators", path: signed, expected: formatted},
+		{name: "not pinned", path: signed},
+		{name: "other signer", path: signed, expected: other.Fingerprint(), wantErr: "but apps.yaml expects"},
+		{name: "unsigned and not pinned", path: unsigned},
+		{name: "unsigned and pinned", path: unsigned, expected: signer.Fingerprint(), wantErr: "no v2 or v3 signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySigner(slog.Default(), tt.path, tt.expected)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("got error %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got error %v, want one about %q", err, tt.wantErr)
+			}
+		})
+	}
+}
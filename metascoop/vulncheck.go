@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/nymtech/fdroid/metascoop/apps"
+	"github.com/nymtech/fdroid/metascoop/osv"
+	"github.com/nymtech/fdroid/metascoop/report"
+	"github.com/nymtech/fdroid/metascoop/retry"
+)
+
+// vulnerabilityCheck looks up the published versions of apps with an OSV package in the OSV database and records
+// the advisories that affect them in the report
+type vulnerabilityCheck struct {
+	client *osv.Client
+	report *report.Report
+
+	// knownVuln adds the "KnownVuln" anti-feature to affected versions
+	knownVuln bool
+}
+
+// newVulnerabilityCheck returns nil if url is empty, which turns the lookups off. A nil *vulnerabilityCheck finds
+// no advisories.
+func newVulnerabilityCheck(url string, knownVuln bool, policy retry.Policy, r *report.Report) *vulnerabilityCheck {
+	if url == "" {
+		return nil
+	}
+	return &vulnerabilityCheck{client: osv.NewClient(url, policy), report: r, knownVuln: knownVuln}
+}
+
+// antiFeatures looks up the version p of app and returns the anti-features its advisories add to it. Lookups that
+// fail are only logged, advisories are a hint for users and the APK was verified already.
+func (c *vulnerabilityCheck) antiFeatures(ctx context.Context, logger *slog.Logger, p apps.PackageInfo, app apps.AppInfo) (afs []string) {
+	if c == nil {
+		return
+	}
+	ecosystem, name, version, ok := app.OSVQuery(app.ReleaseTag, p.VersionName)
+	if !ok {
+		return
+	}
+
+	vulns, err := c.client.Query(ctx, osv.Package{Ecosystem: ecosystem, Name: name}, version)
+	if err != nil {
+		logger.Warn("Looking up known vulnerabilities failed", "version", p.VersionName, "error", err)
+		return
+	}
+	if len(vulns) == 0 {
+		return
+	}
+
+	var ids []string
+	for _, v := range vulns {
+		ids = append(ids, v.ID)
+		c.report.AddVulnerability(app.Name(), report.Vulnerability{Version: p.VersionName, ID: v.ID, Summary: v.Summary, Aliases: v.Aliases})
+	}
+	logger.Warn("Version has known vulnerabilities", "version", p.VersionName, "advisories", strings.Join(ids, ","))
+
+	if c.knownVuln {
+		afs = []string{"KnownVuln"}
+	}
+	return
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+
+	"github.com/nymtech/fdroid/metascoop/site"
+)
+
+// writeSite generates the website of the repo
+func writeSite(repoDir, templateDir, fingerprint string) (err error) {
+	err = site.Generate(site.Options{
+		RepoDir:     repoDir,
+		MetadataDir: filepath.Join(filepath.Dir(repoDir), "metadata"),
+		TemplateDir: templateDir,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return
+	}
+
+	slog.Info("Generated website", "path", filepath.Join(repoDir, "index.html"))
+	return
+}
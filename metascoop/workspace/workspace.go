@@ -0,0 +1,86 @@
+package workspace
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Workspace is a directory for all temporary files of a run. It becomes the temporary directory of the
+// process, so everything that creates temporary files (os.MkdirTemp, git, fdroidserver) puts them there
+// and they can be removed together, even if whoever created them never does.
+type Workspace struct {
+	dir  string
+	keep bool
+
+	once sync.Once
+}
+
+// New creates a workspace in the system's temporary directory. If keep is set, Cleanup leaves it in place for debugging.
+func New(keep bool) (w *Workspace, err error) {
+	dir, err := os.MkdirTemp("", "metascoop-*")
+	if err != nil {
+		return
+	}
+
+	// TMPDIR is used on Unix, TMP and TEMP on Windows
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		err = os.Setenv(name, dir)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+
+	return &Workspace{dir: dir, keep: keep}, nil
+}
+
+// Dir returns the path of the workspace
+func (w *Workspace) Dir() string {
+	return w.dir
+}
+
+// MkdirTemp creates a new directory in the workspace, see os.MkdirTemp
+func (w *Workspace) MkdirTemp(pattern string) (string, error) {
+	return os.MkdirTemp(w.dir, pattern)
+}
+
+// Cleanup removes the workspace with everything in it. It is safe to call it more than once.
+func (w *Workspace) Cleanup() {
+	w.once.Do(func() {
+		if w.keep {
+			slog.Info("Keeping temporary files", "dir", w.dir)
+			return
+		}
+
+		err := os.RemoveAll(w.dir)
+		if err != nil {
+			slog.Error("Removing temporary files failed", "dir", w.dir, "error", err)
+		}
+	})
+}
+
+// CancelOnSignal returns a context that is cancelled when the process is interrupted or terminated, so the run
+// can stop cleanly. A second signal removes the workspace and exits with code 1 right away.
+func (w *Workspace) CancelOnSignal(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		slog.Warn("Received signal, stopping the run. Send it again to exit right away", "signal", sig.String())
+		cancel()
+
+		sig = <-signals
+		slog.Warn("Received signal again, removing temporary files", "signal", sig.String())
+		w.Cleanup()
+		os.Exit(1)
+	}()
+
+	return ctx
+}
@@ -5,7 +5,9 @@ echo "::group::Building metascoop executable"
 go build -o metascoop
 echo "::endgroup::"
 
-./metascoop -ap=../apps.yaml -rd=../fdroid/repo -pat="$GH_ACCESS_TOKEN" $1
+COMMIT_MESSAGE_FILE=$(mktemp)
+
+./metascoop -ap=../apps.yaml -rd=../fdroid/repo -pat="$GH_ACCESS_TOKEN" -commit-message="$COMMIT_MESSAGE_FILE" $1
 EXIT_CODE=$?
 cd ..
 
@@ -22,12 +24,10 @@ elif [ $EXIT_CODE -eq 0 ]; then
 
     echo "This means that we now have changes we should push"
 
-    git config --global user.name 'github-actions'
-    git config --global user.email '41898282+github-actions[bot]@users.noreply.github.com'
-
-    git add .
-    git commit -m"Automated update"
-    git push
+    # Identity and signing can be configured with e.g. METASCOOP_PUBLISH_FLAGS="-sign=ssh -git-email=bot@example.org"
+    # and the private key in $METASCOOP_SIGNING_KEY. "-pull-request" opens a pull request for review instead of pushing.
+    # "-mirrors-config=mirrors.yaml" copies the repo to S3 buckets or rsync targets after pushing.
+    ./metascoop/metascoop publish -C=. -message-file="$COMMIT_MESSAGE_FILE" $METASCOOP_PUBLISH_FLAGS
 else 
     echo "This is an unexpected error"
 